@@ -62,4 +62,6 @@ type RequestHandler interface{
 type Response struct {
 	StatusCode int
 	Body []byte
+	// additional headers of the response, e.g., Content-Disposition of downloads
+	Header map[string]string
 }
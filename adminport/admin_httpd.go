@@ -42,6 +42,7 @@ import (
 	"github.com/couchbase/goxdcr/log"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 )
 import _ "expvar"
@@ -143,6 +144,11 @@ func (s *httpServer) systemHandler(w http.ResponseWriter, r *http.Request) {
 	case *Response:
 		logger_server.Debugf("Response from goxdcr rest server. status=%v\n body in string form=%v", v.StatusCode, string(v.Body))
 		w.Header().Set(base.ContentType, base.JsonContentType)
+		for key, value := range v.Header {
+			w.Header().Set(key, value)
+		}
+		// so that clients, including the xdcr processes on other nodes, can read large bodies, which are not chunked
+		w.Header().Set("Content-Length", strconv.Itoa(len(v.Body)))
 		w.WriteHeader(v.StatusCode)
 		w.Write(v.Body)
 	}
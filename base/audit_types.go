@@ -39,7 +39,9 @@ type RemoteClusterRefEvent struct {
 
 type CreateReplicationEvent struct {
 	GenericReplicationEvent
-	FilterExpression string `json:"filter_expression,omitempty"`
+	FilterExpression     string `json:"filter_expression,omitempty"`
+	FilterBodyExpression string `json:"filter_body_expression,omitempty"`
+	KeyRewriteRules      string `json:"key_rewrite_rules,omitempty"`
 }
 
 type UpdateDefaultReplicationSettingsEvent struct {
@@ -0,0 +1,302 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/couchbase/goxdcr/log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// names of built-in conflict resolvers
+const (
+	// the resolver used by goxdcr all along, which compares cas or revSeq depending on conflict resolution mode
+	ConflictResolverDefault = "default"
+	// source document always wins, i.e., docs are sent without looking at the target
+	ConflictResolverSourceWins = "source_wins"
+	// target document always wins, i.e., docs that already exist on target are never sent
+	ConflictResolverTargetWins = "target_wins"
+	// the document with the highest value of a json field wins, e.g., "json_field_max:updated_at"
+	ConflictResolverJsonFieldMax = "json_field_max"
+)
+
+// separates the name of a conflict resolver from its argument in conflict resolver specs
+const ConflictResolverArgSeparator = ":"
+
+// metadata, and optionally body, of a document on source or target that is used in conflict resolution
+type DocumentMetadata struct {
+	Key      []byte
+	RevSeq   uint64 //Item revision seqno
+	Cas      uint64 //Item cas
+	Flags    uint32 // Item flags
+	Expiry   uint32 // Item expiration time
+	Deletion bool
+	CRMode   ConflictResolutionMode // conflict resolution mode
+	// body of the document. populated for target documents only when the resolver NeedsBody,
+	// and empty for deletions
+	Body []byte
+}
+
+func (doc_meta DocumentMetadata) String() string {
+	return fmt.Sprintf("[key=%s; revSeq=%v;cas=%v;flags=%v;expiry=%v;deletion=%v;crMode=%v]", doc_meta.Key, doc_meta.RevSeq, doc_meta.Cas, doc_meta.Flags, doc_meta.Expiry, doc_meta.Deletion, doc_meta.CRMode)
+}
+
+// returns true if doc_metadata_source wins, i.e., the source document needs to be sent to target; false otherwise.
+// note that target still applies its own conflict resolution to the documents that are sent, unless the resolver
+// OverridesTarget
+type ConflictResolver func(doc_metadata_source DocumentMetadata, doc_metadata_target DocumentMetadata, source_cr_mode ConflictResolutionMode, logger *log.CommonLogger) bool
+
+// creates a conflict resolver from the argument in its spec, e.g., "updated_at" in "json_field_max:updated_at".
+// arg is empty when the spec has no argument
+type ConflictResolverConstructor func(arg string) (ConflictResolver, error)
+
+// definition of a named conflict resolver in the registry
+type ConflictResolverDef struct {
+	Constructor ConflictResolverConstructor
+	// whether the resolver needs the bodies of target documents, which are then fetched from target together with their metadata
+	NeedsBody bool
+	// whether the resolver needs to be applied to all documents.
+	// when false, documents below optimistic replication threshold are sent without conflict resolution
+	AllDocs bool
+	// whether the documents that the resolver picks overwrite the ones on target, i.e., they are sent
+	// with SkipConflictResolutionFlag so that target does not apply its own conflict resolution to them
+	OverridesTarget bool
+}
+
+var conflictResolverRegistry = make(map[string]*ConflictResolverDef)
+var conflictResolverRegistryLock sync.RWMutex
+
+func init() {
+	RegisterConflictResolver(ConflictResolverDefault, &ConflictResolverDef{Constructor: noArgConflictResolver(ConflictResolverDefault, resolveConflict)})
+	RegisterConflictResolver(ConflictResolverSourceWins, &ConflictResolverDef{Constructor: noArgConflictResolver(ConflictResolverSourceWins, resolveConflictSourceWins), OverridesTarget: true})
+	RegisterConflictResolver(ConflictResolverTargetWins, &ConflictResolverDef{Constructor: noArgConflictResolver(ConflictResolverTargetWins, resolveConflictTargetWins), AllDocs: true})
+	RegisterConflictResolver(ConflictResolverJsonFieldMax, &ConflictResolverDef{Constructor: newJsonFieldMaxConflictResolver, NeedsBody: true, AllDocs: true, OverridesTarget: true})
+}
+
+// registers a named conflict resolver, which can then be selected by the conflict_resolver replication setting.
+// custom resolvers need to be registered before replications that use them are created, e.g., in init()
+func RegisterConflictResolver(name string, def *ConflictResolverDef) error {
+	if name == "" || strings.Contains(name, ConflictResolverArgSeparator) {
+		return fmt.Errorf("invalid conflict resolver name %v", name)
+	}
+	if def == nil || def.Constructor == nil {
+		return fmt.Errorf("conflict resolver %v does not have a constructor", name)
+	}
+
+	conflictResolverRegistryLock.Lock()
+	defer conflictResolverRegistryLock.Unlock()
+	if _, ok := conflictResolverRegistry[name]; ok {
+		return fmt.Errorf("conflict resolver %v has already been registered", name)
+	}
+	conflictResolverRegistry[name] = def
+	return nil
+}
+
+// returns the names of registered conflict resolvers in sorted order
+func ConflictResolverNames() []string {
+	conflictResolverRegistryLock.RLock()
+	defer conflictResolverRegistryLock.RUnlock()
+	names := make([]string, 0, len(conflictResolverRegistry))
+	for name := range conflictResolverRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// creates the conflict resolver for spec, which is the name of a registered resolver optionally followed by ":" and an argument.
+// an empty spec selects the default resolver
+func NewConflictResolver(spec string) (ConflictResolver, *ConflictResolverDef, error) {
+	if spec == "" {
+		spec = ConflictResolverDefault
+	}
+	name, arg := spec, ""
+	if index := strings.Index(spec, ConflictResolverArgSeparator); index >= 0 {
+		name, arg = spec[:index], spec[index+1:]
+	}
+
+	conflictResolverRegistryLock.RLock()
+	def, ok := conflictResolverRegistry[name]
+	conflictResolverRegistryLock.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown conflict resolver %v. registered resolvers are %v", name, ConflictResolverNames())
+	}
+
+	resolver, err := def.Constructor(arg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid conflict resolver %v. err=%v", spec, err)
+	}
+	return resolver, def, nil
+}
+
+// checks that spec selects a registered conflict resolver with a valid argument
+func ValidateConflictResolver(spec string) error {
+	_, _, err := NewConflictResolver(spec)
+	return err
+}
+
+func noArgConflictResolver(name string, resolver ConflictResolver) ConflictResolverConstructor {
+	return func(arg string) (ConflictResolver, error) {
+		if arg != "" {
+			return nil, fmt.Errorf("conflict resolver %v does not take an argument", name)
+		}
+		return resolver, nil
+	}
+}
+
+// return true if doc_meta_source win; false otherwise
+func resolveConflict(doc_meta_source DocumentMetadata,
+	doc_meta_target DocumentMetadata, source_cr_mode ConflictResolutionMode, logger *log.CommonLogger) bool {
+	if source_cr_mode == CRMode_LWW && doc_meta_source.CRMode == CRMode_LWW && doc_meta_target.CRMode == CRMode_LWW {
+		return resolveConflictByCAS(doc_meta_source, doc_meta_target, logger)
+	} else {
+		return resolveConflictByRevSeq(doc_meta_source, doc_meta_target, logger)
+	}
+}
+
+func resolveConflictByCAS(doc_meta_source DocumentMetadata,
+	doc_meta_target DocumentMetadata, logger *log.CommonLogger) bool {
+	ret := true
+	if doc_meta_target.Cas > doc_meta_source.Cas {
+		ret = false
+	} else if doc_meta_target.Cas == doc_meta_source.Cas {
+		if doc_meta_target.RevSeq > doc_meta_source.RevSeq {
+			ret = false
+		} else if doc_meta_target.RevSeq == doc_meta_source.RevSeq {
+			//if the outgoing mutation is deletion and its revSeq and cas are the
+			//same as the target side document, it would lose the conflict resolution
+			if doc_meta_source.Deletion || (doc_meta_target.Expiry > doc_meta_source.Expiry) {
+				ret = false
+			} else if doc_meta_target.Expiry == doc_meta_source.Expiry {
+				if doc_meta_target.Flags >= doc_meta_source.Flags {
+					ret = false
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func resolveConflictByRevSeq(doc_meta_source DocumentMetadata,
+	doc_meta_target DocumentMetadata, logger *log.CommonLogger) bool {
+	ret := true
+	if doc_meta_target.RevSeq > doc_meta_source.RevSeq {
+		ret = false
+	} else if doc_meta_target.RevSeq == doc_meta_source.RevSeq {
+		if doc_meta_target.Cas > doc_meta_source.Cas {
+			ret = false
+		} else if doc_meta_target.Cas == doc_meta_source.Cas {
+			//if the outgoing mutation is deletion and its revSeq and cas are the
+			//same as the target side document, it would lose the conflict resolution
+			if doc_meta_source.Deletion || (doc_meta_target.Expiry > doc_meta_source.Expiry) {
+				ret = false
+			} else if doc_meta_target.Expiry == doc_meta_source.Expiry {
+				if doc_meta_target.Flags >= doc_meta_source.Flags {
+					ret = false
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func resolveConflictSourceWins(doc_meta_source DocumentMetadata,
+	doc_meta_target DocumentMetadata, source_cr_mode ConflictResolutionMode, logger *log.CommonLogger) bool {
+	return true
+}
+
+// the resolver is called only when the document exists on target. a document that has been deleted on target
+// does not count as existing, so that deleted documents can be recreated
+func resolveConflictTargetWins(doc_meta_source DocumentMetadata,
+	doc_meta_target DocumentMetadata, source_cr_mode ConflictResolutionMode, logger *log.CommonLogger) bool {
+	return doc_meta_target.Deletion
+}
+
+// the document with the higher value of the json field at path wins. numbers are compared numerically and strings lexically.
+// a document that has the field wins over one that does not. the default resolver decides when the values are equal,
+// when neither document has the field, or when the values are not comparable
+func newJsonFieldMaxConflictResolver(path string) (ConflictResolver, error) {
+	if path == "" {
+		return nil, errors.New("path of json field is missing")
+	}
+	fields := strings.Split(path, ".")
+	for _, field := range fields {
+		if field == "" {
+			return nil, fmt.Errorf("path of json field %v is invalid", path)
+		}
+	}
+
+	return func(doc_meta_source DocumentMetadata, doc_meta_target DocumentMetadata, source_cr_mode ConflictResolutionMode, logger *log.CommonLogger) bool {
+		source_val, source_ok := jsonFieldValue(doc_meta_source, fields)
+		target_val, target_ok := jsonFieldValue(doc_meta_target, fields)
+		if source_ok && !target_ok {
+			return true
+		} else if !source_ok && target_ok {
+			return false
+		} else if source_ok && target_ok {
+			if cmp, ok := compareJsonValues(source_val, target_val); ok && cmp != 0 {
+				return cmp > 0
+			}
+		}
+		return resolveConflict(doc_meta_source, doc_meta_target, source_cr_mode, logger)
+	}, nil
+}
+
+// returns the value of the json field at path in the body of the document, and whether the field exists
+func jsonFieldValue(doc_meta DocumentMetadata, fields []string) (interface{}, bool) {
+	if doc_meta.Deletion || len(doc_meta.Body) == 0 {
+		return nil, false
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(doc_meta.Body, &value); err != nil {
+		return nil, false
+	}
+	for _, field := range fields {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = obj[field]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, value != nil
+}
+
+// returns 1, 0, or -1 when val1 is greater than, equal to, or less than val2. the second return value is false
+// when the two values are not of the same comparable type
+func compareJsonValues(val1, val2 interface{}) (int, bool) {
+	switch v1 := val1.(type) {
+	case float64:
+		v2, ok := val2.(float64)
+		if !ok {
+			return 0, false
+		}
+		if v1 > v2 {
+			return 1, true
+		} else if v1 < v2 {
+			return -1, true
+		}
+		return 0, true
+	case string:
+		v2, ok := val2.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(v1, v2), true
+	}
+	return 0, false
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"github.com/couchbase/goxdcr/log"
+	"testing"
+)
+
+var testLogger = log.NewLogger("ConflictResolverTest", log.DefaultLoggerContext)
+
+func newTestResolver(t *testing.T, spec string) (ConflictResolver, *ConflictResolverDef) {
+	resolver, def, err := NewConflictResolver(spec)
+	if err != nil {
+		t.Fatalf("failed to create conflict resolver %v. err=%v", spec, err)
+	}
+	return resolver, def
+}
+
+func TestDefaultConflictResolver(t *testing.T) {
+	resolver, def := newTestResolver(t, "")
+	if def.NeedsBody || def.AllDocs {
+		t.Errorf("default resolver should not need bodies or all docs")
+	}
+
+	source := DocumentMetadata{Key: []byte("key"), RevSeq: 2, Cas: 100, CRMode: CRMode_RevId}
+	target := DocumentMetadata{Key: []byte("key"), RevSeq: 1, Cas: 200, CRMode: CRMode_RevId}
+	if !resolver(source, target, CRMode_RevId, testLogger) {
+		t.Errorf("source with higher revSeq should win in revId mode")
+	}
+
+	source.CRMode, target.CRMode = CRMode_LWW, CRMode_LWW
+	if resolver(source, target, CRMode_LWW, testLogger) {
+		t.Errorf("target with higher cas should win in lww mode")
+	}
+
+	// a deletion with the same metadata as the target document loses
+	target = source
+	source.Deletion = true
+	if resolver(source, target, CRMode_LWW, testLogger) {
+		t.Errorf("deletion with same metadata as target should lose")
+	}
+}
+
+func TestSourceAndTargetWinsConflictResolvers(t *testing.T) {
+	source := DocumentMetadata{RevSeq: 1, Cas: 100}
+	target := DocumentMetadata{RevSeq: 5, Cas: 500}
+
+	sourceWins, _ := newTestResolver(t, ConflictResolverSourceWins)
+	if !sourceWins(source, target, CRMode_RevId, testLogger) {
+		t.Errorf("source should always win")
+	}
+
+	targetWins, def := newTestResolver(t, ConflictResolverTargetWins)
+	if !def.AllDocs {
+		t.Errorf("target_wins resolver should apply to all docs")
+	}
+	if targetWins(target, source, CRMode_RevId, testLogger) {
+		t.Errorf("target should always win")
+	}
+	target.Deletion = true
+	if !targetWins(source, target, CRMode_RevId, testLogger) {
+		t.Errorf("source should win over a document that has been deleted on target")
+	}
+}
+
+func TestJsonFieldMaxConflictResolver(t *testing.T) {
+	resolver, def := newTestResolver(t, "json_field_max:meta.version")
+	if !def.NeedsBody {
+		t.Errorf("json_field_max resolver should need document bodies")
+	}
+
+	// source has lower revSeq but higher field value
+	source := DocumentMetadata{RevSeq: 1, Body: []byte(`{"meta":{"version":10}}`)}
+	target := DocumentMetadata{RevSeq: 2, Body: []byte(`{"meta":{"version":9}}`)}
+	if !resolver(source, target, CRMode_RevId, testLogger) {
+		t.Errorf("source with higher field value should win")
+	}
+	if resolver(target, source, CRMode_RevId, testLogger) {
+		t.Errorf("source with lower field value should lose")
+	}
+
+	// string values are compared lexically
+	source.Body = []byte(`{"meta":{"version":"2017-01-02"}}`)
+	target.Body = []byte(`{"meta":{"version":"2017-01-01"}}`)
+	if !resolver(source, target, CRMode_RevId, testLogger) {
+		t.Errorf("source with higher string field value should win")
+	}
+
+	// a document with the field wins over one without it
+	target.Body = []byte(`{"meta":{}}`)
+	if !resolver(source, target, CRMode_RevId, testLogger) {
+		t.Errorf("source with the field should win over target without it")
+	}
+	target.Body = nil
+	if !resolver(source, target, CRMode_RevId, testLogger) {
+		t.Errorf("source with the field should win over target without body")
+	}
+
+	// default resolver decides when values are equal or not comparable
+	source.Body = []byte(`{"meta":{"version":1}}`)
+	target.Body = []byte(`{"meta":{"version":1}}`)
+	if resolver(source, target, CRMode_RevId, testLogger) {
+		t.Errorf("target with higher revSeq should win when field values are equal")
+	}
+	target.Body = []byte(`{"meta":{"version":"1"}}`)
+	if resolver(source, target, CRMode_RevId, testLogger) {
+		t.Errorf("target with higher revSeq should win when field values are not comparable")
+	}
+}
+
+func TestInvalidConflictResolverSpecs(t *testing.T) {
+	for _, spec := range []string{"unknown", "default:arg", "json_field_max", "json_field_max:", "json_field_max:a..b"} {
+		if err := ValidateConflictResolver(spec); err == nil {
+			t.Errorf("spec %v should be invalid", spec)
+		}
+	}
+}
+
+func TestRegisterCustomConflictResolver(t *testing.T) {
+	// source wins when its key has the prefix in the argument
+	constructor := func(arg string) (ConflictResolver, error) {
+		prefix := []byte(arg)
+		return func(source DocumentMetadata, target DocumentMetadata, source_cr_mode ConflictResolutionMode, logger *log.CommonLogger) bool {
+			return bytes.HasPrefix(source.Key, prefix)
+		}, nil
+	}
+
+	err := RegisterConflictResolver("test_key_prefix", &ConflictResolverDef{Constructor: constructor})
+	if err != nil {
+		t.Fatalf("failed to register conflict resolver. err=%v", err)
+	}
+	if err = RegisterConflictResolver("test_key_prefix", &ConflictResolverDef{Constructor: constructor}); err == nil {
+		t.Errorf("registering a resolver twice should fail")
+	}
+	if err = RegisterConflictResolver("test:invalid", &ConflictResolverDef{Constructor: constructor}); err == nil {
+		t.Errorf("registering a resolver with separator in name should fail")
+	}
+
+	resolver, _ := newTestResolver(t, "test_key_prefix:abc")
+	if !resolver(DocumentMetadata{Key: []byte("abc1")}, DocumentMetadata{}, CRMode_RevId, testLogger) {
+		t.Errorf("custom resolver should let source win")
+	}
+	if resolver(DocumentMetadata{Key: []byte("xyz1")}, DocumentMetadata{}, CRMode_RevId, testLogger) {
+		t.Errorf("custom resolver should let target win")
+	}
+}
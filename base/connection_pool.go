@@ -42,8 +42,15 @@ const (
 	SSLOverMem   ConnType = iota
 )
 
+// Dialer establishes the network connections of xdcr.
+// it can be replaced, e.g., by FaultInjector to simulate network failures
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
 var (
-	dialer *net.Dialer = &net.Dialer{Timeout: ShortHttpTimeout}
+	dialer      Dialer = &net.Dialer{Timeout: ShortHttpTimeout}
+	dialer_lock sync.RWMutex
 )
 
 func (connType ConnType) String() string {
@@ -625,6 +632,17 @@ func (connPoolMgr *connPoolMgr) FindPoolNamesByPrefix(poolNamePrefix string) []s
 	return poolNames
 }
 
+// returns all the connection pools
+func (connPoolMgr *connPoolMgr) Pools() []ConnPool {
+	connPoolMgr.map_lock.RLock()
+	defer connPoolMgr.map_lock.RUnlock()
+	pools := make([]ConnPool, 0, len(connPoolMgr.conn_pools_map))
+	for _, pool := range connPoolMgr.conn_pools_map {
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
 func (connPoolMgr *connPoolMgr) SetStaleForPoolsWithNamePrefix(poolNamePrefix string) {
 	connPoolMgr.map_lock.RLock()
 	defer connPoolMgr.map_lock.RUnlock()
@@ -732,13 +750,35 @@ func (connPoolMgr *connPoolMgr) Close() {
 	connPoolMgr.conn_pools_map = make(map[string]ConnPool)
 }
 
+// returns the dialer used by NewConn, MakeTLSConn, NewTCPConn and DialTCPWithTimeout
+func GetDialer() Dialer {
+	dialer_lock.RLock()
+	defer dialer_lock.RUnlock()
+	return dialer
+}
+
+// replaces the dialer used by NewConn, MakeTLSConn, NewTCPConn and DialTCPWithTimeout. returns the previous dialer
+// the new dialer applies to new connections only
+func SetDialer(new_dialer Dialer) Dialer {
+	dialer_lock.Lock()
+	defer dialer_lock.Unlock()
+	old_dialer := dialer
+	dialer = new_dialer
+	return old_dialer
+}
+
 func NewConn(hostName string, username string, password string) (conn *mcc.Client, err error) {
 	// connect to host
 	start_time := time.Now()
-	conn, err = mcc.Connect("tcp", hostName)
+	net_conn, err := DialTCPWithTimeout("tcp", hostName)
 	if err != nil {
 		return nil, err
 	}
+	conn, err = mcc.Wrap(net_conn)
+	if err != nil {
+		net_conn.Close()
+		return nil, err
+	}
 
 	ConnPoolMgr().logger.Debugf("%vs spent on establish a connection to %v", time.Since(start_time).Seconds(), hostName)
 
@@ -778,18 +818,23 @@ func MakeTLSConn(ssl_con_str string, certificate []byte, check_server_name bool,
 	tlsConfig.InsecureSkipVerify = true
 
 	// Connect to tls
-	conn, err := tls.DialWithDialer(dialer, "tcp", ssl_con_str, tlsConfig)
+	raw_conn, err := DialTCPWithTimeout("tcp", ssl_con_str)
 
 	if err != nil {
 		logger.Errorf("Failed to connect to %v, err=%v\n", ssl_con_str, err)
 		return nil, nil, err
 	}
+	conn := tls.Client(raw_conn, tlsConfig)
 
 	// Handshake with TLS to get cert
+	// the handshake is bound by the dial timeout
+	conn.SetDeadline(time.Now().Add(ShortHttpTimeout))
 	err = conn.Handshake()
+	conn.SetDeadline(time.Time{})
 
 	if err != nil {
 		logger.Errorf("TLS handshake failed when connecting to %v, err=%v\n", ssl_con_str, err)
+		conn.Close()
 		return nil, nil, err
 	}
 
@@ -828,5 +873,5 @@ func MakeTLSConn(ssl_con_str string, certificate []byte, check_server_name bool,
 }
 
 func DialTCPWithTimeout(network, address string) (net.Conn, error) {
-	return dialer.Dial(network, address)
+	return GetDialer().Dial(network, address)
 }
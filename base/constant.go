@@ -95,8 +95,10 @@ var ShortHttpTimeout = 20 * time.Second
 type XDCROutgoingNozzleType int
 
 const (
-	Xmem XDCROutgoingNozzleType = iota
-	Capi XDCROutgoingNozzleType = iota
+	Xmem    XDCROutgoingNozzleType = iota
+	Capi    XDCROutgoingNozzleType = iota
+	File    XDCROutgoingNozzleType = iota
+	Webhook XDCROutgoingNozzleType = iota
 )
 
 const (
@@ -104,6 +106,7 @@ const (
 	CHECKPOINT_MGR_SVC         string = "CheckpointManager"
 	STATISTICS_MGR_SVC         string = "StatisticsManager"
 	TOPOLOGY_CHANGE_DETECT_SVC string = "TopologyChangeDetectSvc"
+	CONFLICT_LOGGER_SVC        string = "ConflictLogger"
 )
 
 // supervisor related constants
@@ -175,6 +178,8 @@ const (
 	ContentType        = "Content-Type"
 	DefaultContentType = "application/x-www-form-urlencoded"
 	JsonContentType    = "application/json"
+	TextContentType    = "text/plain"
+	ContentDisposition = "Content-Disposition"
 	ContentLength      = "Content-Length"
 )
 
@@ -189,6 +194,7 @@ const (
 	//Bucket sequence number statistics
 	VBUCKET_SEQNO_STAT_NAME            = "vbucket-seqno"
 	VBUCKET_HIGH_SEQNO_STAT_KEY_FORMAT = "vb_%v:high_seqno"
+	VBUCKET_UUID_STAT_KEY_FORMAT       = "vb_%v:uuid"
 	DCP_STAT_NAME                      = "dcp"
 	DCP_XDCR_STATS_PREFIX              = "eq_dcpq:xdcr:"
 	DCP_XDCR_ITEMS_REMAINING_SUFFIX    = ":items_remaining"
@@ -215,6 +221,8 @@ var XDCR_EXPVAR_ROOT = "XDCR_Replications"
 const (
 	RemoteClustersForReplicationDoc = "remoteClusters"
 	BucketsPath                     = "buckets"
+	FilesForReplicationDoc          = "files"
+	WebhooksForReplicationDoc       = "webhooks"
 
 	ReplicationDocType                 = "type"
 	ReplicationDocId                   = "id"
@@ -224,8 +232,10 @@ const (
 	ReplicationDocPauseRequested       = "pause_requested"
 	ReplicationDocPauseRequestedOutput = "pauseRequested"
 
-	ReplicationDocTypeXmem = "xdc-xmem"
-	ReplicationDocTypeCapi = "xdc"
+	ReplicationDocTypeXmem    = "xdc-xmem"
+	ReplicationDocTypeCapi    = "xdc"
+	ReplicationDocTypeFile    = "xdc-file"
+	ReplicationDocTypeWebhook = "xdc-webhook"
 )
 
 // constant used in replication info to ensure compatibility with erlang xdcr
@@ -240,6 +250,25 @@ const (
 	SET_TIME_SYNC    = mc.CommandCode(0xc1)
 )
 
+// options of SET_WITH_META and DELETE_WITH_META, which are placed in extras after cas
+const (
+	// target applies the document without conflict resolution
+	SkipConflictResolutionFlag = 0x08
+)
+
+// features negotiated through HELO and the corresponding data type bits
+const (
+	HELOFeatureDatatype = 0x01
+	HELOFeatureSnappy   = 0x0a
+	SnappyDataType      = 0x02
+)
+
+// the name that xdcr identifies itself with in HELO requests
+var HELOAgentName = "goxdcr"
+
+// bodies smaller than this (in bytes) are not compressed since the saving would not be worth the cost
+var CompressionThreshold = 128
+
 const (
 	PipelineSetting_RequestPool     = "RequestPool"
 	DefaultRequestPoolSize          = 10000
@@ -255,12 +284,14 @@ var MaxNumberOfAsyncListeners = 4
 
 // names of async component event listeners
 const (
-	DataReceivedEventListener    = "DataReceivedEventListener"
-	DataProcessedEventListener   = "DataProcessedEventListener"
-	DataFilteredEventListener    = "DataFilteredEventListener"
-	DataSentEventListener        = "DataSentEventListener"
-	DataFailedCREventListener    = "DataFailedCREventListener"
-	GetMetaReceivedEventListener = "GetMetaReceivedEventListener"
+	DataReceivedEventListener     = "DataReceivedEventListener"
+	DataProcessedEventListener    = "DataProcessedEventListener"
+	DataFilteredEventListener     = "DataFilteredEventListener"
+	DataSentEventListener         = "DataSentEventListener"
+	DataFailedCREventListener     = "DataFailedCREventListener"
+	GetMetaReceivedEventListener  = "GetMetaReceivedEventListener"
+	DataDedupedEventListener      = "DataDedupedEventListener"
+	DataDeadLetteredEventListener = "DataDeadLetteredEventListener"
 )
 
 const (
@@ -330,6 +361,13 @@ var MaxWorkersForCheckpointing = 5
 // timeout for checkpointing attempt due to topology changes - to put an upper bound on the delay of pipeline restartx
 var TopologyChangeCheckpointTimeout = 10 * time.Minute
 
+// directory owned by xdcr on this node. files that replications read or write, e.g., dcp recordings,
+// can only be in directories under it. it is set at startup. when it is empty, such files are not allowed
+var XDCRDataDir = ""
+
+// directory of xdcr logs on this node. it is set at startup. conflict logs can only be written into directories under it
+var XDCRLogDir = ""
+
 func InitConstants(topologyChangeCheckInterval time.Duration, maxTopologyChangeCountBeforeRestart,
 	maxTopologyStableCountBeforeRestart, maxWorkersForCheckpointing int, topologyChangeCheckpointTimeout time.Duration) {
 	TopologyChangeCheckInterval = topologyChangeCheckInterval
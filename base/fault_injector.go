@@ -0,0 +1,300 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the cause of the errors returned by connections cut by fault injection. like the errors of real connections,
+// the errors returned are *net.OpError
+var FaultInjectedError = errors.New("connection has been cut by fault injection")
+
+// FaultRule describes the network faults to inject into the connections to a target host
+type FaultRule struct {
+	// unique name of the rule
+	Name string `json:"name"`
+	// host, or host:port, of the connections that the rule applies to. the rule applies to all connections when empty
+	Host string `json:"host"`
+	// probability, in [0, 1], that a new connection is subject to the rule
+	Probability float64 `json:"probability"`
+	// delay of each read and write on the connection
+	Latency time.Duration `json:"latency"`
+	// the connection is cut once this many bytes have been read from and written to it. 0 means never.
+	// the write that crosses the limit is a partial write
+	DropAfterBytes int64 `json:"dropAfterBytes"`
+	// when the connection is cut, shut down its write side only and leave it half closed, so that
+	// the peer sees EOF while reads are still served
+	HalfClose bool `json:"halfClose"`
+}
+
+func (rule *FaultRule) Validate() error {
+	if rule.Name == "" {
+		return errors.New("name of fault rule cannot be empty")
+	}
+	if rule.Probability < 0 || rule.Probability > 1 {
+		return fmt.Errorf("probability of fault rule %v needs to be in [0, 1]", rule.Name)
+	}
+	if rule.Latency < 0 {
+		return fmt.Errorf("latency of fault rule %v cannot be negative", rule.Name)
+	}
+	if rule.DropAfterBytes < 0 {
+		return fmt.Errorf("dropAfterBytes of fault rule %v cannot be negative", rule.Name)
+	}
+	return nil
+}
+
+func (rule *FaultRule) matches(address string) bool {
+	if rule.Host == "" || rule.Host == address {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	return err == nil && host == rule.Host
+}
+
+type faultRule struct {
+	FaultRule
+	// set when the rule is removed, which stops the injection into the connections established under the rule
+	removed int32
+}
+
+func (rule *faultRule) active() bool {
+	return atomic.LoadInt32(&rule.removed) == 0
+}
+
+// FaultInjector is a Dialer that injects network faults into the connections established by another Dialer,
+// as specified by a set of rules. rules can be added and removed at any time
+type FaultInjector struct {
+	dialer Dialer
+	rules  map[string]*faultRule
+	lock   sync.RWMutex
+}
+
+func NewFaultInjector(dialer Dialer) *FaultInjector {
+	return &FaultInjector{
+		dialer: dialer,
+		rules:  make(map[string]*faultRule),
+	}
+}
+
+// returns the FaultInjector installed by SetDialer, or nil if fault injection is not enabled
+func CurrentFaultInjector() *FaultInjector {
+	fault_injector, _ := GetDialer().(*FaultInjector)
+	return fault_injector
+}
+
+func (injector *FaultInjector) Dial(network, address string) (net.Conn, error) {
+	conn, err := injector.dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	injector.lock.RLock()
+	defer injector.lock.RUnlock()
+	rules := make([]*faultRule, 0)
+	for _, rule := range injector.rules {
+		if rule.matches(address) && rand.Float64() < rule.Probability {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return conn, nil
+	}
+	return &faultConn{Conn: conn, rules: rules}, nil
+}
+
+// adds the rule, or replaces the existing rule with the same name.
+// the rule applies to the connections established after it is added
+func (injector *FaultInjector) AddRule(rule FaultRule) error {
+	err := rule.Validate()
+	if err != nil {
+		return err
+	}
+
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	if old_rule, ok := injector.rules[rule.Name]; ok {
+		atomic.StoreInt32(&old_rule.removed, 1)
+	}
+	injector.rules[rule.Name] = &faultRule{FaultRule: rule}
+	return nil
+}
+
+// removes the rule, which stops the injection into all the connections, existing or new.
+// returns false if the rule does not exist
+func (injector *FaultInjector) RemoveRule(name string) bool {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	rule, ok := injector.rules[name]
+	if ok {
+		atomic.StoreInt32(&rule.removed, 1)
+		delete(injector.rules, name)
+	}
+	return ok
+}
+
+func (injector *FaultInjector) ClearRules() {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	for name, rule := range injector.rules {
+		atomic.StoreInt32(&rule.removed, 1)
+		delete(injector.rules, name)
+	}
+}
+
+// returns the rules sorted by name
+func (injector *FaultInjector) Rules() []FaultRule {
+	injector.lock.RLock()
+	defer injector.lock.RUnlock()
+	rules := make([]FaultRule, 0, len(injector.rules))
+	for _, rule := range injector.rules {
+		rules = append(rules, rule.FaultRule)
+	}
+	sort.Sort(faultRulesByName(rules))
+	return rules
+}
+
+type faultRulesByName []FaultRule
+
+func (rules faultRulesByName) Len() int           { return len(rules) }
+func (rules faultRulesByName) Swap(i, j int)      { rules[i], rules[j] = rules[j], rules[i] }
+func (rules faultRulesByName) Less(i, j int) bool { return rules[i].Name < rules[j].Name }
+
+const (
+	faultConnOpen       = iota
+	faultConnHalfClosed = iota
+	faultConnClosed     = iota
+)
+
+// a connection that faults are injected into
+type faultConn struct {
+	net.Conn
+	rules []*faultRule
+	// number of bytes read from and written to the connection
+	transferred int64
+	state       int
+	lock        sync.Mutex
+}
+
+// sleeps for the longest latency of the active rules, and returns the number of bytes that can be
+// transferred before the connection is cut
+func (conn *faultConn) delay(size int) int {
+	var latency time.Duration
+	for _, rule := range conn.rules {
+		if rule.active() && rule.Latency > latency {
+			latency = rule.Latency
+		}
+	}
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	for _, rule := range conn.rules {
+		if rule.active() && rule.DropAfterBytes > 0 {
+			remaining := rule.DropAfterBytes - conn.transferred
+			if remaining < 0 {
+				remaining = 0
+			}
+			if remaining < int64(size) {
+				size = int(remaining)
+			}
+		}
+	}
+	return size
+}
+
+// records the bytes transferred, and cuts the connection when the limit of an active rule is reached
+func (conn *faultConn) record(size int) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.transferred += int64(size)
+	for _, rule := range conn.rules {
+		if rule.active() && rule.DropAfterBytes > 0 && conn.transferred >= rule.DropAfterBytes {
+			conn.cut(rule.HalfClose)
+			return
+		}
+	}
+}
+
+func (conn *faultConn) cut(half_close bool) {
+	if conn.state == faultConnClosed {
+		return
+	}
+	if half_close {
+		if closer, ok := conn.Conn.(interface {
+			CloseWrite() error
+		}); ok {
+			closer.CloseWrite()
+			conn.state = faultConnHalfClosed
+			return
+		}
+	}
+	conn.Conn.Close()
+	conn.state = faultConnClosed
+}
+
+func (conn *faultConn) getState() int {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.state
+}
+
+func (conn *faultConn) opError(op string) error {
+	return &net.OpError{Op: op, Net: "tcp", Source: conn.LocalAddr(), Addr: conn.RemoteAddr(), Err: FaultInjectedError}
+}
+
+func (conn *faultConn) Read(b []byte) (int, error) {
+	switch conn.getState() {
+	case faultConnHalfClosed:
+		// reads are not subject to faults once the write side is shut down
+		return conn.Conn.Read(b)
+	case faultConnClosed:
+		return 0, conn.opError("read")
+	}
+
+	size := conn.delay(len(b))
+	if size == 0 && len(b) > 0 {
+		conn.record(0)
+		return 0, conn.opError("read")
+	}
+	n, err := conn.Conn.Read(b[:size])
+	conn.record(n)
+	return n, err
+}
+
+func (conn *faultConn) Write(b []byte) (int, error) {
+	if conn.getState() != faultConnOpen {
+		return 0, conn.opError("write")
+	}
+
+	size := conn.delay(len(b))
+	n, err := conn.Conn.Write(b[:size])
+	conn.record(n)
+	if err == nil && n < len(b) {
+		err = conn.opError("write")
+	}
+	return n, err
+}
+
+func (conn *faultConn) Close() error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.state = faultConnClosed
+	return conn.Conn.Close()
+}
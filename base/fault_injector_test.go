@@ -0,0 +1,170 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// starts a server that echoes back what it reads on each connection, until the connection is half closed by client
+func startTestEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", LocalHostName+":0")
+	if err != nil {
+		t.Fatalf("failed to listen. err=%v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func dialTestEchoServer(t *testing.T, injector *FaultInjector, listener net.Listener) net.Conn {
+	conn, err := injector.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial. err=%v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func isFaultInjectedError(err error) bool {
+	op_err, ok := err.(*net.OpError)
+	return ok && op_err.Err == FaultInjectedError
+}
+
+func addTestFaultRule(t *testing.T, injector *FaultInjector, rule FaultRule) {
+	if err := injector.AddRule(rule); err != nil {
+		t.Fatalf("failed to add rule %v. err=%v", rule.Name, err)
+	}
+}
+
+func TestFaultInjectorDropAfterBytes(t *testing.T) {
+	listener := startTestEchoServer(t)
+	defer listener.Close()
+	injector := NewFaultInjector(&net.Dialer{Timeout: time.Second})
+	addTestFaultRule(t, injector, FaultRule{Name: "drop", Probability: 1, DropAfterBytes: 12})
+
+	conn := dialTestEchoServer(t, injector, listener)
+	defer conn.Close()
+	buf := make([]byte, 8)
+	if _, err := conn.Write([]byte("12345678")); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	if _, err := io.ReadFull(conn, buf); !isFaultInjectedError(err) {
+		t.Fatalf("expected read to be cut, got %v", err)
+	}
+	if n, err := conn.Write([]byte("9")); n != 0 || !isFaultInjectedError(err) {
+		t.Errorf("expected write on cut connection to fail, got %v %v", n, err)
+	}
+
+	// the write that crosses the limit is partial
+	conn = dialTestEchoServer(t, injector, listener)
+	defer conn.Close()
+	if n, err := conn.Write([]byte("1234567890abcdef")); n != 12 || !isFaultInjectedError(err) {
+		t.Errorf("expected partial write of 12 bytes, got %v %v", n, err)
+	}
+}
+
+func TestFaultInjectorHalfClose(t *testing.T) {
+	listener := startTestEchoServer(t)
+	defer listener.Close()
+	injector := NewFaultInjector(&net.Dialer{Timeout: time.Second})
+	addTestFaultRule(t, injector, FaultRule{Name: "half", Probability: 1, DropAfterBytes: 4, HalfClose: true})
+
+	conn := dialTestEchoServer(t, injector, listener)
+	defer conn.Close()
+	if n, err := conn.Write([]byte("12345678")); n != 4 || !isFaultInjectedError(err) {
+		t.Errorf("expected partial write of 4 bytes, got %v %v", n, err)
+	}
+	// reads are still served, and end when the server sees EOF and closes its side
+	echoed, err := ioutil.ReadAll(conn)
+	if err != nil || string(echoed) != "1234" {
+		t.Errorf("expected to read back 1234, got %s %v", echoed, err)
+	}
+}
+
+func TestFaultInjectorLatency(t *testing.T) {
+	listener := startTestEchoServer(t)
+	defer listener.Close()
+	injector := NewFaultInjector(&net.Dialer{Timeout: time.Second})
+	addTestFaultRule(t, injector, FaultRule{Name: "slow", Probability: 1, Latency: 50 * time.Millisecond})
+
+	conn := dialTestEchoServer(t, injector, listener)
+	defer conn.Close()
+	start_time := time.Now()
+	buf := make([]byte, 4)
+	conn.Write([]byte("1234"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("unexpected read error %v", err)
+	}
+	if time.Since(start_time) < 100*time.Millisecond {
+		t.Errorf("expected write and read to be delayed, took %v", time.Since(start_time))
+	}
+}
+
+func TestFaultInjectorRules(t *testing.T) {
+	listener := startTestEchoServer(t)
+	defer listener.Close()
+	injector := NewFaultInjector(&net.Dialer{Timeout: time.Second})
+
+	for _, rule := range []FaultRule{
+		FaultRule{Probability: 1},
+		FaultRule{Name: "p", Probability: 1.5},
+		FaultRule{Name: "l", Probability: 1, Latency: -1},
+		FaultRule{Name: "d", Probability: 1, DropAfterBytes: -1},
+	} {
+		if injector.AddRule(rule) == nil {
+			t.Errorf("expected rule %v to be invalid", rule)
+		}
+	}
+
+	// rules that do not match the host, or that are not drawn, do not apply
+	addTestFaultRule(t, injector, FaultRule{Name: "other_host", Host: "10.1.2.3", Probability: 1, DropAfterBytes: 1})
+	addTestFaultRule(t, injector, FaultRule{Name: "never", Probability: 0, DropAfterBytes: 1})
+	conn := dialTestEchoServer(t, injector, listener)
+	if _, ok := conn.(*faultConn); ok {
+		t.Errorf("expected no fault to be injected")
+	}
+	conn.Close()
+
+	addTestFaultRule(t, injector, FaultRule{Name: "this_host", Host: LocalHostName, Probability: 1, DropAfterBytes: 1})
+	rules := injector.Rules()
+	if len(rules) != 3 || rules[0].Name != "never" || rules[2].Name != "this_host" {
+		t.Errorf("unexpected rules %v", rules)
+	}
+
+	// removing a rule stops the injection into existing connections
+	conn = dialTestEchoServer(t, injector, listener)
+	defer conn.Close()
+	if !injector.RemoveRule("this_host") || injector.RemoveRule("this_host") {
+		t.Errorf("expected rule to be removed once")
+	}
+	if n, err := conn.Write([]byte("1234")); n != 4 || err != nil {
+		t.Errorf("expected write to succeed after rule is removed, got %v %v", n, err)
+	}
+
+	injector.ClearRules()
+	if len(injector.Rules()) != 0 {
+		t.Errorf("expected rules to be cleared")
+	}
+}
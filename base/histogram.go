@@ -0,0 +1,122 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+)
+
+// the number of bits of precision kept for recorded values. values below 2^HistogramSubBucketBits are kept
+// exactly. larger values are kept within a relative error of 1/2^HistogramSubBucketBits
+const HistogramSubBucketBits = 7
+
+const (
+	histogramSubBucketCount = 1 << HistogramSubBucketBits
+	histogramBucketCount    = (64 - HistogramSubBucketBits + 1) * histogramSubBucketCount
+)
+
+// Histogram records non-negative values into log-linear buckets, in the manner of HDR histograms.
+// values are grouped by their highest set bit, and each group is divided into equal sub buckets,
+// so that percentiles are accurate to a fixed relative error regardless of the distribution of values.
+// it is safe for concurrent use
+type Histogram struct {
+	counts []int64
+	total  int64
+	max    int64
+	lock   sync.Mutex
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make([]int64, histogramBucketCount)}
+}
+
+func histogramBucketIndex(value int64) int {
+	if value < histogramSubBucketCount {
+		return int(value)
+	}
+	shift := uint(bits.Len64(uint64(value))) - HistogramSubBucketBits - 1
+	sub_bucket := int(value>>shift) - histogramSubBucketCount
+	return histogramSubBucketCount + int(shift)*histogramSubBucketCount + sub_bucket
+}
+
+// returns the largest value that falls into the bucket
+func histogramBucketValue(index int) int64 {
+	if index < histogramSubBucketCount {
+		return int64(index)
+	}
+	shift := uint(index/histogramSubBucketCount - 1)
+	sub_bucket := int64(index%histogramSubBucketCount + histogramSubBucketCount)
+	return (sub_bucket+1)<<shift - 1
+}
+
+// negative values are recorded as 0
+func (h *Histogram) Record(value int64) {
+	if value < 0 {
+		value = 0
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.counts[histogramBucketIndex(value)]++
+	h.total++
+	if value > h.max {
+		h.max = value
+	}
+}
+
+func (h *Histogram) Count() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.total
+}
+
+func (h *Histogram) Max() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.max
+}
+
+// returns the value at the percentile, in [0, 100], of the recorded values, or 0 when no value has been recorded
+func (h *Histogram) Percentile(percentile float64) int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.total == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(percentile / 100 * float64(h.total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var count int64
+	for index, bucket_count := range h.counts {
+		count += bucket_count
+		if count >= rank {
+			value := histogramBucketValue(index)
+			if value > h.max {
+				value = h.max
+			}
+			return value
+		}
+	}
+	return h.max
+}
+
+// returns a histogram with the values recorded so far, and resets this histogram
+func (h *Histogram) SnapshotAndReset() *Histogram {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	snapshot := &Histogram{counts: h.counts, total: h.total, max: h.max}
+	h.counts = make([]int64, histogramBucketCount)
+	h.total = 0
+	h.max = 0
+	return snapshot
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHistogramPercentiles(t *testing.T) {
+	histogram := NewHistogram()
+	if histogram.Percentile(99) != 0 || histogram.Max() != 0 {
+		t.Errorf("expected empty histogram to report 0")
+	}
+
+	// 1..10000, with a long tail
+	for i := int64(1); i <= 10000; i++ {
+		histogram.Record(i)
+	}
+	histogram.Record(5000000)
+
+	for _, test := range []struct {
+		percentile float64
+		expected   int64
+	}{{50, 5001}, {90, 9001}, {99, 9901}, {99.9, 9991}, {100, 5000000}} {
+		value := histogram.Percentile(test.percentile)
+		if math.Abs(float64(value-test.expected)) > float64(test.expected)/histogramSubBucketCount {
+			t.Errorf("expected p%v to be about %v, got %v", test.percentile, test.expected, value)
+		}
+	}
+	if histogram.Max() != 5000000 || histogram.Count() != 10001 {
+		t.Errorf("unexpected max %v or count %v", histogram.Max(), histogram.Count())
+	}
+
+	// small values are kept exactly
+	small := NewHistogram()
+	for _, value := range []int64{-5, 3, 3, 127} {
+		small.Record(value)
+	}
+	if small.Percentile(25) != 0 || small.Percentile(50) != 3 || small.Percentile(100) != 127 {
+		t.Errorf("unexpected percentiles %v %v %v", small.Percentile(25), small.Percentile(50), small.Percentile(100))
+	}
+
+	// the largest values fit as well
+	histogram.Record(math.MaxInt64)
+	if histogram.Percentile(100) != math.MaxInt64 {
+		t.Errorf("expected max value to be kept, got %v", histogram.Percentile(100))
+	}
+}
+
+func TestHistogramSnapshotAndReset(t *testing.T) {
+	histogram := NewHistogram()
+	histogram.Record(1000)
+	histogram.Record(2000)
+
+	snapshot := histogram.SnapshotAndReset()
+	if snapshot.Count() != 2 || snapshot.Max() != 2000 || snapshot.Percentile(50) < 1000 || snapshot.Percentile(50) > 1008 {
+		t.Errorf("unexpected snapshot count=%v max=%v p50=%v", snapshot.Count(), snapshot.Max(), snapshot.Percentile(50))
+	}
+	if histogram.Count() != 0 || histogram.Max() != 0 || histogram.Percentile(50) != 0 {
+		t.Errorf("expected histogram to be reset")
+	}
+
+	histogram.Record(10)
+	if histogram.Percentile(50) != 10 || snapshot.Count() != 2 {
+		t.Errorf("expected snapshot not to be affected by new values")
+	}
+}
@@ -49,6 +49,7 @@ func (pool *MCRequestPool) Put(req *WrappedMCRequest) {
 func (pool *MCRequestPool) cleanReq(req *WrappedMCRequest) *WrappedMCRequest {
 	req.Req = pool.cleanMCReq(req.Req)
 	req.Seqno = 0
+	req.Compressed_size = 0
 	return req
 }
 
@@ -58,6 +59,7 @@ func (pool *MCRequestPool) cleanMCReq(req *gomemcached.MCRequest) *gomemcached.M
 	req.VBucket = 0
 	req.Key = nil
 	req.Body = nil
+	req.DataType = 0
 	pool.cleanExtras(req)
 	//opCode
 	req.Opcode = 0
@@ -11,14 +11,13 @@ package base
 
 import (
 	"errors"
-	"fmt"
 	"github.com/couchbase/goxdcr/log"
 	"net"
 	"sync"
 )
 
 type TCPConnPool struct {
-	clients  chan *net.TCPConn
+	clients  chan net.Conn
 	hostName string
 	maxConn  int
 	logger   *log.CommonLogger
@@ -48,11 +47,11 @@ func (p *TCPConnPool) IsClosed() bool {
 	return p.clients == nil
 }
 
-func (p *TCPConnPool) GetNew() (*net.TCPConn, error) {
+func (p *TCPConnPool) GetNew() (net.Conn, error) {
 	return NewTCPConn(p.hostName)
 }
 
-func (p *TCPConnPool) Get() (*net.TCPConn, error) {
+func (p *TCPConnPool) Get() (net.Conn, error) {
 	p.logger.Debugf("There are %d connections in the pool\n", len(p.clients))
 	select {
 	case client, ok := <-p.clients:
@@ -71,7 +70,7 @@ func (p *TCPConnPool) Get() (*net.TCPConn, error) {
 //
 // Release connection back to the pool
 //
-func (p *TCPConnPool) Release(client *net.TCPConn) {
+func (p *TCPConnPool) Release(client net.Conn) {
 	// This would panic if p.clients is closed.  This
 	// is intentional.
 	select {
@@ -142,7 +141,7 @@ func (tcpConnPoolMgr *tcpConnPoolMgr) GetPool(poolName string) *TCPConnPool {
 func (tcpConnPoolMgr *tcpConnPoolMgr) CreatePool(poolName string, hostName string, connectionSize int) (p *TCPConnPool, err error) {
 	tcpConnPoolMgr.logger.Infof("Create TCP Pool - poolName=%v,", poolName)
 	tcpConnPoolMgr.logger.Infof("connectionSize=%d", connectionSize)
-	p = &TCPConnPool{clients: make(chan *net.TCPConn, connectionSize),
+	p = &TCPConnPool{clients: make(chan net.Conn, connectionSize),
 		hostName: hostName,
 		logger:   log.NewLogger("TCPConnPool", tcpConnPoolMgr.logger.LoggerContext())}
 
@@ -175,17 +174,10 @@ func (tcpConnPoolMgr *tcpConnPoolMgr) CreatePool(poolName string, hostName strin
 
 //
 // This function creates a single connection to the vbucket master node.
+// The connection is a *net.TCPConn unless the dialer has been replaced by SetDialer.
 //
-func NewTCPConn(hostName string) (conn *net.TCPConn, err error) {
-	con, err := DialTCPWithTimeout(NetTCP, hostName)
-	if err != nil {
-		return nil, err
-	}
-	conn, ok := con.(*net.TCPConn)
-	if !ok {
-		return nil, fmt.Errorf("The connection to %v returned is not TCP type", hostName)
-	}
-	return conn, nil
+func NewTCPConn(hostName string) (conn net.Conn, err error) {
+	return DialTCPWithTimeout(NetTCP, hostName)
 }
 
 //return the singleton TCPConnPoolMgr
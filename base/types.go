@@ -83,12 +83,18 @@ type ErrorInfo struct {
 
 type WrappedMCRequest struct {
 	Seqno uint64
-	Req   *gomemcached.MCRequest
+	// vbucket of the mutation on source. it differs from Req.VBucket when key rewrite rules
+	// have moved the document into a different vbucket on target
+	Src_vbno uint16
+	Req      *gomemcached.MCRequest
 	// conflict resolution mode of mutations
 	CRMode     ConflictResolutionMode
 	Start_time time.Time
 	Send_time  time.Time
 	UniqueKey  string
+	// size of Req as it was last sent, with its body compressed. 0 if it was sent uncompressed.
+	// Req itself is never compressed
+	Compressed_size int
 }
 
 func (req *WrappedMCRequest) ConstructUniqueKey() {
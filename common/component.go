@@ -42,6 +42,10 @@ const (
 	DataFailedCRSource ComponentEventType = iota
 	// generic stats update event for the component
 	StatsUpdate ComponentEventType = iota
+	//data is not sent to target since a later mutation of the same document is sent in the same batch
+	DataDeduped ComponentEventType = iota
+	//data is permanently rejected by target and put into dead-letter store
+	DataDeadLettered ComponentEventType = iota
 )
 
 type Event struct {
@@ -0,0 +1,98 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package conflict_log
+
+import (
+	"sync"
+	"time"
+)
+
+// max number of recent conflict records kept in memory per replication
+var MaxRecentRecords = 1000
+
+// recent conflict records of a replication in a ring buffer, without source bodies, which are only written to sinks.
+// they survive pipeline restarts and are removed when the replication is deleted
+type recentRecords struct {
+	records []*Record
+	// position of the next record to be added
+	next int
+	// records older than retention are not returned
+	retention time.Duration
+	lock      sync.RWMutex
+}
+
+var recent_records_map = make(map[string]*recentRecords)
+var recent_records_map_lock sync.RWMutex
+
+// keeps the record in memory for lookup through RecentRecords. the source body is left out,
+// so that the memory held is bounded by MaxRecentRecords records of metadata
+func AddRecentRecord(record *Record, retention time.Duration) {
+	if record.SourceBody != nil {
+		record_copy := *record
+		record_copy.SourceBody = nil
+		record = &record_copy
+	}
+
+	recent_records_map_lock.Lock()
+	recent, ok := recent_records_map[record.ReplicationId]
+	if !ok {
+		recent = &recentRecords{records: make([]*Record, 0, MaxRecentRecords)}
+		recent_records_map[record.ReplicationId] = recent
+	}
+	recent_records_map_lock.Unlock()
+
+	recent.lock.Lock()
+	defer recent.lock.Unlock()
+	recent.retention = retention
+	if len(recent.records) < MaxRecentRecords {
+		recent.records = append(recent.records, record)
+	} else {
+		recent.records[recent.next] = record
+	}
+	recent.next = (recent.next + 1) % MaxRecentRecords
+}
+
+// returns up to limit of the recent records of a replication that are within retention, latest first, skipping the first offset ones,
+// and the total number of such records
+func RecentRecords(replicationId string, offset, limit int) ([]*Record, int) {
+	recent_records_map_lock.RLock()
+	recent, ok := recent_records_map[replicationId]
+	recent_records_map_lock.RUnlock()
+	if !ok {
+		return []*Record{}, 0
+	}
+
+	recent.lock.RLock()
+	defer recent.lock.RUnlock()
+
+	// walk backwards from the latest record until a record falls out of retention
+	cutoff_time := time.Now().Add(-recent.retention)
+	total := 0
+	result := make([]*Record, 0)
+	for i := 0; i < len(recent.records); i++ {
+		index := (recent.next - 1 - i + len(recent.records)) % len(recent.records)
+		record := recent.records[index]
+		if record.Time.Before(cutoff_time) {
+			break
+		}
+		if total >= offset && len(result) < limit {
+			result = append(result, record)
+		}
+		total++
+	}
+	return result, total
+}
+
+// discards the recent records of a replication
+func RemoveRecentRecords(replicationId string) {
+	recent_records_map_lock.Lock()
+	defer recent_records_map_lock.Unlock()
+	delete(recent_records_map, replicationId)
+}
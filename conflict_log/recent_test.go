@@ -0,0 +1,108 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package conflict_log
+
+import (
+	"testing"
+	"time"
+)
+
+const testReplicationId = "uuid/source/target"
+
+func addTestRecords(seqnos []uint64, record_time time.Time, retention time.Duration) {
+	for _, seqno := range seqnos {
+		AddRecentRecord(&Record{ReplicationId: testReplicationId, Time: record_time, Seqno: seqno, SourceBody: []byte(`{}`)}, retention)
+	}
+}
+
+func checkSeqnos(t *testing.T, records []*Record, expected ...uint64) {
+	if len(records) != len(expected) {
+		t.Errorf("expected records with seqnos %v, got %v records", expected, len(records))
+		return
+	}
+	for i, record := range records {
+		if record.Seqno != expected[i] {
+			t.Errorf("expected seqno %v at %v, got %v", expected[i], i, record.Seqno)
+		}
+	}
+}
+
+func TestRecentRecordsWrapAround(t *testing.T) {
+	oldMax := MaxRecentRecords
+	MaxRecentRecords = 4
+	defer func() {
+		MaxRecentRecords = oldMax
+		RemoveRecentRecords(testReplicationId)
+	}()
+
+	addTestRecords([]uint64{1, 2, 3}, time.Now(), time.Hour)
+	records, total := RecentRecords(testReplicationId, 0, 10)
+	if total != 3 {
+		t.Errorf("expected 3 records, got %v", total)
+	}
+	checkSeqnos(t, records, 3, 2, 1)
+
+	// the oldest records are overwritten once the ring is full
+	addTestRecords([]uint64{4, 5, 6}, time.Now(), time.Hour)
+	records, total = RecentRecords(testReplicationId, 0, 10)
+	if total != 4 {
+		t.Errorf("expected 4 records, got %v", total)
+	}
+	checkSeqnos(t, records, 6, 5, 4, 3)
+	if records[0].SourceBody != nil {
+		t.Errorf("expected source bodies not to be kept")
+	}
+
+	records, total = RecentRecords(testReplicationId, 1, 2)
+	if total != 4 {
+		t.Errorf("expected 4 records, got %v", total)
+	}
+	checkSeqnos(t, records, 5, 4)
+	records, _ = RecentRecords(testReplicationId, 4, 2)
+	checkSeqnos(t, records)
+
+	records, total = RecentRecords("other", 0, 10)
+	if total != 0 || len(records) != 0 {
+		t.Errorf("expected no records of other replications, got %v", total)
+	}
+}
+
+func TestRecentRecordsRetention(t *testing.T) {
+	oldMax := MaxRecentRecords
+	MaxRecentRecords = 4
+	defer func() {
+		MaxRecentRecords = oldMax
+		RemoveRecentRecords(testReplicationId)
+	}()
+
+	now := time.Now()
+	addTestRecords([]uint64{1, 2, 3}, now.Add(-2*time.Hour), time.Hour)
+	addTestRecords([]uint64{4, 5}, now, time.Hour)
+
+	// records out of retention are not returned, even when the ring has wrapped around past them
+	records, total := RecentRecords(testReplicationId, 0, 10)
+	if total != 2 {
+		t.Errorf("expected 2 records within retention, got %v", total)
+	}
+	checkSeqnos(t, records, 5, 4)
+
+	// the retention of the latest record added applies
+	addTestRecords([]uint64{6}, now, 3*time.Hour)
+	records, total = RecentRecords(testReplicationId, 0, 10)
+	if total != 4 {
+		t.Errorf("expected 4 records within retention, got %v", total)
+	}
+	checkSeqnos(t, records, 6, 5, 4, 3)
+
+	RemoveRecentRecords(testReplicationId)
+	if _, total = RecentRecords(testReplicationId, 0, 10); total != 0 {
+		t.Errorf("expected records to be removed, got %v", total)
+	}
+}
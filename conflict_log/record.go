@@ -0,0 +1,80 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// conflict_log keeps an audit trail of the source documents that lose source side conflict resolution
+// and hence are not sent to target. each such document produces a record, which is written to a sink,
+// i.e., a rotating local file or a bucket on target, and kept in memory so that recent conflicts can be
+// looked up through rest api.
+package conflict_log
+
+import (
+	"github.com/couchbase/goxdcr/base"
+	"time"
+)
+
+// metadata of a document in a conflict record
+type DocMeta struct {
+	RevSeq   uint64 `json:"revSeq"`
+	Cas      uint64 `json:"cas"`
+	Expiry   uint32 `json:"expiry"`
+	Flags    uint32 `json:"flags"`
+	Deletion bool   `json:"deletion"`
+}
+
+// a source document that lost source side conflict resolution
+type Record struct {
+	Time          time.Time `json:"time"`
+	ReplicationId string    `json:"replicationId"`
+	Key           string    `json:"key"`
+	// vbucket and seqno of the mutation on source
+	VBucket uint16  `json:"vb"`
+	Seqno   uint64  `json:"seqno"`
+	Source  DocMeta `json:"source"`
+	// nil when metadata of the target document is not available, e.g., in capi replications
+	Target *DocMeta `json:"target,omitempty"`
+	// body of the source document, present only when conflict_log_body is enabled. encoded in base64 in json
+	SourceBody []byte `json:"sourceBody,omitempty"`
+	// node that holds the record in memory. set only in rest responses
+	Node string `json:"node,omitempty"`
+}
+
+// constructs the conflict record for a source document. target may be nil
+func NewRecord(replicationId string, vbno uint16, seqno uint64, source *base.DocumentMetadata, target *base.DocumentMetadata) *Record {
+	record := &Record{
+		Time:          time.Now(),
+		ReplicationId: replicationId,
+		Key:           string(source.Key),
+		VBucket:       vbno,
+		Seqno:         seqno,
+		Source:        docMetaFrom(source),
+		SourceBody:    source.Body,
+	}
+	if target != nil {
+		target_meta := docMetaFrom(target)
+		record.Target = &target_meta
+	}
+	return record
+}
+
+// sorts records by time, latest first
+type RecordsByLatest []*Record
+
+func (records RecordsByLatest) Len() int           { return len(records) }
+func (records RecordsByLatest) Swap(i, j int)      { records[i], records[j] = records[j], records[i] }
+func (records RecordsByLatest) Less(i, j int) bool { return records[i].Time.After(records[j].Time) }
+
+func docMetaFrom(doc_meta *base.DocumentMetadata) DocMeta {
+	return DocMeta{
+		RevSeq:   doc_meta.RevSeq,
+		Cas:      doc_meta.Cas,
+		Expiry:   doc_meta.Expiry,
+		Flags:    doc_meta.Flags,
+		Deletion: doc_meta.Deletion,
+	}
+}
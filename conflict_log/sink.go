@@ -0,0 +1,156 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package conflict_log
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/couchbase/go-couchbase"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/simple_utils"
+	"hash/crc32"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// types of sinks. a sink spec is the type followed by ":" and its argument, e.g., "file:/var/log/conflicts"
+const (
+	// rotating file in the local directory in the argument, which is under the log directory of xdcr
+	SinkTypeFile = "file"
+	// bucket on target cluster named in the argument
+	SinkTypeBucket = "bucket"
+
+	SinkSpecSeparator = ":"
+)
+
+// size limit of a conflict log file, beyond which the file is rotated
+var MaxFileSize uint64 = 10 * 1024 * 1024
+
+// max number of conflict log files, including rotated ones, kept per replication
+var MaxNumberOfFiles uint64 = 5
+
+// prefix of the keys of conflict records written to bucket sinks
+var BucketSinkKeyPrefix = "_xdcr_conflict"
+
+// expiry values larger than this are interpreted by memcached as absolute unix time
+const maxRelativeExpiry = 30 * 24 * 60 * 60
+
+// characters that are not safe in file names
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_.\-]`)
+
+// destination of conflict records. Write is called from a single go routine
+type Sink interface {
+	Write(record *Record) error
+	Close() error
+}
+
+// splits a sink spec into sink type and argument, and validates them
+func ParseSinkSpec(spec string) (sinkType, arg string, err error) {
+	index := strings.Index(spec, SinkSpecSeparator)
+	if index < 0 {
+		err = fmt.Errorf("conflict log sink needs to be in the form of %v:<directory> or %v:<bucket name>", SinkTypeFile, SinkTypeBucket)
+		return
+	}
+	sinkType, arg = spec[:index], spec[index+1:]
+
+	switch sinkType {
+	case SinkTypeFile:
+		arg, err = simple_utils.PathUnderRoot(arg, base.XDCRLogDir)
+		if err != nil {
+			err = fmt.Errorf("invalid directory of conflict log file. %v", err)
+		}
+	case SinkTypeBucket:
+		if len(arg) == 0 {
+			err = fmt.Errorf("bucket name of conflict log is missing")
+		}
+	default:
+		err = fmt.Errorf("unknown conflict log sink type %v. valid types are %v and %v", sinkType, SinkTypeFile, SinkTypeBucket)
+	}
+	return
+}
+
+// returns the name of the conflict log file for the replication
+func FileNameForReplication(replicationId string) string {
+	return "conflicts_" + unsafeFileNameChars.ReplaceAllString(replicationId, "_") + ".log"
+}
+
+// writes conflict records as json lines into a file, which is rotated when it grows beyond MaxFileSize.
+// retention is bounded by MaxFileSize * MaxNumberOfFiles
+type FileSink struct {
+	writer *log.RotatingLogFileWriter
+}
+
+func NewFileSink(dir, replicationId string) (*FileSink, error) {
+	// the directory is checked again since symbolic links may have changed after the sink spec was validated
+	dir, err := simple_utils.PathUnderRoot(dir, base.XDCRLogDir)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := log.NewRotatingLogFileWriter(filepath.Join(dir, FileNameForReplication(replicationId)), MaxFileSize, MaxNumberOfFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{writer: writer}, nil
+}
+
+func (sink *FileSink) Write(record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = sink.writer.Write(append(data, '\n'))
+	return err
+}
+
+func (sink *FileSink) Close() error {
+	return sink.writer.Close()
+}
+
+// writes conflict records as json documents into a bucket. the documents expire after retention
+type BucketSink struct {
+	bucket    *couchbase.Bucket
+	retention time.Duration
+	// distinguishes the records of different replications in the same bucket
+	replication_hash uint32
+}
+
+func NewBucketSink(bucket *couchbase.Bucket, replicationId string, retention time.Duration) *BucketSink {
+	return &BucketSink{
+		bucket:           bucket,
+		retention:        retention,
+		replication_hash: crc32.ChecksumIEEE([]byte(replicationId)),
+	}
+}
+
+func (sink *BucketSink) Write(record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	// the source document key is in the record. it is not part of the record key, which would otherwise exceed the max key length
+	key := fmt.Sprintf("%v::%08x::%v::%v::%v", BucketSinkKeyPrefix, sink.replication_hash, record.Time.UnixNano(), record.VBucket, record.Seqno)
+	return sink.bucket.SetRaw(key, sink.expiry(record.Time), data)
+}
+
+func (sink *BucketSink) expiry(record_time time.Time) int {
+	expiry := int(sink.retention.Seconds())
+	if expiry > maxRelativeExpiry {
+		expiry = int(record_time.Add(sink.retention).Unix())
+	}
+	return expiry
+}
+
+func (sink *BucketSink) Close() error {
+	sink.bucket.Close()
+	return nil
+}
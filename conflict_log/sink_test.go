@@ -0,0 +1,94 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package conflict_log
+
+import (
+	"github.com/couchbase/goxdcr/base"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSinkSpec(t *testing.T) {
+	root, err := ioutil.TempDir("", "conflict_log")
+	if err != nil {
+		t.Fatalf("failed to create temp dir. err=%v", err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "conflict_log_outside")
+	if err != nil {
+		t.Fatalf("failed to create temp dir. err=%v", err)
+	}
+	defer os.RemoveAll(outside)
+	if err = os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatalf("failed to create symbolic link. err=%v", err)
+	}
+	oldLogDir := base.XDCRLogDir
+	base.XDCRLogDir = root
+	defer func() { base.XDCRLogDir = oldLogDir }()
+
+	sinkType, arg, err := ParseSinkSpec("file:" + filepath.Join(root, "conflicts") + "/")
+	if err != nil || sinkType != SinkTypeFile || arg != filepath.Join(root, "conflicts") {
+		t.Errorf("unexpected sinkType=%v arg=%v err=%v", sinkType, arg, err)
+	}
+	sinkType, arg, err = ParseSinkSpec("bucket:conflicts")
+	if err != nil || sinkType != SinkTypeBucket || arg != "conflicts" {
+		t.Errorf("unexpected sinkType=%v arg=%v err=%v", sinkType, arg, err)
+	}
+
+	for _, spec := range []string{
+		// not under the log dir
+		"file:" + outside,
+		"file:/",
+		// the log dir itself
+		"file:" + root,
+		// relative
+		"file:conflicts",
+		// out of the log dir through a symbolic link
+		"file:" + filepath.Join(root, "link"),
+		"file:" + filepath.Join(root, "link", "conflicts"),
+		// under the log dir only after ".." is resolved
+		"file:" + root + "/conflicts/../conflicts",
+		"bucket:",
+		"s3:conflicts",
+		"conflicts",
+	} {
+		if _, _, err = ParseSinkSpec(spec); err == nil {
+			t.Errorf("expected %v to be rejected", spec)
+		}
+	}
+
+	// sinks cannot be created out of the log dir either, e.g., when it is changed after the spec is validated
+	base.XDCRLogDir = filepath.Join(root, "other")
+	if _, err = NewFileSink(filepath.Join(root, "conflicts"), "id"); err == nil {
+		t.Errorf("expected file sink out of log dir to be rejected")
+	}
+}
+
+func TestBucketSinkExpiry(t *testing.T) {
+	record_time := time.Unix(1500000000, 0)
+
+	sink := NewBucketSink(nil, "id", time.Hour)
+	if expiry := sink.expiry(record_time); expiry != 3600 {
+		t.Errorf("expected relative expiry 3600, got %v", expiry)
+	}
+	sink = NewBucketSink(nil, "id", maxRelativeExpiry*time.Second)
+	if expiry := sink.expiry(record_time); expiry != maxRelativeExpiry {
+		t.Errorf("expected relative expiry %v, got %v", maxRelativeExpiry, expiry)
+	}
+
+	// memcached takes expiry values above 30 days as absolute unix time
+	sink = NewBucketSink(nil, "id", 31*24*time.Hour)
+	if expiry := sink.expiry(record_time); expiry != 1500000000+31*24*3600 {
+		t.Errorf("expected absolute expiry %v, got %v", 1500000000+31*24*3600, expiry)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package dcp_record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	"io"
+	"os"
+	"time"
+)
+
+var ErrorCorruptedRecord = errors.New("dcp recording is corrupted")
+
+// the max size of a record that a reader accepts, which is well above the max document size
+var MaxRecordSize = 64 * 1024 * 1024
+
+// reads dcp events from a recording file. it is not safe for concurrent use
+type Reader struct {
+	path   string
+	file   *os.File
+	buf    *bufio.Reader
+	header *Header
+}
+
+// opens the recording file and reads its header
+func NewReader(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{
+		path: path,
+		file: file,
+		buf:  bufio.NewReaderSize(file, 64*1024),
+	}
+	r.header, err = r.readHeader()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read header of dcp recording %v. err=%v", path, err)
+	}
+	return r, nil
+}
+
+// reads the header of the recording file without reading its records
+func ReadHeader(path string) (*Header, error) {
+	r, err := NewReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return r.Header(), nil
+}
+
+func (r *Reader) Header() *Header {
+	return r.header
+}
+
+func (r *Reader) readHeader() (*Header, error) {
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(r.buf, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != Magic {
+		return nil, errors.New("not a dcp recording")
+	}
+	version, err := r.readUint16()
+	if err != nil {
+		return nil, err
+	}
+	if version != Version {
+		return nil, fmt.Errorf("unsupported version %v", version)
+	}
+
+	header := &Header{}
+	kvAddr, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	header.KVAddr = kvAddr
+	bucketName, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	header.BucketName = bucketName
+
+	numVBs, err := r.readUint16()
+	if err != nil {
+		return nil, err
+	}
+	header.VBList = make([]uint16, numVBs)
+	for i := range header.VBList {
+		header.VBList[i], err = r.readUint16()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+func (r *Reader) readUint16() (uint16, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r.buf, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[:]), nil
+}
+
+func (r *Reader) readString() (string, error) {
+	length, err := r.readUint16()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, length)
+	if _, err = io.ReadFull(r.buf, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// returns the next record in the recording, or io.EOF when there are no more records.
+// a record truncated at the end of the file, e.g., when the recording nozzle was killed, is treated as the end of the recording
+func (r *Reader) Next() (*Record, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r.buf, length[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if int(size) > MaxRecordSize {
+		return nil, ErrorCorruptedRecord
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r.buf, body); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	return decodeRecord(body)
+}
+
+// moves back to the first record in the recording
+func (r *Reader) Rewind() error {
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r.buf.Reset(r.file)
+	_, err := r.readHeader()
+	return err
+}
+
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
+
+// decodes a record body. the slices in the returned event refer to body
+func decodeRecord(body []byte) (*Record, error) {
+	d := &decoder{buf: body}
+	elapsed := d.uint64()
+	event := &mcc.UprEvent{}
+	event.Opcode = mc.CommandCode(d.uint8())
+	event.Status = mc.Status(d.uint16())
+	event.VBucket = d.uint16()
+	event.Opaque = d.uint16()
+	event.DataType = d.uint8()
+	event.Flags = d.uint32()
+	event.Expiry = d.uint32()
+	event.LockTime = d.uint32()
+	event.Cas = d.uint64()
+	event.Seqno = d.uint64()
+	event.RevSeqno = d.uint64()
+	event.SnapstartSeq = d.uint64()
+	event.SnapendSeq = d.uint64()
+	event.SnapshotType = d.uint32()
+	event.VBuuid = d.uint64()
+	event.Key = d.bytes(int(d.uint16()))
+	event.Value = d.bytes(int(d.uint32()))
+	event.ExtMeta = d.bytes(int(d.uint16()))
+	numFailoverEntries := int(d.uint16())
+	if numFailoverEntries > 0 {
+		failoverLog := make(mcc.FailoverLog, numFailoverEntries)
+		for i := range failoverLog {
+			failoverLog[i][0] = d.uint64()
+			failoverLog[i][1] = d.uint64()
+		}
+		event.FailoverLog = &failoverLog
+	}
+
+	if d.err || d.pos != len(body) {
+		return nil, ErrorCorruptedRecord
+	}
+	return &Record{Time: time.Duration(elapsed), Event: event}, nil
+}
+
+// reads fields from a record body. err is set when the body is too short
+type decoder struct {
+	buf []byte
+	pos int
+	err bool
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err || n < 0 || d.pos+n > len(d.buf) {
+		d.err = true
+		return nil
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) bytes(n int) []byte {
+	b := d.next(n)
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package dcp_record
+
+import (
+	"encoding/binary"
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testEvents() []*mcc.UprEvent {
+	failoverLog := mcc.FailoverLog{[2]uint64{1234, 0}, [2]uint64{5678, 10}}
+	rollback := make([]byte, 8)
+	binary.BigEndian.PutUint64(rollback, 5)
+	return []*mcc.UprEvent{
+		&mcc.UprEvent{Opcode: mc.UPR_STREAMREQ, Status: mc.SUCCESS, VBucket: 0, Opaque: 7, FailoverLog: &failoverLog},
+		&mcc.UprEvent{Opcode: mc.UPR_SNAPSHOT, VBucket: 0, SnapstartSeq: 1, SnapendSeq: 3, SnapshotType: 1},
+		&mcc.UprEvent{Opcode: mc.UPR_MUTATION, VBucket: 0, Opaque: 7, DataType: 1, Flags: 0x02000006, Expiry: 3600, LockTime: 1,
+			Cas: 0x14a1b2c3d4e5f607, Seqno: 1, RevSeqno: 2, VBuuid: 5678, Key: []byte("doc0"), Value: []byte(`{"a":1}`),
+			ExtMeta: []byte{1, 2, 3}},
+		&mcc.UprEvent{Opcode: mc.UPR_DELETION, VBucket: 1, Cas: 2, Seqno: 2, RevSeqno: 3, Key: []byte("doc1")},
+		&mcc.UprEvent{Opcode: mc.UPR_EXPIRATION, VBucket: 1, Cas: 3, Seqno: 3, Key: []byte("doc2")},
+		&mcc.UprEvent{Opcode: mc.UPR_STREAMREQ, Status: mc.ROLLBACK, VBucket: 1, Value: rollback},
+		&mcc.UprEvent{Opcode: mc.UPR_STREAMEND, VBucket: 0, Flags: 2},
+	}
+}
+
+func writeTestRecording(t *testing.T, path string, events []*mcc.UprEvent) {
+	writer, err := NewWriter(path, testHeader)
+	if err != nil {
+		t.Fatalf("failed to create recording. err=%v", err)
+	}
+	for _, event := range events {
+		if err = writer.Write(event); err != nil {
+			t.Fatalf("failed to write event. err=%v", err)
+		}
+	}
+	// nil events are ignored
+	if err = writer.Write(nil); err != nil {
+		t.Fatalf("failed to write nil event. err=%v", err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatalf("failed to close recording. err=%v", err)
+	}
+	if err = writer.Write(events[0]); err != ErrorWriterClosed {
+		t.Errorf("expected write after close to fail, got err=%v", err)
+	}
+}
+
+func readTestRecording(t *testing.T, reader *Reader) []*mcc.UprEvent {
+	events := []*mcc.UprEvent{}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return events
+		} else if err != nil {
+			t.Fatalf("failed to read recording. err=%v", err)
+		}
+		events = append(events, record.Event)
+	}
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, FileNameForNozzle(testNozzleId, 0))
+	events := testEvents()
+	writeTestRecording(t, path, events)
+
+	header, err := ReadHeader(path)
+	if err != nil || !reflect.DeepEqual(header, testHeader) {
+		t.Errorf("expected header %v, got %v. err=%v", testHeader, header, err)
+	}
+
+	reader, err := NewReader(path)
+	if err != nil {
+		t.Fatalf("failed to open recording. err=%v", err)
+	}
+	defer reader.Close()
+	read_events := readTestRecording(t, reader)
+	if len(read_events) != len(events) {
+		t.Fatalf("expected %v events, got %v", len(events), len(read_events))
+	}
+	for i, event := range events {
+		if !reflect.DeepEqual(read_events[i], event) {
+			t.Errorf("expected event %v to be %v, got %v", i, event, read_events[i])
+		}
+	}
+
+	// the recording can be read again after rewind
+	if err = reader.Rewind(); err != nil {
+		t.Fatalf("failed to rewind. err=%v", err)
+	}
+	if read_events = readTestRecording(t, reader); len(read_events) != len(events) {
+		t.Errorf("expected %v events after rewind, got %v", len(events), len(read_events))
+	}
+}
+
+func TestRecordingTimes(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, FileNameForNozzle(testNozzleId, 0))
+	writeTestRecording(t, path, testEvents())
+
+	reader, err := NewReader(path)
+	if err != nil {
+		t.Fatalf("failed to open recording. err=%v", err)
+	}
+	defer reader.Close()
+	var last_time int64 = -1
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to read recording. err=%v", err)
+		}
+		if int64(record.Time) < last_time {
+			t.Errorf("expected times of records not to decrease, got %v after %v", record.Time, last_time)
+		}
+		last_time = int64(record.Time)
+	}
+}
+
+func TestRecordingTruncatedAndCorrupted(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, FileNameForNozzle(testNozzleId, 0))
+	events := testEvents()
+	writeTestRecording(t, path, events)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file. err=%v", err)
+	}
+
+	// a record truncated by a crash of the recording nozzle ends the recording
+	if err = ioutil.WriteFile(path, data[:len(data)-3], 0644); err != nil {
+		t.Fatalf("failed to write file. err=%v", err)
+	}
+	reader, err := NewReader(path)
+	if err != nil {
+		t.Fatalf("failed to open recording. err=%v", err)
+	}
+	if read_events := readTestRecording(t, reader); len(read_events) != len(events)-1 {
+		t.Errorf("expected %v events before the truncated one, got %v", len(events)-1, len(read_events))
+	}
+	reader.Close()
+
+	// a record longer than the max record size is corrupted
+	corrupted := append([]byte{}, data...)
+	header_size := len(Magic) + 2 + 2 + len(testHeader.KVAddr) + 2 + len(testHeader.BucketName) + 2 + 2*len(testHeader.VBList)
+	binary.BigEndian.PutUint32(corrupted[header_size:], uint32(MaxRecordSize+1))
+	if err = ioutil.WriteFile(path, corrupted, 0644); err != nil {
+		t.Fatalf("failed to write file. err=%v", err)
+	}
+	reader, err = NewReader(path)
+	if err != nil {
+		t.Fatalf("failed to open recording. err=%v", err)
+	}
+	if _, err = reader.Next(); err != ErrorCorruptedRecord {
+		t.Errorf("expected corrupted record, got err=%v", err)
+	}
+	reader.Close()
+
+	// files other than recordings are rejected
+	if err = ioutil.WriteFile(path, []byte("XDCRFILE\x00\x01"), 0644); err != nil {
+		t.Fatalf("failed to write file. err=%v", err)
+	}
+	if _, err = NewReader(path); err == nil {
+		t.Errorf("expected file other than recording to be rejected")
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// dcp_record implements the file format used to record the dcp events received by a dcp nozzle,
+// so that they can be replayed into a pipeline later, e.g., to reproduce issues offline.
+//
+// all integers are big endian. a file consists of a header followed by event records:
+//
+//	header := magic[8] version:uint16 len:uint16 kvAddr len:uint16 bucketName numVBs:uint16 vbno:uint16*
+//	record := len:uint32 body[len]
+//	body   := time:uint64 opcode:uint8 status:uint16 vbno:uint16 opaque:uint16 datatype:uint8
+//	          flags:uint32 expiry:uint32 lockTime:uint32 cas:uint64 seqno:uint64 revSeqno:uint64
+//	          snapStart:uint64 snapEnd:uint64 snapType:uint32 vbuuid:uint64
+//	          len:uint16 key len:uint32 value len:uint16 extMeta numFailoverEntries:uint16 (vbuuid:uint64 seqno:uint64)*
+//
+// time is the number of nanoseconds between the start of recording and the receipt of the event.
+// snapshot markers, stream ends and stream request responses, including rollbacks, are recorded as well as mutations.
+//
+// each start of a dcp nozzle records into a new file, named after the nozzle and a sequence number, so that earlier
+// recordings are not overwritten. at most MaxFilesPerNozzle recordings are kept per nozzle, and each of them stops
+// growing at MaxFileSize.
+package dcp_record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mcc "github.com/couchbase/gomemcached/client"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Magic   = "XDCRDCPR"
+	Version = 1
+
+	// extension of recording files
+	FileExtension = ".dcp"
+)
+
+var ErrorWriterClosed = errors.New("dcp recording has been closed")
+var ErrorMaxFileSizeReached = errors.New("dcp recording has reached its max size")
+
+// size limit of a recording file, beyond which no more events are recorded into it
+var MaxFileSize int64 = 1024 * 1024 * 1024
+
+// max number of recording files kept per nozzle. the oldest ones are removed when a new recording is started
+var MaxFilesPerNozzle = 5
+
+// characters that are not safe in file names
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_.\-]`)
+
+// returns the name of the recording file with the given sequence number for the dcp nozzle with the specified id
+func FileNameForNozzle(nozzleId string, seq int) string {
+	return fmt.Sprintf("%v.%v%v", unsafeFileNameChars.ReplaceAllString(nozzleId, "_"), seq, FileExtension)
+}
+
+// splits the name of a recording file into the name of the nozzle and the sequence number of the recording.
+// ok is false when the name is not in the form of FileNameForNozzle
+func ParseFileName(fileName string) (nozzleName string, seq int, ok bool) {
+	if !strings.HasSuffix(fileName, FileExtension) {
+		return "", 0, false
+	}
+	name := strings.TrimSuffix(fileName, FileExtension)
+	index := strings.LastIndex(name, ".")
+	if index <= 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.Atoi(name[index+1:])
+	if err != nil || seq < 0 {
+		return "", 0, false
+	}
+	return name[:index], seq, true
+}
+
+// returns the path of the next recording file of the dcp nozzle with the specified id in dir, and removes
+// the oldest recordings of the nozzle so that at most MaxFilesPerNozzle are kept along with the new one
+func NextFilePath(dir, nozzleId string) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+FileExtension))
+	if err != nil {
+		return "", err
+	}
+	nozzleName := unsafeFileNameChars.ReplaceAllString(nozzleId, "_")
+	// sequence number -> path, for the existing recordings of the nozzle
+	seq_path_map := make(map[int]string)
+	seqs := []int{}
+	for _, path := range paths {
+		name, seq, ok := ParseFileName(filepath.Base(path))
+		if ok && name == nozzleName {
+			seq_path_map[seq] = path
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+
+	next_seq := 0
+	if len(seqs) > 0 {
+		next_seq = seqs[len(seqs)-1] + 1
+	}
+	for len(seqs) >= MaxFilesPerNozzle && len(seqs) > 0 {
+		if err = os.Remove(seq_path_map[seqs[0]]); err != nil {
+			return "", err
+		}
+		seqs = seqs[1:]
+	}
+	return filepath.Join(dir, FileNameForNozzle(nozzleId, next_seq)), nil
+}
+
+// information about the recorded stream
+type Header struct {
+	KVAddr     string
+	BucketName string
+	VBList     []uint16
+}
+
+// a recorded dcp event
+type Record struct {
+	// time elapsed between the start of recording and the receipt of the event
+	Time  time.Duration
+	Event *mcc.UprEvent
+}
+
+// records dcp events into a file. it is safe for concurrent use
+type Writer struct {
+	file *os.File
+	buf  *bufio.Writer
+	// number of bytes written into the file, including buffered ones
+	size       int64
+	start_time time.Time
+	closed     bool
+	lock       sync.Mutex
+}
+
+// creates the recording file and writes the header. existing recordings are never overwritten
+func NewWriter(path string, header *Header) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		file:       file,
+		buf:        bufio.NewWriterSize(file, 64*1024),
+		start_time: time.Now(),
+	}
+
+	err = w.writeHeader(header)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write header of dcp recording %v. err=%v", path, err)
+	}
+	return w, nil
+}
+
+func (w *Writer) writeHeader(header *Header) error {
+	if len(header.KVAddr) > 0xFFFF || len(header.BucketName) > 0xFFFF || len(header.VBList) > 0xFFFF {
+		return errors.New("header is too large")
+	}
+
+	body := make([]byte, 0, 16+len(header.KVAddr)+len(header.BucketName)+2*len(header.VBList))
+	body = append(body, Magic...)
+	body = appendUint16(body, Version)
+	body = appendUint16(body, uint16(len(header.KVAddr)))
+	body = append(body, header.KVAddr...)
+	body = appendUint16(body, uint16(len(header.BucketName)))
+	body = append(body, header.BucketName...)
+	body = appendUint16(body, uint16(len(header.VBList)))
+	for _, vbno := range header.VBList {
+		body = appendUint16(body, vbno)
+	}
+	_, err := w.buf.Write(body)
+	w.size += int64(len(body))
+	return err
+}
+
+// appends the event to the recording. returns ErrorMaxFileSizeReached when the recording would grow beyond MaxFileSize
+func (w *Writer) Write(event *mcc.UprEvent) error {
+	if event == nil {
+		return nil
+	}
+	if len(event.Key) > 0xFFFF || len(event.ExtMeta) > 0xFFFF {
+		return fmt.Errorf("key or extended metadata of event for vb=%v seqno=%v is too large", event.VBucket, event.Seqno)
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return ErrorWriterClosed
+	}
+
+	body := encodeEvent(event, time.Since(w.start_time))
+	if w.size+int64(4+len(body)) > MaxFileSize {
+		return ErrorMaxFileSizeReached
+	}
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(body)))
+	if _, err := w.buf.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.buf.Write(body)
+	w.size += int64(4 + len(body))
+	return err
+}
+
+// flushes buffered records and closes the recording file
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	err := w.buf.Flush()
+	close_err := w.file.Close()
+	if err == nil {
+		err = close_err
+	}
+	return err
+}
+
+func encodeEvent(event *mcc.UprEvent, elapsed time.Duration) []byte {
+	var failoverLog [][2]uint64
+	if event.FailoverLog != nil {
+		failoverLog = *event.FailoverLog
+	}
+
+	body := make([]byte, 0, 100+len(event.Key)+len(event.Value)+len(event.ExtMeta)+16*len(failoverLog))
+	body = appendUint64(body, uint64(elapsed))
+	body = append(body, byte(event.Opcode))
+	body = appendUint16(body, uint16(event.Status))
+	body = appendUint16(body, event.VBucket)
+	body = appendUint16(body, event.Opaque)
+	body = append(body, event.DataType)
+	body = appendUint32(body, event.Flags)
+	body = appendUint32(body, event.Expiry)
+	body = appendUint32(body, event.LockTime)
+	body = appendUint64(body, event.Cas)
+	body = appendUint64(body, event.Seqno)
+	body = appendUint64(body, event.RevSeqno)
+	body = appendUint64(body, event.SnapstartSeq)
+	body = appendUint64(body, event.SnapendSeq)
+	body = appendUint32(body, event.SnapshotType)
+	body = appendUint64(body, event.VBuuid)
+	body = appendUint16(body, uint16(len(event.Key)))
+	body = append(body, event.Key...)
+	body = appendUint32(body, uint32(len(event.Value)))
+	body = append(body, event.Value...)
+	body = appendUint16(body, uint16(len(event.ExtMeta)))
+	body = append(body, event.ExtMeta...)
+	body = appendUint16(body, uint16(len(failoverLog)))
+	for _, entry := range failoverLog {
+		body = appendUint64(body, entry[0])
+		body = appendUint64(body, entry[1])
+	}
+	return body
+}
+
+func appendUint16(buf []byte, val uint16) []byte {
+	return append(buf, byte(val>>8), byte(val))
+}
+
+func appendUint32(buf []byte, val uint32) []byte {
+	return append(buf, byte(val>>24), byte(val>>16), byte(val>>8), byte(val))
+}
+
+func appendUint64(buf []byte, val uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(val>>32)), uint32(val))
+}
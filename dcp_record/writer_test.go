@@ -0,0 +1,144 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package dcp_record
+
+import (
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testNozzleId = "dcp_uuid/source/target_127.0.0.1:11210_0"
+
+var testHeader = &Header{KVAddr: "127.0.0.1:11210", BucketName: "default", VBList: []uint16{0, 1}}
+
+func setupTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dcp_record")
+	if err != nil {
+		t.Fatalf("failed to create temp dir. err=%v", err)
+	}
+	return dir
+}
+
+func TestParseFileName(t *testing.T) {
+	name := FileNameForNozzle(testNozzleId, 12)
+	if name != "dcp_uuid_source_target_127.0.0.1_11210_0.12.dcp" {
+		t.Errorf("unexpected file name %v", name)
+	}
+	if nozzleName, seq, ok := ParseFileName(name); !ok || nozzleName != "dcp_uuid_source_target_127.0.0.1_11210_0" || seq != 12 {
+		t.Errorf("unexpected nozzleName=%v seq=%v ok=%v", nozzleName, seq, ok)
+	}
+	for _, name := range []string{"replay.dcp", "dcp_127.0.0.1_11210_0.dcp", ".1.dcp", "dcp.1.log", "dcp.-1.dcp"} {
+		if _, _, ok := ParseFileName(name); ok {
+			t.Errorf("expected %v not to be parsed", name)
+		}
+	}
+}
+
+func TestNextFilePath(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+	oldMaxFiles := MaxFilesPerNozzle
+	MaxFilesPerNozzle = 3
+	defer func() { MaxFilesPerNozzle = oldMaxFiles }()
+
+	// recordings of other nozzles are left alone
+	otherPath := filepath.Join(dir, FileNameForNozzle(testNozzleId+"1", 0))
+	if err := ioutil.WriteFile(otherPath, nil, 0644); err != nil {
+		t.Fatalf("failed to write file. err=%v", err)
+	}
+
+	paths := []string{}
+	for i := 0; i < 5; i++ {
+		path, err := NextFilePath(dir, testNozzleId)
+		if err != nil {
+			t.Fatalf("unexpected err=%v", err)
+		}
+		if expected := filepath.Join(dir, FileNameForNozzle(testNozzleId, i)); path != expected {
+			t.Errorf("expected %v, got %v", expected, path)
+		}
+		writer, err := NewWriter(path, testHeader)
+		if err != nil {
+			t.Fatalf("failed to create recording. err=%v", err)
+		}
+		writer.Close()
+		paths = append(paths, path)
+	}
+
+	// the oldest recordings are removed
+	for i, path := range paths {
+		_, err := os.Stat(path)
+		if i < 2 && !os.IsNotExist(err) {
+			t.Errorf("expected %v to be removed. err=%v", path, err)
+		} else if i >= 2 && err != nil {
+			t.Errorf("expected %v to be kept. err=%v", path, err)
+		}
+	}
+	if _, err := os.Stat(otherPath); err != nil {
+		t.Errorf("expected the recording of the other nozzle to be kept. err=%v", err)
+	}
+
+	// existing recordings are never overwritten
+	if _, err := NewWriter(paths[4], testHeader); err == nil {
+		t.Errorf("expected existing recording not to be overwritten")
+	}
+}
+
+func TestWriterMaxFileSize(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+	oldMaxSize := MaxFileSize
+	MaxFileSize = 1024
+	defer func() { MaxFileSize = oldMaxSize }()
+
+	path := filepath.Join(dir, FileNameForNozzle(testNozzleId, 0))
+	writer, err := NewWriter(path, testHeader)
+	if err != nil {
+		t.Fatalf("failed to create recording. err=%v", err)
+	}
+	written := 0
+	for {
+		err = writer.Write(&mcc.UprEvent{Opcode: mc.UPR_MUTATION, VBucket: 1, Seqno: uint64(written + 1), Key: []byte("doc"), Value: make([]byte, 100)})
+		if err != nil {
+			break
+		}
+		written++
+	}
+	if err != ErrorMaxFileSizeReached || written == 0 {
+		t.Fatalf("expected max file size to be reached after some events, got err=%v after %v events", err, written)
+	}
+	writer.Close()
+
+	info, err := os.Stat(path)
+	if err != nil || info.Size() > MaxFileSize {
+		t.Errorf("expected recording to be within max size, got %v. err=%v", info.Size(), err)
+	}
+
+	// the events before the limit are all in the recording
+	reader, err := NewReader(path)
+	if err != nil {
+		t.Fatalf("failed to open recording. err=%v", err)
+	}
+	defer reader.Close()
+	read := 0
+	for {
+		if _, err = reader.Next(); err != nil {
+			break
+		}
+		read++
+	}
+	if err != io.EOF || read != written {
+		t.Errorf("expected %v events, got %v. err=%v", written, read, err)
+	}
+}
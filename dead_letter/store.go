@@ -0,0 +1,402 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// dead_letter keeps the documents that target has permanently rejected, e.g., since they are too big,
+// when dead-letter mode is enabled for a replication. such documents are skipped so that the replication
+// can move on, and can be looked up and retried through rest api.
+// each node keeps the entries of the docs rejected by its own nozzles. the entries are persisted under the xdcr
+// data dir before they are added, so that they survive xdcr restarts, and are removed when the replication is deleted
+package dead_letter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// name of the dir under base.XDCRDataDir that dead-letter entries are persisted in.
+// the entries of each replication are in a sub dir named after the escaped replication id, one file per entry
+var DirName = "dead_letters"
+
+const entryFileSuffix = ".json"
+
+var ErrorStoreFull = errors.New("dead-letter store is full")
+
+var logger_dl *log.CommonLogger = log.NewLogger("DeadLetter", log.DefaultLoggerContext)
+
+// a document that has been permanently rejected by target
+type Entry struct {
+	Id            uint64    `json:"id"`
+	Time          time.Time `json:"time"`
+	ReplicationId string    `json:"replicationId"`
+	Key           string    `json:"key"`
+	// vbucket and seqno of the mutation on source
+	VBucket uint16 `json:"vb"`
+	Seqno   uint64 `json:"seqno"`
+	// status returned by target
+	Error string `json:"error"`
+	// the outgoing nozzle that the document was sent through
+	NozzleId string `json:"nozzleId"`
+	// the node that holds the entry. set only when entries of all nodes are listed
+	Node string `json:"node,omitempty"`
+
+	// the rejected request, which is resent on retry. it is the request as routed from source, since outgoing
+	// nozzles compress copies of requests on the wire, and is compressed again, if at all, when it is resent
+	req    *mc.MCRequest
+	crMode base.ConflictResolutionMode
+}
+
+// constructs the entry for a rejected request. the request is copied since the original one is recycled
+func NewEntry(replicationId, nozzleId string, wrappedReq *base.WrappedMCRequest, err string) *Entry {
+	req := *wrappedReq.Req
+	req.Extras = append([]byte(nil), wrappedReq.Req.Extras...)
+	return &Entry{
+		Time:          time.Now(),
+		ReplicationId: replicationId,
+		Key:           string(req.Key),
+		VBucket:       wrappedReq.Src_vbno,
+		Seqno:         wrappedReq.Seqno,
+		Error:         err,
+		NozzleId:      nozzleId,
+		req:           &req,
+		crMode:        wrappedReq.CRMode,
+	}
+}
+
+// constructs a new request for resending the rejected document
+func (entry *Entry) Request() *base.WrappedMCRequest {
+	req := *entry.req
+	req.Extras = append([]byte(nil), entry.req.Extras...)
+	wrappedReq := &base.WrappedMCRequest{
+		Seqno:      entry.Seqno,
+		Src_vbno:   entry.VBucket,
+		Req:        &req,
+		CRMode:     entry.crMode,
+		Start_time: time.Now(),
+	}
+	wrappedReq.ConstructUniqueKey()
+	return wrappedReq
+}
+
+// the form in which entries are persisted, which includes the rejected request
+type persistedEntry struct {
+	*Entry
+	Opcode        mc.CommandCode              `json:"opcode"`
+	TargetVBucket uint16                      `json:"targetVb"`
+	Cas           uint64                      `json:"cas"`
+	DataType      uint8                       `json:"dataType"`
+	Extras        []byte                      `json:"extras"`
+	Body          []byte                      `json:"body"`
+	CRMode        base.ConflictResolutionMode `json:"crMode"`
+}
+
+// entries ordered by id, i.e., by the time they were added
+type EntriesById []*Entry
+
+func (entries EntriesById) Len() int           { return len(entries) }
+func (entries EntriesById) Swap(i, j int)      { entries[i], entries[j] = entries[j], entries[i] }
+func (entries EntriesById) Less(i, j int) bool { return entries[i].Id < entries[j].Id }
+
+// dead-letter entries of a replication on the current node
+type store struct {
+	dir string
+	// entries in the order they were added
+	entries []*Entry
+	// entries to be resent by the outgoing nozzles of the running pipeline. they are not tied to the nozzles that
+	// sent them, which may no longer exist, e.g., after the number of target nozzles has been changed
+	retries []*Entry
+	next_id uint64
+	lock    sync.Mutex
+}
+
+var store_map = make(map[string]*store)
+var store_map_lock sync.RWMutex
+
+// returns the dir that the entries of a replication are persisted in
+func storeDir(replicationId string) (string, error) {
+	if base.XDCRDataDir == "" {
+		return "", errors.New("Dead-letter store needs the xdcr data dir, which has not been set")
+	}
+	return filepath.Join(base.XDCRDataDir, DirName, url.PathEscape(replicationId)), nil
+}
+
+// returns the store of a replication, which is loaded from disk when it is accessed for the first time
+func getStore(replicationId string) (*store, error) {
+	store_map_lock.RLock()
+	s, ok := store_map[replicationId]
+	store_map_lock.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	store_map_lock.Lock()
+	defer store_map_lock.Unlock()
+	s, ok = store_map[replicationId]
+	if ok {
+		return s, nil
+	}
+	dir, err := storeDir(replicationId)
+	if err != nil {
+		return nil, err
+	}
+	s = &store{dir: dir, entries: make([]*Entry, 0)}
+	if err = s.load(); err != nil {
+		return nil, err
+	}
+	store_map[replicationId] = s
+	return s, nil
+}
+
+// loads the persisted entries. entries that were queued for retry when xdcr stopped are back in the store
+func (s *store) load() error {
+	fileInfos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		if !strings.HasSuffix(fileInfo.Name(), entryFileSuffix) {
+			// e.g., temp file left by an interrupted write
+			continue
+		}
+		path := filepath.Join(s.dir, fileInfo.Name())
+		entry, err := readEntry(path)
+		if err != nil {
+			logger_dl.Errorf("Skipping dead-letter entry in %v. err=%v\n", path, err)
+			continue
+		}
+		s.entries = append(s.entries, entry)
+		if entry.Id > s.next_id {
+			s.next_id = entry.Id
+		}
+	}
+	sort.Sort(EntriesById(s.entries))
+	logger_dl.Infof("Loaded %v dead-letter entries from %v\n", len(s.entries), s.dir)
+	return nil
+}
+
+func readEntry(path string) (*Entry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	persisted := &persistedEntry{Entry: &Entry{}}
+	if err = json.Unmarshal(data, persisted); err != nil {
+		return nil, err
+	}
+	entry := persisted.Entry
+	entry.req = &mc.MCRequest{Opcode: persisted.Opcode,
+		VBucket:  persisted.TargetVBucket,
+		Cas:      persisted.Cas,
+		DataType: persisted.DataType,
+		Key:      []byte(entry.Key),
+		Extras:   persisted.Extras,
+		Body:     persisted.Body,
+	}
+	entry.crMode = persisted.CRMode
+	return entry, nil
+}
+
+func (s *store) entryPath(id uint64) string {
+	return filepath.Join(s.dir, strconv.FormatUint(id, 10)+entryFileSuffix)
+}
+
+// writes the entry into a temp file, which is renamed into place after it is synced, so that a partially written
+// entry is never loaded
+func (s *store) persist(entry *Entry) error {
+	req := entry.req
+	data, err := json.Marshal(&persistedEntry{Entry: entry,
+		Opcode:        req.Opcode,
+		TargetVBucket: req.VBucket,
+		Cas:           req.Cas,
+		DataType:      req.DataType,
+		Extras:        req.Extras,
+		Body:          req.Body,
+		CRMode:        entry.crMode,
+	})
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	path := s.entryPath(entry.Id)
+	tmp_path := path + ".tmp"
+	file, err := os.OpenFile(tmp_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(tmp_path, path)
+	}
+	if err != nil {
+		os.Remove(tmp_path)
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// makes the creation, or removal, of files in the dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// adds the entry to the dead-letter store of its replication, after persisting it. returns ErrorStoreFull,
+// without adding the entry, when the store already holds capacity entries. entries that are queued for retry
+// are not counted.
+// ids are derived from the time in nanoseconds when entries are added, so that they are unique across nodes
+func Add(entry *Entry, capacity int) error {
+	s, err := getStore(entry.ReplicationId)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.entries) >= capacity {
+		return ErrorStoreFull
+	}
+	id := uint64(time.Now().UnixNano())
+	if id <= s.next_id {
+		id = s.next_id + 1
+	}
+	entry.Id = id
+	if err = s.persist(entry); err != nil {
+		return fmt.Errorf("Failed to persist dead-letter entry. err=%v", err)
+	}
+	s.next_id = id
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+// returns up to limit of the entries of a replication on the current node, oldest first, skipping the first
+// offset ones, and the total number of entries
+func List(replicationId string, offset, limit int) ([]*Entry, int, error) {
+	s, err := getStore(replicationId)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	total := len(s.entries)
+	if offset >= total {
+		return []*Entry{}, total, nil
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	result := make([]*Entry, end-offset)
+	copy(result, s.entries[offset:end])
+	return result, total, nil
+}
+
+// moves the entries with the given ids, or all entries when ids is empty, out of the store
+// and queues them for retry. returns the number of entries queued.
+// the entries stay on disk until they are taken for resending
+func Retry(replicationId string, ids []uint64) (int, error) {
+	s, err := getStore(replicationId)
+	if err != nil {
+		return 0, err
+	}
+
+	id_set := make(map[uint64]bool)
+	for _, id := range ids {
+		id_set[id] = true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	remaining := make([]*Entry, 0, len(s.entries))
+	count := 0
+	for _, entry := range s.entries {
+		if len(ids) == 0 || id_set[entry.Id] {
+			s.retries = append(s.retries, entry)
+			count++
+		} else {
+			remaining = append(remaining, entry)
+		}
+	}
+	s.entries = remaining
+	return count, nil
+}
+
+// returns and removes the entries queued for retry whose source vbuckets are in vbs, which are then resent by
+// the calling nozzle. entries of other vbuckets, which the pipeline on this node does not own, e.g., after
+// rebalance, stay queued, since their seqnos cannot be tracked by the pipeline.
+// the entries are removed from disk, and go back into the store if target rejects them again
+func TakeRetries(replicationId string, vbs map[uint16]bool) []*Entry {
+	store_map_lock.RLock()
+	s, ok := store_map[replicationId]
+	store_map_lock.RUnlock()
+	if !ok {
+		// nothing can have been queued before the store is loaded
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var entries []*Entry
+	var remaining []*Entry
+	for _, entry := range s.retries {
+		if vbs[entry.VBucket] {
+			entries = append(entries, entry)
+		} else {
+			remaining = append(remaining, entry)
+		}
+	}
+	s.retries = remaining
+	for _, entry := range entries {
+		if err := os.Remove(s.entryPath(entry.Id)); err != nil && !os.IsNotExist(err) {
+			logger_dl.Errorf("Failed to remove dead-letter entry %v of %v. err=%v\n", entry.Id, replicationId, err)
+		}
+	}
+	return entries
+}
+
+// discards the dead-letter entries of a replication, including the persisted ones
+func Remove(replicationId string) {
+	store_map_lock.Lock()
+	defer store_map_lock.Unlock()
+	delete(store_map, replicationId)
+	dir, err := storeDir(replicationId)
+	if err != nil {
+		return
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		logger_dl.Errorf("Failed to remove dead-letter entries of %v. err=%v\n", replicationId, err)
+	}
+}
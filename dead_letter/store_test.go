@@ -0,0 +1,216 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package dead_letter
+
+import (
+	"bytes"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testReplicationId = "uuid/source/target"
+
+// source vbuckets of the pipeline, which include the vbucket of test entries
+var testVBs = map[uint16]bool{3: true, 4: true}
+
+// points the xdcr data dir to a temp dir, and returns the function that restores it
+func setupTestDataDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "dead_letter")
+	if err != nil {
+		t.Fatalf("failed to create temp dir. err=%v", err)
+	}
+	oldDataDir := base.XDCRDataDir
+	base.XDCRDataDir = dir
+	return func() {
+		Remove(testReplicationId)
+		base.XDCRDataDir = oldDataDir
+		os.RemoveAll(dir)
+	}
+}
+
+// simulates xdcr restart, after which stores are loaded from disk
+func forgetTestStores() {
+	store_map_lock.Lock()
+	defer store_map_lock.Unlock()
+	store_map = make(map[string]*store)
+}
+
+func newTestEntry(key string, seqno uint64) *Entry {
+	extras := make([]byte, 24)
+	extras[15] = byte(seqno)
+	req := &base.WrappedMCRequest{Seqno: seqno,
+		Src_vbno: 3,
+		CRMode:   base.CRMode_LWW,
+		Req: &mc.MCRequest{Opcode: base.SET_WITH_META,
+			VBucket:  7,
+			Key:      []byte(key),
+			Body:     []byte(`{"big":true}`),
+			Extras:   extras,
+			DataType: base.SnappyDataType,
+		},
+	}
+	return NewEntry(testReplicationId, "xmem_0", req, "E2BIG")
+}
+
+func addTestEntries(t *testing.T, count int) []*Entry {
+	entries := make([]*Entry, count)
+	for i := range entries {
+		entries[i] = newTestEntry(fmt.Sprintf("doc%v", i), uint64(i+1))
+		if err := Add(entries[i], 100); err != nil {
+			t.Fatalf("failed to add entry. err=%v", err)
+		}
+	}
+	return entries
+}
+
+func entryFiles(t *testing.T) []string {
+	dir, _ := storeDir(testReplicationId)
+	files, err := filepath.Glob(filepath.Join(dir, "*"+entryFileSuffix))
+	if err != nil {
+		t.Fatalf("failed to list entry files. err=%v", err)
+	}
+	return files
+}
+
+func TestStoreAddAndList(t *testing.T) {
+	defer setupTestDataDir(t)()
+
+	entries := addTestEntries(t, 5)
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Id <= entries[i-1].Id {
+			t.Errorf("expected ids to be increasing, got %v after %v", entries[i].Id, entries[i-1].Id)
+		}
+	}
+	listed, total, err := List(testReplicationId, 1, 3)
+	if err != nil || total != 5 || len(listed) != 3 || listed[0] != entries[1] || listed[2] != entries[3] {
+		t.Errorf("unexpected listing total=%v entries=%v err=%v", total, listed, err)
+	}
+	if listed, total, _ = List(testReplicationId, 10, 3); total != 5 || len(listed) != 0 {
+		t.Errorf("expected no entries beyond total, got %v", listed)
+	}
+	if len(entryFiles(t)) != 5 {
+		t.Errorf("expected 5 entries to be persisted, got %v", entryFiles(t))
+	}
+
+	// full store
+	if err = Add(newTestEntry("doc5", 6), 5); err != ErrorStoreFull {
+		t.Errorf("expected full store error, got %v", err)
+	}
+	if len(entryFiles(t)) != 5 {
+		t.Errorf("expected the rejected entry not to be persisted")
+	}
+}
+
+func TestStoreAddWithoutDataDir(t *testing.T) {
+	oldDataDir := base.XDCRDataDir
+	base.XDCRDataDir = ""
+	defer func() { base.XDCRDataDir = oldDataDir }()
+	forgetTestStores()
+
+	if err := Add(newTestEntry("doc0", 1), 100); err == nil {
+		t.Errorf("expected entry not to be added when it cannot be persisted")
+	}
+}
+
+func TestStoreReload(t *testing.T) {
+	defer setupTestDataDir(t)()
+
+	entries := addTestEntries(t, 3)
+	if queued, err := Retry(testReplicationId, []uint64{entries[2].Id}); err != nil || queued != 1 {
+		t.Fatalf("expected 1 entry to be queued, got %v. err=%v", queued, err)
+	}
+	// a partially written entry is skipped
+	dir, _ := storeDir(testReplicationId)
+	ioutil.WriteFile(filepath.Join(dir, "123"+entryFileSuffix+".tmp"), []byte("{"), 0600)
+
+	forgetTestStores()
+	listed, total, err := List(testReplicationId, 0, 10)
+	// the entry that was queued for retry, but not taken, is back in the store
+	if err != nil || total != 3 {
+		t.Fatalf("expected 3 entries to be loaded, got %v. err=%v", total, err)
+	}
+	for i, entry := range listed {
+		if entry.Id != entries[i].Id || entry.Key != entries[i].Key || entry.Seqno != entries[i].Seqno ||
+			entry.VBucket != 3 || entry.Error != "E2BIG" || entry.NozzleId != "xmem_0" {
+			t.Errorf("unexpected loaded entry %+v", entry)
+		}
+		req := entry.Request()
+		orig := entries[i].Request()
+		if req.Req.Opcode != orig.Req.Opcode || req.Req.VBucket != 7 || !bytes.Equal(req.Req.Key, orig.Req.Key) ||
+			!bytes.Equal(req.Req.Body, orig.Req.Body) || !bytes.Equal(req.Req.Extras, orig.Req.Extras) ||
+			req.Req.DataType != base.SnappyDataType || req.CRMode != base.CRMode_LWW || req.Src_vbno != 3 {
+			t.Errorf("unexpected loaded request %+v", req.Req)
+		}
+	}
+
+	// ids of new entries follow the loaded ones
+	entry := newTestEntry("doc3", 4)
+	if err = Add(entry, 100); err != nil || entry.Id <= entries[2].Id {
+		t.Errorf("expected new id to follow %v, got %v. err=%v", entries[2].Id, entry.Id, err)
+	}
+}
+
+func TestStoreRetry(t *testing.T) {
+	defer setupTestDataDir(t)()
+
+	entries := addTestEntries(t, 4)
+	if queued, _ := Retry(testReplicationId, []uint64{entries[1].Id, entries[3].Id, 12345}); queued != 2 {
+		t.Errorf("expected 2 entries to be queued, got %v", queued)
+	}
+	if listed, total, _ := List(testReplicationId, 0, 10); total != 2 || listed[0] != entries[0] || listed[1] != entries[2] {
+		t.Errorf("expected queued entries to be out of store, got %v", listed)
+	}
+	// queued entries stay on disk until they are taken
+	if len(entryFiles(t)) != 4 {
+		t.Errorf("expected 4 entry files, got %v", entryFiles(t))
+	}
+
+	// entries of vbuckets that the pipeline does not own stay queued
+	if retries := TakeRetries(testReplicationId, map[uint16]bool{2: true}); len(retries) != 0 {
+		t.Errorf("expected no retries of vbuckets that are not owned, got %v", retries)
+	}
+	retries := TakeRetries(testReplicationId, testVBs)
+	if len(retries) != 2 || retries[0] != entries[1] || retries[1] != entries[3] {
+		t.Errorf("unexpected retries %v", retries)
+	}
+	if len(TakeRetries(testReplicationId, testVBs)) != 0 {
+		t.Errorf("expected retries to be taken once")
+	}
+	if len(entryFiles(t)) != 2 {
+		t.Errorf("expected taken entries to be removed from disk, got %v", entryFiles(t))
+	}
+
+	// all entries
+	if queued, _ := Retry(testReplicationId, nil); queued != 2 {
+		t.Errorf("expected all entries to be queued, got %v", queued)
+	}
+	if len(TakeRetries(testReplicationId, testVBs)) != 2 || len(entryFiles(t)) != 0 {
+		t.Errorf("expected all entries to be taken")
+	}
+}
+
+func TestStoreRemove(t *testing.T) {
+	defer setupTestDataDir(t)()
+
+	addTestEntries(t, 2)
+	Remove(testReplicationId)
+	dir, _ := storeDir(testReplicationId)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected persisted entries to be removed. err=%v", err)
+	}
+	if _, total, _ := List(testReplicationId, 0, 10); total != 0 {
+		t.Errorf("expected no entries after removal, got %v", total)
+	}
+}
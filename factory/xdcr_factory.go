@@ -8,6 +8,8 @@ import (
 	"github.com/couchbase/goxdcr/capi_utils"
 	"github.com/couchbase/goxdcr/common"
 	component "github.com/couchbase/goxdcr/component"
+	"github.com/couchbase/goxdcr/dcp_record"
+	"github.com/couchbase/goxdcr/key_rewrite"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/metadata"
 	"github.com/couchbase/goxdcr/parts"
@@ -22,15 +24,20 @@ import (
 	"github.com/couchbase/goxdcr/supervisor"
 	"github.com/couchbase/goxdcr/utils"
 	"math"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"time"
 )
 
 const (
 	PART_NAME_DELIMITER     = "_"
-	DCP_NOZZLE_NAME_PREFIX  = "dcp"
-	XMEM_NOZZLE_NAME_PREFIX = "xmem"
-	CAPI_NOZZLE_NAME_PREFIX = "capi"
+	DCP_NOZZLE_NAME_PREFIX        = "dcp"
+	DCP_REPLAY_NOZZLE_NAME_PREFIX = "dcpreplay"
+	XMEM_NOZZLE_NAME_PREFIX       = "xmem"
+	CAPI_NOZZLE_NAME_PREFIX       = "capi"
+	FILE_NOZZLE_NAME_PREFIX       = "file"
+	WEBHOOK_NOZZLE_NAME_PREFIX    = "webhook"
 )
 
 // errors
@@ -105,25 +112,38 @@ func (xdcrf *XDCRFactory) NewPipeline(topic string, progress_recorder common.Pip
 		return nil, err
 	}
 	sourceBucketPassword := sourceBucket.Password
+	numSourceVBs := len(sourceBucket.VBServerMap().VBucketMap)
 	sourceBucket.Close()
 
-	targetClusterRef, err := xdcrf.remote_cluster_svc.RemoteClusterByUuid(spec.TargetClusterUUID, true)
-	if err != nil {
-		xdcrf.logger.Errorf("Error getting remote cluster with uuid=%v for pipeline %v, err=%v\n", spec.TargetClusterUUID, spec.Id, err)
-		return nil, err
-	}
+	// replications of file and webhook types have neither target cluster nor target bucket
+	var targetClusterRef *metadata.RemoteClusterReference
+	var targetBucket *couchbase.Bucket
+	var sourceCRMode base.ConflictResolutionMode
+	// docs go to vbs on target with the same vbnos as on source, unless they are remapped
+	var vbsRemapped bool
+	var numTargetVBs int
+	if spec.HasTargetCluster() {
+		targetClusterRef, err = xdcrf.remote_cluster_svc.RemoteClusterByUuid(spec.TargetClusterUUID, true)
+		if err != nil {
+			xdcrf.logger.Errorf("Error getting remote cluster with uuid=%v for pipeline %v, err=%v\n", spec.TargetClusterUUID, spec.Id, err)
+			return nil, err
+		}
 
-	targetBucket, err := xdcrf.cluster_info_svc.GetBucket(targetClusterRef, spec.TargetBucketName)
-	if err != nil || targetBucket == nil {
-		xdcrf.logger.Errorf("Error getting target bucket %v, err=%v\n", spec.TargetBucketName, err)
-		return nil, err
-	}
-	defer targetBucket.Close()
+		targetBucket, err = xdcrf.cluster_info_svc.GetBucket(targetClusterRef, spec.TargetBucketName)
+		if err != nil || targetBucket == nil {
+			xdcrf.logger.Errorf("Error getting target bucket %v, err=%v\n", spec.TargetBucketName, err)
+			return nil, err
+		}
+		defer targetBucket.Close()
 
-	// sourceCRMode is the conflict resolution mode to use when resolving conflicts for big documents at source side
-	// sourceCRMode is LWW if and only if target bucket is LWW enabled, so as to ensure that source side conflict
-	// resolution and target side conflict resolution yield consistent results
-	sourceCRMode := simple_utils.GetCRModeFromTimeSyncSetting(targetBucket.TimeSynchronization)
+		// sourceCRMode is the conflict resolution mode to use when resolving conflicts for big documents at source side
+		// sourceCRMode is LWW if and only if target bucket is LWW enabled, so as to ensure that source side conflict
+		// resolution and target side conflict resolution yield consistent results
+		sourceCRMode = simple_utils.GetCRModeFromTimeSyncSetting(targetBucket.TimeSynchronization)
+
+		numTargetVBs = len(targetBucket.VBServerMap().VBucketMap)
+		vbsRemapped = key_rewrite.VBsRemapped(spec.Settings.KeyRewriteRules, numSourceVBs, numTargetVBs)
+	}
 
 	xdcrf.logger.Infof("%v extMetaSupported=%v, sourceCRMode=%v\n", topic, extMetaSupported, sourceCRMode)
 
@@ -140,32 +160,59 @@ func (xdcrf *XDCRFactory) NewPipeline(topic string, progress_recorder common.Pip
 	progress_recorder(fmt.Sprintf("%v source nozzles have been constructed", len(sourceNozzles)))
 
 	xdcrf.logger.Infof("%v kv_vb_map=%v\n", topic, kv_vb_map)
-	outNozzles, vbNozzleMap, err := xdcrf.constructOutgoingNozzles(spec, kv_vb_map, extMetaSupported, sourceCRMode, targetBucket, targetClusterRef, logger_ctx)
+	var outNozzles map[string]common.Nozzle
+	var vbNozzleMap map[uint16]string
+	if !spec.HasTargetCluster() {
+		outNozzles, vbNozzleMap, err = xdcrf.constructExportNozzles(spec, kv_vb_map, logger_ctx)
+	} else {
+		xdcrf.logger.Infof("%v numSourceVBs=%v, numTargetVBs=%v, vbsRemapped=%v\n", topic, numSourceVBs, numTargetVBs, vbsRemapped)
+		outNozzles, vbNozzleMap, err = xdcrf.constructOutgoingNozzles(spec, kv_vb_map, vbsRemapped, extMetaSupported, sourceCRMode, targetBucket, targetClusterRef, logger_ctx)
+	}
 	if err != nil {
 		return nil, err
 	}
 	progress_recorder(fmt.Sprintf("%v target nozzles have been constructed", len(outNozzles)))
 
+	// the bandwidth limit of the replication is shared by the target nozzles on this node,
+	// which get the share of it that corresponds to the share of source vbuckets on this node
+	bandwidth_throttler := parts.NewBandwidthThrottler(nodeShareOfVBs(kv_vb_map, numSourceVBs))
+	for _, outNozzle := range outNozzles {
+		outNozzle.(parts.BandwidthThrottledNozzle).SetBandwidthThrottler(bandwidth_throttler)
+	}
+
 	// TODO construct queue parts. This will affect vbMap in router. may need an additional outNozzle -> downStreamPart/queue map in constructRouter
 
 	// connect parts
 	for _, sourceNozzle := range sourceNozzles {
-		vblist := sourceNozzle.(*parts.DcpNozzle).GetVBList()
+		vblist := sourceNozzle.(parts.SourceNozzle).GetVBList()
 		downStreamParts := make(map[string]common.Part)
-		for _, vb := range vblist {
-			targetNozzleId, ok := vbNozzleMap[vb]
-			if !ok {
-				return nil, fmt.Errorf("Error constructing pipeline %v since there is no target nozzle for vb=%v", topic, vb)
+		if vbsRemapped {
+			// docs from any source vb may belong to any vb on target, hence any out nozzle could be downstream.
+			// source vbs need not exist on target
+			for targetNozzleId, outNozzle := range outNozzles {
+				downStreamParts[targetNozzleId] = outNozzle
 			}
+		} else {
+			for _, vb := range vblist {
+				targetNozzleId, ok := vbNozzleMap[vb]
+				if !ok {
+					return nil, fmt.Errorf("Error constructing pipeline %v since there is no target nozzle for vb=%v", topic, vb)
+				}
 
-			outNozzle, ok := outNozzles[targetNozzleId]
-			if !ok {
-				panic(fmt.Sprintf("%v There is no corresponding target nozzle for vb=%v, targetNozzleId=%v", topic, vb, targetNozzleId))
+				outNozzle, ok := outNozzles[targetNozzleId]
+				if !ok {
+					panic(fmt.Sprintf("%v There is no corresponding target nozzle for vb=%v, targetNozzleId=%v", topic, vb, targetNozzleId))
+				}
+				downStreamParts[targetNozzleId] = outNozzle
 			}
-			downStreamParts[targetNozzleId] = outNozzle
 		}
 
-		router, err := xdcrf.constructRouter(sourceNozzle.Id(), spec, downStreamParts, vbNozzleMap, extMetaSupported, logger_ctx)
+		// the router moves docs to the vbs that their keys belong to on target only when vbs are remapped
+		routerNumTargetVBs := 0
+		if vbsRemapped {
+			routerNumTargetVBs = numTargetVBs
+		}
+		router, err := xdcrf.constructRouter(sourceNozzle.Id(), spec, downStreamParts, vbNozzleMap, routerNumTargetVBs, extMetaSupported, logger_ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -185,7 +232,7 @@ func (xdcrf *XDCRFactory) NewPipeline(topic string, progress_recorder common.Pip
 
 		//register services
 		pipeline.SetRuntimeContext(pipelineContext)
-		err = xdcrf.registerServices(pipeline, logger_ctx, kv_vb_map)
+		err = xdcrf.registerServices(pipeline, logger_ctx, kv_vb_map, vbsRemapped)
 		if err != nil {
 			return nil, err
 		}
@@ -205,6 +252,11 @@ func (xdcrf *XDCRFactory) NewPipeline(topic string, progress_recorder common.Pip
 // when ext metadata is not supported, replication would not request ext metadata from dcp
 // or add ext metadata to MCRequest
 func (xdcrf *XDCRFactory) isExtMetaSupported(spec *metadata.ReplicationSpecification) (bool, error) {
+	// files and webhooks do not keep ext metadata
+	if !spec.HasTargetCluster() {
+		return false, nil
+	}
+
 	// first check if replication is of CAPI type, which does not support lww
 	targetClusterRef, err := xdcrf.remote_cluster_svc.RemoteClusterByUuid(spec.TargetClusterUUID, true)
 	if err != nil {
@@ -296,12 +348,20 @@ func (xdcrf *XDCRFactory) registerAsyncListenersOnTargets(pipeline common.Pipeli
 		get_meta_received_event_listener := component.NewDefaultAsyncComponentEventListenerImpl(
 			pipeline_utils.GetElementIdFromNameAndIndex(pipeline, base.GetMetaReceivedEventListener, i),
 			pipeline.Topic(), logger_ctx)
+		data_deduped_event_listener := component.NewDefaultAsyncComponentEventListenerImpl(
+			pipeline_utils.GetElementIdFromNameAndIndex(pipeline, base.DataDedupedEventListener, i),
+			pipeline.Topic(), logger_ctx)
+		data_dead_lettered_event_listener := component.NewDefaultAsyncComponentEventListenerImpl(
+			pipeline_utils.GetElementIdFromNameAndIndex(pipeline, base.DataDeadLetteredEventListener, i),
+			pipeline.Topic(), logger_ctx)
 
 		for index := load_distribution[i][0]; index < load_distribution[i][1]; index++ {
 			out_nozzle := targets[index]
 			out_nozzle.RegisterComponentEventListener(common.DataSent, data_sent_event_listener)
 			out_nozzle.RegisterComponentEventListener(common.DataFailedCRSource, data_failed_cr_event_listener)
 			out_nozzle.RegisterComponentEventListener(common.GetMetaReceived, get_meta_received_event_listener)
+			out_nozzle.RegisterComponentEventListener(common.DataDeduped, data_deduped_event_listener)
+			out_nozzle.RegisterComponentEventListener(common.DataDeadLettered, data_dead_lettered_event_listener)
 		}
 	}
 }
@@ -312,6 +372,10 @@ func (xdcrf *XDCRFactory) constructSourceNozzles(spec *metadata.ReplicationSpeci
 	extMetaSupported bool,
 	bucketPassword string,
 	logger_ctx *log.LoggerContext) (map[string]common.Nozzle, map[string][]uint16, error) {
+	if len(spec.Settings.DcpReplayDir) > 0 {
+		return xdcrf.constructReplaySourceNozzles(spec, logger_ctx)
+	}
+
 	sourceNozzles := make(map[string]common.Nozzle)
 
 	bucketName := spec.SourceBucketName
@@ -358,6 +422,100 @@ func (xdcrf *XDCRFactory) constructSourceNozzles(spec *metadata.ReplicationSpeci
 	return sourceNozzles, kv_vb_map, nil
 }
 
+// construct source nozzles that replay the dcp recordings in the replay directory of the replication,
+// one for each recording of the source bucket. kv_vb_map is constructed from the recordings
+func (xdcrf *XDCRFactory) constructReplaySourceNozzles(spec *metadata.ReplicationSpecification,
+	logger_ctx *log.LoggerContext) (map[string]common.Nozzle, map[string][]uint16, error) {
+	sourceNozzles := make(map[string]common.Nozzle)
+	kv_vb_map := make(map[string][]uint16)
+
+	replayDir, err := simple_utils.PathUnderRoot(spec.Settings.DcpReplayDir, base.XDCRDataDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid dcp replay directory %v. err=%v", spec.Settings.DcpReplayDir, err)
+	}
+	paths, err := filepath.Glob(filepath.Join(replayDir, "*"+dcp_record.FileExtension))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		// recordings cannot be links to files elsewhere
+		if _, err = simple_utils.PathUnderRoot(path, base.XDCRDataDir); err != nil {
+			return nil, nil, fmt.Errorf("Invalid dcp recording %v. err=%v", path, err)
+		}
+	}
+	paths = xdcrf.latestRecordings(spec, paths)
+
+	// vb -> recording that contains the vb
+	vb_path_map := make(map[uint16]string)
+	// kvaddr -> number of replay nozzles for the kvaddr
+	nozzle_index_map := make(map[string]int)
+	for _, path := range paths {
+		header, err := dcp_record.ReadHeader(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.BucketName != spec.SourceBucketName {
+			xdcrf.logger.Infof("topic=%v, skipping dcp recording %v of bucket %v\n", spec.Id, path, header.BucketName)
+			continue
+		}
+		if len(header.VBList) == 0 {
+			continue
+		}
+		for _, vbno := range header.VBList {
+			if existing_path, ok := vb_path_map[vbno]; ok {
+				return nil, nil, fmt.Errorf("Invalid dcp recordings in %v. vb=%v is in both %v and %v", replayDir, vbno, existing_path, path)
+			}
+			vb_path_map[vbno] = path
+		}
+
+		kv_vb_map[header.KVAddr] = append(kv_vb_map[header.KVAddr], header.VBList...)
+
+		// partIds of the replay nozzles look like "dcpreplay_$topic_$kvaddr_1"
+		id := xdcrf.partId(DCP_REPLAY_NOZZLE_NAME_PREFIX, spec.Id, header.KVAddr, nozzle_index_map[header.KVAddr])
+		nozzle_index_map[header.KVAddr]++
+		replayNozzle := parts.NewDcpReplayNozzle(id, path, header.VBList, logger_ctx)
+		sourceNozzles[replayNozzle.Id()] = replayNozzle
+		xdcrf.logger.Infof("Constructed replay source nozzle %v with vbList = %v from %v\n", replayNozzle.Id(), header.VBList, path)
+	}
+
+	if len(sourceNozzles) == 0 {
+		xdcrf.logger.Errorf("topic=%v, no dcp recording of bucket %v is found in %v\n", spec.Id, spec.SourceBucketName, replayDir)
+	}
+
+	return sourceNozzles, kv_vb_map, nil
+}
+
+// a dcp nozzle records into a new file each time it starts. only the latest recording of each nozzle is replayed,
+// since the earlier ones cover the same vbs. recordings that are not named after nozzles are all replayed
+func (xdcrf *XDCRFactory) latestRecordings(spec *metadata.ReplicationSpecification, paths []string) []string {
+	latest_paths := []string{}
+	// nozzle name -> index of its latest recording in latest_paths
+	nozzle_index_map := make(map[string]int)
+	// nozzle name -> sequence number of its latest recording
+	nozzle_seq_map := make(map[string]int)
+	for _, path := range paths {
+		nozzleName, seq, ok := dcp_record.ParseFileName(filepath.Base(path))
+		if !ok {
+			latest_paths = append(latest_paths, path)
+			continue
+		}
+		index, found := nozzle_index_map[nozzleName]
+		if !found {
+			nozzle_index_map[nozzleName] = len(latest_paths)
+			nozzle_seq_map[nozzleName] = seq
+			latest_paths = append(latest_paths, path)
+		} else if seq > nozzle_seq_map[nozzleName] {
+			xdcrf.logger.Infof("topic=%v, skipping dcp recording %v, which is older than %v\n", spec.Id, latest_paths[index], path)
+			nozzle_seq_map[nozzleName] = seq
+			latest_paths[index] = path
+		} else {
+			xdcrf.logger.Infof("topic=%v, skipping dcp recording %v, which is older than %v\n", spec.Id, path, latest_paths[index])
+		}
+	}
+	return latest_paths
+}
+
 func (xdcrf *XDCRFactory) partId(prefix string, topic string, kvaddr string, index int) string {
 	return prefix + PART_NAME_DELIMITER + topic + PART_NAME_DELIMITER + kvaddr + PART_NAME_DELIMITER + strconv.Itoa(index)
 }
@@ -378,7 +536,7 @@ func (xdcrf *XDCRFactory) filterVBList(targetkvVBList []uint16, kv_vb_map map[st
 }
 
 func (xdcrf *XDCRFactory) constructOutgoingNozzles(spec *metadata.ReplicationSpecification, kv_vb_map map[string][]uint16,
-	extMetaSupported bool, sourceCRMode base.ConflictResolutionMode, targetBucket *couchbase.Bucket, targetClusterRef *metadata.RemoteClusterReference, logger_ctx *log.LoggerContext) (map[string]common.Nozzle, map[uint16]string, error) {
+	vbsRemapped bool, extMetaSupported bool, sourceCRMode base.ConflictResolutionMode, targetBucket *couchbase.Bucket, targetClusterRef *metadata.RemoteClusterReference, logger_ctx *log.LoggerContext) (map[string]common.Nozzle, map[uint16]string, error) {
 	outNozzles := make(map[string]common.Nozzle)
 	vbNozzleMap := make(map[uint16]string)
 
@@ -415,7 +573,13 @@ func (xdcrf *XDCRFactory) constructOutgoingNozzles(spec *metadata.ReplicationSpe
 			}
 		}
 
-		relevantVBs := xdcrf.filterVBList(kvVBList, kv_vb_map)
+		var relevantVBs []uint16
+		if vbsRemapped {
+			// when vbs are remapped, docs from source vbs can go to any vb on target
+			relevantVBs = kvVBList
+		} else {
+			relevantVBs = xdcrf.filterVBList(kvVBList, kv_vb_map)
+		}
 
 		xdcrf.logger.Debugf("kvaddr = %v; kvVbList=%v, relevantVBs=-%v\n", kvaddr, kvVBList, relevantVBs)
 
@@ -461,13 +625,74 @@ func (xdcrf *XDCRFactory) constructOutgoingNozzles(spec *metadata.ReplicationSpe
 	return outNozzles, vbNozzleMap, nil
 }
 
+// constructs the outgoing nozzles of a replication of file or webhook type, which export the change stream
+// of the source vbuckets on this node into files on this node or to the webhook url respectively
+func (xdcrf *XDCRFactory) constructExportNozzles(spec *metadata.ReplicationSpecification, kv_vb_map map[string][]uint16,
+	logger_ctx *log.LoggerContext) (map[string]common.Nozzle, map[uint16]string, error) {
+	outNozzles := make(map[string]common.Nozzle)
+	vbNozzleMap := make(map[uint16]string)
+
+	nozzleType, err := xdcrf.getOutNozzleType(nil, spec)
+	if err != nil {
+		xdcrf.logger.Errorf("Failed to get the nozzle type, err=%v\n", err)
+		return nil, nil, err
+	}
+
+	hostAddr, err := xdcrf.xdcr_topology_svc.MyHostAddr()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// docs stay in their source vbs, even when their keys are rewritten
+	relevantVBs := make([]uint16, 0)
+	for _, vbList := range kv_vb_map {
+		relevantVBs = append(relevantVBs, vbList...)
+	}
+	simple_utils.SortUint16List(relevantVBs)
+	if len(relevantVBs) == 0 {
+		return nil, nil, ErrorNoTargetNozzle
+	}
+
+	numOfVbs := len(relevantVBs)
+	numOfOutNozzles := min(numOfVbs, spec.Settings.TargetNozzlePerNode)
+	load_distribution := simple_utils.BalanceLoad(numOfOutNozzles, numOfVbs)
+	xdcrf.logger.Infof("topic=%v, numOfOutNozzles=%v, numOfVbs=%v, load_distribution=%v\n", spec.Id, numOfOutNozzles, numOfVbs, load_distribution)
+
+	for i := 0; i < numOfOutNozzles; i++ {
+		vbList := make([]uint16, 0)
+		for index := load_distribution[i][0]; index < load_distribution[i][1]; index++ {
+			vbList = append(vbList, relevantVBs[index])
+		}
+
+		// partIds of the nozzles look like "file_$topic_$hostaddr_1" or "webhook_$topic_$hostaddr_1"
+		var outNozzle common.Nozzle
+		if nozzleType == base.Webhook {
+			webhookNozzle_Id := xdcrf.partId(WEBHOOK_NOZZLE_NAME_PREFIX, spec.Id, hostAddr, i)
+			outNozzle = parts.NewWebhookNozzle(webhookNozzle_Id, spec.Id, pipeline_manager.RecycleMCRequestObj, logger_ctx)
+		} else {
+			fileNozzle_Id := xdcrf.partId(FILE_NOZZLE_NAME_PREFIX, spec.Id, hostAddr, i)
+			outNozzle = parts.NewFileNozzle(fileNozzle_Id, spec.Id, pipeline_manager.RecycleMCRequestObj, logger_ctx)
+		}
+		outNozzles[outNozzle.Id()] = outNozzle
+
+		for _, vbno := range vbList {
+			vbNozzleMap[vbno] = outNozzle.Id()
+		}
+	}
+
+	xdcrf.logger.Infof("Constructed %v %v nozzles\n", len(outNozzles), spec.Settings.RepType)
+	xdcrf.logger.Debugf("vbNozzleMap = %v\n", vbNozzleMap)
+	return outNozzles, vbNozzleMap, nil
+}
+
 func (xdcrf *XDCRFactory) constructRouter(id string, spec *metadata.ReplicationSpecification,
 	downStreamParts map[string]common.Part,
 	vbNozzleMap map[uint16]string,
+	numTargetVBs int,
 	extMetaSupported bool,
 	logger_ctx *log.LoggerContext) (*parts.Router, error) {
 	routerId := "Router" + PART_NAME_DELIMITER + id
-	router, err := parts.NewRouter(routerId, spec.Id, spec.Settings.FilterExpression, downStreamParts, vbNozzleMap, logger_ctx, pipeline_manager.NewMCRequestObj, extMetaSupported)
+	router, err := parts.NewRouter(routerId, spec.Id, spec.Settings.FilterExpression, spec.Settings.FilterBodyExpression, spec.Settings.FilterDeletions, spec.Settings.FilterExpirations, spec.Settings.KeyRewriteRules, numTargetVBs, downStreamParts, vbNozzleMap, logger_ctx, pipeline_manager.NewMCRequestObj, extMetaSupported)
 	xdcrf.logger.Infof("Constructed router %v", routerId)
 	return router, err
 }
@@ -487,6 +712,10 @@ func (xdcrf *XDCRFactory) getOutNozzleType(targetClusterRef *metadata.RemoteClus
 		}
 	case metadata.ReplicationTypeCapi:
 		return base.Capi, nil
+	case metadata.ReplicationTypeFile:
+		return base.File, nil
+	case metadata.ReplicationTypeWebhook:
+		return base.Webhook, nil
 	default:
 		// should never get here
 		return -1, errors.New(fmt.Sprintf("Invalid replication type %v", spec.Settings.RepType))
@@ -548,9 +777,18 @@ func (xdcrf *XDCRFactory) ConstructSettingsForPart(pipeline common.Pipeline, par
 	} else if _, ok := part.(*parts.DcpNozzle); ok {
 		xdcrf.logger.Debugf("Construct settings for DcpNozzle %s", part.Id())
 		return xdcrf.constructSettingsForDcpNozzle(pipeline, part.(*parts.DcpNozzle), settings)
+	} else if _, ok := part.(*parts.DcpReplayNozzle); ok {
+		xdcrf.logger.Debugf("Construct settings for DcpReplayNozzle %s", part.Id())
+		return xdcrf.constructSettingsForDcpReplayNozzle(pipeline, settings)
 	} else if _, ok := part.(*parts.CapiNozzle); ok {
 		xdcrf.logger.Debugf("Construct settings for CapiNozzle %s", part.Id())
 		return xdcrf.constructSettingsForCapiNozzle(pipeline, settings)
+	} else if _, ok := part.(*parts.FileNozzle); ok {
+		xdcrf.logger.Debugf("Construct settings for FileNozzle %s", part.Id())
+		return xdcrf.constructSettingsForFileNozzle(pipeline, settings)
+	} else if _, ok := part.(*parts.WebhookNozzle); ok {
+		xdcrf.logger.Debugf("Construct settings for WebhookNozzle %s", part.Id())
+		return xdcrf.constructSettingsForWebhookNozzle(pipeline, settings)
 	} else {
 		return settings, nil
 	}
@@ -564,6 +802,12 @@ func (xdcrf *XDCRFactory) ConstructUpdateSettingsForPart(pipeline common.Pipelin
 	} else if _, ok := part.(*parts.CapiNozzle); ok {
 		xdcrf.logger.Debugf("Construct update settings for CapiNozzle %s", part.Id())
 		return xdcrf.constructUpdateSettingsForCapiNozzle(pipeline, settings), nil
+	} else if _, ok := part.(*parts.FileNozzle); ok {
+		xdcrf.logger.Debugf("Construct update settings for FileNozzle %s", part.Id())
+		return xdcrf.constructUpdateSettingsForFileNozzle(pipeline, settings), nil
+	} else if _, ok := part.(*parts.WebhookNozzle); ok {
+		xdcrf.logger.Debugf("Construct update settings for WebhookNozzle %s", part.Id())
+		return xdcrf.constructUpdateSettingsForWebhookNozzle(pipeline, settings), nil
 	} else {
 		return settings, nil
 	}
@@ -574,6 +818,11 @@ func (xdcrf *XDCRFactory) constructUpdateSettingsForXmemNozzle(pipeline common.P
 	repSettings := pipeline.Specification().Settings
 
 	xmemSettings[parts.SETTING_OPTI_REP_THRESHOLD] = getSettingFromSettingsMap(settings, metadata.OptimisticReplicationThreshold, repSettings.OptimisticReplicationThreshold)
+	xmemSettings[parts.XMEM_SETTING_DEDUP_IN_BATCH] = getSettingFromSettingsMap(settings, metadata.DedupInBatch, repSettings.DedupInBatch)
+	xdcrf.constructAdaptiveBatchingSettings(xmemSettings, repSettings, settings)
+	xmemSettings[parts.SETTING_BANDWIDTH_LIMIT] = getSettingFromSettingsMap(settings, metadata.BandwidthLimit, repSettings.BandwidthLimit)
+	xmemSettings[parts.XMEM_SETTING_DEAD_LETTER] = getSettingFromSettingsMap(settings, metadata.DeadLetterEnabled, repSettings.DeadLetterEnabled)
+	xmemSettings[parts.XMEM_SETTING_DEAD_LETTER_CAP] = getSettingFromSettingsMap(settings, metadata.DeadLetterCap, repSettings.DeadLetterCap)
 	return xmemSettings
 
 }
@@ -583,9 +832,26 @@ func (xdcrf *XDCRFactory) constructUpdateSettingsForCapiNozzle(pipeline common.P
 	repSettings := pipeline.Specification().Settings
 
 	capiSettings[parts.SETTING_OPTI_REP_THRESHOLD] = getSettingFromSettingsMap(settings, metadata.OptimisticReplicationThreshold, repSettings.OptimisticReplicationThreshold)
+	capiSettings[parts.SETTING_BANDWIDTH_LIMIT] = getSettingFromSettingsMap(settings, metadata.BandwidthLimit, repSettings.BandwidthLimit)
 	return capiSettings
 }
 
+func (xdcrf *XDCRFactory) constructUpdateSettingsForFileNozzle(pipeline common.Pipeline, settings map[string]interface{}) map[string]interface{} {
+	fileSettings := make(map[string]interface{})
+	repSettings := pipeline.Specification().Settings
+
+	fileSettings[parts.SETTING_BANDWIDTH_LIMIT] = getSettingFromSettingsMap(settings, metadata.BandwidthLimit, repSettings.BandwidthLimit)
+	return fileSettings
+}
+
+func (xdcrf *XDCRFactory) constructUpdateSettingsForWebhookNozzle(pipeline common.Pipeline, settings map[string]interface{}) map[string]interface{} {
+	webhookSettings := make(map[string]interface{})
+	repSettings := pipeline.Specification().Settings
+
+	webhookSettings[parts.SETTING_BANDWIDTH_LIMIT] = getSettingFromSettingsMap(settings, metadata.BandwidthLimit, repSettings.BandwidthLimit)
+	return webhookSettings
+}
+
 func (xdcrf *XDCRFactory) SetStartSeqno(pipeline common.Pipeline) error {
 	if pipeline == nil {
 		return errors.New("pipeline=nil")
@@ -611,6 +877,17 @@ func (xdcrf *XDCRFactory) constructSettingsForXmemNozzle(pipeline common.Pipelin
 	xmemSettings[parts.SETTING_BATCH_EXPIRATION_TIME] = time.Duration(float64(repSettings.MaxExpectedReplicationLag)*0.7) * time.Millisecond
 	xmemSettings[parts.SETTING_OPTI_REP_THRESHOLD] = getSettingFromSettingsMap(settings, metadata.OptimisticReplicationThreshold, repSettings.OptimisticReplicationThreshold)
 	xmemSettings[parts.SETTING_STATS_INTERVAL] = getSettingFromSettingsMap(settings, metadata.PipelineStatsInterval, repSettings.StatsInterval)
+	xmemSettings[parts.XMEM_SETTING_DEDUP_IN_BATCH] = getSettingFromSettingsMap(settings, metadata.DedupInBatch, repSettings.DedupInBatch)
+	xmemSettings[parts.XMEM_SETTING_COMPRESSION_TYPE] = getSettingFromSettingsMap(settings, metadata.CompressionType, repSettings.CompressionType)
+	xmemSettings[parts.XMEM_SETTING_CONFLICT_RESOLVER] = getSettingFromSettingsMap(settings, metadata.ConflictResolver, repSettings.ConflictResolver)
+	xmemSettings[parts.SETTING_CONFLICT_LOG_ENABLED] = getSettingFromSettingsMap(settings, metadata.ConflictLogSink, repSettings.ConflictLogSink).(string) != ""
+	xmemSettings[parts.SETTING_CONFLICT_LOG_BODY] = getSettingFromSettingsMap(settings, metadata.ConflictLogBody, repSettings.ConflictLogBody)
+	xdcrf.constructAdaptiveBatchingSettings(xmemSettings, repSettings, settings)
+	xmemSettings[parts.SETTING_BANDWIDTH_LIMIT] = getSettingFromSettingsMap(settings, metadata.BandwidthLimit, repSettings.BandwidthLimit)
+	xmemSettings[parts.XMEM_SETTING_DEAD_LETTER] = getSettingFromSettingsMap(settings, metadata.DeadLetterEnabled, repSettings.DeadLetterEnabled)
+	xmemSettings[parts.XMEM_SETTING_DEAD_LETTER_CAP] = getSettingFromSettingsMap(settings, metadata.DeadLetterCap, repSettings.DeadLetterCap)
+	xmemSettings[parts.XMEM_SETTING_SETMETA_CONNS] = getSettingFromSettingsMap(settings, metadata.ConnectionsPerTargetNozzle, repSettings.ConnectionsPerTargetNozzle)
+	xmemSettings[parts.XMEM_SETTING_SOURCE_VBS] = pipeline_utils.GetSourceVBListPerPipeline(pipeline)
 
 	demandEncryption := targetClusterRef.DemandEncryption
 	certificate := targetClusterRef.Certificate
@@ -656,6 +933,14 @@ func (xdcrf *XDCRFactory) constructSettingsForXmemNozzle(pipeline common.Pipelin
 
 }
 
+func (xdcrf *XDCRFactory) constructAdaptiveBatchingSettings(xmemSettings map[string]interface{}, repSettings *metadata.ReplicationSettings, settings map[string]interface{}) {
+	xmemSettings[parts.XMEM_SETTING_ADAPTIVE_BATCHING] = getSettingFromSettingsMap(settings, metadata.AdaptiveBatching, repSettings.AdaptiveBatching)
+	xmemSettings[parts.XMEM_SETTING_MIN_BATCH_COUNT] = getSettingFromSettingsMap(settings, metadata.MinBatchCount, repSettings.MinBatchCount)
+	xmemSettings[parts.XMEM_SETTING_MIN_BATCH_SIZE] = getSettingFromSettingsMap(settings, metadata.MinBatchSize, repSettings.MinBatchSize)
+	latency_target := getSettingFromSettingsMap(settings, metadata.AdaptiveBatchLatencyTarget, repSettings.AdaptiveBatchLatencyTarget)
+	xmemSettings[parts.XMEM_SETTING_LATENCY_TARGET] = time.Duration(latency_target.(int)) * time.Millisecond
+}
+
 func (xdcrf *XDCRFactory) constructSettingsForCapiNozzle(pipeline common.Pipeline, settings map[string]interface{}) (map[string]interface{}, error) {
 	capiSettings := make(map[string]interface{})
 	repSettings := pipeline.Specification().Settings
@@ -665,11 +950,54 @@ func (xdcrf *XDCRFactory) constructSettingsForCapiNozzle(pipeline common.Pipelin
 	capiSettings[parts.SETTING_RESP_TIMEOUT] = xdcrf.getTargetTimeoutEstimate(pipeline.Topic())
 	capiSettings[parts.SETTING_OPTI_REP_THRESHOLD] = getSettingFromSettingsMap(settings, metadata.OptimisticReplicationThreshold, repSettings.OptimisticReplicationThreshold)
 	capiSettings[parts.SETTING_STATS_INTERVAL] = getSettingFromSettingsMap(settings, metadata.PipelineStatsInterval, repSettings.StatsInterval)
+	capiSettings[parts.SETTING_CONFLICT_LOG_ENABLED] = getSettingFromSettingsMap(settings, metadata.ConflictLogSink, repSettings.ConflictLogSink).(string) != ""
+	capiSettings[parts.SETTING_CONFLICT_LOG_BODY] = getSettingFromSettingsMap(settings, metadata.ConflictLogBody, repSettings.ConflictLogBody)
+	capiSettings[parts.SETTING_BANDWIDTH_LIMIT] = getSettingFromSettingsMap(settings, metadata.BandwidthLimit, repSettings.BandwidthLimit)
 
 	return capiSettings, nil
 
 }
 
+func (xdcrf *XDCRFactory) constructSettingsForFileNozzle(pipeline common.Pipeline, settings map[string]interface{}) (map[string]interface{}, error) {
+	fileSettings := make(map[string]interface{})
+	spec := pipeline.Specification()
+	repSettings := spec.Settings
+
+	// each replication of file type writes into a sub directory named after the export
+	dir := getSettingFromSettingsMap(settings, metadata.FileSinkDir, repSettings.FileSinkDir).(string)
+	rotate_size := getSettingFromSettingsMap(settings, metadata.FileSinkRotateSize, repSettings.FileSinkRotateSize).(int)
+	rotate_interval := getSettingFromSettingsMap(settings, metadata.FileSinkRotateInterval, repSettings.FileSinkRotateInterval).(int)
+
+	fileSettings[parts.SETTING_BATCHCOUNT] = getSettingFromSettingsMap(settings, metadata.BatchCount, repSettings.BatchCount)
+	fileSettings[parts.SETTING_BATCHSIZE] = getSettingFromSettingsMap(settings, metadata.BatchSize, repSettings.BatchSize)
+	fileSettings[parts.SETTING_STATS_INTERVAL] = getSettingFromSettingsMap(settings, metadata.PipelineStatsInterval, repSettings.StatsInterval)
+	fileSettings[parts.FILE_SETTING_DIR] = filepath.Join(dir, spec.TargetBucketName)
+	fileSettings[parts.FILE_SETTING_FORMAT] = getSettingFromSettingsMap(settings, metadata.FileSinkFormat, repSettings.FileSinkFormat)
+	fileSettings[parts.FILE_SETTING_ROTATE_SIZE] = int64(rotate_size) * 1024 * 1024
+	fileSettings[parts.FILE_SETTING_ROTATE_INTERVAL] = time.Duration(rotate_interval) * time.Second
+	fileSettings[parts.SETTING_BANDWIDTH_LIMIT] = getSettingFromSettingsMap(settings, metadata.BandwidthLimit, repSettings.BandwidthLimit)
+
+	return fileSettings, nil
+}
+
+func (xdcrf *XDCRFactory) constructSettingsForWebhookNozzle(pipeline common.Pipeline, settings map[string]interface{}) (map[string]interface{}, error) {
+	webhookSettings := make(map[string]interface{})
+	repSettings := pipeline.Specification().Settings
+
+	timeout := getSettingFromSettingsMap(settings, metadata.WebhookTimeout, repSettings.WebhookTimeout).(int)
+
+	webhookSettings[parts.SETTING_BATCHCOUNT] = getSettingFromSettingsMap(settings, metadata.BatchCount, repSettings.BatchCount)
+	webhookSettings[parts.SETTING_BATCHSIZE] = getSettingFromSettingsMap(settings, metadata.BatchSize, repSettings.BatchSize)
+	webhookSettings[parts.SETTING_STATS_INTERVAL] = getSettingFromSettingsMap(settings, metadata.PipelineStatsInterval, repSettings.StatsInterval)
+	webhookSettings[parts.WEBHOOK_SETTING_URL] = getSettingFromSettingsMap(settings, metadata.WebhookUrl, repSettings.WebhookUrl)
+	webhookSettings[parts.WEBHOOK_SETTING_TIMEOUT] = time.Duration(timeout) * time.Millisecond
+	webhookSettings[parts.WEBHOOK_SETTING_MAX_RETRIES] = getSettingFromSettingsMap(settings, metadata.WebhookMaxRetries, repSettings.WebhookMaxRetries)
+	webhookSettings[parts.WEBHOOK_SETTING_SECRET] = getSettingFromSettingsMap(settings, metadata.WebhookSecret, repSettings.WebhookSecret)
+	webhookSettings[parts.SETTING_BANDWIDTH_LIMIT] = getSettingFromSettingsMap(settings, metadata.BandwidthLimit, repSettings.BandwidthLimit)
+
+	return webhookSettings, nil
+}
+
 func (xdcrf *XDCRFactory) getTargetTimeoutEstimate(topic string) time.Duration {
 	//TODO: implement
 	//need to get the tcp ping time for the estimate
@@ -689,10 +1017,26 @@ func (xdcrf *XDCRFactory) constructSettingsForDcpNozzle(pipeline common.Pipeline
 
 	dcpNozzleSettings[parts.DCP_VBTimestampUpdator] = ckpt_svc.(*pipeline_svc.CheckpointManager).UpdateVBTimestamps
 	dcpNozzleSettings[parts.DCP_Stats_Interval] = getSettingFromSettingsMap(settings, metadata.PipelineStatsInterval, repSettings.StatsInterval)
+	dcpNozzleSettings[parts.DCP_Connection_Buffer_Size] = getSettingFromSettingsMap(settings, metadata.DcpConnectionBufferSize, repSettings.DcpConnectionBufferSize)
+	dcpNozzleSettings[parts.DCP_Record_Dir] = getSettingFromSettingsMap(settings, metadata.DcpRecordDir, repSettings.DcpRecordDir)
 	return dcpNozzleSettings, nil
 }
 
-func (xdcrf *XDCRFactory) registerServices(pipeline common.Pipeline, logger_ctx *log.LoggerContext, kv_vb_map map[string][]uint16) error {
+func (xdcrf *XDCRFactory) constructSettingsForDcpReplayNozzle(pipeline common.Pipeline, settings map[string]interface{}) (map[string]interface{}, error) {
+	replayNozzleSettings := make(map[string]interface{})
+	repSettings := pipeline.Specification().Settings
+
+	ckpt_svc := pipeline.RuntimeContext().Service(base.CHECKPOINT_MGR_SVC)
+	if ckpt_svc == nil {
+		return nil, fmt.Errorf("No checkpoint manager has been registered with the pipeline %v", pipeline.Topic())
+	}
+
+	replayNozzleSettings[parts.DCP_VBTimestampUpdator] = ckpt_svc.(*pipeline_svc.CheckpointManager).UpdateVBTimestamps
+	replayNozzleSettings[parts.DCP_Replay_Speed] = getSettingFromSettingsMap(settings, metadata.DcpReplaySpeed, repSettings.DcpReplaySpeed)
+	return replayNozzleSettings, nil
+}
+
+func (xdcrf *XDCRFactory) registerServices(pipeline common.Pipeline, logger_ctx *log.LoggerContext, kv_vb_map map[string][]uint16, vbsRemapped bool) error {
 	through_seqno_tracker_svc := service_impl.NewThroughSeqnoTrackerSvc(logger_ctx)
 	through_seqno_tracker_svc.Attach(pipeline)
 
@@ -708,7 +1052,7 @@ func (xdcrf *XDCRFactory) registerServices(pipeline common.Pipeline, logger_ctx
 	//register pipeline checkpoint manager
 	ckptMgr, err := pipeline_svc.NewCheckpointManager(xdcrf.checkpoint_svc, xdcrf.capi_svc,
 		xdcrf.remote_cluster_svc, xdcrf.repl_spec_svc, xdcrf.cluster_info_svc,
-		xdcrf.xdcr_topology_svc, through_seqno_tracker_svc, kv_vb_map, logger_ctx)
+		xdcrf.xdcr_topology_svc, through_seqno_tracker_svc, kv_vb_map, vbsRemapped, logger_ctx)
 	if err != nil {
 		xdcrf.logger.Errorf("Failed to construct CheckpointManager for %v. err=%v ckpt_svc=%v, capi_svc=%v, remote_cluster_svc=%v, repl_spec_svc=%v\n", pipeline.Topic(), err, xdcrf.checkpoint_svc, xdcrf.capi_svc,
 			xdcrf.remote_cluster_svc, xdcrf.repl_spec_svc)
@@ -732,6 +1076,22 @@ func (xdcrf *XDCRFactory) registerServices(pipeline common.Pipeline, logger_ctx
 	if err != nil {
 		return err
 	}
+
+	//register conflict logger when conflict logging is enabled
+	spec := pipeline.Specification()
+	if spec.Settings.ConflictLogSink != "" {
+		conflict_logger := pipeline_svc.NewConflictLogger(func(bucketName string) (*couchbase.Bucket, error) {
+			targetClusterRef, err := xdcrf.remote_cluster_svc.RemoteClusterByUuid(spec.TargetClusterUUID, false)
+			if err != nil {
+				return nil, err
+			}
+			return xdcrf.cluster_info_svc.GetBucket(targetClusterRef, bucketName)
+		}, logger_ctx)
+		err = ctx.RegisterService(base.CONFLICT_LOGGER_SVC, conflict_logger)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -746,6 +1106,9 @@ func (xdcrf *XDCRFactory) ConstructSettingsForService(pipeline common.Pipeline,
 	case *pipeline_svc.CheckpointManager:
 		xdcrf.logger.Debug("Construct settings for CheckpointManager")
 		return xdcrf.constructSettingsForCheckpointManager(pipeline, settings)
+	case *pipeline_svc.ConflictLogger:
+		xdcrf.logger.Debug("Construct settings for ConflictLogger")
+		return xdcrf.constructSettingsForConflictLogger(pipeline, settings)
 	}
 	return settings, nil
 }
@@ -790,6 +1153,14 @@ func (xdcrf *XDCRFactory) constructSettingsForCheckpointManager(pipeline common.
 	return s, nil
 }
 
+func (xdcrf *XDCRFactory) constructSettingsForConflictLogger(pipeline common.Pipeline, settings map[string]interface{}) (map[string]interface{}, error) {
+	s := make(map[string]interface{})
+	repSettings := pipeline.Specification().Settings
+	s[pipeline_svc.CONFLICT_LOG_SINK] = getSettingFromSettingsMap(settings, metadata.ConflictLogSink, repSettings.ConflictLogSink)
+	s[pipeline_svc.CONFLICT_LOG_RETENTION] = getSettingFromSettingsMap(settings, metadata.ConflictLogRetention, repSettings.ConflictLogRetention)
+	return s, nil
+}
+
 func (xdcrf *XDCRFactory) constructUpdateSettingsForSupervisor(pipeline common.Pipeline, settings map[string]interface{}) (map[string]interface{}, error) {
 	s := make(map[string]interface{})
 	log_level_str := getSettingFromSettingsMap(settings, metadata.PipelineLogLevel, nil)
@@ -822,6 +1193,18 @@ func (xdcrf *XDCRFactory) constructUpdateSettingsForCheckpointManager(pipeline c
 	return s, nil
 }
 
+// returns the share of the vbuckets of the source bucket that are on this node
+func nodeShareOfVBs(kv_vb_map map[string][]uint16, numSourceVBs int) float64 {
+	if numSourceVBs == 0 {
+		return 1
+	}
+	numLocalVBs := 0
+	for _, vbs := range kv_vb_map {
+		numLocalVBs += len(vbs)
+	}
+	return float64(numLocalVBs) / float64(numSourceVBs)
+}
+
 func getSettingFromSettingsMap(settings map[string]interface{}, setting_name string, default_value interface{}) interface{} {
 	if settings != nil {
 		if setting, ok := settings[setting_name]; ok {
@@ -833,6 +1216,10 @@ func getSettingFromSettingsMap(settings map[string]interface{}, setting_name str
 }
 
 func (xdcrf *XDCRFactory) ConstructSSLPortMap(targetClusterRef *metadata.RemoteClusterReference, spec *metadata.ReplicationSpecification) (map[string]uint16, bool, error) {
+	// replications of file and webhook types do not connect to target cluster
+	if !spec.HasTargetCluster() {
+		return nil, false, nil
+	}
 
 	var ssl_port_map map[string]uint16
 	var hasSSLOverMemSupport bool
@@ -0,0 +1,189 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// file_sink implements the files that replications of file type export the change stream of source bucket into.
+// mutations, deletions and expirations are written in one of two formats.
+//
+// in jsonl format, each line is a json object of the following form:
+//
+//	{"op":"mutation","vb":12,"seqno":100,"revSeqno":3,"cas":1490000000000000000,"flags":0,"expiry":0,"key":"doc1","doc":{...}}
+//
+// where op is one of mutation, deletion and expiration. the value of the document is in "doc" when it is json,
+// and is base64 encoded in "value" otherwise. both are omitted when the value is empty.
+//
+// in binary format, all integers are big endian and a file consists of a header followed by records:
+//
+//	header := magic[8] version:uint16
+//	record := len:uint32 body[len]
+//	body   := opcode:uint8 vbno:uint16 seqno:uint64 revSeqno:uint64 cas:uint64 flags:uint32 expiry:uint32
+//	          len:uint16 key len:uint32 value
+//
+// where opcode is the dcp opcode, i.e., 0x57 for mutations, 0x58 for deletions and 0x59 for expirations.
+//
+// vb and seqno are those of the source bucket. records of the same vbucket are in seqno order within a file
+// and across the files of the same nozzle. records may be repeated after a replication restarts, since
+// the change stream is resumed from the last checkpoint
+package file_sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+)
+
+// formats of export files
+const (
+	FormatJSONLines = "jsonl"
+	FormatBinary    = "binary"
+)
+
+// header of files in binary format
+const (
+	Magic   = "XDCRFILE"
+	Version = 1
+)
+
+// values of op in jsonl format
+const (
+	OpMutation   = "mutation"
+	OpDeletion   = "deletion"
+	OpExpiration = "expiration"
+)
+
+// a mutation, deletion or expiration in the change stream of source bucket
+type Record struct {
+	Opcode   mc.CommandCode
+	VBucket  uint16
+	Seqno    uint64
+	RevSeqno uint64
+	Cas      uint64
+	Flags    uint32
+	Expiry   uint32
+	Key      []byte
+	Value    []byte
+}
+
+// record in jsonl format
+type jsonRecord struct {
+	Op       string          `json:"op"`
+	VBucket  uint16          `json:"vb"`
+	Seqno    uint64          `json:"seqno"`
+	RevSeqno uint64          `json:"revSeqno"`
+	Cas      uint64          `json:"cas"`
+	Flags    uint32          `json:"flags"`
+	Expiry   uint32          `json:"expiry"`
+	Key      string          `json:"key"`
+	Doc      json.RawMessage `json:"doc,omitempty"`
+	Value    []byte          `json:"value,omitempty"`
+}
+
+// returns the extension of files in the specified format
+func FileExtension(format string) string {
+	if format == FormatBinary {
+		return ".bin"
+	}
+	return "." + FormatJSONLines
+}
+
+func ValidateFormat(format string) error {
+	if format != FormatJSONLines && format != FormatBinary {
+		return fmt.Errorf("unknown file format %v. valid formats are %v and %v", format, FormatJSONLines, FormatBinary)
+	}
+	return nil
+}
+
+func opName(opcode mc.CommandCode) (string, error) {
+	switch opcode {
+	case mc.UPR_MUTATION:
+		return OpMutation, nil
+	case mc.UPR_DELETION:
+		return OpDeletion, nil
+	case mc.UPR_EXPIRATION:
+		return OpExpiration, nil
+	}
+	return "", fmt.Errorf("unexpected opcode %v", opcode)
+}
+
+// encodes the record as a json object
+func EncodeJSON(record *Record) ([]byte, error) {
+	op, err := opName(record.Opcode)
+	if err != nil {
+		return nil, err
+	}
+
+	json_record := &jsonRecord{
+		Op:       op,
+		VBucket:  record.VBucket,
+		Seqno:    record.Seqno,
+		RevSeqno: record.RevSeqno,
+		Cas:      record.Cas,
+		Flags:    record.Flags,
+		Expiry:   record.Expiry,
+		Key:      string(record.Key),
+	}
+	if len(record.Value) > 0 {
+		if isJSON(record.Value) {
+			json_record.Doc = json.RawMessage(record.Value)
+		} else {
+			json_record.Value = record.Value
+		}
+	}
+
+	return json.Marshal(json_record)
+}
+
+func isJSON(value []byte) bool {
+	var raw json.RawMessage
+	return json.Unmarshal(value, &raw) == nil
+}
+
+// encodes the record, including its length prefix, in binary format
+func encodeBinary(record *Record) ([]byte, error) {
+	if _, err := opName(record.Opcode); err != nil {
+		return nil, err
+	}
+	if len(record.Key) > 0xFFFF {
+		return nil, errors.New("key is too long")
+	}
+
+	body_len := 41 + len(record.Key) + len(record.Value)
+	data := make([]byte, 0, 4+body_len)
+	data = appendUint32(data, uint32(body_len))
+	data = append(data, byte(record.Opcode))
+	data = appendUint16(data, record.VBucket)
+	data = appendUint64(data, record.Seqno)
+	data = appendUint64(data, record.RevSeqno)
+	data = appendUint64(data, record.Cas)
+	data = appendUint32(data, record.Flags)
+	data = appendUint32(data, record.Expiry)
+	data = appendUint16(data, uint16(len(record.Key)))
+	data = append(data, record.Key...)
+	data = appendUint32(data, uint32(len(record.Value)))
+	data = append(data, record.Value...)
+	return data, nil
+}
+
+func binaryHeader() []byte {
+	header := make([]byte, 0, len(Magic)+2)
+	header = append(header, Magic...)
+	return appendUint16(header, Version)
+}
+
+func appendUint16(buf []byte, val uint16) []byte {
+	return append(buf, byte(val>>8), byte(val))
+}
+
+func appendUint32(buf []byte, val uint32) []byte {
+	return append(buf, byte(val>>24), byte(val>>16), byte(val>>8), byte(val))
+}
+
+func appendUint64(buf []byte, val uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(val>>32)), uint32(val))
+}
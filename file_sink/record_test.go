@@ -0,0 +1,137 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package file_sink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	mc "github.com/couchbase/gomemcached"
+	"testing"
+)
+
+var errTestTruncated = errors.New("record is truncated")
+
+func newTestRecord(opcode mc.CommandCode, key string, value []byte) *Record {
+	return &Record{
+		Opcode:   opcode,
+		VBucket:  12,
+		Seqno:    100,
+		RevSeqno: 3,
+		Cas:      1490000000000000000,
+		Flags:    0x01020304,
+		Expiry:   60,
+		Key:      []byte(key),
+		Value:    value,
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	data, err := EncodeJSON(newTestRecord(mc.UPR_MUTATION, "doc1", []byte(`{"a":[1,2]}`)))
+	if err != nil {
+		t.Fatalf("failed to encode record. err=%v", err)
+	}
+	expected := `{"op":"mutation","vb":12,"seqno":100,"revSeqno":3,"cas":1490000000000000000,"flags":16909060,"expiry":60,"key":"doc1","doc":{"a":[1,2]}}`
+	if string(data) != expected {
+		t.Errorf("expected %v, got %v", expected, string(data))
+	}
+
+	// values that are not json are base64 encoded
+	data, err = EncodeJSON(newTestRecord(mc.UPR_EXPIRATION, "doc2", []byte{0xff, 0x00, 0x01}))
+	if err != nil {
+		t.Fatalf("failed to encode record. err=%v", err)
+	}
+	var decoded map[string]interface{}
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to decode %v. err=%v", string(data), err)
+	}
+	if decoded["op"] != OpExpiration || decoded["value"] != "/wAB" || decoded["doc"] != nil {
+		t.Errorf("unexpected record %v", string(data))
+	}
+
+	// empty values are omitted
+	data, err = EncodeJSON(newTestRecord(mc.UPR_DELETION, "doc3", nil))
+	if err != nil {
+		t.Fatalf("failed to encode record. err=%v", err)
+	}
+	decoded = nil
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to decode %v. err=%v", string(data), err)
+	}
+	if _, ok := decoded["value"]; ok || decoded["op"] != OpDeletion || decoded["key"] != "doc3" {
+		t.Errorf("unexpected record %v", string(data))
+	}
+
+	if _, err = EncodeJSON(newTestRecord(mc.UPR_SNAPSHOT, "doc4", nil)); err == nil {
+		t.Errorf("expected records of unexpected opcodes to be rejected")
+	}
+}
+
+func TestEncodeBinary(t *testing.T) {
+	record := newTestRecord(mc.UPR_MUTATION, "doc1", []byte("value"))
+	data, err := encodeBinary(record)
+	if err != nil {
+		t.Fatalf("failed to encode record. err=%v", err)
+	}
+
+	decoded, rest, err := decodeTestBinaryRecord(data)
+	if err != nil {
+		t.Fatalf("failed to decode record. err=%v", err)
+	}
+	if len(rest) != 0 {
+		t.Errorf("expected %v extra bytes not to follow the record", len(rest))
+	}
+	if !equalTestRecords(decoded, record) {
+		t.Errorf("expected %+v, got %+v", record, decoded)
+	}
+
+	if _, err = encodeBinary(newTestRecord(mc.UPR_MUTATION, string(make([]byte, 0x10000)), nil)); err == nil {
+		t.Errorf("expected records with keys longer than 65535 bytes to be rejected")
+	}
+}
+
+// decodes the length-prefixed record at the start of data, and returns the data that follows it
+func decodeTestBinaryRecord(data []byte) (*Record, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, errTestTruncated
+	}
+	body_len := int(binary.BigEndian.Uint32(data))
+	if len(data) < 4+body_len || body_len < 41 {
+		return nil, nil, errTestTruncated
+	}
+	body := data[4 : 4+body_len]
+
+	record := &Record{
+		Opcode:   mc.CommandCode(body[0]),
+		VBucket:  binary.BigEndian.Uint16(body[1:3]),
+		Seqno:    binary.BigEndian.Uint64(body[3:11]),
+		RevSeqno: binary.BigEndian.Uint64(body[11:19]),
+		Cas:      binary.BigEndian.Uint64(body[19:27]),
+		Flags:    binary.BigEndian.Uint32(body[27:31]),
+		Expiry:   binary.BigEndian.Uint32(body[31:35]),
+	}
+	key_len := int(binary.BigEndian.Uint16(body[35:37]))
+	if 41+key_len > body_len {
+		return nil, nil, errTestTruncated
+	}
+	record.Key = body[37 : 37+key_len]
+	value_len := int(binary.BigEndian.Uint32(body[37+key_len : 41+key_len]))
+	if 41+key_len+value_len != body_len {
+		return nil, nil, errTestTruncated
+	}
+	record.Value = body[41+key_len:]
+	return record, data[4+body_len:], nil
+}
+
+func equalTestRecords(a, b *Record) bool {
+	return a.Opcode == b.Opcode && a.VBucket == b.VBucket && a.Seqno == b.Seqno && a.RevSeqno == b.RevSeqno &&
+		a.Cas == b.Cas && a.Flags == b.Flags && a.Expiry == b.Expiry && bytes.Equal(a.Key, b.Key) && bytes.Equal(a.Value, b.Value)
+}
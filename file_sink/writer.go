@@ -0,0 +1,160 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package file_sink
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// format of the creation time in file names, which makes the files of a writer sort in creation order
+const fileTimeFormat = "20060102T150405.000000000Z"
+
+// characters that are not safe in file names
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_.\-]`)
+
+// returns the name of the file created by the writer with the specified name prefix at the specified time
+func FileName(namePrefix, format string, createTime time.Time) string {
+	return unsafeFileNameChars.ReplaceAllString(namePrefix, "_") + "_" + createTime.UTC().Format(fileTimeFormat) + FileExtension(format)
+}
+
+// writes records into files in a directory. records are buffered, and are durable only after Sync returns.
+// at Sync, the current file is rotated when it has grown beyond rotate_size, or when it has been open for longer
+// than rotate_interval. it is not safe for concurrent use
+type Writer struct {
+	dir             string
+	name_prefix     string
+	format          string
+	rotate_size     int64
+	rotate_interval time.Duration
+
+	file        *os.File
+	buf         *bufio.Writer
+	file_size   int64
+	num_records int
+	create_time time.Time
+}
+
+// creates the directory when it does not exist, and the first file
+func NewWriter(dir, namePrefix, format string, rotate_size int64, rotate_interval time.Duration) (*Writer, error) {
+	err := ValidateFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		dir:             dir,
+		name_prefix:     namePrefix,
+		format:          format,
+		rotate_size:     rotate_size,
+		rotate_interval: rotate_interval,
+	}
+	err = w.createFile()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) createFile() error {
+	create_time := time.Now()
+	file, err := os.OpenFile(filepath.Join(w.dir, FileName(w.name_prefix, w.format, create_time)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.file = file
+	w.buf = bufio.NewWriterSize(file, 64*1024)
+	w.file_size = 0
+	w.num_records = 0
+	w.create_time = create_time
+
+	if w.format == FormatBinary {
+		header := binaryHeader()
+		if _, err = w.buf.Write(header); err != nil {
+			file.Close()
+			return err
+		}
+		w.file_size += int64(len(header))
+	}
+	return nil
+}
+
+// appends the record to the current file. returns the number of bytes written
+func (w *Writer) Write(record *Record) (int, error) {
+	var data []byte
+	var err error
+	if w.format == FormatBinary {
+		data, err = encodeBinary(record)
+	} else {
+		data, err = EncodeJSON(record)
+		// each record is a line in jsonl format
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.buf.Write(data)
+	w.file_size += int64(n)
+	if err == nil {
+		w.num_records++
+	}
+	return n, err
+}
+
+// flushes buffered records and syncs the current file to disk, after which all records written so far are durable.
+// rotates the file afterwards when it is due
+func (w *Writer) Sync() error {
+	err := w.sync()
+	if err != nil {
+		return err
+	}
+
+	// files without records are not rotated, so that an idle replication does not leave empty files behind
+	if w.num_records > 0 && (w.file_size >= w.rotate_size || time.Since(w.create_time) >= w.rotate_interval) {
+		err = w.file.Close()
+		if err != nil {
+			return err
+		}
+		return w.createFile()
+	}
+	return nil
+}
+
+func (w *Writer) sync() error {
+	err := w.buf.Flush()
+	if err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// syncs and closes the current file
+func (w *Writer) Close() error {
+	err := w.sync()
+	close_err := w.file.Close()
+	if err == nil {
+		err = close_err
+	}
+	return err
+}
+
+// returns the path of the current file
+func (w *Writer) Path() string {
+	return w.file.Name()
+}
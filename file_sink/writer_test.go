@@ -0,0 +1,230 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package file_sink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	mc "github.com/couchbase/gomemcached"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestWriter(t *testing.T, format string, rotate_size int64, rotate_interval time.Duration) (*Writer, string) {
+	dir, err := ioutil.TempDir("", "file_sink")
+	if err != nil {
+		t.Fatalf("failed to create temp dir. err=%v", err)
+	}
+	// the writer creates the directory
+	dir = filepath.Join(dir, "files")
+	w, err := NewWriter(dir, "file/nozzle 1", format, rotate_size, rotate_interval)
+	if err != nil {
+		os.RemoveAll(filepath.Dir(dir))
+		t.Fatalf("failed to create writer. err=%v", err)
+	}
+	return w, dir
+}
+
+func writeTestRecords(t *testing.T, w *Writer, seqnos ...uint64) {
+	for _, seqno := range seqnos {
+		record := newTestRecord(mc.UPR_MUTATION, "doc", []byte(`{"a":1}`))
+		record.Seqno = seqno
+		if _, err := w.Write(record); err != nil {
+			t.Fatalf("failed to write record. err=%v", err)
+		}
+	}
+}
+
+// returns the files in dir in creation order
+func listTestFiles(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read %v. err=%v", dir, err)
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// returns the seqnos of the records in the jsonl file
+func readTestJSONLines(t *testing.T, path string) []uint64 {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %v. err=%v", path, err)
+	}
+	defer file.Close()
+
+	seqnos := make([]uint64, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record jsonRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("failed to decode line %v of %v. err=%v", len(seqnos), path, err)
+		}
+		seqnos = append(seqnos, record.Seqno)
+	}
+	return seqnos
+}
+
+func TestWriterFileName(t *testing.T) {
+	create_time := time.Date(2017, 3, 20, 8, 30, 15, 123, time.UTC)
+	if name := FileName("file/nozzle 1", FormatJSONLines, create_time); name != "file_nozzle_1_20170320T083015.000000123Z.jsonl" {
+		t.Errorf("unexpected file name %v", name)
+	}
+	if name := FileName("nozzle", FormatBinary, create_time); name != "nozzle_20170320T083015.000000123Z.bin" {
+		t.Errorf("unexpected file name %v", name)
+	}
+}
+
+func TestWriterSync(t *testing.T) {
+	w, dir := newTestWriter(t, FormatJSONLines, 1024*1024, time.Hour)
+	defer os.RemoveAll(filepath.Dir(dir))
+	defer w.Close()
+
+	writeTestRecords(t, w, 1, 2, 3)
+	// records are buffered until Sync
+	if seqnos := readTestJSONLines(t, w.Path()); len(seqnos) != 0 {
+		t.Errorf("expected records not to be in file before sync, got %v", seqnos)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatalf("failed to sync. err=%v", err)
+	}
+	if seqnos := readTestJSONLines(t, w.Path()); len(seqnos) != 3 || seqnos[0] != 1 || seqnos[2] != 3 {
+		t.Errorf("expected records 1-3 in file after sync, got %v", seqnos)
+	}
+}
+
+func TestWriterRotateBySize(t *testing.T) {
+	w, dir := newTestWriter(t, FormatJSONLines, 300, time.Hour)
+	defer os.RemoveAll(filepath.Dir(dir))
+	defer w.Close()
+
+	// files are rotated at sync only
+	writeTestRecords(t, w, 1, 2, 3)
+	if files := listTestFiles(t, dir); len(files) != 1 {
+		t.Fatalf("expected 1 file before sync, got %v", files)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatalf("failed to sync. err=%v", err)
+	}
+	// a file below the rotate size is kept
+	writeTestRecords(t, w, 4)
+	if err := w.Sync(); err != nil {
+		t.Fatalf("failed to sync. err=%v", err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatalf("failed to sync. err=%v", err)
+	}
+
+	files := listTestFiles(t, dir)
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %v", files)
+	}
+	if seqnos := readTestJSONLines(t, filepath.Join(dir, files[0])); len(seqnos) != 3 {
+		t.Errorf("expected 3 records in the rotated file, got %v", seqnos)
+	}
+	if filepath.Join(dir, files[1]) != w.Path() {
+		t.Errorf("expected the latest file %v to be the current file %v", files[1], w.Path())
+	}
+	if seqnos := readTestJSONLines(t, w.Path()); len(seqnos) != 1 || seqnos[0] != 4 {
+		t.Errorf("expected record 4 in the current file, got %v", seqnos)
+	}
+}
+
+func TestWriterRotateByInterval(t *testing.T) {
+	w, dir := newTestWriter(t, FormatJSONLines, 1024*1024, 50*time.Millisecond)
+	defer os.RemoveAll(filepath.Dir(dir))
+	defer w.Close()
+
+	writeTestRecords(t, w, 1)
+	if err := w.Sync(); err != nil {
+		t.Fatalf("failed to sync. err=%v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := w.Sync(); err != nil {
+		t.Fatalf("failed to sync. err=%v", err)
+	}
+	if files := listTestFiles(t, dir); len(files) != 2 {
+		t.Fatalf("expected the file to be rotated after the rotate interval, got %v", files)
+	}
+
+	// files without records are not rotated
+	time.Sleep(100 * time.Millisecond)
+	if err := w.Sync(); err != nil {
+		t.Fatalf("failed to sync. err=%v", err)
+	}
+	if files := listTestFiles(t, dir); len(files) != 2 {
+		t.Errorf("expected the empty file not to be rotated, got %v", files)
+	}
+}
+
+func TestWriterBinaryFormat(t *testing.T) {
+	w, dir := newTestWriter(t, FormatBinary, 1024*1024, time.Hour)
+	defer os.RemoveAll(filepath.Dir(dir))
+
+	records := []*Record{
+		newTestRecord(mc.UPR_MUTATION, "doc1", []byte(`{"a":1}`)),
+		newTestRecord(mc.UPR_DELETION, "doc2", nil),
+		newTestRecord(mc.UPR_EXPIRATION, "doc3", []byte{0xff}),
+	}
+	for _, record := range records {
+		if _, err := w.Write(record); err != nil {
+			t.Fatalf("failed to write record. err=%v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close writer. err=%v", err)
+	}
+	if filepath.Ext(w.Path()) != ".bin" {
+		t.Errorf("unexpected extension of %v", w.Path())
+	}
+
+	data, err := ioutil.ReadFile(w.Path())
+	if err != nil {
+		t.Fatalf("failed to read %v. err=%v", w.Path(), err)
+	}
+	if !bytes.HasPrefix(data, binaryHeader()) || !bytes.HasPrefix(data, []byte(Magic+"\x00\x01")) {
+		t.Fatalf("unexpected header %v", data[:10])
+	}
+	data = data[len(Magic)+2:]
+	for _, record := range records {
+		var decoded *Record
+		decoded, data, err = decodeTestBinaryRecord(data)
+		if err != nil {
+			t.Fatalf("failed to decode record. err=%v", err)
+		}
+		if !equalTestRecords(decoded, record) {
+			t.Errorf("expected %+v, got %+v", record, decoded)
+		}
+	}
+	if len(data) != 0 {
+		t.Errorf("expected no data after the last record, got %v bytes", len(data))
+	}
+}
+
+func TestWriterInvalidFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_sink")
+	if err != nil {
+		t.Fatalf("failed to create temp dir. err=%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err = NewWriter(dir, "nozzle", "csv", 1024, time.Hour); err == nil {
+		t.Errorf("expected unknown formats to be rejected")
+	}
+}
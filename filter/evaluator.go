@@ -0,0 +1,269 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+)
+
+// evaluation semantics:
+// 1. a field that does not exist in the document is MISSING. a body that is not a JSON object,
+//    e.g., a binary document, is treated as a document in which every field is MISSING
+// 2. a comparison or an IN predicate involving a MISSING value is false.
+//    as a result, "NOT a = 1" is true for documents without field "a"
+// 3. values of different types are never equal, and cannot be ordered, i.e., "<", "<=", ">" and ">=" are false
+// 4. strings are ordered lexicographically by bytes, numbers numerically, and false < true.
+//    null, objects and arrays can only be compared for (in)equality
+
+// placeholder for the value of fields that do not exist
+type missingValue struct{}
+
+var missing = missingValue{}
+
+// returns whether the document with the specified body matches the expression
+func (e *Expression) Match(body []byte) bool {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		doc = nil
+	}
+	return e.MatchDocument(doc)
+}
+
+// returns whether the document, already unmarshalled from json, matches the expression
+func (e *Expression) MatchDocument(doc interface{}) bool {
+	docMap, ok := doc.(map[string]interface{})
+	if !ok {
+		docMap = nil
+	}
+	return e.root.evaluate(docMap)
+}
+
+type node interface {
+	evaluate(doc map[string]interface{}) bool
+}
+
+type operand interface {
+	value(doc map[string]interface{}) interface{}
+}
+
+type fieldOperand struct {
+	path []string
+}
+
+func (f *fieldOperand) value(doc map[string]interface{}) interface{} {
+	var cur interface{} = doc
+	for _, name := range f.path {
+		curMap, ok := cur.(map[string]interface{})
+		if !ok {
+			return missing
+		}
+		cur, ok = curMap[name]
+		if !ok {
+			return missing
+		}
+	}
+	return cur
+}
+
+type literalOperand struct {
+	val interface{}
+}
+
+func (l *literalOperand) value(doc map[string]interface{}) interface{} {
+	return l.val
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n *andNode) evaluate(doc map[string]interface{}) bool {
+	return n.left.evaluate(doc) && n.right.evaluate(doc)
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n *orNode) evaluate(doc map[string]interface{}) bool {
+	return n.left.evaluate(doc) || n.right.evaluate(doc)
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) evaluate(doc map[string]interface{}) bool {
+	return !n.operand.evaluate(doc)
+}
+
+type compareNode struct {
+	op          string
+	left, right operand
+}
+
+func (n *compareNode) evaluate(doc map[string]interface{}) bool {
+	left := n.left.value(doc)
+	right := n.right.value(doc)
+	if left == missing || right == missing {
+		return false
+	}
+
+	switch n.op {
+	case "=":
+		return equals(left, right)
+	case "!=":
+		return !equals(left, right)
+	}
+
+	cmp, ok := compare(left, right)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+type inNode struct {
+	operand operand
+	values  []interface{}
+	negate  bool
+}
+
+func (n *inNode) evaluate(doc map[string]interface{}) bool {
+	val := n.operand.value(doc)
+	if val == missing {
+		return false
+	}
+	for _, candidate := range n.values {
+		if equals(val, candidate) {
+			return !n.negate
+		}
+	}
+	return n.negate
+}
+
+// IS [NOT] NULL and IS [NOT] MISSING
+type isNode struct {
+	operand   operand
+	isMissing bool
+	negate    bool
+}
+
+func (n *isNode) evaluate(doc map[string]interface{}) bool {
+	val := n.operand.value(doc)
+	var result bool
+	if n.isMissing {
+		result = val == missing
+	} else {
+		result = val == nil
+	}
+	return result != n.negate
+}
+
+// a bare field path, which is true when the field has boolean value true
+type truthNode struct {
+	operand operand
+}
+
+func (n *truthNode) evaluate(doc map[string]interface{}) bool {
+	val, ok := n.operand.value(doc).(bool)
+	return ok && val
+}
+
+func equals(left, right interface{}) bool {
+	switch l := left.(type) {
+	case nil:
+		return right == nil
+	case string:
+		r, ok := right.(string)
+		return ok && l == r
+	case float64:
+		r, ok := right.(float64)
+		return ok && l == r
+	case bool:
+		r, ok := right.(bool)
+		return ok && l == r
+	case map[string]interface{}:
+		r, ok := right.(map[string]interface{})
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for key, lval := range l {
+			rval, ok := r[key]
+			if !ok || !equals(lval, rval) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		r, ok := right.([]interface{})
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for i := range l {
+			if !equals(l[i], r[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// returns -1, 0 or 1 when left is less than, equal to, or greater than right.
+// the second return value is false when the two values cannot be ordered
+func compare(left, right interface{}) (int, bool) {
+	switch l := left.(type) {
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return 0, false
+		}
+		if l < r {
+			return -1, true
+		} else if l > r {
+			return 1, true
+		}
+		return 0, true
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return 0, false
+		}
+		if l < r {
+			return -1, true
+		} else if l > r {
+			return 1, true
+		}
+		return 0, true
+	case bool:
+		r, ok := right.(bool)
+		if !ok {
+			return 0, false
+		}
+		if l == r {
+			return 0, true
+		} else if !l {
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
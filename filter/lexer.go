@@ -0,0 +1,230 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenLParen
+	tokenRParen
+	tokenLBracket
+	tokenRBracket
+	tokenComma
+	tokenDot
+	tokenOperator
+	// keywords
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenIn
+	tokenIs
+	tokenTrue
+	tokenFalse
+	tokenNull
+	tokenMissing
+)
+
+var keywords = map[string]tokenType{
+	"AND":     tokenAnd,
+	"OR":      tokenOr,
+	"NOT":     tokenNot,
+	"IN":      tokenIn,
+	"IS":      tokenIs,
+	"TRUE":    tokenTrue,
+	"FALSE":   tokenFalse,
+	"NULL":    tokenNull,
+	"MISSING": tokenMissing,
+}
+
+type token struct {
+	typ tokenType
+	// for identifiers and strings, the unquoted text. for operators and numbers, the literal text
+	text string
+	// byte offset of the token in the expression, used in error messages
+	pos int
+}
+
+func (t token) String() string {
+	if t.typ == tokenEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q at position %v", t.text, t.pos)
+}
+
+// splits a filter expression into tokens
+func tokenize(expression string) ([]token, error) {
+	tokens := make([]token, 0)
+	pos := 0
+	for pos < len(expression) {
+		r, size := utf8.DecodeRuneInString(expression[pos:])
+		if r == utf8.RuneError && size == 1 {
+			return nil, fmt.Errorf("invalid utf8 character at position %v", pos)
+		}
+
+		switch {
+		case unicode.IsSpace(r):
+			pos += size
+		case r == '(':
+			tokens = append(tokens, token{tokenLParen, "(", pos})
+			pos++
+		case r == ')':
+			tokens = append(tokens, token{tokenRParen, ")", pos})
+			pos++
+		case r == '[':
+			tokens = append(tokens, token{tokenLBracket, "[", pos})
+			pos++
+		case r == ']':
+			tokens = append(tokens, token{tokenRBracket, "]", pos})
+			pos++
+		case r == ',':
+			tokens = append(tokens, token{tokenComma, ",", pos})
+			pos++
+		case r == '.' && !(pos+1 < len(expression) && isDigit(expression[pos+1])):
+			tokens = append(tokens, token{tokenDot, ".", pos})
+			pos++
+		case r == '=' || r == '!' || r == '<' || r == '>':
+			op, err := scanOperator(expression, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokenOperator, op, pos})
+			pos += len(op)
+		case r == '"' || r == '\'':
+			str, end, err := scanQuoted(expression, pos, byte(r))
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokenString, str, pos})
+			pos = end
+		case r == '`':
+			// back-quoted identifiers allow field names with spaces, dots and keywords
+			str, end, err := scanQuoted(expression, pos, '`')
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokenIdent, str, pos})
+			pos = end
+		case r == '-' || r == '.' || (r < utf8.RuneSelf && isDigit(byte(r))):
+			end := scanNumber(expression, pos)
+			if end == pos {
+				return nil, fmt.Errorf("unexpected character %q at position %v", r, pos)
+			}
+			tokens = append(tokens, token{tokenNumber, expression[pos:end], pos})
+			pos = end
+		case r == '_' || unicode.IsLetter(r):
+			end := pos
+			for end < len(expression) {
+				r2, size2 := utf8.DecodeRuneInString(expression[end:])
+				if r2 != '_' && !unicode.IsLetter(r2) && !unicode.IsDigit(r2) {
+					break
+				}
+				end += size2
+			}
+			word := expression[pos:end]
+			if typ, ok := keywords[strings.ToUpper(word)]; ok {
+				tokens = append(tokens, token{typ, word, pos})
+			} else {
+				tokens = append(tokens, token{tokenIdent, word, pos})
+			}
+			pos = end
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %v", r, pos)
+		}
+	}
+	tokens = append(tokens, token{tokenEOF, "", pos})
+	return tokens, nil
+}
+
+func scanOperator(expression string, pos int) (string, error) {
+	if pos+1 < len(expression) {
+		two := expression[pos : pos+2]
+		switch two {
+		case "==", "!=", "<>", "<=", ">=":
+			return two, nil
+		}
+	}
+	switch expression[pos] {
+	case '=', '<', '>':
+		return expression[pos : pos+1], nil
+	}
+	return "", fmt.Errorf("unexpected character %q at position %v", expression[pos], pos)
+}
+
+// scans a quoted string starting at pos. a backslash escapes the next character.
+// returns the unquoted string and the position right after the closing quote
+func scanQuoted(expression string, pos int, quote byte) (string, int, error) {
+	var buf []byte
+	i := pos + 1
+	for i < len(expression) {
+		c := expression[i]
+		if c == '\\' && i+1 < len(expression) {
+			buf = append(buf, expression[i+1])
+			i += 2
+			continue
+		}
+		if c == quote {
+			return string(buf), i + 1, nil
+		}
+		buf = append(buf, c)
+		i++
+	}
+	return "", 0, fmt.Errorf("unterminated quoted string starting at position %v", pos)
+}
+
+// returns the end position of the number starting at pos, or pos if there is no valid number there
+func scanNumber(expression string, pos int) int {
+	i := pos
+	if i < len(expression) && expression[i] == '-' {
+		i++
+	}
+	digits := 0
+	for i < len(expression) && isDigit(expression[i]) {
+		i++
+		digits++
+	}
+	if i < len(expression) && expression[i] == '.' {
+		i++
+		for i < len(expression) && isDigit(expression[i]) {
+			i++
+			digits++
+		}
+	}
+	if digits == 0 {
+		return pos
+	}
+	if i < len(expression) && (expression[i] == 'e' || expression[i] == 'E') {
+		j := i + 1
+		if j < len(expression) && (expression[j] == '+' || expression[j] == '-') {
+			j++
+		}
+		if j < len(expression) && isDigit(expression[j]) {
+			for j < len(expression) && isDigit(expression[j]) {
+				j++
+			}
+			i = j
+		}
+	}
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// filter implements the expression language used to filter documents on the contents of their JSON bodies,
+// e.g., type = "order" AND region IN ["eu", "us"]
+//
+// grammar, with keywords being case insensitive:
+//
+//	expr       := andExpr ( OR andExpr )*
+//	andExpr    := notExpr ( AND notExpr )*
+//	notExpr    := NOT notExpr | primary
+//	primary    := "(" expr ")" | predicate
+//	predicate  := operand [ cmpOp operand | [NOT] IN "[" literal ( "," literal )* "]" | IS [NOT] ( NULL | MISSING ) ]
+//	operand    := fieldPath | literal
+//	fieldPath  := ident ( "." ident )*         identifiers can be back-quoted, e.g., `order type`.status
+//	literal    := string | number | TRUE | FALSE | NULL
+//	cmpOp      := "=" | "==" | "!=" | "<>" | "<" | "<=" | ">" | ">="
+//
+// a predicate consisting of a single field path is true when the field has boolean value true
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var ErrorEmptyExpression = errors.New("filter expression is empty")
+
+// a compiled filter expression
+type Expression struct {
+	text string
+	root node
+}
+
+// parse and compile a filter expression
+func Parse(expression string) (*Expression, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 1 {
+		return nil, ErrorEmptyExpression
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().typ != tokenEOF {
+		return nil, fmt.Errorf("unexpected %v", p.peek())
+	}
+	return &Expression{text: expression, root: root}, nil
+}
+
+// check whether the specified expression is a valid filter expression
+func Validate(expression string) error {
+	_, err := Parse(expression)
+	return err
+}
+
+func (e *Expression) String() string {
+	return e.text
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(typ tokenType, what string) (token, error) {
+	t := p.next()
+	if t.typ != typ {
+		return t, fmt.Errorf("expected %v but found %v", what, t)
+	}
+	return t, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().typ == tokenOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().typ == tokenAnd {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.peek().typ == tokenNot {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.peek().typ == tokenLParen {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(tokenRParen, "\")\""); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+	return p.parsePredicate()
+}
+
+func (p *parser) parsePredicate() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch t.typ {
+	case tokenOperator:
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		op := t.text
+		if op == "==" {
+			op = "="
+		} else if op == "<>" {
+			op = "!="
+		}
+		return &compareNode{op, left, right}, nil
+	case tokenIn:
+		p.next()
+		return p.parseInList(left, false)
+	case tokenNot:
+		// only "NOT IN" is valid here
+		p.next()
+		if _, err = p.expect(tokenIn, "IN"); err != nil {
+			return nil, err
+		}
+		return p.parseInList(left, true)
+	case tokenIs:
+		p.next()
+		negate := false
+		if p.peek().typ == tokenNot {
+			p.next()
+			negate = true
+		}
+		t = p.next()
+		switch t.typ {
+		case tokenNull:
+			return &isNode{left, false, negate}, nil
+		case tokenMissing:
+			return &isNode{left, true, negate}, nil
+		default:
+			return nil, fmt.Errorf("expected NULL or MISSING but found %v", t)
+		}
+	default:
+		if _, ok := left.(*fieldOperand); !ok {
+			return nil, fmt.Errorf("expected a comparison after literal but found %v", t)
+		}
+		return &truthNode{left}, nil
+	}
+}
+
+func (p *parser) parseInList(left operand, negate bool) (node, error) {
+	if _, err := p.expect(tokenLBracket, "\"[\""); err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, 0)
+	for {
+		lit, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, lit.val)
+
+		t := p.next()
+		if t.typ == tokenRBracket {
+			break
+		}
+		if t.typ != tokenComma {
+			return nil, fmt.Errorf("expected \",\" or \"]\" but found %v", t)
+		}
+	}
+	return &inNode{left, values, negate}, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	if p.peek().typ == tokenIdent {
+		path := []string{p.next().text}
+		for p.peek().typ == tokenDot {
+			p.next()
+			t, err := p.expect(tokenIdent, "field name")
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, t.text)
+		}
+		return &fieldOperand{path}, nil
+	}
+	return p.parseLiteral()
+}
+
+func (p *parser) parseLiteral() (*literalOperand, error) {
+	t := p.next()
+	switch t.typ {
+	case tokenString:
+		return &literalOperand{t.text}, nil
+	case tokenNumber:
+		num, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %v", t)
+		}
+		return &literalOperand{num}, nil
+	case tokenTrue:
+		return &literalOperand{true}, nil
+	case tokenFalse:
+		return &literalOperand{false}, nil
+	case tokenNull:
+		return &literalOperand{nil}, nil
+	default:
+		return nil, fmt.Errorf("expected a field name or a literal value but found %v", t)
+	}
+}
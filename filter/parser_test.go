@@ -0,0 +1,148 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package filter
+
+import (
+	"testing"
+)
+
+const testFilterDoc = `{"type": "order", "region": "eu", "total": 150, "paid": true, "note": null,
+	"customer": {"name": "ann", "tier": 2}, "order type": {"status": "open"}, "tags": ["a", "b"]}`
+
+func checkMatch(t *testing.T, expression, body string, expected bool) {
+	expr, err := Parse(expression)
+	if err != nil {
+		t.Errorf("failed to parse %v. err=%v", expression, err)
+		return
+	}
+	if matched := expr.Match([]byte(body)); matched != expected {
+		t.Errorf("expected %v to evaluate to %v, got %v", expression, expected, matched)
+	}
+}
+
+func TestFilterPrecedence(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		expected   bool
+	}{
+		// AND binds tighter than OR
+		{`type = "invoice" AND region = "us" OR paid`, true},
+		{`type = "invoice" AND (region = "us" OR paid)`, false},
+		{`paid OR type = "invoice" AND region = "us"`, true},
+		{`(paid OR type = "invoice") AND region = "us"`, false},
+		// NOT binds tighter than AND and OR
+		{`NOT paid OR region = "eu"`, true},
+		{`NOT (paid OR region = "eu")`, false},
+		{`NOT paid AND region = "eu"`, false},
+		{`NOT NOT paid`, true},
+		// keywords are case insensitive
+		{`type = "order" and not region in ["us", "ap"]`, true},
+	} {
+		checkMatch(t, test.expression, testFilterDoc, test.expected)
+	}
+}
+
+func TestFilterPredicates(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		expected   bool
+	}{
+		{`type == 'order'`, true},
+		{`type <> "order"`, false},
+		{`total >= 150 AND total < 150.5`, true},
+		{`total > 1.5e2`, false},
+		{`total = -150`, false},
+		{`"eu" = region`, true},
+		{`customer.tier <= 2`, true},
+		{"`order type`.status = \"open\"", true},
+		{`customer.nosuch.field IS MISSING`, true},
+		{`note IS NULL AND note IS NOT MISSING`, true},
+		{`customer IS NOT NULL`, true},
+		{`region NOT IN ["us", "ap"]`, true},
+		{`total IN [100, 150]`, true},
+		{`tags = tags`, true},
+		{`customer.name > "al"`, true},
+		{`paid > false`, true},
+		{`customer.name`, false},
+	} {
+		checkMatch(t, test.expression, testFilterDoc, test.expected)
+	}
+}
+
+func TestFilterTypeMismatch(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		expected   bool
+	}{
+		// values of different types are never equal and cannot be ordered
+		{`total = "150"`, false},
+		{`total != "150"`, true},
+		{`total < "200"`, false},
+		{`total >= "100"`, false},
+		{`region > 1`, false},
+		{`paid = 1`, false},
+		{`total IN ["150"]`, false},
+		// null and objects cannot be ordered
+		{`note < 1`, false},
+		{`customer > customer`, false},
+		// comparisons involving missing fields are false, both ways
+		{`nosuchfield = 1`, false},
+		{`nosuchfield != 1`, false},
+		{`NOT nosuchfield = 1`, true},
+		{`nosuchfield NOT IN [1]`, false},
+		// a bare field is only true when it is boolean true
+		{`region`, false},
+		{`nosuchfield`, false},
+	} {
+		checkMatch(t, test.expression, testFilterDoc, test.expected)
+	}
+
+	// documents that are not json objects have all fields missing
+	checkMatch(t, `type IS MISSING`, `not json`, true)
+	checkMatch(t, `type = "order"`, `["order"]`, false)
+}
+
+func TestFilterMalformedExpressions(t *testing.T) {
+	for _, expression := range []string{
+		``,
+		`   `,
+		`type =`,
+		`= "order"`,
+		`type = "order" AND`,
+		`OR type = "order"`,
+		`(type = "order"`,
+		`type = "order")`,
+		`type = "order`,
+		"`order type",
+		`type IN "order"`,
+		`type IN ["order"`,
+		`type IN ["order" "eu"]`,
+		`type IN [region]`,
+		`type IN []`,
+		`type NOT = "order"`,
+		`type IS "order"`,
+		`"order"`,
+		`customer. = 1`,
+		`type ! "order"`,
+		`type = "order" region = "eu"`,
+		`type = #`,
+		`type = -`,
+	} {
+		if _, err := Parse(expression); err == nil {
+			t.Errorf("expected %q to be invalid", expression)
+		}
+	}
+	if Validate(``) != ErrorEmptyExpression {
+		t.Errorf("expected empty expression error")
+	}
+	if err := Validate(`type = "order"`); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
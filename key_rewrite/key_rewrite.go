@@ -0,0 +1,150 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// key_rewrite implements the rules used to rewrite document keys before they are replicated to target,
+// e.g., to avoid key collisions when several source buckets are replicated into one target bucket.
+//
+// rules are specified as a JSON array and are applied in order, each to the output of the previous one, e.g.,
+//
+//	[{"type":"stripPrefix","prefix":"tmp::"},
+//	 {"type":"regexReplace","pattern":"^user_(.*)$","replacement":"u::$1"},
+//	 {"type":"addPrefix","prefix":"eu::"}]
+//
+// supported rule types:
+//
+//	addPrefix     prepends prefix to the key
+//	stripPrefix   removes prefix from the key if the key starts with it
+//	regexReplace  replaces all matches of pattern with replacement, which may reference submatches as $1, ${name}, etc.
+package key_rewrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"regexp"
+)
+
+const (
+	RuleTypeAddPrefix    = "addPrefix"
+	RuleTypeStripPrefix  = "stripPrefix"
+	RuleTypeRegexReplace = "regexReplace"
+)
+
+// max length of document keys accepted by memcached
+const MaxKeyLength = 250
+
+var ErrorNoRules = errors.New("key rewrite rules are empty")
+
+type Rule struct {
+	Type        string `json:"type"`
+	Prefix      string `json:"prefix,omitempty"`
+	Pattern     string `json:"pattern,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// compiled key rewrite rules
+type Rewriter struct {
+	text   string
+	rules  []*Rule
+	regexp []*regexp.Regexp // compiled patterns of regexReplace rules, nil for other rule types
+}
+
+// parse and compile key rewrite rules
+func Parse(rules string) (*Rewriter, error) {
+	var ruleList []*Rule
+	if err := json.Unmarshal([]byte(rules), &ruleList); err != nil {
+		return nil, fmt.Errorf("key rewrite rules need to be a JSON array of rules. err=%v", err)
+	}
+	if len(ruleList) == 0 {
+		return nil, ErrorNoRules
+	}
+
+	rewriter := &Rewriter{
+		text:   rules,
+		rules:  ruleList,
+		regexp: make([]*regexp.Regexp, len(ruleList)),
+	}
+	for i, rule := range ruleList {
+		if rule == nil {
+			return nil, fmt.Errorf("rule %v is null", i)
+		}
+		switch rule.Type {
+		case RuleTypeAddPrefix, RuleTypeStripPrefix:
+			if len(rule.Prefix) == 0 {
+				return nil, fmt.Errorf("rule %v of type %v needs a non-empty prefix", i, rule.Type)
+			}
+		case RuleTypeRegexReplace:
+			if len(rule.Pattern) == 0 {
+				return nil, fmt.Errorf("rule %v of type %v needs a non-empty pattern", i, rule.Type)
+			}
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %v has invalid pattern. err=%v", i, err)
+			}
+			rewriter.regexp[i] = re
+		default:
+			return nil, fmt.Errorf("rule %v has invalid type %q. valid types are %v, %v and %v", i, rule.Type,
+				RuleTypeAddPrefix, RuleTypeStripPrefix, RuleTypeRegexReplace)
+		}
+	}
+	return rewriter, nil
+}
+
+// check whether the specified rules are valid key rewrite rules
+func Validate(rules string) error {
+	_, err := Parse(rules)
+	return err
+}
+
+func (r *Rewriter) String() string {
+	return r.text
+}
+
+// returns the rewritten key. the key passed in is not modified.
+// returns error when the rewritten key is empty or too long to be accepted by target
+func (r *Rewriter) Rewrite(key []byte) ([]byte, error) {
+	newKey := key
+	for i, rule := range r.rules {
+		switch rule.Type {
+		case RuleTypeAddPrefix:
+			buf := make([]byte, 0, len(rule.Prefix)+len(newKey))
+			buf = append(buf, rule.Prefix...)
+			newKey = append(buf, newKey...)
+		case RuleTypeStripPrefix:
+			if bytes.HasPrefix(newKey, []byte(rule.Prefix)) {
+				newKey = newKey[len(rule.Prefix):]
+			}
+		case RuleTypeRegexReplace:
+			newKey = r.regexp[i].ReplaceAll(newKey, []byte(rule.Replacement))
+		}
+	}
+
+	if len(newKey) == 0 {
+		return nil, fmt.Errorf("key %q is rewritten into an empty key", key)
+	}
+	if len(newKey) > MaxKeyLength {
+		return nil, fmt.Errorf("key %q is rewritten into a key longer than %v bytes", key, MaxKeyLength)
+	}
+	return newKey, nil
+}
+
+// returns the vbucket that the key belongs to in a bucket with numOfVBs vbuckets.
+// this is the same hashing as the one used by couchbase clients
+func VBucketForKey(key []byte, numOfVBs int) uint16 {
+	return uint16(((crc32.ChecksumIEEE(key) >> 16) & 0x7fff) % uint32(numOfVBs))
+}
+
+// returns whether docs need to be moved to the vbuckets that their keys belong to on target, rather than
+// staying in vbuckets with the same numbers as on source. this is the case when keys are rewritten, or when
+// source and target buckets have different numbers of vbuckets
+func VBsRemapped(keyRewriteRules string, numSourceVBs int, numTargetVBs int) bool {
+	return len(keyRewriteRules) > 0 || numSourceVBs != numTargetVBs
+}
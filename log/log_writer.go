@@ -61,6 +61,13 @@ func (writer *RotatingLogFileWriter) Write(data []byte) (n int, err error) {
 	}
 }
 
+// closes the current log file
+func (writer *RotatingLogFileWriter) Close() error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	return writer.logFile.Close()
+}
+
 // get the number of log files by looking for existing log files with the highest postfix  
 func (writer *RotatingLogFileWriter) getNumberOfRotatedFiles() (uint64, error){
 	for i:= writer.maxNumberOfLogFiles; i >1; i-- {
@@ -32,6 +32,10 @@ var options struct {
 	sslProxyUpstreamPort uint64 // gometa request port
 	isEnterprise         bool   // whether couchbase is of enterprise edition
 	isConvert            bool   // whether xdcr is running in conversion/upgrade mode
+	enableFaultInjection bool   // whether network faults can be injected through rest api. for testing only
+
+	// directory owned by xdcr, under which replications read and write files
+	dataDir string
 
 	// logging related parameters
 	logFileDir          string
@@ -53,6 +57,11 @@ func argParse() {
 		"whether couchbase is of enterprise edition")
 	flag.BoolVar(&options.isConvert, "isConvert", false,
 		"whether xdcr is running in convertion/upgrade mode")
+	flag.BoolVar(&options.enableFaultInjection, "enableFaultInjection", false,
+		"whether network faults can be injected into connections through rest api. for testing only")
+
+	flag.StringVar(&options.dataDir, "dataDir", "",
+		"directory owned by xdcr, under which replications record, replay and export files")
 
 	flag.StringVar(&options.logFileDir, "logFileDir", "",
 		"directory for couchbase server logs")
@@ -82,6 +91,13 @@ func main() {
 		log.Init(options.logFileDir, options.maxLogFileSize, options.maxNumberOfLogFiles)
 	}
 
+	base.XDCRDataDir = options.dataDir
+	base.XDCRLogDir = options.logFileDir
+
+	if options.enableFaultInjection {
+		base.SetDialer(base.NewFaultInjector(base.GetDialer()))
+	}
+
 	cluster_info_svc := service_impl.NewClusterInfoSvc(nil)
 
 	top_svc, err := service_impl.NewXDCRTopologySvc(uint16(options.sourceKVAdminPort), uint16(options.xdcrRestPort), uint16(options.sslProxyUpstreamPort), options.isEnterprise, cluster_info_svc, nil)
@@ -32,6 +32,8 @@ type CheckpointRecord struct {
 	Target_vb_opaque TargetVBOpaque `json:"target_vb_opaque"`
 	//target vb high sequence number
 	Target_Seqno uint64 `json:"target_seqno"`
+	//filter version of replication when the checkpoint was taken
+	Filter_version int `json:"filter_version"`
 }
 
 func (ckptRecord *CheckpointRecord) IsSame(new_record *CheckpointRecord) bool {
@@ -46,7 +48,8 @@ func (ckptRecord *CheckpointRecord) IsSame(new_record *CheckpointRecord) bool {
 		ckptRecord.Dcp_snapshot_seqno == new_record.Dcp_snapshot_seqno &&
 		ckptRecord.Dcp_snapshot_end_seqno == new_record.Dcp_snapshot_end_seqno &&
 		ckptRecord.Target_vb_opaque.IsSame(new_record.Target_vb_opaque) &&
-		ckptRecord.Target_Seqno == new_record.Target_Seqno {
+		ckptRecord.Target_Seqno == new_record.Target_Seqno &&
+		ckptRecord.Filter_version == new_record.Filter_version {
 		return true
 	} else {
 		return false
@@ -84,6 +87,12 @@ func (ckptRecord *CheckpointRecord) UnmarshalJSON(data []byte) error {
 		ckptRecord.Target_Seqno = uint64(target_seqno.(float64))
 	}
 
+	// checkpoints created before filter versions were introduced have version 0
+	filter_version, ok := fieldMap[FilterVersion]
+	if ok {
+		ckptRecord.Filter_version = int(filter_version.(float64))
+	}
+
 	// this is the special logic where we unmarshal targetVBOpaque into different concrete types
 	target_vb_opaque, ok := fieldMap[TargetVbOpaque]
 	if ok {
@@ -13,15 +13,27 @@ import (
 	"errors"
 	"fmt"
 	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/conflict_log"
+	"github.com/couchbase/goxdcr/file_sink"
+	"github.com/couchbase/goxdcr/filter"
+	"github.com/couchbase/goxdcr/key_rewrite"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/simple_utils"
+	"net/url"
 	"regexp"
 	"strconv"
+	"time"
 )
 
 const (
 	ReplicationType                = "replication_type"
 	FilterExpression               = "filter_expression"
+	FilterBodyExpression           = "filter_body_expression"
+	FilterDeletions                = "filter_deletions"
+	FilterExpirations              = "filter_expirations"
+	KeyRewriteRules                = "key_rewrite_rules"
+	FilterVersion                  = "filter_version"
+	StartFrom                      = "start_from"
 	Active                         = "active"
 	CheckpointInterval             = "checkpoint_interval"
 	BatchCount                     = "worker_batch_size"
@@ -34,17 +46,60 @@ const (
 	TimeoutPercentageCap           = "timeout_percentage_cap"
 	PipelineLogLevel               = "log_level"
 	PipelineStatsInterval          = "stats_interval"
+	DcpConnectionBufferSize        = "dcp_connection_buffer_size"
+	DedupInBatch                   = "dedup_in_batch"
+	DcpRecordDir                   = "dcp_record_dir"
+	DcpReplayDir                   = "dcp_replay_dir"
+	DcpReplaySpeed                 = "dcp_replay_speed"
+	CompressionType                = "compression_type"
+	ConflictResolver               = "conflict_resolver"
+	ConflictLogSink                = "conflict_log_sink"
+	ConflictLogBody                = "conflict_log_body"
+	ConflictLogRetention           = "conflict_log_retention"
+	AdaptiveBatching               = "adaptive_batching"
+	MinBatchCount                  = "min_batch_count"
+	MinBatchSize                   = "min_batch_size_kb"
+	AdaptiveBatchLatencyTarget     = "adaptive_batch_latency_target"
+	BandwidthLimit                 = "bandwidth_limit"
+	DeadLetterEnabled              = "dead_letter_enabled"
+	DeadLetterCap                  = "dead_letter_cap"
+	ConnectionsPerTargetNozzle     = "connections_per_target_nozzle"
+	FileSinkDir                    = "file_sink_dir"
+	FileSinkFormat                 = "file_sink_format"
+	FileSinkRotateSize             = "file_sink_rotate_size_mb"
+	FileSinkRotateInterval         = "file_sink_rotate_interval"
+	WebhookUrl                     = "webhook_url"
+	WebhookTimeout                 = "webhook_timeout"
+	WebhookMaxRetries              = "webhook_max_retries"
+	WebhookSecret                  = "webhook_secret"
 )
 
 // settings whose default values cannot be viewed or changed through rest apis
-var ImmutableDefaultSettings = [3]string{ReplicationType, FilterExpression, Active}
+var ImmutableDefaultSettings = [12]string{ReplicationType, FilterExpression, FilterBodyExpression, KeyRewriteRules, FilterVersion, StartFrom, Active, DcpRecordDir, DcpReplayDir, FileSinkDir, WebhookUrl, WebhookSecret}
 
 // settings whose values cannot be changed after replication is created
-var ImmutableSettings = [1]string{FilterExpression}
+// filter expressions can be changed, see FilterVersion
+var ImmutableSettings = [2]string{KeyRewriteRules, StartFrom}
 
 const (
 	ReplicationTypeXmem = "xmem"
 	ReplicationTypeCapi = "capi"
+	// exports the change stream of source bucket into files on source nodes. there is no target cluster
+	ReplicationTypeFile = "file"
+	// posts the change stream of source bucket to a url. there is no target cluster
+	ReplicationTypeWebhook = "webhook"
+)
+
+// values of CompressionType setting
+const (
+	CompressionTypeNone   = "none"
+	CompressionTypeSnappy = "snappy"
+)
+
+// values of StartFrom setting, other than timestamps
+const (
+	StartFromBeginning = "beginning"
+	StartFromNow       = "now"
 )
 
 type SettingsConfig struct {
@@ -60,6 +115,11 @@ type Range struct {
 // TODO change to "capi"?
 var ReplicationTypeConfig = &SettingsConfig{ReplicationTypeXmem, nil}
 var FilterExpressionConfig = &SettingsConfig{"", nil}
+var FilterBodyExpressionConfig = &SettingsConfig{"", nil}
+var FilterDeletionsConfig = &SettingsConfig{false, nil}
+var FilterExpirationsConfig = &SettingsConfig{false, nil}
+var KeyRewriteRulesConfig = &SettingsConfig{"", nil}
+var StartFromConfig = &SettingsConfig{StartFromBeginning, nil}
 var ActiveConfig = &SettingsConfig{true, nil}
 var CheckpointIntervalConfig = &SettingsConfig{1800, &Range{60, 14400}}
 var BatchCountConfig = &SettingsConfig{500, &Range{500, 10000}}
@@ -72,10 +132,41 @@ var MaxExpectedReplicationLagConfig = &SettingsConfig{1000, &Range{100, 60000}}
 var TimeoutPercentageCapConfig = &SettingsConfig{50, &Range{0, 100}}
 var PipelineLogLevelConfig = &SettingsConfig{log.LogLevelInfo, nil}
 var PipelineStatsIntervalConfig = &SettingsConfig{1000, &Range{200, 600000}}
+var DcpConnectionBufferSizeConfig = &SettingsConfig{1024 * 1024, &Range{64 * 1024, 100 * 1024 * 1024}}
+var DedupInBatchConfig = &SettingsConfig{false, nil}
+var DcpRecordDirConfig = &SettingsConfig{"", nil}
+var DcpReplayDirConfig = &SettingsConfig{"", nil}
+var DcpReplaySpeedConfig = &SettingsConfig{0, &Range{0, 10000}}
+var CompressionTypeConfig = &SettingsConfig{CompressionTypeNone, nil}
+var ConflictResolverConfig = &SettingsConfig{base.ConflictResolverDefault, nil}
+var ConflictLogSinkConfig = &SettingsConfig{"", nil}
+var ConflictLogBodyConfig = &SettingsConfig{false, nil}
+var ConflictLogRetentionConfig = &SettingsConfig{7 * 24 * 60 * 60, &Range{60, 365 * 24 * 60 * 60}}
+var AdaptiveBatchingConfig = &SettingsConfig{false, nil}
+var MinBatchCountConfig = &SettingsConfig{50, &Range{1, 10000}}
+var MinBatchSizeConfig = &SettingsConfig{64, &Range{1, 10000}}
+var AdaptiveBatchLatencyTargetConfig = &SettingsConfig{500, &Range{10, 60000}}
+var BandwidthLimitConfig = &SettingsConfig{0, &Range{0, 1000000}}
+var DeadLetterEnabledConfig = &SettingsConfig{false, nil}
+var DeadLetterCapConfig = &SettingsConfig{1000, &Range{1, 100000}}
+var ConnectionsPerTargetNozzleConfig = &SettingsConfig{1, &Range{1, 16}}
+var FileSinkDirConfig = &SettingsConfig{"", nil}
+var FileSinkFormatConfig = &SettingsConfig{file_sink.FormatJSONLines, nil}
+var FileSinkRotateSizeConfig = &SettingsConfig{256, &Range{1, 1024 * 1024}}
+var FileSinkRotateIntervalConfig = &SettingsConfig{3600, &Range{10, 7 * 24 * 3600}}
+var WebhookUrlConfig = &SettingsConfig{"", nil}
+var WebhookTimeoutConfig = &SettingsConfig{10000, &Range{100, 600000}}
+var WebhookMaxRetriesConfig = &SettingsConfig{5, &Range{0, 100}}
+var WebhookSecretConfig = &SettingsConfig{"", nil}
 
 var SettingsConfigMap = map[string]*SettingsConfig{
 	ReplicationType:                ReplicationTypeConfig,
 	FilterExpression:               FilterExpressionConfig,
+	FilterBodyExpression:           FilterBodyExpressionConfig,
+	FilterDeletions:                FilterDeletionsConfig,
+	FilterExpirations:              FilterExpirationsConfig,
+	KeyRewriteRules:                KeyRewriteRulesConfig,
+	StartFrom:                      StartFromConfig,
 	Active:                         ActiveConfig,
 	CheckpointInterval:             CheckpointIntervalConfig,
 	BatchCount:                     BatchCountConfig,
@@ -88,6 +179,32 @@ var SettingsConfigMap = map[string]*SettingsConfig{
 	TimeoutPercentageCap:           TimeoutPercentageCapConfig,
 	PipelineLogLevel:               PipelineLogLevelConfig,
 	PipelineStatsInterval:          PipelineStatsIntervalConfig,
+	DcpConnectionBufferSize:        DcpConnectionBufferSizeConfig,
+	DedupInBatch:                   DedupInBatchConfig,
+	DcpRecordDir:                   DcpRecordDirConfig,
+	DcpReplayDir:                   DcpReplayDirConfig,
+	DcpReplaySpeed:                 DcpReplaySpeedConfig,
+	CompressionType:                CompressionTypeConfig,
+	ConflictResolver:               ConflictResolverConfig,
+	ConflictLogSink:                ConflictLogSinkConfig,
+	ConflictLogBody:                ConflictLogBodyConfig,
+	ConflictLogRetention:           ConflictLogRetentionConfig,
+	AdaptiveBatching:               AdaptiveBatchingConfig,
+	MinBatchCount:                  MinBatchCountConfig,
+	MinBatchSize:                   MinBatchSizeConfig,
+	AdaptiveBatchLatencyTarget:     AdaptiveBatchLatencyTargetConfig,
+	BandwidthLimit:                 BandwidthLimitConfig,
+	DeadLetterEnabled:              DeadLetterEnabledConfig,
+	DeadLetterCap:                  DeadLetterCapConfig,
+	ConnectionsPerTargetNozzle:     ConnectionsPerTargetNozzleConfig,
+	FileSinkDir:                    FileSinkDirConfig,
+	FileSinkFormat:                 FileSinkFormatConfig,
+	FileSinkRotateSize:             FileSinkRotateSizeConfig,
+	FileSinkRotateInterval:         FileSinkRotateIntervalConfig,
+	WebhookUrl:                     WebhookUrlConfig,
+	WebhookTimeout:                 WebhookTimeoutConfig,
+	WebhookMaxRetries:              WebhookMaxRetriesConfig,
+	WebhookSecret:                  WebhookSecretConfig,
 }
 
 /***********************************
@@ -101,6 +218,33 @@ type ReplicationSettings struct {
 	//the filter expression
 	FilterExpression string `json:"filter_exp"`
 
+	//the filter expression on the JSON body of documents, e.g., type = "order" AND region IN ["eu", "us"]
+	//see package filter for the syntax and semantics
+	FilterBodyExpression string `json:"filter_body_exp"`
+
+	//if true, deletions are not replicated to target, e.g., for archive clusters
+	//default: false
+	FilterDeletions bool `json:"filter_deletions"`
+
+	//if true, expirations are not replicated to target
+	//default: false
+	FilterExpirations bool `json:"filter_expirations"`
+
+	//rules to rewrite document keys before they are replicated to target, e.g., [{"type":"addPrefix","prefix":"eu::"}]
+	//see package key_rewrite for the syntax
+	KeyRewriteRules string `json:"key_rewrite_rules"`
+
+	//bumped when filter expressions are changed with re-streaming requested.
+	//checkpoints created under an older filter version are discarded so that replication restarts from seqno 0
+	//not exposed through rest api
+	FilterVersion int `json:"filter_version"`
+
+	//where a new replication starts from - "beginning", i.e., seqno 0, "now", i.e., the high seqnos when the replication is created,
+	//or a timestamp in RFC3339 format, i.e., the first mutation at or after the timestamp in each vbucket.
+	//the start seqnos are resolved when the replication is created, see ReplicationSpecification.StartSeqnos
+	//default: beginning
+	StartFrom string `json:"start_from"`
+
 	//if the replication is active
 	//default is true
 	Active bool `json:"active"`
@@ -160,6 +304,134 @@ type ReplicationSettings struct {
 	//default:5 second
 	StatsInterval int `json:"stats_interval"`
 
+	//size (in bytes) of the flow control buffer negotiated on dcp connections.
+	//it bounds the data that producer can send to a dcp nozzle before the data is acknowledged
+	//default: 1MB
+	//range: 64KB-100MB
+	DcpConnectionBufferSize int `json:"dcp_connection_buffer_size"`
+
+	//if true, when a batch of an xmem nozzle contains multiple mutations of the same document,
+	//only the latest one is sent to target
+	//default: false
+	DedupInBatch bool `json:"dedup_in_batch"`
+
+	//if not empty, the dcp events received by the dcp nozzles of the replication are recorded
+	//into files in the specified directory on the source node, one file per dcp nozzle
+	//default: ""
+	DcpRecordDir string `json:"dcp_record_dir"`
+
+	//if not empty, the replication reads dcp events from the recording files in the specified directory
+	//on the source node instead of from the source bucket
+	//default: ""
+	DcpReplayDir string `json:"dcp_replay_dir"`
+
+	//speed, in percentage of the recorded speed, at which recorded dcp events are replayed.
+	//0 means that events are replayed as fast as possible
+	//default: 0
+	//range: 0-10000
+	DcpReplaySpeed int `json:"dcp_replay_speed"`
+
+	//compression applied to the documents sent to target by xmem nozzles, none or snappy.
+	//snappy is used only when target supports it
+	//default: none
+	CompressionType string `json:"compression_type"`
+
+	//the conflict resolver used by xmem nozzles in source side conflict resolution,
+	//which is the name of a registered resolver optionally followed by ":" and an argument, e.g., json_field_max:updated_at
+	//default: default
+	ConflictResolver string `json:"conflict_resolver"`
+
+	//where docs that fail source side conflict resolution are logged, file:<directory> or bucket:<target bucket name>
+	//default: empty, i.e., conflict logging is disabled
+	ConflictLogSink string `json:"conflict_log_sink"`
+
+	//whether bodies of source docs are included in conflict log
+	//default: false
+	ConflictLogBody bool `json:"conflict_log_body"`
+
+	//the number of seconds conflict records are retained in bucket sinks and in memory
+	//default: 604800, i.e., 7 days
+	ConflictLogRetention int `json:"conflict_log_retention"`
+
+	//if true, xmem nozzles adjust the effective batch count and batch size between the min values below
+	//and BatchCount and BatchSize, based on the latencies of the docs sent
+	//default: false
+	AdaptiveBatching bool `json:"adaptive_batching"`
+
+	//the lower bound of the effective batch count when adaptive batching is enabled
+	//default: 50
+	//range: 1-10000
+	MinBatchCount int `json:"min_batch_count"`
+
+	//the lower bound of the effective batch size, in KB, when adaptive batching is enabled
+	//default: 64
+	//range: 1-10000
+	MinBatchSize int `json:"min_batch_size"`
+
+	//the latency, in milliseconds, above which adaptive batching shrinks batches
+	//default: 500
+	//range: 10-60000
+	AdaptiveBatchLatencyTarget int `json:"adaptive_batch_latency_target"`
+
+	//the max bandwidth, in MB/s, used by the replication to send docs to target, summed over all source nodes.
+	//0 means no limit
+	//default: 0
+	//range: 0-1000000
+	BandwidthLimit int `json:"bandwidth_limit"`
+
+	//if true, docs that target permanently rejects, e.g., since they are too big, are put into dead-letter store
+	//and skipped, instead of failing the replication
+	//default: false
+	DeadLetterEnabled bool `json:"dead_letter_enabled"`
+
+	//the max number of docs in dead-letter store, beyond which the replication fails as it does without dead-letter mode
+	//default: 1000
+	//range: 1-100000
+	DeadLetterCap int `json:"dead_letter_cap"`
+
+	//the number of connections that each target nozzle uses for sending docs to target. docs are assigned to
+	//connections by target vbucket. unlike target_nozzle_per_node, it does not add nozzles or batches
+	//default: 1
+	//range: 1-16
+	ConnectionsPerTargetNozzle int `json:"connections_per_target_nozzle"`
+
+	//the directory on source nodes that replications of file type export the change stream into.
+	//files are written into a sub directory named after the export, i.e., the target bucket name of the replication
+	//default: ""
+	FileSinkDir string `json:"file_sink_dir"`
+
+	//the format of the files that replications of file type write, jsonl or binary
+	//default: jsonl
+	FileSinkFormat string `json:"file_sink_format"`
+
+	//the size, in MB, beyond which files written by replications of file type are rotated
+	//default: 256
+	//range: 1-1048576
+	FileSinkRotateSize int `json:"file_sink_rotate_size_mb"`
+
+	//the number of seconds after which files written by replications of file type are rotated
+	//default: 3600
+	//range: 10-604800
+	FileSinkRotateInterval int `json:"file_sink_rotate_interval"`
+
+	//the http or https url that replications of webhook type post batches of the change stream to
+	//default: ""
+	WebhookUrl string `json:"webhook_url"`
+
+	//the timeout, in milliseconds, of each post by replications of webhook type
+	//default: 10000
+	//range: 100-600000
+	WebhookTimeout int `json:"webhook_timeout"`
+
+	//the number of times that replications of webhook type retry a failed post before the replication is restarted
+	//default: 5
+	//range: 0-100
+	WebhookMaxRetries int `json:"webhook_max_retries"`
+
+	//the key of the HMAC-SHA256 signature of posts by replications of webhook type. posts are not signed when empty
+	//default: ""
+	WebhookSecret string `json:"webhook_secret"`
+
 	// revision number to be used by metadata service. not included in json
 	Revision interface{}
 }
@@ -168,6 +440,11 @@ func DefaultSettings() *ReplicationSettings {
 	return &ReplicationSettings{
 		RepType:                        ReplicationTypeConfig.defaultValue.(string),
 		FilterExpression:               FilterExpressionConfig.defaultValue.(string),
+		FilterBodyExpression:           FilterBodyExpressionConfig.defaultValue.(string),
+		FilterDeletions:                FilterDeletionsConfig.defaultValue.(bool),
+		FilterExpirations:              FilterExpirationsConfig.defaultValue.(bool),
+		KeyRewriteRules:                KeyRewriteRulesConfig.defaultValue.(string),
+		StartFrom:                      StartFromConfig.defaultValue.(string),
 		Active:                         ActiveConfig.defaultValue.(bool),
 		CheckpointInterval:             CheckpointIntervalConfig.defaultValue.(int),
 		BatchCount:                     BatchCountConfig.defaultValue.(int),
@@ -180,6 +457,32 @@ func DefaultSettings() *ReplicationSettings {
 		TimeoutPercentageCap:           TimeoutPercentageCapConfig.defaultValue.(int),
 		LogLevel:                       PipelineLogLevelConfig.defaultValue.(log.LogLevel),
 		StatsInterval:                  PipelineStatsIntervalConfig.defaultValue.(int),
+		DcpConnectionBufferSize:        DcpConnectionBufferSizeConfig.defaultValue.(int),
+		DedupInBatch:                   DedupInBatchConfig.defaultValue.(bool),
+		DcpRecordDir:                   DcpRecordDirConfig.defaultValue.(string),
+		DcpReplayDir:                   DcpReplayDirConfig.defaultValue.(string),
+		DcpReplaySpeed:                 DcpReplaySpeedConfig.defaultValue.(int),
+		CompressionType:                CompressionTypeConfig.defaultValue.(string),
+		ConflictResolver:               ConflictResolverConfig.defaultValue.(string),
+		ConflictLogSink:                ConflictLogSinkConfig.defaultValue.(string),
+		ConflictLogBody:                ConflictLogBodyConfig.defaultValue.(bool),
+		ConflictLogRetention:           ConflictLogRetentionConfig.defaultValue.(int),
+		AdaptiveBatching:               AdaptiveBatchingConfig.defaultValue.(bool),
+		MinBatchCount:                  MinBatchCountConfig.defaultValue.(int),
+		MinBatchSize:                   MinBatchSizeConfig.defaultValue.(int),
+		AdaptiveBatchLatencyTarget:     AdaptiveBatchLatencyTargetConfig.defaultValue.(int),
+		BandwidthLimit:                 BandwidthLimitConfig.defaultValue.(int),
+		DeadLetterEnabled:              DeadLetterEnabledConfig.defaultValue.(bool),
+		DeadLetterCap:                  DeadLetterCapConfig.defaultValue.(int),
+		ConnectionsPerTargetNozzle:     ConnectionsPerTargetNozzleConfig.defaultValue.(int),
+		FileSinkDir:                    FileSinkDirConfig.defaultValue.(string),
+		FileSinkFormat:                 FileSinkFormatConfig.defaultValue.(string),
+		FileSinkRotateSize:             FileSinkRotateSizeConfig.defaultValue.(int),
+		FileSinkRotateInterval:         FileSinkRotateIntervalConfig.defaultValue.(int),
+		WebhookUrl:                     WebhookUrlConfig.defaultValue.(string),
+		WebhookTimeout:                 WebhookTimeoutConfig.defaultValue.(int),
+		WebhookMaxRetries:              WebhookMaxRetriesConfig.defaultValue.(int),
+		WebhookSecret:                  WebhookSecretConfig.defaultValue.(string),
 	}
 }
 
@@ -221,6 +524,66 @@ func (s *ReplicationSettings) UpdateSettingsFromMap(settingsMap map[string]inter
 				s.FilterExpression = filterExpression
 				changedSettingsMap[key] = filterExpression
 			}
+		case FilterBodyExpression:
+			filterBodyExpression, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.FilterBodyExpression != filterBodyExpression {
+				s.FilterBodyExpression = filterBodyExpression
+				changedSettingsMap[key] = filterBodyExpression
+			}
+		case KeyRewriteRules:
+			keyRewriteRules, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.KeyRewriteRules != keyRewriteRules {
+				s.KeyRewriteRules = keyRewriteRules
+				changedSettingsMap[key] = keyRewriteRules
+			}
+		case StartFrom:
+			startFrom, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.StartFrom != startFrom {
+				s.StartFrom = startFrom
+				changedSettingsMap[key] = startFrom
+			}
+		case FilterVersion:
+			filterVersion, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.FilterVersion != filterVersion {
+				s.FilterVersion = filterVersion
+				changedSettingsMap[key] = filterVersion
+			}
+		case FilterDeletions:
+			filterDeletions, ok := val.(bool)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "bool")
+				continue
+			}
+			if s.FilterDeletions != filterDeletions {
+				s.FilterDeletions = filterDeletions
+				changedSettingsMap[key] = filterDeletions
+			}
+		case FilterExpirations:
+			filterExpirations, ok := val.(bool)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "bool")
+				continue
+			}
+			if s.FilterExpirations != filterExpirations {
+				s.FilterExpirations = filterExpirations
+				changedSettingsMap[key] = filterExpirations
+			}
 		case Active:
 			active, ok := val.(bool)
 			if !ok {
@@ -342,6 +705,266 @@ func (s *ReplicationSettings) UpdateSettingsFromMap(settingsMap map[string]inter
 				s.StatsInterval = interval
 				changedSettingsMap[key] = interval
 			}
+		case DcpConnectionBufferSize:
+			bufferSize, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.DcpConnectionBufferSize != bufferSize {
+				s.DcpConnectionBufferSize = bufferSize
+				changedSettingsMap[key] = bufferSize
+			}
+		case DedupInBatch:
+			dedupInBatch, ok := val.(bool)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "bool")
+				continue
+			}
+			if s.DedupInBatch != dedupInBatch {
+				s.DedupInBatch = dedupInBatch
+				changedSettingsMap[key] = dedupInBatch
+			}
+		case DcpRecordDir:
+			recordDir, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.DcpRecordDir != recordDir {
+				s.DcpRecordDir = recordDir
+				changedSettingsMap[key] = recordDir
+			}
+		case DcpReplayDir:
+			replayDir, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.DcpReplayDir != replayDir {
+				s.DcpReplayDir = replayDir
+				changedSettingsMap[key] = replayDir
+			}
+		case DcpReplaySpeed:
+			replaySpeed, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.DcpReplaySpeed != replaySpeed {
+				s.DcpReplaySpeed = replaySpeed
+				changedSettingsMap[key] = replaySpeed
+			}
+		case CompressionType:
+			compressionType, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.CompressionType != compressionType {
+				s.CompressionType = compressionType
+				changedSettingsMap[key] = compressionType
+			}
+		case ConflictResolver:
+			conflictResolver, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.ConflictResolver != conflictResolver {
+				s.ConflictResolver = conflictResolver
+				changedSettingsMap[key] = conflictResolver
+			}
+		case ConflictLogSink:
+			conflictLogSink, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.ConflictLogSink != conflictLogSink {
+				s.ConflictLogSink = conflictLogSink
+				changedSettingsMap[key] = conflictLogSink
+			}
+		case ConflictLogBody:
+			conflictLogBody, ok := val.(bool)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "bool")
+				continue
+			}
+			if s.ConflictLogBody != conflictLogBody {
+				s.ConflictLogBody = conflictLogBody
+				changedSettingsMap[key] = conflictLogBody
+			}
+		case ConflictLogRetention:
+			conflictLogRetention, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.ConflictLogRetention != conflictLogRetention {
+				s.ConflictLogRetention = conflictLogRetention
+				changedSettingsMap[key] = conflictLogRetention
+			}
+		case AdaptiveBatching:
+			adaptiveBatching, ok := val.(bool)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "bool")
+				continue
+			}
+			if s.AdaptiveBatching != adaptiveBatching {
+				s.AdaptiveBatching = adaptiveBatching
+				changedSettingsMap[key] = adaptiveBatching
+			}
+		case MinBatchCount:
+			minBatchCount, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.MinBatchCount != minBatchCount {
+				s.MinBatchCount = minBatchCount
+				changedSettingsMap[key] = minBatchCount
+			}
+		case MinBatchSize:
+			minBatchSize, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.MinBatchSize != minBatchSize {
+				s.MinBatchSize = minBatchSize
+				changedSettingsMap[key] = minBatchSize
+			}
+		case AdaptiveBatchLatencyTarget:
+			latencyTarget, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.AdaptiveBatchLatencyTarget != latencyTarget {
+				s.AdaptiveBatchLatencyTarget = latencyTarget
+				changedSettingsMap[key] = latencyTarget
+			}
+		case BandwidthLimit:
+			bandwidthLimit, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.BandwidthLimit != bandwidthLimit {
+				s.BandwidthLimit = bandwidthLimit
+				changedSettingsMap[key] = bandwidthLimit
+			}
+		case DeadLetterEnabled:
+			deadLetterEnabled, ok := val.(bool)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "bool")
+				continue
+			}
+			if s.DeadLetterEnabled != deadLetterEnabled {
+				s.DeadLetterEnabled = deadLetterEnabled
+				changedSettingsMap[key] = deadLetterEnabled
+			}
+		case DeadLetterCap:
+			deadLetterCap, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.DeadLetterCap != deadLetterCap {
+				s.DeadLetterCap = deadLetterCap
+				changedSettingsMap[key] = deadLetterCap
+			}
+		case ConnectionsPerTargetNozzle:
+			connectionsPerTargetNozzle, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.ConnectionsPerTargetNozzle != connectionsPerTargetNozzle {
+				s.ConnectionsPerTargetNozzle = connectionsPerTargetNozzle
+				changedSettingsMap[key] = connectionsPerTargetNozzle
+			}
+		case FileSinkDir:
+			fileSinkDir, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.FileSinkDir != fileSinkDir {
+				s.FileSinkDir = fileSinkDir
+				changedSettingsMap[key] = fileSinkDir
+			}
+		case FileSinkFormat:
+			fileSinkFormat, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.FileSinkFormat != fileSinkFormat {
+				s.FileSinkFormat = fileSinkFormat
+				changedSettingsMap[key] = fileSinkFormat
+			}
+		case FileSinkRotateSize:
+			fileSinkRotateSize, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.FileSinkRotateSize != fileSinkRotateSize {
+				s.FileSinkRotateSize = fileSinkRotateSize
+				changedSettingsMap[key] = fileSinkRotateSize
+			}
+		case FileSinkRotateInterval:
+			fileSinkRotateInterval, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.FileSinkRotateInterval != fileSinkRotateInterval {
+				s.FileSinkRotateInterval = fileSinkRotateInterval
+				changedSettingsMap[key] = fileSinkRotateInterval
+			}
+		case WebhookUrl:
+			webhookUrl, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.WebhookUrl != webhookUrl {
+				s.WebhookUrl = webhookUrl
+				changedSettingsMap[key] = webhookUrl
+			}
+		case WebhookTimeout:
+			webhookTimeout, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.WebhookTimeout != webhookTimeout {
+				s.WebhookTimeout = webhookTimeout
+				changedSettingsMap[key] = webhookTimeout
+			}
+		case WebhookMaxRetries:
+			webhookMaxRetries, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.WebhookMaxRetries != webhookMaxRetries {
+				s.WebhookMaxRetries = webhookMaxRetries
+				changedSettingsMap[key] = webhookMaxRetries
+			}
+		case WebhookSecret:
+			webhookSecret, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.WebhookSecret != webhookSecret {
+				s.WebhookSecret = webhookSecret
+				changedSettingsMap[key] = webhookSecret
+			}
 		default:
 			errorMap[key] = errors.New(fmt.Sprintf("Invalid key in map, %v", key))
 		}
@@ -365,16 +988,51 @@ func (s *ReplicationSettings) Clone() *ReplicationSettings {
 
 	clone := &ReplicationSettings{}
 	clone.UpdateSettingsFromMap(s.ToMap())
+	// the webhook secret is not in the map
+	clone.WebhookSecret = s.WebhookSecret
 	return clone
 }
 
+// the webhook secret, like passwords, is not logged
+func (s *ReplicationSettings) String() string {
+	if s == nil {
+		return "nil"
+	}
+	return fmt.Sprintf("%v", s.ToMap())
+}
+
+// returns a copy of the settings map, in which the webhook secret, if present, is masked, for logging
+func RedactSettingsMap(settingsMap map[string]interface{}) map[string]interface{} {
+	if _, ok := settingsMap[WebhookSecret]; !ok {
+		return settingsMap
+	}
+	redactedMap := make(map[string]interface{})
+	for key, val := range settingsMap {
+		redactedMap[key] = val
+	}
+	redactedMap[WebhookSecret] = "xxxx"
+	return redactedMap
+}
+
 func (s *ReplicationSettings) toMap(isDefaultSettings bool) map[string]interface{} {
 	settings_map := make(map[string]interface{})
 	if !isDefaultSettings {
 		settings_map[ReplicationType] = s.RepType
 		settings_map[FilterExpression] = s.FilterExpression
+		settings_map[FilterBodyExpression] = s.FilterBodyExpression
+		settings_map[KeyRewriteRules] = s.KeyRewriteRules
+		settings_map[FilterVersion] = s.FilterVersion
+		settings_map[StartFrom] = s.StartFrom
 		settings_map[Active] = s.Active
+		settings_map[DcpRecordDir] = s.DcpRecordDir
+		settings_map[DcpReplayDir] = s.DcpReplayDir
+		settings_map[FileSinkDir] = s.FileSinkDir
+		settings_map[WebhookUrl] = s.WebhookUrl
+		// the webhook secret, like passwords, is kept only in the stored spec, and is not included in the map,
+		// which is used for output and logging. nozzles get it from the spec
 	}
+	settings_map[FilterDeletions] = s.FilterDeletions
+	settings_map[FilterExpirations] = s.FilterExpirations
 	settings_map[CheckpointInterval] = s.CheckpointInterval
 	settings_map[BatchCount] = s.BatchCount
 	settings_map[BatchSize] = s.BatchSize
@@ -387,13 +1045,34 @@ func (s *ReplicationSettings) toMap(isDefaultSettings bool) map[string]interface
 	settings_map[TimeoutPercentageCap] = s.TimeoutPercentageCap*/
 	settings_map[PipelineLogLevel] = s.LogLevel.String()
 	settings_map[PipelineStatsInterval] = s.StatsInterval
+	settings_map[DcpConnectionBufferSize] = s.DcpConnectionBufferSize
+	settings_map[DedupInBatch] = s.DedupInBatch
+	settings_map[DcpReplaySpeed] = s.DcpReplaySpeed
+	settings_map[CompressionType] = s.CompressionType
+	settings_map[ConflictResolver] = s.ConflictResolver
+	settings_map[ConflictLogSink] = s.ConflictLogSink
+	settings_map[ConflictLogBody] = s.ConflictLogBody
+	settings_map[ConflictLogRetention] = s.ConflictLogRetention
+	settings_map[AdaptiveBatching] = s.AdaptiveBatching
+	settings_map[MinBatchCount] = s.MinBatchCount
+	settings_map[MinBatchSize] = s.MinBatchSize
+	settings_map[AdaptiveBatchLatencyTarget] = s.AdaptiveBatchLatencyTarget
+	settings_map[BandwidthLimit] = s.BandwidthLimit
+	settings_map[DeadLetterEnabled] = s.DeadLetterEnabled
+	settings_map[DeadLetterCap] = s.DeadLetterCap
+	settings_map[ConnectionsPerTargetNozzle] = s.ConnectionsPerTargetNozzle
+	settings_map[FileSinkFormat] = s.FileSinkFormat
+	settings_map[FileSinkRotateSize] = s.FileSinkRotateSize
+	settings_map[FileSinkRotateInterval] = s.FileSinkRotateInterval
+	settings_map[WebhookTimeout] = s.WebhookTimeout
+	settings_map[WebhookMaxRetries] = s.WebhookMaxRetries
 	return settings_map
 }
 
 func ValidateAndConvertSettingsValue(key, value, errorKey string) (convertedValue interface{}, err error) {
 	switch key {
 	case ReplicationType:
-		if value != ReplicationTypeXmem && value != ReplicationTypeCapi {
+		if value != ReplicationTypeXmem && value != ReplicationTypeCapi && value != ReplicationTypeFile && value != ReplicationTypeWebhook {
 			err = simple_utils.GenericInvalidValueError(errorKey)
 		} else {
 			convertedValue = value
@@ -411,6 +1090,89 @@ func ValidateAndConvertSettingsValue(key, value, errorKey string) (convertedValu
 			return
 		}
 		convertedValue = value
+	case FilterBodyExpression:
+		// an empty body expression means no body filtering
+		if len(value) > 0 {
+			err = filter.Validate(value)
+			if err != nil {
+				return
+			}
+		}
+		convertedValue = value
+	case KeyRewriteRules:
+		// empty rules means that keys are not rewritten
+		if len(value) > 0 {
+			err = key_rewrite.Validate(value)
+			if err != nil {
+				return
+			}
+		}
+		convertedValue = value
+	case StartFrom:
+		if value != StartFromBeginning && value != StartFromNow {
+			startTime, ok := StartTimeFromSetting(value)
+			if !ok {
+				err = fmt.Errorf("The value must be %v, %v or a timestamp in RFC3339 format, e.g., 2016-01-02T15:04:05Z", StartFromBeginning, StartFromNow)
+				return
+			}
+			// mutations made between now and a future timestamp cannot be told apart from later ones
+			if startTime.After(time.Now()) {
+				err = fmt.Errorf("The timestamp cannot be in the future. Use %v instead", StartFromNow)
+				return
+			}
+		}
+		convertedValue = value
+	case CompressionType:
+		if value != CompressionTypeNone && value != CompressionTypeSnappy {
+			err = fmt.Errorf("The value must be %v or %v", CompressionTypeNone, CompressionTypeSnappy)
+			return
+		}
+		convertedValue = value
+	case ConflictResolver:
+		err = base.ValidateConflictResolver(value)
+		if err != nil {
+			return
+		}
+		convertedValue = value
+	case ConflictLogSink:
+		// empty value means that conflict logging is disabled
+		if len(value) > 0 {
+			_, _, err = conflict_log.ParseSinkSpec(value)
+			if err != nil {
+				return
+			}
+		}
+		convertedValue = value
+	case FileSinkFormat:
+		if value != file_sink.FormatJSONLines && value != file_sink.FormatBinary {
+			err = fmt.Errorf("The value must be %v or %v", file_sink.FormatJSONLines, file_sink.FormatBinary)
+			return
+		}
+		convertedValue = value
+	case FileSinkDir:
+		value, err = simple_utils.PathUnderRoot(value, base.XDCRDataDir)
+		if err != nil {
+			return
+		}
+		convertedValue = value
+	case WebhookUrl:
+		parsedUrl, parseErr := url.Parse(value)
+		if parseErr != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") || parsedUrl.Host == "" {
+			err = errors.New("The value must be an http or https url")
+			return
+		}
+		convertedValue = value
+	case WebhookSecret:
+		convertedValue = value
+	case DcpRecordDir, DcpReplayDir:
+		// empty value means that recording/replay is disabled
+		if len(value) > 0 {
+			value, err = simple_utils.PathUnderRoot(value, base.XDCRDataDir)
+			if err != nil {
+				return
+			}
+		}
+		convertedValue = value
 	case Active:
 		var paused bool
 		paused, err = strconv.ParseBool(value)
@@ -419,11 +1181,19 @@ func ValidateAndConvertSettingsValue(key, value, errorKey string) (convertedValu
 			return
 		}
 		convertedValue = !paused
+	case FilterDeletions, FilterExpirations, DedupInBatch, ConflictLogBody, AdaptiveBatching, DeadLetterEnabled:
+		convertedValue, err = strconv.ParseBool(value)
+		if err != nil {
+			err = simple_utils.IncorrectValueTypeError("a boolean")
+			return
+		}
 
 	case CheckpointInterval, BatchCount, BatchSize, FailureRestartInterval,
 		OptimisticReplicationThreshold, SourceNozzlePerNode,
 		TargetNozzlePerNode, MaxExpectedReplicationLag, TimeoutPercentageCap,
-		PipelineStatsInterval:
+		PipelineStatsInterval, DcpConnectionBufferSize, DcpReplaySpeed, ConflictLogRetention,
+		MinBatchCount, MinBatchSize, AdaptiveBatchLatencyTarget, BandwidthLimit, DeadLetterCap,
+		ConnectionsPerTargetNozzle, FileSinkRotateSize, FileSinkRotateInterval, WebhookTimeout, WebhookMaxRetries:
 		convertedValue, err = strconv.ParseInt(value, base.ParseIntBase, base.ParseIntBitSize)
 		if err != nil {
 			err = simple_utils.IncorrectValueTypeError("an integer")
@@ -476,6 +1246,11 @@ func ValidateSettingsKey(settingsMap map[string]interface{}) (returnedSettingsMa
 		switch key {
 
 		case ReplicationType, FilterExpression,
+			FilterBodyExpression,
+			FilterDeletions,
+			FilterExpirations,
+			KeyRewriteRules,
+			StartFrom,
 			Active,
 			CheckpointInterval,
 			BatchCount,
@@ -487,7 +1262,33 @@ func ValidateSettingsKey(settingsMap map[string]interface{}) (returnedSettingsMa
 			MaxExpectedReplicationLag,
 			TimeoutPercentageCap,
 			PipelineLogLevel,
-			PipelineStatsInterval:
+			PipelineStatsInterval,
+			DcpConnectionBufferSize,
+			DedupInBatch,
+			DcpRecordDir,
+			DcpReplayDir,
+			DcpReplaySpeed,
+			CompressionType,
+			ConflictResolver,
+			ConflictLogSink,
+			ConflictLogBody,
+			ConflictLogRetention,
+			AdaptiveBatching,
+			MinBatchCount,
+			MinBatchSize,
+			AdaptiveBatchLatencyTarget,
+			BandwidthLimit,
+			DeadLetterEnabled,
+			DeadLetterCap,
+			ConnectionsPerTargetNozzle,
+			FileSinkDir,
+			FileSinkFormat,
+			FileSinkRotateSize,
+			FileSinkRotateInterval,
+			WebhookUrl,
+			WebhookTimeout,
+			WebhookMaxRetries,
+			WebhookSecret:
 			returnedSettingsMap[key] = val
 		}
 	}
@@ -503,3 +1304,22 @@ func RangeCheck(intValue int, settingsConfig *SettingsConfig) error {
 	}
 	return nil
 }
+
+// returns the start time specified by StartFrom setting. the second return value is false when StartFrom is not a timestamp
+func StartTimeFromSetting(startFrom string) (time.Time, bool) {
+	startTime, err := time.Parse(time.RFC3339, startFrom)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return startTime, true
+}
+
+// returns the cas that corresponds to the start time specified by StartFrom setting, or 0 when StartFrom is not a timestamp.
+// cas of mutations is a hybrid logical clock, i.e., nanoseconds since epoch with the lowest 16 bits used as a logical counter
+func (s *ReplicationSettings) StartCas() uint64 {
+	startTime, ok := StartTimeFromSetting(s.StartFrom)
+	if !ok || startTime.UnixNano() <= 0 {
+		return 0
+	}
+	return uint64(startTime.UnixNano()) &^ 0xFFFF
+}
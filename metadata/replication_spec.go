@@ -16,6 +16,15 @@ import (
 	"strings"
 )
 
+// target cluster uuids of replications that have no target cluster. the target bucket name of such replications
+// is the name of the export
+const (
+	// replications of file type export the change stream of source bucket into files
+	FileTargetClusterUUID = "file"
+	// replications of webhook type post the change stream of source bucket to a url
+	WebhookTargetClusterUUID = "webhook"
+)
+
 /************************************
 /* struct ReplicationSpecification
 *************************************/
@@ -39,6 +48,14 @@ type ReplicationSpecification struct {
 
 	Settings *ReplicationSettings `json:"replicationSettings"`
 
+	// vbno -> seqno that the replication starts from in the source vbucket, resolved from the StartFrom setting when
+	// the replication is created. vbuckets that are not in the map start from seqno 0
+	StartSeqnos map[uint16]uint64 `json:"startSeqnos,omitempty"`
+
+	// vbno -> vbuuid of the source vbucket at the time the start seqnos are resolved, which is needed to stream
+	// from the start seqno without a rollback to 0
+	StartVBUuids map[uint16]uint64 `json:"startVBUuids,omitempty"`
+
 	// revision number to be used by metadata service. not included in json
 	Revision interface{}
 }
@@ -74,7 +91,36 @@ func (spec *ReplicationSpecification) Clone() *ReplicationSpecification {
 		SourceBucketName:  spec.SourceBucketName,
 		TargetClusterUUID: spec.TargetClusterUUID,
 		TargetBucketName:  spec.TargetBucketName,
-		Settings:          spec.Settings.Clone()}
+		Settings:          spec.Settings.Clone(),
+		StartSeqnos:       spec.StartSeqnos,
+		StartVBUuids:      spec.StartVBUuids}
+}
+
+// checks if the replication exports the change stream of source bucket into files instead of replicating to a target cluster
+func (spec *ReplicationSpecification) IsFileTarget() bool {
+	return spec.TargetClusterUUID == FileTargetClusterUUID
+}
+
+// checks if the replication posts the change stream of source bucket to a url instead of replicating to a target cluster
+func (spec *ReplicationSpecification) IsWebhookTarget() bool {
+	return spec.TargetClusterUUID == WebhookTargetClusterUUID
+}
+
+// checks if the replication replicates to a target cluster, i.e., is neither of file type nor of webhook type
+func (spec *ReplicationSpecification) HasTargetCluster() bool {
+	return !spec.IsFileTarget() && !spec.IsWebhookTarget()
+}
+
+// returns the target cluster uuid of replications of the specified type when they have no target cluster,
+// and "" otherwise
+func TargetClusterUUIDForRepType(repType string) string {
+	switch repType {
+	case ReplicationTypeFile:
+		return FileTargetClusterUUID
+	case ReplicationTypeWebhook:
+		return WebhookTargetClusterUUID
+	}
+	return ""
 }
 
 func ReplicationId(sourceBucketName string, targetClusterUUID string, targetBucketName string) string {
@@ -172,6 +172,15 @@ func (service *ReplicationSpecService) ValidateNewReplicationSpec(sourceBucket,
 		sourceBucketUUID = sourceBucketObj.UUID
 	}
 
+	// replications of file and webhook types export into files on local nodes or to a url respectively,
+	// and have no target cluster or target bucket
+	repType, _ := settings[metadata.ReplicationType].(string)
+	if metadata.TargetClusterUUIDForRepType(repType) != "" {
+		service.validateNewExportReplicationSpec(sourceBucket, targetBucket, repType, settings, errorMap)
+		service.logger.Infof("Finished ValidateAddReplicationSpec. errorMap=%v\n", errorMap)
+		return sourceBucketUUID, "", nil, errorMap
+	}
+
 	// validate remote cluster ref
 	start_time = time.Now()
 	targetClusterRef, err := service.remote_cluster_svc.RemoteClusterByRefName(targetCluster, true)
@@ -247,6 +256,30 @@ func (service *ReplicationSpecService) ValidateNewReplicationSpec(sourceBucket,
 	return sourceBucketUUID, targetBucketUUID, targetClusterRef, errorMap
 }
 
+// for replications of file and webhook types, targetBucket is the name of the export. for file type it names
+// the directory that the files of the replication are written into
+func (service *ReplicationSpecService) validateNewExportReplicationSpec(sourceBucket, targetBucket, repType string, settings map[string]interface{}, errorMap map[string]error) {
+	if targetBucket == "" || strings.ContainsAny(targetBucket, "/\\") || targetBucket == "." || targetBucket == ".." {
+		errorMap[base.ToBucket] = fmt.Errorf("Invalid export name '%v'", targetBucket)
+	}
+
+	if repType == metadata.ReplicationTypeWebhook {
+		if url, ok := settings[metadata.WebhookUrl]; !ok || url == "" {
+			errorMap[metadata.WebhookUrl] = errors.New("The url to post to is required for replications of webhook type")
+		}
+	} else {
+		if dir, ok := settings[metadata.FileSinkDir]; !ok || dir == "" {
+			errorMap[metadata.FileSinkDir] = errors.New("The directory to write files into is required for replications of file type")
+		}
+	}
+
+	repId := metadata.ReplicationId(sourceBucket, metadata.TargetClusterUUIDForRepType(repType), targetBucket)
+	_, err := service.replicationSpec(repId)
+	if err == nil {
+		errorMap[base.PlaceHolderFieldKey] = errors.New(ReplicationSpecAlreadyExistErrorMessage)
+	}
+}
+
 func (service *ReplicationSpecService) validateBucket(sourceBucket, targetCluster, targetBucket string, bucket *couchbase.Bucket, err error, errorMap map[string]error, isSourceBucket bool) {
 	var qualifier, errKey, bucketName string
 	if isSourceBucket {
@@ -483,11 +516,19 @@ func (service *ReplicationSpecService) updateCache(specId string, newSpec *metad
 func (service *ReplicationSpecService) writeUiLog(spec *metadata.ReplicationSpecification, action, reason string) {
 	if service.uilog_svc != nil {
 		var uiLogMsg string
-		remoteClusterName := service.remote_cluster_svc.GetRemoteClusterNameFromClusterUuid(spec.TargetClusterUUID)
+		var target string
+		if spec.IsFileTarget() {
+			target = fmt.Sprintf("files \"%s\"", spec.TargetBucketName)
+		} else if spec.IsWebhookTarget() {
+			target = fmt.Sprintf("webhook \"%s\"", spec.TargetBucketName)
+		} else {
+			remoteClusterName := service.remote_cluster_svc.GetRemoteClusterNameFromClusterUuid(spec.TargetClusterUUID)
+			target = fmt.Sprintf("bucket \"%s\" on cluster \"%s\"", spec.TargetBucketName, remoteClusterName)
+		}
 		if reason != "" {
-			uiLogMsg = fmt.Sprintf("Replication from bucket \"%s\" to bucket \"%s\" on cluster \"%s\" %s, since %s", spec.SourceBucketName, spec.TargetBucketName, remoteClusterName, action, reason)
+			uiLogMsg = fmt.Sprintf("Replication from bucket \"%s\" to %s %s, since %s", spec.SourceBucketName, target, action, reason)
 		} else {
-			uiLogMsg = fmt.Sprintf("Replication from bucket \"%s\" to bucket \"%s\" on cluster \"%s\" %s.", spec.SourceBucketName, spec.TargetBucketName, remoteClusterName, action)
+			uiLogMsg = fmt.Sprintf("Replication from bucket \"%s\" to %s %s.", spec.SourceBucketName, target, action)
 		}
 		service.uilog_svc.Write(uiLogMsg)
 	}
@@ -535,6 +576,10 @@ func (service *ReplicationSpecService) ValidateExistingReplicationSpec(spec *met
 		return InvalidReplicationSpecError, errors.New(errMsg)
 	}
 
+	if !spec.HasTargetCluster() {
+		return nil, nil
+	}
+
 	//validate target cluster
 	targetClusterRef, err := service.remote_cluster_svc.RemoteClusterByUuid(spec.TargetClusterUUID, true)
 	if err == service_def.MetadataNotFoundErr {
@@ -621,9 +666,13 @@ func (service *ReplicationSpecService) ConstructNewReplicationSpec(sourceBucketN
 		return nil, err
 	}
 
-	targetBucketUUID, err := service.targetBucketUUID(targetClusterUUID, targetBucketName)
-	if err != nil {
-		return nil, err
+	// there is no target bucket for replications of file and webhook types
+	targetBucketUUID := ""
+	if targetClusterUUID != metadata.FileTargetClusterUUID && targetClusterUUID != metadata.WebhookTargetClusterUUID {
+		targetBucketUUID, err = service.targetBucketUUID(targetClusterUUID, targetBucketName)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	spec := metadata.NewReplicationSpecification(sourceBucketName, sourceBucketUUID, targetClusterUUID, targetBucketName, targetBucketUUID)
@@ -0,0 +1,151 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"sync"
+	"time"
+)
+
+// factor by which the effective batch count and size are multiplied when latencies are above target
+var AdaptiveBatchDecreaseFactor = 0.5
+
+// number of additive steps for the effective batch count and size to grow from min to max
+var AdaptiveBatchIncreaseSteps = 20
+
+// min number of responses between two adjustments, so that a few slow docs do not shrink batches
+var AdaptiveBatchMinSamples = 10
+
+// docs latency, which includes the time docs wait in nozzle before being sent, is allowed to be
+// this many times the latency target before batches are shrunk
+var AdaptiveBatchDocsLatencyFactor = 2.0
+
+// adaptiveBatchSizer adjusts the effective batch count and size of a nozzle between the configured min and max
+// with AIMD, i.e., it increases them additively while latencies stay below target, and decreases them
+// multiplicatively when latencies exceed target.
+// when disabled, the effective batch count and size are the configured max
+type adaptiveBatchSizer struct {
+	enabled        bool
+	min_count      int
+	max_count      int
+	min_size       int
+	max_size       int
+	latency_target time.Duration
+
+	// effective batch count and size, in KB
+	cur_count int
+	cur_size  int
+
+	// latencies of the responses received since last adjustment
+	resp_wait_sum    time.Duration
+	docs_latency_sum time.Duration
+	resp_count       int
+
+	lock sync.Mutex
+}
+
+func newAdaptiveBatchSizer() *adaptiveBatchSizer {
+	return &adaptiveBatchSizer{}
+}
+
+// (re)configures the sizer. the effective values are kept when they are within the new bounds
+func (sizer *adaptiveBatchSizer) configure(enabled bool, min_count, max_count, min_size, max_size int, latency_target time.Duration) {
+	sizer.lock.Lock()
+	defer sizer.lock.Unlock()
+
+	sizer.enabled = enabled
+	sizer.max_count = max_count
+	sizer.max_size = max_size
+	sizer.min_count = minInt(min_count, max_count)
+	sizer.min_size = minInt(min_size, max_size)
+	sizer.latency_target = latency_target
+
+	if !enabled || sizer.cur_count == 0 {
+		// start with the configured max, which is what nozzles use without adaptive batching
+		sizer.cur_count = max_count
+		sizer.cur_size = max_size
+	} else {
+		sizer.cur_count = clampInt(sizer.cur_count, sizer.min_count, sizer.max_count)
+		sizer.cur_size = clampInt(sizer.cur_size, sizer.min_size, sizer.max_size)
+	}
+	sizer.resetSamples()
+}
+
+// records the latencies of a doc that has been acknowledged by target
+func (sizer *adaptiveBatchSizer) recordResponse(resp_wait_time, docs_latency time.Duration) {
+	sizer.lock.Lock()
+	defer sizer.lock.Unlock()
+	if !sizer.enabled {
+		return
+	}
+	sizer.resp_wait_sum += resp_wait_time
+	sizer.docs_latency_sum += docs_latency
+	sizer.resp_count++
+}
+
+// adjusts the effective batch count and size based on the latencies recorded since last adjustment,
+// and returns the adjusted values. called when a new batch is started
+func (sizer *adaptiveBatchSizer) adjust() (int, int) {
+	sizer.lock.Lock()
+	defer sizer.lock.Unlock()
+
+	if !sizer.enabled || sizer.resp_count < AdaptiveBatchMinSamples {
+		return sizer.cur_count, sizer.cur_size
+	}
+
+	avg_resp_wait := sizer.resp_wait_sum / time.Duration(sizer.resp_count)
+	avg_docs_latency := sizer.docs_latency_sum / time.Duration(sizer.resp_count)
+	sizer.resetSamples()
+
+	if avg_resp_wait > sizer.latency_target ||
+		float64(avg_docs_latency) > float64(sizer.latency_target)*AdaptiveBatchDocsLatencyFactor {
+		sizer.cur_count = maxInt(int(float64(sizer.cur_count)*AdaptiveBatchDecreaseFactor), sizer.min_count)
+		sizer.cur_size = maxInt(int(float64(sizer.cur_size)*AdaptiveBatchDecreaseFactor), sizer.min_size)
+	} else {
+		sizer.cur_count = minInt(sizer.cur_count+increaseStep(sizer.min_count, sizer.max_count), sizer.max_count)
+		sizer.cur_size = minInt(sizer.cur_size+increaseStep(sizer.min_size, sizer.max_size), sizer.max_size)
+	}
+	return sizer.cur_count, sizer.cur_size
+}
+
+// returns the current effective batch count and size, in KB
+func (sizer *adaptiveBatchSizer) current() (int, int) {
+	sizer.lock.Lock()
+	defer sizer.lock.Unlock()
+	return sizer.cur_count, sizer.cur_size
+}
+
+func (sizer *adaptiveBatchSizer) resetSamples() {
+	sizer.resp_wait_sum = 0
+	sizer.docs_latency_sum = 0
+	sizer.resp_count = 0
+}
+
+func increaseStep(min, max int) int {
+	return maxInt((max-min)/AdaptiveBatchIncreaseSteps, 1)
+}
+
+func clampInt(val, min, max int) int {
+	return maxInt(minInt(val, max), min)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"testing"
+	"time"
+)
+
+const testAdaptiveBatchLatencyTarget = 100 * time.Millisecond
+
+// records enough responses with the specified latencies for the next adjustment to take effect
+func recordTestResponses(sizer *adaptiveBatchSizer, resp_wait_time, docs_latency time.Duration) {
+	for i := 0; i < AdaptiveBatchMinSamples; i++ {
+		sizer.recordResponse(resp_wait_time, docs_latency)
+	}
+}
+
+func newTestAdaptiveBatchSizer() *adaptiveBatchSizer {
+	sizer := newAdaptiveBatchSizer()
+	// count between 100 and 2100, size between 200 and 4200, which grow by 100 and 200 in each step
+	sizer.configure(true, 100, 2100, 200, 4200, testAdaptiveBatchLatencyTarget)
+	return sizer
+}
+
+func TestAdaptiveBatchDecrease(t *testing.T) {
+	sizer := newTestAdaptiveBatchSizer()
+	if count, size := sizer.current(); count != 2100 || size != 4200 {
+		t.Fatalf("expected sizer to start with max, got count=%v size=%v", count, size)
+	}
+
+	recordTestResponses(sizer, 2*testAdaptiveBatchLatencyTarget, 0)
+	if count, size := sizer.adjust(); count != 1050 || size != 2100 {
+		t.Errorf("expected batches to be halved when response wait time is above target, got count=%v size=%v", count, size)
+	}
+
+	// docs latency is allowed to be above target within AdaptiveBatchDocsLatencyFactor
+	recordTestResponses(sizer, 0, 3*testAdaptiveBatchLatencyTarget/2)
+	if count, size := sizer.adjust(); count != 1150 || size != 2300 {
+		t.Errorf("expected batches to grow when docs latency is within limit, got count=%v size=%v", count, size)
+	}
+	recordTestResponses(sizer, 0, 3*testAdaptiveBatchLatencyTarget)
+	if count, size := sizer.adjust(); count != 575 || size != 1150 {
+		t.Errorf("expected batches to be halved when docs latency is above limit, got count=%v size=%v", count, size)
+	}
+}
+
+func TestAdaptiveBatchIncrease(t *testing.T) {
+	sizer := newTestAdaptiveBatchSizer()
+	recordTestResponses(sizer, 2*testAdaptiveBatchLatencyTarget, 0)
+	sizer.adjust()
+
+	for i := 1; i <= 3; i++ {
+		recordTestResponses(sizer, testAdaptiveBatchLatencyTarget/2, testAdaptiveBatchLatencyTarget/2)
+		if count, size := sizer.adjust(); count != 1050+100*i || size != 2100+200*i {
+			t.Errorf("expected batches to grow additively in step %v, got count=%v size=%v", i, count, size)
+		}
+	}
+
+	// no adjustment with fewer samples than AdaptiveBatchMinSamples
+	sizer.recordResponse(2*testAdaptiveBatchLatencyTarget, 0)
+	if count, size := sizer.adjust(); count != 1350 || size != 2700 {
+		t.Errorf("expected batches not to be adjusted with too few samples, got count=%v size=%v", count, size)
+	}
+}
+
+func TestAdaptiveBatchClamp(t *testing.T) {
+	sizer := newTestAdaptiveBatchSizer()
+	// decreases stop at min
+	for i := 0; i < 10; i++ {
+		recordTestResponses(sizer, 2*testAdaptiveBatchLatencyTarget, 0)
+		sizer.adjust()
+	}
+	if count, size := sizer.current(); count != 100 || size != 200 {
+		t.Errorf("expected batches to be clamped to min, got count=%v size=%v", count, size)
+	}
+
+	// increases stop at max
+	for i := 0; i < AdaptiveBatchIncreaseSteps+5; i++ {
+		recordTestResponses(sizer, 0, 0)
+		sizer.adjust()
+	}
+	if count, size := sizer.current(); count != 2100 || size != 4200 {
+		t.Errorf("expected batches to be clamped to max, got count=%v size=%v", count, size)
+	}
+
+	// effective values are clamped to new bounds on reconfiguration
+	sizer.configure(true, 10, 500, 20, 1000, testAdaptiveBatchLatencyTarget)
+	if count, size := sizer.current(); count != 500 || size != 1000 {
+		t.Errorf("expected batches to be clamped to new max, got count=%v size=%v", count, size)
+	}
+	sizer.configure(true, 800, 1000, 1600, 2000, testAdaptiveBatchLatencyTarget)
+	if count, size := sizer.current(); count != 800 || size != 1600 {
+		t.Errorf("expected batches to be clamped to new min, got count=%v size=%v", count, size)
+	}
+
+	// min above max is capped to max
+	sizer.configure(true, 3000, 1000, 5000, 2000, testAdaptiveBatchLatencyTarget)
+	recordTestResponses(sizer, 2*testAdaptiveBatchLatencyTarget, 0)
+	if count, size := sizer.adjust(); count != 1000 || size != 2000 {
+		t.Errorf("expected min to be capped to max, got count=%v size=%v", count, size)
+	}
+
+	// disabled sizer uses max and ignores latencies
+	sizer.configure(false, 100, 2100, 200, 4200, testAdaptiveBatchLatencyTarget)
+	recordTestResponses(sizer, 2*testAdaptiveBatchLatencyTarget, 0)
+	if count, size := sizer.adjust(); count != 2100 || size != 4200 {
+		t.Errorf("expected disabled sizer to use max, got count=%v size=%v", count, size)
+	}
+}
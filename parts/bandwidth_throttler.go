@@ -0,0 +1,101 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// max number of seconds worth of bytes that can be sent in a burst after a replication has been idle
+var BandwidthBurstSeconds = 1.0
+
+// BandwidthThrottler is a token bucket that caps the bytes per second sent to target by the outgoing nozzles
+// of a pipeline on the current node. the limit of the replication is for the whole cluster, and each node gets
+// the share of it that corresponds to the share of source vbuckets on the node.
+// this is an approximation, since nodes do not coordinate with each other. it assumes that mutations are spread
+// evenly across vbuckets, and the total bandwidth can stay below the limit when they are not, since nodes cannot use
+// the share that other nodes leave unused. the share is computed when the pipeline is constructed
+type BandwidthThrottler struct {
+	// share of source vbuckets on the current node, in (0, 1]
+	node_share float64
+	// bytes per second allowed on the current node. 0 means no limit
+	rate float64
+	// bytes that can be sent without waiting. negative when bytes have been sent ahead of the rate
+	tokens      float64
+	last_refill time.Time
+	lock        sync.Mutex
+}
+
+// implemented by outgoing nozzles that can be throttled
+type BandwidthThrottledNozzle interface {
+	SetBandwidthThrottler(throttler *BandwidthThrottler)
+}
+
+func NewBandwidthThrottler(node_share float64) *BandwidthThrottler {
+	if node_share <= 0 || node_share > 1 {
+		node_share = 1
+	}
+	return &BandwidthThrottler{node_share: node_share, last_refill: time.Now()}
+}
+
+// sets the bandwidth limit of the replication in MB/s. 0 means no limit.
+// the tokens accumulated at the old rate are kept up to the burst capacity at the new rate
+func (throttler *BandwidthThrottler) SetLimit(limit_mb int) {
+	throttler.lock.Lock()
+	defer throttler.lock.Unlock()
+	rate := float64(limit_mb) * 1024 * 1024 * throttler.node_share
+	if rate != throttler.rate {
+		now := time.Now()
+		if throttler.rate > 0 {
+			throttler.refill(now)
+		}
+		throttler.rate = rate
+		throttler.tokens = math.Min(throttler.tokens, rate*BandwidthBurstSeconds)
+		throttler.last_refill = now
+	}
+}
+
+// adds the tokens accumulated since last refill, up to the burst capacity
+func (throttler *BandwidthThrottler) refill(now time.Time) {
+	throttler.tokens = math.Min(throttler.tokens+now.Sub(throttler.last_refill).Seconds()*throttler.rate, throttler.rate*BandwidthBurstSeconds)
+	throttler.last_refill = now
+}
+
+// blocks until num_bytes can be sent within the limit, or until finch is closed
+func (throttler *BandwidthThrottler) Throttle(num_bytes int, finch chan bool) {
+	if throttler == nil {
+		return
+	}
+
+	throttler.lock.Lock()
+	if throttler.rate <= 0 {
+		throttler.lock.Unlock()
+		return
+	}
+	throttler.refill(time.Now())
+	// take the tokens upfront, so that concurrent senders queue up behind each other
+	throttler.tokens -= float64(num_bytes)
+	var wait_time time.Duration
+	if throttler.tokens < 0 {
+		wait_time = time.Duration(-throttler.tokens / throttler.rate * float64(time.Second))
+	}
+	throttler.lock.Unlock()
+
+	if wait_time > 0 {
+		timer := time.NewTimer(wait_time)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-finch:
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+const testMB = 1024 * 1024
+
+// checks the tokens of the throttler against the expected value, with a tolerance since time passes in the test
+func checkTestTokens(t *testing.T, throttler *BandwidthThrottler, expected float64, description string) {
+	throttler.lock.Lock()
+	tokens := throttler.tokens
+	throttler.lock.Unlock()
+	if math.Abs(tokens-expected) > 0.01*testMB {
+		t.Errorf("expected %v tokens %v, got %v", expected, description, tokens)
+	}
+}
+
+func TestBandwidthThrottlerNodeShare(t *testing.T) {
+	throttler := NewBandwidthThrottler(0.25)
+	throttler.SetLimit(8)
+	if throttler.rate != 2*testMB {
+		t.Errorf("expected the rate to be the node share of the limit, got %v", throttler.rate)
+	}
+	for _, node_share := range []float64{0, -1, 2} {
+		if throttler := NewBandwidthThrottler(node_share); throttler.node_share != 1 {
+			t.Errorf("expected invalid node share %v to be replaced by 1, got %v", node_share, throttler.node_share)
+		}
+	}
+}
+
+func TestBandwidthThrottlerSetLimit(t *testing.T) {
+	throttler := NewBandwidthThrottler(1)
+	throttler.SetLimit(4)
+	throttler.lock.Lock()
+	throttler.tokens = 3 * testMB
+	throttler.last_refill = time.Now()
+	throttler.lock.Unlock()
+
+	// tokens are kept when they are within the new capacity
+	throttler.SetLimit(8)
+	checkTestTokens(t, throttler, 3*testMB, "to be kept after raising the limit")
+	throttler.SetLimit(1)
+	checkTestTokens(t, throttler, 1*testMB, "to be capped to the new capacity after lowering the limit")
+
+	// bytes sent ahead of the rate are still owed after the limit is changed
+	throttler.lock.Lock()
+	throttler.tokens = -testMB
+	throttler.last_refill = time.Now()
+	throttler.lock.Unlock()
+	throttler.SetLimit(2)
+	checkTestTokens(t, throttler, -testMB, "to be kept when negative")
+
+	// setting the same limit does not change the tokens
+	throttler.SetLimit(2)
+	checkTestTokens(t, throttler, -testMB, "to be kept when the limit does not change")
+}
+
+func TestBandwidthThrottlerThrottle(t *testing.T) {
+	var nilThrottler *BandwidthThrottler
+	nilThrottler.Throttle(testMB, nil)
+
+	throttler := NewBandwidthThrottler(1)
+	start := time.Now()
+	throttler.Throttle(100*testMB, nil)
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("expected no wait without limit")
+	}
+
+	// at 10MB/s, sending 2MB with no tokens takes 200ms
+	throttler.SetLimit(10)
+	start = time.Now()
+	throttler.Throttle(2*testMB, nil)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected to wait for about 200ms, waited %v", elapsed)
+	}
+
+	// the wait ends when finch is closed
+	finch := make(chan bool)
+	close(finch)
+	start = time.Now()
+	throttler.Throttle(100*testMB, finch)
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("expected the wait to end when finch is closed")
+	}
+}
@@ -63,7 +63,10 @@ var capi_setting_defs base.SettingDefinitions = base.SettingDefinitions{SETTING_
 	SETTING_READ_TIMEOUT:          base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
 	SETTING_MAX_RETRY_INTERVAL:    base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
 	SETTING_UPLOAD_WINDOW_SIZE:    base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
-	SETTING_CONNECTION_TIMEOUT:    base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false)}
+	SETTING_CONNECTION_TIMEOUT:    base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
+	SETTING_CONFLICT_LOG_ENABLED:  base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	SETTING_CONFLICT_LOG_BODY:     base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	SETTING_BANDWIDTH_LIMIT:       base.NewSettingDef(reflect.TypeOf((*int)(nil)), false)}
 
 var NewEditsKey = "new_edits"
 var DocsKey = "docs"
@@ -170,7 +173,7 @@ type CapiNozzle struct {
 	//the total size of data (in bytes) queued in all data channels
 	bytes_in_dataChan int
 
-	client *net.TCPConn
+	client net.Conn
 
 	//configurable parameter
 	config capiConfig
@@ -199,6 +202,9 @@ type CapiNozzle struct {
 
 	// buffer to hold http responses from target
 	res_buf []byte
+
+	// caps the bandwidth used by the outgoing nozzles of the pipeline
+	bandwidth_throttler *BandwidthThrottler
 }
 
 func NewCapiNozzle(id string,
@@ -620,10 +626,12 @@ func (capi *CapiNozzle) batchSendWithRetry(batch *capiBatch) error {
 		} else {
 			if needSend == Not_Send_Failed_CR {
 				capi.Logger().Debugf("%v did not send doc with key %v since it failed conflict resolution\n", capi.Id(), string(item.Req.Key))
+				// metadata of target docs is not available since conflict resolution is done by target through _revs_diff
 				additionalInfo := DataFailedCRSourceEventAdditional{Seqno: item.Seqno,
 					Opcode:      encodeOpCode(item.Req.Opcode),
 					IsExpirySet: (binary.BigEndian.Uint32(item.Req.Extras[4:8]) != 0),
-					VBucket:     item.Req.VBucket,
+					VBucket:     item.Src_vbno,
+					Source_meta: capi.config.failedCRSourceMeta(item),
 				}
 				capi.RaiseEvent(common.NewEvent(common.DataFailedCRSource, nil, capi, nil, additionalInfo))
 			}
@@ -643,8 +651,10 @@ func (capi *CapiNozzle) batchSendWithRetry(batch *capiBatch) error {
 				Commit_time: time.Since(req.Start_time),
 				Opcode:      req.Req.Opcode,
 				IsExpirySet: (binary.BigEndian.Uint32(req.Req.Extras[4:8]) != 0),
-				VBucket:     req.Req.VBucket,
+				VBucket:     req.Src_vbno,
 				Req_size:    req.Req.Size(),
+				// capi nozzle does not compress requests
+				Uncompressed_req_size: req.Req.Size(),
 			}
 			capi.RaiseEvent(common.NewEvent(common.DataSent, nil, capi, nil, additionalInfo))
 
@@ -686,7 +696,8 @@ func (capi *CapiNozzle) selfMonitor(finch chan bool, waitGrp *sync.WaitGroup) {
 		case <-finch:
 			goto done
 		case <-statsTicker.C:
-			capi.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, capi, nil, []int{capi.items_in_dataChan, capi.bytes_in_dataChan}))
+			// capi nozzles do not adjust batches, hence the effective batch count and size are the configured ones
+			capi.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, capi, nil, []int{capi.items_in_dataChan, capi.bytes_in_dataChan, capi.config.maxCount, capi.config.maxSize}))
 		}
 	}
 done:
@@ -782,6 +793,8 @@ func (capi *CapiNozzle) batchUpdateDocs(vbno uint16, req_list *[]*base.WrappedMC
 
 	total_length := len(BodyPartsPrefix) + doc_length + len(BodyPartsSuffix)
 
+	capi.bandwidth_throttler.Throttle(total_length, capi.sender_finch)
+
 	http_req, _, err := utils.ConstructHttpRequest(couchApiBaseHost, couchApiBasePath+base.BulkDocsPath, true, capi.config.username, capi.config.password, capi.config.certificate, base.MethodPost, base.JsonContentType,
 		nil, capi.Logger())
 	if err != nil {
@@ -1054,6 +1067,8 @@ func (capi *CapiNozzle) initialize(settings map[string]interface{}) error {
 		return err
 	}
 
+	updateBandwidthLimit(capi.bandwidth_throttler, settings)
+
 	capi.vb_dataChan_map = make(map[uint16]chan *base.WrappedMCRequest)
 	for vbno, _ := range capi.config.vbCouchApiBaseMap {
 		capi.vb_dataChan_map[vbno] = make(chan *base.WrappedMCRequest, capi.config.maxCount*5)
@@ -1164,7 +1179,7 @@ func (capi *CapiNozzle) initializeOrResetConn(initializing bool) error {
 	}
 
 	if pool != nil {
-		var client *net.TCPConn
+		var client net.Conn
 		client, err = pool.GetNew()
 		if err == nil && client != nil {
 			capi.client = client
@@ -1173,8 +1188,10 @@ func (capi *CapiNozzle) initializeOrResetConn(initializing bool) error {
 
 	if err == nil {
 		// same settings as erlang xdcr
-		capi.client.SetKeepAlive(true)
-		capi.client.SetNoDelay(false)
+		if tcp_client, ok := capi.client.(*net.TCPConn); ok {
+			tcp_client.SetKeepAlive(true)
+			tcp_client.SetNoDelay(false)
+		}
 		capi.Logger().Debugf("%v - The connection for capi client is reset successfully\n", capi.Id())
 		return nil
 	} else {
@@ -1191,9 +1208,14 @@ func (capi *CapiNozzle) UpdateSettings(settings map[string]interface{}) error {
 	}
 
 	capi.config.optiRepThreshold = optimisticReplicationThreshold
+	updateBandwidthLimit(capi.bandwidth_throttler, settings)
 	return nil
 }
 
+func (capi *CapiNozzle) SetBandwidthThrottler(throttler *BandwidthThrottler) {
+	capi.bandwidth_throttler = throttler
+}
+
 func (capi *CapiNozzle) recycleDataObj(req *base.WrappedMCRequest) {
 	if capi.dataObj_recycler != nil {
 		capi.dataObj_recycler(capi.topic, req)
@@ -0,0 +1,87 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/filter"
+	"github.com/couchbase/goxdcr/utils"
+	"regexp"
+)
+
+// the reasons that data is filtered out by DataFilter
+type FilteredReason int
+
+const (
+	NotFiltered FilteredReason = iota
+	// by the filter_deletions or filter_expirations setting
+	FilteredBySetting FilteredReason = iota
+	// by the filter expression on key
+	FilteredByKey FilteredReason = iota
+	// by the filter expression on document body
+	FilteredByBody FilteredReason = iota
+)
+
+// DataFilter decides which data is replicated, as specified by the filter settings of a replication
+type DataFilter struct {
+	filterRegexp      *regexp.Regexp     // filter expression
+	filterBody        *filter.Expression // filter expression on document body
+	filterDeletions   bool               // whether to drop deletions
+	filterExpirations bool               // whether to drop expirations
+}
+
+func NewDataFilter(filterExpression string, filterBodyExpression string,
+	filterDeletions bool, filterExpirations bool) (*DataFilter, error) {
+	// compile filter expression
+	var filterRegexp *regexp.Regexp
+	var err error
+	if len(filterExpression) > 0 {
+		filterRegexp, err = regexp.Compile(filterExpression)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// compile filter expression on document body
+	var filterBody *filter.Expression
+	if len(filterBodyExpression) > 0 {
+		filterBody, err = filter.Parse(filterBodyExpression)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &DataFilter{
+		filterRegexp:      filterRegexp,
+		filterBody:        filterBody,
+		filterDeletions:   filterDeletions,
+		filterExpirations: filterExpirations,
+	}, nil
+}
+
+// returns the reason that the mutation, deletion or expiration is filtered out, or NotFiltered if it is to be replicated
+func (dataFilter *DataFilter) Filter(opcode mc.CommandCode, key, value []byte) FilteredReason {
+	// drop deletions and expirations if replication has been configured not to replicate them
+	if (dataFilter.filterDeletions && opcode == mc.UPR_DELETION) ||
+		(dataFilter.filterExpirations && opcode == mc.UPR_EXPIRATION) {
+		return FilteredBySetting
+	}
+
+	// filter data if filter expession has been defined
+	if dataFilter.filterRegexp != nil && !utils.RegexpMatch(dataFilter.filterRegexp, key) {
+		return FilteredByKey
+	}
+
+	// filter data if filter expession on document body has been defined
+	// only mutations carry document bodies. deletions and expirations are never filtered out
+	// by body filter, so that documents replicated earlier get removed from target as well
+	if dataFilter.filterBody != nil && opcode == mc.UPR_MUTATION && !dataFilter.filterBody.Match(value) {
+		return FilteredByBody
+	}
+	return NotFiltered
+}
@@ -17,6 +17,7 @@ import (
 	mcc "github.com/couchbase/gomemcached/client"
 	base "github.com/couchbase/goxdcr/base"
 	common "github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/dcp_record"
 	gen_server "github.com/couchbase/goxdcr/gen_server"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/service_def"
@@ -31,12 +32,14 @@ import (
 
 const (
 	// start settings key name
-	DCP_VBTimestamp         = "VBTimestamps"
-	DCP_VBTimestampUpdator  = "VBTimestampUpdater"
-	DCP_Connection_Prefix   = "xdcr:"
-	EVENT_DCP_DISPATCH_TIME = "dcp_dispatch_time"
-	EVENT_DCP_DATACH_LEN    = "dcp_datach_length"
-	DCP_Stats_Interval      = "stats_interval"
+	DCP_VBTimestamp            = "VBTimestamps"
+	DCP_VBTimestampUpdator     = "VBTimestampUpdater"
+	DCP_Connection_Prefix      = "xdcr:"
+	EVENT_DCP_DISPATCH_TIME    = "dcp_dispatch_time"
+	EVENT_DCP_DATACH_LEN       = "dcp_datach_length"
+	DCP_Stats_Interval         = "stats_interval"
+	DCP_Connection_Buffer_Size = "dcp_connection_buffer_size"
+	DCP_Record_Dir             = "dcp_record_dir"
 )
 
 type DcpStreamState int
@@ -47,6 +50,19 @@ const (
 	Dcp_Stream_Active  = iota
 )
 
+func (state DcpStreamState) String() string {
+	switch state {
+	case Dcp_Stream_NonInit:
+		return "NonInit"
+	case Dcp_Stream_Init:
+		return "Init"
+	case Dcp_Stream_Active:
+		return "Active"
+	default:
+		return "Unknown"
+	}
+}
+
 var dcp_inactive_stream_check_interval = 10 * time.Second
 
 var dcp_setting_defs base.SettingDefinitions = base.SettingDefinitions{DCP_VBTimestamp: base.NewSettingDef(reflect.TypeOf((*map[uint16]*base.VBTimestamp)(nil)), false)}
@@ -55,6 +71,13 @@ var ErrorEmptyVBList = errors.New("Invalid configuration for DCP nozzle. VB list
 
 var MaxCountStreamsInactive uint8 = 40
 
+// flow control buffer size used when it is not specified in settings
+var DefaultDcpConnectionBufferSize = 1024 * 1024
+
+// fraction of the flow control buffer that uprFeed lets events acknowledged by client add up to before it sends
+// a buffer ack to producer. it matches the threshold in uprFeed
+var DcpBufferAckThreshold float32 = 0.2
+
 var SizeOfUprFeedRandName = 16
 var MaxRetryForIdGeneration = 5
 
@@ -68,6 +91,13 @@ type streamStatusWithLock struct {
 	lock  *sync.RWMutex
 }
 
+// source nozzles, i.e., DcpNozzle and DcpReplayNozzle, stream the mutations of a list of vbuckets
+type SourceNozzle interface {
+	common.Nozzle
+	GetVBList() []uint16
+	StatusSummary() string
+}
+
 /************************************
 /* struct DcpNozzle
 *************************************/
@@ -126,6 +156,17 @@ type DcpNozzle struct {
 
 	// whether extended metadata is supported
 	ext_metadata_supported bool
+
+	// size of the flow control buffer negotiated with producer
+	connection_buffer_size int
+	// bytes of dcp events that have been received from uprFeed but have not been acknowledged to producer
+	bytes_unacked int64
+	// bytes of dcp events that have been acknowledged to uprFeed, which has not sent them in a buffer ack yet.
+	// it is accessed only by processData
+	bytes_to_ack int64
+
+	// records the received dcp events when dcp recording is enabled. it is accessed only by processData and onExit
+	recorder *dcp_record.Writer
 }
 
 func NewDcpNozzle(id string,
@@ -188,7 +229,14 @@ func (dcp *DcpNozzle) initialize(settings map[string]interface{}) (err error) {
 		return err
 	}
 
-	dcp.uprFeed, err = dcp.client.NewUprFeed()
+	dcp.connection_buffer_size = DefaultDcpConnectionBufferSize
+	if val, ok := settings[DCP_Connection_Buffer_Size]; ok && val.(int) > 0 {
+		dcp.connection_buffer_size = val.(int)
+	}
+
+	// dcp events are acknowledged by dcp nozzle after they have been forwarded,
+	// so that producer stops sending when downstream parts fall behind
+	dcp.uprFeed, err = dcp.client.NewUprFeedWithConfig(true /*ackByClient*/)
 	if err != nil {
 		return err
 	}
@@ -202,9 +250,9 @@ func (dcp *DcpNozzle) initialize(settings map[string]interface{}) (err error) {
 
 	// request extended metadata from dcp only when it is supported
 	if dcp.ext_metadata_supported {
-		err = dcp.uprFeed.UprOpenWithExtMeta(uprFeedName, uint32(0), 1024*1024)
+		err = dcp.uprFeed.UprOpenWithExtMeta(uprFeedName, uint32(0), uint32(dcp.connection_buffer_size))
 	} else {
-		err = dcp.uprFeed.UprOpen(uprFeedName, uint32(0), 1024*1024)
+		err = dcp.uprFeed.UprOpen(uprFeedName, uint32(0), uint32(dcp.connection_buffer_size))
 	}
 	if err != nil {
 		dcp.Logger().Errorf("%v upr open failed. err=%v.\n", dcp.Id(), err)
@@ -220,6 +268,13 @@ func (dcp *DcpNozzle) initialize(settings map[string]interface{}) (err error) {
 		return errors.New("setting 'stats_interval' is missing")
 	}
 
+	if val, ok := settings[DCP_Record_Dir]; ok && len(val.(string)) > 0 {
+		err = dcp.startRecording(val.(string), addr)
+		if err != nil {
+			return err
+		}
+	}
+
 	//initialize vb_stream_status
 	dcp.vb_stream_status_lock.Lock()
 	defer dcp.vb_stream_status_lock.Unlock()
@@ -422,6 +477,9 @@ func (dcp *DcpNozzle) processData() (err error) {
 				dcp.handleGeneralError(errors.New("DCP stream has been closed."))
 				goto done
 			}
+			atomic.AddInt64(&dcp.bytes_unacked, int64(m.AckSize))
+			dcp.record(m)
+
 			if m.Opcode == mc.UPR_STREAMREQ {
 				if m.Status == mc.NOT_MY_VBUCKET {
 					vb_err := fmt.Errorf("Received error %v on vb %v\n", base.ErrorNotMyVbucket, m.VBucket)
@@ -493,6 +551,8 @@ func (dcp *DcpNozzle) processData() (err error) {
 					}
 				}
 			}
+
+			dcp.ackEvent(uprFeed, m)
 		}
 	}
 done:
@@ -500,9 +560,81 @@ done:
 	return
 }
 
+// acknowledges the event to producer after it has been handled, which frees up space in the flow control buffer.
+// uprFeed batches acknowledged events into a buffer ack once they add up to DcpBufferAckThreshold of the buffer,
+// and the events count as unacked until then
+func (dcp *DcpNozzle) ackEvent(uprFeed *mcc.UprFeed, m *mcc.UprEvent) {
+	if m.AckSize == 0 {
+		return
+	}
+	err := uprFeed.ClientAck(m)
+	if err != nil {
+		dcp.Logger().Errorf("%v failed to ack dcp event for vb=%v. err=%v\n", dcp.Id(), m.VBucket, err)
+		return
+	}
+	dcp.bytes_to_ack += int64(m.AckSize)
+	if dcp.bytes_to_ack >= int64(uint32(DcpBufferAckThreshold*float32(dcp.connection_buffer_size))) {
+		// uprFeed has sent a buffer ack for all the bytes acknowledged so far
+		atomic.AddInt64(&dcp.bytes_unacked, -dcp.bytes_to_ack)
+		dcp.bytes_to_ack = 0
+	}
+}
+
+func (dcp *DcpNozzle) bytesUnacked() int {
+	return int(atomic.LoadInt64(&dcp.bytes_unacked))
+}
+
 func (dcp *DcpNozzle) onExit() {
 	dcp.childrenWaitGrp.Wait()
+	dcp.stopRecording()
+}
 
+func (dcp *DcpNozzle) startRecording(dir string, addr string) error {
+	// the directory is checked again since symbolic links may have changed after the setting was validated
+	if _, err := simple_utils.PathUnderRoot(dir, base.XDCRDataDir); err != nil {
+		dcp.Logger().Errorf("%v cannot record dcp events into %v. err=%v\n", dcp.Id(), dir, err)
+		return err
+	}
+	path, err := dcp_record.NextFilePath(dir, dcp.Id())
+	if err != nil {
+		dcp.Logger().Errorf("%v failed to find the next dcp recording in %v. err=%v\n", dcp.Id(), dir, err)
+		return err
+	}
+	recorder, err := dcp_record.NewWriter(path, &dcp_record.Header{KVAddr: addr, BucketName: dcp.bucketName, VBList: dcp.vbnos})
+	if err != nil {
+		dcp.Logger().Errorf("%v failed to start recording dcp events into %v. err=%v\n", dcp.Id(), path, err)
+		return err
+	}
+	dcp.recorder = recorder
+	dcp.Logger().Infof("%v is recording dcp events into %v\n", dcp.Id(), path)
+	return nil
+}
+
+// records the dcp event when recording is enabled.
+// recording is stopped on errors, which should not affect replication
+func (dcp *DcpNozzle) record(m *mcc.UprEvent) {
+	if dcp.recorder == nil {
+		return
+	}
+	err := dcp.recorder.Write(m)
+	if err == dcp_record.ErrorMaxFileSizeReached {
+		dcp.Logger().Infof("%v stopped recording dcp events since the recording has reached its max size of %v bytes\n", dcp.Id(), dcp_record.MaxFileSize)
+		dcp.stopRecording()
+	} else if err != nil {
+		dcp.Logger().Errorf("%v failed to record dcp event for vb=%v. Recording is stopped. err=%v\n", dcp.Id(), m.VBucket, err)
+		dcp.stopRecording()
+	}
+}
+
+func (dcp *DcpNozzle) stopRecording() {
+	if dcp.recorder == nil {
+		return
+	}
+	err := dcp.recorder.Close()
+	if err != nil {
+		dcp.Logger().Errorf("%v failed to close dcp recording. err=%v\n", dcp.Id(), err)
+	}
+	dcp.recorder = nil
 }
 
 func (dcp *DcpNozzle) StatusSummary() string {
@@ -798,6 +930,11 @@ func (dcp *DcpNozzle) getStreamState(vbno uint16) (DcpStreamState, error) {
 	}
 }
 
+// returns the state of the dcp stream of the vbucket
+func (dcp *DcpNozzle) GetStreamState(vbno uint16) (DcpStreamState, error) {
+	return dcp.getStreamState(vbno)
+}
+
 func (dcp *DcpNozzle) SetMaxMissCount(max_dcp_miss_count int) {
 	dcp.max_dcp_miss_count = max_dcp_miss_count
 }
@@ -987,6 +1124,6 @@ func (dcp *DcpNozzle) getDcpDataChanLen() {
 	} else {
 		dcp_dispatch_len = len(dcp.uprFeed.C)
 	}
-	dcp.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, dcp, nil, dcp_dispatch_len))
+	dcp.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, dcp, nil, []int{dcp_dispatch_len, dcp.bytesUnacked()}))
 
 }
@@ -0,0 +1,268 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	base "github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/service_def"
+	"github.com/couchbase/goxdcr/tests/fake_memcached"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testDcpBucket   = "source"
+	testDcpPassword = "s3cret"
+)
+
+// points dcp nozzles to the fake producer
+type testTopologySvc struct {
+	service_def.XDCRCompTopologySvc
+	memcachedAddr string
+}
+
+func (top_svc *testTopologySvc) MyMemcachedAddr() (string, error) {
+	return top_svc.memcachedAddr, nil
+}
+
+// collects the dcp events forwarded by a dcp nozzle
+type testConnector struct {
+	common.Connector
+	events []*mcc.UprEvent
+	lock   sync.Mutex
+}
+
+func (connector *testConnector) Forward(data interface{}) error {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+	connector.events = append(connector.events, data.(*mcc.UprEvent))
+	return nil
+}
+
+func (connector *testConnector) received() []*mcc.UprEvent {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+	return append([]*mcc.UprEvent(nil), connector.events...)
+}
+
+// returns the seqnos of the events received for the vbucket, in the order they were received
+func (connector *testConnector) seqnos(vbno uint16) []uint64 {
+	seqnos := []uint64{}
+	for _, event := range connector.received() {
+		if event.VBucket == vbno {
+			seqnos = append(seqnos, event.Seqno)
+		}
+	}
+	return seqnos
+}
+
+func newTestProducer(t *testing.T) *fake_memcached.Producer {
+	producer, err := fake_memcached.NewProducer(testDcpBucket, testDcpPassword)
+	if err != nil {
+		t.Fatalf("failed to start fake producer. err=%v", err)
+	}
+	return producer
+}
+
+// starts a dcp nozzle that streams the vbuckets from the fake producer from the specified timestamps
+func startTestDcpNozzle(t *testing.T, producer *fake_memcached.Producer, vbts map[uint16]*base.VBTimestamp,
+	vbtimestamp_updater func(uint16, uint64) (*base.VBTimestamp, error), extraSettings map[string]interface{}) (*DcpNozzle, *testConnector, *testEventListener) {
+	vbnos := []uint16{}
+	for vbno := range vbts {
+		vbnos = append(vbnos, vbno)
+	}
+	dcp := NewDcpNozzle("dcp_"+t.Name(), testDcpBucket, testDcpPassword, vbnos, &testTopologySvc{memcachedAddr: producer.Addr()},
+		false, log.DefaultLoggerContext)
+	connector := &testConnector{}
+	dcp.SetConnector(connector)
+	listener := newTestEventListener(dcp, common.StreamingStart, common.VBErrorEncountered, common.ErrorEncountered)
+
+	if vbtimestamp_updater == nil {
+		vbtimestamp_updater = func(vbno uint16, rollbackSeqno uint64) (*base.VBTimestamp, error) {
+			return &base.VBTimestamp{Vbno: vbno, Seqno: rollbackSeqno}, nil
+		}
+	}
+	settings := map[string]interface{}{
+		DCP_VBTimestampUpdator: vbtimestamp_updater,
+		DCP_Stats_Interval:     1000,
+	}
+	for key, val := range extraSettings {
+		settings[key] = val
+	}
+	if err := dcp.Start(settings); err != nil {
+		t.Fatalf("failed to start dcp nozzle. err=%v", err)
+	}
+	if err := dcp.UpdateSettings(map[string]interface{}{DCP_VBTimestamp: vbts}); err != nil {
+		t.Fatalf("failed to set start timestamps. err=%v", err)
+	}
+	return dcp, connector, listener
+}
+
+func TestDcpNozzleStreaming(t *testing.T) {
+	producer := newTestProducer(t)
+	defer producer.Close()
+	for i := 0; i < 100; i++ {
+		producer.AddMutation(uint16(i%2), fmt.Sprintf("doc%v", i), []byte(`{"a":1}`))
+	}
+	producer.AddDeletion(1, "doc1")
+
+	// a small flow control buffer makes the producer wait for buffer acks
+	dcp, connector, listener := startTestDcpNozzle(t, producer,
+		map[uint16]*base.VBTimestamp{0: &base.VBTimestamp{Vbno: 0}, 1: &base.VBTimestamp{Vbno: 1}},
+		nil, map[string]interface{}{DCP_Connection_Buffer_Size: 1024})
+	defer dcp.Stop()
+
+	waitFor(t, "101 events to be forwarded", func() bool { return len(connector.received()) == 101 })
+	if listener.count(common.StreamingStart) != 2 {
+		t.Errorf("expected 2 streams to start, got %v", listener.count(common.StreamingStart))
+	}
+	if stream_state, err := dcp.GetStreamState(1); err != nil || stream_state.String() != "Active" {
+		t.Errorf("expected stream of vb 1 to be active, got %v %v", stream_state, err)
+	}
+	for _, vbno := range []uint16{0, 1} {
+		for i, seqno := range connector.seqnos(vbno) {
+			if seqno != uint64(i+1) {
+				t.Fatalf("expected seqno %v on vb %v, got %v", i+1, vbno, seqno)
+			}
+		}
+	}
+	last := connector.received()[100]
+	if last.Opcode != mc.UPR_DELETION || string(last.Key) != "doc1" || last.Seqno != 51 {
+		t.Errorf("unexpected last event %v:%s:%v", last.Opcode, last.Key, last.Seqno)
+	}
+
+	// mutations made after the streams have started are streamed as well
+	producer.AddMutation(0, "doc100", []byte(`{"a":2}`))
+	waitFor(t, "102 events to be forwarded", func() bool { return len(connector.received()) == 102 })
+}
+
+func TestDcpNozzleUnackedBytes(t *testing.T) {
+	producer := newTestProducer(t)
+	defer producer.Close()
+	for i := 0; i < 10; i++ {
+		producer.AddMutation(0, fmt.Sprintf("doc%v", i), []byte(`{"a":1}`))
+	}
+
+	// the events add up to less than the buffer ack threshold, so no buffer ack is sent for them
+	dcp, connector, _ := startTestDcpNozzle(t, producer, map[uint16]*base.VBTimestamp{0: &base.VBTimestamp{Vbno: 0}}, nil, nil)
+	defer dcp.Stop()
+
+	waitFor(t, "10 events to be forwarded", func() bool { return len(connector.received()) == 10 })
+	var received int
+	for _, event := range connector.received() {
+		received += int(event.AckSize)
+	}
+	// snapshot markers count as well
+	if unacked := dcp.bytesUnacked(); unacked < received || received == 0 {
+		t.Fatalf("expected %v bytes of events received to be unacked, got %v", received, unacked)
+	}
+
+	// a large enough mutation triggers a buffer ack for all events
+	producer.AddMutation(0, "large", make([]byte, int(DcpBufferAckThreshold*float32(DefaultDcpConnectionBufferSize))))
+	waitFor(t, "buffer ack to be sent", func() bool { return len(connector.received()) == 11 && dcp.bytesUnacked() == 0 })
+}
+
+func TestDcpNozzleRollback(t *testing.T) {
+	producer := newTestProducer(t)
+	defer producer.Close()
+	for i := 0; i < 10; i++ {
+		producer.AddMutation(0, fmt.Sprintf("doc%v", i), nil)
+	}
+	vbuuid := producer.FailoverLog(0)[0][0]
+	// the mutations after seqno 5 are lost in failover, and new ones take their seqnos
+	producer.Failover(0, 5)
+	for i := 0; i < 3; i++ {
+		producer.AddMutation(0, fmt.Sprintf("new_doc%v", i), nil)
+	}
+
+	var rollbackSeqno uint64
+	var lock sync.Mutex
+	vbtimestamp_updater := func(vbno uint16, seqno uint64) (*base.VBTimestamp, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		rollbackSeqno = seqno
+		return &base.VBTimestamp{Vbno: vbno, Vbuuid: vbuuid, Seqno: seqno, SnapshotStart: seqno, SnapshotEnd: seqno}, nil
+	}
+	dcp, connector, listener := startTestDcpNozzle(t, producer,
+		map[uint16]*base.VBTimestamp{0: &base.VBTimestamp{Vbno: 0, Vbuuid: vbuuid, Seqno: 8, SnapshotStart: 8, SnapshotEnd: 8}},
+		vbtimestamp_updater, nil)
+	defer dcp.Stop()
+
+	waitFor(t, "3 events to be forwarded", func() bool { return len(connector.received()) == 3 })
+	lock.Lock()
+	if rollbackSeqno != 5 {
+		t.Errorf("expected rollback to seqno 5, got %v", rollbackSeqno)
+	}
+	lock.Unlock()
+	for i, event := range connector.received() {
+		if string(event.Key) != fmt.Sprintf("new_doc%v", i) || event.Seqno != uint64(i+6) {
+			t.Errorf("unexpected event %s:%v", event.Key, event.Seqno)
+		}
+	}
+	if listener.count(common.StreamingStart) != 1 {
+		t.Errorf("expected stream to start after rollback")
+	}
+}
+
+func TestDcpNozzleNotMyVbucket(t *testing.T) {
+	producer := newTestProducer(t)
+	defer producer.Close()
+	producer.AddMutation(0, "doc0", nil)
+	producer.SetNotMyVBucket(1, true)
+
+	dcp, connector, listener := startTestDcpNozzle(t, producer,
+		map[uint16]*base.VBTimestamp{0: &base.VBTimestamp{Vbno: 0}, 1: &base.VBTimestamp{Vbno: 1}},
+		nil, nil)
+	defer dcp.Stop()
+
+	waitFor(t, "vb error to be raised", func() bool { return listener.count(common.VBErrorEncountered) == 1 })
+	waitFor(t, "doc0 to be forwarded", func() bool { return len(connector.received()) == 1 })
+
+	// the stream is ended by producer when the vbucket moves away
+	producer.SetNotMyVBucket(0, true)
+	waitFor(t, "vb error to be raised on stream end", func() bool { return listener.count(common.VBErrorEncountered) == 2 })
+}
+
+func TestDcpNozzleInactiveStreams(t *testing.T) {
+	checkInterval := dcp_inactive_stream_check_interval
+	maxCount := MaxCountStreamsInactive
+	dcp_inactive_stream_check_interval = 10 * time.Millisecond
+	MaxCountStreamsInactive = 2
+	defer func() {
+		dcp_inactive_stream_check_interval = checkInterval
+		MaxCountStreamsInactive = maxCount
+	}()
+
+	producer := newTestProducer(t)
+	defer producer.Close()
+	producer.AddMutation(0, "doc0", nil)
+	producer.SetStalled(0, true)
+
+	dcp, connector, listener := startTestDcpNozzle(t, producer, map[uint16]*base.VBTimestamp{0: &base.VBTimestamp{Vbno: 0}}, nil, nil)
+	defer dcp.Stop()
+
+	// stream requests that are not answered are retried
+	waitFor(t, "stream request to be retried", func() bool { return producer.RequestCount(mc.UPR_STREAMREQ) >= 2 })
+	if listener.count(common.StreamingStart) != 0 || len(connector.received()) != 0 {
+		t.Errorf("expected stream not to start while it is stalled")
+	}
+
+	producer.SetStalled(0, false)
+	waitFor(t, "doc0 to be forwarded", func() bool { return len(connector.received()) == 1 })
+	if len(dcp.inactiveDcpStreams()) != 0 {
+		t.Errorf("expected stream to be active, got inactive streams %v", dcp.inactiveDcpStreams())
+	}
+}
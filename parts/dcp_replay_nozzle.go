@@ -0,0 +1,466 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	base "github.com/couchbase/goxdcr/base"
+	common "github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/dcp_record"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/utils"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// start settings key name
+	DCP_Replay_Speed = "dcp_replay_speed"
+)
+
+// interval at which replay checks whether start seqnos have been set for all vbs
+var dcp_replay_start_check_interval = 100 * time.Millisecond
+
+/************************************
+/* struct DcpReplayNozzle
+*************************************/
+// DcpReplayNozzle is a source nozzle that reads dcp events from a recording file produced by DcpNozzle,
+// instead of from a kv node, and passes them downstream the same way as DcpNozzle does
+type DcpReplayNozzle struct {
+
+	//parent inheritance
+	AbstractPart
+
+	// path of the recording file
+	path string
+
+	// the list of vbuckets in the recording
+	vbnos []uint16
+
+	reader *dcp_record.Reader
+
+	// speed, in percentage of the recorded speed, at which events are replayed. 0 means no delay
+	speed int
+
+	finch chan bool
+
+	bOpen      bool
+	lock_bOpen sync.RWMutex
+
+	childrenWaitGrp sync.WaitGroup
+
+	counter_received uint32
+	counter_sent     uint32
+	// the number of events in the recording that have been read
+	counter_replayed uint32
+
+	// whether all events in the recording have been replayed
+	replay_done int32
+
+	// index, in the recording, of the record that is being replayed. it is accessed only by replay
+	record_index int
+	// vbno -> index of the first record that needs to be replayed for the vb. a vb skips records before it,
+	// which it has replayed before the reader was rewound for the roll-back of another vb. it is accessed only by replay
+	vb_replay_from map[uint16]int
+
+	cur_ts              map[uint16]*vbtsWithLock
+	vbtimestamp_updater func(uint16, uint64) (*base.VBTimestamp, error)
+}
+
+func NewDcpReplayNozzle(id string,
+	path string,
+	vbnos []uint16,
+	logger_context *log.LoggerContext) *DcpReplayNozzle {
+
+	part := NewAbstractPartWithLogger(id, log.NewLogger("DcpReplayNozzle", logger_context))
+
+	dcp := &DcpReplayNozzle{
+		AbstractPart:   part, /*AbstractPart*/
+		path:           path,
+		vbnos:          vbnos,
+		bOpen:          true,
+		cur_ts:         make(map[uint16]*vbtsWithLock),
+		vb_replay_from: make(map[uint16]int),
+	}
+
+	for _, vbno := range vbnos {
+		dcp.cur_ts[vbno] = &vbtsWithLock{lock: &sync.RWMutex{}, ts: nil}
+	}
+
+	dcp.Logger().Debugf("Constructed Dcp replay nozzle %v with vblist %v from %v\n", dcp.Id(), vbnos, path)
+
+	return dcp
+}
+
+func (dcp *DcpReplayNozzle) initialize(settings map[string]interface{}) (err error) {
+	dcp.finch = make(chan bool)
+
+	dcp.reader, err = dcp_record.NewReader(dcp.path)
+	if err != nil {
+		return err
+	}
+
+	dcp.vbtimestamp_updater = settings[DCP_VBTimestampUpdator].(func(uint16, uint64) (*base.VBTimestamp, error))
+
+	if val, ok := settings[DCP_Replay_Speed]; ok {
+		dcp.speed = val.(int)
+	}
+	return
+}
+
+func (dcp *DcpReplayNozzle) Open() error {
+	dcp.lock_bOpen.Lock()
+	defer dcp.lock_bOpen.Unlock()
+	dcp.bOpen = true
+	return nil
+}
+
+func (dcp *DcpReplayNozzle) Close() error {
+	dcp.lock_bOpen.Lock()
+	defer dcp.lock_bOpen.Unlock()
+	dcp.bOpen = false
+	return nil
+}
+
+func (dcp *DcpReplayNozzle) IsOpen() bool {
+	dcp.lock_bOpen.RLock()
+	defer dcp.lock_bOpen.RUnlock()
+	return dcp.bOpen
+}
+
+func (dcp *DcpReplayNozzle) Start(settings map[string]interface{}) error {
+	dcp.Logger().Infof("%v starting ....\n", dcp.Id())
+
+	err := dcp.SetState(common.Part_Starting)
+	if err != nil {
+		return err
+	}
+
+	err = utils.ValidateSettings(dcp_setting_defs, settings, dcp.Logger())
+	if err != nil {
+		return err
+	}
+
+	err = dcp.initialize(settings)
+	if err != nil {
+		return err
+	}
+	dcp.Logger().Infof("%v has been initialized with speed=%v\n", dcp.Id(), dcp.speed)
+
+	// start replay routine
+	dcp.childrenWaitGrp.Add(1)
+	go dcp.replay()
+
+	err = dcp.SetState(common.Part_Running)
+	if err == nil {
+		dcp.Logger().Infof("%v has been started", dcp.Id())
+	} else {
+		dcp.Logger().Errorf("%v failed to start. err=%v", dcp.Id(), err)
+	}
+
+	return err
+}
+
+func (dcp *DcpReplayNozzle) Stop() error {
+	dcp.Logger().Infof("%v is stopping...\n", dcp.Id())
+	err := dcp.SetState(common.Part_Stopping)
+	if err != nil {
+		return err
+	}
+
+	//notify children routines
+	if dcp.finch != nil {
+		close(dcp.finch)
+	}
+	dcp.childrenWaitGrp.Wait()
+
+	if dcp.reader != nil {
+		dcp.reader.Close()
+	}
+	dcp.Logger().Debugf("%v received %v items, sent %v items\n", dcp.Id(), dcp.counterReceived(), dcp.counterSent())
+
+	err = dcp.SetState(common.Part_Stopped)
+	if err != nil {
+		return err
+	}
+	dcp.Logger().Infof("%v has been stopped\n", dcp.Id())
+	return err
+}
+
+func (dcp *DcpReplayNozzle) Receive(data interface{}) error {
+	// DcpReplayNozzle is a source nozzle and does not receive from upstream nodes
+	return nil
+}
+
+func (dcp *DcpReplayNozzle) replay() {
+	defer dcp.childrenWaitGrp.Done()
+
+	// as with dcp streams, replay can start only after start seqnos have been negotiated
+	if !dcp.waitForStartSeqnos() {
+		return
+	}
+	dcp.Logger().Infof("%v starts replaying dcp events from %v\n", dcp.Id(), dcp.path)
+
+	replay_start_time := time.Now()
+	for {
+		record, err := dcp.reader.Next()
+		if err == io.EOF {
+			atomic.StoreInt32(&dcp.replay_done, 1)
+			dcp.Logger().Infof("%v has replayed all %v dcp events from %v\n", dcp.Id(), dcp.counterReplayed(), dcp.path)
+			return
+		} else if err != nil {
+			dcp.handleGeneralError(fmt.Errorf("Failed to read dcp recording %v. err=%v", dcp.path, err))
+			return
+		}
+		atomic.AddUint32(&dcp.counter_replayed, 1)
+		index := dcp.record_index
+		dcp.record_index++
+		if index < dcp.vb_replay_from[record.Event.VBucket] {
+			continue
+		}
+
+		if !dcp.waitForReplayTime(replay_start_time, record.Time) {
+			return
+		}
+
+		err = dcp.processEvent(record.Event, index)
+		if err != nil {
+			dcp.handleGeneralError(err)
+			return
+		}
+	}
+}
+
+// returns false if the nozzle is stopped before start seqnos have been set for all vbs
+func (dcp *DcpReplayNozzle) waitForStartSeqnos() bool {
+	ticker := time.NewTicker(dcp_replay_start_check_interval)
+	defer ticker.Stop()
+	for {
+		if dcp.allTSSet() {
+			return true
+		}
+		select {
+		case <-dcp.finch:
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// waits until the time at which the event is to be replayed, which is determined by the time
+// at which the event was recorded and the replay speed.
+// returns false if the nozzle is stopped while waiting
+func (dcp *DcpReplayNozzle) waitForReplayTime(replay_start_time time.Time, recorded_time time.Duration) bool {
+	if dcp.speed > 0 {
+		delay := replay_start_time.Add(recorded_time * 100 / time.Duration(dcp.speed)).Sub(time.Now())
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-dcp.finch:
+				return false
+			case <-timer.C:
+			}
+		}
+	}
+
+	select {
+	case <-dcp.finch:
+		return false
+	default:
+		return true
+	}
+}
+
+// index is the index of the record of the event in the recording
+func (dcp *DcpReplayNozzle) processEvent(m *mcc.UprEvent, index int) error {
+	ts, err := dcp.getTS(m.VBucket)
+	if err != nil {
+		dcp.Logger().Debugf("%v skipping dcp event for vb=%v, which is not replayed\n", dcp.Id(), m.VBucket)
+		return nil
+	}
+
+	switch m.Opcode {
+	case mc.UPR_STREAMREQ:
+		if m.Status == mc.ROLLBACK {
+			return dcp.onRollback(m, ts, index)
+		} else if m.Status == mc.SUCCESS {
+			dcp.RaiseEvent(common.NewEvent(common.StreamingStart, m, dcp, nil, nil))
+		}
+	case mc.UPR_STREAMEND:
+		// replaying the error from the recorded stream end would only restart the replay, hence it is just logged
+		dcp.Logger().Infof("%v: recorded dcp stream for vb=%v was closed by producer\n", dcp.Id(), m.VBucket)
+	case mc.UPR_MUTATION, mc.UPR_DELETION, mc.UPR_EXPIRATION:
+		// the replayed stream starts from the start seqno of the vb, as dcp stream would
+		if m.Seqno <= ts.Seqno || !dcp.IsOpen() {
+			return nil
+		}
+		start_time := time.Now()
+		dcp.incCounterReceived()
+		dcp.RaiseEvent(common.NewEvent(common.DataReceived, m, dcp, nil /*derivedItems*/, nil /*otherInfos*/))
+		dcp.Logger().Tracef("%v, Mutation %v:%v:%v <%v>, counter=%v\n", dcp.Id(), m.VBucket, m.Seqno, m.Opcode, m.Key, dcp.counterReceived())
+
+		// forward mutation downstream through connector
+		if err := dcp.Connector().Forward(m); err != nil {
+			return err
+		}
+		dcp.incCounterSent()
+		// raise event for statistics collection
+		dispatch_time := time.Since(start_time)
+		dcp.RaiseEvent(common.NewEvent(common.DataProcessed, m, dcp, nil /*derivedItems*/, dispatch_time.Seconds()*1000000 /*otherInfos*/))
+	default:
+		dcp.Logger().Debugf("%v Uprevent OpCode=%v, is skipped\n", dcp.Id(), m.Opcode)
+	}
+	return nil
+}
+
+// a recorded rollback is replayed only when it rolls back beyond the start seqno of the vb.
+// the events of the vb from the rollback seqno on may be earlier in the recording, and have been skipped as they were
+// before the start seqno. hence the reader is rewound, and the vb is replayed from the start of the recording,
+// while the other vbs skip the records up to the rollback, which they have replayed already
+func (dcp *DcpReplayNozzle) onRollback(m *mcc.UprEvent, ts *base.VBTimestamp, index int) error {
+	if len(m.Value) < 8 {
+		return fmt.Errorf("Invalid rollback event for vb=%v in dcp recording %v", m.VBucket, dcp.path)
+	}
+	rollbackseq := binary.BigEndian.Uint64(m.Value[:8])
+	if rollbackseq >= ts.Seqno {
+		return nil
+	}
+
+	updated_ts, err := dcp.vbtimestamp_updater(m.VBucket, rollbackseq)
+	if err != nil {
+		return fmt.Errorf("Failed to replay roll-back for vb=%v. err=%v\n", m.VBucket, err)
+	}
+	err = dcp.setTS(m.VBucket, updated_ts)
+	if err != nil {
+		return err
+	}
+
+	err = dcp.reader.Rewind()
+	if err != nil {
+		return fmt.Errorf("Failed to rewind dcp recording %v for roll-back of vb=%v. err=%v", dcp.path, m.VBucket, err)
+	}
+	for _, vbno := range dcp.vbnos {
+		if vbno == m.VBucket {
+			dcp.vb_replay_from[vbno] = 0
+		} else if dcp.vb_replay_from[vbno] < index+1 {
+			dcp.vb_replay_from[vbno] = index + 1
+		}
+	}
+	dcp.record_index = 0
+	dcp.Logger().Infof("%v replayed roll-back for vb=%v to seqno=%v\n", dcp.Id(), m.VBucket, updated_ts.Seqno)
+	return nil
+}
+
+func (dcp *DcpReplayNozzle) handleGeneralError(err error) {
+	err1 := dcp.SetState(common.Part_Error)
+	if err1 == nil {
+		dcp.RaiseEvent(common.NewEvent(common.ErrorEncountered, nil, dcp, nil, err))
+		dcp.Logger().Errorf("%v Raise error condition %v\n", dcp.Id(), err)
+	} else {
+		dcp.Logger().Debugf("%v in shutdown process. err=%v is ignored\n", dcp.Id(), err)
+	}
+}
+
+func (dcp *DcpReplayNozzle) UpdateSettings(settings map[string]interface{}) error {
+	ts_obj := utils.GetSettingFromSettings(settings, DCP_VBTimestamp)
+	if ts_obj != nil {
+		new_ts, ok := settings[DCP_VBTimestamp].(map[uint16]*base.VBTimestamp)
+		if !ok || new_ts == nil {
+			panic(fmt.Sprintf("setting %v should have type of map[uint16]*base.VBTimestamp", DCP_VBTimestamp))
+		}
+		for vbno, vbts := range new_ts {
+			ts_withlock, ok := dcp.cur_ts[vbno]
+			if ok && ts_withlock != nil {
+				ts_withlock.lock.Lock()
+				//only update the cur_ts if starting seqno has not been set yet
+				if ts_withlock.ts == nil {
+					ts_withlock.ts = vbts
+				}
+				ts_withlock.lock.Unlock()
+			}
+		}
+	}
+	return nil
+}
+
+func (dcp *DcpReplayNozzle) setTS(vbno uint16, ts *base.VBTimestamp) error {
+	ts_entry := dcp.cur_ts[vbno]
+	if ts_entry == nil {
+		return fmt.Errorf("setTS failed: vbno=%v is not tracked in cur_ts map", vbno)
+	}
+	ts_entry.lock.Lock()
+	defer ts_entry.lock.Unlock()
+	ts_entry.ts = ts
+	return nil
+}
+
+func (dcp *DcpReplayNozzle) getTS(vbno uint16) (*base.VBTimestamp, error) {
+	ts_entry := dcp.cur_ts[vbno]
+	if ts_entry == nil {
+		return nil, fmt.Errorf("getTS failed: vbno=%v is not tracked in cur_ts map", vbno)
+	}
+	ts_entry.lock.RLock()
+	defer ts_entry.lock.RUnlock()
+	if ts_entry.ts == nil {
+		return nil, errors.New("start seqno has not been set")
+	}
+	return ts_entry.ts, nil
+}
+
+func (dcp *DcpReplayNozzle) allTSSet() bool {
+	for _, ts_entry := range dcp.cur_ts {
+		ts_entry.lock.RLock()
+		isSet := ts_entry.ts != nil
+		ts_entry.lock.RUnlock()
+		if !isSet {
+			return false
+		}
+	}
+	return true
+}
+
+func (dcp *DcpReplayNozzle) GetVBList() []uint16 {
+	return dcp.vbnos
+}
+
+func (dcp *DcpReplayNozzle) StatusSummary() string {
+	msg := fmt.Sprintf("%v replayed %v events from %v, received %v items, sent %v items.", dcp.Id(), dcp.counterReplayed(), dcp.path, dcp.counterReceived(), dcp.counterSent())
+	if atomic.LoadInt32(&dcp.replay_done) == 1 {
+		msg += " replay has completed."
+	}
+	return msg
+}
+
+func (dcp *DcpReplayNozzle) counterReceived() uint32 {
+	return atomic.LoadUint32(&dcp.counter_received)
+}
+
+func (dcp *DcpReplayNozzle) incCounterReceived() {
+	atomic.AddUint32(&dcp.counter_received, 1)
+}
+
+func (dcp *DcpReplayNozzle) counterSent() uint32 {
+	return atomic.LoadUint32(&dcp.counter_sent)
+}
+
+func (dcp *DcpReplayNozzle) incCounterSent() {
+	atomic.AddUint32(&dcp.counter_sent, 1)
+}
+
+func (dcp *DcpReplayNozzle) counterReplayed() uint32 {
+	return atomic.LoadUint32(&dcp.counter_replayed)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"encoding/binary"
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	base "github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/dcp_record"
+	"github.com/couchbase/goxdcr/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func writeTestRecording(t *testing.T, path string, vbnos []uint16, events []*mcc.UprEvent) {
+	writer, err := dcp_record.NewWriter(path, &dcp_record.Header{KVAddr: "127.0.0.1:11210", BucketName: testDcpBucket, VBList: vbnos})
+	if err != nil {
+		t.Fatalf("failed to create recording. err=%v", err)
+	}
+	for _, event := range events {
+		if err = writer.Write(event); err != nil {
+			t.Fatalf("failed to write recording. err=%v", err)
+		}
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatalf("failed to close recording. err=%v", err)
+	}
+}
+
+func testReplayMutation(vbno uint16, seqno uint64) *mcc.UprEvent {
+	return &mcc.UprEvent{Opcode: mc.UPR_MUTATION, VBucket: vbno, Seqno: seqno, Key: []byte("doc")}
+}
+
+func TestDcpReplayNozzleRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatalf("failed to create temp dir. err=%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rollback := &mcc.UprEvent{Opcode: mc.UPR_STREAMREQ, Status: mc.ROLLBACK, VBucket: 0, Value: make([]byte, 8)}
+	binary.BigEndian.PutUint64(rollback.Value, 2)
+	path := filepath.Join(dir, "replay"+dcp_record.FileExtension)
+	writeTestRecording(t, path, []uint16{0, 1}, []*mcc.UprEvent{
+		testReplayMutation(0, 1), testReplayMutation(1, 1), testReplayMutation(0, 2), testReplayMutation(1, 2),
+		testReplayMutation(0, 3), testReplayMutation(0, 4), testReplayMutation(1, 3), testReplayMutation(0, 5),
+		rollback, testReplayMutation(0, 6), testReplayMutation(1, 4)})
+
+	dcp := NewDcpReplayNozzle("replay_"+t.Name(), path, []uint16{0, 1}, log.DefaultLoggerContext)
+	connector := &testConnector{}
+	dcp.SetConnector(connector)
+	err = dcp.Start(map[string]interface{}{
+		DCP_VBTimestampUpdator: func(vbno uint16, rollbackSeqno uint64) (*base.VBTimestamp, error) {
+			return &base.VBTimestamp{Vbno: vbno, Seqno: rollbackSeqno}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to start replay nozzle. err=%v", err)
+	}
+	defer dcp.Stop()
+	// vb 0 has been replicated up to seqno 5 before
+	err = dcp.UpdateSettings(map[string]interface{}{DCP_VBTimestamp: map[uint16]*base.VBTimestamp{
+		0: &base.VBTimestamp{Vbno: 0, Seqno: 5}, 1: &base.VBTimestamp{Vbno: 1}}})
+	if err != nil {
+		t.Fatalf("failed to set start timestamps. err=%v", err)
+	}
+
+	waitFor(t, "recording to be replayed", func() bool { return atomic.LoadInt32(&dcp.replay_done) == 1 })
+	// vb 0 is replayed from the rollback seqno, while vb 1 is replayed once
+	if seqnos := connector.seqnos(0); !reflect.DeepEqual(seqnos, []uint64{3, 4, 5, 6}) {
+		t.Errorf("unexpected seqnos %v replayed for vb 0", seqnos)
+	}
+	if seqnos := connector.seqnos(1); !reflect.DeepEqual(seqnos, []uint64{1, 2, 3, 4}) {
+		t.Errorf("unexpected seqnos %v replayed for vb 1", seqnos)
+	}
+}
@@ -0,0 +1,459 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"encoding/binary"
+	"fmt"
+	base "github.com/couchbase/goxdcr/base"
+	common "github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/file_sink"
+	gen_server "github.com/couchbase/goxdcr/gen_server"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/simple_utils"
+	"github.com/couchbase/goxdcr/utils"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	FILE_SETTING_DIR             = "file_dir"
+	FILE_SETTING_FORMAT          = "file_format"
+	FILE_SETTING_ROTATE_SIZE     = "file_rotate_size"
+	FILE_SETTING_ROTATE_INTERVAL = "file_rotate_interval"
+
+	//default configuration
+	default_maxCount_file int = 500
+	// in KB
+	default_maxSize_file int = 2048
+)
+
+// max time that records written by file nozzles wait to be synced to disk, and hence to be acknowledged
+var FileSyncInterval = 500 * time.Millisecond
+
+var file_setting_defs base.SettingDefinitions = base.SettingDefinitions{SETTING_BATCHCOUNT: base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	SETTING_BATCHSIZE:            base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	SETTING_STATS_INTERVAL:       base.NewSettingDef(reflect.TypeOf((*int)(nil)), true),
+	FILE_SETTING_DIR:             base.NewSettingDef(reflect.TypeOf((*string)(nil)), true),
+	FILE_SETTING_FORMAT:          base.NewSettingDef(reflect.TypeOf((*string)(nil)), true),
+	FILE_SETTING_ROTATE_SIZE:     base.NewSettingDef(reflect.TypeOf((*int64)(nil)), true),
+	FILE_SETTING_ROTATE_INTERVAL: base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), true),
+	SETTING_BANDWIDTH_LIMIT:      base.NewSettingDef(reflect.TypeOf((*int)(nil)), false)}
+
+/*
+***********************************
+/* struct fileConfig
+************************************
+*/
+type fileConfig struct {
+	baseConfig
+	dir    string
+	format string
+	// in bytes
+	rotateSize     int64
+	rotateInterval time.Duration
+}
+
+func newFileConfig(logger *log.CommonLogger) fileConfig {
+	return fileConfig{
+		baseConfig: baseConfig{maxCount: default_maxCount_file,
+			maxSize: default_maxSize_file,
+			logger:  logger,
+		},
+	}
+}
+
+func (config *fileConfig) initializeConfig(settings map[string]interface{}) error {
+	err := utils.ValidateSettings(file_setting_defs, settings, config.logger)
+	if err == nil {
+		config.baseConfig.initializeConfig(settings)
+
+		config.dir = settings[FILE_SETTING_DIR].(string)
+		config.format = settings[FILE_SETTING_FORMAT].(string)
+		config.rotateSize = settings[FILE_SETTING_ROTATE_SIZE].(int64)
+		config.rotateInterval = settings[FILE_SETTING_ROTATE_INTERVAL].(time.Duration)
+	}
+	return err
+}
+
+// a record that has been written into file but has not been synced to disk
+type pendingFileRecord struct {
+	additionalInfo DataSentEventAdditional
+	start_time     time.Time
+	write_time     time.Time
+}
+
+/************************************
+/* struct FileNozzle
+*************************************/
+// FileNozzle is the outgoing nozzle of replications of file type. it writes the mutations, deletions and expirations
+// of the vbuckets it is responsible for into rotating files on the current node.
+// records are acknowledged, i.e., DataSent events are raised for them, only after they have been synced to disk,
+// so that checkpoints never cover records that could be lost
+type FileNozzle struct {
+
+	//parent inheritance
+	gen_server.GenServer
+	AbstractPart
+
+	bOpen bool
+
+	topic string
+
+	//configurable parameter
+	config fileConfig
+
+	dataChan chan *base.WrappedMCRequest
+	//the total number of items queued in dataChan
+	items_in_dataChan int32
+	//the total size of data (in bytes) queued in dataChan
+	bytes_in_dataChan int32
+
+	// accessed by processData routine only
+	writer       *file_sink.Writer
+	pending      []*pendingFileRecord
+	pending_size int
+
+	childrenWaitGrp sync.WaitGroup
+
+	writer_finch      chan bool
+	selfMonitor_finch chan bool
+
+	counter_received uint32
+	counter_sent     uint32
+	handle_error     bool
+	dataObj_recycler base.DataObjRecycler
+
+	// caps the bandwidth used by the outgoing nozzles of the pipeline
+	bandwidth_throttler *BandwidthThrottler
+}
+
+func NewFileNozzle(id string,
+	topic string,
+	dataObj_recycler base.DataObjRecycler,
+	logger_context *log.LoggerContext) *FileNozzle {
+
+	//callback functions from GenServer
+	var msg_callback_func gen_server.Msg_Callback_Func
+	var exit_callback_func gen_server.Exit_Callback_Func
+	var error_handler_func gen_server.Error_Handler_Func
+
+	server := gen_server.NewGenServer(&msg_callback_func,
+		&exit_callback_func, &error_handler_func, logger_context, "FileNozzle")
+	part := NewAbstractPartWithLogger(id, server.Logger())
+
+	file := &FileNozzle{GenServer: server,
+		AbstractPart:      part,
+		bOpen:             true,
+		topic:             topic,
+		config:            newFileConfig(server.Logger()),
+		writer_finch:      make(chan bool, 1),
+		selfMonitor_finch: make(chan bool, 1),
+		handle_error:      true,
+		dataObj_recycler:  dataObj_recycler,
+	}
+
+	msg_callback_func = nil
+	exit_callback_func = file.onExit
+	error_handler_func = file.handleGeneralError
+
+	return file
+}
+
+func (file *FileNozzle) Open() error {
+	if !file.bOpen {
+		file.bOpen = true
+	}
+	return nil
+}
+
+func (file *FileNozzle) Close() error {
+	if file.bOpen {
+		file.bOpen = false
+	}
+	return nil
+}
+
+func (file *FileNozzle) IsOpen() bool {
+	return file.bOpen
+}
+
+func (file *FileNozzle) Start(settings map[string]interface{}) error {
+	file.Logger().Infof("%v starting ....\n", file.Id())
+
+	err := file.SetState(common.Part_Starting)
+	if err != nil {
+		return err
+	}
+
+	err = file.initialize(settings)
+	if err == nil {
+		file.Logger().Infof("%v initialized. writing into %v\n", file.Id(), file.writer.Path())
+
+		file.childrenWaitGrp.Add(1)
+		go file.selfMonitor(file.selfMonitor_finch, &file.childrenWaitGrp)
+
+		file.childrenWaitGrp.Add(1)
+		go file.processData(file.writer_finch, &file.childrenWaitGrp)
+
+		err = file.Start_server()
+	}
+
+	if err == nil {
+		err = file.SetState(common.Part_Running)
+		if err == nil {
+			file.Logger().Infof("%v has been started successfully\n", file.Id())
+		}
+	}
+	if err != nil {
+		file.Logger().Errorf("%v failed to start. err=%v\n", file.Id(), err)
+	}
+	return err
+}
+
+func (file *FileNozzle) initialize(settings map[string]interface{}) error {
+	err := file.config.initializeConfig(settings)
+	if err != nil {
+		return err
+	}
+
+	updateBandwidthLimit(file.bandwidth_throttler, settings)
+
+	file.dataChan = make(chan *base.WrappedMCRequest, file.config.maxCount*10)
+	file.pending = make([]*pendingFileRecord, 0, file.config.maxCount)
+
+	// the directory is checked again since symbolic links may have changed after the setting was validated
+	if _, err = simple_utils.PathUnderRoot(file.config.dir, base.XDCRDataDir); err != nil {
+		file.Logger().Errorf("%v cannot write files into %v. err=%v\n", file.Id(), file.config.dir, err)
+		return err
+	}
+	file.writer, err = file_sink.NewWriter(file.config.dir, file.Id(), file.config.format, file.config.rotateSize, file.config.rotateInterval)
+	return err
+}
+
+func (file *FileNozzle) Stop() error {
+	file.Logger().Infof("%v stopping \n", file.Id())
+
+	err := file.SetState(common.Part_Stopping)
+	if err != nil {
+		return err
+	}
+
+	err = file.Stop_server()
+
+	err = file.SetState(common.Part_Stopped)
+	if err == nil {
+		file.Logger().Infof("%v has been stopped\n", file.Id())
+	} else {
+		file.Logger().Errorf("%v failed to stop. err=%v\n", file.Id(), err)
+	}
+
+	return err
+}
+
+func (file *FileNozzle) onExit() {
+	//in the process of stopping, no need to report any error to replication manager anymore
+	file.handle_error = false
+
+	//notify the data processing routine
+	close(file.writer_finch)
+	close(file.selfMonitor_finch)
+	file.childrenWaitGrp.Wait()
+
+	// records that have not been acknowledged are re-streamed from the last checkpoint when the replication is restarted
+	if file.writer != nil {
+		err := file.writer.Close()
+		if err != nil {
+			file.Logger().Errorf("%v failed to close %v. err=%v\n", file.Id(), file.writer.Path(), err)
+		}
+	}
+}
+
+func (file *FileNozzle) Receive(data interface{}) error {
+	err := file.validateRunningState()
+	if err != nil {
+		file.Logger().Infof("%v is in %v state, Recieve did no-op", file.Id(), file.State())
+		return err
+	}
+
+	req, ok := data.(*base.WrappedMCRequest)
+	if !ok {
+		err = fmt.Errorf("Got data of unexpected type. data=%v", data)
+		file.Logger().Errorf("%v %v", file.Id(), err)
+		file.handleGeneralError(err)
+		return err
+	}
+
+	select {
+	case file.dataChan <- req:
+	case <-file.writer_finch:
+		return PartStoppedError
+	}
+
+	atomic.AddUint32(&file.counter_received, 1)
+	atomic.AddInt32(&file.items_in_dataChan, 1)
+	atomic.AddInt32(&file.bytes_in_dataChan, int32(req.Req.Size()))
+	return nil
+}
+
+func (file *FileNozzle) processData(finch chan bool, waitGrp *sync.WaitGroup) {
+	file.Logger().Infof("%v processData starts..........\n", file.Id())
+	defer waitGrp.Done()
+
+	sync_ticker := time.NewTicker(FileSyncInterval)
+	defer sync_ticker.Stop()
+
+	for {
+		select {
+		case <-finch:
+			goto done
+		case req := <-file.dataChan:
+			atomic.AddInt32(&file.items_in_dataChan, -1)
+			atomic.AddInt32(&file.bytes_in_dataChan, -int32(req.Req.Size()))
+
+			err := file.write(req, finch)
+			if err == nil && (len(file.pending) >= file.config.maxCount || file.pending_size >= file.config.maxSize*1024) {
+				err = file.sync()
+			}
+			if err != nil {
+				file.handleGeneralError(err)
+				goto done
+			}
+		case <-sync_ticker.C:
+			err := file.sync()
+			if err != nil {
+				file.handleGeneralError(err)
+				goto done
+			}
+		}
+	}
+
+done:
+	file.Logger().Infof("%v processData exits\n", file.Id())
+}
+
+// writes the request into the current file. the request is recycled right away, and is acknowledged at next sync
+func (file *FileNozzle) write(req *base.WrappedMCRequest, finch chan bool) error {
+	defer file.recycleDataObj(req)
+
+	mc_req := req.Req
+	if len(mc_req.Extras) < 24 {
+		return fmt.Errorf("%v received request with invalid extras for key %v in vb %v", file.Id(), string(mc_req.Key), req.Src_vbno)
+	}
+	record := &file_sink.Record{
+		Opcode:   mc_req.Opcode,
+		VBucket:  req.Src_vbno,
+		Seqno:    req.Seqno,
+		Flags:    binary.BigEndian.Uint32(mc_req.Extras[0:4]),
+		Expiry:   binary.BigEndian.Uint32(mc_req.Extras[4:8]),
+		RevSeqno: binary.BigEndian.Uint64(mc_req.Extras[8:16]),
+		Cas:      mc_req.Cas,
+		Key:      mc_req.Key,
+		Value:    mc_req.Body,
+	}
+
+	file.bandwidth_throttler.Throttle(mc_req.Size(), finch)
+
+	size, err := file.writer.Write(record)
+	if err != nil {
+		return err
+	}
+
+	file.pending = append(file.pending, &pendingFileRecord{
+		additionalInfo: DataSentEventAdditional{Seqno: req.Seqno,
+			// there is no conflict resolution against files
+			IsOptRepd:   true,
+			Opcode:      encodeOpCode(mc_req.Opcode),
+			IsExpirySet: record.Expiry != 0,
+			VBucket:     req.Src_vbno,
+			Req_size:    size,
+			// records are not compressed
+			Uncompressed_req_size: size,
+		},
+		start_time: req.Start_time,
+		write_time: time.Now(),
+	})
+	file.pending_size += size
+	return nil
+}
+
+// syncs the current file to disk and acknowledges the records written since last sync
+func (file *FileNozzle) sync() error {
+	err := file.writer.Sync()
+	if err != nil {
+		return fmt.Errorf("Failed to sync %v. err=%v", file.writer.Path(), err)
+	}
+
+	for _, record := range file.pending {
+		additionalInfo := record.additionalInfo
+		additionalInfo.Commit_time = time.Since(record.start_time)
+		additionalInfo.Resp_wait_time = time.Since(record.write_time)
+		file.RaiseEvent(common.NewEvent(common.DataSent, nil, file, nil, additionalInfo))
+	}
+	atomic.AddUint32(&file.counter_sent, uint32(len(file.pending)))
+	file.pending = file.pending[:0]
+	file.pending_size = 0
+	return nil
+}
+
+func (file *FileNozzle) selfMonitor(finch chan bool, waitGrp *sync.WaitGroup) {
+	defer waitGrp.Done()
+	statsTicker := time.NewTicker(file.config.statsInterval)
+	defer statsTicker.Stop()
+	for {
+		select {
+		case <-finch:
+			goto done
+		case <-statsTicker.C:
+			file.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, file, nil, []int{int(atomic.LoadInt32(&file.items_in_dataChan)), int(atomic.LoadInt32(&file.bytes_in_dataChan)), file.config.maxCount, file.config.maxSize}))
+		}
+	}
+done:
+	file.Logger().Infof("%v selfMonitor routine exits", file.Id())
+}
+
+func (file *FileNozzle) validateRunningState() error {
+	state := file.State()
+	if state == common.Part_Stopping || state == common.Part_Stopped || state == common.Part_Error {
+		return PartStoppedError
+	}
+	return nil
+}
+
+func (file *FileNozzle) StatusSummary() string {
+	return fmt.Sprintf("%v received %v items, sent %v items, %v items waiting to be synced", file.Id(), atomic.LoadUint32(&file.counter_received), atomic.LoadUint32(&file.counter_sent), len(file.pending))
+}
+
+func (file *FileNozzle) handleGeneralError(err error) {
+	if file.handle_error {
+		file.Logger().Errorf("%v raise error condition %v\n", file.Id(), err)
+		file.RaiseEvent(common.NewEvent(common.ErrorEncountered, nil, file, nil, err))
+	} else {
+		file.Logger().Debugf("%v in shutdown process, err=%v is ignored\n", file.Id(), err)
+	}
+}
+
+// file settings can only be changed through pipeline restart
+func (file *FileNozzle) UpdateSettings(settings map[string]interface{}) error {
+	updateBandwidthLimit(file.bandwidth_throttler, settings)
+	return nil
+}
+
+func (file *FileNozzle) SetBandwidthThrottler(throttler *BandwidthThrottler) {
+	file.bandwidth_throttler = throttler
+}
+
+func (file *FileNozzle) recycleDataObj(req *base.WrappedMCRequest) {
+	if file.dataObj_recycler != nil {
+		file.dataObj_recycler(file.topic, req)
+	}
+}
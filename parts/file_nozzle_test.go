@@ -0,0 +1,196 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/file_sink"
+	"github.com/couchbase/goxdcr/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// records, at each DataSent event, whether the record of the event is already in the file on disk
+type testFileSentListener struct {
+	file       *FileNozzle
+	sent       []uint64
+	not_synced []uint64
+	lock       sync.Mutex
+}
+
+func (listener *testFileSentListener) OnEvent(event *common.Event) {
+	seqno := event.OtherInfos.(DataSentEventAdditional).Seqno
+	// the event is raised by the processData routine, which owns the writer
+	data, err := ioutil.ReadFile(listener.file.writer.Path())
+
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	listener.sent = append(listener.sent, seqno)
+	if err != nil || !bytes.Contains(data, []byte(fmt.Sprintf(`"seqno":%v,`, seqno))) {
+		listener.not_synced = append(listener.not_synced, seqno)
+	}
+}
+
+func (listener *testFileSentListener) counts() (int, int) {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	return len(listener.sent), len(listener.not_synced)
+}
+
+// points the xdcr data dir, which files are written under, to a temp dir, and returns the dir of the nozzle
+// and the function that removes the files and restores the data dir
+func setupTestFileDir(t *testing.T) (string, func()) {
+	root, err := ioutil.TempDir("", "file_nozzle")
+	if err != nil {
+		t.Fatalf("failed to create temp dir. err=%v", err)
+	}
+	oldDataDir := base.XDCRDataDir
+	base.XDCRDataDir = root
+	return filepath.Join(root, "export"), func() {
+		base.XDCRDataDir = oldDataDir
+		os.RemoveAll(root)
+	}
+}
+
+func startTestFileNozzle(t *testing.T, dir string, batchCount int, rotateSize int64) (*FileNozzle, *testFileSentListener) {
+	file := NewFileNozzle("file_"+t.Name(), "test", nil, log.DefaultLoggerContext)
+	listener := &testFileSentListener{file: file}
+	file.RegisterComponentEventListener(common.DataSent, listener)
+
+	settings := map[string]interface{}{
+		SETTING_BATCHCOUNT:           batchCount,
+		SETTING_BATCHSIZE:            1024,
+		SETTING_STATS_INTERVAL:       1000,
+		FILE_SETTING_DIR:             dir,
+		FILE_SETTING_FORMAT:          file_sink.FormatJSONLines,
+		FILE_SETTING_ROTATE_SIZE:     rotateSize,
+		FILE_SETTING_ROTATE_INTERVAL: time.Hour,
+	}
+	if err := file.Start(settings); err != nil {
+		t.Fatalf("failed to start file nozzle. err=%v", err)
+	}
+	return file, listener
+}
+
+func sendTestFileRequests(t *testing.T, file *FileNozzle, first, count int) {
+	for i := first; i < first+count; i++ {
+		if err := file.Receive(newTestXmemRequest(fmt.Sprintf("doc%v", i), uint16(i%4), uint64(i+1), []byte(`{"a":1}`))); err != nil {
+			t.Fatalf("failed to send request. err=%v", err)
+		}
+	}
+}
+
+func TestFileNozzleAcksAfterSync(t *testing.T) {
+	dir, cleanup := setupTestFileDir(t)
+	defer cleanup()
+	oldSyncInterval := FileSyncInterval
+	FileSyncInterval = time.Hour
+	defer func() { FileSyncInterval = oldSyncInterval }()
+
+	file, listener := startTestFileNozzle(t, dir, 5, 1024*1024)
+	defer file.Stop()
+
+	// records are not acknowledged until a full batch triggers a sync
+	sendTestFileRequests(t, file, 0, 4)
+	time.Sleep(200 * time.Millisecond)
+	if sent, _ := listener.counts(); sent != 0 {
+		t.Fatalf("expected no record to be acknowledged before sync, got %v", sent)
+	}
+
+	sendTestFileRequests(t, file, 4, 6)
+	waitFor(t, "10 records to be acknowledged", func() bool {
+		sent, _ := listener.counts()
+		return sent == 10
+	})
+	if _, not_synced := listener.counts(); not_synced != 0 {
+		t.Errorf("expected records to be on disk when they are acknowledged, got %v records that were not", not_synced)
+	}
+}
+
+func TestFileNozzleSyncInterval(t *testing.T) {
+	dir, cleanup := setupTestFileDir(t)
+	defer cleanup()
+	oldSyncInterval := FileSyncInterval
+	FileSyncInterval = 50 * time.Millisecond
+	defer func() { FileSyncInterval = oldSyncInterval }()
+
+	file, listener := startTestFileNozzle(t, dir, 100, 1024*1024)
+	defer file.Stop()
+
+	// a partial batch is synced at the sync interval
+	sendTestFileRequests(t, file, 0, 3)
+	waitFor(t, "3 records to be acknowledged", func() bool {
+		sent, _ := listener.counts()
+		return sent == 3
+	})
+	if _, not_synced := listener.counts(); not_synced != 0 {
+		t.Errorf("expected records to be on disk when they are acknowledged, got %v records that were not", not_synced)
+	}
+}
+
+func TestFileNozzleRotation(t *testing.T) {
+	dir, cleanup := setupTestFileDir(t)
+	defer cleanup()
+	oldSyncInterval := FileSyncInterval
+	FileSyncInterval = time.Hour
+	defer func() { FileSyncInterval = oldSyncInterval }()
+
+	// each sync of 5 records goes beyond the rotate size
+	file, listener := startTestFileNozzle(t, dir, 5, 300)
+	sendTestFileRequests(t, file, 0, 15)
+	waitFor(t, "15 records to be acknowledged", func() bool {
+		sent, _ := listener.counts()
+		return sent == 15
+	})
+	file.Stop()
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read %v. err=%v", dir, err)
+	}
+	// the last rotation leaves an empty current file behind
+	if len(infos) != 4 {
+		t.Fatalf("expected 4 files, got %v", len(infos))
+	}
+	for i, info := range infos {
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			t.Fatalf("failed to read %v. err=%v", info.Name(), err)
+		}
+		if lines := bytes.Count(data, []byte("\n")); (i < 3 && lines != 5) || (i == 3 && lines != 0) {
+			t.Errorf("unexpected number of records, %v, in %v", lines, info.Name())
+		}
+	}
+}
+
+func TestFileNozzleOutsideDataDir(t *testing.T) {
+	_, cleanup := setupTestFileDir(t)
+	defer cleanup()
+
+	file := NewFileNozzle("file_"+t.Name(), "test", nil, log.DefaultLoggerContext)
+	settings := map[string]interface{}{
+		SETTING_STATS_INTERVAL:       1000,
+		FILE_SETTING_DIR:             os.TempDir(),
+		FILE_SETTING_FORMAT:          file_sink.FormatJSONLines,
+		FILE_SETTING_ROTATE_SIZE:     int64(1024),
+		FILE_SETTING_ROTATE_INTERVAL: time.Hour,
+	}
+	if err := file.Start(settings); err == nil {
+		file.Stop()
+		t.Errorf("expected file nozzle not to write outside of the xdcr data dir")
+	}
+}
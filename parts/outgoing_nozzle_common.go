@@ -12,10 +12,10 @@ package parts
 
 import (
 	"encoding/binary"
-	"fmt"
 	mc "github.com/couchbase/gomemcached"
 	base "github.com/couchbase/goxdcr/base"
 	"github.com/couchbase/goxdcr/log"
+	"strconv"
 	"time"
 )
 
@@ -31,6 +31,11 @@ const (
 	SETTING_MAX_RETRY_INTERVAL    = "max_retry_interval"
 	SETTING_SELF_MONITOR_INTERVAL = "self_monitor_interval"
 	SETTING_STATS_INTERVAL        = "stats_interval"
+	// whether docs that fail source side conflict resolution are logged, and whether their bodies are included
+	SETTING_CONFLICT_LOG_ENABLED = "conflict_log_enabled"
+	SETTING_CONFLICT_LOG_BODY    = "conflict_log_body"
+	// bandwidth limit of the replication in MB/s
+	SETTING_BANDWIDTH_LIMIT = "bandwidth_limit"
 
 	STATS_QUEUE_SIZE               = "queue_size"
 	STATS_QUEUE_SIZE_BYTES         = "queue_size_bytes"
@@ -52,6 +57,7 @@ const (
 	Send               NeedSendStatus = iota
 	Not_Send_Failed_CR NeedSendStatus = iota
 	Not_Send_Other     NeedSendStatus = iota
+	Not_Send_Deduped   NeedSendStatus = iota
 )
 
 /************************************
@@ -81,23 +87,12 @@ type baseConfig struct {
 	connectStr         string
 	username           string
 	password           string
+	// whether DataFailedCRSource events carry the metadata of docs for conflict logging
+	conflictLogEnabled bool
+	conflictLogBody    bool
 	logger             *log.CommonLogger
 }
 
-type documentMetadata struct {
-	key      []byte
-	revSeq   uint64 //Item revision seqno
-	cas      uint64 //Item cas
-	flags    uint32 // Item flags
-	expiry   uint32 // Item expiration time
-	deletion bool
-	crMode   base.ConflictResolutionMode // conflict resolution mode
-}
-
-func (doc_meta documentMetadata) String() string {
-	return fmt.Sprintf("[key=%s; revSeq=%v;cas=%v;flags=%v;expiry=%v;deletion=%v;crMode=%v]", doc_meta.key, doc_meta.revSeq, doc_meta.cas, doc_meta.flags, doc_meta.expiry, doc_meta.deletion, doc_meta.crMode)
-}
-
 type GetMetaReceivedEventAdditional struct {
 	Key         string
 	Seqno       uint64
@@ -108,7 +103,21 @@ type DataFailedCRSourceEventAdditional struct {
 	Seqno       uint64
 	Opcode      mc.CommandCode
 	IsExpirySet bool
-	VBucket     uint16
+	VBucket     uint16 // vbno on source
+	// metadata of the source doc, and of the target doc when it is available.
+	// populated only when conflict logging is enabled
+	Source_meta *base.DocumentMetadata
+	Target_meta *base.DocumentMetadata
+}
+
+type DataDedupedEventAdditional struct {
+	Seqno   uint64
+	VBucket uint16 // vbno on source
+}
+
+type DataDeadLetteredEventAdditional struct {
+	Seqno   uint64
+	VBucket uint16 // vbno on source
 }
 
 type DataSentEventAdditional struct {
@@ -118,8 +127,10 @@ type DataSentEventAdditional struct {
 	Resp_wait_time time.Duration
 	Opcode         mc.CommandCode
 	IsExpirySet    bool
-	VBucket        uint16
+	VBucket        uint16 // vbno on source
 	Req_size       int
+	// size of the request before compression. it is the same as Req_size when the request is not compressed
+	Uncompressed_req_size int
 }
 
 // does not return error since the assumption is that settings have been validated prior
@@ -151,6 +162,12 @@ func (config *baseConfig) initializeConfig(settings map[string]interface{}) {
 	if val, ok := settings[SETTING_OPTI_REP_THRESHOLD]; ok {
 		config.optiRepThreshold = val.(int)
 	}
+	if val, ok := settings[SETTING_CONFLICT_LOG_ENABLED]; ok {
+		config.conflictLogEnabled = val.(bool)
+	}
+	if val, ok := settings[SETTING_CONFLICT_LOG_BODY]; ok {
+		config.conflictLogBody = val.(bool)
+	}
 
 }
 
@@ -175,6 +192,15 @@ type dataBatch struct {
 	logger            *log.CommonLogger
 	batch_nonempty_ch chan bool
 	nonempty_set      bool
+	// when dedup is enabled, tracks the seqno of the latest mutation of each document in the batch
+	// key of the map is source vbno + document key, value is the seqno
+	latest_seqno_map map[string]uint64
+	// metadata of the target docs of the big docs that failed source side conflict resolution.
+	// populated only when conflict logging is enabled. key of the map is the document key_revSeqno
+	bigDoc_target_meta_map map[string]*base.DocumentMetadata
+	// cas of the target docs that the big docs won over in source side conflict resolution.
+	// populated only when the conflict resolver overrides target. key of the map is the document key_revSeqno
+	bigDoc_target_cas_map map[string]uint64
 }
 
 func newBatch(cap_count int, cap_size int, logger *log.CommonLogger) *dataBatch {
@@ -207,6 +233,14 @@ func (b *dataBatch) accumuBatch(req *base.WrappedMCRequest, classifyFunc func(re
 		if !classifyFunc(req.Req) {
 			b.bigDoc_map[req.UniqueKey] = req
 		}
+		if b.latest_seqno_map != nil {
+			// mutations of a vbucket are accumulated in seqno order, except for retried dead letters,
+			// so the one with the largest seqno wins
+			dedup_key := dedupKey(req)
+			if latest_seqno, ok := b.latest_seqno_map[dedup_key]; !ok || req.Seqno > latest_seqno {
+				b.latest_seqno_map[dedup_key] = req.Seqno
+			}
+		}
 		b.curSize += size
 		if b.curCount < b.capacity_count && b.curSize < b.capacity_size*1000 {
 			ret = false
@@ -215,6 +249,27 @@ func (b *dataBatch) accumuBatch(req *base.WrappedMCRequest, classifyFunc func(re
 	return isFirst, ret
 }
 
+// only the latest mutation of each document in the batch will be sent after dedup is enabled.
+// needs to be called before any mutation is added to the batch
+func (b *dataBatch) enableDedup() {
+	b.latest_seqno_map = make(map[string]uint64)
+}
+
+// returns true if there is a later mutation of the same document in the batch
+func (b *dataBatch) isSuperseded(req *base.WrappedMCRequest) bool {
+	if b.latest_seqno_map == nil {
+		return false
+	}
+	latest_seqno, ok := b.latest_seqno_map[dedupKey(req)]
+	return ok && latest_seqno > req.Seqno
+}
+
+// seqnos are comparable only within a source vbucket. with key rewrite rules,
+// documents from different source vbuckets could have the same key on target
+func dedupKey(req *base.WrappedMCRequest) string {
+	return strconv.FormatUint(uint64(req.Src_vbno), 10) + base.KeyPartsDelimiter + string(req.Req.Key)
+}
+
 func (b *dataBatch) count() int {
 	return b.curCount
 }
@@ -224,15 +279,20 @@ func (b *dataBatch) size() int {
 
 }
 
-// returns three possible values
+// returns four possible values
 // Send - doc needs to be sent to target
 // Not_Send_Failed_CR - doc does not need to be sent to target since it failed source side conflict resolution
 // Not_Send_Other - doc does not need to be sent to target for other reasons, e.g., since target no longer owns the vbucket involved
+// Not_Send_Deduped - doc does not need to be sent to target since a later mutation of the same doc is in the same batch
 func needSend(req *base.WrappedMCRequest, batch *dataBatch, logger *log.CommonLogger) NeedSendStatus {
 	if req == nil || req.Req == nil {
 		panic("req is null")
 	}
 
+	if batch.isSuperseded(req) {
+		return Not_Send_Deduped
+	}
+
 	failedCR, ok := batch.bigDoc_noRep_map[req.UniqueKey]
 	if !ok {
 		return Send
@@ -243,20 +303,46 @@ func needSend(req *base.WrappedMCRequest, batch *dataBatch, logger *log.CommonLo
 	}
 }
 
-func decodeSetMetaReq(wrapped_req *base.WrappedMCRequest) documentMetadata {
-	ret := documentMetadata{}
+func decodeSetMetaReq(wrapped_req *base.WrappedMCRequest) base.DocumentMetadata {
+	ret := base.DocumentMetadata{}
 	req := wrapped_req.Req
-	ret.key = req.Key
-	ret.flags = binary.BigEndian.Uint32(req.Extras[0:4])
-	ret.expiry = binary.BigEndian.Uint32(req.Extras[4:8])
-	ret.revSeq = binary.BigEndian.Uint64(req.Extras[8:16])
-	ret.cas = req.Cas
-	ret.deletion = (req.Opcode == base.DELETE_WITH_META)
-	ret.crMode = wrapped_req.CRMode
+	ret.Key = req.Key
+	ret.Flags = binary.BigEndian.Uint32(req.Extras[0:4])
+	ret.Expiry = binary.BigEndian.Uint32(req.Extras[4:8])
+	ret.RevSeq = binary.BigEndian.Uint64(req.Extras[8:16])
+	ret.Cas = req.Cas
+	ret.Deletion = (req.Opcode == base.DELETE_WITH_META)
+	ret.CRMode = wrapped_req.CRMode
+	if !ret.Deletion {
+		ret.Body = req.Body
+	}
 
 	return ret
 }
 
+// returns the metadata of a source doc that failed source side conflict resolution, to be carried by DataFailedCRSource events.
+// key and body are copied since the request is recycled right after the event is raised
+func (config *baseConfig) failedCRSourceMeta(wrapped_req *base.WrappedMCRequest) *base.DocumentMetadata {
+	if !config.conflictLogEnabled {
+		return nil
+	}
+	doc_meta := decodeSetMetaReq(wrapped_req)
+	doc_meta.Key = append([]byte(nil), doc_meta.Key...)
+	if config.conflictLogBody && len(doc_meta.Body) > 0 {
+		doc_meta.Body = append([]byte(nil), doc_meta.Body...)
+	} else {
+		doc_meta.Body = nil
+	}
+	return &doc_meta
+}
+
+// applies the bandwidth limit in settings, if any, to the throttler shared by the outgoing nozzles of the pipeline
+func updateBandwidthLimit(throttler *BandwidthThrottler, settings map[string]interface{}) {
+	if val, ok := settings[SETTING_BANDWIDTH_LIMIT]; ok && throttler != nil {
+		throttler.SetLimit(val.(int))
+	}
+}
+
 // TODO more common functions, e.g., data queuing and batch processing,
 // may be refectored into a base class, BatchedNozzle
 
@@ -0,0 +1,115 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"testing"
+)
+
+func notBigDoc(req *mc.MCRequest) bool {
+	return true
+}
+
+// accumulates the requests into a batch and returns the ones that need to be sent
+func sendableTestRequests(t *testing.T, batch *dataBatch, reqs []*base.WrappedMCRequest) []*base.WrappedMCRequest {
+	for _, req := range reqs {
+		batch.accumuBatch(req, notBigDoc)
+	}
+	if batch.count() != len(reqs) {
+		t.Fatalf("expected %v requests in batch, got %v", len(reqs), batch.count())
+	}
+
+	sendable := make([]*base.WrappedMCRequest, 0)
+	for _, req := range reqs {
+		status := needSend(req, batch, batch.logger)
+		if status == Send {
+			sendable = append(sendable, req)
+		} else if status != Not_Send_Deduped {
+			t.Fatalf("unexpected status %v for seqno %v", status, req.Seqno)
+		}
+	}
+	return sendable
+}
+
+func TestDataBatchDedup(t *testing.T) {
+	batch := newBatch(100, 1024, log.NewLogger("test", log.DefaultLoggerContext))
+	batch.enableDedup()
+
+	reqs := []*base.WrappedMCRequest{
+		newTestXmemRequest("doc0", 0, 1, []byte(`{"v":1}`)),
+		newTestXmemRequest("doc1", 0, 2, []byte(`{"v":1}`)),
+		newTestXmemRequest("doc0", 0, 3, []byte(`{"v":2}`)),
+		newTestXmemRequest("doc0", 0, 4, []byte(`{"v":3}`)),
+		newTestXmemRequest("doc1", 0, 5, []byte(`{"v":2}`)),
+		newTestXmemRequest("doc2", 0, 6, []byte(`{"v":1}`)),
+	}
+	sendable := sendableTestRequests(t, batch, reqs)
+
+	expected := map[string]uint64{"doc0": 4, "doc1": 5, "doc2": 6}
+	if len(sendable) != len(expected) {
+		t.Fatalf("expected %v requests to be sent, got %v", len(expected), len(sendable))
+	}
+	for _, req := range sendable {
+		if expected[string(req.Req.Key)] != req.Seqno {
+			t.Errorf("expected seqno %v of %v to be sent, got %v", expected[string(req.Req.Key)], string(req.Req.Key), req.Seqno)
+		}
+	}
+}
+
+func TestDataBatchDedupRetriedRequest(t *testing.T) {
+	batch := newBatch(100, 1024, log.NewLogger("test", log.DefaultLoggerContext))
+	batch.enableDedup()
+
+	// a retried dead letter is accumulated after a later mutation of the same doc
+	reqs := []*base.WrappedMCRequest{
+		newTestXmemRequest("doc0", 0, 10, []byte(`{"v":2}`)),
+		newTestXmemRequest("doc0", 0, 3, []byte(`{"v":1}`)),
+	}
+	sendable := sendableTestRequests(t, batch, reqs)
+	if len(sendable) != 1 || sendable[0].Seqno != 10 {
+		t.Errorf("expected only seqno 10 to be sent, got %v", sendable)
+	}
+}
+
+func TestDataBatchDedupAcrossSourceVBs(t *testing.T) {
+	batch := newBatch(100, 1024, log.NewLogger("test", log.DefaultLoggerContext))
+	batch.enableDedup()
+
+	// with key rewrite rules, mutations from different source vbs could have the same key in the same target vb.
+	// their seqnos are not comparable, and none of them supersedes the others
+	reqs := []*base.WrappedMCRequest{
+		newTestXmemRequest("doc0", 0, 7, []byte(`{"v":1}`)),
+		newTestXmemRequest("doc0", 1, 2, []byte(`{"v":1}`)),
+		newTestXmemRequest("doc0", 2, 5, []byte(`{"v":1}`)),
+	}
+	for _, req := range reqs {
+		req.Req.VBucket = 0
+	}
+	sendable := sendableTestRequests(t, batch, reqs)
+	if len(sendable) != len(reqs) {
+		t.Errorf("expected %v requests to be sent, got %v", len(reqs), len(sendable))
+	}
+}
+
+func TestDataBatchDedupDisabled(t *testing.T) {
+	batch := newBatch(100, 1024, log.NewLogger("test", log.DefaultLoggerContext))
+
+	reqs := []*base.WrappedMCRequest{
+		newTestXmemRequest("doc0", 0, 1, []byte(`{"v":1}`)),
+		newTestXmemRequest("doc0", 0, 2, []byte(`{"v":2}`)),
+	}
+	sendable := sendableTestRequests(t, batch, reqs)
+	if len(sendable) != len(reqs) {
+		t.Errorf("expected %v requests to be sent, got %v", len(reqs), len(sendable))
+	}
+}
@@ -18,9 +18,9 @@ import (
 	"github.com/couchbase/goxdcr/base"
 	common "github.com/couchbase/goxdcr/common"
 	connector "github.com/couchbase/goxdcr/connector"
+	"github.com/couchbase/goxdcr/key_rewrite"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/utils"
-	"regexp"
 	"time"
 )
 
@@ -31,36 +31,55 @@ var ErrorInvalidRoutingMapForRouter = errors.New("routingMap in Router is invali
 
 type ReqCreator func(id string) (*base.WrappedMCRequest, error)
 
+type DataFilteredEventAdditional struct {
+	// true if data is dropped because of the filter_deletions or filter_expirations setting,
+	// false if data is dropped by filter expressions
+	FilteredBySetting bool
+	// true if data is dropped since its key cannot be rewritten by key rewrite rules
+	KeyRewriteFailed bool
+}
+
 // XDCR Router does two things:
 // 1. converts UprEvent to MCRequest
 // 2. routes MCRequest to downstream parts
 type Router struct {
 	id string
 	*connector.Router
-	filterRegexp           *regexp.Regexp    // filter expression
-	routingMap             map[uint16]string // pvbno -> partId. This defines the loading balancing strategy of which vbnos would be routed to which part
+	dataFilter             *DataFilter           // filter settings of replication
+	keyRewriter            *key_rewrite.Rewriter // rules to rewrite keys
+	targetNumOfVBs         int                   // when non-zero, requests are moved to the vbnos that their keys belong to on target, and routingMap covers all vbnos on target
+	routingMap             map[uint16]string     // pvbno -> partId. This defines the loading balancing strategy of which vbnos would be routed to which part
 	req_creator            ReqCreator
 	topic                  string
 	ext_metadata_supported bool
 }
 
 func NewRouter(id string, topic string, filterExpression string,
+	filterBodyExpression string,
+	filterDeletions bool, filterExpirations bool,
+	keyRewriteRules string,
+	targetNumOfVBs int,
 	downStreamParts map[string]common.Part,
 	routingMap map[uint16]string,
 	logger_context *log.LoggerContext, req_creator ReqCreator,
 	ext_metadata_supported bool) (*Router, error) {
-	// compile filter expression
-	var filterRegexp *regexp.Regexp
-	var err error
-	if len(filterExpression) > 0 {
-		filterRegexp, err = regexp.Compile(filterExpression)
+	dataFilter, err := NewDataFilter(filterExpression, filterBodyExpression, filterDeletions, filterExpirations)
+	if err != nil {
+		return nil, err
+	}
+	// compile key rewrite rules
+	var keyRewriter *key_rewrite.Rewriter
+	if len(keyRewriteRules) > 0 {
+		keyRewriter, err = key_rewrite.Parse(keyRewriteRules)
 		if err != nil {
 			return nil, err
 		}
 	}
 	router := &Router{
 		id:                     id,
-		filterRegexp:           filterRegexp,
+		dataFilter:             dataFilter,
+		keyRewriter:            keyRewriter,
+		targetNumOfVBs:         targetNumOfVBs,
 		routingMap:             routingMap,
 		topic:                  topic,
 		req_creator:            req_creator,
@@ -73,7 +92,9 @@ func NewRouter(id string, topic string, filterExpression string,
 	return router, nil
 }
 
-func (router *Router) ComposeMCRequest(event *mcc.UprEvent) (*base.WrappedMCRequest, error) {
+// composes the request for the event. key is the key of the doc on target, which differs from the key of the event
+// when it is rewritten
+func (router *Router) ComposeMCRequest(event *mcc.UprEvent, key []byte) (*base.WrappedMCRequest, error) {
 	wrapped_req, err := router.newWrappedMCRequest()
 	if err != nil {
 		return nil, err
@@ -83,7 +104,7 @@ func (router *Router) ComposeMCRequest(event *mcc.UprEvent) (*base.WrappedMCRequ
 	req.Cas = event.Cas
 	req.Opaque = 0
 	req.VBucket = event.VBucket
-	req.Key = event.Key
+	req.Key = key
 	req.Body = event.Value
 	//opCode
 	req.Opcode = event.Opcode
@@ -125,7 +146,15 @@ func (router *Router) ComposeMCRequest(event *mcc.UprEvent) (*base.WrappedMCRequ
 		binary.BigEndian.PutUint32(req.Extras[24:28], event.SnapshotType)
 	}
 
+	if event.Opcode == mc.UPR_MUTATION || event.Opcode == mc.UPR_DELETION || event.Opcode == mc.UPR_EXPIRATION {
+		// move the request to the vbucket that the key belongs to on target
+		if router.targetNumOfVBs > 0 {
+			req.VBucket = key_rewrite.VBucketForKey(req.Key, router.targetNumOfVBs)
+		}
+	}
+
 	wrapped_req.Seqno = event.Seqno
+	wrapped_req.Src_vbno = event.VBucket
 	wrapped_req.Start_time = time.Now()
 	wrapped_req.ConstructUniqueKey()
 	if router.ext_metadata_supported {
@@ -184,27 +213,51 @@ func (router *Router) route(data interface{}) (map[string]interface{}, error) {
 		return nil, ErrorNoRoutingMapForRouter
 	}
 
-	// use vbMap to determine which downstream part to route the request
-	partId, ok := router.routingMap[uprEvent.VBucket]
-	if !ok {
-		return nil, ErrorInvalidRoutingMapForRouter
+	// the vbno on target is known only after the request is composed when vbnos are remapped
+	if router.targetNumOfVBs == 0 {
+		if _, ok := router.routingMap[uprEvent.VBucket]; !ok {
+			return nil, ErrorInvalidRoutingMapForRouter
+		}
 	}
 
-	router.Logger().Debugf("%v Data with key=%v, vbno=%d, opCode=%v is routed to downstream part %s", router.id, string(uprEvent.Key), uprEvent.VBucket, uprEvent.Opcode, partId)
+	switch router.dataFilter.Filter(uprEvent.Opcode, uprEvent.Key, uprEvent.Value) {
+	case FilteredBySetting:
+		router.RaiseEvent(common.NewEvent(common.DataFiltered, uprEvent, router, nil, DataFilteredEventAdditional{FilteredBySetting: true}))
+		router.Logger().Debugf("%v Data with key=%v, vbno=%d, opCode=%v has been filtered out by setting", router.id, string(uprEvent.Key), uprEvent.VBucket, uprEvent.Opcode)
+		return result, nil
+	case FilteredByKey:
+		router.RaiseEvent(common.NewEvent(common.DataFiltered, uprEvent, router, nil, DataFilteredEventAdditional{FilteredBySetting: false}))
+		router.Logger().Debugf("%v Data with key=%v, vbno=%d, opCode=%v has been filtered out", router.id, string(uprEvent.Key), uprEvent.VBucket, uprEvent.Opcode)
+		return result, nil
+	case FilteredByBody:
+		router.RaiseEvent(common.NewEvent(common.DataFiltered, uprEvent, router, nil, DataFilteredEventAdditional{FilteredBySetting: false}))
+		router.Logger().Debugf("%v Data with key=%v, vbno=%d, opCode=%v has been filtered out by body filter", router.id, string(uprEvent.Key), uprEvent.VBucket, uprEvent.Opcode)
+		return result, nil
+	}
 
-	// filter data if filter expession has been defined
-	if router.filterRegexp != nil {
-		if !utils.RegexpMatch(router.filterRegexp, uprEvent.Key) {
-			// if data does not match filter expression, drop it. return empty result
-			router.RaiseEvent(common.NewEvent(common.DataFiltered, uprEvent, router, nil, nil))
-			router.Logger().Debugf("%v Data with key=%v, vbno=%d, opCode=%v has been filtered out", router.id, string(uprEvent.Key), uprEvent.VBucket, uprEvent.Opcode)
+	key := uprEvent.Key
+	if router.keyRewriter != nil && (uprEvent.Opcode == mc.UPR_MUTATION || uprEvent.Opcode == mc.UPR_DELETION || uprEvent.Opcode == mc.UPR_EXPIRATION) {
+		var err error
+		key, err = router.keyRewriter.Rewrite(uprEvent.Key)
+		if err != nil {
+			// the doc is skipped as a filtered doc, so that it does not fail the replication again each time it is streamed
+			router.RaiseEvent(common.NewEvent(common.DataFiltered, uprEvent, router, nil, DataFilteredEventAdditional{KeyRewriteFailed: true}))
+			router.Logger().Errorf("%v Data with key=%v, vbno=%d, seqno=%v, opCode=%v is skipped since its key cannot be rewritten. err=%v", router.id, string(uprEvent.Key), uprEvent.VBucket, uprEvent.Seqno, uprEvent.Opcode, err)
 			return result, nil
 		}
 	}
-	mcRequest, err := router.ComposeMCRequest(uprEvent)
+
+	mcRequest, err := router.ComposeMCRequest(uprEvent, key)
 	if err != nil {
 		return nil, utils.NewEnhancedError("Error creating new memcached request.", err)
 	}
+	// use vbMap to determine which downstream part to route the request
+	partId, ok := router.routingMap[mcRequest.Req.VBucket]
+	if !ok {
+		return nil, ErrorInvalidRoutingMapForRouter
+	}
+	router.Logger().Debugf("%v Data with key=%v, vbno=%d, target vbno=%d, opCode=%v is routed to downstream part %s", router.id, string(uprEvent.Key), uprEvent.VBucket, mcRequest.Req.VBucket, uprEvent.Opcode, partId)
+
 	result[partId] = mcRequest
 	return result, nil
 }
@@ -218,6 +271,12 @@ func (router *Router) RoutingMap() map[uint16]string {
 	return router.routingMap
 }
 
+// returns true if requests are moved to the vbnos that their keys belong to on target,
+// in which case routingMap is keyed by target vbnos
+func (router *Router) VBsRemapped() bool {
+	return router.targetNumOfVBs != 0
+}
+
 func (router *Router) RoutingMapByDownstreams() map[string][]uint16 {
 	ret := make(map[string][]uint16)
 	for vbno, partId := range router.routingMap {
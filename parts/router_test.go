@@ -0,0 +1,157 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	base "github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/key_rewrite"
+	"github.com/couchbase/goxdcr/log"
+	"testing"
+)
+
+// routes vbs 0..numOfVBs-1 to two parts
+func newTestRoutingMap(numOfVBs int) map[uint16]string {
+	routingMap := make(map[uint16]string)
+	for vbno := 0; vbno < numOfVBs; vbno++ {
+		routingMap[uint16(vbno)] = fmt.Sprintf("part%v", vbno%2)
+	}
+	return routingMap
+}
+
+func routeTestMutation(t *testing.T, router *Router, vbno uint16, key string) (string, *base.WrappedMCRequest, error) {
+	result, err := router.route(&mcc.UprEvent{Opcode: mc.UPR_MUTATION, VBucket: vbno, Key: []byte(key), Seqno: 10})
+	if err != nil {
+		return "", nil, err
+	}
+	if len(result) != 1 {
+		t.Fatalf("expected mutation to be routed to one part, got %v", result)
+	}
+	for partId, req := range result {
+		return partId, req.(*base.WrappedMCRequest), nil
+	}
+	return "", nil, nil
+}
+
+func TestRouterMismatchedVBCount(t *testing.T) {
+	// source has 1024 vbs while target has 64
+	routingMap := newTestRoutingMap(64)
+	router, err := NewRouter("router", "topic", "", "", false, false, "", 64, map[string]common.Part{}, routingMap,
+		log.DefaultLoggerContext, nil, false)
+	if err != nil {
+		t.Fatalf("failed to create router. err=%v", err)
+	}
+
+	for _, key := range []string{"doc1", "doc2", "user::3"} {
+		partId, req, err := routeTestMutation(t, router, 1000, key)
+		if err != nil {
+			t.Fatalf("failed to route %v. err=%v", key, err)
+		}
+		target_vb := key_rewrite.VBucketForKey([]byte(key), 64)
+		if req.Req.VBucket != target_vb || req.Src_vbno != 1000 || partId != routingMap[target_vb] {
+			t.Errorf("expected %v to be routed to vb=%v on %v, got vb=%v src vb=%v on %v", key, target_vb, routingMap[target_vb],
+				req.Req.VBucket, req.Src_vbno, partId)
+		}
+	}
+}
+
+func TestRouterKeyRewrite(t *testing.T) {
+	routingMap := newTestRoutingMap(1024)
+	router, err := NewRouter("router", "topic", "", "", false, false, `[{"type":"addPrefix","prefix":"eu::"}]`, 1024,
+		map[string]common.Part{}, routingMap, log.DefaultLoggerContext, nil, false)
+	if err != nil {
+		t.Fatalf("failed to create router. err=%v", err)
+	}
+
+	partId, req, err := routeTestMutation(t, router, 5, "doc1")
+	if err != nil {
+		t.Fatalf("failed to route. err=%v", err)
+	}
+	target_vb := key_rewrite.VBucketForKey([]byte("eu::doc1"), 1024)
+	if string(req.Req.Key) != "eu::doc1" || req.Req.VBucket != target_vb || req.Src_vbno != 5 || partId != routingMap[target_vb] {
+		t.Errorf("unexpected key=%s vb=%v src vb=%v part=%v", req.Req.Key, req.Req.VBucket, req.Src_vbno, partId)
+	}
+}
+
+// records the DataFiltered events raised by router
+type testFilteredListener struct {
+	events []*common.Event
+}
+
+func (listener *testFilteredListener) OnEvent(event *common.Event) {
+	listener.events = append(listener.events, event)
+}
+
+func TestRouterKeyRewriteFailure(t *testing.T) {
+	// keys of tmp docs are rewritten into empty keys
+	router, err := NewRouter("router", "topic", "", "", false, false, `[{"type":"regexReplace","pattern":"^tmp$","replacement":""}]`, 0,
+		map[string]common.Part{}, newTestRoutingMap(4), log.DefaultLoggerContext, nil, false)
+	if err != nil {
+		t.Fatalf("failed to create router. err=%v", err)
+	}
+	listener := &testFilteredListener{}
+	router.RegisterComponentEventListener(common.DataFiltered, listener)
+
+	// the doc is skipped as a filtered doc instead of failing the replication
+	result, err := router.route(&mcc.UprEvent{Opcode: mc.UPR_MUTATION, VBucket: 1, Key: []byte("tmp"), Seqno: 10})
+	if err != nil || len(result) != 0 {
+		t.Fatalf("expected doc to be skipped, got %v. err=%v", result, err)
+	}
+	if len(listener.events) != 1 || !listener.events[0].OtherInfos.(DataFilteredEventAdditional).KeyRewriteFailed ||
+		listener.events[0].Data.(*mcc.UprEvent).Seqno != 10 {
+		t.Errorf("expected DataFiltered event for the skipped doc, got %v", listener.events)
+	}
+
+	// other docs are routed as usual
+	if _, req, err := routeTestMutation(t, router, 1, "tmp1"); err != nil || string(req.Req.Key) != "tmp1" {
+		t.Errorf("expected doc to be routed, got %v. err=%v", req, err)
+	}
+	if len(listener.events) != 1 {
+		t.Errorf("expected no more DataFiltered events, got %v", listener.events)
+	}
+}
+
+func TestRouterSameVBs(t *testing.T) {
+	// when vbs are not remapped, docs stay in their source vbs even when their keys are rewritten
+	router, err := NewRouter("router", "topic", "", "", false, false, `[{"type":"addPrefix","prefix":"eu::"}]`, 0,
+		map[string]common.Part{}, newTestRoutingMap(4), log.DefaultLoggerContext, nil, false)
+	if err != nil {
+		t.Fatalf("failed to create router. err=%v", err)
+	}
+
+	partId, req, err := routeTestMutation(t, router, 3, "doc1")
+	if err != nil {
+		t.Fatalf("failed to route. err=%v", err)
+	}
+	if string(req.Req.Key) != "eu::doc1" || req.Req.VBucket != 3 || partId != "part1" {
+		t.Errorf("unexpected key=%s vb=%v part=%v", req.Req.Key, req.Req.VBucket, partId)
+	}
+
+	if _, _, err = routeTestMutation(t, router, 4, "doc1"); err != ErrorInvalidRoutingMapForRouter {
+		t.Errorf("expected vb not in routing map to be rejected, got %v", err)
+	}
+}
+
+func TestVBucketForKey(t *testing.T) {
+	for _, numOfVBs := range []int{1, 3, 64, 100, 1024} {
+		for i := 0; i < 1000; i++ {
+			if vbno := key_rewrite.VBucketForKey([]byte(fmt.Sprintf("doc%v", i)), numOfVBs); int(vbno) >= numOfVBs {
+				t.Fatalf("vb=%v is out of range for %v vbs", vbno, numOfVBs)
+			}
+		}
+	}
+	// same hashing as couchbase clients
+	if vbno := key_rewrite.VBucketForKey([]byte("foo"), 1024); vbno != 115 {
+		t.Errorf("expected vb=115 for foo, got %v", vbno)
+	}
+}
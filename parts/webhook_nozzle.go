@@ -0,0 +1,542 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	base "github.com/couchbase/goxdcr/base"
+	common "github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/file_sink"
+	gen_server "github.com/couchbase/goxdcr/gen_server"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	WEBHOOK_SETTING_URL         = "webhook_url"
+	WEBHOOK_SETTING_TIMEOUT     = "webhook_timeout"
+	WEBHOOK_SETTING_MAX_RETRIES = "webhook_max_retries"
+	WEBHOOK_SETTING_SECRET      = "webhook_secret"
+
+	// header that carries the signature of request body when a secret is configured
+	WebhookSignatureHeader = "X-XDCR-Signature"
+	WebhookSignaturePrefix = "sha256="
+
+	//default configuration
+	default_maxCount_webhook int = 500
+	// in KB
+	default_maxSize_webhook int = 2048
+)
+
+// max time that records wait in a partial batch before the batch is posted
+var WebhookFlushInterval = 500 * time.Millisecond
+
+// backoff between retries of a batch, which doubles after each failed attempt up to WebhookMaxBackoff
+var WebhookInitialBackoff = 500 * time.Millisecond
+var WebhookMaxBackoff = 30 * time.Second
+
+var webhook_setting_defs base.SettingDefinitions = base.SettingDefinitions{SETTING_BATCHCOUNT: base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	SETTING_BATCHSIZE:           base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	SETTING_STATS_INTERVAL:      base.NewSettingDef(reflect.TypeOf((*int)(nil)), true),
+	WEBHOOK_SETTING_URL:         base.NewSettingDef(reflect.TypeOf((*string)(nil)), true),
+	WEBHOOK_SETTING_TIMEOUT:     base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), true),
+	WEBHOOK_SETTING_MAX_RETRIES: base.NewSettingDef(reflect.TypeOf((*int)(nil)), true),
+	WEBHOOK_SETTING_SECRET:      base.NewSettingDef(reflect.TypeOf((*string)(nil)), false),
+	SETTING_BANDWIDTH_LIMIT:     base.NewSettingDef(reflect.TypeOf((*int)(nil)), false)}
+
+/*
+***********************************
+/* struct webhookConfig
+************************************
+*/
+type webhookConfig struct {
+	baseConfig
+	url        string
+	timeout    time.Duration
+	maxRetries int
+	// batches are not signed when secret is empty
+	secret string
+}
+
+func newWebhookConfig(logger *log.CommonLogger) webhookConfig {
+	return webhookConfig{
+		baseConfig: baseConfig{maxCount: default_maxCount_webhook,
+			maxSize: default_maxSize_webhook,
+			logger:  logger,
+		},
+	}
+}
+
+func (config *webhookConfig) initializeConfig(settings map[string]interface{}) error {
+	err := utils.ValidateSettings(webhook_setting_defs, settings, config.logger)
+	if err == nil {
+		config.baseConfig.initializeConfig(settings)
+
+		config.url = settings[WEBHOOK_SETTING_URL].(string)
+		config.timeout = settings[WEBHOOK_SETTING_TIMEOUT].(time.Duration)
+		config.maxRetries = settings[WEBHOOK_SETTING_MAX_RETRIES].(int)
+		if val, ok := settings[WEBHOOK_SETTING_SECRET]; ok {
+			config.secret = val.(string)
+		}
+	}
+	return err
+}
+
+// a record that has been added to the current batch but has not been delivered
+type pendingWebhookRecord struct {
+	additionalInfo DataSentEventAdditional
+	start_time     time.Time
+}
+
+/************************************
+/* struct WebhookNozzle
+*************************************/
+// WebhookNozzle is the outgoing nozzle of replications of webhook type. it posts the mutations, deletions and
+// expirations of the vbuckets it is responsible for, in batches, as json to the configured url.
+// the body of a request is of the form {"records":[...]}, where each record is in the json form of file_sink.
+// a batch is delivered when the url responds with 2xx status, and is retried with backoff otherwise.
+// records are acknowledged, i.e., DataSent events are raised for them, only after their batch has been delivered
+type WebhookNozzle struct {
+
+	//parent inheritance
+	gen_server.GenServer
+	AbstractPart
+
+	bOpen bool
+
+	topic string
+
+	//configurable parameter
+	config webhookConfig
+
+	client *http.Client
+
+	dataChan chan *base.WrappedMCRequest
+	//the total number of items queued in dataChan
+	items_in_dataChan int32
+	//the total size of data (in bytes) queued in dataChan
+	bytes_in_dataChan int32
+
+	// accessed by processData routine only
+	batch      *bytes.Buffer
+	pending    []*pendingWebhookRecord
+	batch_size int
+
+	childrenWaitGrp sync.WaitGroup
+
+	sender_finch      chan bool
+	selfMonitor_finch chan bool
+
+	counter_received uint32
+	counter_sent     uint32
+	counter_retries  uint32
+	handle_error     bool
+	dataObj_recycler base.DataObjRecycler
+
+	// caps the bandwidth used by the outgoing nozzles of the pipeline
+	bandwidth_throttler *BandwidthThrottler
+}
+
+func NewWebhookNozzle(id string,
+	topic string,
+	dataObj_recycler base.DataObjRecycler,
+	logger_context *log.LoggerContext) *WebhookNozzle {
+
+	//callback functions from GenServer
+	var msg_callback_func gen_server.Msg_Callback_Func
+	var exit_callback_func gen_server.Exit_Callback_Func
+	var error_handler_func gen_server.Error_Handler_Func
+
+	server := gen_server.NewGenServer(&msg_callback_func,
+		&exit_callback_func, &error_handler_func, logger_context, "WebhookNozzle")
+	part := NewAbstractPartWithLogger(id, server.Logger())
+
+	webhook := &WebhookNozzle{GenServer: server,
+		AbstractPart:      part,
+		bOpen:             true,
+		topic:             topic,
+		config:            newWebhookConfig(server.Logger()),
+		sender_finch:      make(chan bool, 1),
+		selfMonitor_finch: make(chan bool, 1),
+		handle_error:      true,
+		dataObj_recycler:  dataObj_recycler,
+	}
+
+	msg_callback_func = nil
+	exit_callback_func = webhook.onExit
+	error_handler_func = webhook.handleGeneralError
+
+	return webhook
+}
+
+func (webhook *WebhookNozzle) Open() error {
+	if !webhook.bOpen {
+		webhook.bOpen = true
+	}
+	return nil
+}
+
+func (webhook *WebhookNozzle) Close() error {
+	if webhook.bOpen {
+		webhook.bOpen = false
+	}
+	return nil
+}
+
+func (webhook *WebhookNozzle) IsOpen() bool {
+	return webhook.bOpen
+}
+
+func (webhook *WebhookNozzle) Start(settings map[string]interface{}) error {
+	webhook.Logger().Infof("%v starting ....\n", webhook.Id())
+
+	err := webhook.SetState(common.Part_Starting)
+	if err != nil {
+		return err
+	}
+
+	err = webhook.initialize(settings)
+	if err == nil {
+		webhook.Logger().Infof("%v initialized. posting to %v\n", webhook.Id(), webhook.config.url)
+
+		webhook.childrenWaitGrp.Add(1)
+		go webhook.selfMonitor(webhook.selfMonitor_finch, &webhook.childrenWaitGrp)
+
+		webhook.childrenWaitGrp.Add(1)
+		go webhook.processData(webhook.sender_finch, &webhook.childrenWaitGrp)
+
+		err = webhook.Start_server()
+	}
+
+	if err == nil {
+		err = webhook.SetState(common.Part_Running)
+		if err == nil {
+			webhook.Logger().Infof("%v has been started successfully\n", webhook.Id())
+		}
+	}
+	if err != nil {
+		webhook.Logger().Errorf("%v failed to start. err=%v\n", webhook.Id(), err)
+	}
+	return err
+}
+
+func (webhook *WebhookNozzle) initialize(settings map[string]interface{}) error {
+	err := webhook.config.initializeConfig(settings)
+	if err != nil {
+		return err
+	}
+
+	updateBandwidthLimit(webhook.bandwidth_throttler, settings)
+
+	webhook.client = &http.Client{Timeout: webhook.config.timeout}
+	webhook.dataChan = make(chan *base.WrappedMCRequest, webhook.config.maxCount*10)
+	webhook.pending = make([]*pendingWebhookRecord, 0, webhook.config.maxCount)
+	webhook.batch = new(bytes.Buffer)
+	webhook.resetBatch()
+	return nil
+}
+
+func (webhook *WebhookNozzle) Stop() error {
+	webhook.Logger().Infof("%v stopping \n", webhook.Id())
+
+	err := webhook.SetState(common.Part_Stopping)
+	if err != nil {
+		return err
+	}
+
+	err = webhook.Stop_server()
+
+	err = webhook.SetState(common.Part_Stopped)
+	if err == nil {
+		webhook.Logger().Infof("%v has been stopped\n", webhook.Id())
+	} else {
+		webhook.Logger().Errorf("%v failed to stop. err=%v\n", webhook.Id(), err)
+	}
+
+	return err
+}
+
+func (webhook *WebhookNozzle) onExit() {
+	//in the process of stopping, no need to report any error to replication manager anymore
+	webhook.handle_error = false
+
+	//notify the data processing routine. records that have not been delivered are re-streamed
+	//from the last checkpoint when the replication is restarted
+	close(webhook.sender_finch)
+	close(webhook.selfMonitor_finch)
+	webhook.childrenWaitGrp.Wait()
+}
+
+func (webhook *WebhookNozzle) Receive(data interface{}) error {
+	err := webhook.validateRunningState()
+	if err != nil {
+		webhook.Logger().Infof("%v is in %v state, Recieve did no-op", webhook.Id(), webhook.State())
+		return err
+	}
+
+	req, ok := data.(*base.WrappedMCRequest)
+	if !ok {
+		err = fmt.Errorf("Got data of unexpected type. data=%v", data)
+		webhook.Logger().Errorf("%v %v", webhook.Id(), err)
+		webhook.handleGeneralError(err)
+		return err
+	}
+
+	select {
+	case webhook.dataChan <- req:
+	case <-webhook.sender_finch:
+		return PartStoppedError
+	}
+
+	atomic.AddUint32(&webhook.counter_received, 1)
+	atomic.AddInt32(&webhook.items_in_dataChan, 1)
+	atomic.AddInt32(&webhook.bytes_in_dataChan, int32(req.Req.Size()))
+	return nil
+}
+
+func (webhook *WebhookNozzle) processData(finch chan bool, waitGrp *sync.WaitGroup) {
+	webhook.Logger().Infof("%v processData starts..........\n", webhook.Id())
+	defer waitGrp.Done()
+
+	flush_ticker := time.NewTicker(WebhookFlushInterval)
+	defer flush_ticker.Stop()
+
+	for {
+		select {
+		case <-finch:
+			goto done
+		case req := <-webhook.dataChan:
+			atomic.AddInt32(&webhook.items_in_dataChan, -1)
+			atomic.AddInt32(&webhook.bytes_in_dataChan, -int32(req.Req.Size()))
+
+			err := webhook.add(req)
+			if err == nil && (len(webhook.pending) >= webhook.config.maxCount || webhook.batch_size >= webhook.config.maxSize*1024) {
+				err = webhook.flush(finch)
+			}
+			if err != nil {
+				if err != PartStoppedError {
+					webhook.handleGeneralError(err)
+				}
+				goto done
+			}
+		case <-flush_ticker.C:
+			if len(webhook.pending) == 0 {
+				continue
+			}
+			err := webhook.flush(finch)
+			if err != nil {
+				if err != PartStoppedError {
+					webhook.handleGeneralError(err)
+				}
+				goto done
+			}
+		}
+	}
+
+done:
+	webhook.Logger().Infof("%v processData exits\n", webhook.Id())
+}
+
+// adds the request to the current batch. the request is recycled right away, and is acknowledged after the batch is delivered
+func (webhook *WebhookNozzle) add(req *base.WrappedMCRequest) error {
+	defer webhook.recycleDataObj(req)
+
+	mc_req := req.Req
+	if len(mc_req.Extras) < 24 {
+		return fmt.Errorf("%v received request with invalid extras for key %v in vb %v", webhook.Id(), string(mc_req.Key), req.Src_vbno)
+	}
+	record := &file_sink.Record{
+		Opcode:   mc_req.Opcode,
+		VBucket:  req.Src_vbno,
+		Seqno:    req.Seqno,
+		Flags:    binary.BigEndian.Uint32(mc_req.Extras[0:4]),
+		Expiry:   binary.BigEndian.Uint32(mc_req.Extras[4:8]),
+		RevSeqno: binary.BigEndian.Uint64(mc_req.Extras[8:16]),
+		Cas:      mc_req.Cas,
+		Key:      mc_req.Key,
+		Value:    mc_req.Body,
+	}
+
+	data, err := file_sink.EncodeJSON(record)
+	if err != nil {
+		return err
+	}
+
+	if len(webhook.pending) > 0 {
+		webhook.batch.WriteByte(',')
+	}
+	webhook.batch.Write(data)
+
+	webhook.pending = append(webhook.pending, &pendingWebhookRecord{
+		additionalInfo: DataSentEventAdditional{Seqno: req.Seqno,
+			// there is no conflict resolution against webhooks
+			IsOptRepd:   true,
+			Opcode:      encodeOpCode(mc_req.Opcode),
+			IsExpirySet: record.Expiry != 0,
+			VBucket:     req.Src_vbno,
+			Req_size:    len(data),
+			// records are not compressed
+			Uncompressed_req_size: len(data),
+		},
+		start_time: req.Start_time,
+	})
+	webhook.batch_size += len(data)
+	return nil
+}
+
+func (webhook *WebhookNozzle) resetBatch() {
+	webhook.batch.Reset()
+	webhook.batch.WriteString(`{"records":[`)
+	webhook.pending = webhook.pending[:0]
+	webhook.batch_size = 0
+}
+
+// posts the current batch, retrying with backoff, and acknowledges its records once it has been delivered.
+// returns error when the batch could not be delivered after max retries, in which case the pipeline is restarted
+// and the records are re-streamed from the last checkpoint
+func (webhook *WebhookNozzle) flush(finch chan bool) error {
+	webhook.batch.WriteString(`]}`)
+	body := webhook.batch.Bytes()
+
+	webhook.bandwidth_throttler.Throttle(len(body), finch)
+
+	post_time := time.Now()
+	backoff := WebhookInitialBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = webhook.post(body)
+		if err == nil {
+			break
+		}
+		if attempt >= webhook.config.maxRetries {
+			return fmt.Errorf("Failed to deliver batch of %v records to %v after %v retries. err=%v", len(webhook.pending), webhook.config.url, attempt, err)
+		}
+
+		webhook.Logger().Infof("%v failed to deliver batch of %v records. err=%v. retrying in %v\n", webhook.Id(), len(webhook.pending), err, backoff)
+		atomic.AddUint32(&webhook.counter_retries, 1)
+		select {
+		case <-finch:
+			return PartStoppedError
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > WebhookMaxBackoff {
+			backoff = WebhookMaxBackoff
+		}
+	}
+
+	for _, record := range webhook.pending {
+		additionalInfo := record.additionalInfo
+		additionalInfo.Commit_time = time.Since(record.start_time)
+		additionalInfo.Resp_wait_time = time.Since(post_time)
+		webhook.RaiseEvent(common.NewEvent(common.DataSent, nil, webhook, nil, additionalInfo))
+	}
+	atomic.AddUint32(&webhook.counter_sent, uint32(len(webhook.pending)))
+	webhook.resetBatch()
+	return nil
+}
+
+// posts the body to the url once. returns nil when the url responds with 2xx status
+func (webhook *WebhookNozzle) post(body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, webhook.config.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set(base.ContentType, base.JsonContentType)
+	if webhook.config.secret != "" {
+		request.Header.Set(WebhookSignatureHeader, WebhookSignaturePrefix+SignWebhookBody(webhook.config.secret, body))
+	}
+
+	response, err := webhook.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	// drain the body so that the connection can be reused
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New(response.Status)
+	}
+	return nil
+}
+
+// returns the hex encoded HMAC-SHA256 of the body with the secret as key
+func SignWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (webhook *WebhookNozzle) selfMonitor(finch chan bool, waitGrp *sync.WaitGroup) {
+	defer waitGrp.Done()
+	statsTicker := time.NewTicker(webhook.config.statsInterval)
+	defer statsTicker.Stop()
+	for {
+		select {
+		case <-finch:
+			goto done
+		case <-statsTicker.C:
+			webhook.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, webhook, nil, []int{int(atomic.LoadInt32(&webhook.items_in_dataChan)), int(atomic.LoadInt32(&webhook.bytes_in_dataChan)), webhook.config.maxCount, webhook.config.maxSize}))
+		}
+	}
+done:
+	webhook.Logger().Infof("%v selfMonitor routine exits", webhook.Id())
+}
+
+func (webhook *WebhookNozzle) validateRunningState() error {
+	state := webhook.State()
+	if state == common.Part_Stopping || state == common.Part_Stopped || state == common.Part_Error {
+		return PartStoppedError
+	}
+	return nil
+}
+
+func (webhook *WebhookNozzle) StatusSummary() string {
+	return fmt.Sprintf("%v received %v items, sent %v items, retried %v times", webhook.Id(), atomic.LoadUint32(&webhook.counter_received), atomic.LoadUint32(&webhook.counter_sent), atomic.LoadUint32(&webhook.counter_retries))
+}
+
+func (webhook *WebhookNozzle) handleGeneralError(err error) {
+	if webhook.handle_error {
+		webhook.Logger().Errorf("%v raise error condition %v\n", webhook.Id(), err)
+		webhook.RaiseEvent(common.NewEvent(common.ErrorEncountered, nil, webhook, nil, err))
+	} else {
+		webhook.Logger().Debugf("%v in shutdown process, err=%v is ignored\n", webhook.Id(), err)
+	}
+}
+
+// webhook settings can only be changed through pipeline restart
+func (webhook *WebhookNozzle) UpdateSettings(settings map[string]interface{}) error {
+	updateBandwidthLimit(webhook.bandwidth_throttler, settings)
+	return nil
+}
+
+func (webhook *WebhookNozzle) SetBandwidthThrottler(throttler *BandwidthThrottler) {
+	webhook.bandwidth_throttler = throttler
+}
+
+func (webhook *WebhookNozzle) recycleDataObj(req *base.WrappedMCRequest) {
+	if webhook.dataObj_recycler != nil {
+		webhook.dataObj_recycler(webhook.topic, req)
+	}
+}
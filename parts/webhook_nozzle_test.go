@@ -0,0 +1,149 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"encoding/json"
+	mc "github.com/couchbase/gomemcached"
+	base "github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// records the bodies posted to it, and fails the first num_failures posts
+type testWebhookServer struct {
+	*httptest.Server
+	num_failures int
+	bodies       [][]byte
+	signatures   []string
+	lock         sync.Mutex
+}
+
+func newTestWebhookServer(num_failures int) *testWebhookServer {
+	server := &testWebhookServer{num_failures: num_failures}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		if server.num_failures > 0 {
+			server.num_failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		server.bodies = append(server.bodies, body)
+		server.signatures = append(server.signatures, r.Header.Get(WebhookSignatureHeader))
+	}))
+	return server
+}
+
+func newTestWebhookNozzle(t *testing.T, url, secret string, maxRetries int) *WebhookNozzle {
+	webhook := NewWebhookNozzle("webhook_test", "test", nil, log.DefaultLoggerContext)
+	settings := map[string]interface{}{
+		SETTING_STATS_INTERVAL:      1000,
+		WEBHOOK_SETTING_URL:         url,
+		WEBHOOK_SETTING_TIMEOUT:     time.Second,
+		WEBHOOK_SETTING_MAX_RETRIES: maxRetries,
+		WEBHOOK_SETTING_SECRET:      secret,
+	}
+	if err := webhook.initialize(settings); err != nil {
+		t.Fatalf("failed to initialize webhook nozzle. err=%v", err)
+	}
+	return webhook
+}
+
+func newTestWebhookRequest(key string, seqno uint64) *base.WrappedMCRequest {
+	return &base.WrappedMCRequest{
+		Seqno:      seqno,
+		Src_vbno:   3,
+		Start_time: time.Now(),
+		Req: &mc.MCRequest{Opcode: mc.UPR_MUTATION,
+			Key:    []byte(key),
+			Body:   []byte(`{"a":1}`),
+			Extras: make([]byte, 24),
+		},
+	}
+}
+
+func TestWebhookNozzleDelivery(t *testing.T) {
+	server := newTestWebhookServer(0)
+	defer server.Close()
+
+	webhook := newTestWebhookNozzle(t, server.URL, "s3cret", 0)
+	for i, key := range []string{"doc1", "doc2"} {
+		if err := webhook.add(newTestWebhookRequest(key, uint64(i+1))); err != nil {
+			t.Fatalf("failed to add request. err=%v", err)
+		}
+	}
+	if err := webhook.flush(make(chan bool)); err != nil {
+		t.Fatalf("failed to flush batch. err=%v", err)
+	}
+
+	if len(server.bodies) != 1 {
+		t.Fatalf("expected 1 post, got %v", len(server.bodies))
+	}
+	var batch struct {
+		Records []struct {
+			Op    string          `json:"op"`
+			VB    uint16          `json:"vb"`
+			Seqno uint64          `json:"seqno"`
+			Key   string          `json:"key"`
+			Doc   json.RawMessage `json:"doc"`
+		} `json:"records"`
+	}
+	if err := json.Unmarshal(server.bodies[0], &batch); err != nil {
+		t.Fatalf("invalid body %s. err=%v", server.bodies[0], err)
+	}
+	if len(batch.Records) != 2 || batch.Records[1].Key != "doc2" || batch.Records[1].Seqno != 2 ||
+		batch.Records[1].Op != "mutation" || batch.Records[1].VB != 3 || string(batch.Records[1].Doc) != `{"a":1}` {
+		t.Errorf("unexpected body %s", server.bodies[0])
+	}
+	if server.signatures[0] != WebhookSignaturePrefix+SignWebhookBody("s3cret", server.bodies[0]) {
+		t.Errorf("unexpected signature %v", server.signatures[0])
+	}
+	if webhook.counter_sent != 2 || len(webhook.pending) != 0 {
+		t.Errorf("expected 2 records sent and none pending, got %v and %v", webhook.counter_sent, len(webhook.pending))
+	}
+}
+
+func TestWebhookNozzleRetry(t *testing.T) {
+	initialBackoff := WebhookInitialBackoff
+	WebhookInitialBackoff = time.Millisecond
+	defer func() { WebhookInitialBackoff = initialBackoff }()
+
+	server := newTestWebhookServer(2)
+	defer server.Close()
+
+	webhook := newTestWebhookNozzle(t, server.URL, "", 2)
+	webhook.add(newTestWebhookRequest("doc1", 1))
+	if err := webhook.flush(make(chan bool)); err != nil {
+		t.Fatalf("failed to flush batch. err=%v", err)
+	}
+	if len(server.bodies) != 1 || webhook.counter_retries != 2 {
+		t.Errorf("expected 1 post after 2 retries, got %v posts after %v retries", len(server.bodies), webhook.counter_retries)
+	}
+	if server.signatures[0] != "" {
+		t.Errorf("unexpected signature %v without secret", server.signatures[0])
+	}
+
+	// the batch is given up on once max retries are exhausted
+	server.num_failures = 3
+	webhook.add(newTestWebhookRequest("doc2", 2))
+	if err := webhook.flush(make(chan bool)); err == nil {
+		t.Errorf("expected flush to fail after max retries")
+	}
+	if webhook.counter_sent != 1 {
+		t.Errorf("expected 1 record sent, got %v", webhook.counter_sent)
+	}
+}
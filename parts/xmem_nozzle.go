@@ -17,10 +17,12 @@ import (
 	mcc "github.com/couchbase/gomemcached/client"
 	base "github.com/couchbase/goxdcr/base"
 	common "github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/dead_letter"
 	gen_server "github.com/couchbase/goxdcr/gen_server"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/metadata"
 	"github.com/couchbase/goxdcr/utils"
+	"github.com/golang/snappy"
 	"io"
 	"math"
 	"math/rand"
@@ -42,6 +44,17 @@ const (
 	XMEM_SETTING_REMOTE_PROXY_PORT   = "remote_proxy_port"
 	XMEM_SETTING_LOCAL_PROXY_PORT    = "local_proxy_port"
 	XMEM_SETTING_REMOTE_MEM_SSL_PORT = "remote_ssl_port"
+	XMEM_SETTING_DEDUP_IN_BATCH      = "dedup_in_batch"
+	XMEM_SETTING_COMPRESSION_TYPE    = "compression_type"
+	XMEM_SETTING_CONFLICT_RESOLVER   = "conflict_resolver"
+	XMEM_SETTING_ADAPTIVE_BATCHING   = "adaptive_batching"
+	XMEM_SETTING_MIN_BATCH_COUNT     = "min_batch_count"
+	XMEM_SETTING_MIN_BATCH_SIZE      = "min_batch_size"
+	XMEM_SETTING_LATENCY_TARGET      = "batch_latency_target"
+	XMEM_SETTING_DEAD_LETTER         = "dead_letter_enabled"
+	XMEM_SETTING_DEAD_LETTER_CAP     = "dead_letter_cap"
+	XMEM_SETTING_SETMETA_CONNS       = "setmeta_conns"
+	XMEM_SETTING_SOURCE_VBS          = "source_vbs"
 
 	//default configuration
 	default_numofretry          int           = 5
@@ -57,6 +70,7 @@ const (
 	default_backoff_wait_time    time.Duration = 10 * time.Millisecond
 	default_getMeta_readTimeout  time.Duration = time.Duration(1) * time.Second
 	default_newconn_backoff_time time.Duration = 1 * time.Second
+	default_setMetaConns                       = 1
 
 	//the maximum data (in byte) data channel can hold
 	max_datachannelSize = 10 * 1024 * 1024
@@ -76,6 +90,20 @@ var xmem_setting_defs base.SettingDefinitions = base.SettingDefinitions{SETTING_
 	XMEM_SETTING_CERTIFICATE:        base.NewSettingDef(reflect.TypeOf((*[]byte)(nil)), false),
 	XMEM_SETTING_SAN_IN_CERITICATE:  base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
 	XMEM_SETTING_INSECURESKIPVERIFY: base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	XMEM_SETTING_DEDUP_IN_BATCH:     base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	XMEM_SETTING_COMPRESSION_TYPE:   base.NewSettingDef(reflect.TypeOf((*string)(nil)), false),
+	XMEM_SETTING_CONFLICT_RESOLVER:  base.NewSettingDef(reflect.TypeOf((*string)(nil)), false),
+	XMEM_SETTING_ADAPTIVE_BATCHING:  base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	XMEM_SETTING_MIN_BATCH_COUNT:    base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	XMEM_SETTING_MIN_BATCH_SIZE:     base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	XMEM_SETTING_LATENCY_TARGET:     base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
+	SETTING_BANDWIDTH_LIMIT:         base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	SETTING_CONFLICT_LOG_ENABLED:    base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	SETTING_CONFLICT_LOG_BODY:       base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	XMEM_SETTING_DEAD_LETTER:        base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	XMEM_SETTING_DEAD_LETTER_CAP:    base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	XMEM_SETTING_SETMETA_CONNS:      base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	XMEM_SETTING_SOURCE_VBS:         base.NewSettingDef(reflect.TypeOf((*[]uint16)(nil)), false),
 
 	//only used for xmem over ssl via ns_proxy for 2.5
 	XMEM_SETTING_REMOTE_PROXY_PORT: base.NewSettingDef(reflect.TypeOf((*uint16)(nil)), false),
@@ -83,8 +111,6 @@ var xmem_setting_defs base.SettingDefinitions = base.SettingDefinitions{SETTING_
 
 var UninitializedReseverationNumber = -1
 
-type ConflictResolver func(doc_metadata_source documentMetadata, doc_metadata_target documentMetadata, source_cr_mode base.ConflictResolutionMode, logger *log.CommonLogger) bool
-
 /************************************
 /* struct bufferedMCRequest
 *************************************/
@@ -333,36 +359,38 @@ func (buf *requestBuffer) reserveSlot() (error, uint16, int) {
 	return nil, uint16(index), reservation_num
 }
 
+// releases a reserved slot, along with the request that has been put in it, if any
 func (buf *requestBuffer) cancelReservation(index uint16, reservation_num int) error {
 
 	err := buf.validatePos(index)
-	if err == nil {
-		buf.empty_slots_pos <- index
-
-		req := buf.slots[index]
-		var reservation_num int
+	if err != nil {
+		return err
+	}
 
-		req.lock.Lock()
-		defer req.lock.Unlock()
+	req := buf.slots[index]
+	req.lock.Lock()
+	defer req.lock.Unlock()
 
-		//non blocking
-		if req.req != nil {
+	// the slot may have been evicted when the response to the request was received
+	if req.reservation != reservation_num {
+		return errors.New("Cancel reservation failed, reservation number doesn't match")
+	}
 
-			if req.reservation == reservation_num {
-				resetBufferedMCRequest(req)
-			} else {
-				err = errors.New("Cancel reservation failed, reservation number doesn't match")
-			}
-		}
-		//increase sequence
-		if buf.sequences[index]+1 > 65535 {
-			buf.sequences[index] = 0
-		} else {
-			buf.sequences[index] = buf.sequences[index] + 1
-		}
+	if req.req != nil {
+		//decrease the occupied_count
+		atomic.AddInt32(&buf.occupied_count, -1)
+		<-buf.token_ch
+	}
+	resetBufferedMCRequest(req)
+	buf.empty_slots_pos <- index
 
+	//increase sequence
+	if buf.sequences[index]+1 > 65535 {
+		buf.sequences[index] = 0
+	} else {
+		buf.sequences[index] = buf.sequences[index] + 1
 	}
-	return err
+	return nil
 }
 
 func (buf *requestBuffer) enSlot(pos uint16, req *base.WrappedMCRequest, reservationNum int) error {
@@ -423,8 +451,29 @@ type xmemConfig struct {
 	san_in_certificate bool
 	respTimeout        time.Duration
 	max_read_downtime  time.Duration
-	logger             *log.CommonLogger
-	lock               sync.RWMutex
+	// whether only the latest mutation of a document in a batch is sent to target
+	dedupInBatch bool
+	// whether batch count and size are adjusted between the min values and maxCount and maxSize
+	adaptiveBatching bool
+	// lower bounds of batch count and size, in KB, with adaptive batching
+	minBatchCount int
+	minBatchSize  int
+	// latency above which adaptive batching shrinks batches
+	batchLatencyTarget time.Duration
+	// compression requested by replication settings
+	compressionType string
+	// spec of the conflict resolver used in source side conflict resolution
+	conflictResolver string
+	// whether docs that target permanently rejects are put into dead-letter store instead of failing the nozzle
+	deadLetterEnabled bool
+	// max number of entries in dead-letter store of the replication
+	deadLetterCap int
+	// source vbuckets of the pipeline on this node. only dead-lettered docs of these vbuckets are resent
+	sourceVBs map[uint16]bool
+	// number of connections for sending setMeta requests
+	setMetaConns int
+	logger       *log.CommonLogger
+	lock         sync.RWMutex
 }
 
 func newConfig(logger *log.CommonLogger) xmemConfig {
@@ -449,6 +498,7 @@ func newConfig(logger *log.CommonLogger) xmemConfig {
 		local_proxy_port:   0,
 		max_read_downtime:  default_max_read_downtime,
 		memcached_ssl_port: 0,
+		setMetaConns:       default_setMetaConns,
 		lock:               sync.RWMutex{},
 		logger:             logger,
 	}
@@ -460,6 +510,30 @@ func (config *xmemConfig) initializeConfig(settings map[string]interface{}) erro
 
 	if err == nil {
 		config.baseConfig.initializeConfig(settings)
+		if val, ok := settings[XMEM_SETTING_DEDUP_IN_BATCH]; ok {
+			config.dedupInBatch = val.(bool)
+		}
+		if val, ok := settings[XMEM_SETTING_COMPRESSION_TYPE]; ok {
+			config.compressionType = val.(string)
+		}
+		if val, ok := settings[XMEM_SETTING_CONFLICT_RESOLVER]; ok {
+			config.conflictResolver = val.(string)
+		}
+		config.initializeAdaptiveBatchingConfig(settings)
+		config.initializeDeadLetterConfig(settings)
+		if val, ok := settings[XMEM_SETTING_SOURCE_VBS]; ok {
+			config.sourceVBs = make(map[uint16]bool)
+			for _, vb := range val.([]uint16) {
+				config.sourceVBs[vb] = true
+			}
+		}
+		if val, ok := settings[XMEM_SETTING_SETMETA_CONNS]; ok {
+			config.setMetaConns = val.(int)
+		}
+		// specs created before the setting was introduced have 0 for it
+		if config.setMetaConns < 1 {
+			config.setMetaConns = default_setMetaConns
+		}
 		if val, ok := settings[XMEM_SETTING_DEMAND_ENCRYPTION]; ok {
 			config.demandEncryption = val.(bool)
 		}
@@ -676,6 +750,58 @@ func (client *xmemClient) incrementBackOffFactor() {
 	client.backoff_factor++
 }
 
+func (config *xmemConfig) initializeAdaptiveBatchingConfig(settings map[string]interface{}) {
+	if val, ok := settings[XMEM_SETTING_ADAPTIVE_BATCHING]; ok {
+		config.adaptiveBatching = val.(bool)
+	}
+	if val, ok := settings[XMEM_SETTING_MIN_BATCH_COUNT]; ok {
+		config.minBatchCount = val.(int)
+	}
+	if val, ok := settings[XMEM_SETTING_MIN_BATCH_SIZE]; ok {
+		config.minBatchSize = val.(int)
+	}
+	if val, ok := settings[XMEM_SETTING_LATENCY_TARGET]; ok {
+		config.batchLatencyTarget = val.(time.Duration)
+	}
+}
+
+func (config *xmemConfig) initializeDeadLetterConfig(settings map[string]interface{}) {
+	if val, ok := settings[XMEM_SETTING_DEAD_LETTER]; ok {
+		config.deadLetterEnabled = val.(bool)
+	}
+	if val, ok := settings[XMEM_SETTING_DEAD_LETTER_CAP]; ok {
+		config.deadLetterCap = val.(int)
+	}
+}
+
+/************************************
+/* struct setMetaConn
+*************************************/
+// a connection for sending setMeta requests, along with the buffer of the requests that have been sent on it
+// and are waiting for responses. the opaque of a request is its position in the buffer of its connection.
+// docs are assigned to connections by target vbucket, so that the mutations of a vbucket are sent in order
+type setMetaConn struct {
+	client *xmemClient
+	buf    *requestBuffer
+	// holds a token for each request waiting for response on the connection
+	receive_token_ch chan int
+	// whether snappy compression has been negotiated on the current connection. 1 means true.
+	// it is negotiated again whenever the connection is repaired
+	snappy_enabled int32
+}
+
+func (conn *setMetaConn) snappyEnabled() bool {
+	return atomic.LoadInt32(&conn.snappy_enabled) == 1
+}
+
+func (conn *setMetaConn) setSnappyEnabled(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&conn.snappy_enabled, value)
+}
+
 /************************************
 /* struct XmemNozzle
 *************************************/
@@ -693,8 +819,8 @@ type XmemNozzle struct {
 	bytes_in_dataChan int32
 	dataChan_control  chan bool
 
-	//memcached client connected to the target bucket
-	client_for_setMeta *xmemClient
+	//memcached clients connected to the target bucket
+	setMeta_conns      []*setMetaConn
 	client_for_getMeta *xmemClient
 
 	//configurable parameter
@@ -710,11 +836,10 @@ type XmemNozzle struct {
 
 	childrenWaitGrp sync.WaitGroup
 
-	//buffer for the sent, but not yet confirmed data
-	buf *requestBuffer
-
 	//conflict resolover
-	conflict_resolver ConflictResolver
+	conflict_resolver base.ConflictResolver
+	// definition of the conflict resolver in the registry, which tells whether it needs target document bodies
+	conflict_resolver_def *base.ConflictResolverDef
 
 	sender_finch      chan bool
 	receiver_finch    chan bool
@@ -731,8 +856,6 @@ type XmemNozzle struct {
 	//it is still possible that smaller seqno hasn't been received
 	maxseqno_received_map map[uint16]uint64
 
-	receive_token_ch chan int
-
 	connType base.ConnType
 
 	dataObj_recycler base.DataObjRecycler
@@ -747,6 +870,16 @@ type XmemNozzle struct {
 
 	// whether lww conflict resolution mode has been enabled
 	source_cr_mode base.ConflictResolutionMode
+
+	// decides the count and size of new batches
+	batch_sizer *adaptiveBatchSizer
+
+	// caps the bandwidth used by the outgoing nozzles of the pipeline
+	bandwidth_throttler *BandwidthThrottler
+
+	// docs that target rejected since the target docs changed after conflict resolution, which are to be resolved again
+	resolve_again_reqs []*base.WrappedMCRequest
+	resolve_again_lock sync.Mutex
 }
 
 func NewXmemNozzle(id string,
@@ -775,15 +908,13 @@ func NewXmemNozzle(id string,
 		bOpen:               true,
 		lock_bOpen:          sync.RWMutex{},
 		dataChan:            nil,
-		receive_token_ch:    nil,
-		client_for_setMeta:  nil,
+		setMeta_conns:       nil,
 		client_for_getMeta:  nil,
 		config:              newConfig(server.Logger()),
 		batches_ready_queue: nil,
 		batch:               nil,
 		batch_lock:          make(chan bool, 1),
 		childrenWaitGrp:     sync.WaitGroup{},
-		buf:                 nil,
 		receiver_finch:      make(chan bool, 1),
 		checker_finch:       make(chan bool, 1),
 		sender_finch:        make(chan bool, 1),
@@ -797,7 +928,8 @@ func NewXmemNozzle(id string,
 		maxseqno_received_map:  make(map[uint16]uint64),
 		last_ten_batches_size:  []int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
 		ext_metadata_supported: ext_metadata_supported,
-		source_cr_mode:         source_cr_mode}
+		source_cr_mode:         source_cr_mode,
+		batch_sizer:            newAdaptiveBatchSizer()}
 
 	xmem.config.connectStr = connectString
 	xmem.config.bucketName = bucketName
@@ -858,8 +990,10 @@ func (xmem *XmemNozzle) Start(settings map[string]interface{}) error {
 	xmem.childrenWaitGrp.Add(1)
 	go xmem.selfMonitor(xmem.selfMonitor_finch, &xmem.childrenWaitGrp)
 
-	xmem.childrenWaitGrp.Add(1)
-	go xmem.receiveResponse(xmem.receiver_finch, &xmem.childrenWaitGrp)
+	for _, conn := range xmem.setMeta_conns {
+		xmem.childrenWaitGrp.Add(1)
+		go xmem.receiveResponse(conn, xmem.receiver_finch, &xmem.childrenWaitGrp)
+	}
 
 	xmem.childrenWaitGrp.Add(1)
 	go xmem.check(xmem.checker_finch, &xmem.childrenWaitGrp)
@@ -867,9 +1001,6 @@ func (xmem *XmemNozzle) Start(settings map[string]interface{}) error {
 	xmem.childrenWaitGrp.Add(1)
 	go xmem.processData_sendbatch(xmem.sender_finch, &xmem.childrenWaitGrp)
 
-	//set conflict resolver
-	xmem.conflict_resolver = resolveConflict
-
 	xmem.start_time = time.Now()
 	err = xmem.Start_server()
 	xmem.SetState(common.Part_Running)
@@ -998,11 +1129,13 @@ func (xmem *XmemNozzle) processData_sendbatch(finch chan bool, waitGrp *sync.Wai
 			}
 
 			//batch get meta to find what need to be sent
-			bigDoc_noRep_map, err := xmem.batchGetMeta(batch.bigDoc_map)
+			bigDoc_noRep_map, bigDoc_target_meta_map, bigDoc_target_cas_map, err := xmem.batchGetMeta(batch.bigDoc_map)
 			if err != nil {
 				xmem.Logger().Errorf("%v batchGetMeta failed. err=%v\n", xmem.Id(), err)
 			} else {
 				batch.bigDoc_noRep_map = bigDoc_noRep_map
+				batch.bigDoc_target_meta_map = bigDoc_target_meta_map
+				batch.bigDoc_target_cas_map = bigDoc_target_cas_map
 			}
 
 			err = xmem.processBatch(batch)
@@ -1038,7 +1171,9 @@ done:
 
 func (xmem *XmemNozzle) processBatch(batch *dataBatch) error {
 	if xmem.IsOpen() {
-		xmem.buf.flowControl()
+		for _, conn := range xmem.setMeta_conns {
+			conn.buf.flowControl()
+		}
 		err := xmem.sendSetMeta_internal(batch)
 		return err
 	}
@@ -1046,7 +1181,9 @@ func (xmem *XmemNozzle) processBatch(batch *dataBatch) error {
 }
 func (xmem *XmemNozzle) onExit() {
 	//in the process of stopping, no need to report any error to replication manager anymore
-	xmem.buf.close()
+	for _, conn := range xmem.setMeta_conns {
+		conn.buf.close()
+	}
 
 	//notify the data processing routine
 	close(xmem.sender_finch)
@@ -1061,13 +1198,17 @@ func (xmem *XmemNozzle) finalCleanup() {
 	xmem.childrenWaitGrp.Wait()
 
 	//cleanup
-	xmem.client_for_setMeta.close()
+	for _, conn := range xmem.setMeta_conns {
+		if conn.client != nil {
+			conn.client.close()
+		}
+	}
 	xmem.client_for_getMeta.close()
 
 	//recycle all the bufferred MCRequest to object pool
-	if xmem.buf != nil {
-		xmem.Logger().Infof("%v recycling %v objects in buffer\n", xmem.Id(), xmem.buf.itemCountInBuffer())
-		for _, bufferredReq := range xmem.buf.slots {
+	xmem.Logger().Infof("%v recycling %v objects in buffer\n", xmem.Id(), xmem.itemCountInBuffers())
+	for _, conn := range xmem.setMeta_conns {
+		for _, bufferredReq := range conn.buf.slots {
 			if bufferredReq != nil && bufferredReq.req != nil {
 				xmem.recycleDataObj(bufferredReq.req)
 			}
@@ -1083,12 +1224,21 @@ func (xmem *XmemNozzle) finalCleanup() {
 
 }
 
-func (xmem *XmemNozzle) batchSetMetaWithRetry(batch *dataBatch, numOfRetry int) error {
-	var err error
+func (xmem *XmemNozzle) batchSetMetaWithRetry(batch *dataBatch, numOfRetry int) (err error) {
 	count := batch.count()
-	batch_replicated_count := 0
-	reqs_bytes := []byte{}
-	index_reservation_list := make([][]uint16, 51)
+	// requests are packaged and sent separately for each setMeta connection
+	conn_batches := make([]*setMetaConnBatch, len(xmem.setMeta_conns))
+	for i, conn := range xmem.setMeta_conns {
+		conn_batches[i] = &setMetaConnBatch{conn: conn}
+	}
+	defer func() {
+		if err != nil {
+			// release the slots reserved on all connections for the requests that have not been sent
+			for _, conn_batch := range conn_batches {
+				conn_batch.cancelReservations()
+			}
+		}
+	}()
 
 	for i := 0; i < count; i++ {
 		//check xmem's state, if it is already in stopping or stopped state, return
@@ -1107,52 +1257,53 @@ func (xmem *XmemNozzle) batchSetMetaWithRetry(batch *dataBatch, numOfRetry int)
 			atomic.AddUint32(&xmem.counter_waittime, uint32(time.Since(item.Start_time).Seconds()*1000))
 			needSend := needSend(item, batch, xmem.Logger())
 			if needSend == Send {
+				conn_batch := conn_batches[xmem.setMetaConnIndex(item.Req.VBucket)]
+				conn := conn_batch.conn
 
 				//blocking
-				err, index, reserv_num := xmem.buf.reserveSlot()
+				err, index, reserv_num := conn.buf.reserveSlot()
 				if err != nil {
 					return err
 				}
 				xmem.adjustRequest(item, index)
+				if target_cas, ok := batch.bigDoc_target_cas_map[item.UniqueKey]; ok {
+					// target rejects the doc with KEY_EEXISTS when the target doc no longer has the cas
+					item.Req.Cas = target_cas
+				}
 
 				//set Sendtime
 				item.Send_time = time.Now()
 
-				item_byte := item.Req.Bytes()
+				item_byte := xmem.requestBytes(conn, item)
 
-				reqs_bytes = append(reqs_bytes, item_byte...)
-				err = xmem.buf.enSlot(index, item, reserv_num)
-				reserv_num_pair := make([]uint16, 2)
-				reserv_num_pair[0] = index
-				reserv_num_pair[1] = uint16(reserv_num)
-				index_reservation_list[batch_replicated_count] = reserv_num_pair
-				batch_replicated_count++
+				conn_batch.reqs_bytes = append(conn_batch.reqs_bytes, item_byte...)
+				err = conn.buf.enSlot(index, item, reserv_num)
+				conn_batch.index_reservation_list = append(conn_batch.index_reservation_list, []int{int(index), reserv_num})
 
 				//ns_ssl_proxy choke if the batch size is too big
-				if batch_replicated_count > 50 {
+				if len(conn_batch.index_reservation_list) > 50 {
 					//send it
-					err = xmem.sendWithRetry(xmem.client_for_setMeta, numOfRetry, xmem.packageRequest(batch_replicated_count, reqs_bytes))
-
+					err = xmem.sendSetMetaConnBatch(conn_batch, numOfRetry)
 					if err != nil {
-						xmem.Logger().Errorf("%v Failed to send. err=%v\n", xmem.Id(), err)
-						for _, index_reserv_tuple := range index_reservation_list {
-							xmem.buf.cancelReservation(index_reserv_tuple[0], int(index_reserv_tuple[1]))
-						}
 						return err
 					}
-
-					batch_replicated_count = 0
-					reqs_bytes = []byte{}
-					index_reservation_list = make([][]uint16, 51)
 				}
 			} else {
-				if needSend == Not_Send_Failed_CR {
+				if needSend == Not_Send_Deduped {
+					// superseded by a later mutation of the same document in the batch
+					additionalInfo := DataDedupedEventAdditional{Seqno: item.Seqno,
+						VBucket: item.Src_vbno,
+					}
+					xmem.RaiseEvent(common.NewEvent(common.DataDeduped, nil, xmem, nil, additionalInfo))
+				} else if needSend == Not_Send_Failed_CR {
 					//lost on conflict resolution on source side
 					// this still counts as data sent
 					additionalInfo := DataFailedCRSourceEventAdditional{Seqno: item.Seqno,
 						Opcode:      encodeOpCode(item.Req.Opcode),
 						IsExpirySet: (binary.BigEndian.Uint32(item.Req.Extras[4:8]) != 0),
-						VBucket:     item.Req.VBucket,
+						VBucket:     item.Src_vbno,
+						Source_meta: xmem.config.failedCRSourceMeta(item),
+						Target_meta: batch.bigDoc_target_meta_map[item.UniqueKey],
 					}
 					xmem.RaiseEvent(common.NewEvent(common.DataFailedCRSource, nil, xmem, nil, additionalInfo))
 				}
@@ -1163,15 +1314,10 @@ func (xmem *XmemNozzle) batchSetMetaWithRetry(batch *dataBatch, numOfRetry int)
 
 	}
 
-	//send the batch in one shot
-	if batch_replicated_count > 0 {
-		err = xmem.sendWithRetry(xmem.client_for_setMeta, numOfRetry, xmem.packageRequest(batch_replicated_count, reqs_bytes))
-
+	//send the rest of the batch in one shot on each connection
+	for _, conn_batch := range conn_batches {
+		err = xmem.sendSetMetaConnBatch(conn_batch, numOfRetry)
 		if err != nil {
-			xmem.Logger().Errorf("%v Failed to send. err=%v\n", xmem.Id(), err)
-			for _, index_reserv_tuple := range index_reservation_list {
-				xmem.buf.cancelReservation(index_reserv_tuple[0], int(index_reserv_tuple[1]))
-			}
 			return err
 		}
 	}
@@ -1180,60 +1326,41 @@ func (xmem *XmemNozzle) batchSetMetaWithRetry(batch *dataBatch, numOfRetry int)
 	return err
 }
 
-//return true if doc_meta_source win; false otherwise
-func resolveConflict(doc_meta_source documentMetadata,
-	doc_meta_target documentMetadata, source_cr_mode base.ConflictResolutionMode, logger *log.CommonLogger) bool {
-	if source_cr_mode == base.CRMode_LWW && doc_meta_source.crMode == base.CRMode_LWW && doc_meta_target.crMode == base.CRMode_LWW {
-		return resolveConflictByCAS(doc_meta_source, doc_meta_target, logger)
-	} else {
-		return resolveConflictByRevSeq(doc_meta_source, doc_meta_target, logger)
-	}
-}
-
-func resolveConflictByCAS(doc_meta_source documentMetadata,
-	doc_meta_target documentMetadata, logger *log.CommonLogger) bool {
-	ret := true
-	if doc_meta_target.cas > doc_meta_source.cas {
-		ret = false
-	} else if doc_meta_target.cas == doc_meta_source.cas {
-		if doc_meta_target.revSeq > doc_meta_source.revSeq {
-			ret = false
-		} else if doc_meta_target.revSeq == doc_meta_source.revSeq {
-			//if the outgoing mutation is deletion and its revSeq and cas are the
-			//same as the target side document, it would lose the conflict resolution
-			if doc_meta_source.deletion || (doc_meta_target.expiry > doc_meta_source.expiry) {
-				ret = false
-			} else if doc_meta_target.expiry == doc_meta_source.expiry {
-				if doc_meta_target.flags >= doc_meta_source.flags {
-					ret = false
-				}
-			}
-		}
+// requests of a batch that are to be sent on a setMeta connection
+type setMetaConnBatch struct {
+	conn       *setMetaConn
+	reqs_bytes []byte
+	// index and reservation number of the buffer slots of the requests
+	index_reservation_list [][]int
+}
+
+// releases the buffer slots of the accumulated requests, and resets the accumulation
+func (conn_batch *setMetaConnBatch) cancelReservations() {
+	for _, index_reserv_tuple := range conn_batch.index_reservation_list {
+		conn_batch.conn.buf.cancelReservation(uint16(index_reserv_tuple[0]), index_reserv_tuple[1])
 	}
-	return ret
+	conn_batch.reqs_bytes = []byte{}
+	conn_batch.index_reservation_list = nil
 }
 
-func resolveConflictByRevSeq(doc_meta_source documentMetadata,
-	doc_meta_target documentMetadata, logger *log.CommonLogger) bool {
-	ret := true
-	if doc_meta_target.revSeq > doc_meta_source.revSeq {
-		ret = false
-	} else if doc_meta_target.revSeq == doc_meta_source.revSeq {
-		if doc_meta_target.cas > doc_meta_source.cas {
-			ret = false
-		} else if doc_meta_target.cas == doc_meta_source.cas {
-			//if the outgoing mutation is deletion and its revSeq and cas are the
-			//same as the target side document, it would lose the conflict resolution
-			if doc_meta_source.deletion || (doc_meta_target.expiry > doc_meta_source.expiry) {
-				ret = false
-			} else if doc_meta_target.expiry == doc_meta_source.expiry {
-				if doc_meta_target.flags >= doc_meta_source.flags {
-					ret = false
-				}
-			}
-		}
+// sends the requests accumulated for a setMeta connection, and resets the accumulation.
+// on failure, the accumulation is kept so that the slots of the requests can be released
+func (xmem *XmemNozzle) sendSetMetaConnBatch(conn_batch *setMetaConnBatch, numOfRetry int) error {
+	count := len(conn_batch.index_reservation_list)
+	if count == 0 {
+		return nil
 	}
-	return ret
+
+	xmem.bandwidth_throttler.Throttle(len(conn_batch.reqs_bytes), xmem.sender_finch)
+	err := xmem.sendWithRetry(conn_batch.conn.client, numOfRetry, xmem.packageRequest(count, conn_batch.reqs_bytes))
+	if err != nil {
+		xmem.Logger().Errorf("%v Failed to send on %v. err=%v\n", xmem.Id(), conn_batch.conn.client.name, err)
+		return err
+	}
+
+	conn_batch.reqs_bytes = []byte{}
+	conn_batch.index_reservation_list = nil
+	return nil
 }
 
 func (xmem *XmemNozzle) sendWithRetry(client *xmemClient, numOfRetry int, item_byte []byte) error {
@@ -1268,17 +1395,25 @@ func (xmem *XmemNozzle) sendSetMeta_internal(batch *dataBatch) error {
 }
 
 //batch call to memcached GetMeta command for document size larger than the optimistic threshold
-func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCRequest) (map[string]bool, error) {
+//when conflict logging is enabled, also returns the metadata of the target docs of the docs that failed conflict resolution.
+//when the conflict resolver overrides target, also returns the cas of the target docs of the docs that won conflict resolution
+func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCRequest) (map[string]bool, map[string]*base.DocumentMetadata, map[string]uint64, error) {
 	bigDoc_noRep_map := make(map[string]bool)
+	var bigDoc_target_meta_map map[string]*base.DocumentMetadata
+	var bigDoc_target_cas_map map[string]uint64
 
 	//if the bigDoc_map size is 0, return
 	if len(bigDoc_map) == 0 {
-		return bigDoc_noRep_map, nil
+		return bigDoc_noRep_map, bigDoc_target_meta_map, bigDoc_target_cas_map, nil
 	}
 
 	xmem.Logger().Debugf("%v GetMeta for %v documents\n", xmem.Id(), len(bigDoc_map))
 	respMap := make(map[string]*mc.MCResponse, xmem.config.maxCount)
 	opaque_keySeqno_map := make(map[uint32][]interface{})
+	// responses to the requests for document bodies, which are sent only when the conflict resolver needs them
+	bodyRespMap := make(map[string]*mc.MCResponse)
+	body_opaque_map := make(map[uint32]bool)
+	needsBody := xmem.conflict_resolver_def != nil && xmem.conflict_resolver_def.NeedsBody
 	receiver_fin_ch := make(chan bool, 1)
 	receiver_return_ch := make(chan bool, 1)
 
@@ -1303,13 +1438,22 @@ func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCReques
 			// request extended meta from target only when
 			// 1. extended meta is supported by replication
 			// and 2. conflict resolution mode of source document is lww
-			req := xmem.composeRequestForGetMeta(docKey, originalReq.Req.VBucket, opaque, xmem.ext_metadata_supported && originalReq.CRMode == base.CRMode_LWW)
+			req := ComposeRequestForGetMeta(docKey, originalReq.Req.VBucket, opaque, xmem.ext_metadata_supported && originalReq.CRMode == base.CRMode_LWW)
 			reqs_bytes = append(reqs_bytes, req.Bytes()...)
 			opaque_keySeqno_map[opaque] = []interface{}{docKey, originalReq.Seqno, originalReq.Req.VBucket, time.Now()}
 			opaque++
 			counter++
 			sent_key_map[docKey] = true
 
+			if needsBody {
+				bodyReq := xmem.composeRequestForGet(docKey, originalReq.Req.VBucket, opaque)
+				reqs_bytes = append(reqs_bytes, bodyReq.Bytes()...)
+				opaque_keySeqno_map[opaque] = []interface{}{docKey, originalReq.Seqno, originalReq.Req.VBucket, time.Now()}
+				body_opaque_map[opaque] = true
+				opaque++
+				counter++
+			}
+
 			if counter > 50 {
 				reqs_bytes_list = append(reqs_bytes_list, reqs_bytes)
 				batch_count_list = append(batch_count_list, counter)
@@ -1329,7 +1473,7 @@ func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCReques
 	}
 
 	//launch the receiver
-	go func(count int, finch chan bool, return_ch chan bool, opaque_keySeqno_map map[uint32][]interface{}, respMap map[string]*mc.MCResponse, logger *log.CommonLogger) {
+	go func(count int, finch chan bool, return_ch chan bool, opaque_keySeqno_map map[uint32][]interface{}, respMap map[string]*mc.MCResponse, bodyRespMap map[string]*mc.MCResponse, body_opaque_map map[uint32]bool, logger *log.CommonLogger) {
 		defer func() {
 			//handle the panic gracefully.
 			if r := recover(); r != nil {
@@ -1394,13 +1538,17 @@ func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCReques
 						vbno, ok2 := keySeqno[2].(uint16)
 						start_time, ok3 := keySeqno[3].(time.Time)
 						if ok1 && ok2 && ok3 {
-							respMap[key] = response
+							if body_opaque_map[response.Opaque] {
+								bodyRespMap[key] = response
+							} else {
+								respMap[key] = response
 
-							additionalInfo := GetMetaReceivedEventAdditional{Key: key,
-								Seqno:       seqno,
-								Commit_time: time.Since(start_time),
+								additionalInfo := GetMetaReceivedEventAdditional{Key: key,
+									Seqno:       seqno,
+									Commit_time: time.Since(start_time),
+								}
+								xmem.RaiseEvent(common.NewEvent(common.GetMetaReceived, nil, xmem, nil, additionalInfo))
 							}
-							xmem.RaiseEvent(common.NewEvent(common.GetMetaReceived, nil, xmem, nil, additionalInfo))
 
 							if response.Status != mc.SUCCESS && !isIgnorableMCError(response.Status) && !isTemporaryMCError(response.Status) && response.Status != mc.KEY_ENOENT {
 								if response.Status == mc.NOT_MY_VBUCKET {
@@ -1425,14 +1573,14 @@ func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCReques
 				}
 
 				//*count == 0 means write is still in session, can't return
-				if len(respMap) >= count {
+				if len(respMap)+len(bodyRespMap) >= count {
 					logger.Debugf("%v Expected %v response, got all", xmem.Id(), count)
 					return
 				}
 			}
 		}
 
-	}(len(opaque_keySeqno_map), receiver_fin_ch, receiver_return_ch, opaque_keySeqno_map, respMap, xmem.Logger())
+	}(len(opaque_keySeqno_map), receiver_fin_ch, receiver_return_ch, opaque_keySeqno_map, respMap, bodyRespMap, body_opaque_map, xmem.Logger())
 
 	//send the requests
 	for index, packet := range reqs_bytes_list {
@@ -1440,7 +1588,7 @@ func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCReques
 		if err != nil {
 			//kill the receiver and return
 			close(receiver_fin_ch)
-			return nil, err
+			return nil, nil, nil, err
 		}
 	}
 
@@ -1451,13 +1599,30 @@ func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCReques
 		key := string(wrappedReq.Req.Key)
 		resp, ok := respMap[key]
 		if ok && resp.Status == mc.SUCCESS {
-			doc_meta_target := xmem.decodeGetMetaResp([]byte(key), resp)
+			doc_meta_target := DecodeGetMetaResp([]byte(key), resp)
+			if bodyResp, ok := bodyRespMap[key]; ok && bodyResp.Status == mc.SUCCESS {
+				doc_meta_target.Body = bodyResp.Body
+			}
 			doc_meta_source := decodeSetMetaReq(wrappedReq)
 			if !xmem.conflict_resolver(doc_meta_source, doc_meta_target, xmem.source_cr_mode, xmem.Logger()) {
 				xmem.Logger().Debugf("%v doc %v failed source side conflict resolution. source meta=%v, target meta=%v. no need to send\n", xmem.Id(), key, doc_meta_source, doc_meta_target)
 				bigDoc_noRep_map[wrappedReq.UniqueKey] = true
+				if xmem.config.conflictLogEnabled {
+					if bigDoc_target_meta_map == nil {
+						bigDoc_target_meta_map = make(map[string]*base.DocumentMetadata)
+					}
+					bigDoc_target_meta_map[wrappedReq.UniqueKey] = &doc_meta_target
+				}
 			} else {
 				xmem.Logger().Debugf("%v doc %v succeeded source side conflict resolution. source meta=%v, target meta=%v. sending it to target\n", xmem.Id(), key, doc_meta_source, doc_meta_target)
+				// the doc overwrites the target doc that it was resolved against, but not one that has been written
+				// to target after it was read. tombstones are not compared, since target does not check their cas
+				if xmem.conflict_resolver_def != nil && xmem.conflict_resolver_def.OverridesTarget && !doc_meta_target.Deletion {
+					if bigDoc_target_cas_map == nil {
+						bigDoc_target_cas_map = make(map[string]uint64)
+					}
+					bigDoc_target_cas_map[wrappedReq.UniqueKey] = doc_meta_target.Cas
+				}
 			}
 		} else if ok && resp.Status == mc.NOT_MY_VBUCKET {
 			bigDoc_noRep_map[wrappedReq.UniqueKey] = false
@@ -1473,30 +1638,32 @@ func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCReques
 	}
 
 	xmem.Logger().Debugf("%v Done with batchGetMeta, bigDoc_noRep_map=%v\n", xmem.Id(), bigDoc_noRep_map)
-	return bigDoc_noRep_map, nil
+	return bigDoc_noRep_map, bigDoc_target_meta_map, bigDoc_target_cas_map, nil
 }
 
-func (xmem *XmemNozzle) decodeGetMetaResp(key []byte, resp *mc.MCResponse) documentMetadata {
-	ret := documentMetadata{}
-	ret.key = key
+// decodes the metadata of a document from the response to a GET_META request
+func DecodeGetMetaResp(key []byte, resp *mc.MCResponse) base.DocumentMetadata {
+	ret := base.DocumentMetadata{}
+	ret.Key = key
 	extras := resp.Extras
-	ret.deletion = (binary.BigEndian.Uint32(extras[0:4]) != 0)
-	ret.flags = binary.BigEndian.Uint32(extras[4:8])
-	ret.expiry = binary.BigEndian.Uint32(extras[8:12])
-	ret.revSeq = binary.BigEndian.Uint64(extras[12:20])
-	ret.cas = resp.Cas
+	ret.Deletion = (binary.BigEndian.Uint32(extras[0:4]) != 0)
+	ret.Flags = binary.BigEndian.Uint32(extras[4:8])
+	ret.Expiry = binary.BigEndian.Uint32(extras[8:12])
+	ret.RevSeq = binary.BigEndian.Uint64(extras[12:20])
+	ret.Cas = resp.Cas
 
 	if len(extras) > 20 {
-		ret.crMode = base.GetConflictResolutionModeFromInt(int(extras[20]))
+		ret.CRMode = base.GetConflictResolutionModeFromInt(int(extras[20]))
 	} else {
-		ret.crMode = base.CRMode_RevId
+		ret.CRMode = base.CRMode_RevId
 	}
 
 	return ret
 
 }
 
-func (xmem *XmemNozzle) composeRequestForGetMeta(key string, vb uint16, opaque uint32, reqExtMeta bool) *mc.MCRequest {
+// composes a GET_META request. conflict resolution mode is returned in extended metadata when reqExtMeta is true
+func ComposeRequestForGetMeta(key string, vb uint16, opaque uint32, reqExtMeta bool) *mc.MCRequest {
 	req := &mc.MCRequest{VBucket: vb,
 		Key:    []byte(key),
 		Opaque: opaque,
@@ -1508,22 +1675,33 @@ func (xmem *XmemNozzle) composeRequestForGetMeta(key string, vb uint16, opaque u
 	return req
 }
 
+// composes the request for the body of a document, which is needed by some conflict resolvers
+func (xmem *XmemNozzle) composeRequestForGet(key string, vb uint16, opaque uint32) *mc.MCRequest {
+	return &mc.MCRequest{VBucket: vb,
+		Key:    []byte(key),
+		Opaque: opaque,
+		Opcode: mc.GET}
+}
+
 func (xmem *XmemNozzle) sendSingleSetMeta(adjustRequest bool, item *base.WrappedMCRequest, index uint16, numOfRetry int) error {
 	var err error
-	if xmem.client_for_setMeta != nil {
+	conn := xmem.setMetaConnForVB(item.Req.VBucket)
+	client := conn.client
+	if client != nil {
 		if adjustRequest {
 			xmem.adjustRequest(item, index)
 			xmem.Logger().Debugf("key=%v\n", item.Req.Key)
 			xmem.Logger().Debugf("opcode=%v\n", item.Req.Opcode)
 		}
-		bytes := item.Req.Bytes()
+		bytes := xmem.requestBytes(conn, item)
+		xmem.bandwidth_throttler.Throttle(len(bytes), xmem.sender_finch)
 
 		for j := 0; j < numOfRetry; j++ {
-			err, rev := xmem.writeToClient(xmem.client_for_setMeta, xmem.packageRequest(1, bytes), true)
+			err, rev := xmem.writeToClient(client, xmem.packageRequest(1, bytes), true)
 			if err == nil {
 				return nil
 			} else if err == badConnectionError {
-				xmem.repairConn(xmem.client_for_setMeta, err.Error(), rev)
+				xmem.repairConn(client, err.Error(), rev)
 			}
 		}
 		return err
@@ -1584,10 +1762,22 @@ func (xmem *XmemNozzle) initializeConnection() (err error) {
 	}
 	xmem.connType = pool.ConnType()
 
-	memClient_setMeta, err := pool.GetNew()
+	for i, conn := range xmem.setMeta_conns {
+		memClient_setMeta, err := pool.GetNew()
+		if err != nil {
+			return err
+		}
 
-	if err != nil {
-		return
+		snappy_enabled, err := xmem.negotiateCompression(memClient_setMeta)
+		if err != nil {
+			memClient_setMeta.Close()
+			return err
+		}
+		conn.setSnappyEnabled(snappy_enabled)
+
+		conn.client = newXmemClient(fmt.Sprintf("client_setMeta_%v", i), xmem.config.readTimeout,
+			xmem.config.writeTimeout, memClient_setMeta,
+			xmem.config.maxRetry, xmem.config.max_read_downtime, xmem.Logger())
 	}
 
 	memClient_getMeta, err := pool.GetNew()
@@ -1595,9 +1785,6 @@ func (xmem *XmemNozzle) initializeConnection() (err error) {
 		return
 	}
 
-	xmem.client_for_setMeta = newXmemClient("client_setMeta", xmem.config.readTimeout,
-		xmem.config.writeTimeout, memClient_setMeta,
-		xmem.config.maxRetry, xmem.config.max_read_downtime, xmem.Logger())
 	xmem.client_for_getMeta = newXmemClient("client_getMeta", xmem.config.readTimeout,
 		xmem.config.writeTimeout, memClient_getMeta,
 		xmem.config.maxRetry, xmem.config.max_read_downtime, xmem.Logger())
@@ -1612,7 +1799,14 @@ func getPoolName(config xmemConfig) string {
 
 func (xmem *XmemNozzle) initNewBatch() {
 	xmem.Logger().Debugf("%v initializing a new batch", xmem.Id())
-	xmem.batch = newBatch(xmem.config.maxCount, xmem.config.maxSize, xmem.Logger())
+	xmem.config.lock.RLock()
+	dedup := xmem.config.dedupInBatch
+	xmem.config.lock.RUnlock()
+	batch_count, batch_size := xmem.batch_sizer.adjust()
+	xmem.batch = newBatch(batch_count, batch_size, xmem.Logger())
+	if dedup {
+		xmem.batch.enableDedup()
+	}
 }
 
 func (xmem *XmemNozzle) initialize(settings map[string]interface{}) error {
@@ -1620,6 +1814,13 @@ func (xmem *XmemNozzle) initialize(settings map[string]interface{}) error {
 	if err != nil {
 		return err
 	}
+
+	//set conflict resolver
+	xmem.conflict_resolver, xmem.conflict_resolver_def, err = base.NewConflictResolver(xmem.config.conflictResolver)
+	if err != nil {
+		return err
+	}
+
 	xmem.dataChan = make(chan *base.WrappedMCRequest, xmem.config.maxCount*10)
 	xmem.bytes_in_dataChan = 0
 	xmem.dataChan_control = make(chan bool, 1)
@@ -1630,11 +1831,21 @@ func (xmem *XmemNozzle) initialize(settings map[string]interface{}) error {
 	xmem.counter_received = 0
 	xmem.counter_sent = 0
 
+	xmem.configureBatchSizer()
+	updateBandwidthLimit(xmem.bandwidth_throttler, settings)
+
 	//init a new batch
 	xmem.initNewBatch()
 
-	xmem.receive_token_ch = make(chan int, xmem.config.maxCount*2)
-	xmem.buf = newReqBuffer(uint16(xmem.config.maxCount*2), uint16(float64(xmem.config.maxCount)*0.2), xmem.receive_token_ch, xmem.Logger())
+	// each setMeta connection gets a buffer of its own, so that it can have as many requests in flight as a single connection
+	xmem.setMeta_conns = make([]*setMetaConn, xmem.config.setMetaConns)
+	for i := range xmem.setMeta_conns {
+		receive_token_ch := make(chan int, xmem.config.maxCount*2)
+		xmem.setMeta_conns[i] = &setMetaConn{
+			buf:              newReqBuffer(uint16(xmem.config.maxCount*2), uint16(float64(xmem.config.maxCount)*0.2), receive_token_ch, xmem.Logger()),
+			receive_token_ch: receive_token_ch,
+		}
+	}
 
 	xmem.receiver_finch = make(chan bool, 1)
 	xmem.checker_finch = make(chan bool, 1)
@@ -1650,21 +1861,22 @@ func (xmem *XmemNozzle) initialize(settings map[string]interface{}) error {
 	return err
 }
 
-func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup) {
+// receives the responses on a setMeta connection
+func (xmem *XmemNozzle) receiveResponse(conn *setMetaConn, finch chan bool, waitGrp *sync.WaitGroup) {
 	defer waitGrp.Done()
 
 	for {
 		select {
 		case <-finch:
 			goto done
-		case <-xmem.receive_token_ch:
-			xmem.receive_token_ch <- 1
+		case <-conn.receive_token_ch:
+			conn.receive_token_ch <- 1
 			if xmem.validateRunningState() != nil {
 				xmem.Logger().Infof("%v has stopped. Exiting", xmem.Id())
 				goto done
 			}
 
-			response, err, rev := xmem.readFromClient(xmem.client_for_setMeta, true)
+			response, err, rev := xmem.readFromClient(conn.client, true)
 			if err != nil {
 				if err == PartStoppedError {
 					goto done
@@ -1672,7 +1884,7 @@ func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup
 					// if possible, log the corresponding request to facilitate debugging
 					if response != nil {
 						pos := xmem.getPosFromOpaque(response.Opaque)
-						wrappedReq, err := xmem.buf.slot(pos)
+						wrappedReq, err := conn.buf.slot(pos)
 						if err == nil && wrappedReq != nil {
 							req := wrappedReq.Req
 							if req != nil && req.Opaque == response.Opaque {
@@ -1683,26 +1895,28 @@ func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup
 					goto done
 				} else if err == badConnectionError || err == connectionClosedError {
 					xmem.Logger().Errorf("%v The connection is ruined. Repair the connection and retry.", xmem.Id())
-					xmem.repairConn(xmem.client_for_setMeta, err.Error(), rev)
+					xmem.repairConn(conn.client, err.Error(), rev)
 				}
 			} else if response == nil {
 				panic("readFromClient returned nil error and nil response")
+			} else if (response.Status == mc.KEY_EEXISTS || response.Status == mc.KEY_ENOENT) && xmem.queueForResolveAgain(conn, response) {
+				xmem.Logger().Debugf("%v target doc has changed since conflict resolution. response=%v\n", xmem.Id(), response)
 			} else if response.Status != mc.SUCCESS && !isIgnorableMCError(response.Status) {
 				if isTemporaryMCError(response.Status) {
 					// target may be overloaded. increase backoff factor to alleviate stress on target
-					xmem.client_for_setMeta.incrementBackOffFactor()
+					conn.client.incrementBackOffFactor()
 
 					// error is temporary. resend doc
 					pos := xmem.getPosFromOpaque(response.Opaque)
 					xmem.Logger().Errorf("%v Received temporary error in setMeta response. Response status=%v, err = %v, response=%v\n", xmem.Id(), response.Status.String(), err, response)
 					//resend and reset the retry=0 as retry is an indicator of network status,
 					//here we have received the response, so reset retry=0
-					_, err = xmem.buf.modSlot(pos, xmem.resendWithReset)
+					_, err = conn.buf.modSlot(pos, xmem.resendWithReset)
 				} else {
 					var req *mc.MCRequest = nil
 					var seqno uint64
 					pos := xmem.getPosFromOpaque(response.Opaque)
-					wrappedReq, err := xmem.buf.slot(pos)
+					wrappedReq, err := conn.buf.slot(pos)
 					if err == nil && wrappedReq != nil {
 						req = wrappedReq.Req
 						seqno = wrappedReq.Seqno
@@ -1723,11 +1937,14 @@ func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup
 								// this is an extremely rare scenario considering the fact that tombstones are kept for 7 days.
 								// make GOXDCR exhibit the same behavior as that of 3.x XDCR -> log the error and resend the doc
 								xmem.Logger().Errorf("%v received KEY_ENOENT error from setMeta client. response status=%v, opcode=%v, seqno=%v, req.Key=%v, req.Cas=%v, req.Extras=%v\n", xmem.Id(), response.Status, response.Opcode, seqno, string(req.Key), req.Cas, req.Extras)
-								_, err = xmem.buf.modSlot(pos, xmem.resendWithReset)
+								_, err = conn.buf.modSlot(pos, xmem.resendWithReset)
+							} else if isPermanentMCError(response.Status) && xmem.config.deadLetterEnabled {
+								// target will never accept the doc. skip it so that the nozzle can move on
+								xmem.deadLetter(conn, pos, wrappedReq, response.Status)
 							} else {
 								// for other non-temporary errors, repair connections
 								xmem.Logger().Errorf("%v received error response from setMeta client. Repairing connection. response status=%v, opcode=%v, seqno=%v, req.Key=%v, req.Cas=%v, req.Extras=%v\n", xmem.Id(), response.Status, response.Opcode, seqno, string(req.Key), req.Cas, req.Extras)
-								xmem.repairConn(xmem.client_for_setMeta, "error response from memcached", rev)
+								xmem.repairConn(conn.client, "error response from memcached", rev)
 							}
 						} else if req != nil {
 							xmem.Logger().Debugf("%v Got the response, response.Opaque=%v, req.Opaque=%v\n", xmem.Id(), response.Opaque, req.Opaque)
@@ -1739,7 +1956,7 @@ func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup
 			} else {
 				//raiseEvent
 				pos := xmem.getPosFromOpaque(response.Opaque)
-				wrappedReq, err := xmem.buf.slot(pos)
+				wrappedReq, err := conn.buf.slot(pos)
 				if err != nil {
 					xmem.Logger().Errorf("%v xmem buffer is in invalid state", xmem.Id())
 					xmem.handleGeneralError(errors.New("xmem buffer is in invalid state"))
@@ -1759,22 +1976,30 @@ func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup
 				if req != nil && req.Opaque == response.Opaque {
 					xmem.Logger().Debugf("%v Got the response, key=%s, status=%v\n", xmem.Id(), req.Key, response.Status)
 
+					uncompressed_req_size := req.Size()
+					req_size := uncompressed_req_size
+					if wrappedReq.Compressed_size > 0 {
+						req_size = wrappedReq.Compressed_size
+					}
+
 					additionalInfo := DataSentEventAdditional{Seqno: seqno,
-						IsOptRepd:      xmem.optimisticRep(req),
-						Opcode:         req.Opcode,
-						IsExpirySet:    (binary.BigEndian.Uint32(req.Extras[4:8]) != 0),
-						VBucket:        req.VBucket,
-						Req_size:       req.Size(),
-						Commit_time:    committing_time,
-						Resp_wait_time: resp_wait_time,
+						IsOptRepd:             xmem.optimisticRepBySize(uncompressed_req_size),
+						Opcode:                req.Opcode,
+						IsExpirySet:           (binary.BigEndian.Uint32(req.Extras[4:8]) != 0),
+						VBucket:               wrappedReq.Src_vbno,
+						Req_size:              req_size,
+						Uncompressed_req_size: uncompressed_req_size,
+						Commit_time:           committing_time,
+						Resp_wait_time:        resp_wait_time,
 					}
 					xmem.RaiseEvent(common.NewEvent(common.DataSent, nil, xmem, nil, additionalInfo))
 
 					//feedback the most current commit_time to xmem.config.respTimeout
 					xmem.adjustRespTimeout(resp_wait_time)
+					xmem.batch_sizer.recordResponse(resp_wait_time, committing_time)
 
 					//empty the slot in the buffer
-					if xmem.buf.evictSlot(pos) != nil {
+					if conn.buf.evictSlot(pos) != nil {
 						panic(fmt.Sprintf("Failed to evict slot %d\n", pos))
 					}
 
@@ -1793,7 +2018,89 @@ func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup
 	}
 
 done:
-	xmem.Logger().Infof("%v receiveResponse exits\n", xmem.Id())
+	xmem.Logger().Infof("%v receiveResponse for %v exits\n", xmem.Id(), conn.client.name)
+}
+
+// puts a doc that target has permanently rejected into dead-letter store and removes it from buffer.
+// fails the nozzle when dead-letter store is full, or when the doc cannot be persisted in it, in which case
+// the doc is not counted as dead-lettered
+func (xmem *XmemNozzle) deadLetter(conn *setMetaConn, pos uint16, wrappedReq *base.WrappedMCRequest, resp_status mc.Status) {
+	req := wrappedReq.Req
+	entry := dead_letter.NewEntry(xmem.topic, xmem.Id(), wrappedReq, resp_status.String())
+	err := dead_letter.Add(entry, xmem.config.deadLetterCap)
+	if err == dead_letter.ErrorStoreFull {
+		xmem.Logger().Errorf("%v received permanent error from setMeta client and dead-letter store is full. response status=%v, seqno=%v, req.Key=%v\n", xmem.Id(), resp_status, wrappedReq.Seqno, string(req.Key))
+		xmem.handleGeneralError(fmt.Errorf("Number of docs in dead-letter store has reached dead_letter_cap of %v", xmem.config.deadLetterCap))
+		return
+	} else if err != nil {
+		xmem.Logger().Errorf("%v received permanent error from setMeta client and failed to put doc into dead-letter store. response status=%v, seqno=%v, req.Key=%v, err=%v\n", xmem.Id(), resp_status, wrappedReq.Seqno, string(req.Key), err)
+		xmem.handleGeneralError(err)
+		return
+	}
+	xmem.Logger().Errorf("%v received permanent error from setMeta client. Put doc into dead-letter store. response status=%v, opcode=%v, seqno=%v, req.Key=%v\n", xmem.Id(), resp_status, req.Opcode, wrappedReq.Seqno, string(req.Key))
+
+	additionalInfo := DataDeadLetteredEventAdditional{Seqno: wrappedReq.Seqno,
+		VBucket: wrappedReq.Src_vbno,
+	}
+	xmem.RaiseEvent(common.NewEvent(common.DataDeadLettered, nil, xmem, nil, additionalInfo))
+
+	if conn.buf.evictSlot(pos) != nil {
+		panic(fmt.Sprintf("Failed to evict slot %d\n", pos))
+	}
+	xmem.recycleDataObj(wrappedReq)
+}
+
+// a doc that won conflict resolution of a resolver that overrides target is sent with the cas of the target doc that
+// it was resolved against. target rejects it with KEY_EEXISTS, or KEY_ENOENT, when the target doc has been changed,
+// or deleted, since, e.g., by an application on target. the doc is then removed from buffer and queued to be
+// resolved again against the current target doc. returns false when the response is not for such a doc
+func (xmem *XmemNozzle) queueForResolveAgain(conn *setMetaConn, response *mc.MCResponse) bool {
+	pos := xmem.getPosFromOpaque(response.Opaque)
+	wrappedReq, err := conn.buf.slot(pos)
+	if err != nil || wrappedReq == nil || wrappedReq.Req == nil || wrappedReq.Req.Opaque != response.Opaque || wrappedReq.Req.Cas == 0 {
+		return false
+	}
+
+	if conn.buf.evictSlot(pos) != nil {
+		panic(fmt.Sprintf("Failed to evict slot %d\n", pos))
+	}
+	// conflict resolution takes the cas of the source doc from the request
+	wrappedReq.Req.Cas = binary.BigEndian.Uint64(wrappedReq.Req.Extras[16:24])
+
+	xmem.resolve_again_lock.Lock()
+	defer xmem.resolve_again_lock.Unlock()
+	xmem.resolve_again_reqs = append(xmem.resolve_again_reqs, wrappedReq)
+	return true
+}
+
+// adds the docs queued by queueForResolveAgain to the batch, so that they go through conflict resolution again
+func (xmem *XmemNozzle) resolveAgain() {
+	xmem.resolve_again_lock.Lock()
+	reqs := xmem.resolve_again_reqs
+	xmem.resolve_again_reqs = nil
+	xmem.resolve_again_lock.Unlock()
+
+	if len(reqs) == 0 {
+		return
+	}
+	xmem.Logger().Infof("%v resolving conflicts of %v docs again since their target docs have changed\n", xmem.Id(), len(reqs))
+	for _, req := range reqs {
+		xmem.accumuBatch(req)
+	}
+}
+
+// resends the dead-lettered docs of the replication that have been queued for retry. any outgoing nozzle of the
+// pipeline can resend them, since docs are sent to target vbuckets regardless of the nozzles. only docs of source
+// vbuckets of the pipeline are resent, since events of other vbuckets cannot be handled by the pipeline
+func (xmem *XmemNozzle) retryDeadLetters() {
+	entries := dead_letter.TakeRetries(xmem.topic, xmem.config.sourceVBs)
+	if len(entries) == 0 {
+		return
+	}
+	xmem.Logger().Infof("%v resending %v docs from dead-letter store\n", xmem.Id(), len(entries))
+	for _, entry := range entries {
+		xmem.accumuBatch(entry.Request())
+	}
 }
 
 func (xmem *XmemNozzle) handleVBError(vbno uint16, err error) {
@@ -1809,6 +2116,11 @@ func (xmem *XmemNozzle) adjustRespTimeout(committing_time time.Duration) {
 	xmem.adjustMaxIdleCount(factor)
 }
 
+func (xmem *XmemNozzle) configureBatchSizer() {
+	xmem.batch_sizer.configure(xmem.config.adaptiveBatching, xmem.config.minBatchCount, xmem.config.maxCount,
+		xmem.config.minBatchSize, xmem.config.maxSize, xmem.config.batchLatencyTarget)
+}
+
 func (xmem *XmemNozzle) adjustMaxIdleCount(factor float64) {
 	new_maxIdleCount := int(float64(xmem.config.maxIdleCount) * factor)
 	xmem.config.maxIdleCount = int(math.Max(float64(new_maxIdleCount), float64(xmem.config.maxIdleCount)))
@@ -1842,6 +2154,18 @@ func isFatalMCError(resp_status mc.Status) bool {
 	}
 }
 
+// check if memcached response status indicates that target will never accept the request, e.g., since the doc is too big
+func isPermanentMCError(resp_status mc.Status) bool {
+	switch resp_status {
+	case mc.E2BIG:
+		fallthrough
+	case mc.EINVAL:
+		return true
+	default:
+		return false
+	}
+}
+
 // check if memcached response status indicates error of temporary nature, which requires retrying corresponding requests
 func isTemporaryMCError(resp_status mc.Status) bool {
 	switch resp_status {
@@ -1870,10 +2194,13 @@ func isIgnorableMCError(resp_status mc.Status) bool {
 
 func (xmem *XmemNozzle) getMaxIdleCount() int {
 	max_idle_count := xmem.config.maxIdleCount
-	backoff_factor := math.Max(float64(xmem.client_for_getMeta.getBackOffFactor()), float64(xmem.client_for_setMeta.getBackOffFactor()))
+	backoff_factor := float64(xmem.client_for_getMeta.getBackOffFactor())
+	for _, conn := range xmem.setMeta_conns {
+		backoff_factor = math.Max(backoff_factor, float64(conn.client.getBackOffFactor()))
+	}
 	backoff_factor = math.Min(float64(10), backoff_factor)
 
-	//if client_for_getMeta.backoff_factor > 0 or client_for_setMeta.backoff_factor > 0, it means the target system is possibly under load, need to be more patient before
+	//if client_for_getMeta.backoff_factor > 0 or backoff_factor of any setMeta client > 0, it means the target system is possibly under load, need to be more patient before
 	//declare the stuckness.
 	if int(backoff_factor) > 1 {
 		max_idle_count = xmem.config.maxIdleCount * int(backoff_factor)
@@ -1905,11 +2232,9 @@ func (xmem *XmemNozzle) selfMonitor(finch chan bool, waitGrp *sync.WaitGroup) {
 				goto done
 			}
 			received_count = atomic.LoadUint32(&xmem.counter_received)
-			buffer_count := xmem.buf.itemCountInBuffer()
+			buffer_count := xmem.itemCountInBuffers()
 			xmem_id := xmem.Id()
 			isOpen := xmem.IsOpen()
-			buffer_size := xmem.buf.bufferSize()
-			empty_slots_pos := xmem.buf.empty_slots_pos
 			batches_ready_queue := xmem.batches_ready_queue
 			dataChan := xmem.dataChan
 			xmem_count_sent := atomic.LoadUint32(&xmem.counter_sent)
@@ -1917,7 +2242,7 @@ func (xmem *XmemNozzle) selfMonitor(finch chan bool, waitGrp *sync.WaitGroup) {
 
 			if xmem_count_sent == sent_count && int(buffer_count) == resp_waitingConfirm_count &&
 				(len(xmem.dataChan) > 0 || buffer_count != 0) &&
-				repairCount_setMeta == xmem.client_for_setMeta.repairCount() &&
+				repairCount_setMeta == xmem.setMetaRepairCount() &&
 				repairCount_getMeta == xmem.client_for_getMeta.repairCount() {
 				freeze_counter++
 			} else {
@@ -1925,26 +2250,35 @@ func (xmem *XmemNozzle) selfMonitor(finch chan bool, waitGrp *sync.WaitGroup) {
 			}
 			sent_count = xmem_count_sent
 			resp_waitingConfirm_count = int(buffer_count)
-			repairCount_setMeta = xmem.client_for_setMeta.repairCount()
+			repairCount_setMeta = xmem.setMetaRepairCount()
 			repairCount_getMeta = xmem.client_for_getMeta.repairCount()
 			if count == 10 {
 				xmem.Logger().Debugf("%v- freeze_counter=%v, xmem.counter_sent=%v, len(xmem.dataChan)=%v, receive_count-%v, cur_batch_count=%v\n", xmem_id, freeze_counter, xmem_count_sent, len(dataChan), received_count, xmem.batch.count())
-				xmem.Logger().Debugf("%v open=%v checking..., %v item unsent, %v items waiting for response, %v batches ready\n", xmem_id, isOpen, len(xmem.dataChan), int(buffer_size)-len(empty_slots_pos), len(batches_ready_queue))
+				xmem.Logger().Debugf("%v open=%v checking..., %v item unsent, %v items waiting for response, %v batches ready\n", xmem_id, isOpen, len(xmem.dataChan), buffer_count, len(batches_ready_queue))
 				count = 0
 			}
 			max_idle_count := xmem.getMaxIdleCount()
 			if freeze_counter > max_idle_count {
-				xmem.Logger().Errorf("%v hasn't sent any item out for %v ticks, %v data in queue, flowcontrol=%v, con_retry_limit=%v, backoff_factor for client_setMeta is %v, backoff_factor for client_getMeta is %v", xmem_id, max_idle_count, len(dataChan), buffer_count <= xmem.buf.notify_threshold, xmem.client_for_setMeta.continuous_write_failure_counter, xmem.client_for_setMeta.getBackOffFactor(), xmem.client_for_getMeta.getBackOffFactor())
-				xmem.Logger().Infof("%v open=%v checking..., %v item unsent, received %v items, sent %v items, %v items waiting for response, %v batches ready\n", xmem_id, isOpen, len(dataChan), received_count, xmem_count_sent, int(buffer_size)-len(empty_slots_pos), len(batches_ready_queue))
+				xmem.Logger().Errorf("%v hasn't sent any item out for %v ticks, %v data in queue, backoff_factor for client_getMeta is %v", xmem_id, max_idle_count, len(dataChan), xmem.client_for_getMeta.getBackOffFactor())
+				for _, conn := range xmem.setMeta_conns {
+					xmem.Logger().Errorf("%v flowcontrol=%v, con_retry_limit=%v, backoff_factor=%v for %v", xmem_id, conn.buf.itemCountInBuffer() <= conn.buf.notify_threshold, conn.client.continuous_write_failure_counter, conn.client.getBackOffFactor(), conn.client.name)
+				}
+				xmem.Logger().Infof("%v open=%v checking..., %v item unsent, received %v items, sent %v items, %v items waiting for response, %v batches ready\n", xmem_id, isOpen, len(dataChan), received_count, xmem_count_sent, buffer_count, len(batches_ready_queue))
 				//				utils.DumpStack(xmem.Logger())
 				//the connection might not be healthy, it should not go back to connection pool
-				xmem.client_for_setMeta.markConnUnhealthy()
+				for _, conn := range xmem.setMeta_conns {
+					conn.client.markConnUnhealthy()
+				}
 				xmem.client_for_getMeta.markConnUnhealthy()
 				xmem.handleGeneralError(errors.New("Xmem is stuck"))
 				goto done
 			}
+			xmem.retryDeadLetters()
+			xmem.resolveAgain()
 		case <-statsTicker.C:
-			xmem.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, xmem, nil, []int{len(xmem.dataChan), xmem.bytesInDataChan()}))
+			// effective batch count and size are reported along with queue stats
+			batch_count, batch_size := xmem.batch_sizer.current()
+			xmem.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, xmem, nil, []int{len(xmem.dataChan), xmem.bytesInDataChan(), batch_count, batch_size}))
 		}
 	}
 done:
@@ -1964,13 +2298,15 @@ func (xmem *XmemNozzle) check(finch chan bool, waitGrp *sync.WaitGroup) {
 			if xmem.validateRunningState() != nil {
 				goto done
 			}
-			size := xmem.buf.bufferSize()
 			timeoutCheckFunc := xmem.checkTimeout
-			for i := 0; i < int(size); i++ {
-				_, err := xmem.buf.modSlot(uint16(i), timeoutCheckFunc)
-				if err != nil {
-					xmem.Logger().Errorf("%v Failed to check timeout %v\n", xmem.Id(), err)
-					break
+			for _, conn := range xmem.setMeta_conns {
+				size := conn.buf.bufferSize()
+				for i := 0; i < int(size); i++ {
+					_, err := conn.buf.modSlot(uint16(i), timeoutCheckFunc)
+					if err != nil {
+						xmem.Logger().Errorf("%v Failed to check timeout %v\n", xmem.Id(), err)
+						break
+					}
 				}
 			}
 
@@ -1991,7 +2327,8 @@ func (xmem *XmemNozzle) checkTimeout(req *bufferedMCRequest, pos uint16) (bool,
 			xmem.Id(), req.req.Req.Key, req.num_of_retry, xmem.config.maxRetry))
 		xmem.Logger().Error(err.Error())
 
-		xmem.repairConn(xmem.client_for_setMeta, err.Error(), xmem.client_for_setMeta.repairCount())
+		client := xmem.setMetaConnForVB(req.req.Req.VBucket).client
+		xmem.repairConn(client, err.Error(), client.repairCount())
 		return false, err
 	}
 
@@ -2063,7 +2400,31 @@ func (xmem *XmemNozzle) adjustRequest(req *base.WrappedMCRequest, index uint16)
 	mc_req := req.Req
 	mc_req.Opcode = encodeOpCode(mc_req.Opcode)
 	mc_req.Cas = 0
-	mc_req.Opaque = xmem.getOpaque(index, xmem.buf.sequences[int(index)])
+	mc_req.Opaque = xmem.getOpaque(index, xmem.setMetaConnForVB(mc_req.VBucket).buf.sequences[int(index)])
+	if xmem.conflict_resolver_def != nil && xmem.conflict_resolver_def.OverridesTarget {
+		// docs are sent only when the resolver has picked them, and target must not reject them in its own resolution
+		setWithMetaOptions(mc_req, base.SkipConflictResolutionFlag)
+	}
+}
+
+// adds the options to the extras of SET_WITH_META and DELETE_WITH_META requests. options are placed after cas,
+// and before the length of extended metadata when it is present
+func setWithMetaOptions(req *mc.MCRequest, options uint32) {
+	switch len(req.Extras) {
+	case 24:
+		extras := make([]byte, 28)
+		copy(extras, req.Extras)
+		binary.BigEndian.PutUint32(extras[24:28], options)
+		req.Extras = extras
+	case 26:
+		extras := make([]byte, 30)
+		copy(extras, req.Extras[:24])
+		binary.BigEndian.PutUint32(extras[24:28], options)
+		copy(extras[28:30], req.Extras[24:26])
+		req.Extras = extras
+	case 28, 30:
+		binary.BigEndian.PutUint32(req.Extras[24:28], binary.BigEndian.Uint32(req.Extras[24:28])|options)
+	}
 }
 
 func (xmem *XmemNozzle) getOpaque(index, sequence uint16) uint32 {
@@ -2099,7 +2460,8 @@ func (xmem *XmemNozzle) StatusSummary() string {
 		if counter_sent > 0 {
 			avg_wait_time = float64(atomic.LoadUint32(&xmem.counter_waittime)) / float64(counter_sent)
 		}
-		return fmt.Sprintf("%v state =%v connType=%v received %v items, sent %v items, %v items waiting to confirm, %v in queue, %v in current batch, avg wait time is %vms, size of last ten batches processed %v, len(batches_ready_queue)=%v\n", xmem.Id(), xmem.State(), connType, atomic.LoadUint32(&xmem.counter_received), atomic.LoadUint32(&xmem.counter_sent), xmem.buf.itemCountInBuffer(), len(xmem.dataChan), xmem.batch.count(), avg_wait_time, xmem.last_ten_batches_size, len(xmem.batches_ready_queue))
+		batch_count, batch_size := xmem.batch_sizer.current()
+		return fmt.Sprintf("%v state =%v connType=%v received %v items, sent %v items, %v items waiting to confirm, %v in queue, %v in current batch, avg wait time is %vms, size of last ten batches processed %v, len(batches_ready_queue)=%v, effective batch count=%v, effective batch size=%vKB\n", xmem.Id(), xmem.State(), connType, atomic.LoadUint32(&xmem.counter_received), atomic.LoadUint32(&xmem.counter_sent), xmem.itemCountInBuffers(), len(xmem.dataChan), xmem.batch.count(), avg_wait_time, xmem.last_ten_batches_size, len(xmem.batches_ready_queue), batch_count, batch_size)
 	} else {
 		return fmt.Sprintf("%v state =%v ", xmem.Id(), xmem.State())
 	}
@@ -2117,11 +2479,20 @@ func (xmem *XmemNozzle) handleGeneralError(err error) {
 
 func (xmem *XmemNozzle) optimisticRep(req *mc.MCRequest) bool {
 	if req != nil {
-		return req.Size() < xmem.config.optiRepThreshold
+		return xmem.optimisticRepBySize(req.Size())
 	}
 	return true
 }
 
+// docs are sent without source side conflict resolution when they are below optimistic replication threshold,
+// unless the conflict resolver needs to be applied to all docs
+func (xmem *XmemNozzle) optimisticRepBySize(size int) bool {
+	if xmem.conflict_resolver_def != nil && xmem.conflict_resolver_def.AllDocs {
+		return false
+	}
+	return size < xmem.config.optiRepThreshold
+}
+
 func (xmem *XmemNozzle) getConn(client *xmemClient, readTimeout bool, writeTimeout bool) (io.ReadWriteCloser, int, error) {
 	err := xmem.validateRunningState()
 	if err != nil {
@@ -2249,10 +2620,22 @@ func (xmem *XmemNozzle) repairConn(client *xmemClient, reason string, rev int) e
 	for {
 		memClient, err := pool.GetNew()
 
+		setMeta_conn := xmem.setMetaConnForClient(client)
+		if err == nil && setMeta_conn != nil {
+			// compression needs to be negotiated again on the new connection, which may not support it
+			var snappy_enabled bool
+			snappy_enabled, err = xmem.negotiateCompression(memClient)
+			if err != nil {
+				memClient.Close()
+			} else {
+				setMeta_conn.setSnappyEnabled(snappy_enabled)
+			}
+		}
+
 		if err == nil {
 			repaired := client.repairConn(memClient, rev, xmem.Id())
-			if repaired && client == xmem.client_for_setMeta {
-				go xmem.onSetMetaConnRepaired()
+			if repaired && setMeta_conn != nil {
+				go xmem.onSetMetaConnRepaired(setMeta_conn)
 			}
 
 			xmem.Logger().Infof("%v - The connection for %v has been repaired\n", xmem.Id(), client.name)
@@ -2276,11 +2659,12 @@ func (xmem *XmemNozzle) repairConn(client *xmemClient, reason string, rev int) e
 	return nil
 }
 
-func (xmem *XmemNozzle) onSetMetaConnRepaired() error {
-	size := xmem.buf.bufferSize()
+// resends the requests that were waiting for response on the repaired connection
+func (xmem *XmemNozzle) onSetMetaConnRepaired(conn *setMetaConn) error {
+	size := conn.buf.bufferSize()
 	count := 0
 	for i := 0; i < int(size); i++ {
-		sent, err := xmem.buf.modSlot(uint16(i), xmem.resendForNewConn)
+		sent, err := conn.buf.modSlot(uint16(i), xmem.resendForNewConn)
 		if err != nil {
 			return err
 		}
@@ -2288,15 +2672,115 @@ func (xmem *XmemNozzle) onSetMetaConnRepaired() error {
 			count++
 		}
 	}
-	xmem.Logger().Infof("%v - %v unresponded items are resent\n", xmem.Id(), count)
+	xmem.Logger().Infof("%v - %v unresponded items are resent on %v\n", xmem.Id(), count, conn.client.name)
 	return nil
 
 }
 
+// docs of a vbucket always go through the same setMeta connection, so that they are applied on target in order
+func (xmem *XmemNozzle) setMetaConnIndex(vbno uint16) int {
+	return int(vbno) % len(xmem.setMeta_conns)
+}
+
+func (xmem *XmemNozzle) setMetaConnForVB(vbno uint16) *setMetaConn {
+	return xmem.setMeta_conns[xmem.setMetaConnIndex(vbno)]
+}
+
+// returns the setMeta connection that uses the client, or nil if the client is not a setMeta one
+func (xmem *XmemNozzle) setMetaConnForClient(client *xmemClient) *setMetaConn {
+	for _, conn := range xmem.setMeta_conns {
+		if conn.client == client {
+			return conn
+		}
+	}
+	return nil
+}
+
+// number of requests waiting for response on all setMeta connections
+func (xmem *XmemNozzle) itemCountInBuffers() int {
+	count := 0
+	for _, conn := range xmem.setMeta_conns {
+		count += int(conn.buf.itemCountInBuffer())
+	}
+	return count
+}
+
+func (xmem *XmemNozzle) setMetaRepairCount() int {
+	count := 0
+	for _, conn := range xmem.setMeta_conns {
+		count += conn.client.repairCount()
+	}
+	return count
+}
+
 func (xmem *XmemNozzle) ConnStr() string {
 	return xmem.config.connectStr
 }
 
+// when snappy compression is requested, sends HELO on a setMeta connection to find out whether target supports it.
+// returns whether snappy has been negotiated on the connection
+func (xmem *XmemNozzle) negotiateCompression(client *mcc.Client) (bool, error) {
+	if xmem.config.compressionType != metadata.CompressionTypeSnappy {
+		return false, nil
+	}
+	if xmem.connType == base.SSLOverProxy {
+		// requests are wrapped for ssl proxy, which does not forward HELO
+		xmem.Logger().Infof("%v snappy compression is not supported over ssl proxy. Documents will be sent uncompressed.", xmem.Id())
+		return false, nil
+	}
+
+	features := []uint16{base.HELOFeatureDatatype, base.HELOFeatureSnappy}
+	body := make([]byte, 2*len(features))
+	for i, feature := range features {
+		binary.BigEndian.PutUint16(body[2*i:2*i+2], feature)
+	}
+	req := &mc.MCRequest{Opcode: mc.HELLO,
+		Key:  []byte(base.HELOAgentName),
+		Body: body}
+
+	resp, err := client.Send(req)
+	if err != nil {
+		if _, ok := err.(*mc.MCResponse); ok {
+			// HELO is not supported by target
+			xmem.Logger().Infof("%v target does not support HELO. Documents will be sent uncompressed. resp=%v", xmem.Id(), err)
+			return false, nil
+		}
+		xmem.Logger().Errorf("%v failed to send HELO. err=%v", xmem.Id(), err)
+		return false, err
+	}
+
+	for i := 0; i+2 <= len(resp.Body); i += 2 {
+		if binary.BigEndian.Uint16(resp.Body[i:i+2]) == base.HELOFeatureSnappy {
+			xmem.Logger().Infof("%v snappy compression has been negotiated with target", xmem.Id())
+			return true, nil
+		}
+	}
+	xmem.Logger().Infof("%v target does not support snappy compression. Documents will be sent uncompressed.", xmem.Id())
+	return false, nil
+}
+
+// returns the bytes of the request to be sent on the connection. the body is compressed when snappy has been
+// negotiated on the connection and the body is large enough. the request itself is left uncompressed,
+// so that it can be resent on a repaired connection that does not support snappy
+func (xmem *XmemNozzle) requestBytes(conn *setMetaConn, item *base.WrappedMCRequest) []byte {
+	req := item.Req
+	item.Compressed_size = 0
+	if !conn.snappyEnabled() || req.DataType&base.SnappyDataType != 0 || len(req.Body) < base.CompressionThreshold {
+		return req.Bytes()
+	}
+
+	compressed := snappy.Encode(nil, req.Body)
+	if len(compressed) >= len(req.Body) {
+		// incompressible
+		return req.Bytes()
+	}
+	compressed_req := *req
+	compressed_req.Body = compressed
+	compressed_req.DataType |= base.SnappyDataType
+	item.Compressed_size = compressed_req.Size()
+	return compressed_req.Bytes()
+}
+
 func (xmem *XmemNozzle) packageRequest(count int, reqs_bytes []byte) []byte {
 	if xmem.ConnType() == base.SSLOverProxy {
 		bytes := make([]byte, 8+len(reqs_bytes))
@@ -2318,9 +2802,24 @@ func (xmem *XmemNozzle) UpdateSettings(settings map[string]interface{}) error {
 		return err
 	}
 	xmem.config.optiRepThreshold = optimisticReplicationThreshold
+	if val, ok := settings[XMEM_SETTING_DEDUP_IN_BATCH]; ok {
+		// takes effect from the next batch
+		xmem.config.dedupInBatch = val.(bool)
+	}
+	if _, ok := settings[XMEM_SETTING_ADAPTIVE_BATCHING]; ok {
+		// takes effect from the next batch
+		xmem.config.initializeAdaptiveBatchingConfig(settings)
+		xmem.configureBatchSizer()
+	}
+	xmem.config.initializeDeadLetterConfig(settings)
+	updateBandwidthLimit(xmem.bandwidth_throttler, settings)
 	return nil
 }
 
+func (xmem *XmemNozzle) SetBandwidthThrottler(throttler *BandwidthThrottler) {
+	xmem.bandwidth_throttler = throttler
+}
+
 func (xmem *XmemNozzle) dataChanControl() {
 	if xmem.bytesInDataChan() < max_datachannelSize {
 		select {
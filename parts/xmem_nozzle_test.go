@@ -0,0 +1,572 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	base "github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/dead_letter"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"github.com/couchbase/goxdcr/tests/fake_memcached"
+	"github.com/golang/snappy"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testXmemBucket   = "target"
+	testXmemPassword = "s3cret"
+)
+
+// counts the events raised by a nozzle
+type testEventListener struct {
+	counts map[common.ComponentEventType]int
+	lock   sync.Mutex
+}
+
+func newTestEventListener(part common.Part, eventTypes ...common.ComponentEventType) *testEventListener {
+	listener := &testEventListener{counts: make(map[common.ComponentEventType]int)}
+	for _, eventType := range eventTypes {
+		part.RegisterComponentEventListener(eventType, listener)
+	}
+	return listener
+}
+
+func (listener *testEventListener) OnEvent(event *common.Event) {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	listener.counts[event.EventType]++
+}
+
+func (listener *testEventListener) count(eventType common.ComponentEventType) int {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	return listener.counts[eventType]
+}
+
+func newTestFakeMemcached(t *testing.T, security fake_memcached.Security) *fake_memcached.Server {
+	server, err := fake_memcached.NewServer(testXmemBucket, testXmemPassword, security)
+	if err != nil {
+		t.Fatalf("failed to start fake memcached. err=%v", err)
+	}
+	return server
+}
+
+// starts an xmem nozzle that replicates to the fake memcached. each test uses a connection pool of its own
+func startTestXmemNozzle(t *testing.T, connectStr string, extraSettings map[string]interface{}) (*XmemNozzle, *testEventListener) {
+	return startTestXmemNozzleWithId(t, "xmem_"+t.Name(), connectStr, extraSettings)
+}
+
+func startTestXmemNozzleWithId(t *testing.T, id string, connectStr string, extraSettings map[string]interface{}) (*XmemNozzle, *testEventListener) {
+	xmem := NewXmemNozzle(id, "test", t.Name(), 2, connectStr, testXmemBucket, testXmemPassword,
+		nil, false, base.CRMode_RevId, log.DefaultLoggerContext)
+	listener := newTestEventListener(xmem, common.DataSent, common.VBErrorEncountered, common.DataDeadLettered, common.ErrorEncountered)
+	// shorten the response timeout, which is not configurable through settings, so that timed out requests are resent quickly
+	xmem.config.respTimeout = 100 * time.Millisecond
+
+	settings := map[string]interface{}{
+		SETTING_BATCHCOUNT:         10,
+		SETTING_BATCHSIZE:          1024 * 1024,
+		SETTING_OPTI_REP_THRESHOLD: 1024,
+		SETTING_STATS_INTERVAL:     1000,
+	}
+	for key, val := range extraSettings {
+		settings[key] = val
+	}
+	if err := xmem.Start(settings); err != nil {
+		t.Fatalf("failed to start xmem nozzle. err=%v", err)
+	}
+	return xmem, listener
+}
+
+func stopTestXmemNozzle(xmem *XmemNozzle) {
+	xmem.Stop()
+	base.ConnPoolMgr().RemovePool(getPoolName(xmem.config))
+}
+
+func newTestXmemRequest(key string, vbno uint16, seqno uint64, body []byte) *base.WrappedMCRequest {
+	extras := make([]byte, 24)
+	// revSeq and cas
+	binary.BigEndian.PutUint64(extras[8:16], seqno)
+	binary.BigEndian.PutUint64(extras[16:24], seqno)
+	req := &base.WrappedMCRequest{
+		Seqno:      seqno,
+		Src_vbno:   vbno,
+		Start_time: time.Now(),
+		Req: &mc.MCRequest{Opcode: mc.UPR_MUTATION,
+			VBucket: vbno,
+			Key:     []byte(key),
+			Body:    body,
+			Cas:     seqno,
+			Extras:  extras,
+		},
+	}
+	req.ConstructUniqueKey()
+	return req
+}
+
+func sendTestXmemRequests(t *testing.T, xmem *XmemNozzle, count int, body []byte) {
+	for i := 0; i < count; i++ {
+		if err := xmem.Receive(newTestXmemRequest(fmt.Sprintf("doc%v", i), uint16(i%4), uint64(i+1), body)); err != nil {
+			t.Fatalf("failed to send request. err=%v", err)
+		}
+	}
+}
+
+// waits for condition to hold, and fails the test when it does not hold in time
+func waitFor(t *testing.T, description string, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestXmemNozzleDelivery(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), nil)
+	defer stopTestXmemNozzle(xmem)
+
+	sendTestXmemRequests(t, xmem, 25, []byte(`{"a":1}`))
+	waitFor(t, "25 docs to be sent", func() bool { return listener.count(common.DataSent) == 25 })
+
+	if server.NumDocuments() != 25 {
+		t.Errorf("expected 25 docs on target, got %v", server.NumDocuments())
+	}
+	doc, ok := server.Document(1, "doc5")
+	if !ok || string(doc.Value) != `{"a":1}` || doc.RevSeq != 6 || doc.Cas != 6 || doc.Deleted {
+		t.Errorf("unexpected doc on target %+v", doc)
+	}
+	if server.RequestCount(mc.SASL_AUTH) == 0 {
+		t.Errorf("expected connections to be authenticated")
+	}
+}
+
+func TestXmemNozzleBigDocs(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), nil)
+	defer stopTestXmemNozzle(xmem)
+
+	body := make([]byte, 2048)
+	sendTestXmemRequests(t, xmem, 5, body)
+	waitFor(t, "5 docs to be sent", func() bool { return listener.count(common.DataSent) == 5 })
+	if server.RequestCount(base.GET_WITH_META) == 0 {
+		t.Errorf("expected metadata of docs above optimistic replication threshold to be checked on target")
+	}
+
+	// docs that target already has are not sent again
+	setMetas := server.RequestCount(base.SET_WITH_META)
+	sendTestXmemRequests(t, xmem, 5, body)
+	waitFor(t, "metadata of 10 docs to be checked", func() bool { return server.RequestCount(base.GET_WITH_META) >= 10 })
+	time.Sleep(200 * time.Millisecond)
+	if server.RequestCount(base.SET_WITH_META) != setMetas {
+		t.Errorf("expected %v setMeta requests, got %v", setMetas, server.RequestCount(base.SET_WITH_META))
+	}
+}
+
+func TestXmemNozzleTemporaryError(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	server.AddFault(fake_memcached.Fault{Key: "doc3", Count: 2, Status: mc.TMPFAIL})
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), nil)
+	defer stopTestXmemNozzle(xmem)
+
+	sendTestXmemRequests(t, xmem, 5, []byte(`{"a":1}`))
+	waitFor(t, "5 docs to be sent", func() bool { return listener.count(common.DataSent) == 5 })
+	if _, ok := server.Document(3, "doc3"); !ok {
+		t.Errorf("expected doc3 to be resent after TMPFAIL")
+	}
+	if server.RequestCount(base.SET_WITH_META) < 7 {
+		t.Errorf("expected at least 7 setMeta requests, got %v", server.RequestCount(base.SET_WITH_META))
+	}
+}
+
+func TestXmemNozzleNotMyVbucket(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	server.AddFault(fake_memcached.Fault{Key: "doc2", Count: 1, Status: mc.NOT_MY_VBUCKET})
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), nil)
+	defer stopTestXmemNozzle(xmem)
+
+	sendTestXmemRequests(t, xmem, 5, []byte(`{"a":1}`))
+	waitFor(t, "vb error to be raised", func() bool { return listener.count(common.VBErrorEncountered) == 1 })
+	waitFor(t, "other docs to be sent", func() bool { return listener.count(common.DataSent) >= 4 })
+	if listener.count(common.ErrorEncountered) != 0 {
+		t.Errorf("expected NOT_MY_VBUCKET not to fail the nozzle")
+	}
+}
+
+// points the xdcr data dir, which dead-letter entries are persisted in, to a temp dir, and returns the function
+// that discards the entries of the replication and restores the dir
+func setupTestDeadLetterDir(t *testing.T, replicationId string) func() {
+	dir, err := ioutil.TempDir("", "dead_letter")
+	if err != nil {
+		t.Fatalf("failed to create temp dir. err=%v", err)
+	}
+	oldDataDir := base.XDCRDataDir
+	base.XDCRDataDir = dir
+	return func() {
+		dead_letter.Remove(replicationId)
+		base.XDCRDataDir = oldDataDir
+		os.RemoveAll(dir)
+	}
+}
+
+func TestXmemNozzleDeadLetter(t *testing.T) {
+	defer setupTestDeadLetterDir(t, "test")()
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	server.AddFault(fake_memcached.Fault{Key: "doc1", Status: mc.E2BIG})
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), map[string]interface{}{XMEM_SETTING_DEAD_LETTER: true, XMEM_SETTING_DEAD_LETTER_CAP: 10})
+	defer stopTestXmemNozzle(xmem)
+
+	sendTestXmemRequests(t, xmem, 5, []byte(`{"a":1}`))
+	waitFor(t, "4 docs to be sent", func() bool { return listener.count(common.DataSent) == 4 })
+	waitFor(t, "doc1 to be dead-lettered", func() bool { return listener.count(common.DataDeadLettered) == 1 })
+	if _, ok := server.Document(1, "doc1"); ok {
+		t.Errorf("expected doc1 to be rejected by target")
+	}
+	if entries, total, err := dead_letter.List("test", 0, 10); err != nil || total != 1 || entries[0].Key != "doc1" {
+		t.Errorf("expected doc1 to be in dead-letter store, got %v. err=%v", entries, err)
+	}
+}
+
+func TestXmemNozzleDeadLetterNotPersisted(t *testing.T) {
+	oldDataDir := base.XDCRDataDir
+	base.XDCRDataDir = ""
+	defer func() { base.XDCRDataDir = oldDataDir }()
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	server.AddFault(fake_memcached.Fault{Key: "doc1", Status: mc.E2BIG})
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), map[string]interface{}{XMEM_SETTING_DEAD_LETTER: true, XMEM_SETTING_DEAD_LETTER_CAP: 10})
+	defer stopTestXmemNozzle(xmem)
+
+	sendTestXmemRequests(t, xmem, 2, []byte(`{"a":1}`))
+	waitFor(t, "nozzle to fail", func() bool { return listener.count(common.ErrorEncountered) > 0 })
+	if listener.count(common.DataDeadLettered) != 0 {
+		t.Errorf("expected doc1 not to be counted as dead-lettered when it cannot be persisted")
+	}
+}
+
+func TestXmemNozzleDeadLetterRetry(t *testing.T) {
+	defer setupTestDeadLetterDir(t, "test")()
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	server.AddFault(fake_memcached.Fault{Key: "doc1", Count: 1, Status: mc.E2BIG})
+	settings := map[string]interface{}{XMEM_SETTING_DEAD_LETTER: true, XMEM_SETTING_DEAD_LETTER_CAP: 10}
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), settings)
+
+	sendTestXmemRequests(t, xmem, 3, []byte(`{"a":1}`))
+	waitFor(t, "doc1 to be dead-lettered", func() bool { return listener.count(common.DataDeadLettered) == 1 })
+	stopTestXmemNozzle(xmem)
+
+	// the doc is retried after the pipeline has been restarted with a nozzle of a different id. queued docs are
+	// picked up on self monitor ticks
+	settings[SETTING_SELF_MONITOR_INTERVAL] = 100 * time.Millisecond
+	settings[XMEM_SETTING_SOURCE_VBS] = []uint16{0, 1, 2, 3}
+	retryXmem, retryListener := startTestXmemNozzleWithId(t, "xmem_retry_"+t.Name(), server.Addr(), settings)
+	defer stopTestXmemNozzle(retryXmem)
+
+	if queued, err := dead_letter.Retry("test", nil); err != nil || queued != 1 {
+		t.Fatalf("expected doc1 to be queued for retry, got %v. err=%v", queued, err)
+	}
+	waitFor(t, "doc1 to be resent", func() bool { return retryListener.count(common.DataSent) == 1 })
+	if doc, ok := server.Document(1, "doc1"); !ok || string(doc.Value) != `{"a":1}` {
+		t.Errorf("expected doc1 to be on target after retry, got %+v", doc)
+	}
+	if _, total, _ := dead_letter.List("test", 0, 10); total != 0 {
+		t.Errorf("expected dead-letter store to be empty after successful retry, got %v entries", total)
+	}
+}
+
+func TestXmemNozzleDeadLetterRetryOtherVB(t *testing.T) {
+	defer setupTestDeadLetterDir(t, "test")()
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	server.AddFault(fake_memcached.Fault{Key: "doc1", Count: 1, Status: mc.E2BIG})
+	// doc1 is in vb 1, which the pipeline no longer owns, e.g., after rebalance
+	settings := map[string]interface{}{XMEM_SETTING_DEAD_LETTER: true, XMEM_SETTING_DEAD_LETTER_CAP: 10,
+		SETTING_SELF_MONITOR_INTERVAL: 100 * time.Millisecond, XMEM_SETTING_SOURCE_VBS: []uint16{0, 2, 3}}
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), settings)
+	defer stopTestXmemNozzle(xmem)
+
+	sendTestXmemRequests(t, xmem, 3, []byte(`{"a":1}`))
+	waitFor(t, "doc1 to be dead-lettered", func() bool { return listener.count(common.DataDeadLettered) == 1 })
+	if queued, err := dead_letter.Retry("test", nil); err != nil || queued != 1 {
+		t.Fatalf("expected doc1 to be queued for retry, got %v. err=%v", queued, err)
+	}
+
+	// the doc is not resent, so that no event is raised for a vb that the pipeline does not own
+	time.Sleep(500 * time.Millisecond)
+	if _, ok := server.Document(1, "doc1"); ok || listener.count(common.DataSent) != 2 {
+		t.Errorf("expected doc1 of vb not owned by the pipeline not to be resent")
+	}
+	if retries := dead_letter.TakeRetries("test", map[uint16]bool{1: true}); len(retries) != 1 {
+		t.Errorf("expected doc1 to stay queued for the pipeline that owns vb 1, got %v", retries)
+	}
+}
+
+func TestXmemNozzleConnectionDrop(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	server.AddFault(fake_memcached.Fault{Key: "doc2", Count: 1, Drop: true})
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), nil)
+	defer stopTestXmemNozzle(xmem)
+	conns := server.TotalConnections()
+
+	sendTestXmemRequests(t, xmem, 5, []byte(`{"a":1}`))
+	waitFor(t, "5 docs to be sent", func() bool { return server.NumDocuments() == 5 })
+	if server.TotalConnections() <= conns {
+		t.Errorf("expected the dropped connection to be repaired")
+	}
+	if listener.count(common.ErrorEncountered) != 0 {
+		t.Errorf("expected the connection drop not to fail the nozzle")
+	}
+}
+
+func TestXmemNozzleCompression(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), map[string]interface{}{XMEM_SETTING_COMPRESSION_TYPE: metadata.CompressionTypeSnappy})
+	defer stopTestXmemNozzle(xmem)
+
+	body := []byte(strings.Repeat(`{"a":1}`, 100))
+	sendTestXmemRequests(t, xmem, 2, body)
+	waitFor(t, "2 docs to be sent", func() bool { return server.NumDocuments() == 2 })
+	doc, _ := server.Document(0, "doc0")
+	if value, err := snappy.Decode(nil, doc.Value); doc.DataType&base.SnappyDataType == 0 || err != nil || !bytes.Equal(value, body) {
+		t.Errorf("expected doc to be sent compressed, got datatype=%v err=%v", doc.DataType, err)
+	}
+
+	// the repaired connection does not support snappy, and the request is resent uncompressed on it
+	server.SetHELOFeatures(base.HELOFeatureDatatype)
+	server.AddFault(fake_memcached.Fault{Key: "new0", Count: 1, Drop: true})
+	for i := 0; i < 4; i++ {
+		if err := xmem.Receive(newTestXmemRequest(fmt.Sprintf("new%v", i), 0, uint64(i+10), body)); err != nil {
+			t.Fatalf("failed to send request. err=%v", err)
+		}
+	}
+	waitFor(t, "6 docs to be sent", func() bool { return server.NumDocuments() == 6 })
+	for i := 0; i < 4; i++ {
+		doc, _ := server.Document(0, fmt.Sprintf("new%v", i))
+		if doc.DataType&base.SnappyDataType != 0 || !bytes.Equal(doc.Value, body) {
+			t.Errorf("expected new%v to be sent uncompressed, got datatype=%v", i, doc.DataType)
+		}
+	}
+	if listener.count(common.ErrorEncountered) != 0 || listener.count(common.DataDeadLettered) != 0 {
+		t.Errorf("expected docs to be accepted by target")
+	}
+}
+
+func TestXmemNozzleOverridesTarget(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	// target docs have higher revSeq than the source docs, and would win target's own conflict resolution
+	server.SetDocument(0, fake_memcached.Document{Key: []byte("doc0"), Value: []byte(`{"a":0}`), RevSeq: 100, Cas: 100})
+	server.SetDocument(1, fake_memcached.Document{Key: []byte("doc1"), Value: []byte(`{"a":0}`), RevSeq: 100, Cas: 100})
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), map[string]interface{}{XMEM_SETTING_CONFLICT_RESOLVER: base.ConflictResolverSourceWins})
+	defer stopTestXmemNozzle(xmem)
+
+	sendTestXmemRequests(t, xmem, 2, []byte(`{"a":1}`))
+	waitFor(t, "2 docs to be sent", func() bool { return listener.count(common.DataSent) == 2 })
+	for i := uint16(0); i < 2; i++ {
+		doc, _ := server.Document(i, fmt.Sprintf("doc%v", i))
+		if string(doc.Value) != `{"a":1}` || doc.RevSeq != uint64(i+1) {
+			t.Errorf("expected source doc to overwrite target doc, got %+v", doc)
+		}
+	}
+}
+
+func TestXmemNozzleZeroSetMetaConns(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	// specs created before connections_per_target_nozzle was introduced have 0 for it
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), map[string]interface{}{XMEM_SETTING_SETMETA_CONNS: 0})
+	defer stopTestXmemNozzle(xmem)
+
+	if len(xmem.setMeta_conns) != 1 {
+		t.Fatalf("expected 1 setMeta connection, got %v", len(xmem.setMeta_conns))
+	}
+	sendTestXmemRequests(t, xmem, 5, []byte(`{"a":1}`))
+	waitFor(t, "5 docs to be sent", func() bool { return listener.count(common.DataSent) == 5 })
+}
+
+func TestXmemSetMetaConnBatchCancelReservations(t *testing.T) {
+	logger := log.NewLogger("test", log.DefaultLoggerContext)
+	conn_batches := make([]*setMetaConnBatch, 2)
+	for i := range conn_batches {
+		buf := newReqBuffer(10, 2, make(chan int, 10), logger)
+		conn_batches[i] = &setMetaConnBatch{conn: &setMetaConn{buf: buf}}
+		for j := 0; j < 3; j++ {
+			_, index, reserv_num := buf.reserveSlot()
+			// the last reservation of each connection is cancelled before its request is put in the slot
+			if j < 2 {
+				if err := buf.enSlot(index, newTestXmemRequest(fmt.Sprintf("doc%v", j), 0, uint64(j+1), nil), reserv_num); err != nil {
+					t.Fatalf("failed to put request in slot. err=%v", err)
+				}
+			}
+			conn_batches[i].index_reservation_list = append(conn_batches[i].index_reservation_list, []int{int(index), reserv_num})
+		}
+	}
+	// the response to a request has been received before the reservations are cancelled
+	evicted := conn_batches[1].index_reservation_list[0][0]
+	if err := conn_batches[1].conn.buf.evictSlot(uint16(evicted)); err != nil {
+		t.Fatalf("failed to evict slot. err=%v", err)
+	}
+
+	for _, conn_batch := range conn_batches {
+		conn_batch.cancelReservations()
+		buf := conn_batch.conn.buf
+		if buf.itemCountInBuffer() != 0 || len(buf.token_ch) != 0 || len(buf.empty_slots_pos) != 10 {
+			t.Errorf("expected all slots to be released, got occupied=%v tokens=%v empty=%v", buf.itemCountInBuffer(), len(buf.token_ch), len(buf.empty_slots_pos))
+		}
+		if len(conn_batch.index_reservation_list) != 0 {
+			t.Errorf("expected reservations to be reset")
+		}
+		for _, slot := range buf.slots {
+			if slot.req != nil || slot.reservation != UninitializedReseverationNumber {
+				t.Errorf("expected slot to be empty, got %+v", slot)
+			}
+		}
+	}
+}
+
+func TestXmemNozzleResponseTimeout(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	server.AddFault(fake_memcached.Fault{Key: "doc0", Count: 1, Latency: 500 * time.Millisecond})
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), nil)
+	defer stopTestXmemNozzle(xmem)
+
+	sendTestXmemRequests(t, xmem, 1, []byte(`{"a":1}`))
+	waitFor(t, "doc0 to be sent", func() bool { return listener.count(common.DataSent) == 1 })
+	// the server processes requests on a connection in order, so the resent request is counted after the delayed one
+	waitFor(t, "doc0 to be resent after response timeout", func() bool { return server.RequestCount(base.SET_WITH_META) >= 2 })
+}
+
+func TestXmemNozzleSSLOverMem(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityTLS)
+	defer server.Close()
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), map[string]interface{}{
+		XMEM_SETTING_DEMAND_ENCRYPTION:   true,
+		XMEM_SETTING_CERTIFICATE:         server.Certificate(),
+		XMEM_SETTING_REMOTE_MEM_SSL_PORT: server.Port(),
+		XMEM_SETTING_SAN_IN_CERITICATE:   true,
+	})
+	defer stopTestXmemNozzle(xmem)
+
+	sendTestXmemRequests(t, xmem, 5, []byte(`{"a":1}`))
+	waitFor(t, "5 docs to be sent", func() bool { return listener.count(common.DataSent) == 5 })
+}
+
+func TestXmemNozzleSSLOverProxy(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityProxy)
+	defer server.Close()
+	xmem, listener := startTestXmemNozzle(t, base.LocalHostName+":11210", map[string]interface{}{
+		XMEM_SETTING_DEMAND_ENCRYPTION: true,
+		XMEM_SETTING_CERTIFICATE:       []byte("certificate"),
+		XMEM_SETTING_REMOTE_PROXY_PORT: uint16(11215),
+		XMEM_SETTING_LOCAL_PROXY_PORT:  server.Port(),
+		SETTING_OPTI_REP_THRESHOLD:     1024 * 1024,
+	})
+	defer stopTestXmemNozzle(xmem)
+
+	sendTestXmemRequests(t, xmem, 25, []byte(`{"a":1}`))
+	waitFor(t, "25 docs to be sent", func() bool { return listener.count(common.DataSent) == 25 })
+	if server.NumDocuments() != 25 {
+		t.Errorf("expected 25 docs on target, got %v", server.NumDocuments())
+	}
+}
+
+func TestXmemNozzleFaultInjection(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	injector := base.NewFaultInjector(base.GetDialer())
+	defer base.SetDialer(base.SetDialer(injector))
+	// each connection is cut after a batch or so, in the middle of a request
+	if err := injector.AddRule(base.FaultRule{Name: "drop", Host: server.Addr(), Probability: 1, DropAfterBytes: 4000}); err != nil {
+		t.Fatalf("failed to add fault rule. err=%v", err)
+	}
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), nil)
+	defer stopTestXmemNozzle(xmem)
+	conns := server.TotalConnections()
+
+	sendTestXmemRequests(t, xmem, 25, make([]byte, 200))
+	waitFor(t, "25 docs to be sent", func() bool { return server.NumDocuments() == 25 })
+	if server.TotalConnections() <= conns {
+		t.Errorf("expected the cut connections to be repaired")
+	}
+	if listener.count(common.ErrorEncountered) != 0 {
+		t.Errorf("expected the cut connections not to fail the nozzle")
+	}
+}
+
+// starts an xmem nozzle with json_field_max resolver, and sends doc0 that wins over the target doc. the target doc
+// is replaced with newTarget while the doc is on its way to target. the doc may be resent in the meantime
+func sendTestJsonFieldMaxDoc(t *testing.T, server *fake_memcached.Server, newTarget string) (*XmemNozzle, *testEventListener) {
+	server.SetDocument(0, fake_memcached.Document{Key: []byte("doc0"), Value: []byte(`{"t":5}`), RevSeq: 100, Cas: 100})
+	server.AddFault(fake_memcached.Fault{Opcodes: []mc.CommandCode{base.SET_WITH_META}, Key: "doc0", Count: 1, Latency: 500 * time.Millisecond})
+	settings := map[string]interface{}{XMEM_SETTING_CONFLICT_RESOLVER: base.ConflictResolverJsonFieldMax + ":t",
+		SETTING_SELF_MONITOR_INTERVAL: 100 * time.Millisecond}
+	xmem, listener := startTestXmemNozzle(t, server.Addr(), settings)
+
+	if err := xmem.Receive(newTestXmemRequest("doc0", 0, 1, []byte(`{"t":10}`))); err != nil {
+		t.Fatalf("failed to send request. err=%v", err)
+	}
+	waitFor(t, "doc0 to be sent", func() bool { return server.RequestCount(base.SET_WITH_META) == 1 })
+	server.SetDocument(0, fake_memcached.Document{Key: []byte("doc0"), Value: []byte(newTarget), RevSeq: 101, Cas: 200})
+	return xmem, listener
+}
+
+func TestXmemNozzleJsonFieldMaxTargetChanged(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	xmem, listener := sendTestJsonFieldMaxDoc(t, server, `{"t":20}`)
+	defer stopTestXmemNozzle(xmem)
+	failedCRListener := newTestEventListener(xmem, common.DataFailedCRSource)
+
+	// the doc is resolved again against the new target doc, and loses
+	waitFor(t, "doc0 to fail conflict resolution", func() bool { return failedCRListener.count(common.DataFailedCRSource) == 1 })
+	if doc, _ := server.Document(0, "doc0"); string(doc.Value) != `{"t":20}` {
+		t.Errorf("expected the new target doc not to be overwritten, got %v", string(doc.Value))
+	}
+	if listener.count(common.DataSent) != 0 {
+		t.Errorf("expected doc0 not to be counted as sent")
+	}
+}
+
+func TestXmemNozzleJsonFieldMaxTargetChangedAndLost(t *testing.T) {
+	server := newTestFakeMemcached(t, fake_memcached.SecurityNone)
+	defer server.Close()
+	xmem, listener := sendTestJsonFieldMaxDoc(t, server, `{"t":7}`)
+	defer stopTestXmemNozzle(xmem)
+
+	// the doc is resolved again against the new target doc, wins, and overwrites it
+	waitFor(t, "doc0 to be sent", func() bool { return listener.count(common.DataSent) == 1 })
+	if doc, _ := server.Document(0, "doc0"); string(doc.Value) != `{"t":10}` || doc.RevSeq != 1 {
+		t.Errorf("expected the new target doc to be overwritten, got %+v", doc)
+	}
+	if server.RequestCount(base.GET_WITH_META) != 2 {
+		t.Errorf("expected doc0 to be resolved again, got %v getMeta requests", server.RequestCount(base.GET_WITH_META))
+	}
+}
@@ -188,10 +188,14 @@ func (genericPipeline *GenericPipeline) Start(settings map[string]interface{}) e
 	//get starting vb timestamp
 	go genericPipeline.startingSeqno_constructor(genericPipeline)
 
-	targetClusterRef, err := genericPipeline.remoteClusterRef_retriever(genericPipeline.spec.TargetClusterUUID, true)
-	if err != nil {
-		genericPipeline.logger.Errorf("%v error getting remote cluster with uuid=%v, err=%v\n", genericPipeline.InstanceId(), genericPipeline.spec.TargetClusterUUID, err)
-		return err
+	// replications of file and webhook types have no target cluster
+	var targetClusterRef *metadata.RemoteClusterReference
+	if genericPipeline.spec.HasTargetCluster() {
+		targetClusterRef, err = genericPipeline.remoteClusterRef_retriever(genericPipeline.spec.TargetClusterUUID, true)
+		if err != nil {
+			genericPipeline.logger.Errorf("%v error getting remote cluster with uuid=%v, err=%v\n", genericPipeline.InstanceId(), genericPipeline.spec.TargetClusterUUID, err)
+			return err
+		}
 	}
 
 	// start async event listeners
@@ -578,7 +582,7 @@ func (genericPipeline *GenericPipeline) Layout() string {
 	footer := "-----------------------------"
 	content := ""
 	for _, sourceNozzle := range genericPipeline.Sources() {
-		dcpSection := fmt.Sprintf("\t%s:{vbList=%v}\n", sourceNozzle.Id(), sourceNozzle.(*parts.DcpNozzle).GetVBList())
+		dcpSection := fmt.Sprintf("\t%s:{vbList=%v}\n", sourceNozzle.Id(), sourceNozzle.(parts.SourceNozzle).GetVBList())
 		router := sourceNozzle.Connector().(*parts.Router)
 		routerSection := fmt.Sprintf("\t\t%s :{\nroutingMap=%v}\n", router.Id(), router.RoutingMapByDownstreams())
 		downstreamParts := router.DownStreams()
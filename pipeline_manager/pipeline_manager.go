@@ -324,6 +324,11 @@ func (pipelineMgr *pipelineManager) validatePipeline(topic string) error {
 		return err
 	}
 
+	// replications of file and webhook types have no target cluster to validate
+	if !spec.HasTargetCluster() {
+		return nil
+	}
+
 	targetClusterRef, err := pipelineMgr.remote_cluster_svc.RemoteClusterByUuid(spec.TargetClusterUUID, true)
 	if err != nil {
 		pipelineMgr.logger.Errorf("Error getting remote cluster with uuid=%v for pipeline %v, err=%v\n", spec.TargetClusterUUID, topic, err)
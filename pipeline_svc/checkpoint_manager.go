@@ -79,6 +79,27 @@ type CheckpointManager struct {
 
 	support_ckpt bool
 
+	// replications of file and webhook types have no remote bucket. their checkpoints need no validation by target
+	no_target_cluster bool
+
+	//filter version of the replication. checkpoints with other filter versions are discarded
+	filter_version int
+
+	// seqnos and vbuuids that the replication started from in source vbs, see ReplicationSpecification.StartSeqnos.
+	// vbs without usable checkpoints start from them rather than from seqno 0
+	start_seqnos  map[uint16]uint64
+	start_vbuuids map[uint16]uint64
+
+	// replications that replay dcp recordings neither read nor persist checkpoints, which belong to the live source bucket.
+	// every vb is replayed from the start of its recording
+	replay bool
+
+	// when vbs are remapped, the docs of a source vb are spread over all target vbs. target vbs are then validated
+	// and committed as a whole, using target_vb_opaques, rather than along with the checkpoints of individual source vbs
+	vbs_remapped           bool
+	target_vb_opaques      map[uint16]metadata.TargetVBOpaque
+	target_vb_opaques_lock sync.RWMutex
+
 	cur_ckpts        map[uint16]*checkpointRecordWithLock
 	active_vbs       map[string][]uint16
 	vb_highseqno_map map[uint16]uint64
@@ -100,7 +121,7 @@ type failoverlogWithLock struct {
 func NewCheckpointManager(checkpoints_svc service_def.CheckpointsService, capi_svc service_def.CAPIService,
 	remote_cluster_svc service_def.RemoteClusterSvc, rep_spec_svc service_def.ReplicationSpecSvc, cluster_info_svc service_def.ClusterInfoSvc,
 	xdcr_topology_svc service_def.XDCRCompTopologySvc, through_seqno_tracker_svc service_def.ThroughSeqnoTrackerSvc,
-	active_vbs map[string][]uint16, logger_ctx *log.LoggerContext) (*CheckpointManager, error) {
+	active_vbs map[string][]uint16, vbs_remapped bool, logger_ctx *log.LoggerContext) (*CheckpointManager, error) {
 	if checkpoints_svc == nil || capi_svc == nil || remote_cluster_svc == nil || rep_spec_svc == nil || cluster_info_svc == nil || xdcr_topology_svc == nil {
 		return nil, errors.New("checkpoints_svc, capi_svc, remote_cluster_svc, rep_spec_svc, cluster_info_svc and xdcr_topology_svc can't be nil")
 	}
@@ -120,6 +141,7 @@ func NewCheckpointManager(checkpoints_svc service_def.CheckpointsService, capi_s
 		logger:                    logger,
 		cur_ckpts:                 make(map[uint16]*checkpointRecordWithLock),
 		active_vbs:                active_vbs,
+		vbs_remapped:              vbs_remapped,
 		wait_grp:                  &sync.WaitGroup{},
 		failoverlog_map:           make(map[uint16]*failoverlogWithLock),
 		vb_highseqno_map:          make(map[uint16]uint64)}, nil
@@ -130,12 +152,21 @@ func (ckmgr *CheckpointManager) Attach(pipeline common.Pipeline) error {
 	ckmgr.logger.Infof("Attach checkpoint manager with pipeline %v\n", pipeline.InstanceId())
 
 	ckmgr.pipeline = pipeline
+	ckmgr.filter_version = pipeline.Specification().Settings.FilterVersion
+	ckmgr.no_target_cluster = !pipeline.Specification().HasTargetCluster()
+	ckmgr.replay = len(pipeline.Specification().Settings.DcpReplayDir) > 0
+	if !ckmgr.replay {
+		ckmgr.start_seqnos = pipeline.Specification().StartSeqnos
+		ckmgr.start_vbuuids = pipeline.Specification().StartVBUuids
+	}
 
 	//populate the remote bucket information at the time of attaching
-	err := ckmgr.populateRemoteBucketInfo(pipeline)
-
-	if err != nil {
-		return err
+	var err error
+	if !ckmgr.no_target_cluster {
+		err = ckmgr.populateRemoteBucketInfo(pipeline)
+		if err != nil {
+			return err
+		}
 	}
 
 	dcp_parts := pipeline.Sources()
@@ -190,6 +221,11 @@ func (ckmgr *CheckpointManager) Start(settings map[string]interface{}) error {
 		return errors.New(fmt.Sprintf("%v should be provided in settings", CHECKPOINT_INTERVAL))
 	}
 
+	if ckmgr.replay {
+		ckmgr.logger.Infof("CheckpointManager started without checkpointing since replication %v replays dcp recordings\n", ckmgr.pipeline.Topic())
+		return nil
+	}
+
 	ckmgr.logger.Infof("CheckpointManager starting with ckpt_interval=%v s\n", ckmgr.ckpt_interval.Seconds())
 
 	ckmgr.startRandomizedCheckpointingTicker()
@@ -299,12 +335,28 @@ func (ckmgr *CheckpointManager) SetVBTimestamps(topic string) error {
 	defer ckmgr.logger.Info("Done with SetVBTimestamps")
 	ckmgr.logger.Infof("Set start seqnos for pipeline %v...", ckmgr.pipeline.InstanceId())
 
+	if ckmgr.replay {
+		ckmgr.setReplayVBTimestamps(ckmgr.getMyVBs())
+		return nil
+	}
+
 	//refresh the remote bucket
-	err := ckmgr.remote_bucket.Refresh(ckmgr.remote_cluster_svc)
-	if err != nil {
-		ckmgr.logger.Errorf("Received error when trying to set VBTimestamps: %v\n", err)
-		ckmgr.RaiseEvent(common.NewEvent(common.ErrorEncountered, nil, ckmgr, nil, err))
-		return err
+	if !ckmgr.no_target_cluster {
+		err := ckmgr.remote_bucket.Refresh(ckmgr.remote_cluster_svc)
+		if err != nil {
+			ckmgr.logger.Errorf("Received error when trying to set VBTimestamps: %v\n", err)
+			ckmgr.RaiseEvent(common.NewEvent(common.ErrorEncountered, nil, ckmgr, nil, err))
+			return err
+		}
+
+		if ckmgr.vbs_remapped {
+			err = ckmgr.populateTargetVBOpaques()
+			if err != nil {
+				ckmgr.logger.Errorf("Received error when trying to get opaques of target vbs: %v\n", err)
+				ckmgr.RaiseEvent(common.NewEvent(common.ErrorEncountered, nil, ckmgr, nil, err))
+				return err
+			}
+		}
 	}
 
 	support_ckpt := ckmgr.support_ckpt
@@ -319,12 +371,19 @@ func (ckmgr *CheckpointManager) SetVBTimestamps(topic string) error {
 	}
 	ckmgr.logger.Infof("Found %v checkpoint documents for replication %v\n", len(ckptDocs), topic)
 
-	for vbno, _ := range ckptDocs {
+	for vbno, ckptDoc := range ckptDocs {
 		if !simple_utils.IsVbInList(vbno, listOfVbs) {
 			// if the vbno is no longer managed by the current checkpoint manager/pipeline,
 			// the checkpoint doc is no longer valid and needs to be deleted
 			// ignore errors, which should have been logged
 			ckmgr.checkpoints_svc.DelCheckpointsDoc(topic, vbno)
+		} else if !ckmgr.filterCkptRecords(ckptDoc) {
+			// filter expressions have been changed with re-streaming requested.
+			// none of the checkpoints is valid and the vb needs to be replicated from its start seqno
+			ckmgr.logger.Infof("Discarding checkpoint doc for vb=%v since it was created under an older filter version. current filter version=%v\n",
+				vbno, ckmgr.filter_version)
+			ckmgr.checkpoints_svc.DelCheckpointsDoc(topic, vbno)
+			delete(ckptDocs, vbno)
 		}
 	}
 
@@ -371,12 +430,25 @@ func (ckmgr *CheckpointManager) SetVBTimestamps(topic string) error {
 
 	ckmgr.logger.Infof("Done with setting starting seqno for pipeline %v\n", ckmgr.pipeline.InstanceId())
 
-	ckmgr.wait_grp.Add(1)
-	go ckmgr.massCheckVBOpaquesJob()
+	// there are no target vb opaques to check for replications without target cluster
+	if !ckmgr.no_target_cluster {
+		ckmgr.wait_grp.Add(1)
+		go ckmgr.massCheckVBOpaquesJob()
+	}
 
 	return nil
 }
 
+// replays all vbs from seqno 0. neither the checkpoints nor the high seqnos of the live source bucket
+// have anything to do with the recordings. target vb opaques are not validated either, since their mismatch
+// would discard the checkpoints of the live replication
+func (ckmgr *CheckpointManager) setReplayVBTimestamps(listOfVbs []uint16) {
+	for _, vbno := range listOfVbs {
+		ckmgr.setTimestampForVB(vbno, &base.VBTimestamp{Vbno: vbno})
+	}
+	ckmgr.logger.Infof("Set start seqnos to 0 for pipeline %v, which replays dcp recordings\n", ckmgr.pipeline.InstanceId())
+}
+
 func (ckmgr *CheckpointManager) setTimestampForVB(vbno uint16, ts *base.VBTimestamp) error {
 	ckmgr.logger.Debugf("%v Set VBTimestamp: vb=%v, ts.Seqno=%v\n", ckmgr.pipeline.Topic(), vbno, ts.Seqno)
 	ckmgr.logger.Debugf("%v vb=%v ts=%v\n", ckmgr.pipeline.Topic(), vbno, ts)
@@ -421,15 +493,35 @@ func (ckmgr *CheckpointManager) startSeqnoGetter(getter_id int, listOfVbs []uint
 
 				ckmgr.logger.Debugf("Negotiate checkpoint record %v...\n", ckpt_record)
 				bMatch := false
-				bMatch, current_remoteVBOpaque, err := ckmgr.capi_svc.PreReplicate(ckmgr.remote_bucket, remote_vb_status, ckmgr.support_ckpt)
+				var current_remoteVBOpaque metadata.TargetVBOpaque
+				var err error
+				if ckmgr.no_target_cluster {
+					// everything up to the checkpoint has been synced into files or delivered to the url,
+					// which cannot go away like target vbuckets
+					bMatch = ckptDoc != nil
+				} else if ckmgr.vbs_remapped {
+					// the target vb with the same vbno as the source vb has nothing to do with the checkpoint.
+					// target vbs are validated as a whole by massCheckVBOpaques instead
+					bMatch = ckptDoc != nil
+				} else {
+					bMatch, current_remoteVBOpaque, err = ckmgr.capi_svc.PreReplicate(ckmgr.remote_bucket, remote_vb_status, ckmgr.support_ckpt)
+				}
 				//remote vb topology changed
 				//udpate the vb_uuid and try again
-				if err == nil {
+				if err == nil && !ckmgr.no_target_cluster && !ckmgr.vbs_remapped {
 					ckmgr.updateCurrentVBOpaque(vbno, current_remoteVBOpaque)
 					ckmgr.logger.Debugf("Remote vbucket %v has a new opaque %v, update\n", current_remoteVBOpaque, vbno)
 					ckmgr.logger.Debugf("Done with _pre_prelicate call for %v for vbno=%v, bMatch=%v", remote_vb_status, vbno, bMatch)
 				}
 
+				// checkpoint records without target vb opaque are initial checkpoints created along with
+				// replications that start from "now". nothing has been replicated to target before them,
+				// hence there is nothing on target to validate
+				if err == nil && ckptDoc != nil && ckpt_record.Target_vb_opaque == nil {
+					ckmgr.logger.Infof("Found initial checkpoint %v for vb=%v\n", ckpt_record, vbno)
+					bMatch = true
+				}
+
 				if err != nil || bMatch {
 					if bMatch {
 						ckmgr.logger.Debugf("Remote bucket %v vbno %v agreed on the checkpoint %v\n", ckmgr.remote_bucket, vbno, ckpt_record)
@@ -465,6 +557,22 @@ func (ckmgr *CheckpointManager) startSeqnoGetter(getter_id int, listOfVbs []uint
 	}
 }
 
+// removes checkpoint records created under filter versions other than the current one from ckptDoc.
+// returns false if there are no remaining records
+func (ckmgr *CheckpointManager) filterCkptRecords(ckptDoc *metadata.CheckpointsDoc) bool {
+	if ckptDoc == nil {
+		return true
+	}
+	records := make([]*metadata.CheckpointRecord, 0, len(ckptDoc.Checkpoint_records))
+	for _, record := range ckptDoc.Checkpoint_records {
+		if record != nil && record.Filter_version == ckmgr.filter_version {
+			records = append(records, record)
+		}
+	}
+	ckptDoc.Checkpoint_records = records
+	return len(records) > 0
+}
+
 func (ckmgr *CheckpointManager) ckptRecords(ckptDoc *metadata.CheckpointsDoc, vbno uint16) []*metadata.CheckpointRecord {
 	if ckptDoc != nil {
 		ckmgr.logger.Infof("Found checkpoint doc for vb=%v\n", vbno)
@@ -577,13 +685,25 @@ func (ckmgr *CheckpointManager) retrieveCkptDoc(vbno uint16) (*metadata.Checkpoi
 
 func (ckmgr *CheckpointManager) populateVBTimestamp(ckptDoc *metadata.CheckpointsDoc, agreedIndex int, vbno uint16, highseqno uint64) *base.VBTimestamp {
 	vbts := &base.VBTimestamp{Vbno: vbno}
-	if agreedIndex > -1 && ckptDoc != nil {
+	agreed := agreedIndex > -1 && ckptDoc != nil
+	if agreed {
 		ckpt_record := ckptDoc.Checkpoint_records[agreedIndex]
 		vbts.Vbuuid = ckpt_record.Failover_uuid
 		vbts.Seqno = ckpt_record.Seqno
 		vbts.SnapshotStart = ckpt_record.Dcp_snapshot_seqno
 		vbts.SnapshotEnd = ckpt_record.Dcp_snapshot_end_seqno
+	} else if start_seqno := ckmgr.start_seqnos[vbno]; start_seqno > 0 {
+		// the checkpoints of the vb have been discarded, e.g., after a filter version change or a target failover.
+		// the vb still must not be replicated from before where the replication started
+		ckmgr.logger.Infof("No usable checkpoint for vb=%v. starting from the start seqno %v of the replication\n", vbno, start_seqno)
+		vbts.Vbuuid = ckmgr.start_vbuuids[vbno]
+		vbts.Seqno = start_seqno
+		vbts.SnapshotStart = start_seqno
+		vbts.SnapshotEnd = start_seqno
+		agreed = true
+	}
 
+	if agreed {
 		//validate and adjust vbts
 		ckmgr.logger.Infof("vbno=%v, Seqno =%v, highseqno=%v", vbno, vbts.Seqno, highseqno)
 		if vbts.Seqno > highseqno {
@@ -608,7 +728,7 @@ func (ckmgr *CheckpointManager) populateVBTimestamp(ckptDoc *metadata.Checkpoint
 		defer obj.lock.Unlock()
 
 		//populate the next ckpt (in cur_ckpts)'s information based on the previous checkpoint information if it exists
-		if agreedIndex > -1 && ckptDoc != nil {
+		if agreed {
 			obj.ckpt.Failover_uuid = vbts.Vbuuid
 			obj.ckpt.Dcp_snapshot_seqno = vbts.SnapshotStart
 			obj.ckpt.Dcp_snapshot_end_seqno = vbts.SnapshotEnd
@@ -674,6 +794,9 @@ func (ckmgr *CheckpointManager) checkpointing() {
 
 // public API. performs one checkpoint operation on request
 func (ckmgr *CheckpointManager) PerformCkpt(fin_ch <-chan bool, time_to_wait time.Duration) {
+	if ckmgr.replay {
+		return
+	}
 	ckmgr.logger.Infof("Start one time checkpointing for replication %v\n", ckmgr.pipeline.Topic())
 	defer ckmgr.logger.Infof("Done one time checkpointing for replication %v\n", ckmgr.pipeline.Topic())
 
@@ -682,6 +805,12 @@ func (ckmgr *CheckpointManager) PerformCkpt(fin_ch <-chan bool, time_to_wait tim
 	simple_utils.RandomizeUint16List(vb_list)
 	number_of_vbs := len(vb_list)
 
+	through_seqnos, err := ckmgr.commitTargetVBsIfRemapped()
+	if err != nil {
+		ckmgr.logger.Errorf("Skipping checkpointing for replication %v. err=%v\n", ckmgr.pipeline.Topic(), err)
+		return
+	}
+
 	number_of_workers := 5
 	if number_of_workers > number_of_vbs {
 		number_of_workers = number_of_vbs
@@ -697,7 +826,7 @@ func (ckmgr *CheckpointManager) PerformCkpt(fin_ch <-chan bool, time_to_wait tim
 
 		worker_wait_grp.Add(1)
 		// do not wait between vbuckets
-		go ckmgr.performCkpt_internal(vb_list_worker, fin_ch, worker_wait_grp, 0)
+		go ckmgr.performCkpt_internal(vb_list_worker, through_seqnos, fin_ch, worker_wait_grp, 0)
 	}
 
 	//wait for all the getter done, then gather result
@@ -708,10 +837,44 @@ func (ckmgr *CheckpointManager) PerformCkpt(fin_ch <-chan bool, time_to_wait tim
 func (ckmgr *CheckpointManager) performCkpt(fin_ch <-chan bool, wait_grp *sync.WaitGroup) {
 	ckmgr.logger.Infof("Start checkpointing for replication %v\n", ckmgr.pipeline.Topic())
 	defer ckmgr.logger.Infof("Done checkpointing for replication %v\n", ckmgr.pipeline.Topic())
-	ckmgr.performCkpt_internal(ckmgr.getMyVBs(), fin_ch, wait_grp, ckmgr.ckpt_interval)
+	through_seqnos, err := ckmgr.commitTargetVBsIfRemapped()
+	if err != nil {
+		ckmgr.logger.Errorf("Skipping checkpointing for replication %v. err=%v\n", ckmgr.pipeline.Topic(), err)
+		wait_grp.Done()
+		return
+	}
+	ckmgr.performCkpt_internal(ckmgr.getMyVBs(), through_seqnos, fin_ch, wait_grp, ckmgr.ckpt_interval)
 }
 
-func (ckmgr *CheckpointManager) performCkpt_internal(vb_list []uint16, fin_ch <-chan bool, wait_grp *sync.WaitGroup, time_to_wait time.Duration) {
+// when vbs are remapped, gets the through seqnos of all source vbs first, and then commits all target vbs,
+// so that the docs up to the through seqnos are persisted on target before checkpoints are taken at them.
+// returns nil through seqnos otherwise, in which case the target vb of each source vb is committed with its checkpoint
+func (ckmgr *CheckpointManager) commitTargetVBsIfRemapped() (map[uint16]uint64, error) {
+	if !ckmgr.vbs_remapped {
+		return nil, nil
+	}
+
+	through_seqnos := ckmgr.through_seqno_tracker_svc.GetThroughSeqnos()
+
+	ckmgr.target_vb_opaques_lock.RLock()
+	defer ckmgr.target_vb_opaques_lock.RUnlock()
+	for vbno, vbOpaque := range ckmgr.target_vb_opaques {
+		if vbOpaque == nil {
+			return nil, errors.New("remote bucket is an older node, no checkpointing should be done")
+		}
+		_, new_vbOpaque, err := ckmgr.capi_svc.CommitForCheckpoint(ckmgr.remote_bucket, vbOpaque, vbno)
+		if err != nil {
+			if new_vbOpaque != nil {
+				ckmgr.handleTargetTopologyChange([]uint16{vbno})
+			}
+			return nil, fmt.Errorf("Failed to commit target vb=%v. err=%v", vbno, err)
+		}
+	}
+	return through_seqnos, nil
+}
+
+// through_seqnos, when not nil, gives the seqnos to checkpoint at
+func (ckmgr *CheckpointManager) performCkpt_internal(vb_list []uint16, through_seqnos map[uint16]uint64, fin_ch <-chan bool, wait_grp *sync.WaitGroup, time_to_wait time.Duration) {
 	defer wait_grp.Done()
 
 	var interval_btwn_vb time.Duration
@@ -735,7 +898,7 @@ func (ckmgr *CheckpointManager) performCkpt_internal(vb_list []uint16, fin_ch <-
 			}
 
 			start_time_vb := time.Now()
-			err := ckmgr.do_checkpoint(vb)
+			err := ckmgr.do_checkpoint(vb, through_seqnos)
 			committing_time_vb := time.Since(start_time_vb)
 			total_committing_time += committing_time_vb.Seconds()
 			if err != nil {
@@ -757,7 +920,7 @@ func (ckmgr *CheckpointManager) performCkpt_internal(vb_list []uint16, fin_ch <-
 	ckmgr.RaiseEvent(common.NewEvent(common.CheckpointDone, nil, ckmgr, nil, time.Duration(total_committing_time)*time.Second))
 }
 
-func (ckmgr *CheckpointManager) do_checkpoint(vbno uint16) (err error) {
+func (ckmgr *CheckpointManager) do_checkpoint(vbno uint16, through_seqnos map[uint16]uint64) (err error) {
 	//locking the current ckpt record and notsent_seqno list for this vb, no update is allowed during the checkpointing
 	ckmgr.logger.Debugf("Checkpointing for vb=%v\n", vbno)
 
@@ -768,7 +931,11 @@ func (ckmgr *CheckpointManager) do_checkpoint(vbno uint16) (err error) {
 
 		ckpt_record := ckpt_obj.ckpt
 
-		ckpt_record.Seqno = ckmgr.through_seqno_tracker_svc.GetThroughSeqno(vbno)
+		if through_seqnos != nil {
+			ckpt_record.Seqno = through_seqnos[vbno]
+		} else {
+			ckpt_record.Seqno = ckmgr.through_seqno_tracker_svc.GetThroughSeqno(vbno)
+		}
 		ckmgr.logger.Debugf("Seqno number used for checkpointing for vb %v is %v\n", vbno, ckpt_record.Seqno)
 
 		if ckpt_record.Seqno == 0 {
@@ -776,18 +943,29 @@ func (ckmgr *CheckpointManager) do_checkpoint(vbno uint16) (err error) {
 			return nil
 		}
 
-		if ckpt_record.Target_vb_opaque == nil {
+		if ckpt_record.Target_vb_opaque == nil && !ckmgr.no_target_cluster && !ckmgr.vbs_remapped {
 			ckmgr.logger.Info("remote bucket is an older node, no checkpointing should be done.")
 			return nil
 		}
 
 		var remote_seqno uint64
 		var vbOpaque metadata.TargetVBOpaque
-		remote_seqno, vbOpaque, err = ckmgr.capi_svc.CommitForCheckpoint(ckmgr.remote_bucket, ckpt_record.Target_vb_opaque, vbno)
+		if ckmgr.no_target_cluster {
+			// records are acknowledged only after they have been synced into files or delivered to the url,
+			// hence there is nothing to commit
+			remote_seqno = ckpt_record.Seqno
+		} else if ckmgr.vbs_remapped {
+			// all target vbs have been committed before the through seqnos were taken.
+			// there is no single target vb whose seqno corresponds to the checkpoint
+			remote_seqno = 0
+		} else {
+			remote_seqno, vbOpaque, err = ckmgr.capi_svc.CommitForCheckpoint(ckmgr.remote_bucket, ckpt_record.Target_vb_opaque, vbno)
+		}
 		if err == nil {
 			//succeed
 			ckpt_record.Target_Seqno = remote_seqno
 			ckpt_record.Failover_uuid = ckmgr.getFailoverUUIDForSeqno(vbno, ckpt_record.Seqno)
+			ckpt_record.Filter_version = ckmgr.filter_version
 			err = ckmgr.persistCkptRecord(vbno, ckpt_record)
 			if err == nil {
 				ckmgr.raiseSuccessCkptForVbEvent(*ckpt_record, vbno)
@@ -881,26 +1059,36 @@ func (ckmgr *CheckpointManager) UpdateVBTimestamps(vbno uint16, rollbackseqno ui
 		panic(fmt.Sprintf("rollbackseqno=%v, current_start_seqno=%v", rollbackseqno, pipeline_start_seqno.Seqno))
 	}
 
-	checkpointDoc, err := ckmgr.retrieveCkptDoc(vbno)
-	if err != nil {
+	var checkpointDoc *metadata.CheckpointsDoc
+	var err error
+	if !ckmgr.replay {
+		checkpointDoc, err = ckmgr.retrieveCkptDoc(vbno)
+	}
+	if err == service_def.MetadataNotFoundErr {
+		// the vb has not been checkpointed since it started from the start seqno of the replication
+		checkpointDoc = nil
+	} else if err != nil {
 		return nil, err
 	}
 
 	foundIndex := -1
-	for index, ckpt_record := range checkpointDoc.Checkpoint_records {
-		if ckpt_record == nil {
-			break
-		}
+	if checkpointDoc != nil {
+		for index, ckpt_record := range checkpointDoc.Checkpoint_records {
+			if ckpt_record == nil {
+				break
+			}
 
-		//found the first ckpt record whose Seqno <= rollbackseqno
-		if ckpt_record.Seqno <= rollbackseqno {
-			foundIndex = index
-			break
-		}
+			//found the first ckpt record whose Seqno <= rollbackseqno
+			if ckpt_record.Seqno <= rollbackseqno {
+				foundIndex = index
+				break
+			}
 
+		}
 	}
 
-	vbts := ckmgr.populateVBTimestamp(checkpointDoc, foundIndex, vbno, pipeline_start_seqno.Seqno)
+	// the stream has to restart at or before rollbackseqno, including when it falls back to the start seqno of the replication
+	vbts := ckmgr.populateVBTimestamp(checkpointDoc, foundIndex, vbno, rollbackseqno)
 	pipeline_startSeqnos_map[vbno] = vbts
 
 	//set the start seqno on through_seqno_tracker_svc
@@ -953,6 +1141,10 @@ func (ckmgr *CheckpointManager) massCheckVBOpaquesJob() {
 }
 
 func (ckmgr *CheckpointManager) massCheckVBOpaques() error {
+	if ckmgr.vbs_remapped {
+		return ckmgr.massCheckTargetVBOpaques()
+	}
+
 	target_vb_vbuuid_map := make(map[uint16]metadata.TargetVBOpaque)
 	//validate target bucket's vbucket uuid
 	for vb, _ := range ckmgr.cur_ckpts {
@@ -990,6 +1182,80 @@ func (ckmgr *CheckpointManager) massCheckVBOpaques() error {
 	return nil
 }
 
+// gets the current opaques of all target vbs, which are used to detect target topology changes when vbs are remapped
+func (ckmgr *CheckpointManager) populateTargetVBOpaques() error {
+	target_vb_opaques := make(map[uint16]metadata.TargetVBOpaque)
+	for _, vbnos := range ckmgr.remote_bucket.VBServerMap {
+		for _, vbno := range vbnos {
+			_, vbOpaque, err := ckmgr.capi_svc.PreReplicate(ckmgr.remote_bucket, &service_def.RemoteVBReplicationStatus{VBNo: vbno}, ckmgr.support_ckpt)
+			if err == service_def.NoSupportForXDCRCheckpointingError {
+				ckmgr.logger.Infof("Remote vbucket %v is on a old node which doesn't support checkpointing\n", vbno)
+				vbOpaque = nil
+			} else if err != nil {
+				return err
+			}
+			target_vb_opaques[vbno] = vbOpaque
+		}
+	}
+
+	ckmgr.target_vb_opaques_lock.Lock()
+	defer ckmgr.target_vb_opaques_lock.Unlock()
+	ckmgr.target_vb_opaques = target_vb_opaques
+	ckmgr.logger.Infof("Got opaques of %v target vbs for replication %v\n", len(target_vb_opaques), ckmgr.pipeline.Topic())
+	return nil
+}
+
+// validates the opaques of all target vbs when vbs are remapped
+func (ckmgr *CheckpointManager) massCheckTargetVBOpaques() error {
+	target_vb_vbuuid_map := make(map[uint16]metadata.TargetVBOpaque)
+	ckmgr.target_vb_opaques_lock.RLock()
+	for vbno, vbOpaque := range ckmgr.target_vb_opaques {
+		if vbOpaque != nil {
+			target_vb_vbuuid_map[vbno] = vbOpaque
+		}
+	}
+	ckmgr.target_vb_opaques_lock.RUnlock()
+	if len(target_vb_vbuuid_map) == 0 {
+		ckmgr.logger.Info("remote bucket is an older node, massCheckVBOpaque is not supported.")
+		return nil
+	}
+
+	matching, mismatching, missing, err := ckmgr.capi_svc.MassValidateVBUUIDs(ckmgr.remote_bucket, target_vb_vbuuid_map)
+	if err != nil {
+		ckmgr.logger.Errorf("MassValidateVBUUID failed, err=%v", err)
+		return err
+	}
+	if len(mismatching) > 0 {
+		ckmgr.logger.Errorf("Target bucket for replication %v's topology has changed. mismatch=%v, missing=%v, matching=%v\n", ckmgr.pipeline.Topic(), mismatching, missing, matching)
+		ckmgr.handleTargetTopologyChange(mismatching)
+	} else if len(missing) > 0 {
+		// vbuckets move between target nodes without changing their opaques during rebalance.
+		// they are validated again in the next round
+		ckmgr.logger.Infof("Target vbuckets %v of replication %v cannot be found. rebalance may be going on on target\n", missing, ckmgr.pipeline.Topic())
+	} else {
+		ckmgr.logger.Infof("No target bucket topology change is detected for replication %v", ckmgr.pipeline.Topic())
+	}
+	return nil
+}
+
+// handles the failover of target vbs when vbs are remapped. docs replicated into the target vbs, from any source vb,
+// before the checkpoints may have been lost, and there is no telling which checkpoints are still valid.
+// this is a full re-stream by design: all checkpoints of the source vbs on this node are discarded, and the pipeline
+// fails so that it is restarted to replicate them again from their start seqnos, which are 0 unless the replication
+// was created to start from a timestamp. docs that are still on target are skipped by target conflict resolution
+func (ckmgr *CheckpointManager) handleTargetTopologyChange(target_vbs []uint16) {
+	topic := ckmgr.pipeline.Topic()
+	my_vbs := ckmgr.getMyVBs()
+	ckmgr.logger.Errorf("Target vbs %v of replication %v have failed over while source vbs are remapped. discarding the checkpoints of source vbs %v, which will be replicated again from their start seqnos\n",
+		target_vbs, topic, my_vbs)
+	for _, vbno := range my_vbs {
+		// ignore errors, which should have been logged
+		ckmgr.checkpoints_svc.DelCheckpointsDoc(topic, vbno)
+	}
+	err := fmt.Errorf("Target bucket's topology has changed for target vbs %v while source vbs are remapped. all checkpoints have been discarded and the replication restarts from its start seqnos", target_vbs)
+	ckmgr.RaiseEvent(common.NewEvent(common.ErrorEncountered, nil, ckmgr, nil, err))
+}
+
 func (ckmgr *CheckpointManager) handleVBError(vbno uint16, err error) {
 	additionalInfo := &base.VBErrorEventAdditional{vbno, err, base.VBErrorType_Target}
 	ckmgr.RaiseEvent(common.NewEvent(common.VBErrorEncountered, nil, ckmgr, nil, additionalInfo))
@@ -0,0 +1,341 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_svc
+
+import (
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/common"
+	component "github.com/couchbase/goxdcr/component"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"github.com/couchbase/goxdcr/service_def"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testCkptTopic = "uuid/source/target"
+
+// pipeline with only the methods used by checkpoint manager in tests
+type testCkptPipeline struct {
+	common.Pipeline
+	spec *metadata.ReplicationSpecification
+	vbts map[uint16]*base.VBTimestamp
+}
+
+func (p *testCkptPipeline) Topic() string {
+	return testCkptTopic
+}
+
+func (p *testCkptPipeline) Specification() *metadata.ReplicationSpecification {
+	return p.spec
+}
+
+func (p *testCkptPipeline) Settings() map[string]interface{} {
+	ts_map := make(map[uint16]*base.VBTimestamp)
+	for vbno, ts := range p.vbts {
+		ts_map[vbno] = ts
+	}
+	return map[string]interface{}{base.VBTimestamps: &base.ObjectWithLock{Object: ts_map, Lock: &sync.RWMutex{}}}
+}
+
+func (p *testCkptPipeline) InstanceId() string {
+	return testCkptTopic
+}
+
+// keeps the vb timestamps that the pipeline is started with
+func (p *testCkptPipeline) UpdateSettings(settings map[string]interface{}) error {
+	if p.vbts == nil {
+		p.vbts = make(map[uint16]*base.VBTimestamp)
+	}
+	for vbno, ts := range settings[base.VBTimestamps].(map[uint16]*base.VBTimestamp) {
+		p.vbts[vbno] = ts
+	}
+	return nil
+}
+
+type testThroughSeqnoTracker struct {
+	service_def.ThroughSeqnoTrackerSvc
+	start_seqnos map[uint16]uint64
+}
+
+func (tracker *testThroughSeqnoTracker) SetStartSeqno(vbno uint16, seqno uint64) {
+	tracker.start_seqnos[vbno] = seqno
+}
+
+// checkpoints service that keeps checkpoint docs in memory
+type testCheckpointsSvc struct {
+	service_def.CheckpointsService
+	lock sync.Mutex
+	docs map[uint16]*metadata.CheckpointsDoc
+}
+
+func (svc *testCheckpointsSvc) CheckpointsDoc(replicationId string, vbno uint16) (*metadata.CheckpointsDoc, error) {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	doc, ok := svc.docs[vbno]
+	if !ok {
+		return nil, service_def.MetadataNotFoundErr
+	}
+	return doc, nil
+}
+
+func (svc *testCheckpointsSvc) DelCheckpointsDoc(replicationId string, vbno uint16) error {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	delete(svc.docs, vbno)
+	return nil
+}
+
+func (svc *testCheckpointsSvc) CheckpointsDocs(replicationId string) (map[uint16]*metadata.CheckpointsDoc, error) {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	docs := make(map[uint16]*metadata.CheckpointsDoc)
+	for vbno, doc := range svc.docs {
+		docs[vbno] = doc
+	}
+	return docs, nil
+}
+
+// capi service that reports the given target vbs as mismatching or missing in mass validation
+type testCAPISvc struct {
+	service_def.CAPIService
+	mismatching []uint16
+	missing     []uint16
+}
+
+func (svc *testCAPISvc) MassValidateVBUUIDs(remoteBucket *service_def.RemoteBucketInfo, remoteVBUUIDs map[uint16]metadata.TargetVBOpaque) ([]uint16, []uint16, []uint16, error) {
+	matching := []uint16{}
+	for vbno, _ := range remoteVBUUIDs {
+		matching = append(matching, vbno)
+	}
+	return matching, svc.mismatching, svc.missing, nil
+}
+
+type testErrorListener struct {
+	errors []error
+}
+
+func (listener *testErrorListener) OnEvent(event *common.Event) {
+	if err, ok := event.OtherInfos.(error); ok {
+		listener.errors = append(listener.errors, err)
+	}
+}
+
+func newTestCkptDoc(seqno uint64) *metadata.CheckpointsDoc {
+	return &metadata.CheckpointsDoc{Checkpoint_records: []*metadata.CheckpointRecord{&metadata.CheckpointRecord{Seqno: seqno}}}
+}
+
+// checkpoint manager of a pipeline owning source vbs 0 and 1, whose docs are remapped onto target vbs 0 to 3
+func newTestRemappedCkptMgr(capi_svc service_def.CAPIService) (*CheckpointManager, *testCheckpointsSvc, *testErrorListener) {
+	checkpoints_svc := &testCheckpointsSvc{docs: map[uint16]*metadata.CheckpointsDoc{0: newTestCkptDoc(10), 1: newTestCkptDoc(20)}}
+	logger := log.NewLogger("CheckpointManager", log.DefaultLoggerContext)
+	ckmgr := &CheckpointManager{
+		AbstractComponent: component.NewAbstractComponentWithLogger(CheckpointMgrId, logger),
+		pipeline:          &testCkptPipeline{spec: &metadata.ReplicationSpecification{Settings: metadata.DefaultSettings()}},
+		checkpoints_svc:   checkpoints_svc,
+		capi_svc:          capi_svc,
+		active_vbs:        map[string][]uint16{"127.0.0.1:11210": []uint16{0, 1}},
+		vbs_remapped:      true,
+		target_vb_opaques: map[uint16]metadata.TargetVBOpaque{0: &metadata.TargetVBUuid{1}, 1: &metadata.TargetVBUuid{2},
+			2: &metadata.TargetVBUuid{3}, 3: &metadata.TargetVBUuid{4}},
+		cur_ckpts:        make(map[uint16]*checkpointRecordWithLock),
+		failoverlog_map:  make(map[uint16]*failoverlogWithLock),
+		vb_highseqno_map: make(map[uint16]uint64),
+		logger:           logger,
+	}
+	listener := &testErrorListener{}
+	ckmgr.RegisterComponentEventListener(common.ErrorEncountered, listener)
+	return ckmgr, checkpoints_svc, listener
+}
+
+func TestCkptMgrTargetTopologyChangeWhenRemapped(t *testing.T) {
+	ckmgr, checkpoints_svc, listener := newTestRemappedCkptMgr(&testCAPISvc{mismatching: []uint16{3}})
+	if err := ckmgr.massCheckTargetVBOpaques(); err != nil {
+		t.Fatalf("unexpected err=%v", err)
+	}
+
+	// the failover of a single target vb discards the checkpoints of all source vbs, and fails the pipeline
+	if len(checkpoints_svc.docs) != 0 {
+		t.Errorf("expected all checkpoint docs to be discarded, got %v", checkpoints_svc.docs)
+	}
+	if len(listener.errors) != 1 {
+		t.Fatalf("expected one error to be raised, got %v", listener.errors)
+	}
+}
+
+func TestCkptMgrTargetVBsMissingWhenRemapped(t *testing.T) {
+	// target vbs that are moving in a rebalance keep their opaques, and are validated again later
+	ckmgr, checkpoints_svc, listener := newTestRemappedCkptMgr(&testCAPISvc{missing: []uint16{3}})
+	if err := ckmgr.massCheckTargetVBOpaques(); err != nil {
+		t.Fatalf("unexpected err=%v", err)
+	}
+	vbs := []int{}
+	for vbno, _ := range checkpoints_svc.docs {
+		vbs = append(vbs, int(vbno))
+	}
+	sort.Ints(vbs)
+	if len(vbs) != 2 || vbs[0] != 0 || vbs[1] != 1 {
+		t.Errorf("expected checkpoint docs to be kept, got %v", vbs)
+	}
+	if len(listener.errors) != 0 {
+		t.Errorf("expected no error to be raised, got %v", listener.errors)
+	}
+}
+
+func TestCkptMgrStartSeqnoFallback(t *testing.T) {
+	spec := &metadata.ReplicationSpecification{Id: testCkptTopic, TargetClusterUUID: metadata.FileTargetClusterUUID,
+		Settings:     metadata.DefaultSettings(),
+		StartSeqnos:  map[uint16]uint64{0: 5, 1: 20},
+		StartVBUuids: map[uint16]uint64{0: 1000, 1: 1001}}
+	pipeline := &testCkptPipeline{spec: spec}
+	tracker := &testThroughSeqnoTracker{start_seqnos: make(map[uint16]uint64)}
+	logger := log.NewLogger("CheckpointManager", log.DefaultLoggerContext)
+	ckmgr := &CheckpointManager{
+		AbstractComponent:         component.NewAbstractComponentWithLogger(CheckpointMgrId, logger),
+		pipeline:                  pipeline,
+		through_seqno_tracker_svc: tracker,
+		no_target_cluster:         true,
+		start_seqnos:              spec.StartSeqnos,
+		start_vbuuids:             spec.StartVBUuids,
+		active_vbs:                map[string][]uint16{"127.0.0.1:11210": []uint16{0, 1, 2, 3}},
+		cur_ckpts:                 make(map[uint16]*checkpointRecordWithLock),
+		failoverlog_map:           make(map[uint16]*failoverlogWithLock),
+		vb_highseqno_map:          make(map[uint16]uint64),
+		logger:                    logger,
+	}
+	ckmgr.initialize()
+
+	// vb 0 has a checkpoint. the checkpoints of vb 1 have been discarded. vb 2 started from seqno 0,
+	// and vb 3 has a start seqno beyond its high seqno
+	ckmgr.start_seqnos[3] = 50
+	ckptDocs := map[uint16]*metadata.CheckpointsDoc{0: &metadata.CheckpointsDoc{Checkpoint_records: []*metadata.CheckpointRecord{
+		&metadata.CheckpointRecord{Failover_uuid: 2000, Seqno: 10, Dcp_snapshot_seqno: 8, Dcp_snapshot_end_seqno: 12}}}}
+	highseqnos := map[uint16]uint64{0: 100, 1: 100, 2: 100, 3: 30}
+	wait_grp := &sync.WaitGroup{}
+	wait_grp.Add(1)
+	err_ch := make(chan interface{}, 4)
+	ckmgr.startSeqnoGetter(0, []uint16{0, 1, 2, 3}, ckptDocs, true, highseqnos, wait_grp, err_ch)
+	if len(err_ch) != 0 {
+		t.Fatalf("unexpected errors %v", len(err_ch))
+	}
+
+	expected := map[uint16]base.VBTimestamp{
+		0: base.VBTimestamp{Vbno: 0, Vbuuid: 2000, Seqno: 10, SnapshotStart: 8, SnapshotEnd: 12},
+		1: base.VBTimestamp{Vbno: 1, Vbuuid: 1001, Seqno: 20, SnapshotStart: 20, SnapshotEnd: 20},
+		2: base.VBTimestamp{Vbno: 2},
+		3: base.VBTimestamp{Vbno: 3, Seqno: 30, SnapshotStart: 30, SnapshotEnd: 50},
+	}
+	for vbno, expected_ts := range expected {
+		ts, ok := pipeline.vbts[vbno]
+		if !ok {
+			t.Errorf("no timestamp is set for vb=%v", vbno)
+			continue
+		}
+		if *ts != expected_ts {
+			t.Errorf("expected timestamp %v for vb=%v, got %v", expected_ts, vbno, *ts)
+		}
+		if tracker.start_seqnos[vbno] != expected_ts.Seqno {
+			t.Errorf("expected start seqno %v in through seqno tracker for vb=%v, got %v", expected_ts.Seqno, vbno, tracker.start_seqnos[vbno])
+		}
+	}
+	if ckpt := ckmgr.getCurrentCkpt(1); ckpt.Failover_uuid != 1001 || ckpt.Dcp_snapshot_seqno != 20 {
+		t.Errorf("expected the next checkpoint of vb 1 to be based on the start seqno, got %v", ckpt)
+	}
+}
+
+func TestCkptMgrRollbackBeforeStartSeqno(t *testing.T) {
+	spec := &metadata.ReplicationSpecification{Id: testCkptTopic, TargetClusterUUID: metadata.FileTargetClusterUUID,
+		Settings: metadata.DefaultSettings()}
+	pipeline := &testCkptPipeline{spec: spec, vbts: map[uint16]*base.VBTimestamp{
+		0: &base.VBTimestamp{Vbno: 0, Vbuuid: 1000, Seqno: 20, SnapshotStart: 20, SnapshotEnd: 20},
+		1: &base.VBTimestamp{Vbno: 1, Vbuuid: 1001, Seqno: 20, SnapshotStart: 20, SnapshotEnd: 20}}}
+	logger := log.NewLogger("CheckpointManager", log.DefaultLoggerContext)
+	ckmgr := &CheckpointManager{
+		AbstractComponent:         component.NewAbstractComponentWithLogger(CheckpointMgrId, logger),
+		pipeline:                  pipeline,
+		checkpoints_svc:           &testCheckpointsSvc{docs: map[uint16]*metadata.CheckpointsDoc{1: newTestCkptDoc(5)}},
+		through_seqno_tracker_svc: &testThroughSeqnoTracker{start_seqnos: make(map[uint16]uint64)},
+		no_target_cluster:         true,
+		start_seqnos:              map[uint16]uint64{0: 20, 1: 20},
+		start_vbuuids:             map[uint16]uint64{0: 1000, 1: 1001},
+		active_vbs:                map[string][]uint16{"127.0.0.1:11210": []uint16{0, 1}},
+		cur_ckpts:                 make(map[uint16]*checkpointRecordWithLock),
+		failoverlog_map:           make(map[uint16]*failoverlogWithLock),
+		vb_highseqno_map:          make(map[uint16]uint64),
+		logger:                    logger,
+	}
+	ckmgr.initialize()
+
+	// vb 0 started from the start seqno of the replication without checkpoints. it restarts at the rollback seqno
+	vbts, err := ckmgr.UpdateVBTimestamps(0, 10)
+	if err != nil || vbts.Seqno != 10 || vbts.SnapshotStart != 10 || vbts.SnapshotEnd != 20 {
+		t.Errorf("expected vb 0 to restart at the rollback seqno, got %v. err=%v", vbts, err)
+	}
+	// vb 1 restarts at the checkpoint before the rollback seqno
+	vbts, err = ckmgr.UpdateVBTimestamps(1, 10)
+	if err != nil || vbts.Seqno != 5 {
+		t.Errorf("expected vb 1 to restart at its checkpoint, got %v. err=%v", vbts, err)
+	}
+}
+
+func TestCkptMgrReplay(t *testing.T) {
+	spec := &metadata.ReplicationSpecification{Id: testCkptTopic, Settings: metadata.DefaultSettings()}
+	pipeline := &testCkptPipeline{spec: spec}
+	// the checkpoints of the live replication, which are neither used nor modified.
+	// the fake service has no UpsertCheckpoints, which would panic if called
+	checkpoints_svc := &testCheckpointsSvc{docs: map[uint16]*metadata.CheckpointsDoc{0: newTestCkptDoc(10), 1: newTestCkptDoc(20)}}
+	logger := log.NewLogger("CheckpointManager", log.DefaultLoggerContext)
+	ckmgr := &CheckpointManager{
+		AbstractComponent:         component.NewAbstractComponentWithLogger(CheckpointMgrId, logger),
+		pipeline:                  pipeline,
+		checkpoints_svc:           checkpoints_svc,
+		through_seqno_tracker_svc: &testThroughSeqnoTracker{start_seqnos: make(map[uint16]uint64)},
+		replay:                    true,
+		active_vbs:                map[string][]uint16{"127.0.0.1:11210": []uint16{0, 1, 2}},
+		cur_ckpts:                 make(map[uint16]*checkpointRecordWithLock),
+		failoverlog_map:           make(map[uint16]*failoverlogWithLock),
+		vb_highseqno_map:          make(map[uint16]uint64),
+		finish_ch:                 make(chan bool, 1),
+		checkpoint_ticker_ch:      make(chan *time.Ticker, 1000),
+		wait_grp:                  &sync.WaitGroup{},
+		logger:                    logger,
+	}
+	ckmgr.initialize()
+
+	if err := ckmgr.Start(map[string]interface{}{CHECKPOINT_INTERVAL: 1}); err != nil {
+		t.Fatalf("unexpected err=%v", err)
+	}
+	if len(ckmgr.checkpoint_ticker_ch) != 0 {
+		t.Errorf("expected no checkpointing to be scheduled")
+	}
+
+	// target is not validated, hence the target cluster does not need to be reachable
+	if err := ckmgr.SetVBTimestamps(testCkptTopic); err != nil {
+		t.Fatalf("unexpected err=%v", err)
+	}
+	if len(pipeline.vbts) != 3 {
+		t.Errorf("expected timestamps for 3 vbs, got %v", pipeline.vbts)
+	}
+	for vbno, ts := range pipeline.vbts {
+		if *ts != (base.VBTimestamp{Vbno: vbno}) {
+			t.Errorf("expected vb=%v to be replayed from seqno 0, got %v", vbno, ts)
+		}
+	}
+
+	ckmgr.PerformCkpt(make(chan bool), time.Second)
+	if len(checkpoints_svc.docs) != 2 || checkpoints_svc.docs[0].Checkpoint_records[0].Seqno != 10 {
+		t.Errorf("expected the checkpoints of the live replication to be kept, got %v", checkpoints_svc.docs)
+	}
+	if err := ckmgr.Stop(); err != nil {
+		t.Errorf("unexpected err=%v", err)
+	}
+}
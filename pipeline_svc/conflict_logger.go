@@ -0,0 +1,205 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_svc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/couchbase/go-couchbase"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/conflict_log"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/parts"
+	pipeline_pkg "github.com/couchbase/goxdcr/pipeline"
+	"github.com/couchbase/goxdcr/pipeline_utils"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CONFLICT_LOG_SINK      = "conflict_log_sink"
+	CONFLICT_LOG_RETENTION = "conflict_log_retention"
+)
+
+// max number of conflict records waiting to be written to sink. records are dropped when the queue is full,
+// so that a slow sink does not hold up replication
+var ConflictLogQueueSize = 10000
+
+// interval at which the number of dropped conflict records is logged
+var ConflictLogDropReportInterval = 60 * time.Second
+
+// returns the bucket with the given name on target cluster
+type TargetBucketGetter func(bucketName string) (*couchbase.Bucket, error)
+
+// ConflictLogger records source documents that fail source side conflict resolution
+// into the sink specified by the conflict_log_sink replication setting
+type ConflictLogger struct {
+	id                   string
+	pipeline             common.Pipeline
+	target_bucket_getter TargetBucketGetter
+	sink                 conflict_log.Sink
+	retention            time.Duration
+	record_ch            chan *conflict_log.Record
+	finish_ch            chan bool
+	wait_grp             *sync.WaitGroup
+	// number of records dropped since last report, due to full queue
+	dropped_count uint64
+	logger        *log.CommonLogger
+}
+
+func NewConflictLogger(target_bucket_getter TargetBucketGetter, logger_ctx *log.LoggerContext) *ConflictLogger {
+	return &ConflictLogger{
+		id:                   base.CONFLICT_LOGGER_SVC,
+		target_bucket_getter: target_bucket_getter,
+		record_ch:            make(chan *conflict_log.Record, ConflictLogQueueSize),
+		finish_ch:            make(chan bool, 1),
+		wait_grp:             &sync.WaitGroup{},
+		logger:               log.NewLogger("ConflictLogger", logger_ctx),
+	}
+}
+
+func (conflict_logger *ConflictLogger) Id() string {
+	return conflict_logger.id
+}
+
+func (conflict_logger *ConflictLogger) Attach(pipeline common.Pipeline) error {
+	conflict_logger.pipeline = pipeline
+	conflict_logger.id = base.CONFLICT_LOGGER_SVC + "_" + pipeline.Topic()
+
+	// register conflict logger as the async event handler for DataFailedCRSource events
+	async_listener_map := pipeline_pkg.GetAllAsyncComponentEventListeners(pipeline)
+	pipeline_utils.RegisterAsyncComponentEventHandler(async_listener_map, base.DataFailedCREventListener, conflict_logger)
+	return nil
+}
+
+func (conflict_logger *ConflictLogger) Start(settings map[string]interface{}) error {
+	spec, ok := settings[CONFLICT_LOG_SINK].(string)
+	if !ok || spec == "" {
+		return errors.New("conflict log sink is not specified")
+	}
+	retention, ok := settings[CONFLICT_LOG_RETENTION].(int)
+	if !ok {
+		return fmt.Errorf("invalid conflict log retention %v", settings[CONFLICT_LOG_RETENTION])
+	}
+	conflict_logger.retention = time.Duration(retention) * time.Second
+
+	sink, err := conflict_logger.newSink(spec)
+	if err != nil {
+		return err
+	}
+	conflict_logger.sink = sink
+	conflict_logger.logger.Infof("ConflictLogger for pipeline %v started. sink=%v, retention=%v", conflict_logger.pipeline.Topic(), spec, conflict_logger.retention)
+
+	conflict_logger.wait_grp.Add(1)
+	go conflict_logger.writeRecords()
+	return nil
+}
+
+func (conflict_logger *ConflictLogger) newSink(spec string) (conflict_log.Sink, error) {
+	sinkType, arg, err := conflict_log.ParseSinkSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	replicationId := conflict_logger.pipeline.Topic()
+	switch sinkType {
+	case conflict_log.SinkTypeFile:
+		return conflict_log.NewFileSink(arg, replicationId)
+	case conflict_log.SinkTypeBucket:
+		bucket, err := conflict_logger.target_bucket_getter(arg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get conflict log bucket %v on target. err=%v", arg, err)
+		}
+		return conflict_log.NewBucketSink(bucket, replicationId, conflict_logger.retention), nil
+	}
+	return nil, fmt.Errorf("unknown conflict log sink type %v", sinkType)
+}
+
+func (conflict_logger *ConflictLogger) Stop() error {
+	conflict_logger.logger.Infof("ConflictLogger for pipeline %v stopping...", conflict_logger.pipeline.Topic())
+	if conflict_logger.sink == nil {
+		// not started
+		return nil
+	}
+	close(conflict_logger.finish_ch)
+	conflict_logger.wait_grp.Wait()
+	err := conflict_logger.sink.Close()
+	conflict_logger.logger.Infof("ConflictLogger for pipeline %v stopped", conflict_logger.pipeline.Topic())
+	return err
+}
+
+// conflict logging settings can only be changed through pipeline restart
+func (conflict_logger *ConflictLogger) UpdateSettings(settings map[string]interface{}) error {
+	return nil
+}
+
+func (conflict_logger *ConflictLogger) ProcessEvent(event *common.Event) error {
+	if event.EventType != common.DataFailedCRSource {
+		return nil
+	}
+	event_otherInfo := event.OtherInfos.(parts.DataFailedCRSourceEventAdditional)
+	if event_otherInfo.Source_meta == nil {
+		// conflict logging is not enabled on the nozzle
+		return nil
+	}
+
+	record := conflict_log.NewRecord(conflict_logger.pipeline.Topic(), event_otherInfo.VBucket, event_otherInfo.Seqno, event_otherInfo.Source_meta, event_otherInfo.Target_meta)
+	conflict_log.AddRecentRecord(record, conflict_logger.retention)
+
+	select {
+	case conflict_logger.record_ch <- record:
+	default:
+		atomic.AddUint64(&conflict_logger.dropped_count, 1)
+	}
+	return nil
+}
+
+func (conflict_logger *ConflictLogger) writeRecords() {
+	defer conflict_logger.wait_grp.Done()
+
+	report_ticker := time.NewTicker(ConflictLogDropReportInterval)
+	defer report_ticker.Stop()
+
+	for {
+		select {
+		case <-conflict_logger.finish_ch:
+			// write out the records that have been queued
+			for {
+				select {
+				case record := <-conflict_logger.record_ch:
+					conflict_logger.writeRecord(record)
+				default:
+					conflict_logger.reportDroppedRecords()
+					return
+				}
+			}
+		case record := <-conflict_logger.record_ch:
+			conflict_logger.writeRecord(record)
+		case <-report_ticker.C:
+			conflict_logger.reportDroppedRecords()
+		}
+	}
+}
+
+func (conflict_logger *ConflictLogger) writeRecord(record *conflict_log.Record) {
+	err := conflict_logger.sink.Write(record)
+	if err != nil {
+		conflict_logger.logger.Errorf("Failed to write conflict record for key %v in vb %v of pipeline %v. err=%v", record.Key, record.VBucket, record.ReplicationId, err)
+	}
+}
+
+func (conflict_logger *ConflictLogger) reportDroppedRecords() {
+	dropped_count := atomic.SwapUint64(&conflict_logger.dropped_count, 0)
+	if dropped_count > 0 {
+		conflict_logger.logger.Infof("Dropped %v conflict records for pipeline %v since conflict log queue was full", dropped_count, conflict_logger.pipeline.Topic())
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_svc
+
+import (
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/conflict_log"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/parts"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testConflictSink struct {
+	records []*conflict_log.Record
+	closed  bool
+}
+
+func (sink *testConflictSink) Write(record *conflict_log.Record) error {
+	sink.records = append(sink.records, record)
+	return nil
+}
+
+func (sink *testConflictSink) Close() error {
+	sink.closed = true
+	return nil
+}
+
+func newTestConflictEvent(key string, seqno uint64, with_meta bool) *common.Event {
+	event_otherInfo := parts.DataFailedCRSourceEventAdditional{Seqno: seqno, VBucket: 1}
+	if with_meta {
+		event_otherInfo.Source_meta = &base.DocumentMetadata{Key: []byte(key), Body: []byte(`{"a":1}`)}
+		event_otherInfo.Target_meta = &base.DocumentMetadata{Key: []byte(key)}
+	}
+	return common.NewEvent(common.DataFailedCRSource, nil, nil, nil, event_otherInfo)
+}
+
+func TestConflictLoggerDropsRecordsWhenQueueIsFull(t *testing.T) {
+	oldQueueSize := ConflictLogQueueSize
+	ConflictLogQueueSize = 2
+	defer func() {
+		ConflictLogQueueSize = oldQueueSize
+		conflict_log.RemoveRecentRecords(testCkptTopic)
+	}()
+
+	conflict_logger := NewConflictLogger(nil, log.DefaultLoggerContext)
+	conflict_logger.pipeline = &testCkptPipeline{}
+	conflict_logger.retention = time.Hour
+	sink := &testConflictSink{}
+	conflict_logger.sink = sink
+
+	// records are queued until the queue is full, while the sink is not being written
+	for i, key := range []string{"doc0", "doc1", "doc2", "doc3"} {
+		conflict_logger.ProcessEvent(newTestConflictEvent(key, uint64(i), true))
+	}
+	// events without metadata come from nozzles without conflict logging
+	conflict_logger.ProcessEvent(newTestConflictEvent("doc4", 4, false))
+
+	if dropped_count := atomic.LoadUint64(&conflict_logger.dropped_count); dropped_count != 2 {
+		t.Errorf("expected 2 records to be dropped, got %v", dropped_count)
+	}
+	// dropped records are still kept in memory
+	if _, total := conflict_log.RecentRecords(testCkptTopic, 0, 10); total != 4 {
+		t.Errorf("expected 4 recent records, got %v", total)
+	}
+
+	// the queued records are written out on stop, and the dropped count is reported and reset
+	conflict_logger.wait_grp.Add(1)
+	go conflict_logger.writeRecords()
+	if err := conflict_logger.Stop(); err != nil {
+		t.Fatalf("unexpected err=%v", err)
+	}
+	if len(sink.records) != 2 || sink.records[0].Key != "doc0" || sink.records[1].Key != "doc1" || !sink.closed {
+		t.Errorf("expected the first 2 records to be written and sink to be closed, got %v", sink.records)
+	}
+	if string(sink.records[0].SourceBody) != `{"a":1}` || sink.records[0].Target == nil {
+		t.Errorf("expected records in sink to have source body and target metadata, got %v", sink.records[0])
+	}
+	if dropped_count := atomic.LoadUint64(&conflict_logger.dropped_count); dropped_count != 0 {
+		t.Errorf("expected dropped count to be reset after report, got %v", dropped_count)
+	}
+}
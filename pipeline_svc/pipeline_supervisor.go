@@ -123,8 +123,11 @@ func (pipelineSupervisor *PipelineSupervisor) Start(settings map[string]interfac
 		max_dcp_miss_count = number_of_waits_to_ensure_stats_update
 	}
 
-	for _, dcp_nozzle := range pipelineSupervisor.pipeline.Sources() {
-		dcp_nozzle.(*parts.DcpNozzle).SetMaxMissCount(max_dcp_miss_count)
+	for _, source_nozzle := range pipelineSupervisor.pipeline.Sources() {
+		// replay nozzles do not read from dcp and cannot get stuck on it
+		if dcp_nozzle, ok := source_nozzle.(*parts.DcpNozzle); ok {
+			dcp_nozzle.SetMaxMissCount(max_dcp_miss_count)
+		}
 	}
 
 	// do the generic supervisor start stuff
@@ -276,8 +279,12 @@ func (pipelineSupervisor *PipelineSupervisor) checkPipelineHealth() error {
 		return nil
 	}
 
-	for _, dcp_nozzle := range pipelineSupervisor.pipeline.Sources() {
-		err = dcp_nozzle.(*parts.DcpNozzle).CheckStuckness(dcp_stats)
+	for _, source_nozzle := range pipelineSupervisor.pipeline.Sources() {
+		dcp_nozzle, ok := source_nozzle.(*parts.DcpNozzle)
+		if !ok {
+			continue
+		}
+		err = dcp_nozzle.CheckStuckness(dcp_stats)
 		if err != nil {
 			//declare pipeline broken
 			pipelineSupervisor.setError(dcp_nozzle.Id(), err)
@@ -46,23 +46,49 @@ const (
 	DATA_REPLICATED_METRIC = "data_replicated"
 	SIZE_REP_QUEUE_METRIC  = "size_rep_queue"
 	DOCS_REP_QUEUE_METRIC  = "docs_rep_queue"
+	// size of data replicated before compression. it is the same as data_replicated when compression is not enabled
+	DATA_REPLICATED_UNCOMPRESSED_METRIC = "data_replicated_uncompressed"
 
 	DOCS_FILTERED_METRIC     = "docs_filtered"
 	EXPIRY_FILTERED_METRIC   = "expiry_filtered"
 	DELETION_FILTERED_METRIC = "deletion_filtered"
 	SET_FILTERED_METRIC      = "set_filtered"
 
+	// the number of deletions and expirations dropped because of filter_deletions and filter_expirations settings.
+	// they are included in the stats above as well
+	DELETION_SETTING_FILTERED_METRIC = "deletion_setting_filtered"
+	EXPIRY_SETTING_FILTERED_METRIC   = "expiry_setting_filtered"
+	// the number of docs dropped since their keys cannot be rewritten by key rewrite rules. they are included in
+	// the stats above as well
+	KEY_REWRITE_FAILED_METRIC = "docs_key_rewrite_failed"
+
 	// the number of docs that failed conflict resolution on the source cluster side due to optimistic replication
 	DOCS_FAILED_CR_SOURCE_METRIC     = "docs_failed_cr_source"
 	EXPIRY_FAILED_CR_SOURCE_METRIC   = "expiry_failed_cr_source"
 	DELETION_FAILED_CR_SOURCE_METRIC = "deletion_failed_cr_source"
 	SET_FAILED_CR_SOURCE_METRIC      = "set_failed_cr_source"
 
+	// the number of docs that are not sent to target since later mutations of the same docs are sent in the same batch
+	DOCS_DEDUPED_METRIC = "docs_deduped"
+
+	// the number of docs that are permanently rejected by target and put into dead-letter store
+	DOCS_DEAD_LETTERED_METRIC = "docs_dead_lettered"
+
+	// effective batch count and size, in KB, of outgoing nozzles, which differ from the configured ones with adaptive batching
+	EFFECTIVE_BATCH_COUNT_METRIC = "effective_batch_count"
+	EFFECTIVE_BATCH_SIZE_METRIC  = "effective_batch_size_kb"
+
 	CHANGES_LEFT_METRIC = "changes_left"
 	DOCS_LATENCY_METRIC = "wtavg_docs_latency"
 	META_LATENCY_METRIC = "wtavg_meta_latency"
 	RESP_WAIT_METRIC    = "resp_wait_time"
 
+	// latency histograms, whose percentiles are published per stats interval as, e.g., docs_latency_p99
+	DOCS_LATENCY_HISTOGRAM = "docs_latency"
+	META_LATENCY_HISTOGRAM = "meta_latency"
+	RESP_WAIT_HISTOGRAM    = "resp_wait_time"
+	LATENCY_MAX_SUFFIX     = "_max"
+
 	//checkpointing related statistics
 	DOCS_CHECKED_METRIC    = "docs_checked" //calculated
 	NUM_CHECKPOINTS_METRIC = "num_checkpoints"
@@ -82,6 +108,8 @@ const (
 
 	DCP_DISPATCH_TIME_METRIC = "dcp_dispatch_time"
 	DCP_DATACH_LEN           = "dcp_datach_length"
+	// bytes received from dcp that have not been acknowledged to producer through dcp flow control
+	DCP_UNACKED_BYTES = "dcp_unacked_bytes"
 
 	//	TIME_COMMITTING_METRIC = "time_committing"
 	//rate
@@ -121,15 +149,23 @@ var StatsToClearForPausedReplications = [13]string{SIZE_REP_QUEUE_METRIC, DOCS_R
 	TIME_COMMITING_METRIC, NUM_FAILEDCKPTS_METRIC, RATE_DOC_CHECKS_METRIC, RATE_OPT_REPD_METRIC, RATE_RECEIVED_DCP_METRIC,
 	RATE_REPLICATED_METRIC, BANDWIDTH_USAGE_METRIC}
 
+var LatencyHistogramNames = []string{DOCS_LATENCY_HISTOGRAM, META_LATENCY_HISTOGRAM, RESP_WAIT_HISTOGRAM}
+
+// percentiles of latency histograms to publish, keyed by the suffix of the metric name
+var LatencyPercentiles = map[string]float64{"_p50": 50, "_p90": 90, "_p99": 99, "_p99_9": 99.9}
+
 // keys for metrics in overview 	125
 // note that DOCS_CHECKED_METRIC is not included since it needs special treatment 	126
 var OverviewMetricKeys = []string{DOCS_WRITTEN_METRIC, EXPIRY_DOCS_WRITTEN_METRIC, DELETION_DOCS_WRITTEN_METRIC,
 	SET_DOCS_WRITTEN_METRIC, DOCS_PROCESSED_METRIC, DOCS_FAILED_CR_SOURCE_METRIC, EXPIRY_FAILED_CR_SOURCE_METRIC,
 	DELETION_FAILED_CR_SOURCE_METRIC, SET_FAILED_CR_SOURCE_METRIC, DATA_REPLICATED_METRIC, DOCS_FILTERED_METRIC,
-	EXPIRY_FILTERED_METRIC, DELETION_FILTERED_METRIC, SET_FILTERED_METRIC, NUM_CHECKPOINTS_METRIC, NUM_FAILEDCKPTS_METRIC,
+	EXPIRY_FILTERED_METRIC, DELETION_FILTERED_METRIC, SET_FILTERED_METRIC, DELETION_SETTING_FILTERED_METRIC,
+	EXPIRY_SETTING_FILTERED_METRIC, NUM_CHECKPOINTS_METRIC, NUM_FAILEDCKPTS_METRIC,
 	TIME_COMMITING_METRIC, DOCS_OPT_REPD_METRIC, DOCS_RECEIVED_DCP_METRIC, EXPIRY_RECEIVED_DCP_METRIC,
 	DELETION_RECEIVED_DCP_METRIC, SET_RECEIVED_DCP_METRIC, SIZE_REP_QUEUE_METRIC, DOCS_REP_QUEUE_METRIC, DOCS_LATENCY_METRIC,
 	RESP_WAIT_METRIC, META_LATENCY_METRIC, DCP_DISPATCH_TIME_METRIC, DCP_DATACH_LEN,
+	DCP_UNACKED_BYTES, DOCS_DEDUPED_METRIC, DATA_REPLICATED_UNCOMPRESSED_METRIC, DOCS_DEAD_LETTERED_METRIC,
+	KEY_REWRITE_FAILED_METRIC,
 }
 
 type SampleStats struct {
@@ -198,6 +234,9 @@ type StatisticsManager struct {
 	through_seqno_tracker_svc service_def.ThroughSeqnoTrackerSvc
 	cluster_info_svc          service_def.ClusterInfoSvc
 	xdcr_topology_svc         service_def.XDCRCompTopologySvc
+
+	// latencies, in microseconds, recorded by outNozzleCollector since the last stats interval
+	latency_histograms map[string]*base.Histogram
 }
 
 func NewStatisticsManager(through_seqno_tracker_svc service_def.ThroughSeqnoTrackerSvc,
@@ -224,7 +263,11 @@ func NewStatisticsManager(through_seqno_tracker_svc service_def.ThroughSeqnoTrac
 		checkpointed_seqnos_lock:  sync.RWMutex{},
 		through_seqno_tracker_svc: through_seqno_tracker_svc,
 		cluster_info_svc:          cluster_info_svc,
-		xdcr_topology_svc:         xdcr_topology_svc}
+		xdcr_topology_svc:         xdcr_topology_svc,
+		latency_histograms:        make(map[string]*base.Histogram)}
+	for _, name := range LatencyHistogramNames {
+		stats_mgr.latency_histograms[name] = base.NewHistogram()
+	}
 	stats_mgr.collectors = []MetricsCollector{&outNozzleCollector{}, &dcpCollector{}, &routerCollector{}, &checkpointMgrCollector{}}
 
 	stats_mgr.initialize()
@@ -254,7 +297,14 @@ func (stats_mgr *StatisticsManager) cleanupBeforeExit() error {
 	if err != nil {
 		return err
 	}
-	rs.CleanupBeforeExit(StatsToClearForPausedReplications[:])
+	statsToClear := StatsToClearForPausedReplications[:]
+	for _, name := range LatencyHistogramNames {
+		for suffix, _ := range LatencyPercentiles {
+			statsToClear = append(statsToClear, name+suffix)
+		}
+		statsToClear = append(statsToClear, name+LATENCY_MAX_SUFFIX)
+	}
+	rs.CleanupBeforeExit(statsToClear)
 	statsLog, _ := stats_mgr.formatStatsForLog()
 	stats_mgr.logger.Infof("expvar=%v\n", statsLog)
 	return nil
@@ -349,13 +399,17 @@ func (stats_mgr *StatisticsManager) logStats() error {
 		for _, part := range outNozzle_parts {
 			if stats_mgr.pipeline.Specification().Settings.RepType == metadata.ReplicationTypeXmem {
 				stats_mgr.logger.Info(part.(*parts.XmemNozzle).StatusSummary())
+			} else if stats_mgr.pipeline.Specification().Settings.RepType == metadata.ReplicationTypeFile {
+				stats_mgr.logger.Info(part.(*parts.FileNozzle).StatusSummary())
+			} else if stats_mgr.pipeline.Specification().Settings.RepType == metadata.ReplicationTypeWebhook {
+				stats_mgr.logger.Info(part.(*parts.WebhookNozzle).StatusSummary())
 			} else {
 				stats_mgr.logger.Info(part.(*parts.CapiNozzle).StatusSummary())
 			}
 		}
 		dcp_parts := stats_mgr.pipeline.Sources()
 		for _, part := range dcp_parts {
-			stats_mgr.logger.Info(part.(*parts.DcpNozzle).StatusSummary())
+			stats_mgr.logger.Info(part.(parts.SourceNozzle).StatusSummary())
 		}
 
 		// log listener summary
@@ -551,9 +605,27 @@ func (stats_mgr *StatisticsManager) processCalculatedStats(overview_expvar_map *
 	rate_doc_checks_var := new(expvar.Float)
 	rate_doc_checks_var.Set(rate_doc_checks)
 	overview_expvar_map.Set(RATE_DOC_CHECKS_METRIC, rate_doc_checks_var)
+
+	stats_mgr.publishLatencyPercentiles(overview_expvar_map)
 	return nil
 }
 
+// publishes the percentiles and max, in milliseconds, of the latencies recorded since the last stats interval,
+// and resets the histograms for the next interval. wtavg_docs_latency and wtavg_meta_latency are kept for compatibility
+func (stats_mgr *StatisticsManager) publishLatencyPercentiles(overview_expvar_map *expvar.Map) {
+	for _, name := range LatencyHistogramNames {
+		histogram := stats_mgr.latency_histograms[name].SnapshotAndReset()
+		for suffix, percentile := range LatencyPercentiles {
+			latency_var := new(expvar.Float)
+			latency_var.Set(float64(histogram.Percentile(percentile)) / 1000)
+			overview_expvar_map.Set(name+suffix, latency_var)
+		}
+		max_var := new(expvar.Float)
+		max_var.Set(float64(histogram.Max()) / 1000)
+		overview_expvar_map.Set(name+LATENCY_MAX_SUFFIX, max_var)
+	}
+}
+
 func (stats_mgr *StatisticsManager) calculateDocsProcessed() int64 {
 	var docs_processed uint64 = 0
 	through_seqno_map := stats_mgr.through_seqno_tracker_svc.GetThroughSeqnos()
@@ -792,8 +864,14 @@ func (outNozzle_collector *outNozzleCollector) Mount(pipeline common.Pipeline, s
 		registry.Register(DELETION_FAILED_CR_SOURCE_METRIC, deletion_failed_cr)
 		set_failed_cr := metrics.NewCounter()
 		registry.Register(SET_FAILED_CR_SOURCE_METRIC, set_failed_cr)
+		docs_deduped := metrics.NewCounter()
+		registry.Register(DOCS_DEDUPED_METRIC, docs_deduped)
+		docs_dead_lettered := metrics.NewCounter()
+		registry.Register(DOCS_DEAD_LETTERED_METRIC, docs_dead_lettered)
 		data_replicated := metrics.NewCounter()
 		registry.Register(DATA_REPLICATED_METRIC, data_replicated)
+		data_replicated_uncompressed := metrics.NewCounter()
+		registry.Register(DATA_REPLICATED_UNCOMPRESSED_METRIC, data_replicated_uncompressed)
 		docs_opt_repd := metrics.NewCounter()
 		registry.Register(DOCS_OPT_REPD_METRIC, docs_opt_repd)
 		docs_latency := metrics.NewHistogram(metrics.NewUniformSample(stats_mgr.sample_size))
@@ -802,6 +880,10 @@ func (outNozzle_collector *outNozzleCollector) Mount(pipeline common.Pipeline, s
 		registry.Register(RESP_WAIT_METRIC, resp_wait)
 		meta_latency := metrics.NewHistogram(metrics.NewUniformSample(stats_mgr.sample_size))
 		registry.Register(META_LATENCY_METRIC, meta_latency)
+		effective_batch_count := metrics.NewCounter()
+		registry.Register(EFFECTIVE_BATCH_COUNT_METRIC, effective_batch_count)
+		effective_batch_size := metrics.NewCounter()
+		registry.Register(EFFECTIVE_BATCH_SIZE_METRIC, effective_batch_size)
 
 		metric_map := make(map[string]interface{})
 		metric_map[SIZE_REP_QUEUE_METRIC] = size_rep_queue
@@ -814,11 +896,16 @@ func (outNozzle_collector *outNozzleCollector) Mount(pipeline common.Pipeline, s
 		metric_map[EXPIRY_FAILED_CR_SOURCE_METRIC] = expiry_failed_cr
 		metric_map[DELETION_FAILED_CR_SOURCE_METRIC] = deletion_failed_cr
 		metric_map[SET_FAILED_CR_SOURCE_METRIC] = set_failed_cr
+		metric_map[DOCS_DEDUPED_METRIC] = docs_deduped
+		metric_map[DOCS_DEAD_LETTERED_METRIC] = docs_dead_lettered
 		metric_map[DATA_REPLICATED_METRIC] = data_replicated
+		metric_map[DATA_REPLICATED_UNCOMPRESSED_METRIC] = data_replicated_uncompressed
 		metric_map[DOCS_OPT_REPD_METRIC] = docs_opt_repd
 		metric_map[DOCS_LATENCY_METRIC] = docs_latency
 		metric_map[RESP_WAIT_METRIC] = resp_wait
 		metric_map[META_LATENCY_METRIC] = meta_latency
+		metric_map[EFFECTIVE_BATCH_COUNT_METRIC] = effective_batch_count
+		metric_map[EFFECTIVE_BATCH_SIZE_METRIC] = effective_batch_size
 		outNozzle_collector.component_map[part.Id()] = metric_map
 
 		// register outNozzle_collector as the sync event listener/handler for StatsUpdate event
@@ -830,6 +917,8 @@ func (outNozzle_collector *outNozzleCollector) Mount(pipeline common.Pipeline, s
 	pipeline_utils.RegisterAsyncComponentEventHandler(async_listener_map, base.DataSentEventListener, outNozzle_collector)
 	pipeline_utils.RegisterAsyncComponentEventHandler(async_listener_map, base.DataFailedCREventListener, outNozzle_collector)
 	pipeline_utils.RegisterAsyncComponentEventHandler(async_listener_map, base.GetMetaReceivedEventListener, outNozzle_collector)
+	pipeline_utils.RegisterAsyncComponentEventHandler(async_listener_map, base.DataDedupedEventListener, outNozzle_collector)
+	pipeline_utils.RegisterAsyncComponentEventHandler(async_listener_map, base.DataDeadLetteredEventListener, outNozzle_collector)
 
 	return nil
 }
@@ -850,6 +939,8 @@ func (outNozzle_collector *outNozzleCollector) ProcessEvent(event *common.Event)
 		queue_size_bytes := event.OtherInfos.([]int)[1]
 		setCounter(metric_map[DOCS_REP_QUEUE_METRIC].(metrics.Counter), queue_size)
 		setCounter(metric_map[SIZE_REP_QUEUE_METRIC].(metrics.Counter), queue_size_bytes)
+		setCounter(metric_map[EFFECTIVE_BATCH_COUNT_METRIC].(metrics.Counter), event.OtherInfos.([]int)[2])
+		setCounter(metric_map[EFFECTIVE_BATCH_SIZE_METRIC].(metrics.Counter), event.OtherInfos.([]int)[3])
 	} else if event.EventType == common.DataSent {
 		outNozzle_collector.stats_mgr.logger.Debugf("Received a DataSent event from %v", reflect.TypeOf(event.Component))
 		event_otherInfo := event.OtherInfos.(parts.DataSentEventAdditional)
@@ -859,6 +950,7 @@ func (outNozzle_collector *outNozzleCollector) ProcessEvent(event *common.Event)
 		resp_wait_time := event_otherInfo.Resp_wait_time
 		metric_map[DOCS_WRITTEN_METRIC].(metrics.Counter).Inc(1)
 		metric_map[DATA_REPLICATED_METRIC].(metrics.Counter).Inc(int64(req_size))
+		metric_map[DATA_REPLICATED_UNCOMPRESSED_METRIC].(metrics.Counter).Inc(int64(event_otherInfo.Uncompressed_req_size))
 		if opti_replicated {
 			metric_map[DOCS_OPT_REPD_METRIC].(metrics.Counter).Inc(1)
 		}
@@ -879,6 +971,8 @@ func (outNozzle_collector *outNozzleCollector) ProcessEvent(event *common.Event)
 
 		metric_map[DOCS_LATENCY_METRIC].(metrics.Histogram).Sample().Update(commit_time.Nanoseconds() / 1000000)
 		metric_map[RESP_WAIT_METRIC].(metrics.Histogram).Sample().Update(resp_wait_time.Nanoseconds() / 1000000)
+		outNozzle_collector.stats_mgr.latency_histograms[DOCS_LATENCY_HISTOGRAM].Record(commit_time.Nanoseconds() / 1000)
+		outNozzle_collector.stats_mgr.latency_histograms[RESP_WAIT_HISTOGRAM].Record(resp_wait_time.Nanoseconds() / 1000)
 	} else if event.EventType == common.DataFailedCRSource {
 		outNozzle_collector.stats_mgr.logger.Debugf("Received a DataFailedCRSource event from %v", reflect.TypeOf(event.Component))
 		metric_map[DOCS_FAILED_CR_SOURCE_METRIC].(metrics.Counter).Inc(1)
@@ -896,11 +990,18 @@ func (outNozzle_collector *outNozzleCollector) ProcessEvent(event *common.Event)
 		} else {
 			panic(fmt.Sprintf("Invalid opcode, %v, in DataFailedCRSource event from %v.", req_opcode, event.Component.Id()))
 		}
+	} else if event.EventType == common.DataDeduped {
+		outNozzle_collector.stats_mgr.logger.Debugf("Received a DataDeduped event from %v", reflect.TypeOf(event.Component))
+		metric_map[DOCS_DEDUPED_METRIC].(metrics.Counter).Inc(1)
+	} else if event.EventType == common.DataDeadLettered {
+		outNozzle_collector.stats_mgr.logger.Debugf("Received a DataDeadLettered event from %v", reflect.TypeOf(event.Component))
+		metric_map[DOCS_DEAD_LETTERED_METRIC].(metrics.Counter).Inc(1)
 	} else if event.EventType == common.GetMetaReceived {
 		outNozzle_collector.stats_mgr.logger.Debugf("Received a GetMetaReceived event from %v", reflect.TypeOf(event.Component))
 		event_otherInfos := event.OtherInfos.(parts.GetMetaReceivedEventAdditional)
 		commit_time := event_otherInfos.Commit_time
 		metric_map[META_LATENCY_METRIC].(metrics.Histogram).Sample().Update(commit_time.Nanoseconds() / 1000000)
+		outNozzle_collector.stats_mgr.latency_histograms[META_LATENCY_HISTOGRAM].Record(commit_time.Nanoseconds() / 1000)
 	}
 
 	return nil
@@ -939,6 +1040,8 @@ func (dcp_collector *dcpCollector) Mount(pipeline common.Pipeline, stats_mgr *St
 		registry.Register(DCP_DISPATCH_TIME_METRIC, dcp_dispatch_time)
 		dcp_datach_len := metrics.NewCounter()
 		registry.Register(DCP_DATACH_LEN, dcp_datach_len)
+		dcp_unacked_bytes := metrics.NewCounter()
+		registry.Register(DCP_UNACKED_BYTES, dcp_unacked_bytes)
 
 		metric_map := make(map[string]interface{})
 		metric_map[DOCS_RECEIVED_DCP_METRIC] = docs_received_dcp
@@ -947,6 +1050,7 @@ func (dcp_collector *dcpCollector) Mount(pipeline common.Pipeline, stats_mgr *St
 		metric_map[SET_RECEIVED_DCP_METRIC] = set_received_dcp
 		metric_map[DCP_DISPATCH_TIME_METRIC] = dcp_dispatch_time
 		metric_map[DCP_DATACH_LEN] = dcp_datach_len
+		metric_map[DCP_UNACKED_BYTES] = dcp_unacked_bytes
 		dcp_collector.component_map[dcp_part.Id()] = metric_map
 
 		dcp_part.RegisterComponentEventListener(common.StatsUpdate, dcp_collector)
@@ -974,22 +1078,23 @@ func (dcp_collector *dcpCollector) ProcessEvent(event *common.Event) error {
 		uprEvent := event.Data.(*mcc.UprEvent)
 		metric_map[DOCS_RECEIVED_DCP_METRIC].(metrics.Counter).Inc(1)
 
-		if uprEvent.Expiry != 0 {
+		if uprEvent.Expiry != 0 || uprEvent.Opcode == mc.UPR_EXPIRATION {
 			metric_map[EXPIRY_RECEIVED_DCP_METRIC].(metrics.Counter).Inc(1)
 		}
 		if uprEvent.Opcode == mc.UPR_DELETION {
 			metric_map[DELETION_RECEIVED_DCP_METRIC].(metrics.Counter).Inc(1)
 		} else if uprEvent.Opcode == mc.UPR_MUTATION {
 			metric_map[SET_RECEIVED_DCP_METRIC].(metrics.Counter).Inc(1)
-		} else {
+		} else if uprEvent.Opcode != mc.UPR_EXPIRATION {
 			panic(fmt.Sprintf("Invalid opcode, %v, in DataReceived event from %v.", uprEvent.Opcode, event.Component.Id()))
 		}
 	} else if event.EventType == common.DataProcessed {
 		dcp_dispatch_time := event.OtherInfos.(float64)
 		metric_map[DCP_DISPATCH_TIME_METRIC].(metrics.Histogram).Sample().Update(int64(dcp_dispatch_time))
 	} else if event.EventType == common.StatsUpdate {
-		dcp_datach_len := event.OtherInfos.(int)
-		setCounter(metric_map[DCP_DATACH_LEN].(metrics.Counter), dcp_datach_len)
+		dcp_stats := event.OtherInfos.([]int)
+		setCounter(metric_map[DCP_DATACH_LEN].(metrics.Counter), dcp_stats[0])
+		setCounter(metric_map[DCP_UNACKED_BYTES].(metrics.Counter), dcp_stats[1])
 	}
 
 	return nil
@@ -1019,12 +1124,21 @@ func (r_collector *routerCollector) Mount(pipeline common.Pipeline, stats_mgr *S
 		registry_router.Register(DELETION_FILTERED_METRIC, deletion_filtered)
 		set_filtered := metrics.NewCounter()
 		registry_router.Register(SET_FILTERED_METRIC, set_filtered)
+		deletion_setting_filtered := metrics.NewCounter()
+		registry_router.Register(DELETION_SETTING_FILTERED_METRIC, deletion_setting_filtered)
+		expiry_setting_filtered := metrics.NewCounter()
+		registry_router.Register(EXPIRY_SETTING_FILTERED_METRIC, expiry_setting_filtered)
+		key_rewrite_failed := metrics.NewCounter()
+		registry_router.Register(KEY_REWRITE_FAILED_METRIC, key_rewrite_failed)
 
 		metric_map := make(map[string]interface{})
 		metric_map[DOCS_FILTERED_METRIC] = docs_filtered
 		metric_map[EXPIRY_FILTERED_METRIC] = expiry_filtered
 		metric_map[DELETION_FILTERED_METRIC] = deletion_filtered
 		metric_map[SET_FILTERED_METRIC] = set_filtered
+		metric_map[DELETION_SETTING_FILTERED_METRIC] = deletion_setting_filtered
+		metric_map[EXPIRY_SETTING_FILTERED_METRIC] = expiry_setting_filtered
+		metric_map[KEY_REWRITE_FAILED_METRIC] = key_rewrite_failed
 		r_collector.component_map[conn.Id()] = metric_map
 	}
 
@@ -1045,16 +1159,28 @@ func (r_collector *routerCollector) ProcessEvent(event *common.Event) error {
 		r_collector.stats_mgr.logger.Debugf("Received a DataFiltered event for %v", seqno)
 		metric_map[DOCS_FILTERED_METRIC].(metrics.Counter).Inc(1)
 
-		if uprEvent.Expiry != 0 {
+		if uprEvent.Expiry != 0 || uprEvent.Opcode == mc.UPR_EXPIRATION {
 			metric_map[EXPIRY_FILTERED_METRIC].(metrics.Counter).Inc(1)
 		}
 		if uprEvent.Opcode == mc.UPR_DELETION {
 			metric_map[DELETION_FILTERED_METRIC].(metrics.Counter).Inc(1)
 		} else if uprEvent.Opcode == mc.UPR_MUTATION {
 			metric_map[SET_FILTERED_METRIC].(metrics.Counter).Inc(1)
-		} else {
+		} else if uprEvent.Opcode != mc.UPR_EXPIRATION {
 			panic(fmt.Sprintf("Invalid opcode, %v, in DataFiltered event from %v.", uprEvent.Opcode, event.Component.Id()))
 		}
+
+		event_otherInfos, ok := event.OtherInfos.(parts.DataFilteredEventAdditional)
+		if ok && event_otherInfos.FilteredBySetting {
+			if uprEvent.Opcode == mc.UPR_DELETION {
+				metric_map[DELETION_SETTING_FILTERED_METRIC].(metrics.Counter).Inc(1)
+			} else if uprEvent.Opcode == mc.UPR_EXPIRATION {
+				metric_map[EXPIRY_SETTING_FILTERED_METRIC].(metrics.Counter).Inc(1)
+			}
+		}
+		if ok && event_otherInfos.KeyRewriteFailed {
+			metric_map[KEY_REWRITE_FAILED_METRIC].(metrics.Counter).Inc(1)
+		}
 	}
 
 	return nil
@@ -339,6 +339,10 @@ func (top_detect_svc *TopologyChangeDetectorSvc) validateTargetVersionForExtMeta
 // 2. second bool indicates whether the first bool needs to be recomputed at the next check
 func (top_detect_svc *TopologyChangeDetectorSvc) needCheckTargetForSSL() (bool, bool) {
 	spec := top_detect_svc.pipeline.Specification()
+	if !spec.HasTargetCluster() {
+		// there is no target cluster for replications of file and webhook types
+		return false, false
+	}
 	targetClusterRef, err := top_detect_svc.remote_cluster_svc.RemoteClusterByUuid(spec.TargetClusterUUID, false)
 	if err == nil {
 		if !targetClusterRef.DemandEncryption {
@@ -376,6 +380,10 @@ func (top_detect_svc *TopologyChangeDetectorSvc) needCheckTargetForExtMeta() (bo
 	}
 	var err error
 	spec := top_detect_svc.pipeline.Specification()
+	if !spec.HasTargetCluster() {
+		// nor for replications without target cluster
+		return false, false
+	}
 	targetClusterRef, err := top_detect_svc.remote_cluster_svc.RemoteClusterByUuid(spec.TargetClusterUUID, false)
 	if err == nil {
 		var extMetaSupportedByTarget bool
@@ -433,6 +441,10 @@ func (top_detect_svc *TopologyChangeDetectorSvc) validateTargetTopology() ([]uin
 
 func (top_detect_svc *TopologyChangeDetectorSvc) getTargetVBServerMap() (map[uint16]string, error) {
 	spec := top_detect_svc.pipeline.Specification()
+	if !spec.HasTargetCluster() {
+		// there is no target topology to change for replications without target cluster
+		return make(map[uint16]string), nil
+	}
 	targetClusterRef, err := top_detect_svc.remote_cluster_svc.RemoteClusterByUuid(spec.TargetClusterUUID, false)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,186 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_svc
+
+import (
+	"fmt"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"github.com/couchbase/goxdcr/parts"
+	pipeline_pkg "github.com/couchbase/goxdcr/pipeline"
+	"github.com/couchbase/goxdcr/pipeline_manager"
+	"github.com/couchbase/goxdcr/pipeline_utils"
+	"github.com/couchbase/goxdcr/service_def"
+	"github.com/couchbase/goxdcr/utils"
+	"sort"
+)
+
+// progress of the replication of a source vbucket on the local node
+type VBProgress struct {
+	Vbno            uint16 `json:"vbno"`
+	SourceHighSeqno uint64 `json:"sourceHighSeqno"`
+	// through seqno of the running pipeline. 0 when the replication is not running
+	ThroughSeqno uint64 `json:"throughSeqno"`
+	// seqno and target vb opaque of the last checkpoint persisted for the vbucket
+	CheckpointSeqno uint64                  `json:"checkpointSeqno"`
+	TargetVBOpaque  metadata.TargetVBOpaque `json:"targetVBOpaque"`
+	// state of the dcp stream. empty when the replication is not running
+	StreamState string `json:"streamState"`
+	// the number of mutations of the vbucket that are yet to be processed. when the replication is not running,
+	// it is computed off the checkpoint seqno, as for the changes_left stat of paused replications.
+	// it is 0 when the seqno is beyond the high seqno, e.g., after source has rolled back
+	ChangesLeft int64 `json:"changesLeft"`
+	// the dcp nozzle and the outgoing nozzle that own the vbucket. empty when the replication is not running.
+	// the outgoing nozzle is empty also when vbs are remapped, since the docs of the vbucket are then spread
+	// over all outgoing nozzles
+	SourceNozzle string `json:"sourceNozzle"`
+	OutNozzle    string `json:"outNozzle"`
+}
+
+// progress of a replication on the local node, broken down by vbucket
+type ReplicationVBProgress struct {
+	ReplicationId string        `json:"id"`
+	Running       bool          `json:"running"`
+	VBuckets      []*VBProgress `json:"vbuckets"`
+}
+
+// computes the per vbucket progress of a replication, which may or may not be running.
+// the high seqnos are read from source kv with connections of its own, so as not to share
+// the connections of statistics manager
+func GetVBProgressForReplication(spec *metadata.ReplicationSpecification, cluster_info_svc service_def.ClusterInfoSvc,
+	xdcr_topology_svc service_def.XDCRCompTopologySvc, checkpoints_svc service_def.CheckpointsService,
+	logger *log.CommonLogger) (*ReplicationVBProgress, error) {
+	kv_vb_map, err := pipeline_utils.GetSourceVBMap(cluster_info_svc, xdcr_topology_svc, spec.SourceBucketName, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	highseqno_map := make(map[uint16]uint64)
+	for serverAddr, vbnos := range kv_vb_map {
+		err = getHighSeqNosFromServer(serverAddr, spec.SourceBucketName, vbnos, highseqno_map, logger)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get high seqnos from %v. err=%v", serverAddr, err)
+		}
+	}
+
+	ckptDocs, err := checkpoints_svc.CheckpointsDocs(spec.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	progress := &ReplicationVBProgress{ReplicationId: spec.Id, VBuckets: make([]*VBProgress, 0)}
+	vb_progress_map := make(map[uint16]*VBProgress)
+	for _, vbnos := range kv_vb_map {
+		for _, vbno := range vbnos {
+			vb_progress := newVBProgress(vbno, highseqno_map[vbno], ckptDocs[vbno])
+			vb_progress_map[vbno] = vb_progress
+			progress.VBuckets = append(progress.VBuckets, vb_progress)
+		}
+	}
+	sort.Sort(vbProgressByVbno(progress.VBuckets))
+
+	progress.Running = addRuntimeVBProgress(spec.Id, vb_progress_map)
+	return progress, nil
+}
+
+// progress of a vbucket off its last checkpoint
+func newVBProgress(vbno uint16, highseqno uint64, ckptDoc *metadata.CheckpointsDoc) *VBProgress {
+	vb_progress := &VBProgress{Vbno: vbno, SourceHighSeqno: highseqno}
+	if ckptDoc != nil && len(ckptDoc.Checkpoint_records) > 0 && ckptDoc.Checkpoint_records[0] != nil {
+		vb_progress.CheckpointSeqno = ckptDoc.Checkpoint_records[0].Seqno
+		vb_progress.TargetVBOpaque = ckptDoc.Checkpoint_records[0].Target_vb_opaque
+	}
+	vb_progress.ChangesLeft = changesLeft(highseqno, vb_progress.CheckpointSeqno)
+	return vb_progress
+}
+
+func changesLeft(highseqno, seqno uint64) int64 {
+	if seqno >= highseqno {
+		return 0
+	}
+	return int64(highseqno - seqno)
+}
+
+// returns the outgoing nozzle that the docs of the source vbucket are routed to. empty when vbs are remapped,
+// since the routing map of the router is then keyed by target vbnos
+func outNozzleForVB(router *parts.Router, vbno uint16) string {
+	if router == nil || router.VBsRemapped() {
+		return ""
+	}
+	return router.RoutingMap()[vbno]
+}
+
+// fills in the parts of vb progress that come from the running pipeline of the replication.
+// returns false if the replication is not running
+func addRuntimeVBProgress(topic string, vb_progress_map map[uint16]*VBProgress) bool {
+	rep_status, _ := pipeline_manager.ReplicationStatus(topic)
+	if rep_status == nil || rep_status.RuntimeStatus(true) != pipeline_pkg.Replicating {
+		return false
+	}
+	pipeline := rep_status.Pipeline()
+	if pipeline == nil || pipeline.RuntimeContext() == nil {
+		return false
+	}
+	stats_mgr, ok := pipeline.RuntimeContext().Service(base.STATISTICS_MGR_SVC).(*StatisticsManager)
+	if !ok || stats_mgr == nil {
+		return false
+	}
+
+	for vbno, through_seqno := range stats_mgr.through_seqno_tracker_svc.GetThroughSeqnos() {
+		if vb_progress, ok := vb_progress_map[vbno]; ok {
+			vb_progress.ThroughSeqno = through_seqno
+			vb_progress.ChangesLeft = changesLeft(vb_progress.SourceHighSeqno, through_seqno)
+		}
+	}
+
+	for _, source := range pipeline.Sources() {
+		dcp, ok := source.(*parts.DcpNozzle)
+		if !ok {
+			continue
+		}
+		router, _ := dcp.Connector().(*parts.Router)
+		for _, vbno := range dcp.GetVBList() {
+			vb_progress, ok := vb_progress_map[vbno]
+			if !ok {
+				continue
+			}
+			vb_progress.SourceNozzle = dcp.Id()
+			vb_progress.OutNozzle = outNozzleForVB(router, vbno)
+			if stream_state, err := dcp.GetStreamState(vbno); err == nil {
+				vb_progress.StreamState = stream_state.String()
+			}
+		}
+	}
+	return true
+}
+
+func getHighSeqNosFromServer(serverAddr, bucketName string, vbnos []uint16, highseqno_map map[uint16]uint64, logger *log.CommonLogger) error {
+	conn, err := utils.GetMemcachedConnection(serverAddr, bucketName, logger)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	highseqno_map_for_server, err := getHighSeqNos(serverAddr, vbnos, conn)
+	if err != nil {
+		return err
+	}
+	for vbno, highseqno := range highseqno_map_for_server {
+		highseqno_map[vbno] = highseqno
+	}
+	return nil
+}
+
+type vbProgressByVbno []*VBProgress
+
+func (list vbProgressByVbno) Len() int           { return len(list) }
+func (list vbProgressByVbno) Swap(i, j int)      { list[i], list[j] = list[j], list[i] }
+func (list vbProgressByVbno) Less(i, j int) bool { return list[i].Vbno < list[j].Vbno }
@@ -0,0 +1,87 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_svc
+
+import (
+	"github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"github.com/couchbase/goxdcr/parts"
+	"testing"
+)
+
+func newTestVBProgressRouter(t *testing.T, targetNumOfVBs int) *parts.Router {
+	routingMap := map[uint16]string{}
+	for vbno := uint16(0); vbno < 1024; vbno++ {
+		routingMap[vbno] = []string{"out0", "out1"}[vbno%2]
+	}
+	router, err := parts.NewRouter("router", "topic", "", "", false, false, "", targetNumOfVBs, map[string]common.Part{}, routingMap,
+		log.DefaultLoggerContext, nil, false)
+	if err != nil {
+		t.Fatalf("failed to create router. err=%v", err)
+	}
+	return router
+}
+
+func TestVBProgressFromCheckpoint(t *testing.T) {
+	ckptDoc := &metadata.CheckpointsDoc{Checkpoint_records: []*metadata.CheckpointRecord{
+		&metadata.CheckpointRecord{Seqno: 80, Target_vb_opaque: &metadata.TargetVBUuid{Target_vb_uuid: 1234}},
+		&metadata.CheckpointRecord{Seqno: 50},
+	}}
+	vb_progress := newVBProgress(5, 100, ckptDoc)
+	if vb_progress.Vbno != 5 || vb_progress.SourceHighSeqno != 100 || vb_progress.CheckpointSeqno != 80 || vb_progress.ChangesLeft != 20 {
+		t.Errorf("unexpected vb progress %+v", vb_progress)
+	}
+	if vb_progress.TargetVBOpaque == nil || vb_progress.TargetVBOpaque.Value() != uint64(1234) {
+		t.Errorf("unexpected target vb opaque %v", vb_progress.TargetVBOpaque)
+	}
+
+	// vbs without checkpoints have all their mutations left
+	vb_progress = newVBProgress(6, 100, nil)
+	if vb_progress.CheckpointSeqno != 0 || vb_progress.TargetVBOpaque != nil || vb_progress.ChangesLeft != 100 {
+		t.Errorf("unexpected vb progress %+v", vb_progress)
+	}
+}
+
+func TestVBProgressChangesLeftBeyondHighSeqno(t *testing.T) {
+	// source has rolled back below the checkpoint
+	ckptDoc := &metadata.CheckpointsDoc{Checkpoint_records: []*metadata.CheckpointRecord{&metadata.CheckpointRecord{Seqno: 120}}}
+	if vb_progress := newVBProgress(5, 100, ckptDoc); vb_progress.ChangesLeft != 0 {
+		t.Errorf("expected no changes left, got %v", vb_progress.ChangesLeft)
+	}
+
+	if changes_left := changesLeft(100, 100); changes_left != 0 {
+		t.Errorf("expected no changes left, got %v", changes_left)
+	}
+	// the through seqno could be ahead of a high seqno that was retrieved earlier
+	if changes_left := changesLeft(100, 105); changes_left != 0 {
+		t.Errorf("expected no changes left, got %v", changes_left)
+	}
+	if changes_left := changesLeft(100, 40); changes_left != 60 {
+		t.Errorf("expected 60 changes left, got %v", changes_left)
+	}
+}
+
+func TestVBProgressOutNozzle(t *testing.T) {
+	router := newTestVBProgressRouter(t, 0)
+	if out := outNozzleForVB(router, 3); out != "out1" {
+		t.Errorf("expected out nozzle out1, got %v", out)
+	}
+
+	// the docs of a source vb go to all outgoing nozzles when vbs are remapped
+	router = newTestVBProgressRouter(t, 1024)
+	if out := outNozzleForVB(router, 3); out != "" {
+		t.Errorf("expected no out nozzle when vbs are remapped, got %v", out)
+	}
+
+	if out := outNozzleForVB(nil, 3); out != "" {
+		t.Errorf("expected no out nozzle without a router, got %v", out)
+	}
+}
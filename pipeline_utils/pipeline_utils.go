@@ -26,7 +26,7 @@ func GetSourceVBListPerPipeline(pipeline common.Pipeline) []uint16 {
 	ret := []uint16{}
 	sourceNozzles := pipeline.Sources()
 	for _, sourceNozzle := range sourceNozzles {
-		ret = append(ret, sourceNozzle.(*parts.DcpNozzle).GetVBList()...)
+		ret = append(ret, sourceNozzle.(parts.SourceNozzle).GetVBList()...)
 	}
 	return ret
 }
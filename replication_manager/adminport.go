@@ -18,12 +18,15 @@ import (
 	"github.com/couchbase/cbauth"
 	ap "github.com/couchbase/goxdcr/adminport"
 	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/conflict_log"
+	"github.com/couchbase/goxdcr/dead_letter"
 	"github.com/couchbase/goxdcr/gen_server"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/metadata"
 	"github.com/couchbase/goxdcr/pipeline_manager"
 	"github.com/couchbase/goxdcr/simple_utils"
 	"github.com/couchbase/goxdcr/utils"
+	"github.com/couchbase/goxdcr/verify"
 	"net/http"
 	"runtime"
 	"strconv"
@@ -33,8 +36,8 @@ import (
 
 import _ "net/http/pprof"
 
-var StaticPaths = []string{base.RemoteClustersPath, CreateReplicationPath, InternalSettingsPath, SettingsReplicationsPath, AllReplicationsPath, AllReplicationInfosPath, RegexpValidationPrefix, MemStatsPath, BlockProfileStartPath, BlockProfileStopPath, XDCRInternalSettingsPath}
-var DynamicPathPrefixes = []string{base.RemoteClustersPath, DeleteReplicationPrefix, SettingsReplicationsPath, StatisticsPrefix, AllReplicationsPath, BucketSettingsPrefix}
+var StaticPaths = []string{base.RemoteClustersPath, CreateReplicationPath, InternalSettingsPath, SettingsReplicationsPath, AllReplicationsPath, AllReplicationInfosPath, RegexpValidationPrefix, MemStatsPath, BlockProfileStartPath, BlockProfileStopPath, XDCRInternalSettingsPath, FilterDryRunPath, FaultInjectionPath, PrometheusMetricsPath}
+var DynamicPathPrefixes = []string{base.RemoteClustersPath, DeleteReplicationPrefix, SettingsReplicationsPath, StatisticsPrefix, AllReplicationsPath, BucketSettingsPrefix, ConflictLogPrefix, DeadLettersPrefix, FaultInjectionPath, VerifyPrefix, VerifyDiffPrefix, VBProgressPrefix}
 
 var logger_ap *log.CommonLogger = log.NewLogger("AdminPort", log.DefaultLoggerContext)
 
@@ -191,16 +194,44 @@ func (adminport *Adminport) handleRequest(
 		response, err = adminport.doGetStatisticsRequest(request)
 	case RegexpValidationPrefix + base.UrlDelimiter + base.MethodPost:
 		response, err = adminport.doRegexpValidationRequest(request)
+	case FilterDryRunPath + base.UrlDelimiter + base.MethodPost:
+		response, err = adminport.doFilterDryRunRequest(request)
 	case MemStatsPath + base.UrlDelimiter + base.MethodGet:
 		response, err = adminport.doMemStatsRequest(request)
+	case PrometheusMetricsPath + base.UrlDelimiter + base.MethodGet:
+		response, err = adminport.doGetPrometheusMetricsRequest(request)
 	case BlockProfileStartPath + base.UrlDelimiter + base.MethodPost:
 		response, err = adminport.doStartBlockProfile(request)
 	case BlockProfileStopPath + base.UrlDelimiter + base.MethodPost:
 		response, err = adminport.doStopBlockProfile(request)
+	case ConflictLogPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodGet:
+		return adminport.doGetConflictLogRequest(request)
+	case DeadLettersPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodGet:
+		response, err = adminport.doGetDeadLettersRequest(request)
+	case DeadLettersPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodPost:
+		response, err = adminport.doRetryDeadLettersRequest(request)
+	case VerifyPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodPost:
+		response, err = adminport.doStartVerifyRequest(request)
+	case VerifyPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodGet:
+		response, err = adminport.doGetVerifyRequest(request)
+	case VerifyPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodDelete:
+		response, err = adminport.doCancelVerifyRequest(request)
+	case VerifyDiffPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodGet:
+		response, err = adminport.doGetVerifyDiffRequest(request)
+	case VBProgressPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodGet:
+		response, err = adminport.doGetVBProgressRequest(request)
 	case BucketSettingsPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodGet:
 		response, err = adminport.doGetBucketSettingsRequest(request)
 	case BucketSettingsPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodPost:
 		response, err = adminport.doBucketSettingsChangeRequest(request)
+	case FaultInjectionPath + base.UrlDelimiter + base.MethodGet:
+		response, err = adminport.doGetFaultRulesRequest(request)
+	case FaultInjectionPath + base.UrlDelimiter + base.MethodPost:
+		response, err = adminport.doAddFaultRuleRequest(request)
+	case FaultInjectionPath + base.UrlDelimiter + base.MethodDelete:
+		response, err = adminport.doRemoveFaultRulesRequest(request, false)
+	case FaultInjectionPath + DynamicSuffix + base.UrlDelimiter + base.MethodDelete:
+		response, err = adminport.doRemoveFaultRulesRequest(request, true)
 	case XDCRInternalSettingsPath + base.UrlDelimiter + base.MethodGet:
 		response, err = adminport.doViewXDCRInternalSettingsRequest(request)
 	case XDCRInternalSettingsPath + base.UrlDelimiter + base.MethodPost:
@@ -409,7 +440,7 @@ func (adminport *Adminport) doCreateReplicationRequest(request *http.Request) (*
 	}
 
 	logger_ap.Infof("Request parameters: justValidate=%v, fromBucket=%v, toCluster=%v, toBucket=%v, settings=%v\n",
-		justValidate, fromBucket, toCluster, toBucket, settings)
+		justValidate, fromBucket, toCluster, toBucket, metadata.RedactSettingsMap(settings))
 
 	replicationId, errorsMap, err := CreateReplication(justValidate, fromBucket, toCluster, toBucket, settings, getRealUserIdFromRequest(request))
 
@@ -487,7 +518,7 @@ func (adminport *Adminport) doChangeInternalSettingsRequest(request *http.Reques
 		return EncodeInternalSettingsErrorsMapIntoResponse(errorsMap)
 	}
 
-	logger_ap.Infof("Request params: inputSettings=%v\n", settingsMap)
+	logger_ap.Infof("Request params: inputSettings=%v\n", metadata.RedactSettingsMap(settingsMap))
 
 	errorsMap, err = UpdateDefaultSettings(settingsMap, getRealUserIdFromRequest(request))
 	if err != nil {
@@ -536,7 +567,7 @@ func (adminport *Adminport) doChangeDefaultReplicationSettingsRequest(request *h
 		return EncodeErrorsMapIntoResponse(errorsMap, false)
 	}
 
-	logger_ap.Infof("Request params: justValidate=%v, inputSettings=%v\n", justValidate, settingsMap)
+	logger_ap.Infof("Request params: justValidate=%v, inputSettings=%v\n", justValidate, metadata.RedactSettingsMap(settingsMap))
 
 	if !justValidate {
 		errorsMap, err := UpdateDefaultSettings(settingsMap, getRealUserIdFromRequest(request))
@@ -601,12 +632,16 @@ func (adminport *Adminport) doChangeReplicationSettingsRequest(request *http.Req
 	logger_ap.Infof("Request params: replicationId=%v\n", replicationId)
 
 	justValidate, settingsMap, errorsMap := DecodeChangeReplicationSettings(request, false)
+	filterRestream, err := DecodeFilterRestreamFromRequest(request)
+	if err != nil {
+		errorsMap[FilterRestream] = err
+	}
 	if len(errorsMap) > 0 {
 		logger_ap.Errorf("Validation error in inputs. errorsMap=%v\n", errorsMap)
 		return EncodeErrorsMapIntoResponse(errorsMap, false)
 	}
 
-	logger_ap.Infof("Request params: justValidate=%v, inputSettings=%v\n", justValidate, settingsMap)
+	logger_ap.Infof("Request params: justValidate=%v, filterRestream=%v, inputSettings=%v\n", justValidate, filterRestream, metadata.RedactSettingsMap(settingsMap))
 
 	// "pauseRequested" setting is special - it requires execute permission
 	_, pauseRequestedSpecified := settingsMap[metadata.Active]
@@ -631,7 +666,7 @@ func (adminport *Adminport) doChangeReplicationSettingsRequest(request *http.Req
 		return NewEmptyArrayResponse()
 	}
 
-	errorsMap, err = UpdateReplicationSettings(replicationId, settingsMap, getRealUserIdFromRequest(request))
+	errorsMap, err = UpdateReplicationSettings(replicationId, settingsMap, filterRestream, getRealUserIdFromRequest(request))
 	if err != nil {
 		return nil, err
 	} else if len(errorsMap) > 0 {
@@ -856,11 +891,23 @@ func (adminport *Adminport) doRegexpValidationRequest(request *http.Request) (*a
 		return response, err
 	}
 
-	expression, keys, err := DecodeRegexpValidationRequest(request)
+	expression, keys, bodyExpression, docs, err := DecodeRegexpValidationRequest(request)
 	if err != nil {
 		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
 	}
 
+	if len(bodyExpression) > 0 {
+		logger_ap.Infof("Request params: bodyExpression=%v, number of docs=%v\n",
+			bodyExpression, len(docs))
+
+		matchedDocs, err := utils.GetMatchedDocs(bodyExpression, docs)
+		if err != nil {
+			return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+		}
+
+		return NewBodyExpressionValidationResponse(matchedDocs)
+	}
+
 	logger_ap.Infof("Request params: expression=%v, keys=%v\n",
 		expression, keys)
 
@@ -873,6 +920,389 @@ func (adminport *Adminport) doRegexpValidationRequest(request *http.Request) (*a
 
 }
 
+func (adminport *Adminport) doFilterDryRunRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doFilterDryRunRequest\n")
+	defer logger_ap.Infof("Finished doFilterDryRunRequest\n")
+
+	bucketName, expression, bodyExpression, numDocs, numVBuckets, err := DecodeFilterDryRunRequest(request)
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+	}
+
+	logger_ap.Infof("Request params: bucketName=%v, expression=%v, bodyExpression=%v, numDocs=%v, numVBuckets=%v\n",
+		bucketName, expression, bodyExpression, numDocs, numVBuckets)
+
+	// documents in the bucket are exposed, hence the same permission as creating a replication from the bucket is required
+	response, err := authWebCreds(request, constructBucketPermission(bucketName, base.PermissionBucketXDCRWriteSuffix))
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	result, err := FilterDryRun(bucketName, expression, bodyExpression, numDocs, numVBuckets)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFilterDryRunResponse(result)
+}
+
+func (adminport *Adminport) doGetConflictLogRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doGetConflictLogRequest\n")
+
+	// get input parameters from request
+	replicationId, err := DecodeDynamicParamInURL(request, ConflictLogPrefix, "Replication Id")
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	offset, limit, local, err := DecodeConflictLogRequest(request)
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+	}
+
+	logger_ap.Infof("Request params: replicationId=%v, offset=%v, limit=%v, local=%v", replicationId, offset, limit, local)
+
+	response, err := authWebCredsForReplication(request, replicationId, []string{base.PermissionBucketXDCRReadSuffix})
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	// make sure that the replication exists
+	_, err = ReplicationSpecService().ReplicationSpec(replicationId)
+	if err != nil {
+		return EncodeReplicationSpecErrorIntoResponse(err)
+	}
+
+	var records []*conflict_log.Record
+	var total int
+	if local {
+		// from the xdcr process on another node, which collects the records on all nodes
+		records, total = conflict_log.RecentRecords(replicationId, offset, limit)
+	} else {
+		records, total, err = ListConflictLog(replicationId, offset, limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewConflictLogResponse(records, total, offset)
+}
+
+func (adminport *Adminport) doGetDeadLettersRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doGetDeadLettersRequest\n")
+
+	// get input parameters from request
+	replicationId, err := DecodeDynamicParamInURL(request, DeadLettersPrefix, "Replication Id")
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	offset, limit, local, err := DecodeDeadLettersRequest(request)
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+	}
+
+	logger_ap.Infof("Request params: replicationId=%v, offset=%v, limit=%v, local=%v", replicationId, offset, limit, local)
+
+	response, err := authWebCredsForReplication(request, replicationId, []string{base.PermissionBucketXDCRReadSuffix})
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	// make sure that the replication exists
+	_, err = ReplicationSpecService().ReplicationSpec(replicationId)
+	if err != nil {
+		return EncodeReplicationSpecErrorIntoResponse(err)
+	}
+
+	var entries []*dead_letter.Entry
+	var total int
+	if local {
+		// from the xdcr process on another node, which collects the entries on all nodes
+		entries, total, err = dead_letter.List(replicationId, offset, limit)
+	} else {
+		entries, total, err = ListDeadLetters(replicationId, offset, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewDeadLettersResponse(entries, total, offset)
+}
+
+func (adminport *Adminport) doRetryDeadLettersRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doRetryDeadLettersRequest\n")
+
+	// get input parameters from request
+	replicationId, err := DecodeDynamicParamInURL(request, DeadLettersPrefix, "Replication Id")
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	ids, local, err := DecodeDeadLettersRetryRequest(request)
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+	}
+
+	logger_ap.Infof("Request params: replicationId=%v, ids=%v, local=%v", replicationId, ids, local)
+
+	response, err := authWebCredsForReplication(request, replicationId, []string{base.PermissionBucketXDCRWriteSuffix})
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	// make sure that the replication exists
+	_, err = ReplicationSpecService().ReplicationSpec(replicationId)
+	if err != nil {
+		return EncodeReplicationSpecErrorIntoResponse(err)
+	}
+
+	// the entries are resent by the outgoing nozzles of the running pipeline on the nodes that hold them
+	var queued int
+	if local {
+		queued, err = dead_letter.Retry(replicationId, ids)
+	} else {
+		queued, err = RetryDeadLetters(replicationId, ids)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewDeadLettersRetryResponse(queued)
+}
+
+func (adminport *Adminport) doStartVerifyRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doStartVerifyRequest\n")
+
+	// get input parameters from request
+	replicationId, err := DecodeDynamicParamInURL(request, VerifyPrefix, "Replication Id")
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	rateLimit, err := DecodeVerifyRequest(request)
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+	}
+
+	logger_ap.Infof("Request params: replicationId=%v, rateLimit=%v", replicationId, rateLimit)
+
+	// documents of both source and target buckets are read
+	response, err := authWebCredsForReplication(request, replicationId, []string{base.PermissionBucketXDCRWriteSuffix})
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	spec, err := ReplicationSpecService().ReplicationSpec(replicationId)
+	if err != nil {
+		return EncodeReplicationSpecErrorIntoResponse(err)
+	}
+	if spec.Settings.RepType != metadata.ReplicationTypeXmem {
+		return EncodeErrorMessageIntoResponse(fmt.Errorf("Verification is supported for replications of type %v only", metadata.ReplicationTypeXmem), http.StatusBadRequest)
+	}
+
+	job, err := StartVerification(spec, rateLimit)
+	if err == verify.ErrorAlreadyRunning {
+		return EncodeErrorMessageIntoResponse(err, http.StatusConflict)
+	} else if err != nil {
+		return nil, err
+	}
+	return NewVerifyProgressResponse(job.Progress())
+}
+
+func (adminport *Adminport) doGetVerifyRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doGetVerifyRequest\n")
+
+	// get input parameters from request
+	replicationId, err := DecodeDynamicParamInURL(request, VerifyPrefix, "Replication Id")
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	logger_ap.Infof("Request params: replicationId=%v", replicationId)
+
+	response, err := authWebCredsForReplication(request, replicationId, []string{base.PermissionBucketXDCRReadSuffix})
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	job := verify.Get(replicationId)
+	if job == nil {
+		return EncodeErrorMessageIntoResponse(verify.ErrorNotFound, http.StatusNotFound)
+	}
+	return NewVerifyProgressResponse(job.Progress())
+}
+
+func (adminport *Adminport) doCancelVerifyRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doCancelVerifyRequest\n")
+
+	// get input parameters from request
+	replicationId, err := DecodeDynamicParamInURL(request, VerifyPrefix, "Replication Id")
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	logger_ap.Infof("Request params: replicationId=%v", replicationId)
+
+	response, err := authWebCredsForReplication(request, replicationId, []string{base.PermissionBucketXDCRWriteSuffix})
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	err = verify.Cancel(replicationId)
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusNotFound)
+	}
+	return NewOKResponse()
+}
+
+func (adminport *Adminport) doGetVerifyDiffRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doGetVerifyDiffRequest\n")
+
+	// get input parameters from request
+	replicationId, err := DecodeDynamicParamInURL(request, VerifyDiffPrefix, "Replication Id")
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	kind, err := DecodeVerifyDiffRequest(request)
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+	}
+
+	logger_ap.Infof("Request params: replicationId=%v, kind=%v", replicationId, kind)
+
+	response, err := authWebCredsForReplication(request, replicationId, []string{base.PermissionBucketXDCRReadSuffix})
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	job := verify.Get(replicationId)
+	if job == nil {
+		return EncodeErrorMessageIntoResponse(verify.ErrorNotFound, http.StatusNotFound)
+	}
+	return NewVerifyDiffResponse(job.Progress(), job.Diffs(), kind)
+}
+
+func (adminport *Adminport) doGetVBProgressRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doGetVBProgressRequest\n")
+
+	// get input parameters from request
+	replicationId, err := DecodeDynamicParamInURL(request, VBProgressPrefix, "Replication Id")
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	format, err := DecodeVBProgressRequest(request)
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+	}
+
+	logger_ap.Infof("Request params: replicationId=%v, format=%v", replicationId, format)
+
+	response, err := authWebCredsForReplication(request, replicationId, []string{base.PermissionBucketXDCRReadSuffix})
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	spec, err := ReplicationSpecService().ReplicationSpec(replicationId)
+	if err != nil {
+		return EncodeReplicationSpecErrorIntoResponse(err)
+	}
+
+	progress, err := GetVBProgress(spec)
+	if err != nil {
+		return nil, err
+	}
+	return NewVBProgressResponse(progress, format)
+}
+
+var FaultInjectionNotEnabledError = errors.New("fault injection is not enabled. xdcr needs to be started with -enableFaultInjection")
+
+func (adminport *Adminport) doGetFaultRulesRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doGetFaultRulesRequest\n")
+
+	response, err := authWebCreds(request, base.PermissionXDCRInternalRead)
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	fault_injector := base.CurrentFaultInjector()
+	if fault_injector == nil {
+		return EncodeErrorMessageIntoResponse(FaultInjectionNotEnabledError, http.StatusNotFound)
+	}
+
+	return NewFaultRulesResponse(fault_injector.Rules())
+}
+
+func (adminport *Adminport) doAddFaultRuleRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doAddFaultRuleRequest\n")
+
+	response, err := authWebCreds(request, base.PermissionXDCRInternalWrite)
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	fault_injector := base.CurrentFaultInjector()
+	if fault_injector == nil {
+		return EncodeErrorMessageIntoResponse(FaultInjectionNotEnabledError, http.StatusNotFound)
+	}
+
+	rule, err := DecodeFaultRuleRequest(request)
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+	}
+
+	logger_ap.Infof("Request params: rule=%v", *rule)
+
+	err = fault_injector.AddRule(*rule)
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+	}
+	return NewOKResponse()
+}
+
+// removes the rule named in the url path, or all rules if singleRule is false
+func (adminport *Adminport) doRemoveFaultRulesRequest(request *http.Request, singleRule bool) (*ap.Response, error) {
+	logger_ap.Infof("doRemoveFaultRulesRequest\n")
+
+	response, err := authWebCreds(request, base.PermissionXDCRInternalWrite)
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	fault_injector := base.CurrentFaultInjector()
+	if fault_injector == nil {
+		return EncodeErrorMessageIntoResponse(FaultInjectionNotEnabledError, http.StatusNotFound)
+	}
+
+	if !singleRule {
+		fault_injector.ClearRules()
+		logger_ap.Info("Removed all fault rules")
+		return NewOKResponse()
+	}
+
+	name, err := DecodeDynamicParamInURL(request, FaultInjectionPath, "Fault Rule Name")
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+	}
+
+	logger_ap.Infof("Request params: name=%v", name)
+
+	if !fault_injector.RemoveRule(name) {
+		return EncodeErrorMessageIntoResponse(fmt.Errorf("fault rule %v does not exist", name), http.StatusNotFound)
+	}
+	return NewOKResponse()
+}
+
+func (adminport *Adminport) doGetPrometheusMetricsRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Debugf("doGetPrometheusMetricsRequest\n")
+
+	response, err := authWebCreds(request, base.PermissionXDCRInternalRead)
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	return NewPrometheusMetricsResponse(GetPrometheusMetrics())
+}
+
 func (adminport *Adminport) doStartBlockProfile(request *http.Request) (*ap.Response, error) {
 	response, err := authWebCreds(request, base.PermissionXDCRInternalWrite)
 	if response != nil || err != nil {
@@ -16,6 +16,8 @@ import (
 	"github.com/couchbase/cbauth/metakv"
 	mc "github.com/couchbase/gomemcached"
 	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/conflict_log"
+	"github.com/couchbase/goxdcr/dead_letter"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/metadata"
 	"github.com/couchbase/goxdcr/metadata_svc"
@@ -23,6 +25,7 @@ import (
 	"github.com/couchbase/goxdcr/pipeline_utils"
 	"github.com/couchbase/goxdcr/service_def"
 	"github.com/couchbase/goxdcr/utils"
+	"github.com/couchbase/goxdcr/verify"
 	"runtime"
 	"runtime/debug"
 	"sync"
@@ -241,15 +244,50 @@ func needToReconstructPipeline(oldSettings *metadata.ReplicationSettings, newSet
 	repTypeChanged := !(oldSettings.RepType == newSettings.RepType)
 	sourceNozzlePerNodeChanged := !(oldSettings.SourceNozzlePerNode == newSettings.SourceNozzlePerNode)
 	targetNozzlePerNodeChanged := !(oldSettings.TargetNozzlePerNode == newSettings.TargetNozzlePerNode)
+	// router is constructed with these settings
+	filterDeletionsChanged := !(oldSettings.FilterDeletions == newSettings.FilterDeletions)
+	filterExpirationsChanged := !(oldSettings.FilterExpirations == newSettings.FilterExpirations)
+	filterExpressionChanged := !(oldSettings.FilterExpression == newSettings.FilterExpression)
+	filterBodyExpressionChanged := !(oldSettings.FilterBodyExpression == newSettings.FilterBodyExpression)
+	// checkpoint manager discards checkpoints of older filter versions when pipeline starts
+	filterVersionChanged := !(oldSettings.FilterVersion == newSettings.FilterVersion)
 
 	// the following may qualify for live update in the future.
 	// batchCount is tricky since the sizes of xmem data channels depend on it.
 	// batchsize is easier to live update but it may not be intuitive to have different behaviors for batchCount and batchSize
 	batchCountChanged := (oldSettings.BatchCount != newSettings.BatchCount)
 	batchSizeChanged := (oldSettings.BatchSize != newSettings.BatchSize)
+	dcpConnectionBufferSizeChanged := (oldSettings.DcpConnectionBufferSize != newSettings.DcpConnectionBufferSize)
+	// source nozzles are constructed differently when dcp events are recorded or replayed
+	dcpRecordReplayChanged := (oldSettings.DcpRecordDir != newSettings.DcpRecordDir) ||
+		(oldSettings.DcpReplayDir != newSettings.DcpReplayDir) ||
+		(oldSettings.DcpReplaySpeed != newSettings.DcpReplaySpeed)
+	// compression is negotiated when xmem nozzles set up connections
+	compressionTypeChanged := (oldSettings.CompressionType != newSettings.CompressionType)
+	conflictResolverChanged := (oldSettings.ConflictResolver != newSettings.ConflictResolver)
+	// conflict logger is registered with pipeline only when conflict logging is enabled
+	conflictLogChanged := (oldSettings.ConflictLogSink != newSettings.ConflictLogSink) ||
+		(oldSettings.ConflictLogBody != newSettings.ConflictLogBody) ||
+		(oldSettings.ConflictLogRetention != newSettings.ConflictLogRetention)
+	// xmem nozzles set up their connections when pipeline starts
+	connectionsPerTargetNozzleChanged := (oldSettings.ConnectionsPerTargetNozzle != newSettings.ConnectionsPerTargetNozzle)
+	// file nozzles open their files when pipeline starts
+	fileSinkChanged := (oldSettings.FileSinkDir != newSettings.FileSinkDir) ||
+		(oldSettings.FileSinkFormat != newSettings.FileSinkFormat) ||
+		(oldSettings.FileSinkRotateSize != newSettings.FileSinkRotateSize) ||
+		(oldSettings.FileSinkRotateInterval != newSettings.FileSinkRotateInterval)
+	// webhook nozzles set up their http clients when pipeline starts
+	webhookChanged := (oldSettings.WebhookUrl != newSettings.WebhookUrl) ||
+		(oldSettings.WebhookTimeout != newSettings.WebhookTimeout) ||
+		(oldSettings.WebhookMaxRetries != newSettings.WebhookMaxRetries) ||
+		(oldSettings.WebhookSecret != newSettings.WebhookSecret)
 
 	return repTypeChanged || sourceNozzlePerNodeChanged || targetNozzlePerNodeChanged ||
-		batchCountChanged || batchSizeChanged
+		filterDeletionsChanged || filterExpirationsChanged ||
+		filterExpressionChanged || filterBodyExpressionChanged || filterVersionChanged ||
+		batchCountChanged || batchSizeChanged || dcpConnectionBufferSizeChanged || dcpRecordReplayChanged ||
+		compressionTypeChanged || conflictResolverChanged || conflictLogChanged || connectionsPerTargetNozzleChanged ||
+		fileSinkChanged || webhookChanged
 }
 
 func (rscl *ReplicationSpecChangeListener) liveUpdatePipeline(topic string, oldSettings *metadata.ReplicationSettings, newSettings *metadata.ReplicationSettings) error {
@@ -258,7 +296,15 @@ func (rscl *ReplicationSpecChangeListener) liveUpdatePipeline(topic string, oldS
 	// perform live update on pipeline if qualifying settings have been changed
 	if oldSettings.LogLevel != newSettings.LogLevel || oldSettings.CheckpointInterval != newSettings.CheckpointInterval ||
 		oldSettings.StatsInterval != newSettings.StatsInterval ||
-		oldSettings.OptimisticReplicationThreshold != newSettings.OptimisticReplicationThreshold {
+		oldSettings.OptimisticReplicationThreshold != newSettings.OptimisticReplicationThreshold ||
+		oldSettings.DedupInBatch != newSettings.DedupInBatch ||
+		oldSettings.AdaptiveBatching != newSettings.AdaptiveBatching ||
+		oldSettings.MinBatchCount != newSettings.MinBatchCount ||
+		oldSettings.MinBatchSize != newSettings.MinBatchSize ||
+		oldSettings.AdaptiveBatchLatencyTarget != newSettings.AdaptiveBatchLatencyTarget ||
+		oldSettings.BandwidthLimit != newSettings.BandwidthLimit ||
+		oldSettings.DeadLetterEnabled != newSettings.DeadLetterEnabled ||
+		oldSettings.DeadLetterCap != newSettings.DeadLetterCap {
 
 		rs, err := pipeline_manager.ReplicationStatus(topic)
 		if err != nil {
@@ -390,6 +436,10 @@ func onDeleteReplication(topic string, logger *log.CommonLogger) error {
 		return err
 	}
 
+	conflict_log.RemoveRecentRecords(topic)
+	dead_letter.Remove(topic)
+	verify.Remove(topic)
+
 	//delete all checkpoint docs in an async fashion
 	err = replication_mgr.checkpoint_svc.DelCheckpointsDocs(topic)
 	if err != nil {
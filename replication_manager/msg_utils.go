@@ -10,21 +10,30 @@
 package replication_manager
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	ap "github.com/couchbase/goxdcr/adminport"
 	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/conflict_log"
+	"github.com/couchbase/goxdcr/dead_letter"
+	"github.com/couchbase/goxdcr/filter"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/metadata"
+	"github.com/couchbase/goxdcr/pipeline_svc"
 	"github.com/couchbase/goxdcr/simple_utils"
 	"github.com/couchbase/goxdcr/utils"
+	"github.com/couchbase/goxdcr/verify"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 // xdcr prefix for internal settings keys
@@ -50,6 +59,14 @@ const (
 	BlockProfileStopPath     = "profile/block/stop"
 	BucketSettingsPrefix     = "controller/bucketSettings"
 	XDCRInternalSettingsPath = "xdcr/internalSettings"
+	FilterDryRunPath         = "controller/filterDryRun"
+	ConflictLogPrefix        = "conflictLog"
+	DeadLettersPrefix        = "deadLetters"
+	FaultInjectionPath       = "debug/faultInjection"
+	VerifyPrefix             = "verify"
+	VerifyDiffPrefix         = "verifyDiff"
+	VBProgressPrefix         = "vbProgress"
+	PrometheusMetricsPath    = "metrics"
 
 	// Some url paths are not static and have variable contents, e.g., settings/replications/$replication_id
 	// The message keys for such paths are constructed by appending the dynamic suffix below to the static portion of the path.
@@ -62,6 +79,11 @@ const (
 	Type                           = "type"
 	ReplicationType                = "replicationType"
 	FilterExpression               = "filterExpression"
+	FilterBodyExpression           = "filterBodyExpression"
+	FilterDeletions                = "filterDeletions"
+	FilterExpirations              = "filterExpirations"
+	KeyRewriteRules                = "keyRewriteRules"
+	StartFrom                      = "startFrom"
 	PauseRequested                 = "pauseRequested"
 	CheckpointInterval             = "checkpointInterval"
 	BatchCount                     = "workerBatchSize"
@@ -74,9 +96,37 @@ const (
 	TimeoutPercentageCap           = "timeoutPercentageCap"
 	LogLevel                       = "logLevel"
 	StatsInterval                  = "statsInterval"
+	DcpConnectionBufferSize        = "dcpConnectionBufferSize"
+	DedupInBatch                   = "dedupInBatch"
+	DcpRecordDir                   = "dcpRecordDir"
+	DcpReplayDir                   = "dcpReplayDir"
+	DcpReplaySpeed                 = "dcpReplaySpeed"
+	CompressionType                = "compressionType"
+	ConflictResolver               = "conflictResolver"
+	ConflictLogSink                = "conflictLogSink"
+	ConflictLogBody                = "conflictLogBody"
+	ConflictLogRetention           = "conflictLogRetention"
+	AdaptiveBatching               = "adaptiveBatching"
+	MinBatchCount                  = "minBatchCount"
+	MinBatchSize                   = "minBatchSizeKb"
+	AdaptiveBatchLatencyTarget     = "adaptiveBatchLatencyTarget"
+	BandwidthLimit                 = "bandwidthLimit"
+	DeadLetterEnabled              = "deadLetterEnabled"
+	DeadLetterCap                  = "deadLetterCap"
+	ConnectionsPerTargetNozzle     = "connectionsPerTargetNozzle"
+	FileSinkDir                    = "fileSinkDir"
+	FileSinkFormat                 = "fileSinkFormat"
+	FileSinkRotateSize             = "fileSinkRotateSizeMb"
+	FileSinkRotateInterval         = "fileSinkRotateInterval"
+	WebhookUrl                     = "webhookUrl"
+	WebhookTimeout                 = "webhookTimeout"
+	WebhookMaxRetries              = "webhookMaxRetries"
+	WebhookSecret                  = "webhookSecret"
 	ReplicationTypeValue           = "continuous"
 	GoMaxProcs                     = "goMaxProcs"
 	GoGC                           = "goGC"
+	// not a setting. when filter expressions are changed, whether to re-stream from seqno 0
+	FilterRestream = "filterRestream"
 )
 
 // constants for parsing create replication response
@@ -86,10 +136,70 @@ const (
 
 // constants for RegexpValidation request
 const (
-	Expression = "expression"
-	Keys       = "keys"
-	StartIndex = "startIndex"
-	EndIndex   = "endIndex"
+	Expression     = "expression"
+	Keys           = "keys"
+	StartIndex     = "startIndex"
+	EndIndex       = "endIndex"
+	BodyExpression = "bodyExpression"
+	Docs           = "docs"
+)
+
+// constants for FilterDryRun request and response
+const (
+	NumDocs          = "numDocs"
+	NumVBuckets      = "numVBuckets"
+	MatchedCount     = "matchedCount"
+	UnmatchedCount   = "unmatchedCount"
+	MatchedSamples   = "matchedSamples"
+	UnmatchedSamples = "unmatchedSamples"
+)
+
+// constants for ConflictLog request and response
+const (
+	Offset    = "offset"
+	Limit     = "limit"
+	Total     = "total"
+	Conflicts = "conflicts"
+	// set by the xdcr processes on other nodes, which ask for the records on the current node only
+	ConflictLogLocal = "local"
+)
+
+// constants for DeadLetters request and response
+const (
+	DeadLetterEntries = "entries"
+	DeadLetterIds     = "ids"
+	DeadLettersQueued = "queued"
+	// set by the xdcr processes on other nodes, which ask for the entries on the current node only
+	DeadLettersLocal = "local"
+)
+
+// constants for FaultInjection request and response
+const (
+	FaultRuleName           = "name"
+	FaultRuleHost           = "host"
+	FaultRuleProbability    = "probability"
+	FaultRuleLatency        = "latency"
+	FaultRuleDropAfterBytes = "dropAfterBytes"
+	FaultRuleHalfClose      = "halfClose"
+	FaultRules              = "rules"
+)
+
+// constants for Verify request and response
+const (
+	VerifyRateLimit = "rateLimit"
+	VerifyDiffKind  = "kind"
+	VerifyDiffs     = "diffs"
+	VerifyProgress  = "progress"
+)
+
+// name of the file that the diff of verification is downloaded as
+const VerifyDiffFileName = "verify_diff.json"
+
+// constants for VBProgress request
+const (
+	VBProgressFormat      = "format"
+	VBProgressFormatJson  = "json"
+	VBProgressFormatTable = "table"
 )
 
 // constants used for parsing bucket setting changes
@@ -131,6 +241,11 @@ var MissingOldSettingsInRequest = errors.New("Invalid http request. No old repli
 var RestKeyToSettingsKeyMap = map[string]string{
 	Type:                           metadata.ReplicationType,
 	FilterExpression:               metadata.FilterExpression,
+	FilterBodyExpression:           metadata.FilterBodyExpression,
+	FilterDeletions:                metadata.FilterDeletions,
+	FilterExpirations:              metadata.FilterExpirations,
+	KeyRewriteRules:                metadata.KeyRewriteRules,
+	StartFrom:                      metadata.StartFrom,
 	PauseRequested:                 metadata.Active,
 	CheckpointInterval:             metadata.CheckpointInterval,
 	BatchCount:                     metadata.BatchCount,
@@ -141,16 +256,47 @@ var RestKeyToSettingsKeyMap = map[string]string{
 	TargetNozzlePerNode:            metadata.TargetNozzlePerNode,
 	/*MaxExpectedReplicationLag:      metadata.MaxExpectedReplicationLag,
 	TimeoutPercentageCap:           metadata.TimeoutPercentageCap,*/
-	LogLevel:      metadata.PipelineLogLevel,
-	StatsInterval: metadata.PipelineStatsInterval,
-	GoMaxProcs:    metadata.GoMaxProcs,
-	GoGC:          metadata.GoGC,
+	LogLevel:                   metadata.PipelineLogLevel,
+	StatsInterval:              metadata.PipelineStatsInterval,
+	DcpConnectionBufferSize:    metadata.DcpConnectionBufferSize,
+	DedupInBatch:               metadata.DedupInBatch,
+	DcpRecordDir:               metadata.DcpRecordDir,
+	DcpReplayDir:               metadata.DcpReplayDir,
+	DcpReplaySpeed:             metadata.DcpReplaySpeed,
+	CompressionType:            metadata.CompressionType,
+	ConflictResolver:           metadata.ConflictResolver,
+	ConflictLogSink:            metadata.ConflictLogSink,
+	ConflictLogBody:            metadata.ConflictLogBody,
+	ConflictLogRetention:       metadata.ConflictLogRetention,
+	AdaptiveBatching:           metadata.AdaptiveBatching,
+	MinBatchCount:              metadata.MinBatchCount,
+	MinBatchSize:               metadata.MinBatchSize,
+	AdaptiveBatchLatencyTarget: metadata.AdaptiveBatchLatencyTarget,
+	BandwidthLimit:             metadata.BandwidthLimit,
+	DeadLetterEnabled:          metadata.DeadLetterEnabled,
+	DeadLetterCap:              metadata.DeadLetterCap,
+	ConnectionsPerTargetNozzle: metadata.ConnectionsPerTargetNozzle,
+	FileSinkDir:                metadata.FileSinkDir,
+	FileSinkFormat:             metadata.FileSinkFormat,
+	FileSinkRotateSize:         metadata.FileSinkRotateSize,
+	FileSinkRotateInterval:     metadata.FileSinkRotateInterval,
+	WebhookUrl:                 metadata.WebhookUrl,
+	WebhookTimeout:             metadata.WebhookTimeout,
+	WebhookMaxRetries:          metadata.WebhookMaxRetries,
+	WebhookSecret:              metadata.WebhookSecret,
+	GoMaxProcs:                 metadata.GoMaxProcs,
+	GoGC:                       metadata.GoGC,
 }
 
 // internal replication settings key -> replication settings key in rest api
 var SettingsKeyToRestKeyMap = map[string]string{
 	metadata.ReplicationType:                Type,
 	metadata.FilterExpression:               FilterExpression,
+	metadata.FilterBodyExpression:           FilterBodyExpression,
+	metadata.FilterDeletions:                FilterDeletions,
+	metadata.FilterExpirations:              FilterExpirations,
+	metadata.KeyRewriteRules:                KeyRewriteRules,
+	metadata.StartFrom:                      StartFrom,
 	metadata.Active:                         PauseRequested,
 	metadata.CheckpointInterval:             CheckpointInterval,
 	metadata.BatchCount:                     BatchCount,
@@ -161,10 +307,36 @@ var SettingsKeyToRestKeyMap = map[string]string{
 	metadata.TargetNozzlePerNode:            TargetNozzlePerNode,
 	/*metadata.MaxExpectedReplicationLag:      MaxExpectedReplicationLag,
 	metadata.TimeoutPercentageCap:           TimeoutPercentageCap,*/
-	metadata.PipelineLogLevel:      LogLevel,
-	metadata.PipelineStatsInterval: StatsInterval,
-	metadata.GoMaxProcs:            GoMaxProcs,
-	metadata.GoGC:                  GoGC,
+	metadata.PipelineLogLevel:           LogLevel,
+	metadata.PipelineStatsInterval:      StatsInterval,
+	metadata.DcpConnectionBufferSize:    DcpConnectionBufferSize,
+	metadata.DedupInBatch:               DedupInBatch,
+	metadata.DcpRecordDir:               DcpRecordDir,
+	metadata.DcpReplayDir:               DcpReplayDir,
+	metadata.DcpReplaySpeed:             DcpReplaySpeed,
+	metadata.CompressionType:            CompressionType,
+	metadata.ConflictResolver:           ConflictResolver,
+	metadata.ConflictLogSink:            ConflictLogSink,
+	metadata.ConflictLogBody:            ConflictLogBody,
+	metadata.ConflictLogRetention:       ConflictLogRetention,
+	metadata.AdaptiveBatching:           AdaptiveBatching,
+	metadata.MinBatchCount:              MinBatchCount,
+	metadata.MinBatchSize:               MinBatchSize,
+	metadata.AdaptiveBatchLatencyTarget: AdaptiveBatchLatencyTarget,
+	metadata.BandwidthLimit:             BandwidthLimit,
+	metadata.DeadLetterEnabled:          DeadLetterEnabled,
+	metadata.DeadLetterCap:              DeadLetterCap,
+	metadata.ConnectionsPerTargetNozzle: ConnectionsPerTargetNozzle,
+	metadata.FileSinkDir:                FileSinkDir,
+	metadata.FileSinkFormat:             FileSinkFormat,
+	metadata.FileSinkRotateSize:         FileSinkRotateSize,
+	metadata.FileSinkRotateInterval:     FileSinkRotateInterval,
+	metadata.WebhookUrl:                 WebhookUrl,
+	metadata.WebhookTimeout:             WebhookTimeout,
+	metadata.WebhookMaxRetries:          WebhookMaxRetries,
+	metadata.WebhookSecret:              WebhookSecret,
+	metadata.GoMaxProcs:                 GoMaxProcs,
+	metadata.GoGC:                       GoGC,
 }
 
 var logger_msgutil *log.CommonLogger = log.NewLogger("MessageUtils", log.DefaultLoggerContext)
@@ -202,11 +374,21 @@ func getReplicationDocMap(replSpec *metadata.ReplicationSpecification) map[strin
 		replDocMap[base.ReplicationDocId] = replSpec.Id
 		replDocMap[base.ReplicationDocContinuous] = true
 		replDocMap[base.ReplicationDocSource] = replSpec.SourceBucketName
-		replDocMap[base.ReplicationDocTarget] = base.UrlDelimiter + base.RemoteClustersForReplicationDoc + base.UrlDelimiter + replSpec.TargetClusterUUID + base.UrlDelimiter + base.BucketsPath + base.UrlDelimiter + replSpec.TargetBucketName
+		if replSpec.IsFileTarget() {
+			replDocMap[base.ReplicationDocTarget] = base.UrlDelimiter + base.FilesForReplicationDoc + base.UrlDelimiter + replSpec.TargetBucketName
+		} else if replSpec.IsWebhookTarget() {
+			replDocMap[base.ReplicationDocTarget] = base.UrlDelimiter + base.WebhooksForReplicationDoc + base.UrlDelimiter + replSpec.TargetBucketName
+		} else {
+			replDocMap[base.ReplicationDocTarget] = base.UrlDelimiter + base.RemoteClustersForReplicationDoc + base.UrlDelimiter + replSpec.TargetClusterUUID + base.UrlDelimiter + base.BucketsPath + base.UrlDelimiter + replSpec.TargetBucketName
+		}
 
 		// special transformation for replication type and active flag
 		replDocMap[base.ReplicationDocPauseRequestedOutput] = !replSpec.Settings.Active
-		if replSpec.Settings.RepType == metadata.ReplicationTypeXmem {
+		if replSpec.IsFileTarget() {
+			replDocMap[base.ReplicationDocType] = base.ReplicationDocTypeFile
+		} else if replSpec.IsWebhookTarget() {
+			replDocMap[base.ReplicationDocType] = base.ReplicationDocTypeWebhook
+		} else if replSpec.Settings.RepType == metadata.ReplicationTypeXmem {
 			replDocMap[base.ReplicationDocType] = base.ReplicationDocTypeXmem
 		} else {
 			replDocMap[base.ReplicationDocType] = base.ReplicationDocTypeCapi
@@ -242,6 +424,24 @@ func DecodeJustValidateFromRequest(request *http.Request) (bool, error) {
 	return false, nil
 }
 
+// this func assumes that the request.ParseForm() has already been called
+func DecodeFilterRestreamFromRequest(request *http.Request) (bool, error) {
+	for key, valArr := range request.Form {
+		switch key {
+		case FilterRestream:
+			filterRestream, err := getBoolFromValArr(valArr, false)
+			if err != nil {
+				return false, err
+			} else {
+				return filterRestream, nil
+			}
+		default:
+			// ignore other parameters
+		}
+	}
+	return false, nil
+}
+
 // decode parameters from create remote cluster request
 func DecodeCreateRemoteClusterRequest(request *http.Request) (justValidate bool, remoteClusterRef *metadata.RemoteClusterReference, errorsMap map[string]error, err error) {
 	errorsMap = make(map[string]error)
@@ -367,18 +567,30 @@ func DecodeCreateReplicationRequest(request *http.Request) (justValidate bool, f
 	if len(fromBucket) == 0 {
 		errorsMap[base.FromBucket] = simple_utils.MissingValueError("source bucket")
 	}
-	if len(toCluster) == 0 {
-		errorsMap[base.ToCluster] = simple_utils.MissingValueError("target cluster")
-	}
-	if len(toBucket) == 0 {
-		errorsMap[base.ToBucket] = simple_utils.MissingValueError("target bucket")
-	}
 
 	settings, settingsErrorsMap := DecodeSettingsFromRequest(request, false, false)
 	for key, value := range settingsErrorsMap {
 		errorsMap[key] = value
 	}
 
+	// replications of file and webhook types have no target cluster, and toBucket is the name of the export
+	repType, _ := settings[metadata.ReplicationType].(string)
+	if metadata.TargetClusterUUIDForRepType(repType) != "" {
+		if len(toCluster) != 0 {
+			errorsMap[base.ToCluster] = fmt.Errorf("Target cluster cannot be specified for replications of %v type", repType)
+		}
+		if len(toBucket) == 0 {
+			errorsMap[base.ToBucket] = simple_utils.MissingValueError("export name")
+		}
+	} else {
+		if len(toCluster) == 0 {
+			errorsMap[base.ToCluster] = simple_utils.MissingValueError("target cluster")
+		}
+		if len(toBucket) == 0 {
+			errorsMap[base.ToBucket] = simple_utils.MissingValueError("target bucket")
+		}
+	}
+
 	isEnterprise, err := XDCRCompTopologyService().IsMyClusterEnterprise()
 	if err != nil {
 		return
@@ -389,6 +601,10 @@ func DecodeCreateReplicationRequest(request *http.Request) (justValidate bool, f
 		if ok && len(filterExpression.(string)) > 0 {
 			errorsMap[FilterExpression] = errors.New("Filter expression can be specified in Enterprise edition only")
 		}
+		filterBodyExpression, ok := settings[metadata.FilterBodyExpression]
+		if ok && len(filterBodyExpression.(string)) > 0 {
+			errorsMap[FilterBodyExpression] = errors.New("Filter body expression can be specified in Enterprise edition only")
+		}
 	}
 
 	return
@@ -527,12 +743,12 @@ func DecodeSettingsFromXDCRInternalSettingsRequest(request *http.Request) (map[s
 	return settings, nil
 }
 
-func DecodeRegexpValidationRequest(request *http.Request) (string, []string, error) {
-	var expression string
-	var keys []string
-
-	if err := request.ParseForm(); err != nil {
-		return "", nil, err
+// decode parameters from regexp validation request
+// the request validates either a key filter expression, which is a regular expression, against a list of keys,
+// or a body filter expression against a map of doc key -> doc body
+func DecodeRegexpValidationRequest(request *http.Request) (expression string, keys []string, bodyExpression string, docs map[string]interface{}, err error) {
+	if err = request.ParseForm(); err != nil {
+		return
 	}
 
 	for key, valArr := range request.Form {
@@ -541,20 +757,412 @@ func DecodeRegexpValidationRequest(request *http.Request) (string, []string, err
 			expression = getStringFromValArr(valArr)
 		case Keys:
 			keysStr := getStringFromValArr(valArr)
-			err := json.Unmarshal([]byte(keysStr), &keys)
+			err = json.Unmarshal([]byte(keysStr), &keys)
+			if err != nil {
+				err = utils.NewEnhancedError(fmt.Sprintf("Error parsing keys=%v.", keysStr), err)
+				return
+			}
+		case BodyExpression:
+			bodyExpression = getStringFromValArr(valArr)
+		case Docs:
+			docsStr := getStringFromValArr(valArr)
+			err = json.Unmarshal([]byte(docsStr), &docs)
 			if err != nil {
-				return "", nil, utils.NewEnhancedError(fmt.Sprintf("Error parsing keys=%v.", keysStr), err)
+				err = utils.NewEnhancedError(fmt.Sprintf("Error parsing docs=%v.", docsStr), err)
+				return
+			}
+		default:
+			// ignore other parameters
+		}
+	}
+
+	if len(expression) == 0 && len(bodyExpression) == 0 {
+		err = simple_utils.MissingParameterError("expression")
+		return
+	}
+
+	if len(expression) > 0 && len(bodyExpression) > 0 {
+		err = fmt.Errorf("%v and %v cannot be specified in the same request", Expression, BodyExpression)
+	}
+
+	return
+}
+
+// decode parameters from filter dry run request
+func DecodeFilterDryRunRequest(request *http.Request) (bucketName, expression, bodyExpression string, numDocs, numVBuckets int, err error) {
+	if err = request.ParseForm(); err != nil {
+		return
+	}
+
+	numDocs = DefaultFilterDryRunNumDocs
+	numVBuckets = DefaultFilterDryRunNumVBuckets
+
+	for key, valArr := range request.Form {
+		switch key {
+		case BucketName:
+			bucketName = getStringFromValArr(valArr)
+		case Expression:
+			expression = getStringFromValArr(valArr)
+		case BodyExpression:
+			bodyExpression = getStringFromValArr(valArr)
+		case NumDocs:
+			numDocs, err = strconv.Atoi(getStringFromValArr(valArr))
+			if err != nil || numDocs <= 0 || numDocs > MaxFilterDryRunNumDocs {
+				err = fmt.Errorf("%v needs to be an integer between 1 and %v", NumDocs, MaxFilterDryRunNumDocs)
+				return
+			}
+		case NumVBuckets:
+			numVBuckets, err = strconv.Atoi(getStringFromValArr(valArr))
+			if err != nil || numVBuckets <= 0 {
+				err = fmt.Errorf("%v needs to be a positive integer", NumVBuckets)
+				return
 			}
 		default:
 			// ignore other parameters
 		}
 	}
 
-	if len(expression) == 0 {
-		return "", nil, simple_utils.MissingParameterError("expression")
+	if len(bucketName) == 0 {
+		err = simple_utils.MissingParameterError(BucketName)
+		return
+	}
+
+	if len(expression) == 0 && len(bodyExpression) == 0 {
+		err = simple_utils.MissingParameterError("expression")
+		return
+	}
+
+	if len(expression) > 0 {
+		err = verifyFilterExpression(expression)
+		if err != nil {
+			err = utils.NewEnhancedError(fmt.Sprintf("Invalid %v.", Expression), err)
+			return
+		}
+	}
+	if len(bodyExpression) > 0 {
+		err = filter.Validate(bodyExpression)
+		if err != nil {
+			err = utils.NewEnhancedError(fmt.Sprintf("Invalid %v.", BodyExpression), err)
+		}
+	}
+
+	return
+}
+
+func NewFilterDryRunResponse(result *FilterDryRunResult) (*ap.Response, error) {
+	returnMap := make(map[string]interface{})
+	returnMap[NumDocs] = result.NumDocs
+	returnMap[MatchedCount] = result.MatchedCount
+	returnMap[UnmatchedCount] = result.UnmatchedCount
+	returnMap[MatchedSamples] = result.MatchedSamples
+	returnMap[UnmatchedSamples] = result.UnmatchedSamples
+	return EncodeObjectIntoResponse(returnMap)
+}
+
+// decode parameters from conflict log request. like dead letter listing requests, requests from other nodes
+// are not subject to the max limit
+func DecodeConflictLogRequest(request *http.Request) (offset, limit int, local bool, err error) {
+	if err = request.ParseForm(); err != nil {
+		return
+	}
+	local, err = getBoolFromValArr(request.Form[ConflictLogLocal], false)
+	if err != nil {
+		err = fmt.Errorf("%v needs to be a boolean", ConflictLogLocal)
+		return
+	}
+	maxLimit := MaxConflictLogLimit
+	if local {
+		maxLimit = math.MaxInt32
+	}
+	offset, limit, err = decodeOffsetAndLimit(request, DefaultConflictLogLimit, maxLimit)
+	return
+}
+
+// decode parameters from dead letter listing request. requests from other nodes are not subject to the max limit,
+// since they ask for the entries up to the offset as well
+func DecodeDeadLettersRequest(request *http.Request) (offset, limit int, local bool, err error) {
+	local, err = decodeDeadLettersLocal(request)
+	if err != nil {
+		return
+	}
+	maxLimit := MaxDeadLettersLimit
+	if local {
+		maxLimit = math.MaxInt32
 	}
+	offset, limit, err = decodeOffsetAndLimit(request, DefaultDeadLettersLimit, maxLimit)
+	return
+}
 
-	return expression, keys, nil
+func decodeDeadLettersLocal(request *http.Request) (bool, error) {
+	if err := request.ParseForm(); err != nil {
+		return false, err
+	}
+	local, err := getBoolFromValArr(request.Form[DeadLettersLocal], false)
+	if err != nil {
+		return false, fmt.Errorf("%v needs to be a boolean", DeadLettersLocal)
+	}
+	return local, nil
+}
+
+func decodeOffsetAndLimit(request *http.Request, defaultLimit, maxLimit int) (offset, limit int, err error) {
+	if err = request.ParseForm(); err != nil {
+		return
+	}
+
+	limit = defaultLimit
+
+	for key, valArr := range request.Form {
+		switch key {
+		case Offset:
+			offset, err = strconv.Atoi(getStringFromValArr(valArr))
+			if err != nil || offset < 0 {
+				err = fmt.Errorf("%v needs to be a non-negative integer", Offset)
+				return
+			}
+		case Limit:
+			limit, err = strconv.Atoi(getStringFromValArr(valArr))
+			if err != nil || limit <= 0 || limit > maxLimit {
+				err = fmt.Errorf("%v needs to be an integer between 1 and %v", Limit, maxLimit)
+				return
+			}
+		default:
+			// ignore other parameters
+		}
+	}
+	return
+}
+
+func NewConflictLogResponse(records []*conflict_log.Record, total, offset int) (*ap.Response, error) {
+	returnMap := make(map[string]interface{})
+	returnMap[Total] = total
+	returnMap[Offset] = offset
+	returnMap[Conflicts] = records
+	return EncodeObjectIntoResponse(returnMap)
+}
+
+// decode the ids of the entries to retry from dead letter retry request. empty ids means all entries
+func DecodeDeadLettersRetryRequest(request *http.Request) ([]uint64, bool, error) {
+	local, err := decodeDeadLettersLocal(request)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ids := make([]uint64, 0)
+	for key, valArr := range request.Form {
+		switch key {
+		case DeadLetterIds:
+			idsStr := getStringFromValArr(valArr)
+			if idsStr == "" {
+				continue
+			}
+			for _, idStr := range strings.Split(idsStr, ",") {
+				id, err := strconv.ParseUint(strings.TrimSpace(idStr), base.ParseIntBase, 64)
+				if err != nil {
+					return nil, false, fmt.Errorf("%v needs to be a comma separated list of entry ids", DeadLetterIds)
+				}
+				ids = append(ids, id)
+			}
+		default:
+			// ignore other parameters
+		}
+	}
+	return ids, local, nil
+}
+
+func NewDeadLettersResponse(entries []*dead_letter.Entry, total, offset int) (*ap.Response, error) {
+	returnMap := make(map[string]interface{})
+	returnMap[Total] = total
+	returnMap[Offset] = offset
+	returnMap[DeadLetterEntries] = entries
+	return EncodeObjectIntoResponse(returnMap)
+}
+
+func NewDeadLettersRetryResponse(queued int) (*ap.Response, error) {
+	returnMap := make(map[string]interface{})
+	returnMap[DeadLettersQueued] = queued
+	return EncodeObjectIntoResponse(returnMap)
+}
+
+// decode the fault rule to add from fault injection request. latency is in milliseconds
+func DecodeFaultRuleRequest(request *http.Request) (*base.FaultRule, error) {
+	if err := request.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	rule := &base.FaultRule{Probability: 1}
+	var err error
+	for key, valArr := range request.Form {
+		switch key {
+		case FaultRuleName:
+			rule.Name = getStringFromValArr(valArr)
+		case FaultRuleHost:
+			rule.Host = getStringFromValArr(valArr)
+		case FaultRuleProbability:
+			rule.Probability, err = strconv.ParseFloat(getStringFromValArr(valArr), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%v needs to be a number", FaultRuleProbability)
+			}
+		case FaultRuleLatency:
+			latency, err := strconv.Atoi(getStringFromValArr(valArr))
+			if err != nil {
+				return nil, fmt.Errorf("%v needs to be an integer", FaultRuleLatency)
+			}
+			rule.Latency = time.Duration(latency) * time.Millisecond
+		case FaultRuleDropAfterBytes:
+			rule.DropAfterBytes, err = strconv.ParseInt(getStringFromValArr(valArr), base.ParseIntBase, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%v needs to be an integer", FaultRuleDropAfterBytes)
+			}
+		case FaultRuleHalfClose:
+			rule.HalfClose, err = getBoolFromValArr(valArr, false)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			// ignore other parameters
+		}
+	}
+	return rule, rule.Validate()
+}
+
+func NewFaultRulesResponse(rules []base.FaultRule) (*ap.Response, error) {
+	rulesList := make([]map[string]interface{}, 0, len(rules))
+	for _, rule := range rules {
+		ruleMap := make(map[string]interface{})
+		ruleMap[FaultRuleName] = rule.Name
+		ruleMap[FaultRuleHost] = rule.Host
+		ruleMap[FaultRuleProbability] = rule.Probability
+		ruleMap[FaultRuleLatency] = int64(rule.Latency / time.Millisecond)
+		ruleMap[FaultRuleDropAfterBytes] = rule.DropAfterBytes
+		ruleMap[FaultRuleHalfClose] = rule.HalfClose
+		rulesList = append(rulesList, ruleMap)
+	}
+	returnMap := make(map[string]interface{})
+	returnMap[FaultRules] = rulesList
+	return EncodeObjectIntoResponse(returnMap)
+}
+
+// decode the rate limit of the verification job to start from verify request. 0 means no limit
+func DecodeVerifyRequest(request *http.Request) (rateLimit int, err error) {
+	if err = request.ParseForm(); err != nil {
+		return
+	}
+
+	rateLimit = DefaultVerifyRateLimit
+	for key, valArr := range request.Form {
+		switch key {
+		case VerifyRateLimit:
+			rateLimit, err = strconv.Atoi(getStringFromValArr(valArr))
+			if err != nil || rateLimit < 0 {
+				err = fmt.Errorf("%v needs to be a non-negative integer", VerifyRateLimit)
+				return
+			}
+		default:
+			// ignore other parameters
+		}
+	}
+	return
+}
+
+// decode the kind of the differences to return from verify diff request. all differences are returned when it is empty
+func DecodeVerifyDiffRequest(request *http.Request) (kind string, err error) {
+	if err = request.ParseForm(); err != nil {
+		return
+	}
+
+	kind = request.Form.Get(VerifyDiffKind)
+	switch kind {
+	case "", verify.DiffMissing, verify.DiffStale, verify.DiffAhead, verify.DiffError:
+		return kind, nil
+	default:
+		return "", fmt.Errorf("%v needs to be one of %v, %v, %v and %v", VerifyDiffKind, verify.DiffMissing, verify.DiffStale, verify.DiffAhead, verify.DiffError)
+	}
+}
+
+func NewVerifyProgressResponse(progress *verify.Progress) (*ap.Response, error) {
+	return EncodeObjectIntoResponse(progress)
+}
+
+// the differences are returned as a json file download, together with the progress of the job
+func NewVerifyDiffResponse(progress *verify.Progress, diffs []*verify.DiffEntry, kind string) (*ap.Response, error) {
+	diffList := make([]*verify.DiffEntry, 0, len(diffs))
+	for _, diff := range diffs {
+		if kind == "" || diff.Kind == kind {
+			diffList = append(diffList, diff)
+		}
+	}
+	returnMap := make(map[string]interface{})
+	returnMap[ReplicationId] = progress.ReplicationId
+	returnMap[VerifyProgress] = progress
+	returnMap[VerifyDiffs] = diffList
+
+	response, err := EncodeObjectIntoResponse(returnMap)
+	if err != nil {
+		return nil, err
+	}
+	response.Header = map[string]string{base.ContentDisposition: "attachment; filename=" + VerifyDiffFileName}
+	return response, nil
+}
+
+func DecodeVBProgressRequest(request *http.Request) (format string, err error) {
+	if err = request.ParseForm(); err != nil {
+		return
+	}
+
+	format = request.Form.Get(VBProgressFormat)
+	switch format {
+	case "":
+		return VBProgressFormatJson, nil
+	case VBProgressFormatJson, VBProgressFormatTable:
+		return format, nil
+	default:
+		return "", fmt.Errorf("%v needs to be either %v or %v", VBProgressFormat, VBProgressFormatJson, VBProgressFormatTable)
+	}
+}
+
+// in table format, the progress is returned as plain text with one row per vbucket
+func NewVBProgressResponse(progress *pipeline_svc.ReplicationVBProgress, format string) (*ap.Response, error) {
+	if format != VBProgressFormatTable {
+		return EncodeObjectIntoResponse(progress)
+	}
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "replication: %v, running: %v\n", progress.ReplicationId, progress.Running)
+	writer := tabwriter.NewWriter(&buffer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "VB\tHIGH_SEQNO\tTHROUGH_SEQNO\tCKPT_SEQNO\tTARGET_VB_OPAQUE\tSTREAM\tCHANGES_LEFT\tSOURCE_NOZZLE\tOUT_NOZZLE")
+	for _, vb_progress := range progress.VBuckets {
+		target_vb_opaque := "-"
+		if vb_progress.TargetVBOpaque != nil {
+			target_vb_opaque = fmt.Sprintf("%v", vb_progress.TargetVBOpaque.Value())
+		}
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", vb_progress.Vbno, vb_progress.SourceHighSeqno,
+			vb_progress.ThroughSeqno, vb_progress.CheckpointSeqno, target_vb_opaque, valueOrDash(vb_progress.StreamState),
+			vb_progress.ChangesLeft, valueOrDash(vb_progress.SourceNozzle), valueOrDash(vb_progress.OutNozzle))
+	}
+	writer.Flush()
+
+	response, err := EncodeByteArrayIntoResponse(buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	response.Header = map[string]string{base.ContentType: base.TextContentType}
+	return response, nil
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func NewPrometheusMetricsResponse(metrics []byte) (*ap.Response, error) {
+	response, err := EncodeByteArrayIntoResponse(metrics)
+	if err != nil {
+		return nil, err
+	}
+	response.Header = map[string]string{base.ContentType: PrometheusContentType}
+	return response, nil
 }
 
 func NewCreateReplicationResponse(replicationId string) (*ap.Response, error) {
@@ -624,6 +1232,10 @@ func NewRegexpValidationResponse(matchesMap map[string][][]int) (*ap.Response, e
 	return EncodeObjectIntoResponse(returnMap)
 }
 
+func NewBodyExpressionValidationResponse(matchedDocs map[string]bool) (*ap.Response, error) {
+	return EncodeObjectIntoResponse(matchedDocs)
+}
+
 // decode dynamic paramater from the path of http request
 func DecodeDynamicParamInURL(request *http.Request, pathPrefix string, paramName string) (string, error) {
 	// length of prefix preceding replicationId in request url path
@@ -677,7 +1289,11 @@ func convertSettingsToRestSettingsMap(settings *metadata.ReplicationSettings, is
 	}
 
 	for key, value := range settingsMap {
-		restKey := SettingsKeyToRestKeyMap[key]
+		restKey, ok := SettingsKeyToRestKeyMap[key]
+		if !ok {
+			// internal settings, e.g., filter version, are not exposed
+			continue
+		}
 		if restKey == PauseRequested {
 			// pauseRequested = !active
 			valueBool := value.(bool)
@@ -824,7 +1440,7 @@ func EncodeByteArrayIntoResponse(data []byte) (*ap.Response, error) {
 
 // encode a byte array into Response object with specified status code
 func EncodeByteArrayIntoResponseWithStatusCode(data []byte, statusCode int) (*ap.Response, error) {
-	return &ap.Response{statusCode, data}, nil
+	return &ap.Response{StatusCode: statusCode, Body: data}, nil
 }
 
 // encode an arbitrary object into Response object with default status code of StatusOK
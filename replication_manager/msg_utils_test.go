@@ -0,0 +1,47 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package replication_manager
+
+import (
+	"fmt"
+	"github.com/couchbase/goxdcr/metadata"
+	"strings"
+	"testing"
+)
+
+func TestWebhookSecretRedaction(t *testing.T) {
+	secret := "s3cret-value"
+	settings := metadata.DefaultSettings()
+	settings.WebhookUrl = "https://example.com/xdcr"
+	settings.WebhookSecret = secret
+
+	if _, ok := settings.ToMap()[metadata.WebhookSecret]; ok {
+		t.Errorf("expected webhook secret not to be in settings map")
+	}
+	if _, ok := convertSettingsToRestSettingsMap(settings, false)[WebhookSecret]; ok {
+		t.Errorf("expected webhook secret not to be in rest settings map")
+	}
+	if strings.Contains(settings.String(), secret) || strings.Contains(fmt.Sprintf("%v", settings), secret) {
+		t.Errorf("expected webhook secret not to be in log form of settings")
+	}
+	if clone := settings.Clone(); clone.WebhookSecret != secret {
+		t.Errorf("expected webhook secret to be kept in clone, got %q", clone.WebhookSecret)
+	}
+
+	// settings maps from requests
+	requestSettings := map[string]interface{}{metadata.WebhookSecret: secret, metadata.BatchCount: 100}
+	redacted := metadata.RedactSettingsMap(requestSettings)
+	if strings.Contains(fmt.Sprintf("%v", redacted), secret) || redacted[metadata.BatchCount] != 100 {
+		t.Errorf("expected only webhook secret to be masked, got %v", redacted)
+	}
+	if requestSettings[metadata.WebhookSecret] != secret {
+		t.Errorf("expected settings map from request not to be modified")
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package replication_manager
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/pipeline_manager"
+	"github.com/couchbase/goxdcr/pipeline_svc"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// prefix of the names of the metrics exported to prometheus
+var PrometheusMetricPrefix = "xdcr_"
+
+// content type of the prometheus text exposition format
+const PrometheusContentType = "text/plain; version=0.0.4"
+
+const (
+	PrometheusCounter = "counter"
+	PrometheusGauge   = "gauge"
+)
+
+// labels of replication metrics
+const (
+	PrometheusLabelSourceBucket  = "source_bucket"
+	PrometheusLabelTargetCluster = "target_cluster"
+	PrometheusLabelTargetBucket  = "target_bucket"
+	PrometheusLabelReplicationId = "replication_id"
+	PrometheusLabelPool          = "pool"
+	PrometheusLabelConnType      = "conn_type"
+)
+
+// pipeline metrics that only go up while a pipeline is running, and are exported as counters.
+// all other pipeline metrics are exported as gauges
+var PrometheusCounterMetrics = map[string]bool{
+	pipeline_svc.DOCS_WRITTEN_METRIC:                 true,
+	pipeline_svc.EXPIRY_DOCS_WRITTEN_METRIC:          true,
+	pipeline_svc.DELETION_DOCS_WRITTEN_METRIC:        true,
+	pipeline_svc.SET_DOCS_WRITTEN_METRIC:             true,
+	pipeline_svc.DATA_REPLICATED_METRIC:              true,
+	pipeline_svc.DATA_REPLICATED_UNCOMPRESSED_METRIC: true,
+	pipeline_svc.DOCS_FILTERED_METRIC:                true,
+	pipeline_svc.EXPIRY_FILTERED_METRIC:              true,
+	pipeline_svc.DELETION_FILTERED_METRIC:            true,
+	pipeline_svc.SET_FILTERED_METRIC:                 true,
+	pipeline_svc.DELETION_SETTING_FILTERED_METRIC:    true,
+	pipeline_svc.EXPIRY_SETTING_FILTERED_METRIC:      true,
+	pipeline_svc.DOCS_FAILED_CR_SOURCE_METRIC:        true,
+	pipeline_svc.EXPIRY_FAILED_CR_SOURCE_METRIC:      true,
+	pipeline_svc.DELETION_FAILED_CR_SOURCE_METRIC:    true,
+	pipeline_svc.SET_FAILED_CR_SOURCE_METRIC:         true,
+	pipeline_svc.DOCS_DEDUPED_METRIC:                 true,
+	pipeline_svc.DOCS_DEAD_LETTERED_METRIC:           true,
+	pipeline_svc.NUM_CHECKPOINTS_METRIC:              true,
+	pipeline_svc.NUM_FAILEDCKPTS_METRIC:              true,
+	pipeline_svc.DOCS_OPT_REPD_METRIC:                true,
+	pipeline_svc.DOCS_RECEIVED_DCP_METRIC:            true,
+	pipeline_svc.EXPIRY_RECEIVED_DCP_METRIC:          true,
+	pipeline_svc.DELETION_RECEIVED_DCP_METRIC:        true,
+	pipeline_svc.SET_RECEIVED_DCP_METRIC:             true,
+	pipeline_svc.DOCS_CHECKED_METRIC:                 true,
+}
+
+type prometheusSample struct {
+	labels string
+	value  float64
+}
+
+type prometheusMetric struct {
+	metricType string
+	samples    []*prometheusSample
+}
+
+// metrics in prometheus text exposition format. the samples of a metric are grouped together,
+// as the format requires
+type prometheusMetrics map[string]*prometheusMetric
+
+// labels are pairs of label names and values
+func (metrics prometheusMetrics) add(name, metricType string, value float64, labels ...string) {
+	name = sanitizePrometheusName(PrometheusMetricPrefix + name)
+	metric, ok := metrics[name]
+	if !ok {
+		metric = &prometheusMetric{metricType: metricType}
+		metrics[name] = metric
+	}
+	metric.samples = append(metric.samples, &prometheusSample{labels: formatPrometheusLabels(labels), value: value})
+}
+
+func (metrics prometheusMetrics) bytes() []byte {
+	names := make([]string, 0, len(metrics))
+	for name, _ := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	for _, name := range names {
+		metric := metrics[name]
+		sort.Sort(prometheusSamplesByLabels(metric.samples))
+		fmt.Fprintf(&buffer, "# TYPE %v %v\n", name, metric.metricType)
+		for _, sample := range metric.samples {
+			fmt.Fprintf(&buffer, "%v%v %v\n", name, sample.labels, strconv.FormatFloat(sample.value, 'g', -1, 64))
+		}
+	}
+	return buffer.Bytes()
+}
+
+type prometheusSamplesByLabels []*prometheusSample
+
+func (list prometheusSamplesByLabels) Len() int           { return len(list) }
+func (list prometheusSamplesByLabels) Swap(i, j int)      { list[i], list[j] = list[j], list[i] }
+func (list prometheusSamplesByLabels) Less(i, j int) bool { return list[i].labels < list[j].labels }
+
+func formatPrometheusLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=\"%v\"", labels[i], escapePrometheusLabelValue(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var prometheusLabelValueReplacer = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func escapePrometheusLabelValue(value string) string {
+	return prometheusLabelValueReplacer.Replace(value)
+}
+
+// replaces the characters that are not allowed in metric names with '_'
+func sanitizePrometheusName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// get the metrics of all replications, the memory stats of the process and the sizes of connection pools,
+// in prometheus text exposition format
+func GetPrometheusMetrics() []byte {
+	metrics := make(prometheusMetrics)
+	addReplicationPrometheusMetrics(metrics)
+	addMemPrometheusMetrics(metrics)
+	addConnPoolPrometheusMetrics(metrics)
+	return metrics.bytes()
+}
+
+func addReplicationPrometheusMetrics(metrics prometheusMetrics) {
+	for _, repl_status := range pipeline_manager.ReplicationStatusMap() {
+		spec := repl_status.Spec()
+		overview_stats := repl_status.GetOverviewStats()
+		if spec == nil || overview_stats == nil {
+			continue
+		}
+
+		// fall back to the uuid of target cluster when its reference cannot be found
+		target_cluster := spec.TargetClusterUUID
+		if ref, err := RemoteClusterService().RemoteClusterByUuid(spec.TargetClusterUUID, false); err == nil && ref != nil {
+			target_cluster = ref.Name
+		}
+		labels := []string{PrometheusLabelSourceBucket, spec.SourceBucketName, PrometheusLabelTargetCluster, target_cluster,
+			PrometheusLabelTargetBucket, spec.TargetBucketName, PrometheusLabelReplicationId, spec.Id}
+
+		overview_stats.Do(func(kv expvar.KeyValue) {
+			// only numeric metrics can be exported
+			value, err := strconv.ParseFloat(kv.Value.String(), 64)
+			if err != nil {
+				return
+			}
+			metricType := PrometheusGauge
+			if PrometheusCounterMetrics[kv.Key] {
+				metricType = PrometheusCounter
+			}
+			metrics.add(kv.Key, metricType, value, labels...)
+		})
+	}
+}
+
+func addMemPrometheusMetrics(metrics prometheusMetrics) {
+	stats := new(runtime.MemStats)
+	runtime.ReadMemStats(stats)
+
+	metrics.add("memstats_alloc_bytes", PrometheusGauge, float64(stats.Alloc))
+	metrics.add("memstats_total_alloc_bytes", PrometheusCounter, float64(stats.TotalAlloc))
+	metrics.add("memstats_sys_bytes", PrometheusGauge, float64(stats.Sys))
+	metrics.add("memstats_mallocs", PrometheusCounter, float64(stats.Mallocs))
+	metrics.add("memstats_frees", PrometheusCounter, float64(stats.Frees))
+	metrics.add("memstats_heap_alloc_bytes", PrometheusGauge, float64(stats.HeapAlloc))
+	metrics.add("memstats_heap_sys_bytes", PrometheusGauge, float64(stats.HeapSys))
+	metrics.add("memstats_heap_idle_bytes", PrometheusGauge, float64(stats.HeapIdle))
+	metrics.add("memstats_heap_inuse_bytes", PrometheusGauge, float64(stats.HeapInuse))
+	metrics.add("memstats_heap_released_bytes", PrometheusGauge, float64(stats.HeapReleased))
+	metrics.add("memstats_heap_objects", PrometheusGauge, float64(stats.HeapObjects))
+	metrics.add("memstats_stack_inuse_bytes", PrometheusGauge, float64(stats.StackInuse))
+	metrics.add("memstats_stack_sys_bytes", PrometheusGauge, float64(stats.StackSys))
+	metrics.add("memstats_next_gc_bytes", PrometheusGauge, float64(stats.NextGC))
+	metrics.add("memstats_pause_total_ns", PrometheusCounter, float64(stats.PauseTotalNs))
+	metrics.add("memstats_num_gc", PrometheusCounter, float64(stats.NumGC))
+	metrics.add("goroutines", PrometheusGauge, float64(runtime.NumGoroutine()))
+}
+
+func addConnPoolPrometheusMetrics(metrics prometheusMetrics) {
+	for _, pool := range base.ConnPoolMgr().Pools() {
+		labels := []string{PrometheusLabelPool, pool.Name(), PrometheusLabelConnType, pool.ConnType().String()}
+		// the number of idle connections in the pool
+		metrics.add("conn_pool_size", PrometheusGauge, float64(pool.Size()), labels...)
+		metrics.add("conn_pool_max_conn", PrometheusGauge, float64(pool.MaxConn()), labels...)
+	}
+}
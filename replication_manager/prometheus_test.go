@@ -0,0 +1,40 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package replication_manager
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	metrics := make(prometheusMetrics)
+	metrics.add("docs_written", PrometheusCounter, 10, PrometheusLabelReplicationId, "b", PrometheusLabelTargetBucket, "t\"1")
+	metrics.add("changes_left", PrometheusGauge, 0.5)
+	metrics.add("docs_written", PrometheusCounter, 20, PrometheusLabelReplicationId, "a", PrometheusLabelTargetBucket, "t\\2\n")
+	metrics.add("conn_pool_size", PrometheusGauge, 3, PrometheusLabelPool, "pool-1.x")
+
+	expected := strings.Join([]string{
+		`# TYPE xdcr_changes_left gauge`,
+		`xdcr_changes_left 0.5`,
+		`# TYPE xdcr_conn_pool_size gauge`,
+		`xdcr_conn_pool_size{pool="pool-1.x"} 3`,
+		`# TYPE xdcr_docs_written counter`,
+		`xdcr_docs_written{replication_id="a",target_bucket="t\\2\n"} 20`,
+		`xdcr_docs_written{replication_id="b",target_bucket="t\"1"} 10`,
+	}, "\n") + "\n"
+	if output := string(metrics.bytes()); output != expected {
+		t.Errorf("unexpected output\n%v\nexpected\n%v", output, expected)
+	}
+
+	if name := sanitizePrometheusName("xdcr_rate-replicated.1"); name != "xdcr_rate_replicated_1" {
+		t.Errorf("unexpected sanitized name %v", name)
+	}
+}
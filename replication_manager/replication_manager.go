@@ -19,30 +19,72 @@ import (
 	mcc "github.com/couchbase/gomemcached/client"
 	"github.com/couchbase/goxdcr/base"
 	"github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/conflict_log"
+	"github.com/couchbase/goxdcr/dead_letter"
 	"github.com/couchbase/goxdcr/factory"
+	"github.com/couchbase/goxdcr/filter"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/metadata"
 	"github.com/couchbase/goxdcr/pipeline"
 	"github.com/couchbase/goxdcr/pipeline_manager"
+	"github.com/couchbase/goxdcr/pipeline_utils"
 	"github.com/couchbase/goxdcr/pipeline_svc"
 	"github.com/couchbase/goxdcr/service_def"
 	"github.com/couchbase/goxdcr/simple_utils"
 	"github.com/couchbase/goxdcr/supervisor"
 	"github.com/couchbase/goxdcr/utils"
+	"github.com/couchbase/goxdcr/verify"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 var logger_rm *log.CommonLogger = log.NewLogger("ReplicationManager", log.DefaultLoggerContext)
 var StatsUpdateIntervalForPausedReplications = 60 * time.Second
 var StatusCheckInterval = 15 * time.Second
 
+// parameters of filter dry run
+var DefaultFilterDryRunNumDocs = 1000
+var MaxFilterDryRunNumDocs = 10000
+var DefaultFilterDryRunNumVBuckets = 4
+var FilterDryRunTimeout = 10 * time.Second
+
+// max time to scan the vbuckets of source bucket for the start seqnos of a replication that starts from a timestamp.
+// source kv nodes are scanned in parallel, and all of them have to finish within it
+var StartFromTimestampScanTimeout = 5 * time.Minute
+
+// scans the vbuckets on a source kv node for start seqnos. replaced in tests
+var findStartSeqnosForCas = utils.FindStartSeqnosForCas
+
+// max number of matched/unmatched keys returned by filter dry run
+var FilterDryRunNumSamples = 20
+
+// number of conflict records returned by conflict log request
+var DefaultConflictLogLimit = 100
+var MaxConflictLogLimit = 1000
+
+// number of dead-letter entries returned by dead letters request
+var DefaultDeadLettersLimit = 100
+var MaxDeadLettersLimit = 1000
+
+// timeout of the requests with which dead-letter entries are listed, or retried, on other nodes
+var DeadLettersPeerTimeout = 30 * time.Second
+
+// timeout of the requests for the recent conflict records on other nodes
+var ConflictLogPeerTimeout = 30 * time.Second
+
+// max number of keys looked up on target per second by a verification job, unless specified in verify request
+var DefaultVerifyRateLimit = 1000
+
 var GoXDCROptions struct {
 	SourceKVAdminPort    uint64 //source kv admin port
 	XdcrRestPort         uint64 // port number of XDCR rest server
@@ -357,7 +399,7 @@ func InternalSettingsService() service_def.InternalSettingsSvc {
 //and start the replication pipeline
 func CreateReplication(justValidate bool, sourceBucket, targetCluster, targetBucket string, settings map[string]interface{}, realUserId *base.RealUserId) (string, map[string]error, error) {
 	logger_rm.Infof("Creating replication - justValidate=%v, sourceBucket=%s, targetCluster=%s, targetBucket=%s, settings=%v\n",
-		justValidate, sourceBucket, targetCluster, targetBucket, settings)
+		justValidate, sourceBucket, targetCluster, targetBucket, metadata.RedactSettingsMap(settings))
 
 	var spec *metadata.ReplicationSpecification
 	spec, errorsMap, err := replication_mgr.createAndPersistReplicationSpec(justValidate, sourceBucket, targetCluster, targetBucket, settings)
@@ -491,27 +533,50 @@ func UpdateDefaultReplicationSettings(settings map[string]interface{}, realUserI
 }
 
 //update the per-replication settings
-func UpdateReplicationSettings(topic string, settings map[string]interface{}, realUserId *base.RealUserId) (map[string]error, error) {
-	logger_rm.Infof("Update replication settings for %v, settings=%v\n", topic, settings)
+//when filter expressions are changed, filterRestream specifies whether replication needs to re-stream from seqno 0,
+//so that documents that did not match the old filter but match the new one get replicated.
+//otherwise replication continues from current checkpoints and the new filter applies only to subsequent mutations
+func UpdateReplicationSettings(topic string, settings map[string]interface{}, filterRestream bool, realUserId *base.RealUserId) (map[string]error, error) {
+	logger_rm.Infof("Update replication settings for %v, settings=%v, filterRestream=%v\n", topic, metadata.RedactSettingsMap(settings), filterRestream)
 	// read replication spec with the specified replication id
 	replSpec, err := ReplicationSpecService().ReplicationSpec(topic)
 	if err != nil {
 		return nil, err
 	}
 
-	oldFilterExpression := replSpec.Settings.FilterExpression
+	oldKeyRewriteRules := replSpec.Settings.KeyRewriteRules
 
 	// update replication spec with input settings
 	changedSettingsMap, errorMap := replSpec.Settings.UpdateSettingsFromMap(settings)
 
-	// enforce that filter expression cannot be changed
-	newFilterExpression, ok := settings[FilterExpression]
+	// enforce that replications cannot be changed from or to file and webhook types, since the targets are of different forms
+	if _, ok := changedSettingsMap[metadata.ReplicationType]; ok && (!replSpec.HasTargetCluster() || metadata.TargetClusterUUIDForRepType(replSpec.Settings.RepType) != "") {
+		errorMap[Type] = errors.New("Replications cannot be changed from or to file or webhook type")
+	}
+	if replSpec.IsFileTarget() && replSpec.Settings.FileSinkDir == "" {
+		errorMap[FileSinkDir] = errors.New("The directory to write files into is required for replications of file type")
+	}
+	if replSpec.IsWebhookTarget() && replSpec.Settings.WebhookUrl == "" {
+		errorMap[WebhookUrl] = errors.New("The url to post to is required for replications of webhook type")
+	}
+
+	// enforce that key rewrite rules cannot be changed, since documents replicated earlier would keep the old keys on target
+	newKeyRewriteRules, ok := settings[metadata.KeyRewriteRules]
 	if ok {
-		if newFilterExpression != oldFilterExpression {
-			errorMap[FilterExpression] = errors.New("Filter expression cannot be changed after the replication is created")
+		if newKeyRewriteRules != oldKeyRewriteRules {
+			errorMap[KeyRewriteRules] = errors.New("Key rewrite rules cannot be changed after the replication is created")
 		}
 	}
 
+	_, filterExpressionChanged := changedSettingsMap[metadata.FilterExpression]
+	_, filterBodyExpressionChanged := changedSettingsMap[metadata.FilterBodyExpression]
+	if (filterExpressionChanged || filterBodyExpressionChanged) && filterRestream {
+		// checkpoints created under the old filter version will be discarded by checkpoint manager
+		replSpec.Settings.FilterVersion++
+		logger_rm.Infof("Filter expressions of replication %v have been changed. Replication will re-stream from seqno 0 with filter version %v\n",
+			topic, replSpec.Settings.FilterVersion)
+	}
+
 	if len(errorMap) != 0 {
 		return errorMap, nil
 	}
@@ -572,7 +637,7 @@ func GetStatistics(bucket string) (*expvar.Map, error) {
 //create and persist the replication specification
 func (rm *replicationManager) createAndPersistReplicationSpec(justValidate bool, sourceBucket, targetCluster, targetBucket string, settings map[string]interface{}) (*metadata.ReplicationSpecification, map[string]error, error) {
 	logger_rm.Infof("Creating replication spec - justValidate=%v, sourceBucket=%s, targetCluster=%s, targetBucket=%s, settings=%v\n",
-		justValidate, sourceBucket, targetCluster, targetBucket, settings)
+		justValidate, sourceBucket, targetCluster, targetBucket, metadata.RedactSettingsMap(settings))
 
 	// validate that everything is alright with the replication configuration before actually creating it
 	sourceBucketUUID, targetBucketUUID, targetClusterRef, errorMap := replication_mgr.repl_spec_svc.ValidateNewReplicationSpec(sourceBucket, targetCluster, targetBucket, settings)
@@ -580,7 +645,13 @@ func (rm *replicationManager) createAndPersistReplicationSpec(justValidate bool,
 		return nil, errorMap, nil
 	}
 
-	spec := metadata.NewReplicationSpecification(sourceBucket, sourceBucketUUID, targetClusterRef.Uuid, targetBucket, targetBucketUUID)
+	// replications of file and webhook types have no target cluster
+	repType, _ := settings[metadata.ReplicationType].(string)
+	targetClusterUUID := metadata.TargetClusterUUIDForRepType(repType)
+	if targetClusterRef != nil {
+		targetClusterUUID = targetClusterRef.Uuid
+	}
+	spec := metadata.NewReplicationSpecification(sourceBucket, sourceBucketUUID, targetClusterUUID, targetBucket, targetBucketUUID)
 
 	replSettings, err := ReplicationSettingsService().GetDefaultReplicationSettings()
 	if err != nil {
@@ -596,6 +667,17 @@ func (rm *replicationManager) createAndPersistReplicationSpec(justValidate bool,
 		return spec, nil, nil
 	}
 
+	startsFromBeginning := spec.Settings.StartFrom == metadata.StartFromBeginning
+	if !startsFromBeginning {
+		// persist the starting point before the spec, so that pipelines find it when they are started
+		err = createInitialCheckpoints(spec)
+		if err != nil {
+			logger_rm.Errorf("Error creating initial checkpoints for replication %s. err=%v\n", spec.Id, err)
+			replication_mgr.checkpoint_svc.DelCheckpointsDocs(spec.Id)
+			return spec, nil, err
+		}
+	}
+
 	//persist it
 	err = replication_mgr.repl_spec_svc.AddReplicationSpec(spec)
 	if err == nil {
@@ -603,10 +685,121 @@ func (rm *replicationManager) createAndPersistReplicationSpec(justValidate bool,
 		return spec, nil, nil
 	} else {
 		logger_rm.Errorf("Error adding replication specification %s. err=%v\n", spec.Id, err)
+		if !startsFromBeginning {
+			replication_mgr.checkpoint_svc.DelCheckpointsDocs(spec.Id)
+		}
 		return spec, nil, err
 	}
 }
 
+// resolves the seqno that the replication starts from in each source vbucket, as specified by its StartFrom setting,
+// and persists checkpoints at them, so that the replication and its restarts never re-stream earlier history.
+// with "now", the replication starts from the current high seqnos. with a timestamp, it starts right before the first
+// mutation at or after the timestamp, which is found by scanning each vbucket up to its current high seqno.
+// the start seqnos are kept in spec.StartSeqnos, along with the vbuuids in spec.StartVBUuids, so that checkpoint manager
+// falls back to them when the checkpoints of a vbucket are discarded later.
+// these checkpoints carry no target vb opaque since nothing has been replicated to target yet.
+// checkpoint manager accepts them without negotiating with target
+func createInitialCheckpoints(spec *metadata.ReplicationSpecification) error {
+	server_vbmap, err := ClusterInfoService().GetServerVBucketsMap(XDCRCompTopologyService(), spec.SourceBucketName)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := ClusterInfoService().GetBucket(XDCRCompTopologyService(), spec.SourceBucketName)
+	if err != nil {
+		return err
+	}
+	statsMap := bucket.GetStats(base.VBUCKET_SEQNO_STAT_NAME)
+	bucket.Close()
+
+	highseqno_map := make(map[uint16]uint64)
+	vbuuid_map := make(map[uint16]uint64)
+	for serverAddr, vbnos := range server_vbmap {
+		statsMapForServer, ok := statsMap[serverAddr]
+		if !ok {
+			return fmt.Errorf("Failed to find vbucket seqno stats for server=%v", serverAddr)
+		}
+		err = utils.ParseHighSeqnoStat(vbnos, statsMapForServer, highseqno_map)
+		if err != nil {
+			return err
+		}
+		err = utils.ParseVBUuidStat(vbnos, statsMapForServer, vbuuid_map)
+		if err != nil {
+			return err
+		}
+		for _, vbno := range vbnos {
+			_, ok1 := highseqno_map[vbno]
+			_, ok2 := vbuuid_map[vbno]
+			if !ok1 || !ok2 {
+				return fmt.Errorf("Failed to find vbucket seqno stats for vb=%v on server=%v", vbno, serverAddr)
+			}
+		}
+	}
+
+	start_seqnos := highseqno_map
+	if startCas := spec.Settings.StartCas(); startCas > 0 {
+		start_seqnos, err = findStartSeqnos(spec.SourceBucketName, server_vbmap, highseqno_map, startCas)
+		if err != nil {
+			return err
+		}
+	}
+
+	for vbno, seqno := range start_seqnos {
+		if seqno == 0 {
+			// nothing to skip
+			continue
+		}
+		ckpt_record := &metadata.CheckpointRecord{
+			Failover_uuid:          vbuuid_map[vbno],
+			Seqno:                  seqno,
+			Dcp_snapshot_seqno:     seqno,
+			Dcp_snapshot_end_seqno: seqno,
+			Filter_version:         spec.Settings.FilterVersion}
+		err = CheckpointService().UpsertCheckpoints(spec.Id, vbno, ckpt_record)
+		if err != nil {
+			return err
+		}
+	}
+	spec.StartSeqnos = start_seqnos
+	spec.StartVBUuids = vbuuid_map
+
+	logger_rm.Infof("Created initial checkpoints for replication %v at seqnos %v\n", spec.Id, start_seqnos)
+	return nil
+}
+
+// scans all source kv nodes in parallel for the start seqnos of a replication that starts from startCas.
+// each scan times out after StartFromTimestampScanTimeout, hence so does the whole
+func findStartSeqnos(bucketName string, server_vbmap map[string][]uint16, highseqno_map map[uint16]uint64, startCas uint64) (map[uint16]uint64, error) {
+	start_seqnos := make(map[uint16]uint64)
+	var start_seqnos_lock sync.Mutex
+	wait_grp := &sync.WaitGroup{}
+	err_ch := make(chan error, len(server_vbmap))
+	for serverAddr, vbnos := range server_vbmap {
+		wait_grp.Add(1)
+		go func(serverAddr string, vbnos []uint16) {
+			defer wait_grp.Done()
+			start_seqnos_for_server, err := findStartSeqnosForCas(serverAddr, bucketName, vbnos, highseqno_map, startCas,
+				StartFromTimestampScanTimeout, logger_rm)
+			if err != nil {
+				err_ch <- err
+				return
+			}
+			start_seqnos_lock.Lock()
+			defer start_seqnos_lock.Unlock()
+			for vbno, seqno := range start_seqnos_for_server {
+				start_seqnos[vbno] = seqno
+			}
+		}(serverAddr, vbnos)
+	}
+	wait_grp.Wait()
+	close(err_ch)
+	if err, ok := <-err_ch; ok {
+		return nil, err
+	}
+	return start_seqnos, nil
+}
+
 // get info of all running replications
 func GetReplicationInfos() ([]base.ReplicationInfo, error) {
 	replInfos := make([]base.ReplicationInfo, 0)
@@ -858,7 +1051,9 @@ func writeCreateReplicationEvent(spec *metadata.ReplicationSpecification, realUs
 	if err == nil {
 		createReplicationEvent := &base.CreateReplicationEvent{
 			GenericReplicationEvent: *genericReplicationEvent,
-			FilterExpression:        spec.Settings.FilterExpression}
+			FilterExpression:        spec.Settings.FilterExpression,
+			FilterBodyExpression:    spec.Settings.FilterBodyExpression,
+			KeyRewriteRules:         spec.Settings.KeyRewriteRules}
 
 		err = AuditService().Write(base.CreateReplicationEventId, createReplicationEvent)
 	}
@@ -907,7 +1102,11 @@ func constructGenericReplicationFields(realUserId *base.RealUserId) (*base.Gener
 }
 
 func constructReplicationSpecificFieldsFromSpec(spec *metadata.ReplicationSpecification) (*base.ReplicationSpecificFields, error) {
-	remoteClusterName := RemoteClusterService().GetRemoteClusterNameFromClusterUuid(spec.TargetClusterUUID)
+	// replications of file and webhook types have no remote cluster
+	remoteClusterName := ""
+	if spec.HasTargetCluster() {
+		remoteClusterName = RemoteClusterService().GetRemoteClusterNameFromClusterUuid(spec.TargetClusterUUID)
+	}
 
 	return &base.ReplicationSpecificFields{
 		SourceBucketName:  spec.SourceBucketName,
@@ -940,7 +1139,7 @@ func constructUpdateDefaultReplicationSettingsEvent(changedSettingsMap *map[stri
 
 	// convert keys in changedSettingsMap from internal metadata keys to external facing rest api keys
 	convertedSettingsMap := make(map[string]interface{})
-	for key, value := range *changedSettingsMap {
+	for key, value := range metadata.RedactSettingsMap(*changedSettingsMap) {
 		if key == metadata.Active {
 			convertedSettingsMap[SettingsKeyToRestKeyMap[key]] = !(value.(bool))
 		} else {
@@ -1010,3 +1209,402 @@ func setBucketSettings(bucketName string, lwwEnabled bool, realUserId *base.Real
 	// return new settings after set op
 	return getBucketSettings(bucketName)
 }
+
+// result of filter dry run
+type FilterDryRunResult struct {
+	// number of docs sampled
+	NumDocs        int
+	MatchedCount   int
+	UnmatchedCount int
+	// keys of some of the docs that match/do not match the filters
+	MatchedSamples   []string
+	UnmatchedSamples []string
+}
+
+// runs the key filter expression and/or the body filter expression over docs sampled from the source bucket,
+// so that filters can be verified against real data before replications are created.
+// docs are sampled through a short-lived dcp stream on numVBuckets vbuckets owned by a kv node local to this xdcr node.
+// a doc matches when it matches both filters, which is what router does
+func FilterDryRun(bucketName, expression, bodyExpression string, numDocs, numVBuckets int) (*FilterDryRunResult, error) {
+	kv_vb_map, err := pipeline_utils.GetSourceVBMap(ClusterInfoService(), XDCRCompTopologyService(), bucketName, logger_rm)
+	if err != nil {
+		return nil, err
+	}
+
+	var kvaddr string
+	var vbnos []uint16
+	for kvaddr_iter, vbnos_iter := range kv_vb_map {
+		if len(vbnos_iter) > 0 {
+			kvaddr = kvaddr_iter
+			vbnos = vbnos_iter
+			break
+		}
+	}
+	if len(vbnos) == 0 {
+		return nil, fmt.Errorf("No vbucket of bucket %v is found on local kv node", bucketName)
+	}
+
+	// pick vbuckets evenly from the vb list, which tends to give a more representative sample than consecutive vbuckets
+	if numVBuckets < len(vbnos) {
+		sampledVBs := make([]uint16, 0, numVBuckets)
+		for i := 0; i < numVBuckets; i++ {
+			sampledVBs = append(sampledVBs, vbnos[i*len(vbnos)/numVBuckets])
+		}
+		vbnos = sampledVBs
+	}
+
+	logger_rm.Infof("Sampling %v docs from vbs %v of bucket %v on %v for filter dry run\n", numDocs, vbnos, bucketName, kvaddr)
+	keys, bodies, err := utils.SampleDocsFromDcp(kvaddr, bucketName, vbnos, numDocs, FilterDryRunTimeout, logger_rm)
+	if err != nil {
+		return nil, err
+	}
+
+	// GetMatchedKeys works on utf8 keys only. exclude other keys from the sample
+	validKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if utf8.ValidString(key) {
+			validKeys = append(validKeys, key)
+		}
+	}
+	keys = validKeys
+
+	var matchesMap map[string][][]int
+	if len(expression) > 0 {
+		matchesMap, err = utils.GetMatchedKeys(expression, keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var bodyFilter *filter.Expression
+	if len(bodyExpression) > 0 {
+		bodyFilter, err = filter.Parse(bodyExpression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &FilterDryRunResult{
+		NumDocs:          len(keys),
+		MatchedSamples:   make([]string, 0),
+		UnmatchedSamples: make([]string, 0)}
+	for _, key := range keys {
+		matched := true
+		if matchesMap != nil && len(matchesMap[key]) == 0 {
+			matched = false
+		}
+		if matched && bodyFilter != nil && !bodyFilter.Match(bodies[key]) {
+			matched = false
+		}
+
+		if matched {
+			result.MatchedCount++
+			if len(result.MatchedSamples) < FilterDryRunNumSamples {
+				result.MatchedSamples = append(result.MatchedSamples, key)
+			}
+		} else {
+			result.UnmatchedCount++
+			if len(result.UnmatchedSamples) < FilterDryRunNumSamples {
+				result.UnmatchedSamples = append(result.UnmatchedSamples, key)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// get the progress of the replication on the local node, broken down by vbucket
+func GetVBProgress(spec *metadata.ReplicationSpecification) (*pipeline_svc.ReplicationVBProgress, error) {
+	return pipeline_svc.GetVBProgressForReplication(spec, ClusterInfoService(), XDCRCompTopologyService(), CheckpointService(), logger_rm)
+}
+
+// starts a job that verifies the target bucket of the replication against the source vbuckets owned by the kv node
+// local to this xdcr node. the job looks up at most rateLimit keys per second on target, or is not limited when rateLimit is 0
+func StartVerification(spec *metadata.ReplicationSpecification, rateLimit int) (*verify.Job, error) {
+	kv_vb_map, err := pipeline_utils.GetSourceVBMap(ClusterInfoService(), XDCRCompTopologyService(), spec.SourceBucketName, logger_rm)
+	if err != nil {
+		return nil, err
+	}
+	var kvaddr string
+	var vbnos []uint16
+	for kvaddr_iter, vbnos_iter := range kv_vb_map {
+		if len(vbnos_iter) > 0 {
+			kvaddr = kvaddr_iter
+			vbnos = vbnos_iter
+			break
+		}
+	}
+	if len(vbnos) == 0 {
+		return nil, fmt.Errorf("No vbucket of bucket %v is found on local kv node", spec.SourceBucketName)
+	}
+
+	sourceBucket, err := ClusterInfoService().GetBucket(XDCRCompTopologyService(), spec.SourceBucketName)
+	if err != nil {
+		return nil, err
+	}
+	numSourceVBs := len(sourceBucket.VBServerMap().VBucketMap)
+	sourceBucket.Close()
+
+	targetClusterRef, err := RemoteClusterService().RemoteClusterByUuid(spec.TargetClusterUUID, false)
+	if err != nil {
+		return nil, err
+	}
+	targetBucket, err := ClusterInfoService().GetBucket(targetClusterRef, spec.TargetBucketName)
+	if err != nil {
+		return nil, err
+	}
+	defer targetBucket.Close()
+	targetServerVBMap, err := ClusterInfoService().GetServerVBucketsMap(targetClusterRef, spec.TargetBucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	// conflict resolution mode is decided in the same way as in the replication
+	crMode := base.CRMode_RevId
+	extMetaSupported, err := pipeline_utils.HasExtMetadataSupport(ClusterInfoService(), targetClusterRef)
+	if err != nil {
+		return nil, err
+	}
+	if extMetaSupported {
+		crMode = simple_utils.GetCRModeFromTimeSyncSetting(targetBucket.TimeSynchronization)
+	}
+
+	newTargetConn, err := getVerificationTargetConnFunc(spec, targetClusterRef, targetBucket.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	return verify.Start(verify.Config{
+		ReplicationId:    spec.Id,
+		SourceBucketName: spec.SourceBucketName,
+		VBuckets:         vbnos,
+		NumSourceVBs:     numSourceVBs,
+		NewSourceConn: func() (*mcc.Client, error) {
+			return utils.GetMemcachedConnection(kvaddr, spec.SourceBucketName, logger_rm)
+		},
+		TargetServerVBMap: targetServerVBMap,
+		NewTargetConn:     newTargetConn,
+		Settings:          spec.Settings,
+		CRMode:            crMode,
+		RateLimit:         rateLimit,
+		StartSeqnos:       spec.StartSeqnos,
+	})
+}
+
+// returns the function that opens connections to target kv nodes for verification jobs.
+// like xmem nozzles, it uses ssl over memcached when the remote cluster reference demands encryption
+func getVerificationTargetConnFunc(spec *metadata.ReplicationSpecification, targetClusterRef *metadata.RemoteClusterReference,
+	bucketPwd string) (func(serverAddr string) (*mcc.Client, error), error) {
+	bucketName := spec.TargetBucketName
+	if !targetClusterRef.DemandEncryption {
+		return func(serverAddr string) (*mcc.Client, error) {
+			return base.NewConn(serverAddr, bucketName, bucketPwd)
+		}, nil
+	}
+
+	hasSSLOverMemSupport, err := pipeline_utils.HasSSLOverMemSupport(ClusterInfoService(), targetClusterRef)
+	if err != nil {
+		return nil, err
+	}
+	if !hasSSLOverMemSupport {
+		return nil, errors.New("Verification is not supported for replications to target clusters that require ssl over proxy")
+	}
+	sanInCertificate, err := pipeline_utils.HasSANInCertificateSupport(ClusterInfoService(), targetClusterRef)
+	if err != nil {
+		return nil, err
+	}
+	ssl_port_map, err := utils.GetMemcachedSSLPort(targetClusterRef.HostName, targetClusterRef.UserName, targetClusterRef.Password, bucketName, logger_rm)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(serverAddr string) (*mcc.Client, error) {
+		ssl_port, ok := ssl_port_map[serverAddr]
+		if !ok {
+			return nil, fmt.Errorf("Cannot find memcached ssl port for %v", serverAddr)
+		}
+		ssl_con_str := utils.GetHostAddr(utils.GetHostName(serverAddr), ssl_port)
+		conn, _, err := base.MakeTLSConn(ssl_con_str, targetClusterRef.Certificate, sanInCertificate, logger_rm)
+		if err != nil {
+			return nil, err
+		}
+		client, err := mcc.Wrap(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		_, err = client.Auth(bucketName, bucketPwd)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		return client, nil
+	}, nil
+}
+
+// returns the addresses, host:port, of the rest servers of the xdcr processes on the other nodes of the cluster
+func peerXDCRAddrs() (string, []string, error) {
+	myHost, err := XDCRCompTopologyService().MyHost()
+	if err != nil {
+		return "", nil, err
+	}
+	topology, err := XDCRCompTopologyService().XDCRTopology()
+	if err != nil {
+		return "", nil, err
+	}
+	peers := make([]string, 0, len(topology))
+	for host, port := range topology {
+		if host != myHost {
+			peers = append(peers, utils.GetHostAddr(host, port))
+		}
+	}
+	return myHost, peers, nil
+}
+
+func conflictLogPath(replicationId string) string {
+	return base.AdminportUrlPrefix + ConflictLogPrefix + base.UrlDelimiter + replicationId
+}
+
+// returns up to limit of the recent conflict records of a replication on all nodes, latest first, skipping the first
+// offset ones, and the total number of records
+func ListConflictLog(replicationId string, offset, limit int) ([]*conflict_log.Record, int, error) {
+	myHost, peers, err := peerXDCRAddrs()
+	if err != nil {
+		return nil, 0, err
+	}
+	return listConflictLog(replicationId, offset, limit, myHost, peers)
+}
+
+func listConflictLog(replicationId string, offset, limit int, myHost string, peers []string) ([]*conflict_log.Record, int, error) {
+	// each node returns its latest offset+limit records, which include all the records to return
+	localRecords, total := conflict_log.RecentRecords(replicationId, 0, offset+limit)
+	records := make([]*conflict_log.Record, 0, len(localRecords))
+	for _, localRecord := range localRecords {
+		// records in memory are not modified
+		record := *localRecord
+		record.Node = myHost
+		records = append(records, &record)
+	}
+
+	path := fmt.Sprintf("%v?%v=true&%v=0&%v=%v", conflictLogPath(replicationId), ConflictLogLocal, Offset, Limit, offset+limit)
+	for _, peer := range peers {
+		var peerResponse struct {
+			Total     int                    `json:"total"`
+			Conflicts []*conflict_log.Record `json:"conflicts"`
+		}
+		err, statusCode := utils.QueryRestApi(peer, path, false, base.MethodGet, "", nil, ConflictLogPeerTimeout, &peerResponse, logger_rm)
+		if err != nil || statusCode != http.StatusOK {
+			return nil, 0, fmt.Errorf("Failed to get conflict records from %v. err=%v, statusCode=%v", peer, err, statusCode)
+		}
+		for _, record := range peerResponse.Conflicts {
+			record.Node = utils.GetHostName(peer)
+			records = append(records, record)
+		}
+		total += peerResponse.Total
+	}
+
+	sort.Stable(conflict_log.RecordsByLatest(records))
+	if offset >= len(records) {
+		return []*conflict_log.Record{}, total, nil
+	}
+	end := offset + limit
+	if end > len(records) {
+		end = len(records)
+	}
+	return records[offset:end], total, nil
+}
+
+func deadLettersPath(replicationId string) string {
+	return base.AdminportUrlPrefix + DeadLettersPrefix + base.UrlDelimiter + replicationId
+}
+
+// returns up to limit of the dead-letter entries of a replication on all nodes, oldest first, skipping the first
+// offset ones, and the total number of entries
+func ListDeadLetters(replicationId string, offset, limit int) ([]*dead_letter.Entry, int, error) {
+	myHost, peers, err := peerXDCRAddrs()
+	if err != nil {
+		return nil, 0, err
+	}
+	return listDeadLetters(replicationId, offset, limit, myHost, peers)
+}
+
+func listDeadLetters(replicationId string, offset, limit int, myHost string, peers []string) ([]*dead_letter.Entry, int, error) {
+	// each node returns its oldest offset+limit entries, which include all the entries to return
+	localEntries, total, err := dead_letter.List(replicationId, 0, offset+limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	entries := make([]*dead_letter.Entry, 0, len(localEntries))
+	for _, localEntry := range localEntries {
+		// entries in store are not modified
+		entry := *localEntry
+		entry.Node = myHost
+		entries = append(entries, &entry)
+	}
+
+	path := fmt.Sprintf("%v?%v=true&%v=0&%v=%v", deadLettersPath(replicationId), DeadLettersLocal, Offset, Limit, offset+limit)
+	for _, peer := range peers {
+		var peerResponse struct {
+			Total   int                  `json:"total"`
+			Entries []*dead_letter.Entry `json:"entries"`
+		}
+		err, statusCode := utils.QueryRestApi(peer, path, false, base.MethodGet, "", nil, DeadLettersPeerTimeout, &peerResponse, logger_rm)
+		if err != nil || statusCode != http.StatusOK {
+			return nil, 0, fmt.Errorf("Failed to get dead-letter entries from %v. err=%v, statusCode=%v", peer, err, statusCode)
+		}
+		for _, entry := range peerResponse.Entries {
+			entry.Node = utils.GetHostName(peer)
+			entries = append(entries, entry)
+		}
+		total += peerResponse.Total
+	}
+
+	// ids are derived from the time entries are added, and are ordered across nodes
+	sort.Sort(dead_letter.EntriesById(entries))
+	if offset >= len(entries) {
+		return []*dead_letter.Entry{}, total, nil
+	}
+	end := offset + limit
+	if end > len(entries) {
+		end = len(entries)
+	}
+	return entries[offset:end], total, nil
+}
+
+// queues the dead-letter entries of a replication with the given ids, or all entries when ids is empty, on all nodes
+// for retry. returns the number of entries queued
+func RetryDeadLetters(replicationId string, ids []uint64) (int, error) {
+	_, peers, err := peerXDCRAddrs()
+	if err != nil {
+		return 0, err
+	}
+	return retryDeadLetters(replicationId, ids, peers)
+}
+
+func retryDeadLetters(replicationId string, ids []uint64, peers []string) (int, error) {
+	queued, err := dead_letter.Retry(replicationId, ids)
+	if err != nil {
+		return 0, err
+	}
+
+	params := url.Values{}
+	params.Set(DeadLettersLocal, "true")
+	if len(ids) > 0 {
+		idStrs := make([]string, len(ids))
+		for i, id := range ids {
+			idStrs[i] = strconv.FormatUint(id, base.ParseIntBase)
+		}
+		params.Set(DeadLetterIds, strings.Join(idStrs, ","))
+	}
+	for _, peer := range peers {
+		var peerResponse struct {
+			Queued int `json:"queued"`
+		}
+		err, statusCode := utils.QueryRestApi(peer, deadLettersPath(replicationId), false, base.MethodPost, base.DefaultContentType, []byte(params.Encode()), DeadLettersPeerTimeout, &peerResponse, logger_rm)
+		if err != nil || statusCode != http.StatusOK {
+			return queued, fmt.Errorf("Queued %v dead-letter entries for retry, but failed to retry the entries on %v. err=%v, statusCode=%v", queued, peer, err, statusCode)
+		}
+		queued += peerResponse.Queued
+	}
+	return queued, nil
+}
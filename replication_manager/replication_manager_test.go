@@ -0,0 +1,368 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package replication_manager
+
+import (
+	"errors"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/conflict_log"
+	"github.com/couchbase/goxdcr/dead_letter"
+	"github.com/couchbase/goxdcr/log"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDeadLettersReplicationId = "uuid/source/target"
+
+// points the xdcr data dir to a temp dir, and returns the function that discards the local entries and restores it
+func setupTestDeadLetters(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "dead_letter")
+	if err != nil {
+		t.Fatalf("failed to create temp dir. err=%v", err)
+	}
+	oldDataDir := base.XDCRDataDir
+	base.XDCRDataDir = dir
+	return func() {
+		dead_letter.Remove(testDeadLettersReplicationId)
+		base.XDCRDataDir = oldDataDir
+		os.RemoveAll(dir)
+	}
+}
+
+func addTestDeadLetter(t *testing.T, key string) *dead_letter.Entry {
+	req := &base.WrappedMCRequest{Seqno: 1,
+		Req: &mc.MCRequest{Opcode: base.SET_WITH_META,
+			Key:    []byte(key),
+			Body:   []byte(`{"big":true}`),
+			Extras: make([]byte, 24),
+		},
+	}
+	entry := dead_letter.NewEntry(testDeadLettersReplicationId, "xmem_0", req, "E2BIG")
+	if err := dead_letter.Add(entry, 100); err != nil {
+		t.Fatalf("failed to add entry. err=%v", err)
+	}
+	return entry
+}
+
+// the dead-letter rest server of the xdcr process on another node, which holds the given entries
+type testDeadLettersPeer struct {
+	t       *testing.T
+	entries []*dead_letter.Entry
+	retried []uint64
+	server  *httptest.Server
+}
+
+func newTestDeadLettersPeer(t *testing.T, entries ...*dead_letter.Entry) *testDeadLettersPeer {
+	peer := &testDeadLettersPeer{t: t, entries: entries}
+	peer.server = httptest.NewServer(http.HandlerFunc(peer.handle))
+	return peer
+}
+
+func (peer *testDeadLettersPeer) addr() string {
+	return strings.TrimPrefix(peer.server.URL, "http://")
+}
+
+func (peer *testDeadLettersPeer) handle(w http.ResponseWriter, r *http.Request) {
+	replicationId, err := DecodeDynamicParamInURL(r, DeadLettersPrefix, "Replication Id")
+	if err != nil || replicationId != testDeadLettersReplicationId {
+		peer.t.Errorf("unexpected replication id %v in request. err=%v", replicationId, err)
+	}
+
+	var local bool
+	var status int
+	var body []byte
+	switch r.Method {
+	case base.MethodGet:
+		var offset, limit int
+		offset, limit, local, err = DecodeDeadLettersRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if offset != 0 {
+			peer.t.Errorf("expected other nodes to be asked for entries from offset 0, got %v", offset)
+		}
+		entries := peer.entries
+		if limit < len(entries) {
+			entries = entries[:limit]
+		}
+		response, _ := NewDeadLettersResponse(entries, len(peer.entries), offset)
+		status, body = response.StatusCode, response.Body
+	case base.MethodPost:
+		var ids []uint64
+		ids, local, err = DecodeDeadLettersRetryRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		queued := 0
+		for _, entry := range peer.entries {
+			for _, id := range ids {
+				if entry.Id == id {
+					queued++
+				}
+			}
+		}
+		if len(ids) == 0 {
+			queued = len(peer.entries)
+		}
+		peer.retried = append(peer.retried, ids...)
+		response, _ := NewDeadLettersRetryResponse(queued)
+		status, body = response.StatusCode, response.Body
+	}
+	if !local {
+		peer.t.Errorf("expected requests to other nodes to be local")
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func TestDecodeDeadLettersRequest(t *testing.T) {
+	request, _ := http.NewRequest(base.MethodGet, "/deadLetters/id?offset=10&limit=20", nil)
+	if offset, limit, local, err := DecodeDeadLettersRequest(request); err != nil || offset != 10 || limit != 20 || local {
+		t.Errorf("unexpected offset=%v limit=%v local=%v err=%v", offset, limit, local, err)
+	}
+	request, _ = http.NewRequest(base.MethodGet, "/deadLetters/id", nil)
+	if offset, limit, _, err := DecodeDeadLettersRequest(request); err != nil || offset != 0 || limit != DefaultDeadLettersLimit {
+		t.Errorf("expected default offset and limit, got offset=%v limit=%v err=%v", offset, limit, err)
+	}
+
+	// only requests from other nodes can go beyond the max limit
+	request, _ = http.NewRequest(base.MethodGet, "/deadLetters/id?limit=5000", nil)
+	if _, _, _, err := DecodeDeadLettersRequest(request); err == nil {
+		t.Errorf("expected limit above max to be rejected")
+	}
+	request, _ = http.NewRequest(base.MethodGet, "/deadLetters/id?limit=5000&local=true", nil)
+	if _, limit, local, err := DecodeDeadLettersRequest(request); err != nil || limit != 5000 || !local {
+		t.Errorf("unexpected limit=%v local=%v err=%v", limit, local, err)
+	}
+	request, _ = http.NewRequest(base.MethodGet, "/deadLetters/id?local=maybe", nil)
+	if _, _, _, err := DecodeDeadLettersRequest(request); err == nil {
+		t.Errorf("expected invalid local to be rejected")
+	}
+}
+
+func TestDecodeDeadLettersRetryRequest(t *testing.T) {
+	request, _ := http.NewRequest(base.MethodPost, "/deadLetters/id", strings.NewReader("ids=3,%201&local=true"))
+	request.Header.Set(base.ContentType, base.DefaultContentType)
+	if ids, local, err := DecodeDeadLettersRetryRequest(request); err != nil || len(ids) != 2 || ids[0] != 3 || ids[1] != 1 || !local {
+		t.Errorf("unexpected ids=%v local=%v err=%v", ids, local, err)
+	}
+
+	request, _ = http.NewRequest(base.MethodPost, "/deadLetters/id", strings.NewReader(""))
+	request.Header.Set(base.ContentType, base.DefaultContentType)
+	if ids, local, err := DecodeDeadLettersRetryRequest(request); err != nil || len(ids) != 0 || local {
+		t.Errorf("expected all entries to be retried, got ids=%v local=%v err=%v", ids, local, err)
+	}
+
+	request, _ = http.NewRequest(base.MethodPost, "/deadLetters/id", strings.NewReader("ids=1,x"))
+	request.Header.Set(base.ContentType, base.DefaultContentType)
+	if _, _, err := DecodeDeadLettersRetryRequest(request); err == nil {
+		t.Errorf("expected invalid ids to be rejected")
+	}
+}
+
+func TestListDeadLetters(t *testing.T) {
+	defer setupTestDeadLetters(t)()
+	local0 := addTestDeadLetter(t, "doc0")
+	local1 := addTestDeadLetter(t, "doc1")
+
+	// entries on other nodes were added before, between and after the local ones
+	peer1 := newTestDeadLettersPeer(t, &dead_letter.Entry{Id: local0.Id + 1, Key: "peer1_doc0"},
+		&dead_letter.Entry{Id: local1.Id + 1, Key: "peer1_doc1"})
+	defer peer1.server.Close()
+	peer2 := newTestDeadLettersPeer(t, &dead_letter.Entry{Id: local0.Id - 1, Key: "peer2_doc0"})
+	defer peer2.server.Close()
+	peers := []string{peer1.addr(), peer2.addr()}
+
+	entries, total, err := listDeadLetters(testDeadLettersReplicationId, 0, 10, "node0", peers)
+	if err != nil || total != 5 || len(entries) != 5 {
+		t.Fatalf("expected 5 entries, got %v of total %v. err=%v", len(entries), total, err)
+	}
+	expectedKeys := []string{"peer2_doc0", "doc0", "peer1_doc0", "doc1", "peer1_doc1"}
+	for i, entry := range entries {
+		if entry.Key != expectedKeys[i] {
+			t.Errorf("expected %v at %v, got %v", expectedKeys[i], i, entry.Key)
+		}
+	}
+	if entries[1].Node != "node0" || entries[2].Node != "127.0.0.1" {
+		t.Errorf("expected entries to have their nodes, got %v and %v", entries[1].Node, entries[2].Node)
+	}
+	if local0.Node != "" {
+		t.Errorf("expected entries in local store not to be modified")
+	}
+
+	entries, total, err = listDeadLetters(testDeadLettersReplicationId, 1, 3, "node0", peers)
+	if err != nil || total != 5 || len(entries) != 3 || entries[0].Key != "doc0" || entries[2].Key != "doc1" {
+		t.Errorf("unexpected page %v of total %v. err=%v", entries, total, err)
+	}
+	if entries, total, _ = listDeadLetters(testDeadLettersReplicationId, 5, 3, "node0", peers); total != 5 || len(entries) != 0 {
+		t.Errorf("expected no entries beyond total, got %v", entries)
+	}
+
+	// entries cannot be listed when a node is not reachable
+	peer2.server.Close()
+	if _, _, err = listDeadLetters(testDeadLettersReplicationId, 0, 10, "node0", peers); err == nil {
+		t.Errorf("expected listing to fail when a node is not reachable")
+	}
+}
+
+func TestRetryDeadLetters(t *testing.T) {
+	defer setupTestDeadLetters(t)()
+	local0 := addTestDeadLetter(t, "doc0")
+	addTestDeadLetter(t, "doc1")
+	addTestDeadLetter(t, "doc2")
+
+	peerEntry := &dead_letter.Entry{Id: local0.Id + 1, Key: "peer1_doc0"}
+	peer1 := newTestDeadLettersPeer(t, peerEntry, &dead_letter.Entry{Id: local0.Id + 2, Key: "peer1_doc1"})
+	defer peer1.server.Close()
+	peer2 := newTestDeadLettersPeer(t)
+	defer peer2.server.Close()
+	peers := []string{peer1.addr(), peer2.addr()}
+
+	queued, err := retryDeadLetters(testDeadLettersReplicationId, []uint64{local0.Id, peerEntry.Id}, peers)
+	if err != nil || queued != 2 {
+		t.Errorf("expected 2 entries to be queued, got %v. err=%v", queued, err)
+	}
+	if len(peer1.retried) != 2 || len(peer2.retried) != 2 {
+		t.Errorf("expected ids to be sent to all nodes, got %v and %v", peer1.retried, peer2.retried)
+	}
+	if _, total, _ := dead_letter.List(testDeadLettersReplicationId, 0, 10); total != 2 {
+		t.Errorf("expected local entry to be queued, %v entries left", total)
+	}
+
+	// all entries
+	if queued, err = retryDeadLetters(testDeadLettersReplicationId, nil, peers); err != nil || queued != 4 {
+		t.Errorf("expected 4 entries to be queued, got %v. err=%v", queued, err)
+	}
+
+	// entries queued before the failure are reported
+	addTestDeadLetter(t, "doc3")
+	peer2.server.Close()
+	queued, err = retryDeadLetters(testDeadLettersReplicationId, nil, peers)
+	if err == nil || queued != 3 {
+		t.Errorf("expected retry to fail after 3 entries are queued, got %v. err=%v", queued, err)
+	}
+}
+
+func TestFindStartSeqnos(t *testing.T) {
+	oldFind := findStartSeqnosForCas
+	defer func() { findStartSeqnosForCas = oldFind }()
+
+	server_vbmap := map[string][]uint16{"node0": []uint16{0, 1}, "node1": []uint16{2}, "node2": []uint16{3}}
+	highseqno_map := map[uint16]uint64{0: 10, 1: 20, 2: 30, 3: 40}
+
+	// each scan waits for the scans of all other nodes to start, which only finishes when nodes are scanned in parallel
+	started := make(chan bool, len(server_vbmap))
+	findStartSeqnosForCas = func(serverAddr, bucketName string, vbnos []uint16, highseqno_map map[uint16]uint64, startCas uint64,
+		timeout time.Duration, logger *log.CommonLogger) (map[uint16]uint64, error) {
+		started <- true
+		for len(started) < len(server_vbmap) {
+			select {
+			case <-time.After(time.Second):
+				return nil, errors.New("other nodes are not scanned in parallel")
+			default:
+				time.Sleep(time.Millisecond)
+			}
+		}
+		start_seqnos := make(map[uint16]uint64)
+		for _, vbno := range vbnos {
+			start_seqnos[vbno] = highseqno_map[vbno] - 1
+		}
+		return start_seqnos, nil
+	}
+	start_seqnos, err := findStartSeqnos("default", server_vbmap, highseqno_map, 1)
+	if err != nil {
+		t.Fatalf("unexpected err=%v", err)
+	}
+	if len(start_seqnos) != 4 || start_seqnos[0] != 9 || start_seqnos[1] != 19 || start_seqnos[2] != 29 || start_seqnos[3] != 39 {
+		t.Errorf("unexpected start seqnos %v", start_seqnos)
+	}
+
+	// the failure of any node fails the whole
+	findStartSeqnosForCas = func(serverAddr, bucketName string, vbnos []uint16, highseqno_map map[uint16]uint64, startCas uint64,
+		timeout time.Duration, logger *log.CommonLogger) (map[uint16]uint64, error) {
+		if serverAddr == "node1" {
+			return nil, errors.New("timed out")
+		}
+		return map[uint16]uint64{}, nil
+	}
+	if _, err = findStartSeqnos("default", server_vbmap, highseqno_map, 1); err == nil {
+		t.Errorf("expected the failure of a node to be returned")
+	}
+}
+
+// the conflict log rest server of the xdcr process on another node, which holds the given records, latest first
+func newTestConflictLogPeer(t *testing.T, records ...*conflict_log.Record) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offset, limit, local, err := DecodeConflictLogRequest(r)
+		if err != nil || !local || offset != 0 {
+			t.Errorf("expected local requests from offset 0, got offset=%v local=%v err=%v", offset, local, err)
+		}
+		page := records
+		if limit < len(page) {
+			page = page[:limit]
+		}
+		response, _ := NewConflictLogResponse(page, len(records), offset)
+		w.WriteHeader(response.StatusCode)
+		w.Write(response.Body)
+	}))
+}
+
+func TestListConflictLog(t *testing.T) {
+	defer conflict_log.RemoveRecentRecords(testDeadLettersReplicationId)
+	now := time.Now()
+	for _, i := range []int{4, 1} {
+		conflict_log.AddRecentRecord(&conflict_log.Record{ReplicationId: testDeadLettersReplicationId, Key: fmt.Sprintf("doc%v", i),
+			Time: now.Add(-time.Duration(i) * time.Second), SourceBody: []byte(`{}`)}, time.Hour)
+	}
+
+	peer1 := newTestConflictLogPeer(t, &conflict_log.Record{Key: "doc0", Time: now}, &conflict_log.Record{Key: "doc3", Time: now.Add(-3 * time.Second)})
+	defer peer1.Close()
+	peer2 := newTestConflictLogPeer(t, &conflict_log.Record{Key: "doc2", Time: now.Add(-2 * time.Second)})
+	defer peer2.Close()
+	peers := []string{strings.TrimPrefix(peer1.URL, "http://"), strings.TrimPrefix(peer2.URL, "http://")}
+
+	records, total, err := listConflictLog(testDeadLettersReplicationId, 0, 10, "node0", peers)
+	if err != nil || total != 5 || len(records) != 5 {
+		t.Fatalf("expected 5 records, got %v of total %v. err=%v", len(records), total, err)
+	}
+	for i, record := range records {
+		if record.Key != fmt.Sprintf("doc%v", i) {
+			t.Errorf("expected doc%v at %v, got %v", i, i, record.Key)
+		}
+	}
+	if records[1].Node != "node0" || records[0].Node != "127.0.0.1" {
+		t.Errorf("expected records to have their nodes, got %v and %v", records[1].Node, records[0].Node)
+	}
+	if records[1].SourceBody != nil {
+		t.Errorf("expected source bodies not to be kept in memory")
+	}
+
+	records, total, err = listConflictLog(testDeadLettersReplicationId, 1, 2, "node0", peers)
+	if err != nil || total != 5 || len(records) != 2 || records[0].Key != "doc1" || records[1].Key != "doc2" {
+		t.Errorf("unexpected page %v of total %v. err=%v", records, total, err)
+	}
+	if records, total, _ = listConflictLog(testDeadLettersReplicationId, 5, 3, "node0", peers); total != 5 || len(records) != 0 {
+		t.Errorf("expected no records beyond total, got %v", records)
+	}
+
+	peer2.Close()
+	if _, _, err = listConflictLog(testDeadLettersReplicationId, 0, 10, "node0", peers); err == nil {
+		t.Errorf("expected listing to fail when a node is not reachable")
+	}
+}
@@ -86,7 +86,7 @@ func (service *AuditSvc) write_internal(client *mcc.Client, eventId uint32, even
 	service.logger.Debugf("audit request=%v\n", req)
 
 	conn := client.Hijack()
-	conn.(*net.TCPConn).SetWriteDeadline(time.Now().Add(WriteTimeout))
+	conn.(net.Conn).SetWriteDeadline(time.Now().Add(WriteTimeout))
 
 	if err := client.Transmit(req); err != nil {
 		return err
@@ -94,7 +94,7 @@ func (service *AuditSvc) write_internal(client *mcc.Client, eventId uint32, even
 
 	service.logger.Debugf("audit request transmitted\n")
 
-	conn.(*net.TCPConn).SetReadDeadline(time.Now().Add(ReadTimeout))
+	conn.(net.Conn).SetReadDeadline(time.Now().Add(ReadTimeout))
 	res, err := client.Receive()
 	service.logger.Debugf("audit response=%v, opcode=%v, opaque=%v, status=%v, err=%v\n", res, res.Opcode, res.Opaque, res.Status, err)
 
@@ -41,6 +41,12 @@ type ThroughSeqnoTrackerSvc struct {
 	vb_filtered_seqno_list_map map[uint16]*SortedSeqnoListWithLock
 	// stores for each vb a sorted list of seqnos that have failed conflict resolution on source
 	vb_failed_cr_seqno_list_map map[uint16]*SortedSeqnoListWithLock
+	// stores for each vb a list of seqnos that have been deduped by outnozzles, i.e., superseded by later mutations
+	// of the same documents. the list may not be sorted when documents of a vb are sent by multiple outnozzles
+	vb_deduped_seqno_list_map map[uint16]*SortedSeqnoListWithLock
+	// stores for each vb a list of seqnos of the docs that have been permanently rejected by target
+	// and put into dead-letter store. the list may not be sorted when dead-lettered docs are retried
+	vb_dead_lettered_seqno_list_map map[uint16]*SortedSeqnoListWithLock
 
 	// gap_seqno_list_1[i] stores the start seqno of the ith gap range
 	// gap_seqno_list_2[i] stores the end seqno of  the ith gap range
@@ -69,8 +75,9 @@ func newSortedSeqnoListWithLock() *SortedSeqnoListWithLock {
 }
 
 // when needToSort is true, sort the internal seqno_list before returning it
-// sorting is needed only when seqno_list is not already sorted, which is the case only for sent_seqno_list
-// in other words, needToSort should be set to true only when operating on sent_seqno_list
+// sorting is needed only when seqno_list is not already sorted, which is the case only for sent_seqno_list,
+// deduped_seqno_list and dead_lettered_seqno_list
+// in other words, needToSort should be set to true only when operating on these lists
 func (list_obj *SortedSeqnoListWithLock) getSortedSeqnoList(needToSort bool) []uint64 {
 	if needToSort {
 		list_obj.lock.Lock()
@@ -161,14 +168,16 @@ func truncateGapSeqnoList(through_seqno uint64, seqno_list []uint64) []uint64 {
 func NewThroughSeqnoTrackerSvc(logger_ctx *log.LoggerContext) *ThroughSeqnoTrackerSvc {
 	logger := log.NewLogger("ThroughSeqnoTrackerSvc", logger_ctx)
 	tsTracker := &ThroughSeqnoTrackerSvc{
-		logger:                      logger,
-		vb_map:                      make(map[uint16]bool),
-		through_seqno_map:           make(map[uint16]*base.SeqnoWithLock),
-		vb_last_seen_seqno_map:      make(map[uint16]*base.SeqnoWithLock),
-		vb_sent_seqno_list_map:      make(map[uint16]*SortedSeqnoListWithLock),
-		vb_filtered_seqno_list_map:  make(map[uint16]*SortedSeqnoListWithLock),
-		vb_failed_cr_seqno_list_map: make(map[uint16]*SortedSeqnoListWithLock),
-		vb_gap_seqno_list_map:       make(map[uint16]*DualSortedSeqnoListWithLock),
+		logger:                          logger,
+		vb_map:                          make(map[uint16]bool),
+		through_seqno_map:               make(map[uint16]*base.SeqnoWithLock),
+		vb_last_seen_seqno_map:          make(map[uint16]*base.SeqnoWithLock),
+		vb_sent_seqno_list_map:          make(map[uint16]*SortedSeqnoListWithLock),
+		vb_filtered_seqno_list_map:      make(map[uint16]*SortedSeqnoListWithLock),
+		vb_failed_cr_seqno_list_map:     make(map[uint16]*SortedSeqnoListWithLock),
+		vb_deduped_seqno_list_map:       make(map[uint16]*SortedSeqnoListWithLock),
+		vb_dead_lettered_seqno_list_map: make(map[uint16]*SortedSeqnoListWithLock),
+		vb_gap_seqno_list_map:           make(map[uint16]*DualSortedSeqnoListWithLock),
 	}
 	return tsTracker
 }
@@ -185,6 +194,8 @@ func (tsTracker *ThroughSeqnoTrackerSvc) initialize(pipeline common.Pipeline) {
 		tsTracker.vb_sent_seqno_list_map[vbno] = newSortedSeqnoListWithLock()
 		tsTracker.vb_filtered_seqno_list_map[vbno] = newSortedSeqnoListWithLock()
 		tsTracker.vb_failed_cr_seqno_list_map[vbno] = newSortedSeqnoListWithLock()
+		tsTracker.vb_deduped_seqno_list_map[vbno] = newSortedSeqnoListWithLock()
+		tsTracker.vb_dead_lettered_seqno_list_map[vbno] = newSortedSeqnoListWithLock()
 		tsTracker.vb_gap_seqno_list_map[vbno] = newDualSortedSeqnoListWithLock()
 	}
 }
@@ -200,6 +211,8 @@ func (tsTracker *ThroughSeqnoTrackerSvc) Attach(pipeline common.Pipeline) error
 	pipeline_utils.RegisterAsyncComponentEventHandler(asyncListenerMap, base.DataFailedCREventListener, tsTracker)
 	pipeline_utils.RegisterAsyncComponentEventHandler(asyncListenerMap, base.DataFilteredEventListener, tsTracker)
 	pipeline_utils.RegisterAsyncComponentEventHandler(asyncListenerMap, base.DataReceivedEventListener, tsTracker)
+	pipeline_utils.RegisterAsyncComponentEventHandler(asyncListenerMap, base.DataDedupedEventListener, tsTracker)
+	pipeline_utils.RegisterAsyncComponentEventHandler(asyncListenerMap, base.DataDeadLetteredEventListener, tsTracker)
 	return nil
 }
 
@@ -221,6 +234,14 @@ func (tsTracker *ThroughSeqnoTrackerSvc) ProcessEvent(event *common.Event) error
 		seqno := event.OtherInfos.(parts.DataFailedCRSourceEventAdditional).Seqno
 		vbno := event.OtherInfos.(parts.DataFailedCRSourceEventAdditional).VBucket
 		tsTracker.addFailedCRSeqno(vbno, seqno)
+	} else if event.EventType == common.DataDeduped {
+		seqno := event.OtherInfos.(parts.DataDedupedEventAdditional).Seqno
+		vbno := event.OtherInfos.(parts.DataDedupedEventAdditional).VBucket
+		tsTracker.addDedupedSeqno(vbno, seqno)
+	} else if event.EventType == common.DataDeadLettered {
+		seqno := event.OtherInfos.(parts.DataDeadLetteredEventAdditional).Seqno
+		vbno := event.OtherInfos.(parts.DataDeadLetteredEventAdditional).VBucket
+		tsTracker.addDeadLetteredSeqno(vbno, seqno)
 	} else if event.EventType == common.DataReceived {
 		upr_event := event.Data.(*mcc.UprEvent)
 		seqno := upr_event.Seqno
@@ -253,6 +274,20 @@ func (tsTracker *ThroughSeqnoTrackerSvc) addFailedCRSeqno(vbno uint16, failed_cr
 	tsTracker.vb_failed_cr_seqno_list_map[vbno].appendSeqno(failed_cr_seqno, tsTracker.logger)
 }
 
+func (tsTracker *ThroughSeqnoTrackerSvc) addDedupedSeqno(vbno uint16, deduped_seqno uint64) {
+	tsTracker.validateVbno(vbno, "addDedupedSeqno")
+
+	tsTracker.logger.Tracef("%v adding deduped seqno %v for vb %v.", tsTracker.id, deduped_seqno, vbno)
+	tsTracker.vb_deduped_seqno_list_map[vbno].appendSeqno(deduped_seqno, tsTracker.logger)
+}
+
+func (tsTracker *ThroughSeqnoTrackerSvc) addDeadLetteredSeqno(vbno uint16, dead_lettered_seqno uint64) {
+	tsTracker.validateVbno(vbno, "addDeadLetteredSeqno")
+
+	tsTracker.logger.Tracef("%v adding dead-lettered seqno %v for vb %v.", tsTracker.id, dead_lettered_seqno, vbno)
+	tsTracker.vb_dead_lettered_seqno_list_map[vbno].appendSeqno(dead_lettered_seqno, tsTracker.logger)
+}
+
 func (tsTracker *ThroughSeqnoTrackerSvc) processGapSeqnos(vbno uint16, current_seqno uint64) {
 	tsTracker.validateVbno(vbno, "processGapSeqnos")
 
@@ -278,6 +313,8 @@ func (tsTracker *ThroughSeqnoTrackerSvc) truncateSeqnoLists(vbno uint16, through
 	tsTracker.vb_sent_seqno_list_map[vbno].truncateSeqnos(through_seqno)
 	tsTracker.vb_filtered_seqno_list_map[vbno].truncateSeqnos(through_seqno)
 	tsTracker.vb_failed_cr_seqno_list_map[vbno].truncateSeqnos(through_seqno)
+	tsTracker.vb_deduped_seqno_list_map[vbno].truncateSeqnos(through_seqno)
+	tsTracker.vb_dead_lettered_seqno_list_map[vbno].truncateSeqnos(through_seqno)
 	tsTracker.vb_gap_seqno_list_map[vbno].truncateSeqnos(through_seqno)
 }
 
@@ -298,18 +335,23 @@ func (tsTracker *ThroughSeqnoTrackerSvc) GetThroughSeqno(vbno uint16) uint64 {
 	max_filtered_seqno := maxSeqno(filtered_seqno_list)
 	failed_cr_seqno_list := tsTracker.vb_failed_cr_seqno_list_map[vbno].getSortedSeqnoList(false)
 	max_failed_cr_seqno := maxSeqno(failed_cr_seqno_list)
+	deduped_seqno_list := tsTracker.vb_deduped_seqno_list_map[vbno].getSortedSeqnoList(true)
+	max_deduped_seqno := maxSeqno(deduped_seqno_list)
+	dead_lettered_seqno_list := tsTracker.vb_dead_lettered_seqno_list_map[vbno].getSortedSeqnoList(true)
+	max_dead_lettered_seqno := maxSeqno(dead_lettered_seqno_list)
 	gap_seqno_list_1, gap_seqno_list_2 := tsTracker.vb_gap_seqno_list_map[vbno].getSortedSeqnoLists()
 	max_end_gap_seqno := maxSeqno(gap_seqno_list_2)
 
-	tsTracker.logger.Tracef("%v, vbno=%v, last_through_seqno=%v len(sent_seqno_list)=%v len(filtered_seqno_list)=%v len(failed_cr_seqno_list)=%v len(gap_seqno_list_1)=%v len(gap_seqno_list_2)=%v\n", tsTracker.id, vbno, last_through_seqno, len(sent_seqno_list), len(filtered_seqno_list), len(failed_cr_seqno_list), len(gap_seqno_list_1), len(gap_seqno_list_2))
-	tsTracker.logger.Tracef("%v, vbno=%v, last_through_seqno=%v\n sent_seqno_list=%v\n filtered_seqno_list=%v\n failed_cr_seqno_list=%v\n gap_seqno_list_1=%v\n gap_seqno_list_2=%v\n", tsTracker.id, vbno, last_through_seqno, sent_seqno_list, filtered_seqno_list, failed_cr_seqno_list, gap_seqno_list_1, gap_seqno_list_2)
+	tsTracker.logger.Tracef("%v, vbno=%v, last_through_seqno=%v len(sent_seqno_list)=%v len(filtered_seqno_list)=%v len(failed_cr_seqno_list)=%v len(deduped_seqno_list)=%v len(dead_lettered_seqno_list)=%v len(gap_seqno_list_1)=%v len(gap_seqno_list_2)=%v\n", tsTracker.id, vbno, last_through_seqno, len(sent_seqno_list), len(filtered_seqno_list), len(failed_cr_seqno_list), len(deduped_seqno_list), len(dead_lettered_seqno_list), len(gap_seqno_list_1), len(gap_seqno_list_2))
+	tsTracker.logger.Tracef("%v, vbno=%v, last_through_seqno=%v\n sent_seqno_list=%v\n filtered_seqno_list=%v\n failed_cr_seqno_list=%v\n deduped_seqno_list=%v\n dead_lettered_seqno_list=%v\n gap_seqno_list_1=%v\n gap_seqno_list_2=%v\n", tsTracker.id, vbno, last_through_seqno, sent_seqno_list, filtered_seqno_list, failed_cr_seqno_list, deduped_seqno_list, dead_lettered_seqno_list, gap_seqno_list_1, gap_seqno_list_2)
 
 	// Goal of algorithm:
 	// Find the right through_seqno for stats and checkpointing, with the constraint that through_seqno cannot be
 	// a gap seqno, since we do not want to use gap seqnos for checkpointing
 
 	// Starting from last_through_seqno, find the largest N such that last_through_seqno+1, last_through_seqno+2,
-	// .., last_through_seqno+N all exist in filtered_seqno_list, failed_cr_seqno_list, sent_seqno_list, or a gap range,
+	// .., last_through_seqno+N all exist in filtered_seqno_list, failed_cr_seqno_list, deduped_seqno_list,
+	// dead_lettered_seqno_list, sent_seqno_list, or a gap range,
 	// and that last_through_seqno+N itself is not in a gap range
 	// return last_through_seqno+N as the current through_seqno. Note that N could be 0.
 
@@ -319,12 +361,16 @@ func (tsTracker *ThroughSeqnoTrackerSvc) GetThroughSeqno(vbno uint16) uint64 {
 	var last_sent_index int = -1
 	var last_filtered_index int = -1
 	var last_failed_cr_index int = -1
+	var last_deduped_index int = -1
+	var last_dead_lettered_index int = -1
 	var found_seqno_type int = -1
 
 	const (
-		SeqnoTypeSent     int = 1
-		SeqnoTypeFiltered int = 2
-		SeqnoTypeFailedCR int = 3
+		SeqnoTypeSent         int = 1
+		SeqnoTypeFiltered     int = 2
+		SeqnoTypeFailedCR     int = 3
+		SeqnoTypeDeduped      int = 4
+		SeqnoTypeDeadLettered int = 5
 	)
 
 	for {
@@ -356,6 +402,24 @@ func (tsTracker *ThroughSeqnoTrackerSvc) GetThroughSeqno(vbno uint16) uint64 {
 			}
 		}
 
+		if iter_seqno <= max_deduped_seqno {
+			deduped_index, deduped_found := simple_utils.SearchUint64List(deduped_seqno_list, iter_seqno)
+			if deduped_found {
+				last_deduped_index = deduped_index
+				found_seqno_type = SeqnoTypeDeduped
+				continue
+			}
+		}
+
+		if iter_seqno <= max_dead_lettered_seqno {
+			dead_lettered_index, dead_lettered_found := simple_utils.SearchUint64List(dead_lettered_seqno_list, iter_seqno)
+			if dead_lettered_found {
+				last_dead_lettered_index = dead_lettered_index
+				found_seqno_type = SeqnoTypeDeadLettered
+				continue
+			}
+		}
+
 		if iter_seqno <= max_end_gap_seqno {
 			gap_found := isSeqnoGapSeqno(gap_seqno_list_1, gap_seqno_list_2, iter_seqno)
 			if gap_found {
@@ -367,13 +431,17 @@ func (tsTracker *ThroughSeqnoTrackerSvc) GetThroughSeqno(vbno uint16) uint64 {
 		break
 	}
 
-	if last_sent_index >= 0 || last_filtered_index >= 0 || last_failed_cr_index >= 0 {
+	if last_sent_index >= 0 || last_filtered_index >= 0 || last_failed_cr_index >= 0 || last_deduped_index >= 0 || last_dead_lettered_index >= 0 {
 		if found_seqno_type == SeqnoTypeSent {
 			through_seqno = sent_seqno_list[last_sent_index]
 		} else if found_seqno_type == SeqnoTypeFiltered {
 			through_seqno = filtered_seqno_list[last_filtered_index]
 		} else if found_seqno_type == SeqnoTypeFailedCR {
 			through_seqno = failed_cr_seqno_list[last_failed_cr_index]
+		} else if found_seqno_type == SeqnoTypeDeduped {
+			through_seqno = deduped_seqno_list[last_deduped_index]
+		} else if found_seqno_type == SeqnoTypeDeadLettered {
+			through_seqno = dead_lettered_seqno_list[last_dead_lettered_index]
 		} else {
 			panic(fmt.Sprintf("unexpected found_seqno_type, %v", found_seqno_type))
 		}
@@ -0,0 +1,92 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package service_impl
+
+import (
+	"github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/parts"
+	"testing"
+)
+
+type testSourceNozzle struct {
+	parts.SourceNozzle
+	vbs []uint16
+}
+
+func (nozzle *testSourceNozzle) GetVBList() []uint16 {
+	return nozzle.vbs
+}
+
+type testTrackerPipeline struct {
+	common.Pipeline
+	sources map[string]common.Nozzle
+}
+
+func (pipeline *testTrackerPipeline) Topic() string {
+	return "test"
+}
+
+func (pipeline *testTrackerPipeline) Sources() map[string]common.Nozzle {
+	return pipeline.sources
+}
+
+func newTestThroughSeqnoTracker(vbs ...uint16) *ThroughSeqnoTrackerSvc {
+	tsTracker := NewThroughSeqnoTrackerSvc(log.DefaultLoggerContext)
+	tsTracker.initialize(&testTrackerPipeline{sources: map[string]common.Nozzle{"dcp": &testSourceNozzle{vbs: vbs}}})
+	return tsTracker
+}
+
+func receiveTestSeqnos(tsTracker *ThroughSeqnoTrackerSvc, vbno uint16, seqnos ...uint64) {
+	for _, seqno := range seqnos {
+		tsTracker.processGapSeqnos(vbno, seqno)
+	}
+}
+
+func TestThroughSeqnoWithDedupedSeqnos(t *testing.T) {
+	tsTracker := newTestThroughSeqnoTracker(0)
+	// 3-4 and 7-8 are gaps
+	receiveTestSeqnos(tsTracker, 0, 1, 2, 5, 6, 9)
+
+	tsTracker.addSentSeqno(0, 9)
+	tsTracker.addSentSeqno(0, 2)
+	// deduped seqnos come from multiple outnozzles, and are not in order
+	tsTracker.addDedupedSeqno(0, 5)
+	tsTracker.addDedupedSeqno(0, 1)
+	if through_seqno := tsTracker.GetThroughSeqno(0); through_seqno != 5 {
+		t.Fatalf("expected through seqno 5, got %v", through_seqno)
+	}
+
+	tsTracker.addDedupedSeqno(0, 6)
+	if through_seqno := tsTracker.GetThroughSeqno(0); through_seqno != 9 {
+		t.Fatalf("expected through seqno 9, got %v", through_seqno)
+	}
+}
+
+func TestThroughSeqnoEndingWithDedupedSeqno(t *testing.T) {
+	tsTracker := newTestThroughSeqnoTracker(0, 1)
+	receiveTestSeqnos(tsTracker, 0, 4, 8)
+	receiveTestSeqnos(tsTracker, 1, 3)
+
+	// the last mutation before a gap was deduped
+	tsTracker.addDedupedSeqno(0, 4)
+	if through_seqno := tsTracker.GetThroughSeqno(0); through_seqno != 4 {
+		t.Fatalf("expected through seqno 4, got %v", through_seqno)
+	}
+	tsTracker.addDedupedSeqno(0, 8)
+	if through_seqno := tsTracker.GetThroughSeqno(0); through_seqno != 8 {
+		t.Fatalf("expected through seqno 8, got %v", through_seqno)
+	}
+
+	// deduped seqnos of one vb do not advance the through seqno of another
+	if through_seqno := tsTracker.GetThroughSeqno(1); through_seqno != 0 {
+		t.Errorf("expected through seqno 0 for vb 1, got %v", through_seqno)
+	}
+}
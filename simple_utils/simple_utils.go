@@ -20,8 +20,11 @@ import (
 	"github.com/couchbase/goxdcr/log"
 	"math"
 	mrand "math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -324,6 +327,67 @@ func GenerateRandomId(length, maxRetry int) (string, error) {
 
 }
 
+// checks that dir is an absolute path under root, which does not escape root through ".." elements
+// or symbolic links. dir does not need to exist. returns dir cleaned
+func PathUnderRoot(dir, root string) (string, error) {
+	if root == "" {
+		return "", errors.New("No directory has been configured for xdcr files on this node")
+	}
+	if !filepath.IsAbs(dir) {
+		return "", errors.New("The value must be an absolute path")
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(dir), "/") {
+		if elem == ".." {
+			return "", errors.New("The value cannot contain \"..\"")
+		}
+	}
+	dir = filepath.Clean(dir)
+	root = filepath.Clean(root)
+	if !isStrictlyUnder(dir, root) {
+		return "", fmt.Errorf("The value must be a directory under %v", root)
+	}
+
+	// symbolic links in either path are resolved before they are compared again
+	real_root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	real_dir, err := evalSymlinksOfExistingPath(dir)
+	if err != nil {
+		return "", err
+	}
+	if !isStrictlyUnder(real_dir, real_root) {
+		return "", fmt.Errorf("The value must be a directory under %v. It is resolved to %v through symbolic links", root, real_dir)
+	}
+	return dir, nil
+}
+
+func isStrictlyUnder(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolves the symbolic links in the longest part of path that exists
+func evalSymlinksOfExistingPath(path string) (string, error) {
+	missing := ""
+	for {
+		real_path, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(real_path, missing), nil
+		}
+		if _, lstat_err := os.Lstat(path); !os.IsNotExist(err) || lstat_err == nil {
+			// dangling symbolic links cannot be resolved
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		missing = filepath.Join(filepath.Base(path), missing)
+		path = parent
+	}
+}
+
 // translate time synchronization bucket metadata into base.ConflictResolutionMode
 func GetCRModeFromTimeSyncSetting(timeSynchronization string) base.ConflictResolutionMode {
 	if timeSynchronization != "" && timeSynchronization != base.TimeSynchronization_Disabled {
@@ -0,0 +1,72 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package simple_utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathUnderRoot(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "xdcr")
+	if err != nil {
+		t.Fatalf("failed to create temp dir. err=%v", err)
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "data")
+	outside := filepath.Join(tmp, "outside")
+	for _, dir := range []string{filepath.Join(root, "records"), outside} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("failed to create %v. err=%v", dir, err)
+		}
+	}
+	for name, target := range map[string]string{"escape": outside, "inside": filepath.Join(root, "records"), "dangling": filepath.Join(outside, "missing")} {
+		if err = os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatalf("failed to create symbolic link. err=%v", err)
+		}
+	}
+
+	for _, dir := range []string{
+		filepath.Join(root, "records"),
+		filepath.Join(root, "records") + "/",
+		filepath.Join(root, "new", "dir"),
+		filepath.Join(root, "inside", "new"),
+	} {
+		if _, err = PathUnderRoot(dir, root); err != nil {
+			t.Errorf("expected %v to be accepted, got %v", dir, err)
+		}
+	}
+
+	for _, dir := range []string{
+		"",
+		"records",
+		root,
+		tmp,
+		outside,
+		root + "2",
+		filepath.Join(root, "..", "outside"),
+		root + "/records/../../outside",
+		root + "/records/..",
+		filepath.Join(root, "escape"),
+		filepath.Join(root, "escape", "new"),
+		filepath.Join(root, "dangling"),
+		filepath.Join(root, "dangling", "new"),
+	} {
+		if _, err = PathUnderRoot(dir, root); err == nil {
+			t.Errorf("expected %v to be rejected", dir)
+		}
+	}
+
+	if _, err = PathUnderRoot(filepath.Join(root, "records"), ""); err == nil {
+		t.Errorf("expected paths to be rejected when root is not configured")
+	}
+}
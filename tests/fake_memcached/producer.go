@@ -0,0 +1,685 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package fake_memcached
+
+import (
+	"bufio"
+	"encoding/binary"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// flags of UPR_STREAMEND, i.e., the reasons that streams are ended by producer
+const (
+	StreamEndOK           uint32 = 0
+	StreamEndClosed       uint32 = 1
+	StreamEndStateChanged uint32 = 2
+	StreamEndDisconnected uint32 = 3
+	StreamEndTooSlow      uint32 = 4
+)
+
+// the vbuuid of the first failover log entry of vbuckets. later entries get consecutive vbuuids
+const firstVBUuid uint64 = 0x1000
+
+// size of the extras of dcp messages
+const (
+	streamReqExtrasLen = 48
+	snapshotExtrasLen  = 20
+	mutationExtrasLen  = 31
+	deletionExtrasLen  = 18
+)
+
+// flag of UPR_STREAMREQ that sets the end seqno of the stream to the current high seqno of the vbucket
+const StreamReqFlagLatest uint32 = 0x04
+
+// snapshot type in snapshot markers, i.e., memory snapshot
+const snapshotTypeMemory uint32 = 1
+
+// a mutation, deletion or expiration in a vbucket of the producer
+type Event struct {
+	// UPR_MUTATION, UPR_DELETION or UPR_EXPIRATION
+	Opcode mc.CommandCode
+	Key    []byte
+	// empty for deletions and expirations
+	Value []byte
+	// assigned by the producer when the event is added
+	Seqno    uint64
+	RevSeq   uint64
+	Cas      uint64
+	Flags    uint32
+	Expiry   uint32
+	DataType uint8
+	// sent only when it is not empty, as with enable_ext_metadata
+	ExtMeta []byte
+}
+
+type vbucket struct {
+	// newest entry first, as in UPR_FAILOVERLOG responses. each entry is a vbuuid and the seqno at which it took over
+	failover_log [][2]uint64
+	// in seqno order
+	events     []*Event
+	high_seqno uint64
+	stalled    bool
+	not_my_vb  bool
+}
+
+// returns the seqno to roll back to, and whether a stream that starts from start_seqno on the branch of vbuuid
+// needs to roll back. it needs to when the branch has diverged from the history of the vbucket before start_seqno
+func (vb *vbucket) rollbackSeqno(vbuuid, start_seqno uint64) (uint64, bool) {
+	if start_seqno == 0 {
+		return 0, false
+	}
+	for i, entry := range vb.failover_log {
+		if entry[0] != vbuuid {
+			continue
+		}
+		// the branch of vbuuid lasted until the next failover
+		upper := vb.high_seqno
+		if i > 0 {
+			upper = vb.failover_log[i-1][1]
+		}
+		if start_seqno > upper {
+			return upper, true
+		}
+		return 0, false
+	}
+	// unknown branch
+	return 0, true
+}
+
+// returns the index of the first event with seqno above the specified seqno
+func (vb *vbucket) eventIndexAfter(seqno uint64) int {
+	return sort.Search(len(vb.events), func(i int) bool { return vb.events[i].Seqno > seqno })
+}
+
+type dcpStream struct {
+	vbno   uint16
+	opaque uint32
+	// seqno of the last event sent
+	last_seqno uint64
+	end_seqno  uint64
+	// end of the snapshot last sent. a new snapshot marker is sent before events beyond it
+	snapshot_end uint64
+	// the stream is ended with the flags when it is set
+	end_flags *uint32
+}
+
+// a connection to the producer. everything is protected by the lock of the producer
+type producerConn struct {
+	conn  net.Conn
+	state connState
+	// whether UPR_OPEN has been received
+	open bool
+	// flow control buffer size. no flow control when 0
+	buffer_size int
+	// bytes sent and not yet acknowledged by consumer
+	unacked int
+	streams map[uint16]*dcpStream
+	// stream requests for stalled vbuckets, which are processed when the vbuckets are resumed
+	pending_reqs []*mc.MCRequest
+	// responses to be sent ahead of dcp messages
+	responses [][]byte
+	// wakes up the sender of the connection
+	wake_ch chan bool
+	fin_ch  chan bool
+}
+
+func (pc *producerConn) wake() {
+	select {
+	case pc.wake_ch <- true:
+	default:
+	}
+}
+
+// Producer is an in-process fake of the dcp producer of a source bucket, which serves the dcp connections of DcpNozzle
+// from a scripted in-memory dataset.
+//
+// it serves UPR_OPEN, UPR_CONTROL, UPR_FAILOVERLOG, UPR_STREAMREQ, UPR_CLOSESTREAM and UPR_BUFFERACK, and streams
+// snapshot markers, mutations, deletions, expirations and UPR_STREAMEND, subject to flow control. stream requests
+// are answered with ROLLBACK when they start beyond the branch of their vbuuid in the failover log.
+// NOT_MY_VBUCKET and stalled streams can be injected per vbucket
+type Producer struct {
+	bucketName string
+	password   string
+
+	listener net.Listener
+
+	vbuckets map[uint16]*vbucket
+	// vbuuid of the next failover log entry
+	next_vbuuid uint64
+	// the number of requests received, by opcode
+	request_counts map[mc.CommandCode]int
+	conns          map[*producerConn]bool
+	closed         bool
+	lock           sync.Mutex
+
+	waitGrp sync.WaitGroup
+}
+
+// starts a producer for the bucket with the specified name and password on a random local port
+func NewProducer(bucketName, password string) (*Producer, error) {
+	listener, err := net.Listen("tcp", base.LocalHostName+":0")
+	if err != nil {
+		return nil, err
+	}
+
+	producer := &Producer{
+		bucketName:     bucketName,
+		password:       password,
+		listener:       listener,
+		vbuckets:       make(map[uint16]*vbucket),
+		next_vbuuid:    firstVBUuid,
+		request_counts: make(map[mc.CommandCode]int),
+		conns:          make(map[*producerConn]bool),
+	}
+
+	producer.waitGrp.Add(1)
+	go producer.accept()
+	return producer, nil
+}
+
+// returns the address that the producer listens on, i.e., host:port
+func (producer *Producer) Addr() string {
+	return producer.listener.Addr().String()
+}
+
+// stops the producer and closes all connections
+func (producer *Producer) Close() {
+	producer.lock.Lock()
+	producer.closed = true
+	producer.listener.Close()
+	for pc := range producer.conns {
+		pc.conn.Close()
+	}
+	producer.lock.Unlock()
+	producer.waitGrp.Wait()
+}
+
+// closes all current connections
+func (producer *Producer) DropConnections() {
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+	for pc := range producer.conns {
+		pc.conn.Close()
+	}
+}
+
+// returns the vbucket, and creates it when it does not exist. caller needs to hold the lock
+func (producer *Producer) vbucket(vbno uint16) *vbucket {
+	vb, ok := producer.vbuckets[vbno]
+	if !ok {
+		vb = &vbucket{failover_log: [][2]uint64{{producer.next_vbuuid, 0}}}
+		producer.next_vbuuid++
+		producer.vbuckets[vbno] = vb
+	}
+	return vb
+}
+
+// appends the event to the vbucket, and returns the seqno assigned to it.
+// RevSeq and Cas default to 1 and the seqno respectively when they are not set
+func (producer *Producer) AddEvent(vbno uint16, event Event) uint64 {
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+
+	vb := producer.vbucket(vbno)
+	vb.high_seqno++
+	event.Seqno = vb.high_seqno
+	if event.RevSeq == 0 {
+		event.RevSeq = 1
+	}
+	if event.Cas == 0 {
+		event.Cas = event.Seqno
+	}
+	vb.events = append(vb.events, &event)
+	producer.wakeAll()
+	return event.Seqno
+}
+
+func (producer *Producer) AddMutation(vbno uint16, key string, value []byte) uint64 {
+	return producer.AddEvent(vbno, Event{Opcode: mc.UPR_MUTATION, Key: []byte(key), Value: value})
+}
+
+func (producer *Producer) AddDeletion(vbno uint16, key string) uint64 {
+	return producer.AddEvent(vbno, Event{Opcode: mc.UPR_DELETION, Key: []byte(key)})
+}
+
+// returns the seqno of the last event in the vbucket
+func (producer *Producer) HighSeqno(vbno uint16) uint64 {
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+	return producer.vbucket(vbno).high_seqno
+}
+
+// returns a copy of the failover log of the vbucket, newest entry first
+func (producer *Producer) FailoverLog(vbno uint16) [][2]uint64 {
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+	return append([][2]uint64(nil), producer.vbucket(vbno).failover_log...)
+}
+
+// simulates a failover to a replica that has the events of the vbucket up to seqno only. the events beyond seqno
+// are discarded, and a new entry is added to the failover log. streams of the vbucket are ended with
+// StreamEndStateChanged. returns the vbuuid of the new entry
+func (producer *Producer) Failover(vbno uint16, seqno uint64) uint64 {
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+
+	vb := producer.vbucket(vbno)
+	if seqno < vb.high_seqno {
+		vb.events = vb.events[:vb.eventIndexAfter(seqno)]
+		vb.high_seqno = seqno
+	}
+	vbuuid := producer.next_vbuuid
+	producer.next_vbuuid++
+	vb.failover_log = append([][2]uint64{{vbuuid, vb.high_seqno}}, vb.failover_log...)
+
+	producer.endStreams(vbno, StreamEndStateChanged)
+	return vbuuid
+}
+
+// when set, stream requests for the vbucket are answered with NOT_MY_VBUCKET, and its streams are ended
+// with StreamEndStateChanged, as when the vbucket has moved to another node
+func (producer *Producer) SetNotMyVBucket(vbno uint16, notMyVB bool) {
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+
+	producer.vbucket(vbno).not_my_vb = notMyVB
+	if notMyVB {
+		producer.endStreams(vbno, StreamEndStateChanged)
+	}
+}
+
+// when set, the streams of the vbucket stop sending, and stream requests for the vbucket are not answered.
+// they are answered and the streams resume when it is unset
+func (producer *Producer) SetStalled(vbno uint16, stalled bool) {
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+
+	producer.vbucket(vbno).stalled = stalled
+	producer.wakeAll()
+}
+
+// returns the number of requests with the specified opcode received so far
+func (producer *Producer) RequestCount(opcode mc.CommandCode) int {
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+	return producer.request_counts[opcode]
+}
+
+// returns the number of open streams for the vbucket over all connections
+func (producer *Producer) NumStreams(vbno uint16) int {
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+	count := 0
+	for pc := range producer.conns {
+		if _, ok := pc.streams[vbno]; ok {
+			count++
+		}
+	}
+	return count
+}
+
+// caller needs to hold the lock
+func (producer *Producer) endStreams(vbno uint16, flags uint32) {
+	for pc := range producer.conns {
+		if stream, ok := pc.streams[vbno]; ok {
+			stream.end_flags = &flags
+			pc.wake()
+		}
+	}
+}
+
+// caller needs to hold the lock
+func (producer *Producer) wakeAll() {
+	for pc := range producer.conns {
+		pc.wake()
+	}
+}
+
+func (producer *Producer) accept() {
+	defer producer.waitGrp.Done()
+	for {
+		conn, err := producer.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		pc := &producerConn{
+			conn:    conn,
+			streams: make(map[uint16]*dcpStream),
+			wake_ch: make(chan bool, 1),
+			fin_ch:  make(chan bool),
+		}
+
+		producer.lock.Lock()
+		if producer.closed {
+			producer.lock.Unlock()
+			conn.Close()
+			return
+		}
+		producer.conns[pc] = true
+		producer.waitGrp.Add(2)
+		producer.lock.Unlock()
+
+		go producer.serve(pc)
+		go producer.send(pc)
+	}
+}
+
+// reads and processes the requests on the connection
+func (producer *Producer) serve(pc *producerConn) {
+	defer producer.waitGrp.Done()
+	defer func() {
+		pc.conn.Close()
+		close(pc.fin_ch)
+		producer.lock.Lock()
+		delete(producer.conns, pc)
+		producer.lock.Unlock()
+	}()
+
+	reader := bufio.NewReader(pc.conn)
+	for {
+		req := &mc.MCRequest{}
+		if _, err := req.Receive(reader, nil); err != nil {
+			return
+		}
+
+		producer.lock.Lock()
+		producer.request_counts[req.Opcode]++
+		resp := producer.handle(pc, req)
+		if resp != nil {
+			pc.responses = append(pc.responses, resp.Bytes())
+		}
+		producer.lock.Unlock()
+		pc.wake()
+	}
+}
+
+// processes a request, and returns the response, if any. caller needs to hold the lock
+func (producer *Producer) handle(pc *producerConn, req *mc.MCRequest) *mc.MCResponse {
+	switch req.Opcode {
+	case mc.SASL_LIST_MECHS:
+		resp := newResponse(req, mc.SUCCESS)
+		resp.Body = []byte("PLAIN")
+		return resp
+	case mc.SASL_AUTH:
+		return authenticate(producer.bucketName, producer.password, &pc.state, req)
+	case mc.SELECT_BUCKET:
+		if !pc.state.authenticated {
+			return newResponse(req, mc.AUTH_ERROR)
+		}
+		if string(req.Key) != producer.bucketName {
+			return newResponse(req, mc.KEY_ENOENT)
+		}
+		pc.state.bucket = producer.bucketName
+		return newResponse(req, mc.SUCCESS)
+	case mc.NOOP:
+		return newResponse(req, mc.SUCCESS)
+	case mc.UPR_OPEN, mc.UPR_CONTROL, mc.UPR_FAILOVERLOG, mc.UPR_STREAMREQ, mc.UPR_CLOSESTREAM, mc.UPR_BUFFERACK:
+	default:
+		return newResponse(req, mc.UNKNOWN_COMMAND)
+	}
+
+	if pc.state.bucket == "" {
+		return newResponse(req, mc.NO_BUCKET)
+	}
+
+	switch req.Opcode {
+	case mc.UPR_OPEN:
+		pc.open = true
+		return newResponse(req, mc.SUCCESS)
+	case mc.UPR_CONTROL:
+		if string(req.Key) == "connection_buffer_size" {
+			size, err := strconv.Atoi(string(req.Body))
+			if err != nil {
+				return newResponse(req, mc.EINVAL)
+			}
+			pc.buffer_size = size
+		}
+		return newResponse(req, mc.SUCCESS)
+	case mc.UPR_FAILOVERLOG:
+		resp := newResponse(req, mc.SUCCESS)
+		resp.Body = encodeFailoverLog(producer.vbucket(req.VBucket).failover_log)
+		return resp
+	case mc.UPR_STREAMREQ:
+		return producer.streamRequest(pc, req)
+	case mc.UPR_CLOSESTREAM:
+		return producer.closeStream(pc, req)
+	default:
+		// UPR_BUFFERACK is not responded to
+		if len(req.Extras) >= 4 {
+			pc.unacked -= int(binary.BigEndian.Uint32(req.Extras[0:4]))
+			if pc.unacked < 0 {
+				pc.unacked = 0
+			}
+		}
+		return nil
+	}
+}
+
+// the extras of UPR_STREAMREQ are flags:uint32 reserved:uint32 start_seqno:uint64 end_seqno:uint64 vbuuid:uint64
+// snapshot_start:uint64 snapshot_end:uint64. returns nil when the vbucket is stalled, in which case the request
+// is answered after the vbucket is resumed
+func (producer *Producer) streamRequest(pc *producerConn, req *mc.MCRequest) *mc.MCResponse {
+	vb := producer.vbucket(req.VBucket)
+	if vb.not_my_vb {
+		return newResponse(req, mc.NOT_MY_VBUCKET)
+	}
+	if !pc.open || len(req.Extras) < streamReqExtrasLen {
+		return newResponse(req, mc.EINVAL)
+	}
+	if vb.stalled {
+		pc.pending_reqs = append(pc.pending_reqs, req)
+		return nil
+	}
+	if _, ok := pc.streams[req.VBucket]; ok {
+		return newResponse(req, mc.KEY_EEXISTS)
+	}
+
+	start_seqno := binary.BigEndian.Uint64(req.Extras[8:16])
+	end_seqno := binary.BigEndian.Uint64(req.Extras[16:24])
+	if binary.BigEndian.Uint32(req.Extras[0:4])&StreamReqFlagLatest != 0 {
+		end_seqno = vb.high_seqno
+	}
+	vbuuid := binary.BigEndian.Uint64(req.Extras[24:32])
+	if rollback_seqno, rollback := vb.rollbackSeqno(vbuuid, start_seqno); rollback {
+		resp := newResponse(req, mc.ROLLBACK)
+		resp.Body = make([]byte, 8)
+		binary.BigEndian.PutUint64(resp.Body, rollback_seqno)
+		return resp
+	}
+
+	pc.streams[req.VBucket] = &dcpStream{
+		vbno:         req.VBucket,
+		opaque:       req.Opaque,
+		last_seqno:   start_seqno,
+		end_seqno:    end_seqno,
+		snapshot_end: start_seqno,
+	}
+	resp := newResponse(req, mc.SUCCESS)
+	resp.Body = encodeFailoverLog(vb.failover_log)
+	return resp
+}
+
+func (producer *Producer) closeStream(pc *producerConn, req *mc.MCRequest) *mc.MCResponse {
+	if _, ok := pc.streams[req.VBucket]; ok {
+		delete(pc.streams, req.VBucket)
+		return newResponse(req, mc.SUCCESS)
+	}
+
+	// a stream request that has not been answered is cancelled
+	for i, pending_req := range pc.pending_reqs {
+		if pending_req.VBucket == req.VBucket {
+			pc.pending_reqs = append(pc.pending_reqs[:i], pc.pending_reqs[i+1:]...)
+			return newResponse(req, mc.SUCCESS)
+		}
+	}
+	return newResponse(req, mc.KEY_ENOENT)
+}
+
+func encodeFailoverLog(failover_log [][2]uint64) []byte {
+	body := make([]byte, 16*len(failover_log))
+	for i, entry := range failover_log {
+		binary.BigEndian.PutUint64(body[16*i:16*i+8], entry[0])
+		binary.BigEndian.PutUint64(body[16*i+8:16*i+16], entry[1])
+	}
+	return body
+}
+
+// writes responses and dcp messages to the connection. all writes go through it, so that the messages of
+// a stream never go ahead of the response to its stream request
+func (producer *Producer) send(pc *producerConn) {
+	defer producer.waitGrp.Done()
+	for {
+		select {
+		case <-pc.fin_ch:
+			return
+		case <-pc.wake_ch:
+		}
+
+		for {
+			data := producer.nextMessages(pc)
+			if len(data) == 0 {
+				break
+			}
+			if _, err := pc.conn.Write(data); err != nil {
+				pc.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// returns the messages that can be sent on the connection, i.e., the pending responses, followed by the messages of
+// the streams that are not stalled, as far as flow control permits
+func (producer *Producer) nextMessages(pc *producerConn) []byte {
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+
+	// answer the stream requests of vbuckets that have been resumed
+	pending_reqs := pc.pending_reqs
+	pc.pending_reqs = nil
+	for _, req := range pending_reqs {
+		if resp := producer.streamRequest(pc, req); resp != nil {
+			pc.responses = append(pc.responses, resp.Bytes())
+		}
+	}
+
+	data := []byte{}
+	for _, resp := range pc.responses {
+		data = append(data, resp...)
+	}
+	pc.responses = nil
+
+	vbnos := make([]int, 0, len(pc.streams))
+	for vbno := range pc.streams {
+		vbnos = append(vbnos, int(vbno))
+	}
+	sort.Ints(vbnos)
+
+	for _, vbno := range vbnos {
+		stream := pc.streams[uint16(vbno)]
+		vb := producer.vbucket(stream.vbno)
+		if vb.stalled {
+			continue
+		}
+
+		if stream.end_flags != nil {
+			data = append(data, producer.streamEnd(pc, stream, *stream.end_flags)...)
+			continue
+		}
+
+		for _, event := range vb.events[vb.eventIndexAfter(stream.last_seqno):] {
+			if event.Seqno > stream.end_seqno || producer.flowControlled(pc) {
+				break
+			}
+			if event.Seqno > stream.snapshot_end {
+				// the snapshot covers the events available now
+				stream.snapshot_end = vb.high_seqno
+				if stream.snapshot_end > stream.end_seqno {
+					stream.snapshot_end = stream.end_seqno
+				}
+				data = append(data, producer.bufferedMessage(pc, snapshotMarker(stream, event.Seqno))...)
+			}
+			data = append(data, producer.bufferedMessage(pc, eventMessage(stream, event))...)
+			stream.last_seqno = event.Seqno
+		}
+
+		if stream.last_seqno >= stream.end_seqno && !producer.flowControlled(pc) {
+			data = append(data, producer.streamEnd(pc, stream, StreamEndOK)...)
+		}
+	}
+	return data
+}
+
+// whether the flow control buffer of the connection is full
+func (producer *Producer) flowControlled(pc *producerConn) bool {
+	return pc.buffer_size > 0 && pc.unacked >= pc.buffer_size
+}
+
+// returns the bytes of a message that counts against the flow control buffer
+func (producer *Producer) bufferedMessage(pc *producerConn, req *mc.MCRequest) []byte {
+	data := req.Bytes()
+	pc.unacked += len(data)
+	return data
+}
+
+func (producer *Producer) streamEnd(pc *producerConn, stream *dcpStream, flags uint32) []byte {
+	delete(pc.streams, stream.vbno)
+	req := &mc.MCRequest{Opcode: mc.UPR_STREAMEND,
+		VBucket: stream.vbno,
+		Opaque:  stream.opaque,
+		Extras:  make([]byte, 4)}
+	binary.BigEndian.PutUint32(req.Extras, flags)
+	return producer.bufferedMessage(pc, req)
+}
+
+// the extras of UPR_SNAPSHOT are start_seqno:uint64 end_seqno:uint64 type:uint32
+func snapshotMarker(stream *dcpStream, start_seqno uint64) *mc.MCRequest {
+	req := &mc.MCRequest{Opcode: mc.UPR_SNAPSHOT,
+		VBucket: stream.vbno,
+		Opaque:  stream.opaque,
+		Extras:  make([]byte, snapshotExtrasLen)}
+	binary.BigEndian.PutUint64(req.Extras[0:8], start_seqno)
+	binary.BigEndian.PutUint64(req.Extras[8:16], stream.snapshot_end)
+	binary.BigEndian.PutUint32(req.Extras[16:20], snapshotTypeMemory)
+	return req
+}
+
+// the extras of UPR_MUTATION are seqno:uint64 revSeq:uint64 flags:uint32 expiry:uint32 lock_time:uint32
+// ext_meta_len:uint16 nru:uint8. those of UPR_DELETION and UPR_EXPIRATION are seqno:uint64 revSeq:uint64
+// ext_meta_len:uint16. extended metadata is at the end of body
+func eventMessage(stream *dcpStream, event *Event) *mc.MCRequest {
+	req := &mc.MCRequest{Opcode: event.Opcode,
+		VBucket:  stream.vbno,
+		Opaque:   stream.opaque,
+		Cas:      event.Cas,
+		DataType: event.DataType,
+		Key:      event.Key}
+
+	if event.Opcode == mc.UPR_MUTATION {
+		req.Extras = make([]byte, mutationExtrasLen)
+		binary.BigEndian.PutUint32(req.Extras[16:20], event.Flags)
+		binary.BigEndian.PutUint32(req.Extras[20:24], event.Expiry)
+		binary.BigEndian.PutUint16(req.Extras[28:30], uint16(len(event.ExtMeta)))
+		req.Body = append(append([]byte(nil), event.Value...), event.ExtMeta...)
+	} else {
+		req.Extras = make([]byte, deletionExtrasLen)
+		binary.BigEndian.PutUint16(req.Extras[16:18], uint16(len(event.ExtMeta)))
+		req.Body = append([]byte(nil), event.ExtMeta...)
+	}
+	binary.BigEndian.PutUint64(req.Extras[0:8], event.Seqno)
+	binary.BigEndian.PutUint64(req.Extras[8:16], event.RevSeq)
+	return req
+}
@@ -0,0 +1,650 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// fake_memcached is an in-process fake of the memcached service of a bucket, so that nozzles can be exercised
+// in go test without a live cluster.
+//
+// Server plays the memcached of a target bucket for outgoing nozzles, XmemNozzle in particular.
+// it speaks the subset of the memcached binary protocol that xdcr uses, i.e., SASL_LIST_MECHS, SASL_AUTH (PLAIN),
+// HELO, SELECT_BUCKET, SET_WITH_META, DEL_WITH_META, GET_META, GET and NOOP, over plain tcp, over tls as with
+// ssl over memcached, or after the handshake of ns_ssl_proxy as with ssl over proxy.
+// documents are kept in memory, and SET_WITH_META and DEL_WITH_META are subject to revision based conflict resolution,
+// and to the cas in the request header when it is not 0.
+// latency, error responses and connection drops can be injected through faults.
+//
+// Producer plays the dcp producer of a source bucket for DcpNozzle
+package fake_memcached
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// how connections to the server are secured
+type Security int
+
+const (
+	// plain tcp
+	SecurityNone Security = iota
+	// tls, as with ssl over memcached. the certificate of the server is returned by Certificate()
+	SecurityTLS
+	// the handshake of ns_ssl_proxy, after which requests come in frames, as with ssl over proxy.
+	// the server plays both the local and the remote proxy
+	SecurityProxy
+)
+
+// max size of the messages in the handshake of ns_ssl_proxy
+const maxHandshakeMsgSize = 1024 * 1024
+
+// a document, or the tombstone of a deleted document, in the fake bucket
+type Document struct {
+	Key      []byte
+	Value    []byte
+	Flags    uint32
+	Expiry   uint32
+	RevSeq   uint64
+	Cas      uint64
+	Deleted  bool
+	DataType uint8
+	ExtMeta  []byte
+}
+
+// a fault injected into the processing of the requests that it matches
+type Fault struct {
+	// opcodes of the requests that the fault applies to. when empty, the fault applies to
+	// SET_WITH_META, DEL_WITH_META, GET_META and GET requests
+	Opcodes []mc.CommandCode
+	// key of the requests that the fault applies to. any key when empty
+	Key string
+	// the number of requests that the fault applies to, after which it is removed. unlimited when 0
+	Count int
+	// delay before the request is processed
+	Latency time.Duration
+	// status of the response, which is returned without processing the request. the request is processed when it is SUCCESS
+	Status mc.Status
+	// whether the connection is closed instead of responding to the request
+	Drop bool
+}
+
+func (fault *Fault) matches(req *mc.MCRequest) bool {
+	if fault.Key != "" && fault.Key != string(req.Key) {
+		return false
+	}
+	if len(fault.Opcodes) == 0 {
+		return isDataOpcode(req.Opcode)
+	}
+	for _, opcode := range fault.Opcodes {
+		if opcode == req.Opcode {
+			return true
+		}
+	}
+	return false
+}
+
+func isDataOpcode(opcode mc.CommandCode) bool {
+	switch opcode {
+	case base.SET_WITH_META, base.DELETE_WITH_META, base.GET_WITH_META, mc.GET:
+		return true
+	}
+	return false
+}
+
+type docId struct {
+	vbno uint16
+	key  string
+}
+
+// state of a connection
+type connState struct {
+	authenticated bool
+	// the bucket selected on the connection. data requests are rejected with NO_BUCKET when it is empty
+	bucket string
+	// whether snappy has been negotiated through HELO on the connection. documents with snappy datatype
+	// are rejected with EINVAL otherwise, as memcached does
+	snappy bool
+}
+
+type Server struct {
+	bucketName string
+	password   string
+	security   Security
+
+	listener    net.Listener
+	certificate []byte
+
+	docs     map[docId]*Document
+	faults   []*Fault
+	features []uint16
+	// the number of requests received, by opcode
+	request_counts map[mc.CommandCode]int
+	conns          map[net.Conn]bool
+	total_conns    int
+	closed         bool
+	lock           sync.Mutex
+
+	waitGrp sync.WaitGroup
+}
+
+// starts a server for the bucket with the specified name and password on a random local port.
+// clients authenticate with the bucket name as user name, as xdcr does
+func NewServer(bucketName, password string, security Security) (*Server, error) {
+	listener, err := net.Listen("tcp", base.LocalHostName+":0")
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		bucketName:     bucketName,
+		password:       password,
+		security:       security,
+		docs:           make(map[docId]*Document),
+		features:       []uint16{base.HELOFeatureDatatype, base.HELOFeatureSnappy},
+		request_counts: make(map[mc.CommandCode]int),
+		conns:          make(map[net.Conn]bool),
+	}
+
+	if security == SecurityTLS {
+		certificate, tlsCert, err := newCertificate()
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		server.certificate = certificate
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{tlsCert}})
+	}
+	server.listener = listener
+
+	server.waitGrp.Add(1)
+	go server.accept()
+	return server, nil
+}
+
+// returns the address that the server listens on, i.e., host:port
+func (server *Server) Addr() string {
+	return server.listener.Addr().String()
+}
+
+func (server *Server) Port() uint16 {
+	return uint16(server.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// returns the certificate, in PEM format, that the server presents in SecurityTLS mode
+func (server *Server) Certificate() []byte {
+	return server.certificate
+}
+
+// stops the server and closes all connections
+func (server *Server) Close() {
+	server.lock.Lock()
+	server.closed = true
+	server.listener.Close()
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.lock.Unlock()
+	server.waitGrp.Wait()
+}
+
+// sets the HELO features that the server supports. datatype and snappy are supported by default
+func (server *Server) SetHELOFeatures(features ...uint16) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.features = features
+}
+
+// adds a fault. faults are matched in the order they are added, and at most one fault applies to a request
+func (server *Server) AddFault(fault Fault) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.faults = append(server.faults, &fault)
+}
+
+func (server *Server) ClearFaults() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.faults = nil
+}
+
+// closes all current connections
+func (server *Server) DropConnections() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for conn := range server.conns {
+		conn.Close()
+	}
+}
+
+// returns a copy of the document, or tombstone, with the specified key in the specified vbucket
+func (server *Server) Document(vbno uint16, key string) (Document, bool) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	doc, ok := server.docs[docId{vbno, key}]
+	if !ok {
+		return Document{}, false
+	}
+	return *doc, true
+}
+
+// adds or replaces the document, or tombstone, with the specified key in the specified vbucket
+func (server *Server) SetDocument(vbno uint16, doc Document) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.docs[docId{vbno, string(doc.Key)}] = &doc
+}
+
+// returns the number of documents, including tombstones
+func (server *Server) NumDocuments() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return len(server.docs)
+}
+
+// returns the number of requests with the specified opcode received so far, including the ones that faults applied to
+func (server *Server) RequestCount(opcode mc.CommandCode) int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.request_counts[opcode]
+}
+
+// returns the number of open connections
+func (server *Server) NumConnections() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return len(server.conns)
+}
+
+// returns the number of connections accepted so far
+func (server *Server) TotalConnections() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.total_conns
+}
+
+func (server *Server) accept() {
+	defer server.waitGrp.Done()
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		server.lock.Lock()
+		if server.closed {
+			server.lock.Unlock()
+			conn.Close()
+			return
+		}
+		server.conns[conn] = true
+		server.total_conns++
+		server.waitGrp.Add(1)
+		server.lock.Unlock()
+
+		go server.serve(conn)
+	}
+}
+
+func (server *Server) serve(conn net.Conn) {
+	defer server.waitGrp.Done()
+	defer func() {
+		conn.Close()
+		server.lock.Lock()
+		delete(server.conns, conn)
+		server.lock.Unlock()
+	}()
+
+	reader := bufio.NewReader(conn)
+	state := &connState{}
+	if server.security == SecurityProxy {
+		if err := server.proxyHandshake(reader, conn, state); err != nil {
+			return
+		}
+	}
+
+	for {
+		// with ssl over proxy, requests come in frames of the form len:uint32 count:uint32 requests
+		count := 1
+		if server.security == SecurityProxy {
+			frame_header := make([]byte, 8)
+			if _, err := io.ReadFull(reader, frame_header); err != nil {
+				return
+			}
+			count = int(binary.BigEndian.Uint32(frame_header[4:8]))
+		}
+
+		for i := 0; i < count; i++ {
+			req := &mc.MCRequest{}
+			if _, err := req.Receive(reader, nil); err != nil {
+				return
+			}
+
+			resp, drop := server.handle(state, req)
+			if drop {
+				return
+			}
+			if _, err := conn.Write(resp.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// processes a request, and returns the response, or true when the connection is to be dropped
+func (server *Server) handle(state *connState, req *mc.MCRequest) (*mc.MCResponse, bool) {
+	server.lock.Lock()
+	server.request_counts[req.Opcode]++
+	fault := server.matchFault(req)
+	server.lock.Unlock()
+
+	if fault != nil {
+		if fault.Latency > 0 {
+			time.Sleep(fault.Latency)
+		}
+		if fault.Drop {
+			return nil, true
+		}
+		if fault.Status != mc.SUCCESS {
+			return newResponse(req, fault.Status), false
+		}
+	}
+
+	switch req.Opcode {
+	case mc.SASL_LIST_MECHS:
+		resp := newResponse(req, mc.SUCCESS)
+		resp.Body = []byte("PLAIN")
+		return resp, false
+	case mc.SASL_AUTH:
+		return authenticate(server.bucketName, server.password, state, req), false
+	case mc.SELECT_BUCKET:
+		if !state.authenticated {
+			return newResponse(req, mc.AUTH_ERROR), false
+		}
+		if string(req.Key) != server.bucketName {
+			return newResponse(req, mc.KEY_ENOENT), false
+		}
+		state.bucket = server.bucketName
+		return newResponse(req, mc.SUCCESS), false
+	case mc.HELLO:
+		return server.hello(state, req), false
+	case mc.NOOP:
+		return newResponse(req, mc.SUCCESS), false
+	}
+
+	if !isDataOpcode(req.Opcode) {
+		return newResponse(req, mc.UNKNOWN_COMMAND), false
+	}
+	if state.bucket == "" {
+		return newResponse(req, mc.NO_BUCKET), false
+	}
+
+	switch req.Opcode {
+	case base.SET_WITH_META, base.DELETE_WITH_META:
+		if req.DataType&base.SnappyDataType != 0 && !state.snappy {
+			return newResponse(req, mc.EINVAL), false
+		}
+		return server.setWithMeta(req), false
+	case base.GET_WITH_META:
+		return server.getMeta(req), false
+	default:
+		return server.get(req), false
+	}
+}
+
+// returns the first fault that matches the request, and counts the request against the fault
+func (server *Server) matchFault(req *mc.MCRequest) *Fault {
+	for i, fault := range server.faults {
+		if !fault.matches(req) {
+			continue
+		}
+		if fault.Count > 0 {
+			fault.Count--
+			if fault.Count == 0 {
+				server.faults = append(server.faults[:i], server.faults[i+1:]...)
+			}
+		}
+		return fault
+	}
+	return nil
+}
+
+func newResponse(req *mc.MCRequest, status mc.Status) *mc.MCResponse {
+	return &mc.MCResponse{Opcode: req.Opcode,
+		Status: status,
+		Opaque: req.Opaque}
+}
+
+// the body of SASL_AUTH with PLAIN mechanism is authzid\0user\0password
+func authenticate(bucketName, password string, state *connState, req *mc.MCRequest) *mc.MCResponse {
+	if string(req.Key) != "PLAIN" {
+		return newResponse(req, mc.AUTH_ERROR)
+	}
+	fields := splitNull(req.Body)
+	if len(fields) != 3 || fields[1] != bucketName || fields[2] != password {
+		return newResponse(req, mc.AUTH_ERROR)
+	}
+
+	state.authenticated = true
+	// users named after buckets have the buckets selected upon authentication
+	state.bucket = bucketName
+	resp := newResponse(req, mc.SUCCESS)
+	resp.Body = []byte("Authenticated")
+	return resp
+}
+
+func splitNull(data []byte) []string {
+	fields := []string{}
+	start := 0
+	for i, b := range data {
+		if b == 0 {
+			fields = append(fields, string(data[start:i]))
+			start = i + 1
+		}
+	}
+	return append(fields, string(data[start:]))
+}
+
+// responds with the requested features that the server supports
+func (server *Server) hello(state *connState, req *mc.MCRequest) *mc.MCResponse {
+	server.lock.Lock()
+	supported := make(map[uint16]bool)
+	for _, feature := range server.features {
+		supported[feature] = true
+	}
+	server.lock.Unlock()
+
+	body := []byte{}
+	for i := 0; i+2 <= len(req.Body); i += 2 {
+		feature := binary.BigEndian.Uint16(req.Body[i : i+2])
+		if supported[feature] {
+			body = append(body, req.Body[i:i+2]...)
+			if feature == base.HELOFeatureSnappy {
+				state.snappy = true
+			}
+		}
+	}
+	resp := newResponse(req, mc.SUCCESS)
+	resp.Body = body
+	return resp
+}
+
+// the extras of SET_WITH_META and DEL_WITH_META are flags:uint32 expiry:uint32 revSeq:uint64 cas:uint64,
+// optionally followed by options:uint32, optionally followed by the length of extended metadata:uint16,
+// in which case extended metadata is at the end of body
+func (server *Server) setWithMeta(req *mc.MCRequest) *mc.MCResponse {
+	if len(req.Extras) < 24 {
+		return newResponse(req, mc.EINVAL)
+	}
+
+	value := req.Body
+	var extMeta []byte
+	if len(req.Extras) == 26 || len(req.Extras) == 30 {
+		meta_len := int(binary.BigEndian.Uint16(req.Extras[len(req.Extras)-2:]))
+		if meta_len > len(value) {
+			return newResponse(req, mc.EINVAL)
+		}
+		extMeta = value[len(value)-meta_len:]
+		value = value[:len(value)-meta_len]
+	}
+
+	doc := &Document{
+		Key:      append([]byte(nil), req.Key...),
+		Flags:    binary.BigEndian.Uint32(req.Extras[0:4]),
+		Expiry:   binary.BigEndian.Uint32(req.Extras[4:8]),
+		RevSeq:   binary.BigEndian.Uint64(req.Extras[8:16]),
+		Cas:      binary.BigEndian.Uint64(req.Extras[16:24]),
+		Deleted:  req.Opcode == base.DELETE_WITH_META,
+		DataType: req.DataType,
+		ExtMeta:  append([]byte(nil), extMeta...),
+	}
+	if !doc.Deleted {
+		doc.Value = append([]byte(nil), value...)
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	id := docId{req.VBucket, string(req.Key)}
+	var options uint32
+	if len(req.Extras) == 28 || len(req.Extras) == 30 {
+		options = binary.BigEndian.Uint32(req.Extras[24:28])
+	}
+	existing, ok := server.docs[id]
+	// as in memcached, a cas in the request header needs to match that of the existing document
+	if req.Cas != 0 {
+		if !ok || existing.Deleted {
+			return newResponse(req, mc.KEY_ENOENT)
+		} else if existing.Cas != req.Cas {
+			return newResponse(req, mc.KEY_EEXISTS)
+		}
+	}
+	if ok && options&base.SkipConflictResolutionFlag == 0 && !wins(doc, existing) {
+		return newResponse(req, mc.KEY_EEXISTS)
+	}
+	server.docs[id] = doc
+
+	resp := newResponse(req, mc.SUCCESS)
+	resp.Cas = doc.Cas
+	return resp
+}
+
+// revision based conflict resolution. the incoming document loses when its metadata is the same as that of the existing one
+func wins(doc, existing *Document) bool {
+	if doc.RevSeq != existing.RevSeq {
+		return doc.RevSeq > existing.RevSeq
+	}
+	if doc.Cas != existing.Cas {
+		return doc.Cas > existing.Cas
+	}
+	if doc.Expiry != existing.Expiry {
+		return doc.Expiry > existing.Expiry
+	}
+	return doc.Flags > existing.Flags
+}
+
+// the extras of GET_META responses are deleted:uint32 flags:uint32 expiry:uint32 revSeq:uint64, followed by
+// conflict resolution mode:uint8 when the request asks for extended metadata
+func (server *Server) getMeta(req *mc.MCRequest) *mc.MCResponse {
+	server.lock.Lock()
+	doc, ok := server.docs[docId{req.VBucket, string(req.Key)}]
+	server.lock.Unlock()
+	if !ok {
+		return newResponse(req, mc.KEY_ENOENT)
+	}
+
+	extras := make([]byte, 20)
+	if doc.Deleted {
+		binary.BigEndian.PutUint32(extras[0:4], 1)
+	}
+	binary.BigEndian.PutUint32(extras[4:8], doc.Flags)
+	binary.BigEndian.PutUint32(extras[8:12], doc.Expiry)
+	binary.BigEndian.PutUint64(extras[12:20], doc.RevSeq)
+	if len(req.Extras) == 1 && req.Extras[0] == 1 {
+		extras = append(extras, byte(base.CRMode_RevId))
+	}
+
+	resp := newResponse(req, mc.SUCCESS)
+	resp.Extras = extras
+	resp.Cas = doc.Cas
+	return resp
+}
+
+func (server *Server) get(req *mc.MCRequest) *mc.MCResponse {
+	server.lock.Lock()
+	doc, ok := server.docs[docId{req.VBucket, string(req.Key)}]
+	server.lock.Unlock()
+	if !ok || doc.Deleted {
+		return newResponse(req, mc.KEY_ENOENT)
+	}
+
+	resp := newResponse(req, mc.SUCCESS)
+	resp.Extras = make([]byte, 4)
+	binary.BigEndian.PutUint32(resp.Extras, doc.Flags)
+	resp.Body = doc.Value
+	resp.Cas = doc.Cas
+	resp.DataType = doc.DataType
+	return resp
+}
+
+// the handshake of ns_ssl_proxy consists of a json message with the target bucket and its password, and the
+// certificate of target, each prefixed by its length:uint32. it is acknowledged with {"type":"ok"} prefixed by its length
+func (server *Server) proxyHandshake(reader io.Reader, conn net.Conn, state *connState) error {
+	msg, err := readHandshakeMsg(reader)
+	if err != nil {
+		return err
+	}
+	if _, err = readHandshakeMsg(reader); err != nil {
+		return err
+	}
+
+	handshake := make(map[string]interface{})
+	ack := map[string]interface{}{"type": "ok"}
+	if err = json.Unmarshal(msg, &handshake); err != nil {
+		ack = map[string]interface{}{"type": "error", "message": err.Error()}
+	} else if handshake["bucket"] != server.bucketName || handshake["password"] != server.password {
+		err = errors.New("authentication failed")
+		ack = map[string]interface{}{"type": "error", "message": err.Error()}
+	}
+
+	ack_bytes, _ := json.Marshal(ack)
+	data := make([]byte, 4+len(ack_bytes))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(ack_bytes)))
+	copy(data[4:], ack_bytes)
+	if _, write_err := conn.Write(data); write_err != nil {
+		return write_err
+	}
+	if err != nil {
+		return err
+	}
+
+	state.authenticated = true
+	state.bucket = server.bucketName
+	return nil
+}
+
+func readHandshakeMsg(reader io.Reader) ([]byte, error) {
+	size_bytes := make([]byte, 4)
+	if _, err := io.ReadFull(reader, size_bytes); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(size_bytes)
+	if size > maxHandshakeMsgSize {
+		return nil, fmt.Errorf("handshake message of size %v is too big", size)
+	}
+	msg := make([]byte, size)
+	_, err := io.ReadFull(reader, msg)
+	return msg, err
+}
@@ -236,13 +236,13 @@ func test() {
 		fail(fmt.Sprintf("No checkpointing happended as it is supposed to"))
 	}
 	settings[metadata.Active] = false
-	replication_manager.UpdateReplicationSettings(topic, settings, &base.RealUserId{})
+	replication_manager.UpdateReplicationSettings(topic, settings, false, &base.RealUserId{})
 
 	logger.Infof("Replication %s is paused\n", topic)
 	time.Sleep(100 * time.Millisecond)
 
 	settings[metadata.Active] = true
-	errMap, err := replication_manager.UpdateReplicationSettings(topic, settings, &base.RealUserId{})
+	errMap, err := replication_manager.UpdateReplicationSettings(topic, settings, false, &base.RealUserId{})
 	if err != nil || len(errMap) > 0 {
 		fail(fmt.Sprintf("err= %v, errMap=%v", err, errMap))
 	}
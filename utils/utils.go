@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"github.com/couchbase/cbauth"
 	"github.com/couchbase/go-couchbase"
+	mc "github.com/couchbase/gomemcached"
 	mcc "github.com/couchbase/gomemcached/client"
 	base "github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/filter"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/simple_utils"
 	"net/url"
@@ -15,6 +17,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -265,6 +268,26 @@ func ParseHighSeqnoStat(vbnos []uint16, stats_map map[string]string, highseqno_m
 	return nil
 }
 
+//convert the format returned by go-memcached StatMap - map[string]string to map[uint16]uint64 of vb uuids
+func ParseVBUuidStat(vbnos []uint16, stats_map map[string]string, vbuuid_map map[uint16]uint64) error {
+
+	for _, vbno := range vbnos {
+		stats_key := fmt.Sprintf(base.VBUCKET_UUID_STAT_KEY_FORMAT, vbno)
+		vbuuidstr, ok := stats_map[stats_key]
+		if !ok {
+			logger_utils.Infof("Can't find vb uuid for vbno=%v in stats map. Source topology may have changed.\n", vbno)
+			continue
+		}
+		vbuuid, err := strconv.ParseUint(vbuuidstr, 10, 64)
+		if err != nil {
+			return err
+		}
+		vbuuid_map[vbno] = vbuuid
+	}
+
+	return nil
+}
+
 // encode data in a map into a byte array, which can then be used as
 // the body part of a http request
 // so far only five types are supported: string, int, bool, LogLevel, []byte
@@ -346,6 +369,205 @@ func GetMatchedKeys(expression string, keys []string) (map[string][][]int, error
 	return matchesMap, nil
 }
 
+// returns, for each doc in docs, whether it matches the body filter expression
+// docs is a map of doc key -> doc body, where doc body has already been unmarshalled from json
+func GetMatchedDocs(bodyExpression string, docs map[string]interface{}) (map[string]bool, error) {
+	logger_utils.Infof("GetMatchedDocs bodyExpression=%v\n", bodyExpression)
+
+	expr, err := filter.Parse(bodyExpression)
+	if err != nil {
+		return nil, err
+	}
+
+	matchedDocs := make(map[string]bool)
+	for key, doc := range docs {
+		matchedDocs[key] = expr.MatchDocument(doc)
+	}
+
+	return matchedDocs, nil
+}
+
+// name prefix of the short-lived dcp connections opened by SampleDocsFromDcp
+var DcpSamplerConnectionPrefix = "xdcr_sampler:"
+
+// opens a short-lived dcp stream on the specified vbuckets of bucketName at serverAddr and collects
+// the keys and bodies of the first maxDocs mutations received, up to the high seqnos of the vbuckets when the streams
+// are opened. deletions and expirations are skipped. it returns what has been collected so far when timeout expires
+// before maxDocs mutations are received
+func SampleDocsFromDcp(serverAddr, bucketName string, vbnos []uint16, maxDocs int, timeout time.Duration, logger *log.CommonLogger) (keys []string, bodies map[string][]byte, err error) {
+	conn, err := GetMemcachedConnection(serverAddr, bucketName, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	uprFeed, err := conn.NewUprFeed()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer uprFeed.Close()
+
+	randName, err := simple_utils.GenerateRandomId(16, 5)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = uprFeed.UprOpen(DcpSamplerConnectionPrefix+bucketName+":"+randName, uint32(0), 1024*1024)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = uprFeed.StartFeedWithConfig(base.UprFeedDataChanLength)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// streams end at the current high seqnos of vbuckets, so that vbuckets with fewer mutations than wanted
+	// are done as soon as they have been read, rather than waiting out the timeout for mutations that may never come
+	stats_map, err := conn.StatsMap(base.VBUCKET_SEQNO_STAT_NAME)
+	if err != nil {
+		return nil, nil, err
+	}
+	highseqno_map := make(map[uint16]uint64)
+	err = ParseHighSeqnoStat(vbnos, stats_map, highseqno_map)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// vbno -> high seqno, for streams that have not ended yet
+	openStreams := make(map[uint16]uint64)
+	for _, vbno := range vbnos {
+		highseqno := highseqno_map[vbno]
+		if highseqno == 0 {
+			// there is nothing in the vbucket, or the vbucket is no longer on the node
+			continue
+		}
+		err = uprFeed.UprRequestStream(vbno, vbno, 0, 0, 0, highseqno, 0, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		openStreams[vbno] = highseqno
+	}
+
+	keys = make([]string, 0, maxDocs)
+	bodies = make(map[string][]byte)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for len(keys) < maxDocs && len(openStreams) > 0 {
+		select {
+		case <-timer.C:
+			logger.Infof("Timed out sampling docs from bucket %v after %v. %v docs have been sampled\n", bucketName, timeout, len(keys))
+			return keys, bodies, nil
+		case event, ok := <-uprFeed.C:
+			if !ok {
+				return keys, bodies, errors.New("dcp feed has been closed")
+			}
+			switch event.Opcode {
+			case mc.UPR_STREAMREQ:
+				if event.Status != mc.SUCCESS {
+					logger.Infof("Failed to open dcp stream for vb=%v of bucket %v. status=%v\n", event.VBucket, bucketName, event.Status)
+					delete(openStreams, event.VBucket)
+				}
+			case mc.UPR_STREAMEND:
+				delete(openStreams, event.VBucket)
+			case mc.UPR_MUTATION, mc.UPR_DELETION, mc.UPR_EXPIRATION:
+				if event.Opcode == mc.UPR_MUTATION {
+					key := string(event.Key)
+					if _, ok := bodies[key]; !ok {
+						keys = append(keys, key)
+					}
+					bodies[key] = event.Value
+				}
+				// the vbucket is done once its high seqno is reached, whether or not stream end follows
+				if highseqno, ok := openStreams[event.VBucket]; ok && event.Seqno >= highseqno {
+					delete(openStreams, event.VBucket)
+				}
+			}
+		}
+	}
+	return keys, bodies, nil
+}
+
+// finds, for each of the specified vbuckets of bucketName at serverAddr, the seqno right before the first mutation,
+// deletion or expiration with cas at or after startCas, by streaming the vbucket up to its high seqno in highseqno_map.
+// vbuckets with no such mutation get their high seqnos. it is an error when the scan does not finish before timeout
+func FindStartSeqnosForCas(serverAddr, bucketName string, vbnos []uint16, highseqno_map map[uint16]uint64, startCas uint64,
+	timeout time.Duration, logger *log.CommonLogger) (map[uint16]uint64, error) {
+	conn, err := GetMemcachedConnection(serverAddr, bucketName, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	uprFeed, err := conn.NewUprFeed()
+	if err != nil {
+		return nil, err
+	}
+	defer uprFeed.Close()
+
+	randName, err := simple_utils.GenerateRandomId(16, 5)
+	if err != nil {
+		return nil, err
+	}
+	err = uprFeed.UprOpen(DcpSamplerConnectionPrefix+bucketName+":"+randName, uint32(0), 1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	err = uprFeed.StartFeedWithConfig(base.UprFeedDataChanLength)
+	if err != nil {
+		return nil, err
+	}
+
+	start_seqnos := make(map[uint16]uint64)
+	// vbno -> high seqno, for vbuckets whose start seqnos have not been found yet
+	openStreams := make(map[uint16]uint64)
+	for _, vbno := range vbnos {
+		highseqno := highseqno_map[vbno]
+		start_seqnos[vbno] = highseqno
+		if highseqno == 0 {
+			continue
+		}
+		err = uprFeed.UprRequestStream(vbno, vbno, 0, 0, 0, highseqno, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		openStreams[vbno] = highseqno
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for len(openStreams) > 0 {
+		select {
+		case <-timer.C:
+			return nil, fmt.Errorf("Timed out finding start seqnos in bucket %v on %v after %v. %v vbuckets have not been scanned", bucketName, serverAddr, timeout, len(openStreams))
+		case event, ok := <-uprFeed.C:
+			if !ok {
+				return nil, errors.New("dcp feed has been closed")
+			}
+			if _, ok := openStreams[event.VBucket]; !ok {
+				continue
+			}
+			switch event.Opcode {
+			case mc.UPR_STREAMREQ:
+				if event.Status != mc.SUCCESS {
+					return nil, fmt.Errorf("Failed to open dcp stream for vb=%v of bucket %v on %v. status=%v", event.VBucket, bucketName, serverAddr, event.Status)
+				}
+			case mc.UPR_STREAMEND:
+				delete(openStreams, event.VBucket)
+			case mc.UPR_MUTATION, mc.UPR_DELETION, mc.UPR_EXPIRATION:
+				if event.Cas >= startCas {
+					start_seqnos[event.VBucket] = event.Seqno - 1
+					delete(openStreams, event.VBucket)
+					uprFeed.CloseStream(event.VBucket, event.VBucket)
+				} else if event.Seqno >= openStreams[event.VBucket] {
+					delete(openStreams, event.VBucket)
+				}
+			}
+		}
+	}
+	return start_seqnos, nil
+}
+
 func RegexpMatch(regExp *regexp.Regexp, key []byte) bool {
 	return regExp.Match(key)
 }
@@ -0,0 +1,705 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// verify checks whether the target bucket of a replication is consistent with the source bucket.
+// a verification job streams the keys and metadata of the documents in the source vbuckets over dcp, up to
+// the seqnos that the vbuckets are at when their streams start, looks the keys up on target with GET_META,
+// and records the keys that are missing, stale or ahead on target. keys that are filtered out by the
+// replication are excluded. jobs are kept in memory, one per replication, and are discarded when the
+// replication is deleted
+package verify
+
+import (
+	"errors"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/key_rewrite"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"github.com/couchbase/goxdcr/parts"
+	"github.com/couchbase/goxdcr/simple_utils"
+	"math"
+	"sync"
+	"time"
+)
+
+// kinds of the differences between source and target
+const (
+	// the document exists on source and not on target
+	DiffMissing = "missing"
+	// the document on target is older than the one on source
+	DiffStale = "stale"
+	// the document on target is newer than the one on source
+	DiffAhead = "ahead"
+	// the document could not be looked up on target
+	DiffError = "error"
+)
+
+// states of verification jobs and of the vbuckets in them
+const (
+	StatePending   = "pending"
+	StateRunning   = "running"
+	StateCompleted = "completed"
+	StateCancelled = "cancelled"
+	StateFailed    = "failed"
+)
+
+// flag of UPR_STREAMREQ that ends the stream at the high seqno of the vbucket when the stream starts
+const dcpStreamReqFlagLatest uint32 = 0x04
+
+// max number of differences kept by a job. further differences are counted only
+var MaxDiffEntries = 10000
+
+// max number of keys looked up on target in one batch of GET_META requests
+var GetMetaBatchSize = 100
+
+// max time to wait for a dcp message, or for the responses to a batch of GET_META requests
+var Timeout = 2 * time.Minute
+
+// name prefix of the dcp connections opened by verification jobs
+var DcpConnectionPrefix = "xdcr_verify:"
+
+var ErrorAlreadyRunning = errors.New("Verification is already running for the replication")
+var ErrorNotFound = errors.New("No verification has been run for the replication")
+var errorCancelled = errors.New("verification has been cancelled")
+
+type Config struct {
+	ReplicationId    string
+	SourceBucketName string
+	// source vbuckets to verify
+	VBuckets []uint16
+	// number of vbuckets in source bucket
+	NumSourceVBs int
+	// opens a connection to the source kv node that owns the vbuckets, with the source bucket selected
+	NewSourceConn func() (*mcc.Client, error)
+	// target kv node -> target vbuckets that it owns
+	TargetServerVBMap map[string][]uint16
+	// opens a connection to a target kv node, with the target bucket selected
+	NewTargetConn func(serverAddr string) (*mcc.Client, error)
+	// settings of the replication, which give its filters and key rewrite rules
+	Settings *metadata.ReplicationSettings
+	// conflict resolution mode of the replication, which decides whether a document on target is stale or ahead
+	CRMode base.ConflictResolutionMode
+	// max number of keys checked per second. 0 means no limit
+	RateLimit int
+	// vbno -> seqno that the replication starts from in the source vbucket. mutations at or before it are not
+	// replicated, and are counted as filtered
+	StartSeqnos map[uint16]uint64
+}
+
+// metadata of a document on source or target
+type Metadata struct {
+	RevSeq  uint64 `json:"revSeq"`
+	Cas     uint64 `json:"cas"`
+	Flags   uint32 `json:"flags"`
+	Expiry  uint32 `json:"expiry"`
+	Deleted bool   `json:"deleted"`
+}
+
+func newMetadata(doc_meta base.DocumentMetadata) *Metadata {
+	return &Metadata{
+		RevSeq:  doc_meta.RevSeq,
+		Cas:     doc_meta.Cas,
+		Flags:   doc_meta.Flags,
+		Expiry:  doc_meta.Expiry,
+		Deleted: doc_meta.Deletion,
+	}
+}
+
+// a key whose document differs between source and target
+type DiffEntry struct {
+	// key on source
+	Key string `json:"key"`
+	// vbucket and seqno of the document on source
+	VBucket uint16    `json:"vb"`
+	Seqno   uint64    `json:"seqno"`
+	Kind    string    `json:"kind"`
+	Source  *Metadata `json:"source"`
+	// nil when the document is missing on target or cannot be looked up
+	Target *Metadata `json:"target,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+type VBProgress struct {
+	VBucket uint16 `json:"vb"`
+	State   string `json:"state"`
+	// seqno of the last document streamed from the vbucket
+	Seqno   uint64 `json:"seqno"`
+	Checked int64  `json:"checked"`
+	Error   string `json:"error,omitempty"`
+}
+
+type Progress struct {
+	ReplicationId string    `json:"replicationId"`
+	State         string    `json:"state"`
+	Error         string    `json:"error,omitempty"`
+	StartTime     time.Time `json:"startTime"`
+	// nil while the job is running
+	EndTime   *time.Time `json:"endTime,omitempty"`
+	RateLimit int        `json:"rateLimit"`
+	// number of keys looked up on target, and their results
+	Checked    int64 `json:"checked"`
+	Consistent int64 `json:"consistent"`
+	Missing    int64 `json:"missing"`
+	Stale      int64 `json:"stale"`
+	Ahead      int64 `json:"ahead"`
+	Errors     int64 `json:"errors"`
+	// number of keys excluded by the filters of the replication
+	Filtered int64 `json:"filtered"`
+	// number of differences that are not kept since there are more than MaxDiffEntries of them
+	DroppedDiffs int64        `json:"droppedDiffs"`
+	VBucketsDone int          `json:"vbucketsDone"`
+	VBuckets     []VBProgress `json:"vbuckets"`
+}
+
+// a document streamed from source
+type item struct {
+	key        string
+	seqno      uint64
+	meta       base.DocumentMetadata
+	target_key []byte
+	target_vb  uint16
+}
+
+type Job struct {
+	config       Config
+	data_filter  *parts.DataFilter
+	key_rewriter *key_rewrite.Rewriter
+	resolver     base.ConflictResolver
+	// target kv node that owns each target vbucket
+	target_servers map[uint16]string
+	num_target_vbs int
+	// whether docs are in the vbuckets that their keys belong to on target, rather than in the same vbuckets as on source
+	vbs_remapped bool
+	target_conns map[string]*mcc.Client
+	batch_size   int
+	// time before which further keys cannot be checked without exceeding rate limit
+	next_check_time time.Time
+
+	progress Progress
+	// index of each vbucket in progress.VBuckets
+	vb_index map[uint16]int
+	diffs    []*DiffEntry
+	lock     sync.RWMutex
+
+	fin_ch      chan bool
+	done_ch     chan bool
+	cancel_once sync.Once
+}
+
+var logger_verify *log.CommonLogger = log.NewLogger("Verify", log.DefaultLoggerContext)
+
+var job_map = make(map[string]*Job)
+var job_map_lock sync.Mutex
+
+func newJob(config Config) (*Job, error) {
+	settings := config.Settings
+	data_filter, err := parts.NewDataFilter(settings.FilterExpression, settings.FilterBodyExpression, settings.FilterDeletions, settings.FilterExpirations)
+	if err != nil {
+		return nil, err
+	}
+	var key_rewriter *key_rewrite.Rewriter
+	if len(settings.KeyRewriteRules) > 0 {
+		key_rewriter, err = key_rewrite.Parse(settings.KeyRewriteRules)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resolver, _, err := base.NewConflictResolver(base.ConflictResolverDefault)
+	if err != nil {
+		return nil, err
+	}
+
+	target_servers := make(map[uint16]string)
+	for server, vbnos := range config.TargetServerVBMap {
+		for _, vbno := range vbnos {
+			target_servers[vbno] = server
+		}
+	}
+
+	batch_size := GetMetaBatchSize
+	if config.RateLimit > 0 && config.RateLimit < batch_size {
+		// smaller batches keep the rate even
+		batch_size = config.RateLimit
+	}
+
+	job := &Job{
+		config:         config,
+		data_filter:    data_filter,
+		key_rewriter:   key_rewriter,
+		resolver:       resolver,
+		target_servers: target_servers,
+		num_target_vbs: len(target_servers),
+		vbs_remapped:   key_rewrite.VBsRemapped(settings.KeyRewriteRules, config.NumSourceVBs, len(target_servers)),
+		target_conns:   make(map[string]*mcc.Client),
+		batch_size:     batch_size,
+		vb_index:       make(map[uint16]int),
+		diffs:          make([]*DiffEntry, 0),
+		fin_ch:         make(chan bool),
+		done_ch:        make(chan bool),
+		progress: Progress{
+			ReplicationId: config.ReplicationId,
+			State:         StateRunning,
+			StartTime:     time.Now(),
+			RateLimit:     config.RateLimit,
+			VBuckets:      make([]VBProgress, len(config.VBuckets)),
+		},
+	}
+	for i, vbno := range config.VBuckets {
+		job.progress.VBuckets[i] = VBProgress{VBucket: vbno, State: StatePending}
+		job.vb_index[vbno] = i
+	}
+	return job, nil
+}
+
+// starts a verification job for the replication, which replaces the finished job of the replication, if any.
+// returns ErrorAlreadyRunning when a job is running for the replication
+func Start(config Config) (*Job, error) {
+	job, err := newJob(config)
+	if err != nil {
+		return nil, err
+	}
+
+	job_map_lock.Lock()
+	defer job_map_lock.Unlock()
+	if old_job, ok := job_map[config.ReplicationId]; ok && old_job.Progress().State == StateRunning {
+		return nil, ErrorAlreadyRunning
+	}
+	job_map[config.ReplicationId] = job
+
+	logger_verify.Infof("Started verification of replication %v on vbuckets %v with rate limit %v\n", config.ReplicationId, config.VBuckets, config.RateLimit)
+	go job.run()
+	return job, nil
+}
+
+// returns the latest verification job of the replication, or nil if there is none
+func Get(replicationId string) *Job {
+	job_map_lock.Lock()
+	defer job_map_lock.Unlock()
+	return job_map[replicationId]
+}
+
+// cancels the verification job of the replication. the progress and diff found so far are kept
+func Cancel(replicationId string) error {
+	job := Get(replicationId)
+	if job == nil {
+		return ErrorNotFound
+	}
+	job.cancel()
+	return nil
+}
+
+// cancels and discards the verification job of the replication
+func Remove(replicationId string) {
+	job_map_lock.Lock()
+	job, ok := job_map[replicationId]
+	delete(job_map, replicationId)
+	job_map_lock.Unlock()
+	if ok {
+		job.cancel()
+	}
+}
+
+func (job *Job) cancel() {
+	job.cancel_once.Do(func() {
+		close(job.fin_ch)
+	})
+}
+
+// returns a channel that is closed when the job finishes
+func (job *Job) Done() <-chan bool {
+	return job.done_ch
+}
+
+func (job *Job) Progress() *Progress {
+	job.lock.RLock()
+	defer job.lock.RUnlock()
+	progress := job.progress
+	progress.VBuckets = append([]VBProgress(nil), job.progress.VBuckets...)
+	return &progress
+}
+
+// returns the differences found so far, in the order they were found
+func (job *Job) Diffs() []*DiffEntry {
+	job.lock.RLock()
+	defer job.lock.RUnlock()
+	return append([]*DiffEntry(nil), job.diffs...)
+}
+
+func (job *Job) run() {
+	defer close(job.done_ch)
+	defer job.closeTargetConns()
+
+	err := job.verify()
+
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	end_time := time.Now()
+	job.progress.EndTime = &end_time
+	if err == errorCancelled {
+		job.progress.State = StateCancelled
+	} else if err != nil {
+		job.progress.State = StateFailed
+		job.progress.Error = err.Error()
+	} else {
+		job.progress.State = StateCompleted
+	}
+	logger_verify.Infof("Verification of replication %v finished. state=%v, checked=%v, missing=%v, stale=%v, ahead=%v, errors=%v, err=%v\n",
+		job.config.ReplicationId, job.progress.State, job.progress.Checked, job.progress.Missing, job.progress.Stale, job.progress.Ahead, job.progress.Errors, err)
+}
+
+func (job *Job) verify() error {
+	client, err := job.config.NewSourceConn()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	uprFeed, err := client.NewUprFeed()
+	if err != nil {
+		return err
+	}
+	defer uprFeed.Close()
+
+	randName, err := simple_utils.GenerateRandomId(16, 5)
+	if err != nil {
+		return err
+	}
+	err = uprFeed.UprOpen(DcpConnectionPrefix+job.config.SourceBucketName+":"+randName, uint32(0), 1024*1024)
+	if err != nil {
+		return err
+	}
+	err = uprFeed.StartFeedWithConfig(base.UprFeedDataChanLength)
+	if err != nil {
+		return err
+	}
+
+	// vbuckets are verified one at a time, which keeps the load on source and target low
+	for _, vbno := range job.config.VBuckets {
+		err = job.verifyVBucket(uprFeed, vbno)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streams the vbucket and checks its documents on target. a failure of the stream fails the vbucket only.
+// returns an error when the job cannot go on
+func (job *Job) verifyVBucket(uprFeed *mcc.UprFeed, vbno uint16) error {
+	job.setVBState(vbno, StateRunning, nil)
+	err := uprFeed.UprRequestStream(vbno, vbno, dcpStreamReqFlagLatest, 0, 0, math.MaxUint64, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	batch := make([]*item, 0, job.batch_size)
+	// index of each key in batch. a key that is streamed again replaces the older version in batch
+	batch_index := make(map[string]int)
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-job.fin_ch:
+			return errorCancelled
+		case <-timer.C:
+			return fmt.Errorf("Timed out waiting for dcp messages for vb=%v", vbno)
+		case event, ok := <-uprFeed.C:
+			if !ok {
+				return errors.New("dcp feed has been closed")
+			}
+			timer.Reset(Timeout)
+			if event.VBucket != vbno {
+				continue
+			}
+
+			switch event.Opcode {
+			case mc.UPR_STREAMREQ:
+				if event.Status != mc.SUCCESS {
+					job.setVBState(vbno, StateFailed, fmt.Errorf("Failed to open dcp stream. status=%v", event.Status))
+					return nil
+				}
+			case mc.UPR_MUTATION, mc.UPR_DELETION, mc.UPR_EXPIRATION:
+				job.setVBSeqno(vbno, event.Seqno)
+				if event.Seqno <= job.config.StartSeqnos[vbno] || job.data_filter.Filter(event.Opcode, event.Key, event.Value) != parts.NotFiltered {
+					job.addFiltered()
+					continue
+				}
+
+				it := job.newItem(event)
+				if index, ok := batch_index[it.key]; ok {
+					batch[index] = it
+					continue
+				}
+				batch_index[it.key] = len(batch)
+				batch = append(batch, it)
+				if len(batch) >= job.batch_size {
+					if err = job.checkBatch(vbno, batch); err != nil {
+						return err
+					}
+					batch = batch[:0]
+					batch_index = make(map[string]int)
+					timer.Reset(Timeout)
+				}
+			case mc.UPR_STREAMEND:
+				if err = job.checkBatch(vbno, batch); err != nil {
+					return err
+				}
+				job.setVBState(vbno, StateCompleted, nil)
+				return nil
+			}
+		}
+	}
+}
+
+func (job *Job) newItem(event *mcc.UprEvent) *item {
+	it := &item{
+		key:   string(event.Key),
+		seqno: event.Seqno,
+		meta: base.DocumentMetadata{
+			Key:      event.Key,
+			RevSeq:   event.RevSeqno,
+			Cas:      event.Cas,
+			Flags:    event.Flags,
+			Expiry:   event.Expiry,
+			Deletion: event.Opcode != mc.UPR_MUTATION,
+			CRMode:   job.config.CRMode,
+		},
+		target_key: event.Key,
+		target_vb:  event.VBucket,
+	}
+	return it
+}
+
+// looks up the documents in batch on target and records the results
+func (job *Job) checkBatch(vbno uint16, batch []*item) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	if !job.throttle(len(batch)) {
+		return errorCancelled
+	}
+
+	// keys to look up on each target kv node
+	server_items := make(map[string][]*item)
+	for _, it := range batch {
+		if job.key_rewriter != nil {
+			new_key, err := job.key_rewriter.Rewrite([]byte(it.key))
+			if err != nil {
+				job.addResult(vbno, it, nil, err)
+				continue
+			}
+			it.target_key = new_key
+		}
+		if job.vbs_remapped {
+			it.target_vb = key_rewrite.VBucketForKey(it.target_key, job.num_target_vbs)
+		}
+		server, ok := job.target_servers[it.target_vb]
+		if !ok {
+			job.addResult(vbno, it, nil, fmt.Errorf("No target node owns vb=%v", it.target_vb))
+			continue
+		}
+		server_items[server] = append(server_items[server], it)
+	}
+
+	for server, items := range server_items {
+		resps, err := job.getMetas(server, items)
+		for i, it := range items {
+			if err != nil {
+				job.addResult(vbno, it, nil, err)
+			} else {
+				job.addResult(vbno, it, resps[i], nil)
+			}
+		}
+	}
+	return nil
+}
+
+// sends GET_META requests for the items to the target kv node, and returns the responses in the order of the items
+func (job *Job) getMetas(server string, items []*item) ([]*mc.MCResponse, error) {
+	client, err := job.getTargetConn(server)
+	if err != nil {
+		return nil, err
+	}
+
+	resps, err := job.sendGetMetas(client, items)
+	if err != nil {
+		// the connection is re-established for the next batch
+		client.Close()
+		delete(job.target_conns, server)
+	}
+	return resps, err
+}
+
+func (job *Job) sendGetMetas(client *mcc.Client, items []*item) ([]*mc.MCResponse, error) {
+	client.SetDeadline(time.Now().Add(Timeout))
+	defer client.SetDeadline(time.Time{})
+
+	req_ext_meta := job.config.CRMode == base.CRMode_LWW
+	for i, it := range items {
+		req := parts.ComposeRequestForGetMeta(string(it.target_key), it.target_vb, uint32(i), req_ext_meta)
+		if err := client.Transmit(req); err != nil {
+			return nil, err
+		}
+	}
+
+	resps := make([]*mc.MCResponse, len(items))
+	for range items {
+		resp, err := client.Receive()
+		if err != nil && err != resp {
+			return nil, err
+		}
+		if int(resp.Opaque) >= len(resps) {
+			return nil, fmt.Errorf("Received response with unexpected opaque %v", resp.Opaque)
+		}
+		resps[resp.Opaque] = resp
+	}
+	return resps, nil
+}
+
+func (job *Job) getTargetConn(server string) (*mcc.Client, error) {
+	if client, ok := job.target_conns[server]; ok {
+		return client, nil
+	}
+	client, err := job.config.NewTargetConn(server)
+	if err != nil {
+		return nil, err
+	}
+	job.target_conns[server] = client
+	return client, nil
+}
+
+func (job *Job) closeTargetConns() {
+	for server, client := range job.target_conns {
+		client.Close()
+		delete(job.target_conns, server)
+	}
+}
+
+// waits until num_keys more keys can be checked without exceeding rate limit.
+// returns false if the job is cancelled while waiting
+func (job *Job) throttle(num_keys int) bool {
+	if job.config.RateLimit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if job.next_check_time.Before(now) {
+		job.next_check_time = now
+	}
+	wait_time := job.next_check_time.Sub(now)
+	job.next_check_time = job.next_check_time.Add(time.Duration(num_keys) * time.Second / time.Duration(job.config.RateLimit))
+	if wait_time <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait_time)
+	defer timer.Stop()
+	select {
+	case <-job.fin_ch:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// classifies the document by the GET_META response from target, or by the error when it could not be looked up
+func (job *Job) classify(it *item, resp *mc.MCResponse, err error) (string, *Metadata, error) {
+	if err != nil {
+		return DiffError, nil, err
+	}
+	switch resp.Status {
+	case mc.SUCCESS:
+	case mc.KEY_ENOENT:
+		if it.meta.Deletion {
+			// the deletion of a document that target never had, or whose tombstone has been purged
+			return "", nil, nil
+		}
+		return DiffMissing, nil, nil
+	default:
+		return DiffError, nil, fmt.Errorf("GET_META failed with status %v", resp.Status)
+	}
+
+	target_meta := parts.DecodeGetMetaResp(it.target_key, resp)
+	if target_meta.RevSeq == it.meta.RevSeq && target_meta.Cas == it.meta.Cas && target_meta.Deletion == it.meta.Deletion {
+		return "", nil, nil
+	}
+	if job.resolver(it.meta, target_meta, job.config.CRMode, logger_verify) {
+		return DiffStale, newMetadata(target_meta), nil
+	}
+	return DiffAhead, newMetadata(target_meta), nil
+}
+
+func (job *Job) addResult(vbno uint16, it *item, resp *mc.MCResponse, err error) {
+	kind, target_meta, err := job.classify(it, resp, err)
+
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.progress.Checked++
+	job.progress.VBuckets[job.vb_index[vbno]].Checked++
+	switch kind {
+	case "":
+		job.progress.Consistent++
+		return
+	case DiffMissing:
+		job.progress.Missing++
+	case DiffStale:
+		job.progress.Stale++
+	case DiffAhead:
+		job.progress.Ahead++
+	case DiffError:
+		job.progress.Errors++
+	}
+
+	if len(job.diffs) >= MaxDiffEntries {
+		job.progress.DroppedDiffs++
+		return
+	}
+	entry := &DiffEntry{
+		Key:     it.key,
+		VBucket: vbno,
+		Seqno:   it.seqno,
+		Kind:    kind,
+		Source:  newMetadata(it.meta),
+		Target:  target_meta,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	job.diffs = append(job.diffs, entry)
+}
+
+func (job *Job) addFiltered() {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.progress.Filtered++
+}
+
+func (job *Job) setVBSeqno(vbno uint16, seqno uint64) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.progress.VBuckets[job.vb_index[vbno]].Seqno = seqno
+}
+
+func (job *Job) setVBState(vbno uint16, state string, err error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	vb_progress := &job.progress.VBuckets[job.vb_index[vbno]]
+	vb_progress.State = state
+	if err != nil {
+		vb_progress.Error = err.Error()
+		logger_verify.Errorf("Verification of vb=%v of replication %v failed. err=%v\n", vbno, job.config.ReplicationId, err)
+	}
+	if state == StateCompleted || state == StateFailed {
+		job.progress.VBucketsDone++
+	}
+}
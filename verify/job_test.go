@@ -0,0 +1,252 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package verify
+
+import (
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/key_rewrite"
+	"github.com/couchbase/goxdcr/metadata"
+	"github.com/couchbase/goxdcr/tests/fake_memcached"
+	"testing"
+	"time"
+)
+
+const (
+	testSourceBucket = "source"
+	testTargetBucket = "target"
+	testPassword     = "s3cret"
+)
+
+// starts a fake producer as source and a fake memcached server as target, which owns vbuckets 0 and 1
+func startTestClusters(t *testing.T) (*fake_memcached.Producer, *fake_memcached.Server) {
+	producer, err := fake_memcached.NewProducer(testSourceBucket, testPassword)
+	if err != nil {
+		t.Fatalf("failed to start fake producer. err=%v", err)
+	}
+	server, err := fake_memcached.NewServer(testTargetBucket, testPassword, fake_memcached.SecurityNone)
+	if err != nil {
+		producer.Close()
+		t.Fatalf("failed to start fake server. err=%v", err)
+	}
+	return producer, server
+}
+
+func newTestConfig(replicationId string, producer *fake_memcached.Producer, server *fake_memcached.Server, settings *metadata.ReplicationSettings) Config {
+	return Config{
+		ReplicationId:    replicationId,
+		SourceBucketName: testSourceBucket,
+		VBuckets:         []uint16{0, 1},
+		NumSourceVBs:     2,
+		NewSourceConn: func() (*mcc.Client, error) {
+			return base.NewConn(producer.Addr(), testSourceBucket, testPassword)
+		},
+		TargetServerVBMap: map[string][]uint16{server.Addr(): []uint16{0, 1}},
+		NewTargetConn: func(serverAddr string) (*mcc.Client, error) {
+			return base.NewConn(serverAddr, testTargetBucket, testPassword)
+		},
+		Settings: settings,
+		CRMode:   base.CRMode_RevId,
+	}
+}
+
+// adds a mutation to source, and its replica, with the specified revSeq, to target
+func addTestDoc(producer *fake_memcached.Producer, server *fake_memcached.Server, vbno uint16, key string, targetRevSeq uint64) {
+	seqno := producer.AddEvent(vbno, fake_memcached.Event{Opcode: mc.UPR_MUTATION, Key: []byte(key), RevSeq: 5})
+	if targetRevSeq > 0 {
+		server.SetDocument(vbno, fake_memcached.Document{Key: []byte(key), RevSeq: targetRevSeq, Cas: seqno})
+	}
+}
+
+func waitForJob(t *testing.T, job *Job) *Progress {
+	select {
+	case <-job.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for verification to finish")
+	}
+	return job.Progress()
+}
+
+func TestVerify(t *testing.T) {
+	producer, server := startTestClusters(t)
+	defer producer.Close()
+	defer server.Close()
+
+	for i := 0; i < 20; i++ {
+		addTestDoc(producer, server, uint16(i%2), fmt.Sprintf("doc%v", i), 5)
+	}
+	addTestDoc(producer, server, 0, "missing", 0)
+	addTestDoc(producer, server, 1, "stale", 4)
+	addTestDoc(producer, server, 0, "ahead", 6)
+	// keys filtered out by replication are not checked
+	addTestDoc(producer, server, 1, "skipped", 0)
+	// a deletion that target never saw is consistent
+	producer.AddDeletion(1, "deleted")
+	// the latest version of a key is checked
+	producer.AddEvent(0, fake_memcached.Event{Opcode: mc.UPR_MUTATION, Key: []byte("doc0"), RevSeq: 6, Cas: 1000})
+	server.SetDocument(0, fake_memcached.Document{Key: []byte("doc0"), RevSeq: 6, Cas: 1000})
+
+	settings := metadata.DefaultSettings()
+	settings.FilterExpression = "^(doc|missing|stale|ahead|deleted)"
+	job, err := Start(newTestConfig(t.Name(), producer, server, settings))
+	if err != nil {
+		t.Fatalf("failed to start verification. err=%v", err)
+	}
+	defer Remove(t.Name())
+
+	progress := waitForJob(t, job)
+	if progress.State != StateCompleted || progress.VBucketsDone != 2 {
+		t.Fatalf("unexpected progress %+v", progress)
+	}
+	if progress.Checked != 24 || progress.Consistent != 21 || progress.Missing != 1 || progress.Stale != 1 ||
+		progress.Ahead != 1 || progress.Filtered != 1 || progress.Errors != 0 {
+		t.Errorf("unexpected counts %+v", progress)
+	}
+	if progress.VBuckets[0].Seqno != producer.HighSeqno(0) || progress.VBuckets[1].Seqno != producer.HighSeqno(1) {
+		t.Errorf("expected vbuckets to be streamed to their high seqnos, got %+v", progress.VBuckets)
+	}
+
+	kinds := make(map[string]string)
+	for _, diff := range job.Diffs() {
+		kinds[diff.Key] = diff.Kind
+	}
+	if len(kinds) != 3 || kinds["missing"] != DiffMissing || kinds["stale"] != DiffStale || kinds["ahead"] != DiffAhead {
+		t.Errorf("unexpected diffs %v", kinds)
+	}
+
+	// mutations made after the streams have started are not checked
+	producer.AddMutation(0, "doc100", nil)
+	if Get(t.Name()) != job {
+		t.Errorf("expected job to be kept")
+	}
+}
+
+func TestVerifyTargetErrors(t *testing.T) {
+	producer, server := startTestClusters(t)
+	defer producer.Close()
+	defer server.Close()
+
+	for i := 0; i < 10; i++ {
+		addTestDoc(producer, server, 0, fmt.Sprintf("doc%v", i), 5)
+	}
+	server.AddFault(fake_memcached.Fault{Status: mc.TMPFAIL})
+
+	maxDiffEntries := MaxDiffEntries
+	MaxDiffEntries = 4
+	defer func() { MaxDiffEntries = maxDiffEntries }()
+
+	job, err := Start(newTestConfig(t.Name(), producer, server, metadata.DefaultSettings()))
+	if err != nil {
+		t.Fatalf("failed to start verification. err=%v", err)
+	}
+	defer Remove(t.Name())
+
+	progress := waitForJob(t, job)
+	if progress.State != StateCompleted || progress.Errors != 10 || progress.DroppedDiffs != 6 {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+	diffs := job.Diffs()
+	if len(diffs) != 4 || diffs[0].Kind != DiffError || diffs[0].Error == "" {
+		t.Errorf("unexpected diffs %v", diffs)
+	}
+}
+
+func TestVerifyRateLimitAndCancel(t *testing.T) {
+	producer, server := startTestClusters(t)
+	defer producer.Close()
+	defer server.Close()
+
+	for i := 0; i < 10; i++ {
+		addTestDoc(producer, server, 0, fmt.Sprintf("doc%v", i), 5)
+	}
+
+	config := newTestConfig(t.Name(), producer, server, metadata.DefaultSettings())
+	config.RateLimit = 2
+	job, err := Start(config)
+	if err != nil {
+		t.Fatalf("failed to start verification. err=%v", err)
+	}
+	defer Remove(t.Name())
+	if _, err = Start(config); err != ErrorAlreadyRunning {
+		t.Errorf("expected second job to be rejected, got %v", err)
+	}
+
+	time.Sleep(1200 * time.Millisecond)
+	if err = Cancel(t.Name()); err != nil {
+		t.Fatalf("failed to cancel verification. err=%v", err)
+	}
+	progress := waitForJob(t, job)
+	// the first two keys are checked right away, and two more each second
+	if progress.State != StateCancelled || progress.Checked != 4 {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+
+	if Cancel("unknown") != ErrorNotFound {
+		t.Errorf("expected cancelling unknown job to fail")
+	}
+}
+
+func TestVerifyMismatchedVBCount(t *testing.T) {
+	producer, server := startTestClusters(t)
+	defer producer.Close()
+	defer server.Close()
+
+	// source has 4 vbuckets while target has 2. docs are in the vbuckets that their keys belong to on target
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("doc%v", i)
+		seqno := producer.AddEvent(uint16(2+i%2), fake_memcached.Event{Opcode: mc.UPR_MUTATION, Key: []byte(key), RevSeq: 5})
+		server.SetDocument(key_rewrite.VBucketForKey([]byte(key), 2), fake_memcached.Document{Key: []byte(key), RevSeq: 5, Cas: seqno})
+	}
+
+	config := newTestConfig(t.Name(), producer, server, metadata.DefaultSettings())
+	config.VBuckets = []uint16{2, 3}
+	config.NumSourceVBs = 4
+	job, err := Start(config)
+	if err != nil {
+		t.Fatalf("failed to start verification. err=%v", err)
+	}
+	defer Remove(t.Name())
+
+	progress := waitForJob(t, job)
+	if progress.State != StateCompleted || progress.Checked != 10 || progress.Consistent != 10 {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+}
+
+func TestVerifyStartSeqnos(t *testing.T) {
+	producer, server := startTestClusters(t)
+	defer producer.Close()
+	defer server.Close()
+
+	// docs before the start of the replication were never replicated
+	for i := 0; i < 4; i++ {
+		addTestDoc(producer, server, 0, fmt.Sprintf("old%v", i), 0)
+	}
+	startSeqno := producer.HighSeqno(0)
+	for i := 0; i < 3; i++ {
+		addTestDoc(producer, server, 0, fmt.Sprintf("doc%v", i), 5)
+	}
+	addTestDoc(producer, server, 1, "doc3", 5)
+
+	config := newTestConfig(t.Name(), producer, server, metadata.DefaultSettings())
+	config.StartSeqnos = map[uint16]uint64{0: startSeqno}
+	job, err := Start(config)
+	if err != nil {
+		t.Fatalf("failed to start verification. err=%v", err)
+	}
+	defer Remove(t.Name())
+
+	progress := waitForJob(t, job)
+	if progress.State != StateCompleted || progress.Checked != 4 || progress.Consistent != 4 || progress.Filtered != 4 {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+}